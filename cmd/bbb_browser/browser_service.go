@@ -19,10 +19,16 @@ import (
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	historypb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/testresult"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/buildkite/terminal"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/gorilla/mux"
 
 	"google.golang.org/grpc/codes"
@@ -46,28 +52,57 @@ func getDigestFromRequest(req *http.Request) (*util.Digest, error) {
 // BrowserService implements a web service that can be used to explore
 // data stored in the Content Addressable Storage and Action Cache. It
 // can show the details of actions and download their input and output
-// files.
+// files. Recently executed actions and cache hits can be searched for
+// through the action indices of schedulers and frontends. If an
+// execution history store is provided, the outcomes of recent
+// executions of actions are shown as well, so that flaky actions can be
+// identified. Results of actions that may not be stored in the Action
+// Cache are read from the uncached action result store, if provided.
 type BrowserService struct {
 	contentAddressableStorage           cas.ContentAddressableStorage
 	contentAddressableStorageBlobAccess blobstore.BlobAccess
 	actionCache                         ac.ActionCache
+	uncachedActionResultStore           ac.UncachedActionResultStore
+	actionIndices                       []ActionIndexSource
+	executionHistoryStore               history.ExecutionHistoryStore
 	templates                           *template.Template
 }
 
+// ActionIndexSource is an action index that may be searched by the
+// browser. Instance is the name of the instance whose entries are
+// stored in the index, or the empty string if the index may contain
+// entries for any instance.
+type ActionIndexSource struct {
+	Instance string
+	Client   actionindex.ActionIndexClient
+}
+
 // NewBrowserService constructs a BrowserService that accesses storage
 // through a set of handles.
-func NewBrowserService(contentAddressableStorage cas.ContentAddressableStorage, contentAddressableStorageBlobAccess blobstore.BlobAccess, actionCache ac.ActionCache, templates *template.Template, router *mux.Router) *BrowserService {
+func NewBrowserService(contentAddressableStorage cas.ContentAddressableStorage, contentAddressableStorageBlobAccess blobstore.BlobAccess, actionCache ac.ActionCache, uncachedActionResultStore ac.UncachedActionResultStore, actionIndices []ActionIndexSource, executionHistoryStore history.ExecutionHistoryStore, templates *template.Template, router *mux.Router) *BrowserService {
 	s := &BrowserService{
 		contentAddressableStorage:           contentAddressableStorage,
 		contentAddressableStorageBlobAccess: contentAddressableStorageBlobAccess,
 		actionCache:                         actionCache,
+		uncachedActionResultStore:           uncachedActionResultStore,
+		actionIndices:                       actionIndices,
+		executionHistoryStore:               executionHistoryStore,
 		templates:                           templates,
 	}
+	router.Handle("/", http.RedirectHandler("/search", http.StatusFound))
+	router.HandleFunc("/search", s.handleSearch)
 	router.HandleFunc("/action/{instance}/{hash}/{sizeBytes}/", s.handleAction)
 	router.HandleFunc("/actionfailure/{instance}/{hash}/{sizeBytes}/", s.handleActionFailure)
+	router.HandleFunc("/uncachedactionresult/{instance}/{hash}/{sizeBytes}/", s.handleUncachedActionResult)
 	router.HandleFunc("/command/{instance}/{hash}/{sizeBytes}/", s.handleCommand)
+	router.HandleFunc("/diff", s.handleDiff)
 	router.HandleFunc("/directory/{instance}/{hash}/{sizeBytes}/", s.handleDirectory)
+	router.HandleFunc("/invocation/{invocation}", s.handleInvocation)
+	router.HandleFunc("/log/{instance}/{hash}/{sizeBytes}/", s.handleLog)
 	router.HandleFunc("/file/{instance}/{hash}/{sizeBytes}/{name}", s.handleFile)
+	router.HandleFunc("/fileview/{instance}/{hash}/{sizeBytes}/{name}", s.handleFileView)
+	router.HandleFunc("/inputroot/{instance}/{hash}/{sizeBytes}/", s.handleInputRoot)
+	router.HandleFunc("/reproduce/{instance}/{hash}/{sizeBytes}/", s.handleReproduce)
 	router.HandleFunc("/tree/{instance}/{hash}/{sizeBytes}/{subdirectory:(?:.*/)?}", s.handleTree)
 	return s
 }
@@ -77,13 +112,18 @@ type directoryInfo struct {
 	Directory *remoteexecution.Directory
 }
 
+// maximumInlineLogSizeBytes is the maximum number of bytes of a log
+// file that is shown on the action page. The full log file can be
+// viewed on a separate page.
+const maximumInlineLogSizeBytes = 100000
+
 type logInfo struct {
-	Name     string
-	Instance string
-	Digest   *remoteexecution.Digest
-	TooLarge bool
-	NotFound bool
-	HTML     template.HTML
+	Name      string
+	Instance  string
+	Digest    *remoteexecution.Digest
+	Truncated bool
+	NotFound  bool
+	HTML      template.HTML
 }
 
 func (s *BrowserService) handleAction(w http.ResponseWriter, req *http.Request) {
@@ -123,6 +163,30 @@ func (s *BrowserService) handleActionFailure(w http.ResponseWriter, req *http.Re
 	s.handleActionCommon(w, req, actionDigest, actionFailure.ActionResult)
 }
 
+func (s *BrowserService) handleUncachedActionResult(w http.ResponseWriter, req *http.Request) {
+	if s.uncachedActionResultStore == nil {
+		http.Error(w, "No uncached action result storage configured", http.StatusNotFound)
+		return
+	}
+	digest, err := getDigestFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	uncachedActionResult, err := s.uncachedActionResultStore.GetUncachedActionResult(ctx, digest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actionDigest, err := digest.NewDerivedDigest(uncachedActionResult.ActionDigest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.handleActionCommon(w, req, actionDigest, uncachedActionResult.ActionResult)
+}
+
 func (s *BrowserService) getLogInfo(ctx context.Context, name string, instance string, logDigest *remoteexecution.Digest) (*logInfo, error) {
 	if logDigest == nil {
 		return nil, nil
@@ -131,32 +195,28 @@ func (s *BrowserService) getLogInfo(ctx context.Context, name string, instance s
 	if err != nil {
 		return nil, err
 	}
-	if size := digest.GetSizeBytes(); size == 0 {
+	size := digest.GetSizeBytes()
+	if size == 0 {
 		// No log file present.
 		return nil, nil
-	} else if size > 100000 {
-		// Log file too large to show inline.
-		return &logInfo{
-			Name:     name,
-			Instance: instance,
-			Digest:   logDigest,
-			TooLarge: true,
-		}, nil
 	}
 
+	// Only load the first part of log files that are too large
+	// to show inline.
 	_, r, err := s.contentAddressableStorageBlobAccess.Get(ctx, digest)
 	if err != nil {
 		return nil, err
 	}
-	data, err := ioutil.ReadAll(r)
+	data, err := ioutil.ReadAll(io.LimitReader(r, maximumInlineLogSizeBytes))
 	r.Close()
 	if err == nil {
 		// Log found. Convert ANSI escape sequences to HTML.
 		return &logInfo{
-			Name:     name,
-			Instance: instance,
-			Digest:   logDigest,
-			HTML:     template.HTML(terminal.Render(data)),
+			Name:      name,
+			Instance:  instance,
+			Digest:    logDigest,
+			Truncated: size > maximumInlineLogSizeBytes,
+			HTML:      template.HTML(terminal.Render(data)),
 		}, nil
 	} else if status.Code(err) == codes.NotFound {
 		// Not found.
@@ -175,13 +235,16 @@ func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Req
 	instance := digest.GetInstance()
 	actionInfo := struct {
 		Instance string
+		Digest   *util.Digest
 		Action   *remoteexecution.Action
 
 		Command *remoteexecution.Command
 
-		ActionResult *remoteexecution.ActionResult
-		StdoutInfo   *logInfo
-		StderrInfo   *logInfo
+		ActionResult  *remoteexecution.ActionResult
+		StdoutInfo    *logInfo
+		StderrInfo    *logInfo
+		ResourceUsage *resourceusage.POSIXResourceUsage
+		TestResult    *testresult.TestResultSummary
 
 		InputRoot *directoryInfo
 
@@ -190,17 +253,32 @@ func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Req
 		OutputFiles        []*remoteexecution.OutputFile
 		MissingDirectories []string
 		MissingFiles       []string
+
+		ExecutionHistory         *historypb.ExecutionHistory
+		ExecutionHistoryAnalysis history.Analysis
 	}{
 		Instance:     instance,
+		Digest:       digest,
 		ActionResult: actionResult,
 	}
 
 	ctx := req.Context()
 	if actionResult != nil {
 		actionInfo.OutputDirectories = actionResult.OutputDirectories
-		actionInfo.OutputSymlinks = actionResult.OutputFileSymlinks
+		actionInfo.OutputSymlinks = append(append([]*remoteexecution.OutputSymlink{}, actionResult.OutputFileSymlinks...), actionResult.OutputSymlinks...)
 		actionInfo.OutputFiles = actionResult.OutputFiles
 
+		for _, auxiliaryMetadata := range actionResult.ExecutionMetadata.GetAuxiliaryMetadata() {
+			var resourceUsage resourceusage.POSIXResourceUsage
+			if ptypes.UnmarshalAny(auxiliaryMetadata, &resourceUsage) == nil {
+				actionInfo.ResourceUsage = &resourceUsage
+			}
+			var testResult testresult.TestResultSummary
+			if ptypes.UnmarshalAny(auxiliaryMetadata, &testResult) == nil {
+				actionInfo.TestResult = &testResult
+			}
+		}
+
 		// TODO(edsch): Should we support Std{out,err}Raw as well? Buildbarn doesn't generate them.
 		var err error
 		actionInfo.StdoutInfo, err = s.getLogInfo(ctx, "Standard output", instance, actionResult.StdoutDigest)
@@ -249,6 +327,15 @@ func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Req
 					actionInfo.MissingFiles = append(actionInfo.MissingFiles, outputFile)
 				}
 			}
+			// Outputs declared through output_paths may either
+			// be files or directories.
+			for _, outputPath := range command.OutputPaths {
+				_, foundFile := foundFiles[outputPath]
+				_, foundDirectory := foundDirectories[outputPath]
+				if !foundFile && !foundDirectory {
+					actionInfo.MissingFiles = append(actionInfo.MissingFiles, outputPath)
+				}
+			}
 		} else if status.Code(err) != codes.NotFound {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -274,6 +361,17 @@ func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Req
 		return
 	}
 
+	if s.executionHistoryStore != nil {
+		executionHistory, err := s.executionHistoryStore.GetExecutionHistory(ctx, digest)
+		if err == nil {
+			actionInfo.ExecutionHistory = executionHistory
+			actionInfo.ExecutionHistoryAnalysis = history.Analyze(executionHistory)
+		} else if status.Code(err) != codes.NotFound {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	if action == nil && actionResult == nil {
 		http.Error(w, "Could not find an action or action result", http.StatusNotFound)
 		return
@@ -284,6 +382,36 @@ func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Req
 	}
 }
 
+func (s *BrowserService) handleLog(w http.ResponseWriter, req *http.Request) {
+	digest, err := getDigestFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	_, r, err := s.contentAddressableStorageBlobAccess.Get(ctx, digest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "page_log.html", &logInfo{
+		Name:     "Log file",
+		Instance: digest.GetInstance(),
+		Digest:   digest.GetPartialDigest(),
+		HTML:     template.HTML(terminal.Render(data)),
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
 func (s *BrowserService) handleCommand(w http.ResponseWriter, req *http.Request) {
 	digest, err := getDigestFromRequest(req)
 	if err != nil {
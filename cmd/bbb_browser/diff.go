@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// diffListCellsMax is the maximum size of the matrix used to
+	// compute the difference between two lists. Larger lists are
+	// shown as being replaced entirely.
+	diffListCellsMax = 10000000
+
+	// diffInputRootChangesMax is the maximum number of changed paths
+	// reported when comparing input roots.
+	diffInputRootChangesMax = 1000
+)
+
+// diffLine is a single entry in the difference between two lists.
+type diffLine struct {
+	Kind string
+	Text string
+}
+
+// diffLists computes the difference between two lists of strings,
+// based on their longest common subsequence.
+func diffLists(a []string, b []string) []diffLine {
+	var lines []diffLine
+	if len(a)*len(b) > diffListCellsMax {
+		for _, s := range a {
+			lines = append(lines, diffLine{Kind: "removed", Text: s})
+		}
+		for _, s := range b {
+			lines = append(lines, diffLine{Kind: "added", Text: s})
+		}
+		return lines
+	}
+
+	// lcs[i][j] holds the length of the longest common subsequence
+	// of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			lines = append(lines, diffLine{Kind: "equal", Text: a[i]})
+			i++
+			j++
+		} else if j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]) {
+			lines = append(lines, diffLine{Kind: "removed", Text: a[i]})
+			i++
+		} else {
+			lines = append(lines, diffLine{Kind: "added", Text: b[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// diffEntry is a single entry in the difference between two maps.
+type diffEntry struct {
+	Kind     string
+	Name     string
+	OldValue string
+	NewValue string
+}
+
+// diffMaps computes the difference between two maps, returning all
+// keys in sorted order.
+func diffMaps(a map[string]string, b map[string]string) []diffEntry {
+	var names []string
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	entries := make([]diffEntry, 0, len(names))
+	for _, name := range names {
+		oldValue, inA := a[name]
+		newValue, inB := b[name]
+		entry := diffEntry{Name: name, OldValue: oldValue, NewValue: newValue}
+		if !inA {
+			entry.Kind = "added"
+		} else if !inB {
+			entry.Kind = "removed"
+		} else if oldValue != newValue {
+			entry.Kind = "changed"
+		} else {
+			entry.Kind = "equal"
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func getEnvironmentVariables(command *remoteexecution.Command) map[string]string {
+	m := map[string]string{}
+	for _, environmentVariable := range command.GetEnvironmentVariables() {
+		m[environmentVariable.Name] = environmentVariable.Value
+	}
+	return m
+}
+
+func getPlatformProperties(command *remoteexecution.Command) map[string]string {
+	// Platform properties may have multiple values.
+	values := map[string][]string{}
+	for _, property := range command.GetPlatform().GetProperties() {
+		values[property.Name] = append(values[property.Name], property.Value)
+	}
+	m := map[string]string{}
+	for name, v := range values {
+		m[name] = strings.Join(v, ", ")
+	}
+	return m
+}
+
+func getActionProperties(action *remoteexecution.Action, command *remoteexecution.Command) map[string]string {
+	m := map[string]string{}
+	if action != nil {
+		m["Command digest"] = fmt.Sprintf("%s/%d", action.GetCommandDigest().GetHash(), action.GetCommandDigest().GetSizeBytes())
+		m["Input root digest"] = fmt.Sprintf("%s/%d", action.GetInputRootDigest().GetHash(), action.GetInputRootDigest().GetSizeBytes())
+		m["Do not cache"] = strconv.FormatBool(action.DoNotCache)
+		if action.Timeout != nil {
+			m["Timeout"] = fmt.Sprintf("%d seconds", action.Timeout.Seconds)
+		} else {
+			m["Timeout"] = "∞"
+		}
+	}
+	if command != nil {
+		m["Working directory"] = command.WorkingDirectory
+		m["Output files"] = strings.Join(command.OutputFiles, " ")
+		m["Output directories"] = strings.Join(command.OutputDirectories, " ")
+		m["Output paths"] = strings.Join(command.OutputPaths, " ")
+	}
+	return m
+}
+
+// pathChange describes a path that differs between two input roots.
+type pathChange struct {
+	Kind     string
+	Path     string
+	OldValue string
+	NewValue string
+}
+
+type directoryEntry struct {
+	kind        string
+	description string
+	digest      *remoteexecution.Digest
+}
+
+func getDirectoryEntries(directory *remoteexecution.Directory) map[string]directoryEntry {
+	entries := map[string]directoryEntry{}
+	for _, directoryNode := range directory.GetDirectories() {
+		entries[directoryNode.Name] = directoryEntry{
+			kind:        "directory",
+			description: "directory",
+			digest:      directoryNode.Digest,
+		}
+	}
+	for _, fileNode := range directory.GetFiles() {
+		description := fmt.Sprintf("file %s/%d", fileNode.Digest.GetHash(), fileNode.Digest.GetSizeBytes())
+		if fileNode.IsExecutable {
+			description += " (executable)"
+		}
+		entries[fileNode.Name] = directoryEntry{
+			kind:        "file",
+			description: description,
+			digest:      fileNode.Digest,
+		}
+	}
+	for _, symlinkNode := range directory.GetSymlinks() {
+		entries[symlinkNode.Name] = directoryEntry{
+			kind:        "symlink",
+			description: "symlink to " + symlinkNode.Target,
+		}
+	}
+	return entries
+}
+
+// inputRootDiffer computes the paths that differ between two input
+// roots. Subdirectories with identical digests are skipped, meaning
+// that only the parts of the trees that differ are loaded.
+type inputRootDiffer struct {
+	getDirectoryFunc func(ctx context.Context, digest *util.Digest) (*remoteexecution.Directory, error)
+	changes          []pathChange
+	truncated        bool
+}
+
+func (d *inputRootDiffer) getDirectory(ctx context.Context, digest *util.Digest) (*remoteexecution.Directory, error) {
+	directory, err := d.getDirectoryFunc(ctx, digest)
+	if status.Code(err) == codes.NotFound {
+		// Treat missing directories as being empty.
+		return &remoteexecution.Directory{}, nil
+	}
+	return directory, err
+}
+
+func (d *inputRootDiffer) addChange(change pathChange) {
+	if len(d.changes) >= diffInputRootChangesMax {
+		d.truncated = true
+		return
+	}
+	d.changes = append(d.changes, change)
+}
+
+func (d *inputRootDiffer) diffDirectories(ctx context.Context, directoryPath string, digestA *util.Digest, digestB *util.Digest) error {
+	if d.truncated {
+		return nil
+	}
+	var entriesA, entriesB map[string]directoryEntry
+	if digestA != nil {
+		directory, err := d.getDirectory(ctx, digestA)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to obtain directory %#v", directoryPath)
+		}
+		entriesA = getDirectoryEntries(directory)
+	}
+	if digestB != nil {
+		directory, err := d.getDirectory(ctx, digestB)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to obtain directory %#v", directoryPath)
+		}
+		entriesB = getDirectoryEntries(directory)
+	}
+
+	var names []string
+	for name := range entriesA {
+		names = append(names, name)
+	}
+	for name := range entriesB {
+		if _, ok := entriesA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childPath := directoryPath + name
+		entryA, inA := entriesA[name]
+		entryB, inB := entriesB[name]
+
+		// Traverse into directories that are added, removed or
+		// modified, so that all files in them are listed.
+		var childDigestA, childDigestB *util.Digest
+		if inA && entryA.kind == "directory" {
+			var err error
+			if childDigestA, err = digestA.NewDerivedDigest(entryA.digest); err != nil {
+				return err
+			}
+		}
+		if inB && entryB.kind == "directory" {
+			var err error
+			if childDigestB, err = digestB.NewDerivedDigest(entryB.digest); err != nil {
+				return err
+			}
+		}
+		if childDigestA != nil && childDigestB != nil {
+			if !proto.Equal(entryA.digest, entryB.digest) {
+				if err := d.diffDirectories(ctx, childPath+"/", childDigestA, childDigestB); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if inA && inB {
+			if entryA.description != entryB.description {
+				d.addChange(pathChange{Kind: "changed", Path: childPath, OldValue: entryA.description, NewValue: entryB.description})
+			}
+		} else if inA {
+			if childDigestA == nil {
+				d.addChange(pathChange{Kind: "removed", Path: childPath, OldValue: entryA.description})
+			}
+		} else {
+			if childDigestB == nil {
+				d.addChange(pathChange{Kind: "added", Path: childPath, NewValue: entryB.description})
+			}
+		}
+		if childDigestA != nil || childDigestB != nil {
+			if err := d.diffDirectories(ctx, childPath+"/", childDigestA, childDigestB); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseDiffDigest(instance string, value string) (*util.Digest, error) {
+	components := strings.SplitN(value, "/", 2)
+	if len(components) != 2 {
+		return nil, status.Errorf(codes.InvalidArgument, "Digest %#v is not of the form hash/size", value)
+	}
+	sizeBytes, err := strconv.ParseInt(components[1], 10, 64)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid size in digest %#v", value)
+	}
+	return util.NewDigest(instance, &remoteexecution.Digest{
+		Hash:      components[0],
+		SizeBytes: sizeBytes,
+	})
+}
+
+// getActionAndCommand loads an action and its command. Either of them
+// may be nil if absent from the Content Addressable Storage.
+func (s *BrowserService) getActionAndCommand(ctx context.Context, digest *util.Digest) (*remoteexecution.Action, *remoteexecution.Command, error) {
+	action, err := s.contentAddressableStorage.GetAction(ctx, digest)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	commandDigest, err := digest.NewDerivedDigest(action.CommandDigest)
+	if err != nil {
+		return nil, nil, err
+	}
+	command, err := s.contentAddressableStorage.GetCommand(ctx, commandDigest)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return action, nil, nil
+		}
+		return nil, nil, err
+	}
+	return action, command, nil
+}
+
+func (s *BrowserService) handleDiff(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	diffInfo := struct {
+		Instance string
+		A        string
+		B        string
+		Compared bool
+
+		ActionAFound  bool
+		ActionBFound  bool
+		CommandAFound bool
+		CommandBFound bool
+
+		ActionProperties     []diffEntry
+		Arguments            []diffLine
+		EnvironmentVariables []diffEntry
+		PlatformProperties   []diffEntry
+		InputRootChanges     []pathChange
+		InputRootTruncated   bool
+	}{
+		Instance: query.Get("instance"),
+		A:        query.Get("a"),
+		B:        query.Get("b"),
+	}
+
+	if diffInfo.A != "" && diffInfo.B != "" {
+		digestA, err := parseDiffDigest(diffInfo.Instance, diffInfo.A)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		digestB, err := parseDiffDigest(diffInfo.Instance, diffInfo.B)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx := req.Context()
+		actionA, commandA, err := s.getActionAndCommand(ctx, digestA)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		actionB, commandB, err := s.getActionAndCommand(ctx, digestB)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		diffInfo.Compared = true
+		diffInfo.ActionAFound = actionA != nil
+		diffInfo.ActionBFound = actionB != nil
+		diffInfo.CommandAFound = commandA != nil
+		diffInfo.CommandBFound = commandB != nil
+
+		diffInfo.ActionProperties = diffMaps(getActionProperties(actionA, commandA), getActionProperties(actionB, commandB))
+		diffInfo.Arguments = diffLists(commandA.GetArguments(), commandB.GetArguments())
+		diffInfo.EnvironmentVariables = diffMaps(getEnvironmentVariables(commandA), getEnvironmentVariables(commandB))
+		diffInfo.PlatformProperties = diffMaps(getPlatformProperties(commandA), getPlatformProperties(commandB))
+
+		if actionA != nil && actionB != nil {
+			inputRootA, err := digestA.NewDerivedDigest(actionA.InputRootDigest)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			inputRootB, err := digestB.NewDerivedDigest(actionB.InputRootDigest)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			differ := inputRootDiffer{
+				getDirectoryFunc: s.contentAddressableStorage.GetDirectory,
+			}
+			if !proto.Equal(actionA.InputRootDigest, actionB.InputRootDigest) {
+				if err := differ.diffDirectories(ctx, "", inputRootA, inputRootB); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			diffInfo.InputRootChanges = differ.changes
+			diffInfo.InputRootTruncated = differ.truncated
+		}
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "page_diff.html", &diffInfo); err != nil {
+		log.Print(err)
+	}
+}
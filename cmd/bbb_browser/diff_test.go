@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDiffLists(t *testing.T) {
+	require.Equal(t, []diffLine{
+		{Kind: "equal", Text: "cc"},
+		{Kind: "removed", Text: "-O0"},
+		{Kind: "added", Text: "-O2"},
+		{Kind: "equal", Text: "-c"},
+		{Kind: "equal", Text: "hello.c"},
+		{Kind: "added", Text: "-Wall"},
+	}, diffLists(
+		[]string{"cc", "-O0", "-c", "hello.c"},
+		[]string{"cc", "-O2", "-c", "hello.c", "-Wall"}))
+
+	require.Nil(t, diffLists(nil, nil))
+	require.Equal(t, []diffLine{
+		{Kind: "added", Text: "cc"},
+	}, diffLists(nil, []string{"cc"}))
+}
+
+func TestDiffMaps(t *testing.T) {
+	require.Equal(t, []diffEntry{
+		{Kind: "removed", Name: "HOME", OldValue: "/root"},
+		{Kind: "added", Name: "LANG", NewValue: "C"},
+		{Kind: "changed", Name: "PATH", OldValue: "/bin", NewValue: "/bin:/usr/bin"},
+		{Kind: "equal", Name: "TZ", OldValue: "UTC", NewValue: "UTC"},
+	}, diffMaps(
+		map[string]string{"HOME": "/root", "PATH": "/bin", "TZ": "UTC"},
+		map[string]string{"LANG": "C", "PATH": "/bin:/usr/bin", "TZ": "UTC"}))
+}
+
+func TestGetPlatformProperties(t *testing.T) {
+	require.Equal(t, map[string]string{
+		"OSFamily":  "Linux",
+		"container": "debian8, ubuntu16-04",
+	}, getPlatformProperties(&remoteexecution.Command{
+		Platform: &remoteexecution.Platform{
+			Properties: []*remoteexecution.Platform_Property{
+				{Name: "OSFamily", Value: "Linux"},
+				{Name: "container", Value: "debian8"},
+				{Name: "container", Value: "ubuntu16-04"},
+			},
+		},
+	}))
+	require.Empty(t, getPlatformProperties(nil))
+}
+
+func TestParseDiffDigest(t *testing.T) {
+	digest, err := parseDiffDigest("debian8", "8b1a9953c4611296a827abf8c47804d7/5")
+	require.NoError(t, err)
+	require.Equal(t, util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	}), digest)
+
+	_, err = parseDiffDigest("debian8", "8b1a9953c4611296a827abf8c47804d7")
+	require.Equal(t, status.Error(codes.InvalidArgument, "Digest \"8b1a9953c4611296a827abf8c47804d7\" is not of the form hash/size"), err)
+
+	_, err = parseDiffDigest("debian8", "8b1a9953c4611296a827abf8c47804d7/five")
+	require.Equal(t, status.Error(codes.InvalidArgument, "Invalid size in digest \"8b1a9953c4611296a827abf8c47804d7/five\""), err)
+}
+
+func TestInputRootDiffer(t *testing.T) {
+	ctx := context.Background()
+
+	getDigest := func(i int) *remoteexecution.Digest {
+		return &remoteexecution.Digest{
+			Hash:      fmt.Sprintf("%032x", i),
+			SizeBytes: int64(i),
+		}
+	}
+	directories := map[string]*remoteexecution.Directory{
+		// Input root A.
+		getDigest(1).Hash: {
+			Directories: []*remoteexecution.DirectoryNode{
+				{Name: "old", Digest: getDigest(3)},
+				{Name: "src", Digest: getDigest(4)},
+				{Name: "third_party", Digest: getDigest(6)},
+			},
+			Files: []*remoteexecution.FileNode{
+				{Name: "a.txt", Digest: getDigest(10)},
+			},
+			Symlinks: []*remoteexecution.SymlinkNode{
+				{Name: "l", Target: "a.txt"},
+			},
+		},
+		// Input root B.
+		getDigest(2).Hash: {
+			Directories: []*remoteexecution.DirectoryNode{
+				{Name: "src", Digest: getDigest(5)},
+				{Name: "third_party", Digest: getDigest(6)},
+			},
+			Files: []*remoteexecution.FileNode{
+				{Name: "a.txt", Digest: getDigest(11), IsExecutable: true},
+				{Name: "new.txt", Digest: getDigest(12)},
+			},
+		},
+		getDigest(3).Hash: {
+			Files: []*remoteexecution.FileNode{
+				{Name: "gone.c", Digest: getDigest(13)},
+			},
+		},
+		getDigest(4).Hash: {
+			Files: []*remoteexecution.FileNode{
+				{Name: "main.c", Digest: getDigest(14)},
+			},
+		},
+		getDigest(5).Hash: {
+			Files: []*remoteexecution.FileNode{
+				{Name: "main.c", Digest: getDigest(14)},
+				{Name: "util.c", Digest: getDigest(15)},
+			},
+		},
+	}
+	var loaded []string
+	differ := inputRootDiffer{
+		getDirectoryFunc: func(ctx context.Context, digest *util.Digest) (*remoteexecution.Directory, error) {
+			hash := digest.GetHashString()
+			loaded = append(loaded, hash)
+			if directory, ok := directories[hash]; ok {
+				return directory, nil
+			}
+			return nil, status.Error(codes.NotFound, "Blob not found")
+		},
+	}
+
+	// Identical subdirectories should not be loaded, while the
+	// contents of removed directories should be listed.
+	require.NoError(t, differ.diffDirectories(
+		ctx,
+		"",
+		util.MustNewDigest("debian8", getDigest(1)),
+		util.MustNewDigest("debian8", getDigest(2))))
+	require.Equal(t, []pathChange{
+		{Kind: "changed", Path: "a.txt", OldValue: "file 0000000000000000000000000000000a/10", NewValue: "file 0000000000000000000000000000000b/11 (executable)"},
+		{Kind: "removed", Path: "l", OldValue: "symlink to a.txt"},
+		{Kind: "added", Path: "new.txt", NewValue: "file 0000000000000000000000000000000c/12"},
+		{Kind: "removed", Path: "old/gone.c", OldValue: "file 0000000000000000000000000000000d/13"},
+		{Kind: "added", Path: "src/util.c", NewValue: "file 0000000000000000000000000000000f/15"},
+	}, differ.changes)
+	require.False(t, differ.truncated)
+	require.NotContains(t, loaded, getDigest(6).Hash)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// inputRootDirectoriesMax is the maximum number of directories
+	// that are loaded when displaying an input root.
+	inputRootDirectoriesMax = 10000
+
+	// filePreviewSizeMax is the maximum number of bytes of a file
+	// that are displayed on its preview page.
+	filePreviewSizeMax = 1 << 20
+
+	// fileHexDumpSizeMax is the maximum number of bytes of a binary
+	// file that are displayed as a hex dump.
+	fileHexDumpSizeMax = 4096
+)
+
+type inputRootFile struct {
+	Node    *remoteexecution.FileNode
+	Missing bool
+}
+
+type inputRootDirectory struct {
+	Instance    string
+	Name        string
+	Path        string
+	Digest      *remoteexecution.Digest
+	Missing     bool
+	Truncated   bool
+	Directories []*inputRootDirectory
+	Symlinks    []*remoteexecution.SymlinkNode
+	Files       []*inputRootFile
+}
+
+// getInputRootDirectory loads a directory and all of its children
+// recursively. Directories and files that are absent from the Content
+// Addressable Storage are marked as missing, instead of causing an
+// error, as displaying them is useful for debugging.
+func (s *BrowserService) getInputRootDirectory(ctx context.Context, digest *util.Digest, name string, directoryPath string, directoriesRemaining *int, files map[string][]*inputRootFile) (*inputRootDirectory, error) {
+	d := &inputRootDirectory{
+		Instance: digest.GetInstance(),
+		Name:     name,
+		Path:     directoryPath,
+		Digest:   digest.GetPartialDigest(),
+	}
+	if *directoriesRemaining <= 0 {
+		d.Truncated = true
+		return d, nil
+	}
+	*directoriesRemaining--
+
+	directory, err := s.contentAddressableStorage.GetDirectory(ctx, digest)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			d.Missing = true
+			return d, nil
+		}
+		return nil, err
+	}
+
+	for _, directoryNode := range directory.Directories {
+		childDigest, err := digest.NewDerivedDigest(directoryNode.Digest)
+		if err != nil {
+			return nil, err
+		}
+		child, err := s.getInputRootDirectory(ctx, childDigest, directoryNode.Name, directoryPath+directoryNode.Name+"/", directoriesRemaining, files)
+		if err != nil {
+			return nil, err
+		}
+		d.Directories = append(d.Directories, child)
+	}
+	d.Symlinks = directory.Symlinks
+	for _, fileNode := range directory.Files {
+		childDigest, err := digest.NewDerivedDigest(fileNode.Digest)
+		if err != nil {
+			return nil, err
+		}
+		file := &inputRootFile{Node: fileNode}
+		d.Files = append(d.Files, file)
+		key := childDigest.GetKey(util.DigestKeyWithInstance)
+		files[key] = append(files[key], file)
+	}
+	return d, nil
+}
+
+func (s *BrowserService) handleInputRoot(w http.ResponseWriter, req *http.Request) {
+	digest, err := getDigestFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	directoriesRemaining := inputRootDirectoriesMax
+	files := map[string][]*inputRootFile{}
+	root, err := s.getInputRootDirectory(ctx, digest, "", "", &directoriesRemaining, files)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Mark files that are absent from the Content Addressable
+	// Storage, as these are a common cause of build failures.
+	var fileDigests []*util.Digest
+	for _, fileList := range files {
+		fileDigest, err := digest.NewDerivedDigest(fileList[0].Node.Digest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fileDigests = append(fileDigests, fileDigest)
+	}
+	missing, err := s.contentAddressableStorageBlobAccess.FindMissing(ctx, fileDigests)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, missingDigest := range missing {
+		for _, file := range files[missingDigest.GetKey(util.DigestKeyWithInstance)] {
+			file.Missing = true
+		}
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "page_input_root.html", struct {
+		Instance     string
+		Root         *inputRootDirectory
+		MissingCount int
+		Truncated    bool
+	}{
+		Instance:     digest.GetInstance(),
+		Root:         root,
+		MissingCount: len(missing),
+		Truncated:    directoriesRemaining <= 0,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// isBinary returns whether the contents of a file should be treated as
+// binary data, as opposed to text. When the data is truncated, a
+// partial UTF-8 sequence at the end is permitted.
+func isBinary(data []byte, truncated bool) bool {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	if truncated {
+		for i := 0; i < utf8.UTFMax-1 && len(data) > 0; i++ {
+			if r, size := utf8.DecodeLastRune(data); r != utf8.RuneError || size > 1 {
+				break
+			}
+			data = data[:len(data)-1]
+		}
+	}
+	return !utf8.Valid(data)
+}
+
+// highlightSource converts source code to HTML with syntax
+// highlighting, using the filename to determine the language.
+func highlightSource(name string, source string) (template.HTML, error) {
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		lexer = lexers.Analyse(source)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, source)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := html.New(html.WithLineNumbers()).Format(&b, styles.Get("github"), iterator); err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
+
+func (s *BrowserService) handleFileView(w http.ResponseWriter, req *http.Request) {
+	digest, err := getDigestFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(req)["name"]
+
+	// Only read the start of the file, so that large files can be
+	// previewed without loading them into memory entirely.
+	ctx := req.Context()
+	_, r, err := s.contentAddressableStorageBlobAccess.Get(ctx, digest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, filePreviewSizeMax))
+	r.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileInfo := struct {
+		Instance  string
+		Digest    *remoteexecution.Digest
+		Name      string
+		Truncated bool
+		Binary    bool
+		HexDump   string
+		HTML      template.HTML
+	}{
+		Instance:  digest.GetInstance(),
+		Digest:    digest.GetPartialDigest(),
+		Name:      name,
+		Truncated: int64(len(data)) < digest.GetSizeBytes(),
+	}
+	fileInfo.Binary = isBinary(data, fileInfo.Truncated)
+	if fileInfo.Binary {
+		if len(data) > fileHexDumpSizeMax {
+			data = data[:fileHexDumpSizeMax]
+		}
+		fileInfo.HexDump = hex.Dump(data)
+	} else {
+		fileInfo.HTML, err = highlightSource(name, string(data))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "page_file.html", &fileInfo); err != nil {
+		log.Print(err)
+	}
+}
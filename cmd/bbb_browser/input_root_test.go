@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetInputRootDirectory(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	s := &BrowserService{
+		contentAddressableStorage: contentAddressableStorage,
+	}
+
+	rootDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "c4d0d6a4a5e3d3d8f4b8d57a3fb0cb4c",
+		SizeBytes: 100,
+	})
+	childDigest := &remoteexecution.Digest{
+		Hash:      "0e1d4e4c7ffbd3d5bd9e6d0f2f66dde3",
+		SizeBytes: 50,
+	}
+	fileDigest := &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	}
+	root := &remoteexecution.Directory{
+		Directories: []*remoteexecution.DirectoryNode{
+			{Name: "lib", Digest: childDigest},
+		},
+		Files: []*remoteexecution.FileNode{
+			{Name: "hello.c", Digest: fileDigest},
+			{Name: "hello2.c", Digest: fileDigest},
+		},
+	}
+
+	t.Run("MissingChild", func(t *testing.T) {
+		// Directories that are absent should be marked as
+		// missing, as opposed to causing a failure. Files with
+		// the same digest should be grouped together.
+		contentAddressableStorage.EXPECT().GetDirectory(ctx, rootDigest).Return(root, nil)
+		contentAddressableStorage.EXPECT().GetDirectory(ctx, util.MustNewDigest("debian8", childDigest)).Return(nil, status.Error(codes.NotFound, "Blob not found"))
+
+		directoriesRemaining := 10
+		files := map[string][]*inputRootFile{}
+		d, err := s.getInputRootDirectory(ctx, rootDigest, "", "", &directoriesRemaining, files)
+		require.NoError(t, err)
+		require.Equal(t, 8, directoriesRemaining)
+		require.False(t, d.Missing)
+		require.Len(t, d.Directories, 1)
+		require.Equal(t, "lib", d.Directories[0].Name)
+		require.Equal(t, "lib/", d.Directories[0].Path)
+		require.True(t, d.Directories[0].Missing)
+		require.Len(t, d.Files, 2)
+		require.Equal(t, map[string][]*inputRootFile{
+			util.MustNewDigest("debian8", fileDigest).GetKey(util.DigestKeyWithInstance): d.Files,
+		}, files)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		// Directories beyond the limit should not be loaded.
+		contentAddressableStorage.EXPECT().GetDirectory(ctx, rootDigest).Return(root, nil)
+
+		directoriesRemaining := 1
+		d, err := s.getInputRootDirectory(ctx, rootDigest, "", "", &directoriesRemaining, map[string][]*inputRootFile{})
+		require.NoError(t, err)
+		require.False(t, d.Truncated)
+		require.True(t, d.Directories[0].Truncated)
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		// Errors other than NotFound should be propagated.
+		contentAddressableStorage.EXPECT().GetDirectory(ctx, rootDigest).Return(nil, status.Error(codes.Unavailable, "Server offline"))
+
+		directoriesRemaining := 10
+		_, err := s.getInputRootDirectory(ctx, rootDigest, "", "", &directoriesRemaining, map[string][]*inputRootFile{})
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+}
+
+func TestIsBinary(t *testing.T) {
+	require.False(t, isBinary([]byte("Hello, world\n"), false))
+	require.True(t, isBinary([]byte("ELF\x00\x01"), false))
+	require.True(t, isBinary([]byte{0xff, 0xfe}, false))
+
+	// A multi-byte UTF-8 sequence that is cut off at the end is
+	// only permitted if the data is truncated.
+	euro := []byte("Price: €")
+	require.True(t, isBinary(euro[:len(euro)-1], false))
+	require.False(t, isBinary(euro[:len(euro)-1], true))
+}
+
+func TestHandleFileView(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	contentAddressableStorageBlobAccess := mock.NewMockBlobAccess(ctrl)
+	s := &BrowserService{
+		contentAddressableStorageBlobAccess: contentAddressableStorageBlobAccess,
+		templates: template.Must(template.New("page_file.html").Parse(
+			"{{if .Binary}}binary:{{.HexDump}}{{else}}text{{end}} truncated:{{.Truncated}}")),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/fileview/{instance}/{hash}/{sizeBytes}/{name}", s.handleFileView)
+
+	t.Run("Text", func(t *testing.T) {
+		digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		})
+		contentAddressableStorageBlobAccess.EXPECT().Get(gomock.Any(), digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fileview/debian8/8b1a9953c4611296a827abf8c47804d7/5/hello.txt", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "text truncated:false", w.Body.String())
+	})
+
+	t.Run("BinaryTruncated", func(t *testing.T) {
+		// Binary files should be displayed as a hex dump. Only
+		// part of the file should be shown if it is large.
+		digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 2 * filePreviewSizeMax,
+		})
+		contentAddressableStorageBlobAccess.EXPECT().Get(gomock.Any(), digest).Return(int64(2*filePreviewSizeMax), ioutil.NopCloser(bytes.NewReader(make([]byte, 2*filePreviewSizeMax))), nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fileview/debian8/8b1a9953c4611296a827abf8c47804d7/2097152/a.out", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), "binary:00000000  00 00 00 00")
+		require.Contains(t, w.Body.String(), "truncated:true")
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		})
+		contentAddressableStorageBlobAccess.EXPECT().Get(gomock.Any(), digest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fileview/debian8/8b1a9953c4611296a827abf8c47804d7/5/hello.txt", nil))
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
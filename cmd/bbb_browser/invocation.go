@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gorilla/mux"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// invocationEntriesMax is the maximum number of entries that are
+	// requested from every action index when displaying an
+	// invocation.
+	invocationEntriesMax = 1000
+
+	// invocationSlowestActionsMax is the number of slowest actions
+	// that are displayed for an invocation.
+	invocationSlowestActionsMax = 20
+)
+
+type invocationAction struct {
+	Entry     *actionindex.Entry
+	Duration  time.Duration
+	Succeeded bool
+}
+
+func (s *BrowserService) handleInvocation(w http.ResponseWriter, req *http.Request) {
+	invocation := mux.Vars(req)["invocation"]
+	entries, err := s.searchActionIndices(req.Context(), &actionindex.SearchRequest{
+		ToolInvocationId: invocation,
+		MaxResults:       invocationEntriesMax,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	invocationInfo := struct {
+		Invocation            string
+		Truncated             bool
+		CacheHits             int
+		Executions            int
+		Failures              int
+		ExecutionDuration     time.Duration
+		FirstTimestamp        time.Time
+		LastTimestamp         time.Time
+		SlowestActions        []invocationAction
+		FailedActions         []invocationAction
+		CorrelatedInvocations string
+	}{
+		Invocation: invocation,
+		Truncated:  len(entries) >= invocationEntriesMax,
+	}
+
+	var executedActions []invocationAction
+	for _, entry := range entries {
+		action := invocationAction{
+			Entry:     entry,
+			Succeeded: entry.ExitCode == 0 && codes.Code(entry.GetStatus().GetCode()) == codes.OK,
+		}
+		if completed, err := ptypes.Timestamp(entry.CompletedTimestamp); err == nil {
+			if invocationInfo.FirstTimestamp.IsZero() || completed.Before(invocationInfo.FirstTimestamp) {
+				invocationInfo.FirstTimestamp = completed
+			}
+			if completed.After(invocationInfo.LastTimestamp) {
+				invocationInfo.LastTimestamp = completed
+			}
+			if dispatched, err := ptypes.Timestamp(entry.DispatchedTimestamp); err == nil {
+				action.Duration = completed.Sub(dispatched)
+			}
+		}
+		if correlated := entry.GetRequestMetadata().GetCorrelatedInvocationsId(); correlated != "" {
+			invocationInfo.CorrelatedInvocations = correlated
+		}
+
+		if entry.CachedResult {
+			invocationInfo.CacheHits++
+		} else {
+			invocationInfo.Executions++
+			invocationInfo.ExecutionDuration += action.Duration
+			executedActions = append(executedActions, action)
+		}
+		if !action.Succeeded {
+			invocationInfo.Failures++
+			invocationInfo.FailedActions = append(invocationInfo.FailedActions, action)
+		}
+	}
+
+	sort.SliceStable(executedActions, func(i, j int) bool {
+		return executedActions[i].Duration > executedActions[j].Duration
+	})
+	if len(executedActions) > invocationSlowestActionsMax {
+		executedActions = executedActions[:invocationSlowestActionsMax]
+	}
+	invocationInfo.SlowestActions = executedActions
+
+	if err := s.templates.ExecuteTemplate(w, "page_invocation.html", &invocationInfo); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSearchActionIndices(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	schedulerDebian8 := mock.NewMockActionIndexClient(ctrl)
+	schedulerUbuntu := mock.NewMockActionIndexClient(ctrl)
+	frontend := mock.NewMockActionIndexClient(ctrl)
+	s := &BrowserService{
+		actionIndices: []ActionIndexSource{
+			{Instance: "debian8", Client: schedulerDebian8},
+			{Instance: "ubuntu16-04", Client: schedulerUbuntu},
+			{Instance: "", Client: frontend},
+		},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		// Indices of other instances should not be queried.
+		// Results should be merged, most recent first.
+		request := &actionindex.SearchRequest{
+			InstanceName: "debian8",
+			MaxResults:   2,
+		}
+		entry1 := &actionindex.Entry{OperationName: "operation1", CompletedTimestamp: &timestamp.Timestamp{Seconds: 1000}}
+		entry2 := &actionindex.Entry{OperationName: "operation2", CompletedTimestamp: &timestamp.Timestamp{Seconds: 1002}}
+		entry3 := &actionindex.Entry{CachedResult: true, CompletedTimestamp: &timestamp.Timestamp{Seconds: 1001}}
+		schedulerDebian8.EXPECT().Search(ctx, request).Return(&actionindex.SearchResponse{
+			Entries: []*actionindex.Entry{entry2, entry1},
+		}, nil)
+		frontend.EXPECT().Search(ctx, request).Return(&actionindex.SearchResponse{
+			Entries: []*actionindex.Entry{entry3},
+		}, nil)
+
+		entries, err := s.searchActionIndices(ctx, request)
+		require.NoError(t, err)
+		require.Equal(t, []*actionindex.Entry{entry2, entry3}, entries)
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		request := &actionindex.SearchRequest{
+			InstanceName: "ubuntu16-04",
+		}
+		schedulerUbuntu.EXPECT().Search(ctx, request).Return(nil, status.Error(codes.Unavailable, "Server offline"))
+
+		_, err := s.searchActionIndices(ctx, request)
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+}
+
+func TestHandleInvocation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scheduler := mock.NewMockActionIndexClient(ctrl)
+	frontend := mock.NewMockActionIndexClient(ctrl)
+	s := &BrowserService{
+		actionIndices: []ActionIndexSource{
+			{Instance: "debian8", Client: scheduler},
+			{Instance: "", Client: frontend},
+		},
+		templates: template.Must(template.New("page_invocation.html").Parse(
+			"{{.CacheHits}} {{.Executions}} {{.Failures}} {{.ExecutionDuration}} " +
+				"{{range .SlowestActions}}{{.Entry.OperationName}}={{.Duration}} {{end}}" +
+				"{{range .FailedActions}}{{.Entry.OperationName}} {{end}}" +
+				"{{.FirstTimestamp.Unix}}-{{.LastTimestamp.Unix}} {{.CorrelatedInvocations}}")),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/invocation/{invocation}", s.handleInvocation)
+
+	request := &actionindex.SearchRequest{
+		ToolInvocationId: "invocation1",
+		MaxResults:       invocationEntriesMax,
+	}
+	requestMetadata := &remoteexecution.RequestMetadata{
+		ToolInvocationId:        "invocation1",
+		CorrelatedInvocationsId: "build1",
+	}
+	scheduler.EXPECT().Search(gomock.Any(), request).Return(&actionindex.SearchResponse{
+		Entries: []*actionindex.Entry{
+			{
+				OperationName:       "operation2",
+				RequestMetadata:     requestMetadata,
+				ExitCode:            1,
+				DispatchedTimestamp: &timestamp.Timestamp{Seconds: 1000},
+				CompletedTimestamp:  &timestamp.Timestamp{Seconds: 1030},
+			},
+			{
+				OperationName:       "operation1",
+				RequestMetadata:     requestMetadata,
+				DispatchedTimestamp: &timestamp.Timestamp{Seconds: 1000},
+				CompletedTimestamp:  &timestamp.Timestamp{Seconds: 1010},
+			},
+		},
+	}, nil)
+	frontend.EXPECT().Search(gomock.Any(), request).Return(&actionindex.SearchResponse{
+		Entries: []*actionindex.Entry{
+			{
+				RequestMetadata:    requestMetadata,
+				CachedResult:       true,
+				CompletedTimestamp: &timestamp.Timestamp{Seconds: 990},
+			},
+		},
+	}, nil)
+
+	// Cache hits should not contribute to the execution time, and
+	// executed actions should be sorted by duration.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/invocation/invocation1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "1 2 1 40s operation2=30s operation1=10s operation2 990-1030 build1", w.Body.String())
+}
@@ -8,20 +8,46 @@ import (
 	_ "net/http/pprof"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/gorilla/mux"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/kballard/go-shellquote"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"google.golang.org/grpc"
 )
 
+func dialActionIndex(address string) *grpc.ClientConn {
+	client, err := grpc.Dial(
+		address,
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
+		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+	if err != nil {
+		log.Fatal("Failed to create action index RPC client: ", err)
+	}
+	return client
+}
+
 func main() {
+	var frontendsList util.StringList
+	var schedulersList util.StringList
 	var (
 		blobstoreConfig  = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
 		webListenAddress = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
 	)
+	flag.Var(&frontendsList, "frontend", "Frontend whose action index of cache hits should be searchable. Example: bbb-frontend:8980")
+	flag.Var(&schedulersList, "scheduler", "Scheduler whose action index should be searchable. Example: debian8|hostname-of-debian8-scheduler:8981")
 	flag.Parse()
 
 	// Storage access.
@@ -29,9 +55,64 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to create blob access: ", err)
 	}
+	executionHistoryBlobAccess, err := configuration.CreateExecutionHistoryBlobAccessFromConfig(*blobstoreConfig)
+	if err != nil {
+		log.Fatal("Failed to create execution history blob access: ", err)
+	}
+	var executionHistoryStore history.ExecutionHistoryStore
+	if executionHistoryBlobAccess != nil {
+		// The browser only reads execution histories, meaning
+		// the maximum number of outcomes is irrelevant.
+		executionHistoryStore = history.NewBlobAccessExecutionHistoryStore(executionHistoryBlobAccess, 0)
+	}
+
+	uncachedActionResultBlobAccess, err := configuration.CreateUncachedActionResultBlobAccessFromConfig(*blobstoreConfig)
+	if err != nil {
+		log.Fatal("Failed to create uncached action result blob access: ", err)
+	}
+	var uncachedActionResultStore ac.UncachedActionResultStore
+	if uncachedActionResultBlobAccess != nil {
+		uncachedActionResultStore = ac.NewBlobAccessUncachedActionResultStore(uncachedActionResultBlobAccess)
+	}
+
+	// Action indices of schedulers and frontends. Schedulers only
+	// store entries for the instance they serve.
+	var actionIndices []ActionIndexSource
+	for _, schedulerEntry := range schedulersList {
+		components := strings.SplitN(schedulerEntry, "|", 2)
+		if len(components) != 2 {
+			log.Fatal("Invalid scheduler entry: ", schedulerEntry)
+		}
+		actionIndices = append(actionIndices, ActionIndexSource{
+			Instance: components[0],
+			Client:   actionindex.NewActionIndexClient(dialActionIndex(components[1])),
+		})
+	}
+	for _, frontend := range frontendsList {
+		actionIndices = append(actionIndices, ActionIndexSource{
+			Client: actionindex.NewActionIndexClient(dialActionIndex(frontend)),
+		})
+	}
 
 	templates, err := template.New("templates").Funcs(template.FuncMap{
 		"basename": path.Base,
+		"duration": func(d time.Duration) string {
+			return d.Round(time.Millisecond).String()
+		},
+		"protoduration": func(pd *duration.Duration) string {
+			d, err := ptypes.Duration(pd)
+			if err != nil {
+				return ""
+			}
+			return d.Round(time.Millisecond).String()
+		},
+		"timestamp": func(ts *timestamp.Timestamp) string {
+			t, err := ptypes.Timestamp(ts)
+			if err != nil {
+				return ""
+			}
+			return t.UTC().Format("2006-01-02 15:04:05")
+		},
 		"shellquote": func(in string) string {
 			// Use non-breaking hyphens to improve readability of output.
 			return strings.Replace(shellquote.Join(in), "-", "‑", -1)
@@ -48,6 +129,9 @@ func main() {
 		cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageBlobAccess),
 		contentAddressableStorageBlobAccess,
 		ac.NewBlobAccessActionCache(actionCacheBlobAccess),
+		uncachedActionResultStore,
+		actionIndices,
+		executionHistoryStore,
 		templates,
 		router)
 	log.Fatal(http.ListenAndServe(*webListenAddress, router))
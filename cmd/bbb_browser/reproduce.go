@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// getBaseURL reconstructs the URL at which the browser is reachable,
+// based on the headers of an incoming request.
+func getBaseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if forwardedProto := req.Header.Get("X-Forwarded-Proto"); forwardedProto != "" {
+		scheme = forwardedProto
+	}
+	return fmt.Sprintf("%s://%s", scheme, req.Host)
+}
+
+// handleReproduce generates a shell script that downloads the input
+// root of an action and runs its command with the exact arguments and
+// environment variables, so that failures of remotely executed actions
+// can be reproduced locally.
+func (s *BrowserService) handleReproduce(w http.ResponseWriter, req *http.Request) {
+	digest, err := getDigestFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	action, command, err := s.getActionAndCommand(ctx, digest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if action == nil || command == nil {
+		http.Error(w, "Could not find the action or its command", http.StatusNotFound)
+		return
+	}
+
+	inputRoot := action.InputRootDigest
+	tarballURL := fmt.Sprintf(
+		"%s/directory/%s/%s/%d/?format=tar",
+		getBaseURL(req), digest.GetInstance(), inputRoot.GetHash(), inputRoot.GetSizeBytes())
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Reproduces action %s/%d", digest.GetHashString(), digest.GetSizeBytes())
+	if instance := digest.GetInstance(); instance != "" {
+		fmt.Fprintf(&b, " of instance %s", instance)
+	}
+	fmt.Fprintf(&b, ".\n")
+	if properties := command.GetPlatform().GetProperties(); len(properties) > 0 {
+		fmt.Fprintf(&b, "# The action was executed remotely on a platform with the following properties:\n")
+		for _, property := range properties {
+			fmt.Fprintf(&b, "#   %s=%s\n", property.Name, property.Value)
+		}
+	}
+	if action.Timeout != nil {
+		fmt.Fprintf(&b, "# The action has a timeout of %d seconds.\n", action.Timeout.Seconds)
+	}
+	fmt.Fprintf(&b, "set -eu\n\n")
+
+	// Download the input root into a fresh directory.
+	fmt.Fprintf(&b, "root=${1:-%s}\n", shellquote.Join("action-"+digest.GetHashString()))
+	fmt.Fprintf(&b, "mkdir \"${root}\"\n")
+	fmt.Fprintf(&b, "curl -sSf %s | tar -xz -C \"${root}\"\n", shellquote.Join(tarballURL))
+	fmt.Fprintf(&b, "cd \"${root}\"\n\n")
+
+	// Create the parent directories of outputs, as build rules
+	// expect them to be present. Output paths are relative to the
+	// working directory.
+	outputParentDirectories := map[string]bool{}
+	outputPaths := command.OutputPaths
+	if len(outputPaths) == 0 {
+		outputPaths = append(append([]string(nil), command.OutputFiles...), command.OutputDirectories...)
+	}
+	for _, outputPath := range outputPaths {
+		if dirPath := path.Join(command.WorkingDirectory, path.Dir(outputPath)); dirPath != "." {
+			outputParentDirectories[dirPath] = true
+		}
+	}
+	if len(outputParentDirectories) > 0 {
+		var dirPaths []string
+		for dirPath := range outputParentDirectories {
+			dirPaths = append(dirPaths, dirPath)
+		}
+		sort.Strings(dirPaths)
+		fmt.Fprintf(&b, "mkdir -p")
+		for _, dirPath := range dirPaths {
+			fmt.Fprintf(&b, " %s", shellquote.Join(dirPath))
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	if command.WorkingDirectory != "" {
+		fmt.Fprintf(&b, "cd %s\n", shellquote.Join(command.WorkingDirectory))
+	}
+
+	// Run the command with exactly the same environment.
+	fmt.Fprintf(&b, "exec env -i \\\n")
+	for _, environmentVariable := range command.EnvironmentVariables {
+		fmt.Fprintf(&b, "  %s \\\n", shellquote.Join(environmentVariable.Name+"="+environmentVariable.Value))
+	}
+	for i, argument := range command.Arguments {
+		if i > 0 {
+			fmt.Fprintf(&b, " \\\n")
+		}
+		fmt.Fprintf(&b, "  %s", shellquote.Join(argument))
+	}
+	fmt.Fprintf(&b, "\n")
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"reproduce-%s.sh\"", digest.GetHashString()))
+	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetBaseURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://browser.example.com/reproduce/", nil)
+	require.Equal(t, "http://browser.example.com", getBaseURL(req))
+
+	// Reverse proxies may terminate TLS.
+	req.Header.Set("X-Forwarded-Proto", "https")
+	require.Equal(t, "https://browser.example.com", getBaseURL(req))
+}
+
+func TestHandleReproduce(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	s := &BrowserService{
+		contentAddressableStorage: contentAddressableStorage,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/reproduce/{instance}/{hash}/{sizeBytes}/", s.handleReproduce)
+
+	actionDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "c4d0d6a4a5e3d3d8f4b8d57a3fb0cb4c",
+		SizeBytes: 123,
+	})
+	commandDigest := &remoteexecution.Digest{
+		Hash:      "0e1d4e4c7ffbd3d5bd9e6d0f2f66dde3",
+		SizeBytes: 456,
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		contentAddressableStorage.EXPECT().GetAction(gomock.Any(), actionDigest).Return(&remoteexecution.Action{
+			CommandDigest: commandDigest,
+			InputRootDigest: &remoteexecution.Digest{
+				Hash:      "8b1a9953c4611296a827abf8c47804d7",
+				SizeBytes: 789,
+			},
+		}, nil)
+		contentAddressableStorage.EXPECT().GetCommand(gomock.Any(), util.MustNewDigest("debian8", commandDigest)).Return(&remoteexecution.Command{
+			Arguments: []string{"cc", "-c", "hello world.c"},
+			EnvironmentVariables: []*remoteexecution.Command_EnvironmentVariable{
+				{Name: "PATH", Value: "/bin"},
+			},
+			OutputFiles: []string{"bazel-out/hello.o"},
+			Platform: &remoteexecution.Platform{
+				Properties: []*remoteexecution.Platform_Property{
+					{Name: "OSFamily", Value: "Linux"},
+				},
+			},
+		}, nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://browser.example.com/reproduce/debian8/c4d0d6a4a5e3d3d8f4b8d57a3fb0cb4c/123/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "attachment; filename=\"reproduce-c4d0d6a4a5e3d3d8f4b8d57a3fb0cb4c.sh\"", w.Header().Get("Content-Disposition"))
+
+		script := w.Body.String()
+		require.Contains(t, script, "# Reproduces action c4d0d6a4a5e3d3d8f4b8d57a3fb0cb4c/123 of instance debian8.\n")
+		require.Contains(t, script, "#   OSFamily=Linux\n")
+		require.Contains(t, script, "root=${1:-action-c4d0d6a4a5e3d3d8f4b8d57a3fb0cb4c}\n")
+		require.Contains(t, script, "browser.example.com/directory/debian8/8b1a9953c4611296a827abf8c47804d7/789/")
+		require.Contains(t, script, "mkdir -p bazel-out\n")
+		require.Contains(t, script, "exec env -i \\\n  PATH=/bin \\\n  cc \\\n  -c \\\n  'hello world.c'\n")
+	})
+
+	t.Run("CommandNotFound", func(t *testing.T) {
+		contentAddressableStorage.EXPECT().GetAction(gomock.Any(), actionDigest).Return(&remoteexecution.Action{
+			CommandDigest: commandDigest,
+		}, nil)
+		contentAddressableStorage.EXPECT().GetCommand(gomock.Any(), util.MustNewDigest("debian8", commandDigest)).Return(nil, status.Error(codes.NotFound, "Blob not found"))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reproduce/debian8/c4d0d6a4a5e3d3d8f4b8d57a3fb0cb4c/123/", nil))
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("ActionFailure", func(t *testing.T) {
+		contentAddressableStorage.EXPECT().GetAction(gomock.Any(), actionDigest).Return(nil, status.Error(codes.Unavailable, "Server offline"))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reproduce/debian8/c4d0d6a4a5e3d3d8f4b8d57a3fb0cb4c/123/", nil))
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
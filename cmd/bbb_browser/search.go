@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// searchTimeFormat is the format of timestamps provided through the
+// search form, matching the format used by HTML's datetime-local input.
+const searchTimeFormat = "2006-01-02T15:04"
+
+// searchMaxResults is the maximum number of search results displayed.
+const searchMaxResults = 100
+
+func parseSearchTime(value string) (*timestamp.Timestamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.ParseInLocation(searchTimeFormat, value, time.UTC)
+	if err != nil {
+		return nil, err
+	}
+	return ptypes.TimestampProto(t)
+}
+
+// searchActionIndices queries all action indices that may contain
+// entries for the requested instance and merges the results, most
+// recently completed first.
+func (s *BrowserService) searchActionIndices(ctx context.Context, request *actionindex.SearchRequest) ([]*actionindex.Entry, error) {
+	var entries []*actionindex.Entry
+	for _, actionIndex := range s.actionIndices {
+		if request.InstanceName != "" && actionIndex.Instance != "" && request.InstanceName != actionIndex.Instance {
+			continue
+		}
+		response, err := actionIndex.Client.Search(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, response.Entries...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		ti, tj := entries[i].CompletedTimestamp, entries[j].CompletedTimestamp
+		return ti.GetSeconds() > tj.GetSeconds() || (ti.GetSeconds() == tj.GetSeconds() && ti.GetNanos() > tj.GetNanos())
+	})
+	if maxResults := int(request.MaxResults); maxResults > 0 && len(entries) > maxResults {
+		entries = entries[:maxResults]
+	}
+	return entries, nil
+}
+
+func (s *BrowserService) handleSearch(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	searchInfo := struct {
+		Instances []string
+		Query     map[string]string
+		Searched  bool
+		Entries   []*actionindex.Entry
+	}{
+		Query: map[string]string{},
+	}
+	instances := map[string]bool{}
+	for _, actionIndex := range s.actionIndices {
+		if actionIndex.Instance != "" && !instances[actionIndex.Instance] {
+			instances[actionIndex.Instance] = true
+			searchInfo.Instances = append(searchInfo.Instances, actionIndex.Instance)
+		}
+	}
+	sort.Strings(searchInfo.Instances)
+	for _, key := range []string{"instance", "invocation", "correlated_invocations", "action_id", "hash", "test_target", "outcome", "after", "before"} {
+		searchInfo.Query[key] = query.Get(key)
+	}
+
+	// Only perform a search if the form has been submitted.
+	if len(query) > 0 {
+		searchInfo.Searched = true
+		request := &actionindex.SearchRequest{
+			InstanceName:            query.Get("instance"),
+			ToolInvocationId:        query.Get("invocation"),
+			CorrelatedInvocationsId: query.Get("correlated_invocations"),
+			ActionId:                query.Get("action_id"),
+			ActionDigestHash:        query.Get("hash"),
+			TestTarget:              query.Get("test_target"),
+			MaxResults:              searchMaxResults,
+		}
+		switch query.Get("outcome") {
+		case "succeeded":
+			request.Outcome = actionindex.SearchRequest_SUCCEEDED
+		case "failed":
+			request.Outcome = actionindex.SearchRequest_FAILED
+		}
+		var err error
+		if request.CompletedAfter, err = parseSearchTime(query.Get("after")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.CompletedBefore, err = parseSearchTime(query.Get("before")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries, err := s.searchActionIndices(req.Context(), request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		searchInfo.Entries = entries
+
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "page_search.html", &searchInfo); err != nil {
+		log.Print(err)
+	}
+}
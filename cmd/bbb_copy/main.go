@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/gc"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+func listBlobs(ctx context.Context, blobAccess blobstore.BlobAccess) ([]*util.Digest, error) {
+	var digests []*util.Digest
+	if err := blobstore.ListBlobs(ctx, blobAccess, func(digest *util.Digest, timestamp time.Time) error {
+		digests = append(digests, digest)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+func readDigestList(path string) ([]*util.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var digests []*util.Digest
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, err := util.NewDigestFromKey(line, util.DigestKeyWithoutInstance)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Invalid digest %#v", line)
+		}
+		digests = append(digests, digest)
+	}
+	return digests, scanner.Err()
+}
+
+func copyBlobs(ctx context.Context, storageType string, source blobstore.BlobAccess, destination blobstore.BlobAccess, digests []*util.Digest, batchSize int, concurrency int) {
+	logger := logrus.WithField("storage_type", storageType)
+	logger.WithField("blobs", len(digests)).Info("Copying blobs")
+	result, err := blobstore.CopyBlobs(ctx, source, destination, digests, batchSize, concurrency)
+	logger = logger.WithFields(logrus.Fields{
+		"blobs_copied":  result.BlobsCopied,
+		"bytes_copied":  result.BytesCopied,
+		"blobs_skipped": result.BlobsSkipped,
+		"blobs_missing": result.BlobsMissing,
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to copy blobs")
+	}
+	logger.Info("Copied blobs")
+}
+
+func main() {
+	var (
+		batchSize         = flag.Int("batch-size", 1000, "Number of blobs for which presence in the destination is checked at once")
+		concurrency       = flag.Int("concurrency", 10, "Number of blobs to copy in parallel")
+		destinationConfig = flag.String("destination-blobstore-config", "", "Configuration for blob storage to which to copy blobs")
+		digestList        = flag.String("digest-list", "", "File containing digests of Content Addressable Storage blobs to copy, one \"hash-size\" pair per line. Only used in \"list\" mode")
+		logFormat         = flag.String("log-format", "text", "Format of log entries. Supported formats: text, json")
+		mode              = flag.String("mode", "all", "Blobs to copy. Supported modes: all (all blobs in the CAS and AC), reachable (all AC entries and CAS blobs referenced by them), list (CAS blobs provided through -digest-list)")
+		sourceConfig      = flag.String("source-blobstore-config", "", "Configuration for blob storage from which to copy blobs")
+	)
+	flag.Parse()
+
+	if err := logging.Configure(*logFormat); err != nil {
+		logrus.WithError(err).Fatal("Failed to configure logging")
+	}
+
+	// Storage access.
+	sourceContentAddressableStorage, sourceActionCache, err := configuration.CreateBlobAccessObjectsFromConfig(*sourceConfig)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create source blob access")
+	}
+	destinationContentAddressableStorage, destinationActionCache, err := configuration.CreateBlobAccessObjectsFromConfig(*destinationConfig)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create destination blob access")
+	}
+
+	ctx := context.Background()
+	var actionDigests, blobDigests []*util.Digest
+	switch *mode {
+	case "all":
+		if actionDigests, err = listBlobs(ctx, sourceActionCache); err != nil {
+			logrus.WithError(err).Fatal("Failed to list Action Cache entries")
+		}
+		if blobDigests, err = listBlobs(ctx, sourceContentAddressableStorage); err != nil {
+			logrus.WithError(err).Fatal("Failed to list Content Addressable Storage blobs")
+		}
+	case "reachable":
+		if actionDigests, blobDigests, err = gc.FindReachableBlobs(ctx, sourceContentAddressableStorage, sourceActionCache); err != nil {
+			logrus.WithError(err).Fatal("Failed to find reachable blobs")
+		}
+	case "list":
+		if blobDigests, err = readDigestList(*digestList); err != nil {
+			logrus.WithError(err).Fatal("Failed to read digest list")
+		}
+	default:
+		logrus.Fatalf("Unknown mode: %#v", *mode)
+	}
+
+	// Copy the CAS prior to the AC, so that AC entries copied into
+	// the destination never refer to blobs that are absent.
+	copyBlobs(ctx, "cas", sourceContentAddressableStorage, destinationContentAddressableStorage, blobDigests, *batchSize, *concurrency)
+	if len(actionDigests) > 0 {
+		copyBlobs(ctx, "ac", sourceActionCache, destinationActionCache, actionDigests, *batchSize, *concurrency)
+	}
+}
@@ -1,94 +1,327 @@
 package main
 
 import (
-	"flag"
-	"log"
-	"net"
+	"context"
+	"fmt"
 	"net/http"
-	_ "net/http/pprof"
-	"strings"
+	"net/url"
+	"os"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
-	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	blobstore_configuration "github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/grpcclient"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/healthcheck"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/httpcache"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/outputstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	blobstore_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_frontend"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/logstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/quota"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/statistics"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/sirupsen/logrus"
 
 	"google.golang.org/genproto/googleapis/bytestream"
-	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 func main() {
-	var schedulersList util.StringList
-	var (
-		actionCacheAllowUpdates = flag.Bool("ac-allow-updates", false, "Allow clients to write into the action cache")
-		blobstoreConfig         = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
-		webListenAddress        = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Var(&schedulersList, "scheduler", "Backend capable of executing build actions. Example: debian8|hostname-of-debian8-scheduler:8981")
-	flag.Parse()
-
-	// Web server for metrics and profiling.
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Fatal(http.ListenAndServe(*webListenAddress, nil))
-	}()
-
-	// Storage access.
-	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := configuration.CreateBlobAccessObjectsFromConfig(*blobstoreConfig)
+	if len(os.Args) != 2 {
+		logrus.Fatal("Usage: bbb_frontend bbb_frontend.conf")
+	}
+	var configuration bbb_frontend.ApplicationConfiguration
+	if err := global.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		logrus.WithError(err).Fatal("Failed to read configuration")
+	}
+	if err := validateConfiguration(&configuration); err != nil {
+		logrus.WithError(err).Fatal("Failed to validate configuration")
+	}
+	if err := global.ApplyDiagnosticsConfiguration("bbb_frontend", configuration.Diagnostics); err != nil {
+		logrus.WithError(err).Fatal("Failed to apply diagnostics configuration")
+	}
+
+	// Storage access. The storage configuration is reloaded from
+	// the configuration file upon receiving SIGHUP.
+	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := blobstore_configuration.CreateReloadingBlobAccessObjects(
+		func() (*blobstore_pb.BlobstoreConfiguration, error) {
+			var newConfiguration bbb_frontend.ApplicationConfiguration
+			if err := global.UnmarshalConfigurationFromFile(os.Args[1], &newConfiguration); err != nil {
+				return nil, err
+			}
+			return newConfiguration.Blobstore, nil
+		},
+		true)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create blob access")
+	}
+
+	// Download large objects directly from S3, validating their
+	// contents, as they bypass the storage configuration.
+	var blobURLProvider blobstore.BlobURLProvider
+	var redirectMinimumSizeBytes int64
+	if presignedURLs := configuration.PresignedUrls; presignedURLs != nil {
+		expiry := 15 * time.Minute
+		if presignedURLs.Expiry != nil {
+			expiry, err = ptypes.Duration(presignedURLs.Expiry)
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to parse presigned URL expiry")
+			}
+		}
+		urlProvider := blobstore_configuration.CreateS3BlobURLProvider(presignedURLs.S3, expiry)
+		contentAddressableStorageBlobAccess = blobstore.NewSizeDistinguishingBlobAccess(
+			contentAddressableStorageBlobAccess,
+			blobstore.NewMerkleBlobAccess(
+				blobstore.NewURLFetchingBlobAccess(contentAddressableStorageBlobAccess, urlProvider, http.DefaultClient)),
+			presignedURLs.MinimumSizeBytes-1)
+		if presignedURLs.RedirectHttpCacheClients {
+			blobURLProvider = urlProvider
+			redirectMinimumSizeBytes = presignedURLs.MinimumSizeBytes
+		}
+	}
+
+	// Per-client quotas on the amount of data uploaded.
+	var quotaIdentityExtractor quota.IdentityExtractor
+	var quotaWindow time.Duration
+	if quotaConfiguration := configuration.Quota; quotaConfiguration != nil {
+		quotaIdentityExtractor = quota.NewHeaderIdentityExtractor(quotaConfiguration.IdentityHeader)
+		quotaWindow, err = ptypes.Duration(quotaConfiguration.Window)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to parse quota window")
+		}
+		if quotaConfiguration.UploadBytesMax > 0 {
+			uploadTracker := quota.NewSlidingWindowTracker("upload_bytes", quotaConfiguration.UploadBytesMax, quotaWindow)
+			contentAddressableStorageBlobAccess = blobstore.NewQuotaEnforcingBlobAccess(contentAddressableStorageBlobAccess, uploadTracker, quotaIdentityExtractor)
+			actionCacheBlobAccess = blobstore.NewQuotaEnforcingBlobAccess(actionCacheBlobAccess, uploadTracker, quotaIdentityExtractor)
+		}
+	}
+	// Limit the hashing algorithms that clients may use.
+	digestFunctionPolicy, err := global.NewDigestFunctionPolicyFromConfiguration(configuration.DigestFunctions)
 	if err != nil {
-		log.Fatal("Failed to create blob access: ", err)
+		logrus.WithError(err).Fatal("Failed to create digest function policy")
 	}
+	contentAddressableStorageBlobAccess = blobstore.NewDigestFunctionCheckingBlobAccess(contentAddressableStorageBlobAccess, digestFunctionPolicy)
+	actionCacheBlobAccess = blobstore.NewDigestFunctionCheckingBlobAccess(actionCacheBlobAccess, digestFunctionPolicy)
 	actionCache := ac.NewBlobAccessActionCache(actionCacheBlobAccess)
+	healthChecks := map[string]healthcheck.Check{
+		"ac_storage":  healthcheck.NewBlobAccessCheck(actionCacheBlobAccess),
+		"cas_storage": healthcheck.NewBlobAccessCheck(contentAddressableStorageBlobAccess),
+	}
+
+	// Executions of build actions, including ones for which cached
+	// results are returned, are recorded in the action index.
+	actionIndexRecorder, actionIndexServer := builder.NewInMemoryActionIndex(int(configuration.ActionIndexEntriesMax), 1000)
+	if configuration.StatisticsExport != nil {
+		actionIndexRecorder, err = statistics.NewActionIndexRecorderFromConfiguration(actionIndexRecorder, configuration.StatisticsExport)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to create statistics exporter")
+		}
+	}
 
 	// Backends capable of compiling.
 	schedulers := map[string]builder.BuildQueue{}
-	for _, schedulerEntry := range schedulersList {
-		components := strings.SplitN(schedulerEntry, "|", 2)
-		if len(components) != 2 {
-			log.Fatal("Invalid scheduler entry: ", schedulerEntry)
-		}
-		scheduler, err := grpc.Dial(
-			components[1],
-			grpc.WithInsecure(),
-			grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-			grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+	schedulerByteStreams := map[string]bytestream.ByteStreamClient{}
+	schedulerLogStreams := map[string]logstream.LogStreamServiceClient{}
+	for instance, endpoint := range configuration.Schedulers {
+		scheduler, err := grpcclient.NewClientFromEndpointConfiguration(endpoint)
 		if err != nil {
-			log.Fatal("Failed to create scheduler RPC client: ", err)
+			logrus.WithError(err).WithField("instance", instance).Fatal("Failed to create scheduler RPC client")
 		}
-		schedulers[components[0]] = builder.NewForwardingBuildQueue(scheduler)
+		schedulers[instance] = builder.NewForwardingBuildQueue(scheduler)
+		schedulerByteStreams[instance] = bytestream.NewByteStreamClient(scheduler)
+		schedulerLogStreams[instance] = logstream.NewLogStreamServiceClient(scheduler)
+		healthChecks["scheduler_"+instance] = healthcheck.NewConnectionCheck(scheduler)
+	}
+
+	// Embedded scheduler, queueing build actions for all instance
+	// names for which no scheduler is configured explicitly.
+	var embeddedBuildQueue builder.BuildQueue
+	var embeddedSchedulerServer scheduler.SchedulerServer
+	if embeddedScheduler := configuration.EmbeddedScheduler; embeddedScheduler != nil {
+		embeddedBuildQueue, embeddedSchedulerServer, _ = builder.NewWorkerBuildQueue(
+			context.Background(),
+			util.DigestKeyWithInstance,
+			uint(embeddedScheduler.JobsPendingMax),
+			actionIndexRecorder,
+			0, nil, nil, 0, nil,
+			digestFunctionPolicy,
+			nil,
+			nil)
 	}
+
 	buildQueue := builder.NewDemultiplexingBuildQueue(func(instance string) (builder.BuildQueue, error) {
-		scheduler, ok := schedulers[instance]
-		if !ok {
-			return nil, status.Errorf(codes.InvalidArgument, "Unknown instance name")
+		if scheduler, ok := schedulers[instance]; ok {
+			return scheduler, nil
+		}
+		if embeddedBuildQueue != nil {
+			return embeddedBuildQueue, nil
 		}
-		return scheduler, nil
+		return nil, status.Errorf(codes.InvalidArgument, "Unknown instance name")
 	})
 
+	// Per-client quotas on the number of actions executed. Cached
+	// results are served by the validating build queue below, so
+	// that they do not count towards the quota.
+	if quotaConfiguration := configuration.Quota; quotaConfiguration != nil && quotaConfiguration.ExecutionsMax > 0 {
+		var excessPriority *int32
+		if quotaConfiguration.DeprioritizeExcessExecutions {
+			excessPriority = &quotaConfiguration.ExcessExecutionPriority
+		}
+		buildQueue = builder.NewQuotaEnforcingBuildQueue(
+			buildQueue,
+			quota.NewSlidingWindowTracker("executions", quotaConfiguration.ExecutionsMax, quotaWindow),
+			quotaIdentityExtractor,
+			excessPriority)
+	}
+
+	// Reject malformed requests and serve cached results before
+	// forwarding requests to the schedulers.
+	var browserURL *url.URL
+	if configuration.BrowserUrl != "" {
+		browserURL, err = url.Parse(configuration.BrowserUrl)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to parse browser URL")
+		}
+	}
+	buildQueue = builder.NewValidatingBuildQueue(buildQueue, contentAddressableStorageBlobAccess, actionCache, browserURL)
+
+	// Worker running inside the frontend process, executing build
+	// actions queued by the embedded scheduler.
+	if embeddedWorker := configuration.EmbeddedScheduler.GetWorker(); embeddedWorker != nil {
+		buildDirectory, err := filesystem.NewLocalDirectory(embeddedWorker.BuildDirectoryPath)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to open build directory")
+		}
+		workerBrowserURL := browserURL
+		if workerBrowserURL == nil {
+			workerBrowserURL = &url.URL{}
+		}
+		contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(
+			blobstore.NewExistencePreconditionBlobAccess(contentAddressableStorageBlobAccess))
+		buildExecutor := builder.NewCachingBuildExecutor(
+			builder.NewLocalBuildExecutor(
+				contentAddressableStorage,
+				environment.NewCleanBuildDirectoryManager(
+					environment.NewSingletonManager(
+						environment.NewLocalExecutionEnvironment(buildDirectory, embeddedWorker.BuildDirectoryPath))),
+				0, 0, 0, false, false, nil, nil),
+			contentAddressableStorage,
+			actionCache,
+			nil,
+			workerBrowserURL)
+		identity := builder.NewWorkerIdentity("embedded", nil)
+		go func() {
+			for {
+				err := builder.RunInProcessWorker(context.Background(), embeddedSchedulerServer, identity, buildExecutor)
+				logrus.WithError(err).Warn("Embedded worker disconnected from scheduler")
+				time.Sleep(3 * time.Second)
+			}
+		}()
+	}
+	if determinismChecking := configuration.DeterminismChecking; determinismChecking != nil {
+		buildQueue = builder.NewDeterminismCheckingBuildQueue(buildQueue, determinismChecking.Probability, int(determinismChecking.ConcurrentRebuildsMax))
+	}
+
+	// Bazel HTTP caching protocol server.
+	if httpCache := configuration.HttpCache; httpCache != nil {
+		go func() {
+			logrus.Fatal(http.ListenAndServe(
+				httpCache.ListenAddress,
+				httpcache.NewServer(
+					contentAddressableStorageBlobAccess,
+					actionCacheBlobAccess,
+					configuration.ActionCacheAllowUpdates,
+					int(httpCache.DigestSizeIndexEntriesMax),
+					blobURLProvider,
+					redirectMinimumSizeBytes)))
+		}()
+	}
+
 	// RPC server.
-	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
-	remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache, *actionCacheAllowUpdates))
+	s, err := global.NewGRPCServer(configuration.GrpcServer)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create gRPC server")
+	}
+	remoteexecution.RegisterActionCacheServer(s, builder.NewIndexingActionCacheServer(
+		ac.NewActionCacheServer(
+			actionCache,
+			cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageBlobAccess),
+			configuration.ActionCacheAllowUpdates),
+		actionIndexRecorder))
+	actionindex.RegisterActionIndexServer(s, actionIndexServer)
 	remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess))
-	bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(contentAddressableStorageBlobAccess, 1<<16))
+	bytestream.RegisterByteStreamServer(s, outputstream.NewDemultiplexingByteStreamServer(
+		cas.NewByteStreamServer(contentAddressableStorageBlobAccess, 1<<16),
+		func(instance string) (bytestream.ByteStreamClient, error) {
+			client, ok := schedulerByteStreams[instance]
+			if !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "Unknown instance name")
+			}
+			return client, nil
+		}))
+	logstream.RegisterLogStreamServiceServer(s, outputstream.NewDemultiplexingLogStreamServiceServer(
+		func(instance string) (logstream.LogStreamServiceClient, error) {
+			client, ok := schedulerLogStreams[instance]
+			if !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "Unknown instance name")
+			}
+			return client, nil
+		}))
 	remoteexecution.RegisterCapabilitiesServer(s, buildQueue)
 	remoteexecution.RegisterExecutionServer(s, buildQueue)
-	grpc_prometheus.EnableHandlingTimeHistogram()
-	grpc_prometheus.Register(s)
+	if embeddedSchedulerServer != nil {
+		scheduler.RegisterSchedulerServer(s, embeddedSchedulerServer)
+	}
+	healthcheck.Register(s, 10*time.Second, healthChecks)
+	if err := global.ServeGRPC(s, configuration.GrpcServer); err != nil {
+		logrus.WithError(err).Fatal("Failed to serve RPC server")
+	}
+}
 
-	sock, err := net.Listen("tcp", ":8980")
-	if err != nil {
-		log.Fatal("Failed to create listening socket: ", err)
+// validateConfiguration checks that all settings that have no sensible
+// default value are provided.
+func validateConfiguration(configuration *bbb_frontend.ApplicationConfiguration) error {
+	var errs global.ConfigurationErrors
+	errs.Require(configuration.Blobstore != nil, "blobstore", "must be set")
+	errs.Require(len(configuration.Schedulers) > 0 || configuration.EmbeddedScheduler != nil, "schedulers", "must contain at least one scheduler if no embedded scheduler is configured")
+	for instance, endpoint := range configuration.Schedulers {
+		errs.Require(endpoint.GetAddress() != "", fmt.Sprintf("schedulers[%#v].address", instance), "must be set")
+	}
+	errs.Require(configuration.ActionIndexEntriesMax > 0, "action_index_entries_max", "must be positive")
+	errs.ValidateServerConfiguration("grpc_server", configuration.GrpcServer)
+	if httpCache := configuration.HttpCache; httpCache != nil {
+		errs.Require(httpCache.ListenAddress != "", "http_cache.listen_address", "must be set")
+		errs.Require(httpCache.DigestSizeIndexEntriesMax > 0, "http_cache.digest_size_index_entries_max", "must be positive")
+	}
+	if determinismChecking := configuration.DeterminismChecking; determinismChecking != nil {
+		errs.Require(determinismChecking.Probability > 0 && determinismChecking.Probability <= 1, "determinism_checking.probability", "must be between 0 and 1")
+		errs.Require(determinismChecking.ConcurrentRebuildsMax > 0, "determinism_checking.concurrent_rebuilds_max", "must be positive")
+	}
+	if presignedURLs := configuration.PresignedUrls; presignedURLs != nil {
+		errs.Require(presignedURLs.S3 != nil, "presigned_urls.s3", "must be set")
+		errs.Require(presignedURLs.MinimumSizeBytes > 0, "presigned_urls.minimum_size_bytes", "must be positive")
+	}
+	if embeddedScheduler := configuration.EmbeddedScheduler; embeddedScheduler != nil {
+		errs.Require(embeddedScheduler.JobsPendingMax > 0, "embedded_scheduler.jobs_pending_max", "must be positive")
+		if embeddedWorker := embeddedScheduler.Worker; embeddedWorker != nil {
+			errs.Require(embeddedWorker.BuildDirectoryPath != "", "embedded_scheduler.worker.build_directory_path", "must be set")
+		}
 	}
-	if err := s.Serve(sock); err != nil {
-		log.Fatal("Failed to serve RPC server: ", err)
+	if quotaConfiguration := configuration.Quota; quotaConfiguration != nil {
+		errs.Require(quotaConfiguration.Window != nil, "quota.window", "must be set")
+		errs.Require(quotaConfiguration.UploadBytesMax >= 0, "quota.upload_bytes_max", "must be non-negative")
+		errs.Require(quotaConfiguration.ExecutionsMax >= 0, "quota.executions_max", "must be non-negative")
 	}
+	return errs.Err()
 }
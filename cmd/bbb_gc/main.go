@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	_ "net/http/pprof"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/gc"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	var (
+		blobstoreConfig  = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
+		dryRun           = flag.Bool("dry-run", false, "Only report unreachable blobs, instead of deleting them")
+		interval         = flag.Duration("interval", 0, "Interval between garbage collection runs. If zero, a single run is performed")
+		logFormat        = flag.String("log-format", "text", "Format of log entries. Supported formats: text, json")
+		minimumAge       = flag.Duration("minimum-age", 24*time.Hour, "Minimum age of unreachable blobs before they are deleted")
+		webListenAddress = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
+	)
+	flag.Parse()
+
+	if err := logging.Configure(*logFormat); err != nil {
+		logrus.WithError(err).Fatal("Failed to configure logging")
+	}
+
+	// Web server for metrics and profiling.
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		logrus.Fatal(http.ListenAndServe(*webListenAddress, nil))
+	}()
+
+	// Storage access.
+	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := configuration.CreateBlobAccessObjectsFromConfig(*blobstoreConfig)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create blob access")
+	}
+	garbageCollector := gc.NewGarbageCollector(contentAddressableStorageBlobAccess, actionCacheBlobAccess, *minimumAge, *dryRun)
+
+	for {
+		if err := garbageCollector.Run(context.Background()); err != nil {
+			if *interval == 0 {
+				logrus.WithError(err).Fatal("Garbage collection failed")
+			}
+			logrus.WithError(err).Error("Garbage collection failed")
+		} else {
+			logrus.Info("Garbage collection completed")
+		}
+		if *interval == 0 {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -2,37 +2,102 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/healthcheck"
+	global_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/global"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/secrets"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/tracing"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 
 	"google.golang.org/grpc"
 )
 
 func main() {
-	var tempDirectoriesList util.StringList
+	var tempDirectoriesList, wrapperArguments, preRunHook, postRunHook util.StringList
 	var (
-		buildDirectoryPath = flag.String("build-directory", "/worker/build", "Directory where builds take place")
-		listenPath         = flag.String("listen-path", "/worker/runner", "Path on which this process should bind its UNIX socket to wait for incoming requests through GRPC")
+		buildDirectoryPath         = flag.String("build-directory", "/worker/build", "Directory where builds take place")
+		listenPath                 = flag.String("listen-path", "/worker/runner", "Path on which this process should bind its UNIX socket to wait for incoming requests through GRPC")
+		traceOTLPEndpoint          = flag.String("trace-otlp-endpoint", "", "Address of an OpenTelemetry collector to which trace spans should be sent over OTLP/gRPC. Example: otel-collector:4317")
+		traceSamplingProbability   = flag.Float64("trace-sampling-probability", 0.01, "Probability at which requests that are not part of a sampled trace are traced")
+		webListenAddress           = flag.String("web.listen-address", "", "Address on which to expose Prometheus metrics, pprof profiles and expvar variables. Example: :80")
+		goroutineDumpPath          = flag.String("goroutine-dump-path", "", "File to which stack traces of all goroutines are written upon receiving SIGQUIT")
+		secretsDirectoryPath       = flag.String("secrets-directory", "", "Directory containing secrets that build actions may request through \"secret:\" platform properties, one file per secret. Example: /etc/buildbarn/secrets")
+		vaultAddress               = flag.String("vault-address", "", "Address of a HashiCorp Vault server from which secrets are obtained. Example: https://vault:8200")
+		vaultSecretPath            = flag.String("vault-secret-path", "", "Path of the Vault key/value secret whose keys are exposed as secrets. Example: secret/data/buildbarn")
+		compilerCacheDirectoryPath = flag.String("compiler-cache-directory", "", "Persistent directory that build actions may use to store a ccache/sccache compiler cache. Example: /worker/ccache")
+		vaultTokenPath             = flag.String("vault-token-path", "", "Path of a file containing the token used to authenticate against Vault")
+		scratchTmpfsDirectoryPath  = flag.String("scratch-tmpfs-directory", "", "Directory in which a tmpfs is mounted for every build action, to which TMPDIR and TEST_TMPDIR are pointed. Requires CAP_SYS_ADMIN. Example: /worker/scratch")
+		scratchTmpfsSizeBytes      = flag.Int64("scratch-tmpfs-size-bytes", 1<<30, "Maximum size of the tmpfs mounted for every build action, in bytes")
 	)
 	flag.Var(&tempDirectoriesList, "temp-directory", "Temporary directory that should be cleaned up after a build action. Example: /tmp")
+	flag.Var(&wrapperArguments, "command-wrapper", "Argument to prepend to the command line of every build action. May be provided multiple times. Example: /usr/bin/strace")
+	flag.Var(&preRunHook, "pre-run-hook", "Argument of a command to run before every build action, receiving the command specification as JSON on stdin. May be provided multiple times")
+	flag.Var(&postRunHook, "post-run-hook", "Argument of a command to run after every build action, receiving the command specification and its outcome as JSON on stdin. May be provided multiple times")
 	flag.Parse()
 
+	if err := global.ApplyDiagnosticsConfiguration("bbb_runner", &global_pb.DiagnosticsConfiguration{
+		HttpListenAddress: *webListenAddress,
+		Tracing: &global_pb.TracingConfiguration{
+			OtlpEndpoint:        *traceOTLPEndpoint,
+			SamplingProbability: *traceSamplingProbability,
+		},
+		GoroutineDumpPath: *goroutineDumpPath,
+	}); err != nil {
+		log.Fatal("Failed to apply diagnostics configuration: ", err)
+	}
+
 	buildDirectory, err := filesystem.NewLocalDirectory(*buildDirectoryPath)
 	if err != nil {
 		log.Fatal("Failed to open build directory: ", err)
 	}
 
 	env := environment.NewLocalExecutionEnvironment(buildDirectory, *buildDirectoryPath)
+	// Obtain secrets requested by build actions from either a local
+	// directory or Vault.
+	var secretProvider secrets.Provider
+	if *secretsDirectoryPath != "" && *vaultAddress != "" {
+		log.Fatal("Secrets can only be obtained from either a directory or Vault")
+	} else if *secretsDirectoryPath != "" {
+		secretsDirectory, err := filesystem.NewLocalDirectory(*secretsDirectoryPath)
+		if err != nil {
+			log.Fatal("Failed to open secrets directory: ", err)
+		}
+		secretProvider = secrets.NewDirectoryProvider(secretsDirectory)
+	} else if *vaultAddress != "" {
+		vaultToken, err := ioutil.ReadFile(*vaultTokenPath)
+		if err != nil {
+			log.Fatal("Failed to read Vault token: ", err)
+		}
+		secretProvider = secrets.NewVaultProvider(
+			&http.Client{Timeout: time.Minute},
+			*vaultAddress,
+			*vaultSecretPath,
+			strings.TrimSpace(string(vaultToken)))
+	}
+
+	if *scratchTmpfsDirectoryPath != "" && *scratchTmpfsSizeBytes <= 0 {
+		log.Fatal("Size of the scratch tmpfs must be positive")
+	}
+
 	var runnerServer runner.RunnerServer
 	// When temporary directories need cleaning prior to executing a build
-	// action, attach a series of TempDirectoryCleaningManagers.
-	if len(tempDirectoriesList) > 0 {
+	// action, attach a series of TempDirectoryCleaningManagers. Hooks,
+	// secrets, compiler caches and scratch file systems are handled by
+	// separate Managers as well.
+	if len(tempDirectoriesList) > 0 || len(wrapperArguments) > 0 || len(preRunHook) > 0 || len(postRunHook) > 0 || secretProvider != nil || *compilerCacheDirectoryPath != "" || *scratchTmpfsDirectoryPath != "" {
 		m := environment.NewSingletonManager(env)
 		for _, d := range tempDirectoriesList {
 			directory, err := filesystem.NewLocalDirectory(d)
@@ -41,13 +106,24 @@ func main() {
 			}
 			m = environment.NewTempDirectoryCleaningManager(m, directory)
 		}
+		if secretProvider != nil {
+			m = environment.NewSecretInjectingManager(m, secretProvider)
+		}
+		if *compilerCacheDirectoryPath != "" {
+			m = environment.NewCompilerCacheManager(m, *compilerCacheDirectoryPath)
+		}
+		if *scratchTmpfsDirectoryPath != "" {
+			m = environment.NewScratchTmpfsManager(m, *scratchTmpfsDirectoryPath, *scratchTmpfsSizeBytes, environment.MountTmpfs, environment.UnmountTmpfs)
+		}
+		m = environment.NewHookRunningManager(m, wrapperArguments, preRunHook, postRunHook)
 		runnerServer = environment.NewRunnerServer(environment.NewConcurrentManager(m))
 	} else {
 		runnerServer = env
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(tracing.NewServerOptions(nil, nil)...)
 	runner.RegisterRunnerServer(s, runnerServer)
+	healthcheck.Register(s, 10*time.Second, nil)
 
 	if err := os.Remove(*listenPath); err != nil && !os.IsNotExist(err) {
 		log.Fatalf("Could not remove stale socket %#v: %s", *listenPath, err)
@@ -57,6 +133,16 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create listening socket %#v: %s", *listenPath, err)
 	}
+
+	// Shut down cleanly when requested by the service manager (e.g.,
+	// launchd on macOS), so that the socket is removed and the runner
+	// can be restarted without intervention.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		s.GracefulStop()
+	}()
 	if err := s.Serve(sock); err != nil {
 		log.Fatal("Failed to serve RPC server: ", err)
 	}
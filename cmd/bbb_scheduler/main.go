@@ -1,53 +1,286 @@
 package main
 
 import (
-	"flag"
-	"log"
-	"net"
+	"context"
+	"io/ioutil"
 	"net/http"
-	_ "net/http/pprof"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	blobstore_configuration "github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/healthcheck"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/outputstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	blobstore_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/logstream"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/statistics"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/sirupsen/logrus"
 
-	"google.golang.org/grpc"
+	"google.golang.org/genproto/googleapis/bytestream"
 )
 
 func main() {
-	var (
-		jobsPendingMax   = flag.Uint("jobs-pending-max", 100, "Maximum number of build actions to be enqueued")
-		webListenAddress = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Parse()
+	if len(os.Args) != 2 {
+		logrus.Fatal("Usage: bbb_scheduler bbb_scheduler.conf")
+	}
+	var configuration bbb_scheduler.ApplicationConfiguration
+	if err := global.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		logrus.WithError(err).Fatal("Failed to read configuration")
+	}
+	if err := validateConfiguration(&configuration); err != nil {
+		logrus.WithError(err).Fatal("Failed to validate configuration")
+	}
+	if err := global.ApplyDiagnosticsConfiguration("bbb_scheduler", configuration.Diagnostics); err != nil {
+		logrus.WithError(err).Fatal("Failed to apply diagnostics configuration")
+	}
+
+	// Storage access. Finished log streams are only moved into the
+	// Content Addressable Storage if configured.
+	var contentAddressableStorageBlobAccess blobstore.BlobAccess
+	healthChecks := map[string]healthcheck.Check{}
+	if configuration.Blobstore != nil {
+		var err error
+		contentAddressableStorageBlobAccess, _, err = blobstore_configuration.CreateBlobAccessObjects(configuration.Blobstore, false)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to create blob access")
+		}
+		healthChecks["cas_storage"] = healthcheck.NewBlobAccessCheck(contentAddressableStorageBlobAccess)
+	}
 
-	// Web server for metrics and profiling.
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Fatal(http.ListenAndServe(*webListenAddress, nil))
-	}()
+	var autoscalingTargetQueueDuration time.Duration
+	if configuration.AutoscalingTargetQueueDuration != nil {
+		var err error
+		autoscalingTargetQueueDuration, err = ptypes.Duration(configuration.AutoscalingTargetQueueDuration)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to parse autoscaling target queue duration")
+		}
+	}
+
+	var contentAddressableStorage cas.ContentAddressableStorage
+	if configuration.ResourceAwareScheduling || configuration.Affinity != nil {
+		contentAddressableStorage = cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageBlobAccess)
+	}
+
+	var resourcePackingPolicy *builder.ResourcePackingPolicy
+	if configuration.ResourceAwareScheduling {
+		resourcePackingPolicy = &builder.ResourcePackingPolicy{
+			Lookahead:      100,
+			ReservationAge: time.Minute,
+		}
+		if resourcePacking := configuration.ResourcePacking; resourcePacking != nil {
+			if resourcePacking.Lookahead != 0 {
+				resourcePackingPolicy.Lookahead = int(resourcePacking.Lookahead)
+			}
+			if resourcePacking.ReservationAge != nil {
+				var err error
+				resourcePackingPolicy.ReservationAge, err = ptypes.Duration(resourcePacking.ReservationAge)
+				if err != nil {
+					logrus.WithError(err).Fatal("Failed to parse resource packing reservation age")
+				}
+			}
+		}
+	}
 
-	executionServer, schedulerServer := builder.NewWorkerBuildQueue(util.DigestKeyWithInstance, *jobsPendingMax)
+	var affinityPolicy *builder.AffinityPolicy
+	if affinity := configuration.Affinity; affinity != nil {
+		affinityPolicy = &builder.AffinityPolicy{
+			Directories:      affinity.Directories,
+			HistorySize:      4,
+			MaximumQueueJump: 100,
+		}
+		if affinity.HistorySize != 0 {
+			affinityPolicy.HistorySize = int(affinity.HistorySize)
+		}
+		if affinity.MaximumQueueJump != 0 {
+			affinityPolicy.MaximumQueueJump = int(affinity.MaximumQueueJump)
+		}
+	}
+
+	var speculativeExecutionPolicy *builder.SpeculativeExecutionPolicy
+	if speculativeExecution := configuration.SpeculativeExecution; speculativeExecution != nil {
+		speculativeExecutionPolicy = &builder.SpeculativeExecutionPolicy{
+			Percentile: speculativeExecution.Percentile,
+		}
+		if speculativeExecution.MinimumDelay != nil {
+			var err error
+			speculativeExecutionPolicy.MinimumDelay, err = ptypes.Duration(speculativeExecution.MinimumDelay)
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to parse speculative execution minimum delay")
+			}
+		}
+	}
+
+	var queueStatusInterval time.Duration
+	if configuration.QueueStatusInterval != nil {
+		var err error
+		queueStatusInterval, err = ptypes.Duration(configuration.QueueStatusInterval)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to parse queue status interval")
+		}
+	}
+
+	outputStreamsIdleTimeout, err := ptypes.Duration(configuration.OutputStreamsIdleTimeout)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to parse output streams idle timeout")
+	}
+
+	var workerBlacklistPolicy *builder.WorkerBlacklistPolicy
+	if workerBlacklist := configuration.WorkerBlacklist; workerBlacklist != nil {
+		workerBlacklistPolicy = &builder.WorkerBlacklistPolicy{
+			FailureThreshold: int(workerBlacklist.FailureThreshold),
+		}
+		if workerBlacklist.Duration != nil {
+			var err error
+			workerBlacklistPolicy.Duration, err = ptypes.Duration(workerBlacklist.Duration)
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to parse worker blacklist duration")
+			}
+		}
+	}
+
+	actionIndexRecorder, actionIndexServer := builder.NewInMemoryActionIndex(int(configuration.ActionIndexEntriesMax), 1000)
+	if configuration.Blobstore.GetExecutionHistory() != nil {
+		executionHistoryBlobAccess, err := blobstore_configuration.CreateExecutionHistoryBlobAccess(configuration.Blobstore)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to create execution history blob access")
+		}
+		actionIndexRecorder = builder.NewExecutionHistoryRecordingActionIndexRecorder(
+			actionIndexRecorder,
+			history.NewBlobAccessExecutionHistoryStore(executionHistoryBlobAccess, int(configuration.ExecutionHistoryOutcomesMax)))
+		healthChecks["execution_history_storage"] = healthcheck.NewBlobAccessCheck(executionHistoryBlobAccess)
+	}
+	if configuration.StatisticsExport != nil {
+		var err error
+		actionIndexRecorder, err = statistics.NewActionIndexRecorderFromConfiguration(actionIndexRecorder, configuration.StatisticsExport)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to create statistics exporter")
+		}
+	}
+	digestFunctionPolicy, err := global.NewDigestFunctionPolicyFromConfiguration(configuration.DigestFunctions)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create digest function policy")
+	}
+	executionServer, schedulerServer, adminServer := builder.NewWorkerBuildQueue(context.Background(), util.DigestKeyWithInstance, uint(configuration.JobsPendingMax), actionIndexRecorder, autoscalingTargetQueueDuration, contentAddressableStorage, speculativeExecutionPolicy, queueStatusInterval, workerBlacklistPolicy, digestFunctionPolicy, affinityPolicy, resourcePackingPolicy)
+
+	// Report the shards of storage that are drained according to
+	// the storage configuration through the Admin service.
+	var drainedShards []*admin.DrainedShard
+	for _, storage := range []struct {
+		storageType string
+		config      *blobstore_pb.BlobAccessConfiguration
+	}{
+		{"cas", configuration.Blobstore.GetContentAddressableStorage()},
+		{"ac", configuration.Blobstore.GetActionCache()},
+	} {
+		for _, drainedShard := range blobstore_configuration.GetDrainedShards(storage.config) {
+			drainedShards = append(drainedShards, &admin.DrainedShard{
+				StorageType: storage.storageType,
+				Path:        drainedShard.Path,
+				Weight:      drainedShard.Weight,
+			})
+		}
+	}
+	adminServer = builder.NewDrainedShardsReportingAdminServer(adminServer, drainedShards)
 
 	// RPC server.
-	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
+	s, err := global.NewGRPCServer(configuration.GrpcServer)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create gRPC server")
+	}
 	remoteexecution.RegisterCapabilitiesServer(s, executionServer)
 	remoteexecution.RegisterExecutionServer(s, executionServer)
 	scheduler.RegisterSchedulerServer(s, schedulerServer)
-	grpc_prometheus.EnableHandlingTimeHistogram()
-	grpc_prometheus.Register(s)
+	actionindex.RegisterActionIndexServer(s, actionIndexServer)
+	if configuration.AdminTokenPath != "" {
+		adminToken, err := ioutil.ReadFile(configuration.AdminTokenPath)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to read admin token")
+		}
+		// Also use the authenticating server for the HTTP
+		// handler below, so that it requires the same token.
+		adminServer = builder.NewAuthenticatingAdminServer(adminServer, strings.TrimSpace(string(adminToken)))
+		admin.RegisterAdminServer(s, adminServer)
+	}
+	if configuration.AdminHttpListenAddress != "" {
+		var browserURL *url.URL
+		if configuration.BrowserUrl != "" {
+			browserURL, err = url.Parse(configuration.BrowserUrl)
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to parse browser URL")
+			}
+		}
+		go func() {
+			logrus.Fatal(http.ListenAndServe(configuration.AdminHttpListenAddress, builder.NewAdminHTTPHandler(adminServer, browserURL)))
+		}()
+	}
+	byteStreamServer, logStreamServer := outputstream.NewServer(
+		contentAddressableStorageBlobAccess,
+		1<<16,
+		int(configuration.OutputStreamsFinishedMax),
+		configuration.OutputStreamSizeBytesMax,
+		configuration.OutputStreamsTotalSizeBytesMax,
+		outputStreamsIdleTimeout)
+	bytestream.RegisterByteStreamServer(s, byteStreamServer)
+	logstream.RegisterLogStreamServiceServer(s, logStreamServer)
+	healthcheck.Register(s, 10*time.Second, healthChecks)
+	if err := global.ServeGRPC(s, configuration.GrpcServer); err != nil {
+		logrus.WithError(err).Fatal("Failed to serve RPC server")
+	}
+}
 
-	sock, err := net.Listen("tcp", ":8981")
-	if err != nil {
-		log.Fatal("Failed to create listening socket: ", err)
+// validateConfiguration checks that all settings that have no sensible
+// default value are provided.
+func validateConfiguration(configuration *bbb_scheduler.ApplicationConfiguration) error {
+	var errs global.ConfigurationErrors
+	errs.Require(configuration.JobsPendingMax > 0, "jobs_pending_max", "must be positive")
+	errs.Require(configuration.OutputStreamsFinishedMax > 0, "output_streams_finished_max", "must be positive")
+	errs.Require(configuration.OutputStreamSizeBytesMax > 0, "output_stream_size_bytes_max", "must be positive")
+	errs.Require(configuration.OutputStreamsTotalSizeBytesMax >= configuration.OutputStreamSizeBytesMax, "output_streams_total_size_bytes_max", "must be at least output_stream_size_bytes_max")
+	if d := configuration.OutputStreamsIdleTimeout; d != nil {
+		errs.Require(d.Seconds > 0 || (d.Seconds == 0 && d.Nanos > 0), "output_streams_idle_timeout", "must be positive")
+	} else {
+		errs.Require(false, "output_streams_idle_timeout", "must be set")
+	}
+	errs.Require(configuration.ActionIndexEntriesMax > 0, "action_index_entries_max", "must be positive")
+	errs.ValidateServerConfiguration("grpc_server", configuration.GrpcServer)
+	if configuration.Blobstore.GetExecutionHistory() != nil {
+		errs.Require(configuration.ExecutionHistoryOutcomesMax > 0, "execution_history_outcomes_max", "must be positive when execution history storage is configured")
+	}
+	if configuration.ResourceAwareScheduling {
+		errs.Require(configuration.Blobstore != nil, "blobstore", "must be set when resource aware scheduling is enabled")
+	}
+	if resourcePacking := configuration.ResourcePacking; resourcePacking != nil {
+		errs.Require(configuration.ResourceAwareScheduling, "resource_packing", "requires resource_aware_scheduling to be enabled")
+		if d := resourcePacking.ReservationAge; d != nil {
+			errs.Require(d.Seconds > 0 || (d.Seconds == 0 && d.Nanos > 0), "resource_packing.reservation_age", "must be positive")
+		}
+	}
+	if affinity := configuration.Affinity; affinity != nil {
+		errs.Require(configuration.Blobstore != nil, "blobstore", "must be set when affinity scheduling is enabled")
+		errs.Require(len(affinity.Directories) > 0, "affinity.directories", "must not be empty")
+	}
+	if speculativeExecution := configuration.SpeculativeExecution; speculativeExecution != nil {
+		errs.Require(speculativeExecution.Percentile > 0 && speculativeExecution.Percentile <= 1, "speculative_execution.percentile", "must be between 0 and 1")
+	}
+	if workerBlacklist := configuration.WorkerBlacklist; workerBlacklist != nil {
+		errs.Require(workerBlacklist.FailureThreshold > 0, "worker_blacklist.failure_threshold", "must be positive")
+		errs.Require(workerBlacklist.Duration != nil, "worker_blacklist.duration", "must be set")
 	}
-	if err := s.Serve(sock); err != nil {
-		log.Fatal("Failed to serve RPC server: ", err)
+	if d := configuration.AutoscalingTargetQueueDuration; d != nil {
+		errs.Require(d.Seconds > 0 || (d.Seconds == 0 && d.Nanos > 0), "autoscaling_target_queue_duration", "must be positive")
 	}
+	return errs.Err()
 }
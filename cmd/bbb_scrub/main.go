@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	var (
+		blobstoreConfig           = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
+		interval                  = flag.Duration("interval", 0, "Interval between scrubbing runs. If zero, a single run is performed")
+		logFormat                 = flag.String("log-format", "text", "Format of log entries. Supported formats: text, json")
+		quarantineBlobstoreConfig = flag.String("quarantine-blobstore-config", "", "Configuration for blob storage in whose Content Addressable Storage corrupted blobs are stored prior to deletion. Corrupted blobs are only deleted if not set")
+		webListenAddress          = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
+	)
+	flag.Parse()
+
+	if err := logging.Configure(*logFormat); err != nil {
+		logrus.WithError(err).Fatal("Failed to configure logging")
+	}
+
+	// Web server for metrics and profiling.
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		logrus.Fatal(http.ListenAndServe(*webListenAddress, nil))
+	}()
+
+	// Storage access. Every shard is scrubbed separately, so that
+	// corruption rates can be reported per shard.
+	shards, err := configuration.CreateContentAddressableStorageShardsFromConfig(*blobstoreConfig)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create blob access")
+	}
+	var quarantine blobstore.BlobAccess
+	if *quarantineBlobstoreConfig != "" {
+		quarantine, _, err = configuration.CreateUnverifiedBlobAccessObjectsFromConfig(*quarantineBlobstoreConfig)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to create quarantine blob access")
+		}
+	}
+	var scrubbers []blobstore.Scrubber
+	for i, shard := range shards {
+		scrubbers = append(scrubbers, blobstore.NewScrubber(shard, quarantine, fmt.Sprintf("shard%d", i)))
+	}
+
+	for {
+		for i, scrubber := range scrubbers {
+			logger := logrus.WithField("shard", i)
+			if err := scrubber.Scrub(context.Background()); err != nil {
+				logger.WithError(err).Error("Scrubbing failed")
+			} else {
+				logger.Info("Scrubbing completed")
+			}
+		}
+		if *interval == 0 {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
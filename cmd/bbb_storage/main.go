@@ -1,59 +1,71 @@
 package main
 
 import (
-	"flag"
-	"log"
-	"net"
-	"net/http"
-	_ "net/http/pprof"
+	"os"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
-	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	blobstore_configuration "github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/healthcheck"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_storage"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 
 	"google.golang.org/genproto/googleapis/bytestream"
-	"google.golang.org/grpc"
 )
 
 func main() {
-	var (
-		blobstoreConfig  = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
-		webListenAddress = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Parse()
-
-	// Web server for metrics and profiling.
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Fatal(http.ListenAndServe(*webListenAddress, nil))
-	}()
+	if len(os.Args) != 2 {
+		logrus.Fatal("Usage: bbb_storage bbb_storage.conf")
+	}
+	var configuration bbb_storage.ApplicationConfiguration
+	if err := global.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		logrus.WithError(err).Fatal("Failed to read configuration")
+	}
+	if err := validateConfiguration(&configuration); err != nil {
+		logrus.WithError(err).Fatal("Failed to validate configuration")
+	}
+	if err := global.ApplyDiagnosticsConfiguration("bbb_storage", configuration.Diagnostics); err != nil {
+		logrus.WithError(err).Fatal("Failed to apply diagnostics configuration")
+	}
 
 	// Storage access.
-	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := configuration.CreateBlobAccessObjectsFromConfig(*blobstoreConfig)
+	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := blobstore_configuration.CreateBlobAccessObjects(configuration.Blobstore, true)
 	if err != nil {
-		log.Fatal("Failed to create blob access: ", err)
+		logrus.WithError(err).Fatal("Failed to create blob access")
 	}
 	actionCache := ac.NewBlobAccessActionCache(actionCacheBlobAccess)
+	healthChecks := map[string]healthcheck.Check{
+		"ac_storage":  healthcheck.NewBlobAccessCheck(actionCacheBlobAccess),
+		"cas_storage": healthcheck.NewBlobAccessCheck(contentAddressableStorageBlobAccess),
+	}
 
-	// RPC server.
-	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
-	remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache, true))
-	remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess))
-	bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(contentAddressableStorageBlobAccess, 1<<16))
-	grpc_prometheus.EnableHandlingTimeHistogram()
-	grpc_prometheus.Register(s)
-
-	sock, err := net.Listen("tcp", ":8982")
+	// RPC server. Action Cache updates are always permitted, as
+	// frontends and workers write results through this service.
+	s, err := global.NewGRPCServer(configuration.GrpcServer)
 	if err != nil {
-		log.Fatal("Failed to create listening socket: ", err)
+		logrus.WithError(err).Fatal("Failed to create gRPC server")
 	}
-	if err := s.Serve(sock); err != nil {
-		log.Fatal("Failed to serve RPC server: ", err)
+	remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(
+		actionCache,
+		cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageBlobAccess),
+		true))
+	remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess))
+	bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(contentAddressableStorageBlobAccess, 1<<16))
+	healthcheck.Register(s, 10*time.Second, healthChecks)
+	if err := global.ServeGRPC(s, configuration.GrpcServer); err != nil {
+		logrus.WithError(err).Fatal("Failed to serve RPC server")
 	}
 }
+
+// validateConfiguration checks that all settings that have no sensible
+// default value are provided.
+func validateConfiguration(configuration *bbb_storage.ApplicationConfiguration) error {
+	var errs global.ConfigurationErrors
+	errs.Require(configuration.Blobstore.GetContentAddressableStorage() != nil, "blobstore.content_addressable_storage", "must be set")
+	errs.Require(configuration.Blobstore.GetActionCache() != nil, "blobstore.action_cache", "must be set")
+	errs.ValidateServerConfiguration("grpc_server", configuration.GrpcServer)
+	return errs.Err()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_storage"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateConfiguration(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		// Configuration similar to the one shipped with the
+		// bare deployment.
+		directory, err := ioutil.TempDir("", "bbb_storage")
+		require.NoError(t, err)
+		defer os.RemoveAll(directory)
+		path := filepath.Join(directory, "storage.conf")
+		require.NoError(t, ioutil.WriteFile(path, []byte(`
+diagnostics {
+  http_listen_address: "localhost:7982"
+}
+blobstore {
+  content_addressable_storage {
+    circular {
+      directory: "storage-cas"
+      offset_file_size_bytes: 16777216
+      offset_cache_size: 10000
+      data_file_size_bytes: 10737418240
+      data_allocation_chunk_size_bytes: 16777216
+    }
+  }
+  action_cache {
+    circular {
+      directory: "storage-ac"
+      offset_file_size_bytes: 1048576
+      offset_cache_size: 1000
+      data_file_size_bytes: 104857600
+      data_allocation_chunk_size_bytes: 1048576
+      instance: "local"
+    }
+  }
+}
+grpc_server {
+  listen_address: "localhost:8982"
+}
+`), 0666))
+
+		var configuration bbb_storage.ApplicationConfiguration
+		require.NoError(t, global.UnmarshalConfigurationFromFile(path, &configuration))
+		require.NoError(t, validateConfiguration(&configuration))
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		// All missing settings should be reported at once.
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Invalid configuration:\n  blobstore.content_addressable_storage: must be set\n  blobstore.action_cache: must be set\n  grpc_server.listen_address: must be set"),
+			validateConfiguration(&bbb_storage.ApplicationConfiguration{}))
+	})
+}
@@ -2,198 +2,1011 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
-	"log"
-	"net/http"
-	_ "net/http/pprof"
+	"math"
 	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
-	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	blobstore_configuration "github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/grpcclient"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/healthcheck"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	blobstore_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_worker"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/tracing"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
 
-	"google.golang.org/grpc"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func main() {
-	var (
-		blobstoreConfig    = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
-		browserURLString   = flag.String("browser-url", "http://bbb-browser/", "URL of the Bazel Buildbarn Browser, accessible by the user through 'bazel build --verbose_failures'")
-		buildDirectoryPath = flag.String("build-directory", "/worker/build", "Directory where builds take place")
-		cacheDirectoryPath = flag.String("cache-directory", "/worker/cache", "Directory where build input files are cached")
-		concurrency        = flag.Int("concurrency", 1, "Number of actions to run concurrently")
-		runnerAddress      = flag.String("runner", "unix:///worker/runner", "Address of the runner to which to connect")
-		schedulerAddress   = flag.String("scheduler", "", "Address of the scheduler to which to connect")
-		webListenAddress   = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Parse()
-
-	// To ease privilege separation, clear the umask. This process
-	// either writes files into directories that can easily be
-	// closed off, or creates files with the appropriate mode to be
-	// secure.
-	syscall.Umask(0)
-
-	browserURL, err := url.Parse(*browserURLString)
-	if err != nil {
-		log.Fatal("Failed to parse browser URL: ", err)
+	if len(os.Args) != 2 {
+		logrus.Fatal("Usage: bbb_worker bbb_worker.conf")
+	}
+	var configuration bbb_worker.ApplicationConfiguration
+	if err := global.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		logrus.WithError(err).Fatal("Failed to read configuration")
+	}
+	if err := validateConfiguration(&configuration); err != nil {
+		logrus.WithError(err).Fatal("Failed to validate configuration")
+	}
+	if err := global.ApplyDiagnosticsConfiguration("bbb_worker", configuration.Diagnostics); err != nil {
+		logrus.WithError(err).Fatal("Failed to apply diagnostics configuration")
 	}
 
-	// Web server for metrics and profiling.
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Fatal(http.ListenAndServe(*webListenAddress, nil))
-	}()
+	// To ease privilege separation, clear the umask by default.
+	// This process either writes files into directories that can
+	// easily be closed off, or creates files with the appropriate
+	// mode to be secure.
+	syscall.Umask(int(configuration.Umask))
 
-	// Storage access.
-	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := configuration.CreateBlobAccessObjectsFromConfig(*blobstoreConfig)
+	browserURL, err := url.Parse(configuration.BrowserUrl)
 	if err != nil {
-		log.Fatal("Failed to create blob access: ", err)
+		logrus.WithError(err).Fatal("Failed to parse browser URL")
 	}
 
-	// Directories where builds take place.
-	buildDirectory, err := filesystem.NewLocalDirectory(*buildDirectoryPath)
+	// Storage access. The storage configuration is reloaded from
+	// the configuration file upon receiving SIGHUP.
+	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := blobstore_configuration.CreateReloadingBlobAccessObjects(
+		func() (*blobstore_pb.BlobstoreConfiguration, error) {
+			var newConfiguration bbb_worker.ApplicationConfiguration
+			if err := global.UnmarshalConfigurationFromFile(os.Args[1], &newConfiguration); err != nil {
+				return nil, err
+			}
+			return newConfiguration.Blobstore, nil
+		},
+		false)
 	if err != nil {
-		log.Fatal("Failed to open cache directory: ", err)
+		logrus.WithError(err).Fatal("Failed to create blob access")
+	}
+
+	// Decorators applied to the Content Addressable Storage, both
+	// for fetching inputs and uploading outputs.
+	contentAddressableStorageDecorators := configuration.ContentAddressableStorageDecorators
+	if len(contentAddressableStorageDecorators) == 0 {
+		contentAddressableStorageDecorators = []*blobstore_pb.BlobAccessDecoratorConfiguration{
+			{Decorator: &blobstore_pb.BlobAccessDecoratorConfiguration_ExistencePrecondition{ExistencePrecondition: true}},
+		}
+	}
+	decoratedContentAddressableStorageBlobAccess, err := blobstore_configuration.ApplyBlobAccessDecorators(contentAddressableStorageBlobAccess, contentAddressableStorageDecorators, "cas", util.DigestKeyWithoutInstance)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to apply Content Addressable Storage decorators")
 	}
 
 	// On-disk caching of content for efficient linking into build environments.
-	cacheDirectory, err := filesystem.NewLocalDirectory(*cacheDirectoryPath)
+	cacheDirectory, err := filesystem.NewLocalDirectory(configuration.CacheDirectoryPath)
 	if err != nil {
-		log.Fatal("Failed to open cache directory: ", err)
+		logrus.WithError(err).Fatal("Failed to open cache directory")
 	}
-	if err := cacheDirectory.RemoveAllChildren(); err != nil {
-		log.Fatal("Failed to clear cache directory: ", err)
+
+	// Adjust the mode and ownership of input files according to
+	// the configuration, prior to them being added to the cache.
+	fetchingContentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(
+		decoratedContentAddressableStorageBlobAccess)
+	fileMode, executableFileMode, uid, gid := os.FileMode(0444), os.FileMode(0555), -1, -1
+	if permissions := configuration.InputFilePermissions; permissions != nil {
+		if permissions.FileMode != 0 {
+			fileMode = os.FileMode(permissions.FileMode)
+		}
+		if permissions.ExecutableFileMode != 0 {
+			executableFileMode = os.FileMode(permissions.ExecutableFileMode)
+		}
+		if owner := permissions.Owner; owner != nil {
+			uid, gid = int(owner.Uid), int(owner.Gid)
+		}
+		fetchingContentAddressableStorage = cas.NewPermissionsNormalizingContentAddressableStorage(
+			fetchingContentAddressableStorage,
+			fileMode, executableFileMode, uid, gid)
 	}
 
 	// Cached read access to the Content Addressable Storage. All
 	// workers make use of the same cache, to increase the hit rate.
-	contentAddressableStorageReader := cas.NewDirectoryCachingContentAddressableStorage(
-		cas.NewHardlinkingContentAddressableStorage(
-			cas.NewBlobAccessContentAddressableStorage(
-				blobstore.NewExistencePreconditionBlobAccess(contentAddressableStorageBlobAccess)),
-			util.DigestKeyWithoutInstance, cacheDirectory, 10000, 1<<30),
-		util.DigestKeyWithoutInstance, 1000)
-	actionCache := ac.NewBlobAccessActionCache(actionCacheBlobAccess)
-
-	// Create connection with scheduler.
-	schedulerConnection, err := grpc.Dial(
-		*schedulerAddress,
-		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+	// Files left behind in the cache directory by a previous run
+	// are reused. Input files can only be hardlinked out of the
+	// cache if they are read-only, as build actions would otherwise
+	// be able to modify the contents of the cache. Clone them
+	// instead if they are writable.
+	//
+	// Multiple workers may share the same cache directory. Its
+	// usage is tracked in a subdirectory, so that the limits on its
+	// size apply to all workers combined.
+	if err := cacheDirectory.Mkdir(".usage", 0777); err != nil && !os.IsExist(err) {
+		logrus.WithError(err).Fatal("Failed to create cache usage directory")
+	}
+	cacheUsageDirectory, err := cacheDirectory.Enter(".usage")
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open cache usage directory")
+	}
+	cloneFiles := configuration.CloneInputFiles || (fileMode|executableFileMode)&0222 != 0
+	fileCachingContentAddressableStorage, hardlinkingCache, err := cas.NewHardlinkingContentAddressableStorage(
+		fetchingContentAddressableStorage,
+		util.DigestKeyWithoutInstance, cacheDirectory,
+		cas.NewDirectoryCacheUsageStore(cacheUsageDirectory),
+		10000, 1<<30, cloneFiles)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to load cache directory")
+	}
+	messageCacheSize, messageCacheSizeBytes := 1000, int64(64<<20)
+	if configuration.MessageCacheSize != 0 {
+		messageCacheSize = int(configuration.MessageCacheSize)
+	}
+	if configuration.MessageCacheSizeBytes != 0 {
+		messageCacheSizeBytes = configuration.MessageCacheSizeBytes
+	}
+	contentAddressableStorageReader, saveDirectoryCache, err := cas.NewDirectoryCachingContentAddressableStorage(
+		fileCachingContentAddressableStorage,
+		util.DigestKeyWithoutInstance, messageCacheSize, messageCacheSizeBytes, cacheDirectory)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to load cached messages")
+	}
+
+	// Scratch space for prefetching the inputs of pipelined build
+	// actions. It is placed inside the cache directory, so that
+	// files can be hardlinked into it. Entries starting with a dot
+	// are ignored by the cache.
+	var prefetchDirectory filesystem.Directory
+	if configuration.Pipelining {
+		if err := cacheDirectory.RemoveAll(".prefetch"); err != nil {
+			logrus.WithError(err).Fatal("Failed to remove prefetch directory")
+		}
+		if err := cacheDirectory.Mkdir(".prefetch", 0777); err != nil {
+			logrus.WithError(err).Fatal("Failed to create prefetch directory")
+		}
+		prefetchDirectory, err = cacheDirectory.Enter(".prefetch")
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to open prefetch directory")
+		}
+	}
+
+	// Write the indexes of the caches to disk upon shutdown, so
+	// that they remain warm across restarts.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := saveDirectoryCache(); err != nil {
+			logrus.WithError(err).Error("Failed to save cached messages")
+		}
+		if err := hardlinkingCache.SaveIndex(); err != nil {
+			logrus.WithError(err).Error("Failed to save index of cache directory")
+		}
+		os.Exit(0)
+	}()
+	// Keep recently computed action results in memory, so that
+	// actions that are executed repeatedly can be served locally.
+	actionCacheSize := 1000
+	if configuration.ActionCacheSize != 0 {
+		actionCacheSize = int(configuration.ActionCacheSize)
+	}
+	actionCache := ac.NewMemoryCachingActionCache(
+		ac.NewBlobAccessActionCache(actionCacheBlobAccess),
+		util.DigestKeyWithInstance, actionCacheSize)
+
+	// Results of actions that may not be stored in the Action
+	// Cache are stored separately if configured, so that they can
+	// be inspected through the browser.
+	var uncachedActionResultStore ac.UncachedActionResultStore
+	uncachedActionResultBlobAccess, err := blobstore_configuration.CreateUncachedActionResultBlobAccess(configuration.Blobstore)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create uncached action result blob access")
+	}
+	if uncachedActionResultBlobAccess != nil {
+		uncachedActionResultStore = ac.NewBlobAccessUncachedActionResultStore(uncachedActionResultBlobAccess)
+	}
+
+	// Workers are identified by their hostname, followed by a
+	// random suffix to distinguish restarts of the same worker.
+	workerName := configuration.WorkerName
+	if workerName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to obtain hostname")
+		}
+		workerName = hostname
+	}
+	identity := builder.NewWorkerIdentity(workerName, configuration.WorkerLabels)
+
+	// Without any explicitly configured platforms, serve a single
+	// platform using the top-level settings.
+	platforms := configuration.Platforms
+	if len(platforms) == 0 {
+		platforms = []*bbb_worker.PlatformConfiguration{
+			{
+				Scheduler:          configuration.Scheduler,
+				Runner:             configuration.Runner,
+				BuildDirectoryPath: configuration.BuildDirectoryPath,
+				ContainerRunner:    configuration.ContainerRunner,
+				AllowedSecrets:     configuration.AllowedSecrets,
+			},
+		}
+	}
+
+	var environmentVariableRules []environment.EnvironmentVariableRule
+	for _, rule := range configuration.EnvironmentVariableRules {
+		environmentVariableRules = append(environmentVariableRules, environment.EnvironmentVariableRule{
+			PlatformProperties: rule.PlatformProperties,
+			Remove:             rule.Remove,
+			SetDefault:         rule.SetDefault,
+			Set:                rule.Set,
+		})
+	}
+
+	// Slots for executing build actions, shared by all platforms.
+	slots := make(chan struct{}, configuration.Concurrency)
+	var stageLimits *builder.StageConcurrencyLimits
+	if stageConcurrency := configuration.StageConcurrency; stageConcurrency != nil {
+		stageLimits = &builder.StageConcurrencyLimits{
+			FetchingInputs:   newStageSlots(stageConcurrency.FetchingInputs),
+			Executing:        newStageSlots(stageConcurrency.Executing),
+			UploadingOutputs: newStageSlots(stageConcurrency.UploadingOutputs),
+		}
+	}
+	// CPU sets dedicated to slots, shared by all platforms.
+	var cpuSets chan []uint32
+	if cpuPinning := configuration.CpuPinning; cpuPinning != nil {
+		var cpuSetList [][]uint32
+		if cpuPinning.CpusPerSlot > 0 {
+			numaNodeCPUs, err := environment.GetNUMANodeCPUs()
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to obtain NUMA topology")
+			}
+			cpuSetList, err = environment.AllocateCPUSets(numaNodeCPUs, int(configuration.Concurrency), int(cpuPinning.CpusPerSlot))
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to allocate CPU sets")
+			}
+		} else {
+			for _, cpuSet := range cpuPinning.CpuSets {
+				cpus, _ := environment.ParseCPUList(cpuSet)
+				cpuSetList = append(cpuSetList, cpus)
+			}
+		}
+		cpuSets = make(chan []uint32, len(cpuSetList))
+		for _, cpus := range cpuSetList {
+			cpuSets <- cpus
+		}
+	}
+	var transientFailureSignatures []builder.TransientFailureSignature
+	for _, signature := range configuration.TransientFailureRetry.GetSignatures() {
+		transientFailureSignature := builder.TransientFailureSignature{
+			Name:      signature.Name,
+			ExitCodes: signature.ExitCodes,
+		}
+		if signature.StderrPattern != "" {
+			transientFailureSignature.StderrPattern = regexp.MustCompile(signature.StderrPattern)
+		}
+		transientFailureSignatures = append(transientFailureSignatures, transientFailureSignature)
+	}
+
+	healthChecks := map[string]healthcheck.Check{
+		"ac_storage":  healthcheck.NewBlobAccessCheck(actionCacheBlobAccess),
+		"cas_storage": healthcheck.NewBlobAccessCheck(contentAddressableStorageBlobAccess),
+	}
+
+	// Stop accepting build actions when running low on disk space,
+	// after attempting to free up space by evicting cached files.
+	var diskSpaceMonitor builder.DiskSpaceMonitor
+	if configuration.MinimumFreeSpaceBytes > 0 {
+		paths := []string{configuration.CacheDirectoryPath}
+		for _, platform := range platforms {
+			paths = append(paths, platform.BuildDirectoryPath)
+		}
+		diskSpaceMonitor = builder.NewDiskSpaceMonitor(
+			paths,
+			configuration.MinimumFreeSpaceBytes,
+			filesystem.GetFreeSpace,
+			hardlinkingCache.Evict,
+			10*time.Second)
+		healthChecks["disk_space"] = func(ctx context.Context) error {
+			if unhealthyReason, _ := diskSpaceMonitor.GetUnhealthyReason(); unhealthyReason != "" {
+				return status.Error(codes.ResourceExhausted, unhealthyReason)
+			}
+			return nil
+		}
+	}
+	// Discard cached input files when requested by an administrator
+	// through the Admin service of the scheduler. Files that are in
+	// use by build actions that are executing are retained. Flushes
+	// requested through multiple platforms are serialized.
+	var flushCacheLock sync.Mutex
+	flushCache := func() {
+		flushCacheLock.Lock()
+		defer flushCacheLock.Unlock()
+		freedBytes, err := hardlinkingCache.Evict(math.MaxInt64)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to flush cache")
+			return
+		}
+		logrus.WithField("freed_bytes", freedBytes).Info("Flushed cache")
+	}
+
+	prefetchSlots := 0
+	for _, platform := range platforms {
+		// Create connection with scheduler.
+		schedulerConnection, err := grpcclient.NewClientFromEndpointConfiguration(platform.Scheduler)
+		if err != nil {
+			logrus.WithError(err).WithField("platform", platform.Name).Fatal("Failed to create scheduler RPC client")
+		}
+		schedulerClient := scheduler.NewSchedulerClient(schedulerConnection)
+
+		// Execute commands using a separate runner process. Due to the
+		// interaction between threads, forking and execve() returning
+		// ETXTBSY, concurrent execution of build actions can only be
+		// used in combination with a runner process. Having a separate
+		// runner process also makes it possible to apply privilege
+		// separation.
+		runnerConnection, err := grpcclient.NewClientFromEndpointConfiguration(platform.Runner)
+		if err != nil {
+			logrus.WithError(err).WithField("platform", platform.Name).Fatal("Failed to create runner RPC client")
+		}
+
+		if platform.Name == "" {
+			healthChecks["runner"] = healthcheck.NewConnectionCheck(runnerConnection)
+			healthChecks["scheduler"] = healthcheck.NewConnectionCheck(schedulerConnection)
+		} else {
+			healthChecks["runner_"+platform.Name] = healthcheck.NewConnectionCheck(runnerConnection)
+			healthChecks["scheduler_"+platform.Name] = healthcheck.NewConnectionCheck(schedulerConnection)
+		}
+
+		// Directory where builds take place.
+		buildDirectory, err := filesystem.NewLocalDirectory(platform.BuildDirectoryPath)
+		if err != nil {
+			logrus.WithError(err).WithField("platform", platform.Name).Fatal("Failed to open build directory")
+		}
+
+		// Build environment capable of executing one action at a time.
+		// The build takes place in the root of the build directory.
+		// Build actions requesting to be run inside a container
+		// are forwarded to a separate runner if configured.
+		runnerEnvironment := environment.NewRemoteExecutionEnvironment(runnerConnection, buildDirectory)
+		containerRunner := platform.ContainerRunner
+		if containerRunner != nil {
+			containerRunnerConnection, err := grpcclient.NewClientFromEndpointConfiguration(containerRunner.Runner)
+			if err != nil {
+				logrus.WithError(err).WithField("platform", platform.Name).Fatal("Failed to create container runner RPC client")
+			}
+			if platform.Name == "" {
+				healthChecks["container_runner"] = healthcheck.NewConnectionCheck(containerRunnerConnection)
+			} else {
+				healthChecks["container_runner_"+platform.Name] = healthcheck.NewConnectionCheck(containerRunnerConnection)
+			}
+			runnerEnvironment = environment.NewContainerRoutingEnvironment(
+				runnerEnvironment,
+				environment.NewRemoteExecutionEnvironment(containerRunnerConnection, buildDirectory))
+		}
+		environmentManager := environment.NewSingletonManager(runnerEnvironment)
+
+		if configuration.ReuseInputRoots {
+			// Subdirectories in which build actions are run
+			// are created by InputRootReusingManager below.
+			environmentManager = environment.NewConcurrentManager(environmentManager)
+		} else {
+			// Create a per-action subdirectory in the build
+			// directory named after the action digest, so
+			// that multiple actions may be run concurrently
+			// within the same environment.
+			// TODO(edsch): It might make sense to disable
+			// this if concurrency is disabled to improve
+			// action cache hit rate, but only if there are no
+			// other workers in the same cluster that have
+			// concurrency enabled.
+			environmentManager = environment.NewActionDigestSubdirectoryManager(
+				environment.NewConcurrentManager(
+					environment.NewCleanBuildDirectoryManager(environmentManager)),
+				util.DigestKeyWithoutInstance)
+		}
+
+		// Run build actions without network access if requested.
+		environmentManager = environment.NewNetworkIsolationManager(
+			environmentManager,
+			configuration.IsolateNetworkByDefault)
+
+		// Let build actions request being run inside a container
+		// permitted by the policy of the worker.
+		if containerRunner != nil {
+			environmentManager = environment.NewContainerPolicyManager(
+				environmentManager,
+				&environment.ContainerPolicy{
+					AllowedImages:   containerRunner.AllowedImages,
+					AllowPrivileged: containerRunner.AllowPrivileged,
+					AllowedRuntimes: containerRunner.AllowedRuntimes,
+				})
+		}
+
+		// Adjust environment variables of build actions according
+		// to the policy of the worker.
+		if len(environmentVariableRules) > 0 {
+			environmentManager = environment.NewEnvironmentVariablePolicyManager(
+				environmentManager,
+				environmentVariableRules)
+		}
+
+		// Let build actions run inside subdirectories that retain
+		// the input root of the previous build action. Adapters
+		// added before this one observe paths relative to the
+		// root of the build directory, while adapters added
+		// after it observe paths relative to the subdirectory.
+		if configuration.ReuseInputRoots {
+			environmentManager = environment.NewInputRootReusingManager(
+				environmentManager,
+				contentAddressableStorageReader)
+		}
+
+		// Stream stdout and stderr of build actions to the scheduler
+		// while they are running, so that clients can observe them.
+		// This is done after adding the adapter that reuses input
+		// roots, as output files are only streamed when placed
+		// directly inside the build directory.
+		environmentManager = environment.NewOutputStreamingManager(
+			environmentManager,
+			bytestream.NewByteStreamClient(schedulerConnection),
+			time.Second)
+
+		// Translate "secret:" platform properties to requests for
+		// secrets that are fetched by the runner. This is done
+		// after adding the adapters that run build actions in
+		// subdirectories, so that paths of secret files get
+		// rewritten accordingly.
+		allowedSecrets := map[string][]string{}
+		for instance, secrets := range platform.AllowedSecrets {
+			allowedSecrets[instance] = secrets.Names
+		}
+		environmentManager = environment.NewSecretRequestingManager(environmentManager, allowedSecrets)
+
+		// Pin build actions to the CPUs dedicated to the slot
+		// in which they run.
+		if cpuSets != nil {
+			environmentManager = environment.NewCPUPinningManager(environmentManager, cpuSets)
+		}
+
+		// Every platform subscribes to its scheduler once,
+		// requesting as many build actions as it is permitted
+		// to run concurrently. Build actions received while all
+		// slots are in use by other platforms wait for a slot
+		// to become available.
+		concurrency := configuration.Concurrency
+		if platform.Concurrency > 0 && platform.Concurrency < concurrency {
+			concurrency = platform.Concurrency
+		}
+		workerSlotPrefix := ""
+		if platform.Name != "" {
+			workerSlotPrefix = platform.Name + "/"
+		}
+		workerSlots := make([]workerSlot, 0, concurrency)
+		for i := 0; i < int(concurrency); i++ {
+			slotName := fmt.Sprintf("%s%d", workerSlotPrefix, i)
+			var inputPrefetcher builder.InputPrefetcher
+			if prefetchDirectory != nil {
+				inputPrefetcher = newInputPrefetcher(contentAddressableStorageReader, prefetchDirectory, strconv.Itoa(prefetchSlots))
+				prefetchSlots++
+			}
+			workerSlots = append(workerSlots, workerSlot{
+				name:   slotName,
+				logger: logrus.WithField(logging.WorkerIDField, fmt.Sprintf("%s/%s", identity.Id, slotName)),
+				buildExecutor: newBuildExecutor(
+					contentAddressableStorageBlobAccess,
+					decoratedContentAddressableStorageBlobAccess,
+					contentAddressableStorageReader,
+					environmentManager,
+					actionCache,
+					uncachedActionResultStore,
+					browserURL,
+					slots,
+					stageLimits,
+					transientFailureSignatures,
+					&configuration),
+				inputPrefetcher: inputPrefetcher,
+			})
+		}
+		go runPlatform(
+			logrus.WithField(logging.WorkerIDField, identity.Id),
+			schedulerClient,
+			workerSlots,
+			browserURL,
+			identity,
+			configuration.Resources,
+			configuration.Pipelining,
+			diskSpaceMonitor,
+			flushCache)
+	}
+
+	// Health checking service, reporting whether the worker is
+	// capable of reaching all of its dependencies.
+	s, err := global.NewGRPCServer(configuration.GrpcServer)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create gRPC server")
+	}
+	healthcheck.Register(s, 10*time.Second, healthChecks)
+	if err := global.ServeGRPC(s, configuration.GrpcServer); err != nil {
+		logrus.WithError(err).Fatal("Failed to serve RPC server")
+	}
+}
+
+// workerSlot is a BuildExecutor capable of executing a single build
+// action at a time, along with a logger that identifies it. Slots of
+// workers that use pipelining also have an InputPrefetcher.
+type workerSlot struct {
+	name            string
+	logger          *logrus.Entry
+	buildExecutor   builder.BuildExecutor
+	inputPrefetcher builder.InputPrefetcher
+}
+
+// newInputPrefetcher creates an InputPrefetcher for a single worker
+// slot, using a subdirectory of the prefetch directory as its scratch
+// space.
+func newInputPrefetcher(contentAddressableStorageReader cas.ContentAddressableStorage, prefetchDirectory filesystem.Directory, name string) builder.InputPrefetcher {
+	if err := prefetchDirectory.Mkdir(name, 0777); err != nil {
+		logrus.WithError(err).Fatal("Failed to create prefetch directory")
+	}
+	scratchDirectory, err := prefetchDirectory.Enter(name)
 	if err != nil {
-		log.Fatal("Failed to create scheduler RPC client: ", err)
-	}
-	schedulerClient := scheduler.NewSchedulerClient(schedulerConnection)
-
-	// Execute commands using a separate runner process. Due to the
-	// interaction between threads, forking and execve() returning
-	// ETXTBSY, concurrent execution of build actions can only be
-	// used in combination with a runner process. Having a separate
-	// runner process also makes it possible to apply privilege
-	// separation.
-	runnerConnection, err := grpc.Dial(
-		*runnerAddress,
-		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+		logrus.WithError(err).Fatal("Failed to open prefetch directory")
+	}
+	return builder.NewInputPrefetcher(contentAddressableStorageReader, scratchDirectory)
+}
+
+// newStageSlots creates a channel for limiting the concurrency of a
+// stage of execution. Stages with a concurrency of zero are unlimited.
+func newStageSlots(concurrency int32) chan struct{} {
+	if concurrency == 0 {
+		return nil
+	}
+	return make(chan struct{}, concurrency)
+}
+
+// newBuildExecutor creates the BuildExecutor of a single worker slot.
+func newBuildExecutor(contentAddressableStorageBlobAccess blobstore.BlobAccess, decoratedContentAddressableStorageBlobAccess blobstore.BlobAccess, contentAddressableStorageReader cas.ContentAddressableStorage, environmentManager environment.Manager, actionCache ac.ActionCache, uncachedActionResultStore ac.UncachedActionResultStore, browserURL *url.URL, slots chan struct{}, stageLimits *builder.StageConcurrencyLimits, transientFailureSignatures []builder.TransientFailureSignature, configuration *bbb_worker.ApplicationConfiguration) builder.BuildExecutor {
+	// Per-worker separate writer of the Content Addressable Storage
+	// that batches writes after completing the build action.
+	outputUploadConcurrency := int(configuration.OutputUploadConcurrency)
+	if outputUploadConcurrency == 0 {
+		outputUploadConcurrency = 1
+	}
+	contentAddressableStorageWriter, contentAddressableStorageFlusher := blobstore.NewBatchedStoreBlobAccess(
+		decoratedContentAddressableStorageBlobAccess,
+		util.DigestKeyWithoutInstance, 100,
+		outputUploadConcurrency, int(configuration.OutputUploadMaxRetries))
+	outputUploadDecorators := configuration.OutputUploadDecorators
+	if len(outputUploadDecorators) == 0 {
+		outputUploadDecorators = []*blobstore_pb.BlobAccessDecoratorConfiguration{
+			{Decorator: &blobstore_pb.BlobAccessDecoratorConfiguration_Metrics{Metrics: "batched_store"}},
+		}
+	}
+	contentAddressableStorageWriter, err := blobstore_configuration.ApplyBlobAccessDecorators(contentAddressableStorageWriter, outputUploadDecorators, "cas", util.DigestKeyWithoutInstance)
 	if err != nil {
-		log.Fatal("Failed to create runner RPC client: ", err)
-	}
-
-	// Build environment capable of executing one action at a time.
-	// The build takes place in the root of the build directory.
-	environmentManager := environment.NewCleanBuildDirectoryManager(
-		environment.NewSingletonManager(
-			environment.NewRemoteExecutionEnvironment(runnerConnection, buildDirectory)))
-
-	// Create a per-action subdirectory in the build directory named
-	// after the action digest, so that multiple actions may be run
-	// concurrently within the same environment.
-	// TODO(edsch): It might make sense to disable this if
-	// concurrency is disabled to improve action cache hit rate, but
-	// only if there are no other workers in the same cluster that
-	// have concurrency enabled.
-	environmentManager = environment.NewActionDigestSubdirectoryManager(
-		environment.NewConcurrentManager(environmentManager),
-		util.DigestKeyWithoutInstance)
-
-	for i := 0; i < *concurrency; i++ {
-		go func(i int) {
-			// Per-worker separate writer of the Content
-			// Addressable Storage that batches writes after
-			// completing the build action.
-			contentAddressableStorageWriter, contentAddressableStorageFlusher := blobstore.NewBatchedStoreBlobAccess(
-				blobstore.NewExistencePreconditionBlobAccess(contentAddressableStorageBlobAccess),
-				util.DigestKeyWithoutInstance, 100)
-			contentAddressableStorageWriter = blobstore.NewMetricsBlobAccess(
-				contentAddressableStorageWriter,
-				"cas_batched_store")
-			contentAddressableStorage := cas.NewReadWriteDecouplingContentAddressableStorage(
-				contentAddressableStorageReader,
-				cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageWriter))
-			buildExecutor := builder.NewStorageFlushingBuildExecutor(
+		logrus.WithError(err).Fatal("Failed to apply output upload decorators")
+	}
+	contentAddressableStorage := cas.NewReadWriteDecouplingContentAddressableStorage(
+		contentAddressableStorageReader,
+		cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageWriter))
+	buildExecutor := builder.NewLocalBuildExecutor(
+		contentAddressableStorage,
+		environmentManager,
+		configuration.MaxInlineStdoutSizeBytes,
+		configuration.MaxInlineStderrSizeBytes,
+		configuration.MaxInlineOutputFileSizeBytes,
+		configuration.TruncateInlineLogs,
+		configuration.CacheFailedActions,
+		&builder.ActionLimits{
+			MaxInputFiles:      configuration.MaxInputFiles,
+			MaxInputSizeBytes:  configuration.MaxInputSizeBytes,
+			MaxOutputSizeBytes: configuration.MaxOutputSizeBytes,
+		},
+		stageLimits)
+	if len(transientFailureSignatures) > 0 {
+		// Retry before storing results, so that the results of
+		// attempts that are retried don't end up in the cache.
+		buildExecutor = builder.NewRetryingBuildExecutor(
+			buildExecutor,
+			contentAddressableStorageBlobAccess,
+			contentAddressableStorageFlusher,
+			transientFailureSignatures,
+			int(configuration.TransientFailureRetry.MaxRetries))
+	}
+	return builder.NewConcurrencyLimitingBuildExecutor(
+		builder.NewStorageFlushingBuildExecutor(
+			builder.NewActionCacheLookupBuildExecutor(
 				builder.NewCachingBuildExecutor(
-					builder.NewLocalBuildExecutor(
-						contentAddressableStorage,
-						environmentManager),
+					buildExecutor,
 					contentAddressableStorage,
 					actionCache,
+					uncachedActionResultStore,
 					browserURL),
-				contentAddressableStorageFlusher)
+				actionCache,
+				browserURL),
+			contentAddressableStorageFlusher),
+		slots)
+}
 
-			// Repeatedly ask the scheduler for work.
-			for {
-				err := subscribeAndExecute(schedulerClient, buildExecutor, browserURL)
-				log.Print("Failed to subscribe and execute: ", err)
-				time.Sleep(time.Second * 3)
-			}
-		}(i)
+// runPlatform repeatedly requests build actions from a scheduler and
+// executes them.
+func runPlatform(logger *logrus.Entry, schedulerClient scheduler.SchedulerClient, workerSlots []workerSlot, browserURL *url.URL, identity *scheduler.WorkerIdentity, resources *scheduler.WorkerResources, pipelining bool, diskSpaceMonitor builder.DiskSpaceMonitor, flushCache func()) {
+	for {
+		err := subscribeAndExecute(schedulerClient, workerSlots, browserURL, identity, resources, pipelining, diskSpaceMonitor, flushCache)
+		logger.WithError(err).Warn("Failed to subscribe and execute")
+		time.Sleep(time.Second * 3)
 	}
-	select {}
 }
 
-func subscribeAndExecute(schedulerClient scheduler.SchedulerClient, buildExecutor builder.BuildExecutor, browserURL *url.URL) error {
-	stream, err := schedulerClient.GetWork(context.Background())
+// validateConfiguration checks that all settings that have no sensible
+// default value are provided.
+func validateConfiguration(configuration *bbb_worker.ApplicationConfiguration) error {
+	var errs global.ConfigurationErrors
+	errs.Require(configuration.Blobstore != nil, "blobstore", "must be set")
+	errs.Require(configuration.BrowserUrl != "", "browser_url", "must be set")
+	errs.Require(configuration.CacheDirectoryPath != "", "cache_directory_path", "must be set")
+	errs.Require(configuration.Concurrency > 0, "concurrency", "must be positive")
+	errs.Require(configuration.ActionCacheSize >= 0, "action_cache_size", "must not be negative")
+	errs.Require(configuration.MaxInlineStdoutSizeBytes >= 0, "max_inline_stdout_size_bytes", "must not be negative")
+	errs.Require(configuration.MaxInlineStderrSizeBytes >= 0, "max_inline_stderr_size_bytes", "must not be negative")
+	errs.Require(configuration.MaxInlineOutputFileSizeBytes >= 0, "max_inline_output_file_size_bytes", "must not be negative")
+	errs.Require(configuration.OutputUploadConcurrency >= 0, "output_upload_concurrency", "must not be negative")
+	errs.Require(configuration.OutputUploadMaxRetries >= 0, "output_upload_max_retries", "must not be negative")
+	errs.Require(configuration.MessageCacheSize >= 0, "message_cache_size", "must not be negative")
+	errs.Require(configuration.MessageCacheSizeBytes >= 0, "message_cache_size_bytes", "must not be negative")
+	errs.Require(configuration.MaxInputFiles >= 0, "max_input_files", "must not be negative")
+	errs.Require(configuration.MaxInputSizeBytes >= 0, "max_input_size_bytes", "must not be negative")
+	errs.Require(configuration.MaxOutputSizeBytes >= 0, "max_output_size_bytes", "must not be negative")
+	if len(configuration.Platforms) == 0 {
+		errs.Require(configuration.BuildDirectoryPath != "", "build_directory_path", "must be set")
+		errs.Require(configuration.Scheduler.GetAddress() != "", "scheduler.address", "must be set")
+		errs.Require(configuration.Runner.GetAddress() != "", "runner.address", "must be set")
+		validateContainerRunnerConfiguration(&errs, "container_runner", configuration.ContainerRunner)
+	} else {
+		errs.Require(configuration.BuildDirectoryPath == "", "build_directory_path", "must not be set when platforms are provided")
+		errs.Require(configuration.Scheduler == nil, "scheduler", "must not be set when platforms are provided")
+		errs.Require(configuration.Runner == nil, "runner", "must not be set when platforms are provided")
+		errs.Require(configuration.ContainerRunner == nil, "container_runner", "must not be set when platforms are provided")
+		errs.Require(len(configuration.AllowedSecrets) == 0, "allowed_secrets", "must not be set when platforms are provided")
+		names := map[string]bool{}
+		for i, platform := range configuration.Platforms {
+			field := fmt.Sprintf("platforms[%d]", i)
+			errs.Require(platform.Name != "", field+".name", "must be set")
+			errs.Require(!names[platform.Name], field+".name", "must be unique")
+			names[platform.Name] = true
+			errs.Require(platform.BuildDirectoryPath != "", field+".build_directory_path", "must be set")
+			errs.Require(platform.Scheduler.GetAddress() != "", field+".scheduler.address", "must be set")
+			errs.Require(platform.Runner.GetAddress() != "", field+".runner.address", "must be set")
+			errs.Require(platform.Concurrency >= 0, field+".concurrency", "must not be negative")
+			validateContainerRunnerConfiguration(&errs, field+".container_runner", platform.ContainerRunner)
+		}
+	}
+	if resources := configuration.Resources; resources != nil {
+		errs.Require(resources.Cpus > 0, "resources.cpus", "must be positive")
+	}
+	if stageConcurrency := configuration.StageConcurrency; stageConcurrency != nil {
+		errs.Require(stageConcurrency.FetchingInputs >= 0, "stage_concurrency.fetching_inputs", "must not be negative")
+		errs.Require(stageConcurrency.Executing >= 0, "stage_concurrency.executing", "must not be negative")
+		errs.Require(stageConcurrency.UploadingOutputs >= 0, "stage_concurrency.uploading_outputs", "must not be negative")
+	}
+	if cpuPinning := configuration.CpuPinning; cpuPinning != nil {
+		if cpuPinning.CpusPerSlot > 0 {
+			errs.Require(len(cpuPinning.CpuSets) == 0, "cpu_pinning.cpu_sets", "must not be set when cpus_per_slot is set")
+		} else {
+			errs.Require(len(cpuPinning.CpuSets) == int(configuration.Concurrency), "cpu_pinning.cpu_sets", "must contain one entry per slot")
+		}
+		for i, cpuSet := range cpuPinning.CpuSets {
+			cpus, err := environment.ParseCPUList(cpuSet)
+			errs.Require(err == nil && len(cpus) > 0, fmt.Sprintf("cpu_pinning.cpu_sets[%d]", i), "must be a non-empty list of CPUs")
+		}
+	}
+	for i, signature := range configuration.TransientFailureRetry.GetSignatures() {
+		field := fmt.Sprintf("transient_failure_retry.signatures[%d]", i)
+		errs.Require(signature.Name != "", field+".name", "must be set")
+		errs.Require(len(signature.ExitCodes) > 0 || signature.StderrPattern != "", field, "must set at least one of exit_codes and stderr_pattern")
+		_, err := regexp.Compile(signature.StderrPattern)
+		errs.Require(err == nil, field+".stderr_pattern", "must be a valid regular expression")
+	}
+	if permissions := configuration.InputFilePermissions; permissions != nil {
+		errs.Require(permissions.FileMode&^0777 == 0, "input_file_permissions.file_mode", "must only contain permission bits")
+		errs.Require(permissions.ExecutableFileMode&^0777 == 0, "input_file_permissions.executable_file_mode", "must only contain permission bits")
+	}
+	errs.Require(configuration.Umask&^0777 == 0, "umask", "must only contain permission bits")
+	errs.ValidateServerConfiguration("grpc_server", configuration.GrpcServer)
+	return errs.Err()
+}
+
+// validateContainerRunnerConfiguration checks that a container runner,
+// if provided, has an address and permits at least one image.
+func validateContainerRunnerConfiguration(errs *global.ConfigurationErrors, field string, containerRunner *bbb_worker.ContainerRunnerConfiguration) {
+	if containerRunner == nil {
+		return
+	}
+	errs.Require(containerRunner.Runner.GetAddress() != "", field+".runner.address", "must be set")
+	errs.Require(len(containerRunner.AllowedImages) > 0, field+".allowed_images", "must not be empty")
+	for i, pattern := range containerRunner.AllowedImages {
+		_, err := path.Match(pattern, "")
+		errs.Require(err == nil, fmt.Sprintf("%s.allowed_images[%d]", field, i), "must be a valid pattern")
+	}
+}
+
+// subscribeAndExecute opens a single stream to the scheduler, over
+// which build actions are received for all of the worker slots. The
+// stream starts out with a single credit. Additional credits are
+// granted for the remaining slots, so that the scheduler may dispatch
+// as many build actions as there are slots. If pipelining is enabled,
+// the scheduler may also send a build action for every slot whose
+// build action is executing.
+func subscribeAndExecute(schedulerClient scheduler.SchedulerClient, workerSlots []workerSlot, browserURL *url.URL, identity *scheduler.WorkerIdentity, resources *scheduler.WorkerResources, pipelining bool, diskSpaceMonitor builder.DiskSpaceMonitor, flushCache func()) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = builder.NewContextWithWorkerIdentity(ctx, identity)
+	if resources != nil {
+		ctx = builder.NewContextWithWorkerResources(ctx, resources)
+	}
+	stream, err := schedulerClient.GetWork(ctx)
 	if err != nil {
 		return err
 	}
 	defer stream.CloseSend()
 
+	// gRPC streams don't permit concurrent calls to Send().
+	// Completion of a cache flush is reported through the next
+	// update that is sent.
+	var sendLock sync.Mutex
+	cacheFlushed := false
+	send := func(update *scheduler.WorkerUpdate) error {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		if cacheFlushed {
+			update.CacheFlushed = true
+			cacheFlushed = false
+		}
+		return stream.Send(update)
+	}
+
+	freeSlots := make(chan workerSlot, len(workerSlots))
+	for _, slot := range workerSlots {
+		freeSlots <- slot
+	}
+	if pipelining {
+		if err := send(&scheduler.WorkerUpdate{
+			Update: &scheduler.WorkerUpdate_Pipelining{Pipelining: true},
+		}); err != nil {
+			return err
+		}
+	}
+	pipeline := &workerPipeline{
+		freeSlots: freeSlots,
+		executing: map[string]*pipelinedExecution{},
+	}
+	if len(workerSlots) > 1 {
+		if err := send(&scheduler.WorkerUpdate{
+			Update: &scheduler.WorkerUpdate_Credits{Credits: uint32(len(workerSlots) - 1)},
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Report changes in the availability of disk space, so that
+	// the scheduler stops dispatching build actions while the
+	// worker is running low.
+	if diskSpaceMonitor != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reportedReason := ""
+			for {
+				unhealthyReason, changed := diskSpaceMonitor.GetUnhealthyReason()
+				if unhealthyReason != reportedReason {
+					if err := send(&scheduler.WorkerUpdate{
+						Update: &scheduler.WorkerUpdate_Health{
+							Health: &scheduler.WorkerHealth{UnhealthyReason: unhealthyReason},
+						},
+					}); err != nil {
+						return
+					}
+					reportedReason = unhealthyReason
+				}
+				select {
+				case <-changed:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
 	for {
 		request, err := stream.Recv()
 		if err != nil {
 			return err
 		}
+		if request.FlushCache {
+			// Flushing a large cache may take a while. Don't
+			// let it delay the processing of work requests.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				flushCache()
+				sendLock.Lock()
+				cacheFlushed = true
+				sendLock.Unlock()
+			}()
+		}
 
-		// Print URL of the action into the log before execution.
-		actionURL, err := browserURL.Parse(
-			fmt.Sprintf(
-				"/action/%s/%s/%d/",
-				request.InstanceName,
-				request.ActionDigest.Hash,
-				request.ActionDigest.SizeBytes))
-		if err != nil {
-			return err
+		// Build actions pipelined behind one that is still
+		// executing are run on the same slot afterwards.
+		if pipeline.enqueue(ctx, &wg, request) {
+			continue
 		}
-		log.Print("Action: ", actionURL.String())
 
-		response, _ := buildExecutor.Execute(stream.Context(), request)
-		log.Print("ExecuteResponse: ", response)
-		if err := stream.Send(response); err != nil {
-			return err
+		// The scheduler never dispatches more build actions
+		// than credits granted, meaning a slot should be
+		// available. Still, block in case it isn't.
+		var slot workerSlot
+		select {
+		case slot = <-freeSlots:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pipeline.execute(ctx, slot, request, browserURL, send)
+		}()
+	}
+}
+
+// pipelinedExecution tracks a build action that is executing on a
+// worker slot, along with the build action that the scheduler
+// pipelined behind it, if any.
+type pipelinedExecution struct {
+	slot         workerSlot
+	next         *scheduler.WorkRequest
+	prefetchDone chan struct{}
+}
+
+// workerPipeline keeps track of the build actions executing on the
+// slots of a worker, so that build actions pipelined behind them can
+// be executed on the same slots.
+type workerPipeline struct {
+	freeSlots chan<- workerSlot
+
+	lock      sync.Mutex
+	executing map[string]*pipelinedExecution
+}
+
+// enqueue attaches a build action to the one it is pipelined behind,
+// starting to prefetch its inputs. It returns false if the build
+// action is not pipelined, or if the build action it is pipelined
+// behind already completed. It should then be executed on a free slot.
+func (p *workerPipeline) enqueue(ctx context.Context, wg *sync.WaitGroup, request *scheduler.WorkRequest) bool {
+	if request.PreviousOperationName == "" {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e, ok := p.executing[request.PreviousOperationName]
+	if !ok || e.next != nil {
+		return false
+	}
+	e.next = request
+	e.prefetchDone = make(chan struct{})
+	if e.slot.inputPrefetcher != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(e.prefetchDone)
+			prefetchOnSlot(ctx, e.slot, request)
+		}()
+	} else {
+		close(e.prefetchDone)
+	}
+	return true
+}
+
+// execute runs a build action on a worker slot, followed by any build
+// actions pipelined behind it. The slot is released before the
+// response of the last build action is sent.
+func (p *workerPipeline) execute(ctx context.Context, slot workerSlot, request *scheduler.WorkRequest, browserURL *url.URL, send func(update *scheduler.WorkerUpdate) error) {
+	for {
+		e := &pipelinedExecution{slot: slot}
+		p.lock.Lock()
+		p.executing[request.OperationName] = e
+		p.lock.Unlock()
+
+		response := executeOnSlot(ctx, slot, request, browserURL, send)
+
+		p.lock.Lock()
+		delete(p.executing, request.OperationName)
+		next, prefetchDone := e.next, e.prefetchDone
+		if next == nil {
+			p.freeSlots <- slot
+		}
+		p.lock.Unlock()
+		send(&scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update:        &scheduler.WorkerUpdate_ExecuteResponse{ExecuteResponse: response},
+		})
+		if next == nil {
+			return
 		}
+		<-prefetchDone
+		request = next
 	}
 }
+
+// prefetchOnSlot loads the inputs of a build action that is about to
+// be executed on a worker slot into the local caches. As this is
+// merely an optimization, failures are only logged.
+func prefetchOnSlot(ctx context.Context, slot workerSlot, request *scheduler.WorkRequest) {
+	actionDigest, err := util.NewDigest(request.InstanceName, request.ActionDigest)
+	if err != nil {
+		return
+	}
+	if err := slot.inputPrefetcher.Prefetch(ctx, actionDigest); err != nil {
+		logging.WithActionDigest(slot.logger, actionDigest).WithError(err).Warn("Failed to prefetch inputs of action")
+	}
+}
+
+// executeOnSlot executes a single build action received from the
+// scheduler on a worker slot.
+func executeOnSlot(ctx context.Context, slot workerSlot, request *scheduler.WorkRequest, browserURL *url.URL, send func(update *scheduler.WorkerUpdate) error) *remoteexecution.ExecuteResponse {
+	actionDigest, err := util.NewDigest(request.InstanceName, request.ActionDigest)
+	if err != nil {
+		return &remoteexecution.ExecuteResponse{Status: status.Convert(err).Proto()}
+	}
+	actionLogger := logging.WithActionDigest(slot.logger, actionDigest).WithField(logging.OperationNameField, request.OperationName)
+
+	// Print URL of the action into the log before execution.
+	actionURL, err := browserURL.Parse(
+		fmt.Sprintf(
+			"/action/%s/%s/%d/",
+			actionDigest.GetInstance(),
+			actionDigest.GetHashString(),
+			actionDigest.GetSizeBytes()))
+	if err != nil {
+		return &remoteexecution.ExecuteResponse{Status: status.Convert(err).Proto()}
+	}
+	actionLogger.WithField("url", actionURL.String()).Info("Executing action")
+
+	// Record the worker slot on which the action is executed in
+	// the action result, using the identity under which the
+	// scheduler knows this worker.
+	ctx = builder.NewContextWithWorkerName(ctx, fmt.Sprintf("%s/%s", request.Worker.GetId(), slot.name))
+
+	// Attach the execution to the trace of the client that
+	// enqueued the action, if any.
+	ctx = logging.NewContext(ctx, actionLogger)
+	ctx, span := otel.Tracer("github.com/EdSchouten/bazel-buildbarn/cmd/bbb_worker").Start(
+		tracing.ExtractTraceContext(ctx, request.TraceContext),
+		"Worker.Execute")
+	defer span.End()
+
+	// Forward stage transitions to the scheduler, so that clients
+	// can observe the progress of the action. Failures to send are
+	// picked up by the receiving end of the stream.
+	ctx = builder.NewContextWithExecutionStageReporter(ctx, func(stage scheduler.ExecutionStage) {
+		send(&scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update:        &scheduler.WorkerUpdate_Stage{Stage: stage},
+		})
+	})
+	response, _ := slot.buildExecutor.Execute(ctx, builder.GetExecuteRequest(request))
+	actionLogger.WithField("response", response.String()).Info("Executed action")
+	return response
+}
@@ -29,29 +29,52 @@ trap 'kill $(jobs -p)' EXIT TERM INT
 rm -f runner
 mkdir -p build cache storage-ac storage-cas
 
+# The worker connects to the runner through a socket, whose location
+# needs to be absolute.
+cat > worker.conf << EOF
+diagnostics {
+  http_listen_address: "localhost:7984"
+}
+blobstore {
+  content_addressable_storage {
+    grpc {
+      endpoint: "localhost:8982"
+    }
+  }
+  action_cache {
+    grpc {
+      endpoint: "localhost:8982"
+    }
+  }
+}
+browser_url: "http://localhost:7983/"
+build_directory_path: "build"
+cache_directory_path: "cache"
+concurrency: 4
+action_cache_size: 1000
+max_inline_stdout_size_bytes: 1024
+max_inline_stderr_size_bytes: 1024
+max_inline_output_file_size_bytes: 1024
+scheduler {
+  address: "localhost:8981"
+}
+runner {
+  address: "unix://${CURWD}/runner"
+}
+grpc_server {
+  listen_address: "localhost:8983"
+}
+EOF
+
 # Launch frontend, scheduler, storage, browser and worker.
-"${BBB_SRC}/bazel-bin/cmd/bbb_frontend/${ARCH}/bbb_frontend" \
-    -blobstore-config frontend-worker-blobstore.conf \
-    -scheduler 'local|localhost:8981' \
-    -web.listen-address localhost:7980 &
-"${BBB_SRC}/bazel-bin/cmd/bbb_scheduler/${ARCH}/bbb_scheduler" \
-    -web.listen-address localhost:7981 &
-"${BBB_SRC}/bazel-bin/cmd/bbb_storage/${ARCH}/bbb_storage" \
-    -blobstore-config storage-blobstore.conf \
-    -web.listen-address localhost:7982 &
+"${BBB_SRC}/bazel-bin/cmd/bbb_frontend/${ARCH}/bbb_frontend" frontend.conf &
+"${BBB_SRC}/bazel-bin/cmd/bbb_scheduler/${ARCH}/bbb_scheduler" scheduler.conf &
+"${BBB_SRC}/bazel-bin/cmd/bbb_storage/${ARCH}/bbb_storage" storage.conf &
 (cd "${BBB_SRC}/cmd/bbb_browser" &&
  exec "${BBB_SRC}/bazel-bin/cmd/bbb_browser/${ARCH}/bbb_browser" \
     -blobstore-config "${CURWD}/frontend-worker-blobstore.conf" \
     -web.listen-address localhost:7983) &
-"${BBB_SRC}/bazel-bin/cmd/bbb_worker/${ARCH}/bbb_worker" \
-    -blobstore-config "${CURWD}/frontend-worker-blobstore.conf" \
-    -browser-url http://localhost:7983/ \
-    -build-directory build \
-    -cache-directory cache \
-    -concurrency 4 \
-    -runner "unix://${CURWD}/runner" \
-    -scheduler localhost:8981 \
-    -web.listen-address localhost:7984 &
+"${BBB_SRC}/bazel-bin/cmd/bbb_worker/${ARCH}/bbb_worker" worker.conf &
 "${BBB_SRC}/bazel-bin/cmd/bbb_runner/${ARCH}/bbb_runner" \
     -build-directory build \
     -listen-path "${CURWD}/runner" &
@@ -3,33 +3,50 @@ package ac
 import (
 	"context"
 
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type actionCacheServer struct {
-	actionCache  ActionCache
-	allowUpdates bool
+	actionCache               ActionCache
+	contentAddressableStorage cas.ContentAddressableStorage
+	allowUpdates              bool
 }
 
 // NewActionCacheServer creates a GRPC service for serving the contents
 // of a Bazel Action Cache (AC) to Bazel.
-func NewActionCacheServer(actionCache ActionCache, allowUpdates bool) remoteexecution.ActionCacheServer {
+//
+// If updates are allowed, clients may store action results directly,
+// making it possible to use Buildbarn as a remote cache without remote
+// execution. Standard output and error that are only provided inline
+// are written into the Content Addressable Storage, so that action
+// results always reference them by digest.
+func NewActionCacheServer(actionCache ActionCache, contentAddressableStorage cas.ContentAddressableStorage, allowUpdates bool) remoteexecution.ActionCacheServer {
 	return &actionCacheServer{
-		actionCache:  actionCache,
-		allowUpdates: allowUpdates,
+		actionCache:               actionCache,
+		contentAddressableStorage: contentAddressableStorage,
+		allowUpdates:              allowUpdates,
 	}
 }
 
 func (s *actionCacheServer) GetActionResult(ctx context.Context, in *remoteexecution.GetActionResultRequest) (*remoteexecution.ActionResult, error) {
 	digest, err := util.NewDigest(in.InstanceName, in.ActionDigest)
 	if err != nil {
-		return nil, err
+		return nil, util.StatusWrapWithCode(err, codes.InvalidArgument, "Invalid action digest")
+	}
+	actionResult, err := s.actionCache.GetActionResult(ctx, digest)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, err
+		}
+		return nil, util.StatusWrap(err, "Failed to obtain action result")
 	}
-	return s.actionCache.GetActionResult(ctx, digest)
+	return actionResult, nil
 }
 
 func (s *actionCacheServer) UpdateActionResult(ctx context.Context, in *remoteexecution.UpdateActionResultRequest) (*remoteexecution.ActionResult, error) {
@@ -38,7 +55,61 @@ func (s *actionCacheServer) UpdateActionResult(ctx context.Context, in *remoteex
 	}
 	digest, err := util.NewDigest(in.InstanceName, in.ActionDigest)
 	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.InvalidArgument, "Invalid action digest")
+	}
+	if in.ActionResult == nil {
+		return nil, status.Error(codes.InvalidArgument, "No action result provided")
+	}
+	actionResult := proto.Clone(in.ActionResult).(*remoteexecution.ActionResult)
+	if err := validateActionResult(digest, actionResult); err != nil {
 		return nil, err
 	}
-	return in.ActionResult, s.actionCache.PutActionResult(ctx, digest, in.ActionResult)
+
+	// Store inline logs in the Content Addressable Storage.
+	if len(actionResult.StdoutRaw) > 0 && actionResult.StdoutDigest == nil {
+		stdoutDigest, err := s.contentAddressableStorage.PutLog(ctx, actionResult.StdoutRaw, digest)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to store standard output")
+		}
+		actionResult.StdoutDigest = stdoutDigest.GetPartialDigest()
+	}
+	if len(actionResult.StderrRaw) > 0 && actionResult.StderrDigest == nil {
+		stderrDigest, err := s.contentAddressableStorage.PutLog(ctx, actionResult.StderrRaw, digest)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to store standard error")
+		}
+		actionResult.StderrDigest = stderrDigest.GetPartialDigest()
+	}
+
+	if err := s.actionCache.PutActionResult(ctx, digest, actionResult); err != nil {
+		return nil, util.StatusWrap(err, "Failed to store action result")
+	}
+	return actionResult, nil
+}
+
+// validateActionResult checks that all digests referenced by an action
+// result are well-formed.
+func validateActionResult(actionDigest *util.Digest, actionResult *remoteexecution.ActionResult) error {
+	instance := actionDigest.GetInstance()
+	for _, outputFile := range actionResult.OutputFiles {
+		if _, err := util.NewDigest(instance, outputFile.Digest); err != nil {
+			return util.StatusWrapfWithCode(err, codes.InvalidArgument, "Invalid digest for output file %#v", outputFile.Path)
+		}
+	}
+	for _, outputDirectory := range actionResult.OutputDirectories {
+		if _, err := util.NewDigest(instance, outputDirectory.TreeDigest); err != nil {
+			return util.StatusWrapfWithCode(err, codes.InvalidArgument, "Invalid tree digest for output directory %#v", outputDirectory.Path)
+		}
+	}
+	if actionResult.StdoutDigest != nil {
+		if _, err := util.NewDigest(instance, actionResult.StdoutDigest); err != nil {
+			return util.StatusWrapWithCode(err, codes.InvalidArgument, "Invalid standard output digest")
+		}
+	}
+	if actionResult.StderrDigest != nil {
+		if _, err := util.NewDigest(instance, actionResult.StderrDigest); err != nil {
+			return util.StatusWrapWithCode(err, codes.InvalidArgument, "Invalid standard error digest")
+		}
+	}
+	return nil
 }
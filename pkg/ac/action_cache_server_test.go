@@ -0,0 +1,108 @@
+package ac_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestActionCacheServerGetActionResult(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionCache := mock.NewMockActionCache(ctrl)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	actionCacheServer := ac.NewActionCacheServer(actionCache, contentAddressableStorage, false)
+
+	// Malformed digests should be rejected.
+	_, err := actionCacheServer.GetActionResult(ctx, &remoteexecution.GetActionResultRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "Hello",
+			SizeBytes: 11,
+		},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Absence of an action result should be reported as is.
+	actionDigest := &remoteexecution.Digest{
+		Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+		SizeBytes: 11,
+	}
+	actionCache.EXPECT().GetActionResult(ctx, util.MustNewDigest("debian8", actionDigest)).Return(nil, status.Error(codes.NotFound, "Blob not found"))
+	_, err = actionCacheServer.GetActionResult(ctx, &remoteexecution.GetActionResultRequest{
+		InstanceName: "debian8",
+		ActionDigest: actionDigest,
+	})
+	require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+}
+
+func TestActionCacheServerUpdateActionResultDisallowed(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionCache := mock.NewMockActionCache(ctrl)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	actionCacheServer := ac.NewActionCacheServer(actionCache, contentAddressableStorage, false)
+
+	_, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+		ActionResult: &remoteexecution.ActionResult{},
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestActionCacheServerUpdateActionResultInlineLogs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionCache := mock.NewMockActionCache(ctrl)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	actionCacheServer := ac.NewActionCacheServer(actionCache, contentAddressableStorage, true)
+
+	// Standard output that is only provided inline should be
+	// written into the Content Addressable Storage. Standard error
+	// that already has a digest should be left alone.
+	actionDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+		SizeBytes: 11,
+	})
+	stdoutDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "315f5bdb76d078c43b8ac0064e4a0164612b1fce77c869345bfc94c75894edd3",
+		SizeBytes: 13,
+	})
+	stderrDigest := &remoteexecution.Digest{
+		Hash:      "cf5b8b98bd7bd3c7fcbb0d2e5c5f43ec6fae7d2a0bc8e1b6a96d9cd2bd8ac8e9",
+		SizeBytes: 18,
+	}
+	contentAddressableStorage.EXPECT().PutLog(ctx, []byte("Hello, world!"), actionDigest).Return(stdoutDigest, nil)
+	expectedActionResult := &remoteexecution.ActionResult{
+		StdoutRaw:    []byte("Hello, world!"),
+		StdoutDigest: stdoutDigest.GetPartialDigest(),
+		StderrRaw:    []byte("Compilation failed"),
+		StderrDigest: stderrDigest,
+	}
+	actionCache.EXPECT().PutActionResult(ctx, actionDigest, expectedActionResult).Return(nil)
+
+	actionResult, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+		InstanceName: "debian8",
+		ActionDigest: actionDigest.GetPartialDigest(),
+		ActionResult: &remoteexecution.ActionResult{
+			StdoutRaw:    []byte("Hello, world!"),
+			StderrRaw:    []byte("Compilation failed"),
+			StderrDigest: stderrDigest,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, expectedActionResult, actionResult)
+}
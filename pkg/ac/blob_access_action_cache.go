@@ -1,12 +1,11 @@
 package ac
 
 import (
-	"bytes"
 	"context"
 	"io/ioutil"
-	"log"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/protobuf/proto"
@@ -40,10 +39,11 @@ func (ac *blobAccessActionCache) GetActionResult(ctx context.Context, digest *ut
 	if err := proto.Unmarshal(data, &actionResult); err != nil {
 		// Malformed data stored in the Action Cache. Attempt to
 		// delete the data and report it as if absent.
+		logger := logging.FromContext(ctx).WithField(logging.BlobDigestField, digest.String())
 		if err := ac.blobAccess.Delete(ctx, digest); err == nil {
-			log.Printf("Successfully deleted corrupted blob %s", digest)
+			logger.Info("Successfully deleted corrupted blob")
 		} else {
-			log.Printf("Failed to delete corrupted blob %s: %s", digest, err)
+			logger.WithError(err).Warn("Failed to delete corrupted blob")
 		}
 		return nil, util.StatusWrapWithCode(err, codes.NotFound, "Failed to unmarshal message")
 	}
@@ -55,5 +55,5 @@ func (ac *blobAccessActionCache) PutActionResult(ctx context.Context, digest *ut
 	if err != nil {
 		return util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to marshal message")
 	}
-	return ac.blobAccess.Put(ctx, digest, int64(len(data)), ioutil.NopCloser(bytes.NewBuffer(data)))
+	return ac.blobAccess.Put(ctx, digest, int64(len(data)), blobstore.NewBytesReader(data))
 }
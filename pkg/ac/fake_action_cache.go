@@ -0,0 +1,105 @@
+package ac
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FakeActionCache is an in-memory implementation of ActionCache that
+// is intended to be used in unit tests. Faults may be injected by
+// delaying operations or letting them fail with a given error.
+//
+// Action results are copied when stored and returned, so that tests
+// cannot accidentally modify them after the fact.
+type FakeActionCache struct {
+	digestKeyFormat util.DigestKeyFormat
+
+	lock          sync.Mutex
+	actionResults map[string]*remoteexecution.ActionResult
+	latency       time.Duration
+	errors        map[string]error
+}
+
+// NewFakeActionCache creates an empty FakeActionCache that stores
+// action results under keys of a given format.
+func NewFakeActionCache(digestKeyFormat util.DigestKeyFormat) *FakeActionCache {
+	return &FakeActionCache{
+		digestKeyFormat: digestKeyFormat,
+		actionResults:   map[string]*remoteexecution.ActionResult{},
+		errors:          map[string]error{},
+	}
+}
+
+// SetLatency causes all subsequent operations to be delayed by a
+// fixed amount of time. Operations are interrupted if their context
+// is cancelled while being delayed.
+func (ac *FakeActionCache) SetLatency(latency time.Duration) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	ac.latency = latency
+}
+
+// SetError causes all subsequent calls to an operation (i.e.,
+// "GetActionResult" or "PutActionResult") to fail with a given error.
+// Passing a nil error lets the operation succeed once again.
+func (ac *FakeActionCache) SetError(operation string, err error) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	if err == nil {
+		delete(ac.errors, operation)
+	} else {
+		ac.errors[operation] = err
+	}
+}
+
+// startOperation applies the latency and error that have been
+// injected for an operation.
+func (ac *FakeActionCache) startOperation(ctx context.Context, operation string) error {
+	ac.lock.Lock()
+	latency, err := ac.latency, ac.errors[operation]
+	ac.lock.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+func (ac *FakeActionCache) GetActionResult(ctx context.Context, digest *util.Digest) (*remoteexecution.ActionResult, error) {
+	if err := ac.startOperation(ctx, "GetActionResult"); err != nil {
+		return nil, err
+	}
+
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	actionResult, ok := ac.actionResults[digest.GetKey(ac.digestKeyFormat)]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Action result not found")
+	}
+	return proto.Clone(actionResult).(*remoteexecution.ActionResult), nil
+}
+
+func (ac *FakeActionCache) PutActionResult(ctx context.Context, digest *util.Digest, result *remoteexecution.ActionResult) error {
+	if err := ac.startOperation(ctx, "PutActionResult"); err != nil {
+		return err
+	}
+
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	ac.actionResults[digest.GetKey(ac.digestKeyFormat)] = proto.Clone(result).(*remoteexecution.ActionResult)
+	return nil
+}
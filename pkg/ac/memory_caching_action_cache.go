@@ -0,0 +1,117 @@
+package ac
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	memoryCachingActionCacheOperationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "ac",
+			Name:      "memory_caching_action_cache_operations_total",
+			Help:      "Total number of operations against the memory caching action cache.",
+		},
+		[]string{"result"})
+	memoryCachingActionCacheOperationsTotalHit  = memoryCachingActionCacheOperationsTotal.WithLabelValues("Hit")
+	memoryCachingActionCacheOperationsTotalMiss = memoryCachingActionCacheOperationsTotal.WithLabelValues("Miss")
+)
+
+func init() {
+	prometheus.MustRegister(memoryCachingActionCacheOperationsTotal)
+}
+
+type memoryCachedActionResult struct {
+	key    string
+	result *remoteexecution.ActionResult
+}
+
+type memoryCachingActionCache struct {
+	base ActionCache
+
+	lock sync.Mutex
+
+	digestKeyFormat util.DigestKeyFormat
+	maxResults      int
+
+	// Action results, ordered from most recently used (front) to
+	// least recently used (back).
+	resultsList    *list.List
+	resultsPresent map[string]*list.Element
+}
+
+// NewMemoryCachingActionCache is an adapter for ActionCache that keeps a
+// fixed number of recently stored or retrieved action results in
+// memory, evicting them in least recently used order. When placed in
+// front of the Action Cache used by a worker, this allows actions that
+// are executed repeatedly (e.g., by retry loops of flaky tests) to be
+// served without contacting the storage backend.
+func NewMemoryCachingActionCache(base ActionCache, digestKeyFormat util.DigestKeyFormat, maxResults int) ActionCache {
+	return &memoryCachingActionCache{
+		base: base,
+
+		digestKeyFormat: digestKeyFormat,
+		maxResults:      maxResults,
+
+		resultsList:    list.New(),
+		resultsPresent: map[string]*list.Element{},
+	}
+}
+
+func (ac *memoryCachingActionCache) insert(key string, result *remoteexecution.ActionResult) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	if element, ok := ac.resultsPresent[key]; ok {
+		element.Value.(*memoryCachedActionResult).result = result
+		ac.resultsList.MoveToFront(element)
+		return
+	}
+	for ac.resultsList.Len() >= ac.maxResults && ac.resultsList.Len() > 0 {
+		element := ac.resultsList.Back()
+		delete(ac.resultsPresent, element.Value.(*memoryCachedActionResult).key)
+		ac.resultsList.Remove(element)
+	}
+	ac.resultsPresent[key] = ac.resultsList.PushFront(&memoryCachedActionResult{
+		key:    key,
+		result: result,
+	})
+}
+
+func (ac *memoryCachingActionCache) GetActionResult(ctx context.Context, digest *util.Digest) (*remoteexecution.ActionResult, error) {
+	key := digest.GetKey(ac.digestKeyFormat)
+
+	// Check the cache.
+	ac.lock.Lock()
+	if element, ok := ac.resultsPresent[key]; ok {
+		ac.resultsList.MoveToFront(element)
+		result := element.Value.(*memoryCachedActionResult).result
+		ac.lock.Unlock()
+		memoryCachingActionCacheOperationsTotalHit.Inc()
+		return result, nil
+	}
+	ac.lock.Unlock()
+	memoryCachingActionCacheOperationsTotalMiss.Inc()
+
+	// Not found. Fetch the action result from the backend.
+	result, err := ac.base.GetActionResult(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	ac.insert(key, result)
+	return result, nil
+}
+
+func (ac *memoryCachingActionCache) PutActionResult(ctx context.Context, digest *util.Digest, result *remoteexecution.ActionResult) error {
+	if err := ac.base.PutActionResult(ctx, digest, result); err != nil {
+		return err
+	}
+	ac.insert(digest.GetKey(ac.digestKeyFormat), result)
+	return nil
+}
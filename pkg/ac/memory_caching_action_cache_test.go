@@ -0,0 +1,62 @@
+package ac_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMemoryCachingActionCache(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseActionCache := mock.NewMockActionCache(ctrl)
+	actionCache := ac.NewMemoryCachingActionCache(baseActionCache, util.DigestKeyWithInstance, 1)
+
+	digest1 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+		SizeBytes: 11,
+	})
+	digest2 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "f11999245771a5c184b62dc5380e0d8b42df67b5d8cd8a9fc2ed57a7e2f1d5e5",
+		SizeBytes: 42,
+	})
+
+	// Results that are stored should be returned without
+	// contacting the backend.
+	result1 := &remoteexecution.ActionResult{ExitCode: 1}
+	baseActionCache.EXPECT().PutActionResult(ctx, digest1, result1).Return(nil)
+	require.NoError(t, actionCache.PutActionResult(ctx, digest1, result1))
+	result, err := actionCache.GetActionResult(ctx, digest1)
+	require.NoError(t, err)
+	require.Equal(t, result1, result)
+
+	// Failures to fetch results should be propagated.
+	baseActionCache.EXPECT().GetActionResult(ctx, digest2).Return(nil, status.Error(codes.NotFound, "Blob not found"))
+	_, err = actionCache.GetActionResult(ctx, digest2)
+	require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+
+	// Fetching a result from the backend should evict the least
+	// recently used result.
+	result2 := &remoteexecution.ActionResult{ExitCode: 2}
+	baseActionCache.EXPECT().GetActionResult(ctx, digest2).Return(result2, nil)
+	result, err = actionCache.GetActionResult(ctx, digest2)
+	require.NoError(t, err)
+	require.Equal(t, result2, result)
+	result, err = actionCache.GetActionResult(ctx, digest2)
+	require.NoError(t, err)
+	require.Equal(t, result2, result)
+
+	baseActionCache.EXPECT().GetActionResult(ctx, digest1).Return(result1, nil)
+	result, err = actionCache.GetActionResult(ctx, digest1)
+	require.NoError(t, err)
+	require.Equal(t, result1, result)
+}
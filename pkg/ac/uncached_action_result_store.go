@@ -0,0 +1,68 @@
+package ac
+
+import (
+	"context"
+	"io/ioutil"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/failure"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+)
+
+// UncachedActionResultStore provides access to results of actions that
+// may not be stored in the Action Cache, such as failed actions and
+// actions that have do_not_cache set. Entries are keyed by the digest
+// of their contents.
+type UncachedActionResultStore interface {
+	GetUncachedActionResult(ctx context.Context, digest *util.Digest) (*failure.UncachedActionResult, error)
+	PutUncachedActionResult(ctx context.Context, result *failure.UncachedActionResult, parentDigest *util.Digest) (*util.Digest, error)
+}
+
+type blobAccessUncachedActionResultStore struct {
+	blobAccess blobstore.BlobAccess
+}
+
+// NewBlobAccessUncachedActionResultStore creates an
+// UncachedActionResultStore that reads and writes entries from a
+// BlobAccess based store.
+func NewBlobAccessUncachedActionResultStore(blobAccess blobstore.BlobAccess) UncachedActionResultStore {
+	return &blobAccessUncachedActionResultStore{
+		blobAccess: blobAccess,
+	}
+}
+
+func (s *blobAccessUncachedActionResultStore) GetUncachedActionResult(ctx context.Context, digest *util.Digest) (*failure.UncachedActionResult, error) {
+	_, r, err := s.blobAccess.Get(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	var result failure.UncachedActionResult
+	if err := proto.Unmarshal(data, &result); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.NotFound, "Failed to unmarshal message")
+	}
+	return &result, nil
+}
+
+func (s *blobAccessUncachedActionResultStore) PutUncachedActionResult(ctx context.Context, result *failure.UncachedActionResult, parentDigest *util.Digest) (*util.Digest, error) {
+	data, err := proto.Marshal(result)
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to marshal message")
+	}
+	digestGenerator := parentDigest.NewDigestGenerator()
+	if _, err := digestGenerator.Write(data); err != nil {
+		return nil, err
+	}
+	digest := digestGenerator.Sum()
+	if err := s.blobAccess.Put(ctx, digest, digest.GetSizeBytes(), blobstore.NewBytesReader(data)); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
@@ -0,0 +1,60 @@
+package ac_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/failure"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobAccessUncachedActionResultStorePutGet(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	store := ac.NewBlobAccessUncachedActionResultStore(blobAccess)
+
+	uncachedActionResult := &failure.UncachedActionResult{
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+		ActionResult: &remoteexecution.ActionResult{
+			ExitCode: 1,
+		},
+	}
+
+	// Entries should be stored under the digest of their contents,
+	// using the instance name of the action.
+	var storedDigest *util.Digest
+	var storedData []byte
+	blobAccess.EXPECT().Put(ctx, gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+			data, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, sizeBytes, int64(len(data)))
+			storedDigest = digest
+			storedData = data
+			return nil
+		})
+	digest, err := store.PutUncachedActionResult(ctx, uncachedActionResult, util.MustNewDigest("debian8", uncachedActionResult.ActionDigest))
+	require.NoError(t, err)
+	require.Equal(t, storedDigest, digest)
+	require.Equal(t, "debian8", digest.GetInstance())
+
+	// Reading the entry back should yield the original message.
+	blobAccess.EXPECT().Get(ctx, digest).Return(int64(len(storedData)), blobstore.NewBytesReader(storedData), nil)
+	result, err := store.GetUncachedActionResult(ctx, digest)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(uncachedActionResult, result))
+}
@@ -0,0 +1,23 @@
+package blobstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// AccessTimeStore keeps track of the last time blobs were accessed.
+// It is used by AccessTrackingBlobAccess to provide least recently
+// used (LRU) information for backends that don't track access times
+// natively, such as S3.
+type AccessTimeStore interface {
+	// Touch sets the access time of a set of blobs.
+	Touch(ctx context.Context, digests []*util.Digest, accessTime time.Time) error
+	// GetAccessTimes returns the access times of a set of blobs.
+	// The zero time is returned for blobs whose access time is
+	// unknown.
+	GetAccessTimes(ctx context.Context, digests []*util.Digest) ([]time.Time, error)
+	// Remove discards the access time of a blob.
+	Remove(ctx context.Context, digest *util.Digest) error
+}
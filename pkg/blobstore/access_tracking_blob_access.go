@@ -0,0 +1,128 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// accessTrackingListBatchSize is the number of blobs for which access
+// times are looked up at once when listing.
+const accessTrackingListBatchSize = 1000
+
+type accessTrackingBlobAccess struct {
+	blobAccess      BlobAccess
+	accessTimeStore AccessTimeStore
+}
+
+// NewAccessTrackingBlobAccess creates an adapter for BlobAccess that
+// records the last time blobs were accessed in an AccessTimeStore.
+// Blobs are considered to be accessed when they are read, written or
+// reported as present by FindMissing().
+//
+// Access times are also used when listing blobs, meaning that garbage
+// collection considers the last access of a blob instead of the time
+// at which it was written.
+func NewAccessTrackingBlobAccess(blobAccess BlobAccess, accessTimeStore AccessTimeStore) BlobAccess {
+	return &accessTrackingBlobAccess{
+		blobAccess:      blobAccess,
+		accessTimeStore: accessTimeStore,
+	}
+}
+
+func (ba *accessTrackingBlobAccess) touch(ctx context.Context, digests []*util.Digest) {
+	// Failing to record access times should not cause requests to
+	// fail, as the data itself is still intact.
+	if err := ba.accessTimeStore.Touch(ctx, digests, time.Now()); err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("Failed to record access times of blobs")
+	}
+}
+
+func (ba *accessTrackingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	length, r, err := ba.blobAccess.Get(ctx, digest)
+	if err == nil {
+		ba.touch(ctx, []*util.Digest{digest})
+	}
+	return length, r, err
+}
+
+func (ba *accessTrackingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	if err := ba.blobAccess.Put(ctx, digest, sizeBytes, r); err != nil {
+		return err
+	}
+	ba.touch(ctx, []*util.Digest{digest})
+	return nil
+}
+
+func (ba *accessTrackingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if err := ba.blobAccess.Delete(ctx, digest); err != nil {
+		return err
+	}
+	if err := ba.accessTimeStore.Remove(ctx, digest); err != nil {
+		logging.FromContext(ctx).WithField(logging.BlobDigestField, digest.String()).WithError(err).Warn("Failed to remove access time of blob")
+	}
+	return nil
+}
+
+func (ba *accessTrackingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	missing, err := ba.blobAccess.FindMissing(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+
+	// Touch all blobs that are present, as clients will assume
+	// they remain available.
+	missingKeys := map[string]struct{}{}
+	for _, digest := range missing {
+		missingKeys[digest.GetKey(util.DigestKeyWithInstance)] = struct{}{}
+	}
+	var present []*util.Digest
+	for _, digest := range digests {
+		if _, ok := missingKeys[digest.GetKey(util.DigestKeyWithInstance)]; !ok {
+			present = append(present, digest)
+		}
+	}
+	ba.touch(ctx, present)
+	return missing, nil
+}
+
+func (ba *accessTrackingBlobAccess) List(ctx context.Context, fn BlobListerFunc) error {
+	var digests []*util.Digest
+	var timestamps []time.Time
+	flush := func() error {
+		accessTimes, err := ba.accessTimeStore.GetAccessTimes(ctx, digests)
+		if err != nil {
+			return util.StatusWrap(err, "Failed to get access times of blobs")
+		}
+		for i, digest := range digests {
+			timestamp := timestamps[i]
+			if accessTimes[i].After(timestamp) {
+				timestamp = accessTimes[i]
+			}
+			if err := fn(digest, timestamp); err != nil {
+				return err
+			}
+		}
+		digests = digests[:0]
+		timestamps = timestamps[:0]
+		return nil
+	}
+
+	if err := ListBlobs(ctx, ba.blobAccess, func(digest *util.Digest, timestamp time.Time) error {
+		digests = append(digests, digest)
+		timestamps = append(timestamps, timestamp)
+		if len(digests) >= accessTrackingListBatchSize {
+			return flush()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(digests) > 0 {
+		return flush()
+	}
+	return nil
+}
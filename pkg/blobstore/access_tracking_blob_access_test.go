@@ -0,0 +1,84 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAccessTrackingBlobAccessFindMissing(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	presentDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	missingDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	bottomBlobAccess.EXPECT().FindMissing(
+		ctx, []*util.Digest{presentDigest, missingDigest},
+	).Return([]*util.Digest{
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+			SizeBytes: 7,
+		}),
+	}, nil)
+
+	// Only the blob that is present should have its access time
+	// updated. Failures to do so should not be propagated.
+	accessTimeStore := mock.NewMockAccessTimeStore(ctrl)
+	accessTimeStore.EXPECT().Touch(ctx, []*util.Digest{presentDigest}, gomock.Any()).Return(
+		status.Error(codes.Unavailable, "Connection refused"))
+
+	missing, err := blobstore.NewAccessTrackingBlobAccess(bottomBlobAccess, accessTimeStore).FindMissing(
+		ctx, []*util.Digest{presentDigest, missingDigest})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{missingDigest}, missing)
+}
+
+func TestAccessTrackingBlobAccessGetFailure(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Blobs that could not be read should not be touched.
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+	accessTimeStore := mock.NewMockAccessTimeStore(ctrl)
+
+	_, _, err := blobstore.NewAccessTrackingBlobAccess(bottomBlobAccess, accessTimeStore).Get(ctx, digest)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAccessTrackingBlobAccessDelete(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Deleting a blob should also discard its access time.
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	bottomBlobAccess.EXPECT().Delete(ctx, digest).Return(nil)
+	accessTimeStore := mock.NewMockAccessTimeStore(ctrl)
+	accessTimeStore.EXPECT().Remove(ctx, digest).Return(nil)
+
+	require.NoError(t, blobstore.NewAccessTrackingBlobAccess(bottomBlobAccess, accessTimeStore).Delete(ctx, digest))
+}
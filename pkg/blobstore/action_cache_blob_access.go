@@ -1,7 +1,6 @@
 package blobstore
 
 import (
-	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
@@ -42,7 +41,7 @@ func (ba *actionCacheBlobAccess) Get(ctx context.Context, digest *util.Digest) (
 	if err != nil {
 		return 0, nil, err
 	}
-	return int64(len(data)), ioutil.NopCloser(bytes.NewBuffer(data)), nil
+	return int64(len(data)), NewBytesReader(data), nil
 }
 
 func (ba *actionCacheBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
@@ -2,12 +2,38 @@ package blobstore
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	batchedStoreBlobAccessBlobsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "batched_store_blob_access_blobs_total",
+			Help:      "Total number of blobs provided to batched store, and whether they needed to be uploaded.",
+		},
+		[]string{"result"})
+	batchedStoreBlobAccessBlobsTotalDuplicate = batchedStoreBlobAccessBlobsTotal.WithLabelValues("Duplicate")
+	batchedStoreBlobAccessBlobsTotalPresent   = batchedStoreBlobAccessBlobsTotal.WithLabelValues("Present")
+	batchedStoreBlobAccessBlobsTotalMissing   = batchedStoreBlobAccessBlobsTotal.WithLabelValues("Missing")
 )
 
+func init() {
+	prometheus.MustRegister(batchedStoreBlobAccessBlobsTotal)
+}
+
 type pendingPutOperation struct {
 	digest    *util.Digest
 	sizeBytes int64
@@ -16,39 +42,71 @@ type pendingPutOperation struct {
 
 type batchedStoreBlobAccess struct {
 	BlobAccess
-	blobKeyFormat util.DigestKeyFormat
-	batchSize     int
+	blobKeyFormat  util.DigestKeyFormat
+	batchSize      int
+	putConcurrency int
+	maxRetries     int
 
 	lock                 sync.Mutex
 	pendingPutOperations map[string]pendingPutOperation
+	// Blobs that have been uploaded or were found to be present
+	// since the last explicit flush.
+	flushedDigests map[string]struct{}
 }
 
 // NewBatchedStoreBlobAccess is an adapter for BlobAccess that causes
 // Put() operations to be enqueued. When a sufficient number of
 // operations are enqueued, a FindMissing() call is generated to
 // determine which blobs actually need to be stored. Writes for blobs
-// with the same digest are merged.
+// with the same digest are merged. This also applies to writes for
+// blobs that were already part of an earlier batch, up to the point
+// where the returned flush function is called.
+//
+// Up to putConcurrency missing blobs are uploaded in parallel. Uploads
+// that fail due to transient errors are retried up to maxRetries
+// times, using exponential backoff. Retrying is only possible for
+// blobs whose readers are seekable (e.g., files). Failures of
+// individual uploads are combined into a single error.
 //
 // This adapter may be used by the worker to speed up the uploading
 // phase of actions.
-func NewBatchedStoreBlobAccess(blobAccess BlobAccess, blobKeyFormat util.DigestKeyFormat, batchSize int) (BlobAccess, func(ctx context.Context) error) {
+func NewBatchedStoreBlobAccess(blobAccess BlobAccess, blobKeyFormat util.DigestKeyFormat, batchSize int, putConcurrency int, maxRetries int) (BlobAccess, func(ctx context.Context) error) {
 	ba := &batchedStoreBlobAccess{
 		BlobAccess:           blobAccess,
 		blobKeyFormat:        blobKeyFormat,
 		batchSize:            batchSize,
+		putConcurrency:       putConcurrency,
+		maxRetries:           maxRetries,
 		pendingPutOperations: map[string]pendingPutOperation{},
+		flushedDigests:       map[string]struct{}{},
 	}
 	return ba, func(ctx context.Context) error {
 		ba.lock.Lock()
 		defer ba.lock.Unlock()
-		return ba.flushLocked(ctx)
+		err := ba.flushLocked(ctx)
+		ba.flushedDigests = map[string]struct{}{}
+		return err
 	}
 }
 
 func (ba *batchedStoreBlobAccess) flushLocked(ctx context.Context) error {
+	if len(ba.pendingPutOperations) == 0 {
+		return nil
+	}
+
+	// Discard all pending operations, regardless of whether
+	// uploading succeeds.
+	pendingPutOperations := ba.pendingPutOperations
+	ba.pendingPutOperations = map[string]pendingPutOperation{}
+	defer func() {
+		for _, pendingPutOperation := range pendingPutOperations {
+			pendingPutOperation.r.Close()
+		}
+	}()
+
 	// Determine which blobs are missing.
 	var digests []*util.Digest
-	for _, pendingPutOperation := range ba.pendingPutOperations {
+	for _, pendingPutOperation := range pendingPutOperations {
 		digests = append(digests, pendingPutOperation.digest)
 	}
 	missing, err := ba.BlobAccess.FindMissing(ctx, digests)
@@ -56,25 +114,106 @@ func (ba *batchedStoreBlobAccess) flushLocked(ctx context.Context) error {
 		return err
 	}
 
-	// Upload the missing ones.
+	// Upload the missing ones in parallel.
+	var (
+		wg          sync.WaitGroup
+		resultsLock sync.Mutex
+		failures    []string
+		firstErr    error
+	)
+	semaphore := make(chan struct{}, ba.putConcurrency)
 	for _, digest := range missing {
 		key := digest.GetKey(ba.blobKeyFormat)
-		if pendingPutOperation, ok := ba.pendingPutOperations[key]; ok {
-			delete(ba.pendingPutOperations, key)
-			if err := ba.BlobAccess.Put(ctx, pendingPutOperation.digest, pendingPutOperation.sizeBytes, pendingPutOperation.r); err != nil {
-				return err
-			}
+		pendingPutOperation, ok := pendingPutOperations[key]
+		if !ok {
+			continue
 		}
+		delete(pendingPutOperations, key)
+		batchedStoreBlobAccessBlobsTotalMissing.Inc()
+
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(key string, pendingPutOperation pendingPutOperation) {
+			err := ba.putWithRetries(ctx, pendingPutOperation)
+			resultsLock.Lock()
+			if err == nil {
+				ba.flushedDigests[key] = struct{}{}
+			} else {
+				if firstErr == nil {
+					firstErr = err
+				}
+				failures = append(failures, fmt.Sprintf("%s: %s", pendingPutOperation.digest, status.Convert(err).Message()))
+			}
+			resultsLock.Unlock()
+			<-semaphore
+			wg.Done()
+		}(key, pendingPutOperation)
 	}
+	wg.Wait()
 
-	// Discard the others.
-	for _, pendingPutOperation := range ba.pendingPutOperations {
-		pendingPutOperation.r.Close()
+	// The others are already present.
+	for key := range pendingPutOperations {
+		batchedStoreBlobAccessBlobsTotalPresent.Inc()
+		ba.flushedDigests[key] = struct{}{}
+	}
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return status.Errorf(status.Code(firstErr), "Failed to store %d blob(s): %s", len(failures), strings.Join(failures, ", "))
 	}
-	ba.pendingPutOperations = map[string]pendingPutOperation{}
 	return nil
 }
 
+// isTransientError returns whether an error returned by a backend is
+// likely to disappear when retried.
+func isTransientError(err error) bool {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.ResourceExhausted, codes.Unavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// nopCloseReadSeeker is a wrapper for io.ReadSeeker that prevents the
+// underlying reader from being closed by Put(), so that it may be
+// rewound and used for another attempt.
+type nopCloseReadSeeker struct {
+	io.ReadSeeker
+}
+
+func (r nopCloseReadSeeker) Close() error {
+	return nil
+}
+
+// putWithRetries uploads a single blob. If the blob's reader is
+// seekable, uploads that fail due to transient errors are retried.
+func (ba *batchedStoreBlobAccess) putWithRetries(ctx context.Context, pendingPutOperation pendingPutOperation) error {
+	rs, ok := pendingPutOperation.r.(io.ReadSeeker)
+	if !ok || ba.maxRetries == 0 {
+		return ba.BlobAccess.Put(ctx, pendingPutOperation.digest, pendingPutOperation.sizeBytes, pendingPutOperation.r)
+	}
+	defer pendingPutOperation.r.Close()
+
+	delay := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return util.StatusWrapWithCode(err, codes.Internal, "Failed to rewind blob")
+		}
+		err := ba.BlobAccess.Put(ctx, pendingPutOperation.digest, pendingPutOperation.sizeBytes, nopCloseReadSeeker{ReadSeeker: rs})
+		if err == nil || attempt >= ba.maxRetries || !isTransientError(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
 func (ba *batchedStoreBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
 	// First flush the existing files if there are too many pending.
 	ba.lock.Lock()
@@ -86,9 +225,15 @@ func (ba *batchedStoreBlobAccess) Put(ctx context.Context, digest *util.Digest,
 		}
 	}
 
-	// Discard duplicate writes.
+	// Discard duplicate writes, both against the current batch and
+	// earlier batches.
 	key := digest.GetKey(ba.blobKeyFormat)
 	if _, ok := ba.pendingPutOperations[key]; ok {
+		batchedStoreBlobAccessBlobsTotalDuplicate.Inc()
+		return r.Close()
+	}
+	if _, ok := ba.flushedDigests[key]; ok {
+		batchedStoreBlobAccessBlobsTotalDuplicate.Inc()
 		return r.Close()
 	}
 
@@ -0,0 +1,125 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBatchedStoreBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess, flush := blobstore.NewBatchedStoreBlobAccess(baseBlobAccess, util.DigestKeyWithoutInstance, 2, 1, 0)
+	digestA := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "0cc175b9c0f1b6a831c399e269772661",
+		SizeBytes: 1,
+	})
+	digestB := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "92eb5ffee6ae2fec3ad71c777531578f",
+		SizeBytes: 1,
+	})
+	digestC := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "4a8a08f09d37b73795649038408b5f33",
+		SizeBytes: 1,
+	})
+
+	// Writes for the same blob within a batch should be merged.
+	require.NoError(t, blobAccess.Put(ctx, digestA, 1, ioutil.NopCloser(bytes.NewBufferString("a"))))
+	require.NoError(t, blobAccess.Put(ctx, digestA, 1, ioutil.NopCloser(bytes.NewBufferString("a"))))
+	require.NoError(t, blobAccess.Put(ctx, digestB, 1, ioutil.NopCloser(bytes.NewBufferString("b"))))
+
+	// Exceeding the batch size should cause only the blobs that are
+	// missing to be uploaded.
+	baseBlobAccess.EXPECT().FindMissing(ctx, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+			require.ElementsMatch(t, []*util.Digest{digestA, digestB}, digests)
+			return []*util.Digest{digestB}, nil
+		})
+	baseBlobAccess.EXPECT().Put(ctx, digestB, int64(1), gomock.Any()).Return(nil)
+	require.NoError(t, blobAccess.Put(ctx, digestC, 1, ioutil.NopCloser(bytes.NewBufferString("c"))))
+
+	// Blobs that were part of an earlier batch should not be
+	// checked for existence again.
+	require.NoError(t, blobAccess.Put(ctx, digestA, 1, ioutil.NopCloser(bytes.NewBufferString("a"))))
+	require.NoError(t, blobAccess.Put(ctx, digestB, 1, ioutil.NopCloser(bytes.NewBufferString("b"))))
+
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestC}).Return([]*util.Digest{digestC}, nil)
+	baseBlobAccess.EXPECT().Put(ctx, digestC, int64(1), gomock.Any()).Return(nil)
+	require.NoError(t, flush(ctx))
+
+	// After flushing explicitly, blobs should be checked for
+	// existence once again, as they may have been removed.
+	require.NoError(t, blobAccess.Put(ctx, digestA, 1, ioutil.NopCloser(bytes.NewBufferString("a"))))
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestA}).Return(nil, nil)
+	require.NoError(t, flush(ctx))
+
+	// Flushing without any pending writes should not call into the
+	// backend.
+	require.NoError(t, flush(ctx))
+}
+
+// readSeekCloser is a seekable reader, similar to the ones returned
+// when opening files.
+type readSeekCloser struct {
+	*bytes.Reader
+}
+
+func (r readSeekCloser) Close() error {
+	return nil
+}
+
+func TestBatchedStoreBlobAccessParallelRetries(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess, flush := blobstore.NewBatchedStoreBlobAccess(baseBlobAccess, util.DigestKeyWithoutInstance, 10, 2, 1)
+	digestA := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "0cc175b9c0f1b6a831c399e269772661",
+		SizeBytes: 1,
+	})
+	digestB := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "92eb5ffee6ae2fec3ad71c777531578f",
+		SizeBytes: 1,
+	})
+	require.NoError(t, blobAccess.Put(ctx, digestA, 1, readSeekCloser{Reader: bytes.NewReader([]byte("a"))}))
+	require.NoError(t, blobAccess.Put(ctx, digestB, 1, ioutil.NopCloser(bytes.NewBufferString("b"))))
+
+	// Transient failures should be retried, while other failures
+	// should be reported once all uploads have completed.
+	baseBlobAccess.EXPECT().FindMissing(ctx, gomock.Any()).Return([]*util.Digest{digestA, digestB}, nil)
+	baseBlobAccess.EXPECT().Put(ctx, digestA, int64(1), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+			data, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, []byte("a"), data)
+			return status.Error(codes.Unavailable, "Connection reset by peer")
+		})
+	baseBlobAccess.EXPECT().Put(ctx, digestA, int64(1), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+			data, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, []byte("a"), data)
+			return nil
+		})
+	baseBlobAccess.EXPECT().Put(ctx, digestB, int64(1), gomock.Any()).Return(
+		status.Error(codes.InvalidArgument, "Checksum mismatch"))
+	require.Equal(
+		t,
+		status.Error(codes.InvalidArgument, "Failed to store 1 blob(s): 92eb5ffee6ae2fec3ad71c777531578f-1-debian8: Checksum mismatch"),
+		flush(ctx))
+}
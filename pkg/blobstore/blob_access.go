@@ -10,8 +10,17 @@ import (
 // BlobAccess is an abstraction for a data store that can be used to
 // hold both a Bazel Action Cache (AC) and Content Addressable Storage
 // (CAS).
+//
+// Readers returned by Get() and provided to Put() may implement
+// io.WriterTo, allowing io.Copy() to transfer data without copying it
+// into an intermediate buffer. Implementations that merely forward
+// readers should therefore not wrap them unnecessarily.
 type BlobAccess interface {
+	// Get returns the size of a blob and a reader for its
+	// contents. The caller must close the reader.
 	Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error)
+	// Put stores a blob of a given size. The reader is always
+	// closed, even if an error is returned.
 	Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error
 	Delete(ctx context.Context, digest *util.Digest) error
 	FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error)
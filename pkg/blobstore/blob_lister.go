@@ -0,0 +1,36 @@
+package blobstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BlobListerFunc is the callback type invoked by BlobLister.List() for
+// every object stored in a backend. The timestamp corresponds with the
+// last time the object was written or accessed, depending on what the
+// backend is capable of tracking.
+type BlobListerFunc func(digest *util.Digest, timestamp time.Time) error
+
+// BlobLister is an optional interface that may be implemented by
+// BlobAccess objects whose backends are capable of enumerating the
+// objects they store. It is used by the garbage collector to find
+// blobs that are no longer referenced.
+type BlobLister interface {
+	List(ctx context.Context, fn BlobListerFunc) error
+}
+
+// ListBlobs enumerates all objects stored in a BlobAccess, if it
+// implements BlobLister. An error with code Unimplemented is returned
+// otherwise.
+func ListBlobs(ctx context.Context, blobAccess BlobAccess, fn BlobListerFunc) error {
+	lister, ok := blobAccess.(BlobLister)
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "Storage backend does not support listing of blobs")
+	}
+	return lister.List(ctx, fn)
+}
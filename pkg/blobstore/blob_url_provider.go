@@ -0,0 +1,17 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// BlobURLProvider is implemented by storage backends that permit blobs
+// to be downloaded directly over HTTP (e.g., through presigned URLs).
+// This allows large blobs to be obtained without the data passing
+// through intermediate Buildbarn processes.
+type BlobURLProvider interface {
+	// GetBlobURL returns a URL through which the blob may be
+	// downloaded. It does not check whether the blob exists.
+	GetBlobURL(ctx context.Context, digest *util.Digest) (string, error)
+}
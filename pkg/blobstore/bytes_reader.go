@@ -0,0 +1,23 @@
+package blobstore
+
+import (
+	"bytes"
+	"io"
+)
+
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+// NewBytesReader creates a reader for a blob whose contents are
+// already stored in memory. Unlike ioutil.NopCloser(), the resulting
+// reader preserves support for io.WriterTo and io.Seeker, allowing
+// consumers to copy the data without intermediate buffering and to
+// rewind it when retrying.
+func NewBytesReader(data []byte) io.ReadCloser {
+	return bytesReadCloser{Reader: bytes.NewReader(data)}
+}
+
+func (r bytesReadCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,38 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytesReader(t *testing.T) {
+	r := blobstore.NewBytesReader([]byte("Hello"))
+
+	// The reader should permit copying without intermediate
+	// buffering.
+	writerTo, ok := r.(io.WriterTo)
+	require.True(t, ok)
+	var b bytes.Buffer
+	n, err := writerTo.WriteTo(&b)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+	require.Equal(t, "Hello", b.String())
+
+	// The reader should be rewindable, so that retries can send
+	// the same data once more.
+	seeker, ok := r.(io.Seeker)
+	require.True(t, ok)
+	offset, err := seeker.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), offset)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+
+	require.NoError(t, r.Close())
+}
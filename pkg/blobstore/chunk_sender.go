@@ -0,0 +1,85 @@
+package blobstore
+
+import (
+	"io"
+	"sync"
+)
+
+// ChunkBufferPool is a pool of fixed size buffers that may be used to
+// split blobs into chunks, so that they can be transmitted over gRPC
+// streams. Reusing buffers prevents allocating a new chunk for every
+// message sent.
+type ChunkBufferPool struct {
+	chunkSize int
+	pool      sync.Pool
+}
+
+// NewChunkBufferPool creates a pool of buffers of a given size.
+func NewChunkBufferPool(chunkSize int) *ChunkBufferPool {
+	bp := &ChunkBufferPool{
+		chunkSize: chunkSize,
+	}
+	bp.pool.New = func() interface{} {
+		b := make([]byte, chunkSize)
+		return &b
+	}
+	return bp
+}
+
+// SendInChunks reads all data from a reader and passes it to a
+// callback in chunks of at most the pool's chunk size. Chunks passed
+// to the callback are only valid for the duration of the call, as
+// their underlying memory is reused afterwards.
+//
+// Readers that implement io.WriterTo (e.g., ones backed by memory)
+// have their data sliced up directly, without copying it into a
+// buffer. Other readers are read into a buffer obtained from the
+// pool, filling each chunk entirely before passing it on.
+func (bp *ChunkBufferPool) SendInChunks(r io.Reader, send func(chunk []byte) error) error {
+	_, err := io.Copy(&chunkWriter{pool: bp, send: send}, r)
+	return err
+}
+
+// chunkWriter is an io.Writer that forwards data to a callback in
+// chunks of a bounded size. It implements io.ReaderFrom, so that
+// io.Copy() uses pooled buffers instead of allocating its own.
+type chunkWriter struct {
+	pool *ChunkBufferPool
+	send func(chunk []byte) error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > w.pool.chunkSize {
+			chunk = chunk[:w.pool.chunkSize]
+		}
+		if err := w.send(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (w *chunkWriter) ReadFrom(r io.Reader) (int64, error) {
+	b := w.pool.pool.Get().(*[]byte)
+	defer w.pool.pool.Put(b)
+
+	var total int64
+	for {
+		n, err := io.ReadFull(r, *b)
+		if n > 0 {
+			if err := w.send((*b)[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestChunkBufferPoolSendInChunks(t *testing.T) {
+	chunkPool := blobstore.NewChunkBufferPool(4)
+
+	t.Run("WriterTo", func(t *testing.T) {
+		// Readers backed by memory should be sliced up directly.
+		var chunks []string
+		require.NoError(t, chunkPool.SendInChunks(
+			blobstore.NewBytesReader([]byte("Hello world")),
+			func(chunk []byte) error {
+				chunks = append(chunks, string(chunk))
+				return nil
+			}))
+		require.Equal(t, []string{"Hell", "o wo", "rld"}, chunks)
+	})
+
+	t.Run("Reader", func(t *testing.T) {
+		// Other readers should be read into buffers that are
+		// filled entirely, even if the reader returns less data.
+		var chunks []string
+		require.NoError(t, chunkPool.SendInChunks(
+			iotest.HalfReader(bytes.NewBufferString("Hello world")),
+			func(chunk []byte) error {
+				chunks = append(chunks, string(chunk))
+				return nil
+			}))
+		require.Equal(t, []string{"Hell", "o wo", "rld"}, chunks)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		require.NoError(t, chunkPool.SendInChunks(
+			iotest.HalfReader(&bytes.Buffer{}),
+			func(chunk []byte) error {
+				t.Fatal("Empty readers should not yield any chunks")
+				return nil
+			}))
+	})
+
+	t.Run("SendFailure", func(t *testing.T) {
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Connection closed"),
+			chunkPool.SendInChunks(
+				iotest.HalfReader(bytes.NewBufferString("Hello world")),
+				func(chunk []byte) error {
+					return status.Error(codes.Unavailable, "Connection closed")
+				}))
+	})
+}
@@ -0,0 +1,295 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/chunkmanifest"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type chunkVerifyingBlobAccess struct {
+	BlobAccess
+	manifestBlobAccess BlobAccess
+	minimumSizeBytes   int64
+	chunkSizeBytes     int64
+	maximumRetries     int
+}
+
+// NewChunkVerifyingBlobAccess creates a BlobAccess that stores
+// checksums of fixed-size chunks of large blobs in a separate backend.
+// When such blobs are read, every chunk is validated before it is
+// returned, so that corruption is detected as soon as it occurs,
+// instead of only after the entire blob has been read.
+//
+// Chunks that fail validation or whose transfer fails are fetched
+// again, resuming at the start of the chunk. As BlobAccess does not
+// permit reading parts of blobs, data preceding the chunk is
+// transferred again, but discarded. This spares consumers from having
+// to restart downloads of blobs that are many gigabytes in size.
+//
+// Blobs for which no chunk checksums are present (e.g., because they
+// were written before this adapter was enabled) are returned without
+// validating individual chunks.
+func NewChunkVerifyingBlobAccess(blobAccess BlobAccess, manifestBlobAccess BlobAccess, minimumSizeBytes int64, chunkSizeBytes int64, maximumRetries int) BlobAccess {
+	return &chunkVerifyingBlobAccess{
+		BlobAccess:         blobAccess,
+		manifestBlobAccess: manifestBlobAccess,
+		minimumSizeBytes:   minimumSizeBytes,
+		chunkSizeBytes:     chunkSizeBytes,
+		maximumRetries:     maximumRetries,
+	}
+}
+
+func (ba *chunkVerifyingBlobAccess) getManifest(ctx context.Context, digest *util.Digest) (*chunkmanifest.ChunkManifest, error) {
+	_, r, err := ba.manifestBlobAccess.Get(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	var manifest chunkmanifest.ChunkManifest
+	if err := proto.Unmarshal(data, &manifest); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to unmarshal chunk manifest")
+	}
+
+	// Ensure that the manifest covers the entire blob, so that
+	// the reader doesn't need to perform any bounds checking.
+	if manifest.ChunkSizeBytes <= 0 {
+		return nil, status.Errorf(codes.Internal, "Chunk manifest has invalid chunk size %d", manifest.ChunkSizeBytes)
+	}
+	expectedChunks := (digest.GetSizeBytes() + manifest.ChunkSizeBytes - 1) / manifest.ChunkSizeBytes
+	if int64(len(manifest.ChunkChecksums)) != expectedChunks {
+		return nil, status.Errorf(codes.Internal, "Chunk manifest contains %d checksums, while %d were expected", len(manifest.ChunkChecksums), expectedChunks)
+	}
+	return &manifest, nil
+}
+
+func (ba *chunkVerifyingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	if digest.GetSizeBytes() < ba.minimumSizeBytes {
+		return ba.BlobAccess.Get(ctx, digest)
+	}
+	manifest, err := ba.getManifest(ctx, digest)
+	if err != nil {
+		if status.Code(err) != codes.NotFound {
+			logging.FromContext(ctx).
+				WithField(logging.BlobDigestField, digest.String()).
+				WithError(err).
+				Warn("Failed to obtain chunk manifest")
+		}
+		return ba.BlobAccess.Get(ctx, digest)
+	}
+	length, r, err := ba.BlobAccess.Get(ctx, digest)
+	if err != nil {
+		return 0, nil, err
+	}
+	return length, &chunkVerifyingReader{
+		ctx:            ctx,
+		blobAccess:     ba.BlobAccess,
+		digest:         digest,
+		manifest:       manifest,
+		maximumRetries: ba.maximumRetries,
+		r:              r,
+		hasher:         digest.NewHasher(),
+	}, nil
+}
+
+func (ba *chunkVerifyingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	if sizeBytes < ba.minimumSizeBytes {
+		return ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+	}
+	hashingReader := &chunkHashingReader{
+		ReadCloser:     r,
+		chunkSizeBytes: ba.chunkSizeBytes,
+		hasher:         digest.NewHasher(),
+	}
+	if err := ba.BlobAccess.Put(ctx, digest, sizeBytes, hashingReader); err != nil {
+		return err
+	}
+
+	// Only store a manifest if the backend consumed the blob
+	// entirely, as the checksums are incomplete otherwise. Failing
+	// to store the manifest is not fatal, as the blob can still be
+	// read without validating individual chunks.
+	manifest := hashingReader.getManifest(sizeBytes)
+	if manifest == nil {
+		return nil
+	}
+	data, err := proto.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := ba.manifestBlobAccess.Put(ctx, digest, int64(len(data)), NewBytesReader(data)); err != nil {
+		logging.FromContext(ctx).
+			WithField(logging.BlobDigestField, digest.String()).
+			WithError(err).
+			Warn("Failed to store chunk manifest")
+	}
+	return nil
+}
+
+// chunkHashingReader computes checksums of fixed-size chunks of a
+// blob while it is being written to storage.
+type chunkHashingReader struct {
+	io.ReadCloser
+
+	chunkSizeBytes int64
+	hasher         hash.Hash
+	chunkOffset    int64
+	sizeBytes      int64
+	checksums      [][]byte
+}
+
+func (r *chunkHashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	for data := p[:n]; len(data) > 0; {
+		writeSizeBytes := r.chunkSizeBytes - r.chunkOffset
+		if dataSizeBytes := int64(len(data)); writeSizeBytes > dataSizeBytes {
+			writeSizeBytes = dataSizeBytes
+		}
+		r.hasher.Write(data[:writeSizeBytes])
+		data = data[writeSizeBytes:]
+		r.chunkOffset += writeSizeBytes
+		r.sizeBytes += writeSizeBytes
+		if r.chunkOffset == r.chunkSizeBytes {
+			r.checksums = append(r.checksums, r.hasher.Sum(nil))
+			r.hasher.Reset()
+			r.chunkOffset = 0
+		}
+	}
+	return n, err
+}
+
+func (r *chunkHashingReader) getManifest(sizeBytes int64) *chunkmanifest.ChunkManifest {
+	if r.sizeBytes != sizeBytes {
+		return nil
+	}
+	checksums := r.checksums
+	if r.chunkOffset > 0 {
+		checksums = append(checksums, r.hasher.Sum(nil))
+	}
+	return &chunkmanifest.ChunkManifest{
+		ChunkSizeBytes: r.chunkSizeBytes,
+		ChunkChecksums: checksums,
+	}
+}
+
+// chunkVerifyingReader reads a blob one chunk at a time, only returning
+// data belonging to chunks whose checksum has been validated.
+type chunkVerifyingReader struct {
+	ctx            context.Context
+	blobAccess     BlobAccess
+	digest         *util.Digest
+	manifest       *chunkmanifest.ChunkManifest
+	maximumRetries int
+
+	// Reader positioned at the start of the next chunk, or nil if
+	// the blob needs to be fetched again.
+	r          io.ReadCloser
+	hasher     hash.Hash
+	chunkIndex int
+	offset     int64
+	chunk      []byte
+	buffered   []byte
+}
+
+func (r *chunkVerifyingReader) Read(p []byte) (int, error) {
+	if len(r.buffered) == 0 {
+		if r.chunkIndex >= len(r.manifest.ChunkChecksums) {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buffered)
+	r.buffered = r.buffered[n:]
+	return n, nil
+}
+
+func (r *chunkVerifyingReader) readChunk() error {
+	chunkSizeBytes := r.manifest.ChunkSizeBytes
+	if sizeLeft := r.digest.GetSizeBytes() - r.offset; chunkSizeBytes > sizeLeft {
+		chunkSizeBytes = sizeLeft
+	}
+	if int64(cap(r.chunk)) < chunkSizeBytes {
+		r.chunk = make([]byte, chunkSizeBytes)
+	}
+	chunk := r.chunk[:chunkSizeBytes]
+
+	for attempt := 0; ; attempt++ {
+		err := r.tryReadChunk(chunk)
+		if err == nil {
+			r.buffered = chunk
+			r.chunkIndex++
+			r.offset += chunkSizeBytes
+			return nil
+		}
+
+		// Discard the current reader, so that the next attempt
+		// fetches the blob again.
+		if r.r != nil {
+			r.r.Close()
+			r.r = nil
+		}
+		if attempt >= r.maximumRetries || r.ctx.Err() != nil {
+			return err
+		}
+		logging.FromContext(r.ctx).
+			WithField(logging.BlobDigestField, r.digest.String()).
+			WithField("chunk", r.chunkIndex).
+			WithError(err).
+			Warn("Retrying transfer of chunk")
+	}
+}
+
+func (r *chunkVerifyingReader) tryReadChunk(chunk []byte) error {
+	if r.r == nil {
+		_, newR, err := r.blobAccess.Get(r.ctx, r.digest)
+		if err != nil {
+			return err
+		}
+		r.r = newR
+		if _, err := io.CopyN(ioutil.Discard, r.r, r.offset); err != nil {
+			return util.StatusWrap(err, "Failed to skip over previously validated chunks")
+		}
+	}
+	if _, err := io.ReadFull(r.r, chunk); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return status.Errorf(codes.Internal, "Blob is shorter than expected while reading chunk %d", r.chunkIndex)
+		}
+		return err
+	}
+
+	r.hasher.Reset()
+	r.hasher.Write(chunk)
+	actualChecksum := r.hasher.Sum(nil)
+	if expectedChecksum := r.manifest.ChunkChecksums[r.chunkIndex]; !bytes.Equal(actualChecksum, expectedChecksum) {
+		return status.Errorf(
+			codes.Internal,
+			"Checksum of chunk %d is %s, while %s was expected",
+			r.chunkIndex,
+			hex.EncodeToString(actualChecksum),
+			hex.EncodeToString(expectedChecksum))
+	}
+	return nil
+}
+
+func (r *chunkVerifyingReader) Close() error {
+	if r.r == nil {
+		return nil
+	}
+	return r.r.Close()
+}
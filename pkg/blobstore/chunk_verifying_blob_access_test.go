@@ -0,0 +1,104 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestChunkVerifyingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "b10a8db164e0754105b7a99be72e3fe5",
+		SizeBytes: 11,
+	})
+	manifestBlobAccess := blobstore.NewFakeBlobAccess(util.DigestKeyWithInstance)
+
+	// Storing a blob should cause checksums of chunks of four
+	// bytes to be written to the manifest storage.
+	storageBlobAccess := blobstore.NewFakeBlobAccess(util.DigestKeyWithInstance)
+	blobAccess := blobstore.NewChunkVerifyingBlobAccess(storageBlobAccess, manifestBlobAccess, 8, 4, 1)
+	require.NoError(t, blobAccess.Put(ctx, digest, 11, blobstore.NewBytesReader([]byte("Hello World"))))
+	_, ok := manifestBlobAccess.GetContents(digest)
+	require.True(t, ok)
+
+	_, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello World"), data)
+	require.NoError(t, r.Close())
+
+	t.Run("SmallBlob", func(t *testing.T) {
+		// No checksums should be stored for small blobs.
+		smallDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		})
+		require.NoError(t, blobAccess.Put(ctx, smallDigest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+		_, ok := manifestBlobAccess.GetContents(smallDigest)
+		require.False(t, ok)
+	})
+
+	t.Run("RetryCorruptedChunk", func(t *testing.T) {
+		// The second chunk is corrupted during the first
+		// transfer. It should be fetched again, skipping the
+		// first chunk that has already been returned.
+		bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+		gomock.InOrder(
+			bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(11), ioutil.NopCloser(bytes.NewBufferString("Hello_World")), nil),
+			bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(11), ioutil.NopCloser(bytes.NewBufferString("Hello World")), nil))
+		blobAccess := blobstore.NewChunkVerifyingBlobAccess(bottomBlobAccess, manifestBlobAccess, 8, 4, 1)
+
+		_, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello World"), data)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("RetriesExhausted", func(t *testing.T) {
+		// Data from chunks preceding the corrupted chunk
+		// should still be returned.
+		bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+		bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(11), ioutil.NopCloser(bytes.NewBufferString("Hello_World")), nil).Times(2)
+		blobAccess := blobstore.NewChunkVerifyingBlobAccess(bottomBlobAccess, manifestBlobAccess, 8, 4, 1)
+
+		_, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.Equal(t, []byte("Hell"), data)
+		s := status.Convert(err)
+		require.Equal(t, codes.Internal, s.Code())
+		require.Contains(t, s.Message(), "Checksum of chunk 1 is ")
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("MissingManifest", func(t *testing.T) {
+		// Blobs without a manifest should be returned as is.
+		bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+		bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(11), ioutil.NopCloser(bytes.NewBufferString("Hello_World")), nil)
+		blobAccess := blobstore.NewChunkVerifyingBlobAccess(bottomBlobAccess, blobstore.NewFakeBlobAccess(util.DigestKeyWithInstance), 8, 4, 1)
+
+		_, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello_World"), data)
+		require.NoError(t, r.Close())
+	})
+}
@@ -0,0 +1,41 @@
+package circular
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyFileToWriter copies a region of a file to a writer using
+// sendfile(), if both are files. It returns false if the copy was not
+// attempted, in which case the caller should fall back to copying the
+// data through userspace.
+func copyFileToWriter(w io.Writer, r ReadWriterAt, offset int64, length int64) (int64, bool, error) {
+	wf, ok := w.(*os.File)
+	if !ok {
+		return 0, false, nil
+	}
+	rf, ok := r.(*os.File)
+	if !ok {
+		return 0, false, nil
+	}
+
+	var written int64
+	for written < length {
+		n, err := unix.Sendfile(int(wf.Fd()), int(rf.Fd()), &offset, int(length-written))
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		} else if err != nil {
+			if written == 0 && (err == unix.EINVAL || err == unix.ENOSYS) {
+				// File types not supported by sendfile().
+				return 0, false, nil
+			}
+			return written, true, err
+		} else if n == 0 {
+			return written, true, io.ErrUnexpectedEOF
+		}
+		written += int64(n)
+	}
+	return written, true, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package circular
+
+import (
+	"io"
+)
+
+// copyFileToWriter is not implemented on this platform, causing data
+// to always be copied through userspace.
+func copyFileToWriter(w io.Writer, r ReadWriterAt, offset int64, length int64) (int64, bool, error) {
+	return 0, false, nil
+}
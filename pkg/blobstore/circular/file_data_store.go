@@ -21,28 +21,36 @@ func NewFileDataStore(file ReadWriterAt, size uint64) DataStore {
 }
 
 func (ds *fileDataStore) Put(r io.Reader, offset uint64) error {
-	for {
-		// Read data. If at the end of the storage file, limit
-		// the size to ensure proper wrap-around.
-		writeOffset := offset % ds.size
-		var b [65536]byte
-		copyLength := uint64(len(b))
-		if copyLength > ds.size-writeOffset {
-			copyLength = ds.size - writeOffset
-		}
-		n, err := r.Read(b[:])
-		if err == io.EOF {
-			return nil
-		} else if err != nil {
-			return err
-		}
+	// Readers that implement io.WriterTo (e.g., ones backed by
+	// buffers in memory) write into the storage file directly,
+	// without copying the data into an intermediate buffer.
+	_, err := io.Copy(&fileDataStoreWriter{ds: ds, offset: offset}, r)
+	return err
+}
+
+type fileDataStoreWriter struct {
+	ds     *fileDataStore
+	offset uint64
+}
 
-		// Write data to storage.
-		if _, err := ds.file.WriteAt(b[:n], int64(writeOffset)); err != nil {
-			return err
+func (f *fileDataStoreWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		// If at the end of the storage file, limit the size to
+		// ensure proper wrap-around.
+		writeOffset := f.offset % f.ds.size
+		writeLength := uint64(len(b))
+		if writeLength > f.ds.size-writeOffset {
+			writeLength = f.ds.size - writeOffset
+		}
+		if _, err := f.ds.file.WriteAt(b[:writeLength], int64(writeOffset)); err != nil {
+			return written, err
 		}
-		offset += uint64(n)
+		f.offset += writeLength
+		b = b[writeLength:]
+		written += int(writeLength)
 	}
+	return written, nil
 }
 
 func (ds *fileDataStore) Get(offset uint64, size int64) io.ReadCloser {
@@ -86,6 +94,35 @@ func (f *fileDataStoreReader) Read(b []byte) (n int, err error) {
 	return int(readLength), nil
 }
 
+// WriteTo copies the remainder of the blob to a writer. When both the
+// storage file and the writer are files, the data may be copied
+// without passing through userspace.
+func (f *fileDataStoreReader) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for f.size > 0 {
+		// Copy up to the end of the storage file.
+		readOffset := f.offset % f.ds.size
+		readLength := f.size
+		if readLength > f.ds.size-readOffset {
+			readLength = f.ds.size - readOffset
+		}
+		n, ok, err := copyFileToWriter(w, f.ds.file, int64(readOffset), int64(readLength))
+		if !ok {
+			n, err = io.Copy(w, io.NewSectionReader(f.ds.file, int64(readOffset), int64(readLength)))
+		}
+		f.offset += uint64(n)
+		f.size -= uint64(n)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if uint64(n) != readLength {
+			return total, io.ErrUnexpectedEOF
+		}
+	}
+	return total, nil
+}
+
 func (f *fileDataStoreReader) Close() error {
 	return nil
 }
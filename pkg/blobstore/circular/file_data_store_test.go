@@ -0,0 +1,74 @@
+package circular_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDataStore(t *testing.T) {
+	file, err := ioutil.TempFile("", "data")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	dataStore := circular.NewFileDataStore(file, 10)
+
+	t.Run("PutWrapAround", func(t *testing.T) {
+		// Blobs stored at the end of the file should wrap
+		// around to the start, regardless of whether the
+		// reader implements io.WriterTo.
+		require.NoError(t, dataStore.Put(blobstore.NewBytesReader([]byte("Hello")), 7))
+		data, err := ioutil.ReadAll(dataStore.Get(7, 5))
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+
+		require.NoError(t, dataStore.Put(iotest.OneByteReader(bytes.NewBufferString("World")), 17))
+		data, err = ioutil.ReadAll(dataStore.Get(7, 5))
+		require.NoError(t, err)
+		require.Equal(t, []byte("World"), data)
+	})
+
+	t.Run("WriteToBuffer", func(t *testing.T) {
+		// Readers should implement io.WriterTo, so that
+		// io.Copy() doesn't allocate an intermediate buffer.
+		require.NoError(t, dataStore.Put(blobstore.NewBytesReader([]byte("Buildbarn")), 25))
+		r := dataStore.Get(25, 9)
+		_, ok := r.(io.WriterTo)
+		require.True(t, ok)
+
+		var b bytes.Buffer
+		n, err := io.Copy(&b, r)
+		require.NoError(t, err)
+		require.Equal(t, int64(9), n)
+		require.Equal(t, "Buildbarn", b.String())
+
+		// Successive reads should not return any data.
+		n, err = io.Copy(&b, r)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), n)
+	})
+
+	t.Run("WriteToFile", func(t *testing.T) {
+		// Copying into another file may bypass userspace
+		// entirely. This should also respect wrap-around.
+		output, err := ioutil.TempFile("", "output")
+		require.NoError(t, err)
+		defer os.Remove(output.Name())
+		defer output.Close()
+
+		require.NoError(t, dataStore.Put(blobstore.NewBytesReader([]byte("Buildbarn")), 35))
+		n, err := io.Copy(output, dataStore.Get(35, 9))
+		require.NoError(t, err)
+		require.Equal(t, int64(9), n)
+		data, err := ioutil.ReadFile(output.Name())
+		require.NoError(t, err)
+		require.Equal(t, []byte("Buildbarn"), data)
+	})
+}
@@ -0,0 +1,204 @@
+package blobstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// compressingBlobAccessMagic is prepended to every compressed object,
+// so that objects that were stored before compression was enabled can
+// be told apart from compressed ones.
+const compressingBlobAccessMagic = "\xbbBBZ"
+
+// compressingBlobAccessHeaderSizeBytes is the size of the header that
+// is prepended to every compressed object, containing the magic and
+// the size of the object prior to compression.
+const compressingBlobAccessHeaderSizeBytes = len(compressingBlobAccessMagic) + 8
+
+type compressingBlobAccess struct {
+	BlobAccess
+	level                    int
+	maximumInMemorySizeBytes int64
+}
+
+// NewCompressingBlobAccess is an adapter for BlobAccess that compresses
+// objects using DEFLATE before storing them in a backend. As the size
+// of compressed objects is only known after compressing them, objects
+// are compressed before being stored. Compressed objects up to a given
+// size are kept in memory, while larger ones are written to a
+// temporary file, so that memory usage remains bounded.
+//
+// Objects that lack the header written by this adapter (e.g., because
+// they were stored before compression was enabled) are returned as is.
+//
+// Compressed objects no longer match their digest. This adapter may
+// therefore only be used in front of backends that store objects
+// opaquely (e.g., Redis, S3 or local storage).
+func NewCompressingBlobAccess(base BlobAccess, level int, maximumInMemorySizeBytes int64) BlobAccess {
+	return &compressingBlobAccess{
+		BlobAccess:               base,
+		level:                    level,
+		maximumInMemorySizeBytes: maximumInMemorySizeBytes,
+	}
+}
+
+func (ba *compressingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	length, r, err := ba.BlobAccess.Get(ctx, digest)
+	if err != nil {
+		return 0, nil, err
+	}
+	var header [compressingBlobAccessHeaderSizeBytes]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.Close()
+		return 0, nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to read compression header")
+	}
+	if n < len(header) || string(header[:len(compressingBlobAccessMagic)]) != compressingBlobAccessMagic {
+		// Object was not stored by this adapter. Return it
+		// unaltered, including the bytes read so far.
+		return length, &prefixedReader{
+			Reader: io.MultiReader(bytes.NewReader(header[:n]), r),
+			Closer: r,
+		}, nil
+	}
+	return int64(binary.BigEndian.Uint64(header[len(compressingBlobAccessMagic):])), &decompressingReader{
+		ReadCloser: flate.NewReader(r),
+		compressed: r,
+	}, nil
+}
+
+func (ba *compressingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	compressed := spillingBuffer{maximumInMemorySizeBytes: ba.maximumInMemorySizeBytes}
+	var header [compressingBlobAccessHeaderSizeBytes]byte
+	copy(header[:], compressingBlobAccessMagic)
+	binary.BigEndian.PutUint64(header[len(compressingBlobAccessMagic):], uint64(sizeBytes))
+	if _, err := compressed.Write(header[:]); err != nil {
+		r.Close()
+		compressed.Discard()
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to write compression header")
+	}
+
+	w, err := flate.NewWriter(&compressed, ba.level)
+	if err != nil {
+		r.Close()
+		compressed.Discard()
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to create compressor")
+	}
+	n, err := io.Copy(w, r)
+	r.Close()
+	if err != nil {
+		compressed.Discard()
+		return util.StatusWrap(err, "Failed to compress blob")
+	}
+	if n != sizeBytes {
+		compressed.Discard()
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while %d bytes were expected", n, sizeBytes)
+	}
+	if err := w.Close(); err != nil {
+		compressed.Discard()
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to compress blob")
+	}
+	compressedSizeBytes, compressedReader, err := compressed.Reader()
+	if err != nil {
+		return err
+	}
+	return ba.BlobAccess.Put(ctx, digest, compressedSizeBytes, compressedReader)
+}
+
+// decompressingReader is returned by compressingBlobAccess.Get(). It
+// ensures that closing the decompressor also closes the reader of the
+// compressed object returned by the backend.
+type decompressingReader struct {
+	io.ReadCloser
+	compressed io.ReadCloser
+}
+
+func (r *decompressingReader) Close() error {
+	r.ReadCloser.Close()
+	return r.compressed.Close()
+}
+
+// prefixedReader is returned by compressingBlobAccess.Get() for
+// objects that are not compressed. It replays the bytes that were read
+// while checking for the presence of a header.
+type prefixedReader struct {
+	io.Reader
+	io.Closer
+}
+
+// spillingBuffer is an io.Writer that stores data in memory, up to a
+// given size. Beyond that size, all data is moved to a temporary file.
+type spillingBuffer struct {
+	maximumInMemorySizeBytes int64
+	memory                   bytes.Buffer
+	file                     *os.File
+	sizeBytes                int64
+}
+
+func (b *spillingBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.sizeBytes+int64(len(p)) > b.maximumInMemorySizeBytes {
+		f, err := ioutil.TempFile("", "compressing_blob_access")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+		if _, err := b.memory.WriteTo(f); err != nil {
+			return 0, err
+		}
+		b.memory = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if b.file == nil {
+		n, err = b.memory.Write(p)
+	} else {
+		n, err = b.file.Write(p)
+	}
+	b.sizeBytes += int64(n)
+	return n, err
+}
+
+// Discard releases the resources held by the buffer.
+func (b *spillingBuffer) Discard() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+// Reader returns the size of the data written to the buffer and a
+// reader for it. Closing the reader releases the resources held by the
+// buffer.
+func (b *spillingBuffer) Reader() (int64, io.ReadCloser, error) {
+	if b.file == nil {
+		return b.sizeBytes, NewBytesReader(b.memory.Bytes()), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		b.Discard()
+		return 0, nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to rewind temporary file")
+	}
+	return b.sizeBytes, &temporaryFileReader{File: b.file}, nil
+}
+
+// temporaryFileReader is a reader for a temporary file that removes the
+// file upon closure. Like the reader returned by NewBytesReader(), it
+// implements io.Seeker, allowing consumers to rewind it when retrying.
+type temporaryFileReader struct {
+	*os.File
+}
+
+func (r *temporaryFileReader) Close() error {
+	err := r.File.Close()
+	os.Remove(r.File.Name())
+	return err
+}
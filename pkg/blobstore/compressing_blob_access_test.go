@@ -0,0 +1,108 @@
+package blobstore_test
+
+import (
+	"compress/flate"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCompressingBlobAccess(t *testing.T) {
+	ctx := context.Background()
+	bottomBlobAccess := blobstore.NewFakeBlobAccess(util.DigestKeyWithoutInstance)
+	blobAccess := blobstore.NewCompressingBlobAccess(bottomBlobAccess, flate.BestCompression, 1024)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		// Highly compressible objects should take up less
+		// space in the backend, while being returned unaltered.
+		data := strings.Repeat("Hello world. ", 1000)
+		digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: int64(len(data)),
+		})
+		require.NoError(t, blobAccess.Put(ctx, digest, int64(len(data)), blobstore.NewBytesReader([]byte(data))))
+		compressed, ok := bottomBlobAccess.GetContents(digest)
+		require.True(t, ok)
+		require.True(t, len(compressed) < len(data))
+
+		length, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), length)
+		contents, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, string(contents))
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("SpillToFile", func(t *testing.T) {
+		// Objects whose compressed size exceeds the in-memory
+		// limit are written to a temporary file first.
+		data := make([]byte, 100000)
+		rand.New(rand.NewSource(0)).Read(data)
+		digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "0e1b9b7a5fbd2d4d5d4c3f3c6b7d8ad3",
+			SizeBytes: int64(len(data)),
+		})
+		require.NoError(t, blobAccess.Put(ctx, digest, int64(len(data)), blobstore.NewBytesReader(data)))
+
+		length, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), length)
+		contents, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, contents)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("Uncompressed", func(t *testing.T) {
+		// Objects stored before compression was enabled lack
+		// the header. They should be returned unaltered. This
+		// includes objects smaller than the header.
+		for _, data := range []string{"Hello", "This object was stored without compression"} {
+			digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+				Hash:      "f6f5c3e0d8f1e3b0a1c2d4e6f8a0b2c4",
+				SizeBytes: int64(len(data)),
+			})
+			require.NoError(t, bottomBlobAccess.Put(ctx, digest, int64(len(data)), blobstore.NewBytesReader([]byte(data))))
+
+			length, r, err := blobAccess.Get(ctx, digest)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), length)
+			contents, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, data, string(contents))
+			require.NoError(t, r.Close())
+		}
+	})
+
+	t.Run("SizeMismatch", func(t *testing.T) {
+		digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+			SizeBytes: 7,
+		})
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Blob is 5 bytes in size, while 7 bytes were expected"),
+			blobAccess.Put(ctx, digest, 7, blobstore.NewBytesReader([]byte("Hello"))))
+		_, ok := bottomBlobAccess.GetContents(digest)
+		require.False(t, ok)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, _, err := blobAccess.Get(ctx, util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "c8ec2d5e1a3c6a5d4b6d0b6c5f2bd0f5",
+			SizeBytes: 3,
+		}))
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+}
@@ -0,0 +1,60 @@
+package configuration
+
+import (
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BlobAccessCreator is provided to implementations of
+// BlobAccessFactory, so that custom storage backends may wrap other
+// storage backends declared in the configuration file.
+type BlobAccessCreator func(config *pb.BlobAccessConfiguration) (blobstore.BlobAccess, error)
+
+// BlobAccessFactory creates a BlobAccess from backend specific
+// parameters provided in the configuration file. The storage type is
+// either "ac" or "cas". The digest key format should be used by
+// backends that convert digests to keys, so that Action Cache entries
+// remain separated by instance name.
+type BlobAccessFactory func(parameters *any.Any, storageType string, digestKeyFormat util.DigestKeyFormat, createBlobAccess BlobAccessCreator) (blobstore.BlobAccess, error)
+
+var (
+	blobAccessFactoriesLock sync.RWMutex
+	blobAccessFactories     = map[string]BlobAccessFactory{}
+)
+
+// RegisterBlobAccessFactory makes a storage backend available under a
+// given name, so that it may be referenced from the configuration file
+// through CustomBlobAccessConfiguration. This allows users of Bazel
+// Buildbarn as a library to compile in storage backends that are not
+// part of this repository. It is intended to be called from init()
+// functions and panics if the name is registered twice.
+func RegisterBlobAccessFactory(name string, factory BlobAccessFactory) {
+	blobAccessFactoriesLock.Lock()
+	defer blobAccessFactoriesLock.Unlock()
+
+	if factory == nil {
+		panic("Attempted to register nil BlobAccessFactory " + name)
+	}
+	if _, ok := blobAccessFactories[name]; ok {
+		panic("Attempted to register BlobAccessFactory " + name + " twice")
+	}
+	blobAccessFactories[name] = factory
+}
+
+func getBlobAccessFactory(name string) (BlobAccessFactory, error) {
+	blobAccessFactoriesLock.RLock()
+	defer blobAccessFactoriesLock.RUnlock()
+
+	factory, ok := blobAccessFactories[name]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "No storage backend registered under name %#v", name)
+	}
+	return factory, nil
+}
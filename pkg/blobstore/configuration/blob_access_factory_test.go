@@ -0,0 +1,104 @@
+package configuration_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/stretchr/testify/require"
+	status_pb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegisterBlobAccessFactory(t *testing.T) {
+	ctx := context.Background()
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	// Factory that wraps the backend provided in the parameters,
+	// recording the arguments with which it was called.
+	var storageTypes []string
+	configuration.RegisterBlobAccessFactory("test_wrapping", func(parameters *any.Any, storageType string, digestKeyFormat util.DigestKeyFormat, createBlobAccess configuration.BlobAccessCreator) (blobstore.BlobAccess, error) {
+		var errorStatus status_pb.Status
+		if err := ptypes.UnmarshalAny(parameters, &errorStatus); err != nil {
+			return nil, err
+		}
+		storageTypes = append(storageTypes, storageType)
+		return createBlobAccess(&pb.BlobAccessConfiguration{
+			Backend: &pb.BlobAccessConfiguration_Error{Error: &errorStatus},
+		})
+	})
+	configuration.RegisterBlobAccessFactory("test_failing", func(parameters *any.Any, storageType string, digestKeyFormat util.DigestKeyFormat, createBlobAccess configuration.BlobAccessCreator) (blobstore.BlobAccess, error) {
+		return nil, status.Error(codes.InvalidArgument, "Bad parameters")
+	})
+
+	newConfiguration := func(name string, parameters *any.Any) *pb.BlobstoreConfiguration {
+		backend := &pb.BlobAccessConfiguration{
+			Backend: &pb.BlobAccessConfiguration_Custom{
+				Custom: &pb.CustomBlobAccessConfiguration{
+					Name:       name,
+					Parameters: parameters,
+				},
+			},
+		}
+		return &pb.BlobstoreConfiguration{
+			ContentAddressableStorage: backend,
+			ActionCache:               backend,
+		}
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		parameters, err := ptypes.MarshalAny(&status_pb.Status{Code: int32(codes.Unavailable), Message: "Backend unavailable"})
+		require.NoError(t, err)
+		contentAddressableStorage, actionCache, err := configuration.CreateBlobAccessObjects(newConfiguration("test_wrapping", parameters), false)
+		require.NoError(t, err)
+		require.Equal(t, []string{"cas", "ac"}, storageTypes)
+
+		// Requests should be forwarded to the wrapped backend.
+		_, _, err = contentAddressableStorage.Get(ctx, digest)
+		require.Equal(t, status.Error(codes.Unavailable, "Backend unavailable"), err)
+		_, _, err = actionCache.Get(ctx, digest)
+		require.Equal(t, status.Error(codes.Unavailable, "Backend unavailable"), err)
+	})
+
+	t.Run("InvalidParameters", func(t *testing.T) {
+		parameters, err := ptypes.MarshalAny(&duration.Duration{Seconds: 5})
+		require.NoError(t, err)
+		_, _, err = configuration.CreateBlobAccessObjects(newConfiguration("test_wrapping", parameters), false)
+		require.Error(t, err)
+	})
+
+	t.Run("FactoryFailure", func(t *testing.T) {
+		_, _, err := configuration.CreateBlobAccessObjects(newConfiguration("test_failing", nil), false)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Failed to create storage backend \"test_failing\": Bad parameters"), err)
+	})
+
+	t.Run("NotRegistered", func(t *testing.T) {
+		_, _, err := configuration.CreateBlobAccessObjects(newConfiguration("test_nonexistent", nil), false)
+		require.Equal(t, status.Error(codes.InvalidArgument, "No storage backend registered under name \"test_nonexistent\""), err)
+	})
+
+	t.Run("RegisterTwice", func(t *testing.T) {
+		require.Panics(t, func() {
+			configuration.RegisterBlobAccessFactory("test_failing", func(parameters *any.Any, storageType string, digestKeyFormat util.DigestKeyFormat, createBlobAccess configuration.BlobAccessCreator) (blobstore.BlobAccess, error) {
+				return nil, nil
+			})
+		})
+	})
+
+	t.Run("RegisterNil", func(t *testing.T) {
+		require.Panics(t, func() {
+			configuration.RegisterBlobAccessFactory("test_nil", nil)
+		})
+	})
+}
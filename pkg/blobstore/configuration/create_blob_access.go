@@ -1,15 +1,25 @@
 package configuration
 
 import (
+	"compress/flate"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/sharding"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/grpcclient"
 	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/aws/aws-sdk-go/aws"
@@ -19,52 +29,290 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/go-redis/redis"
 	"github.com/golang/protobuf/proto"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+
+	"golang.org/x/net/http2"
 
-	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+func loadConfig(configurationFile string) (*pb.BlobstoreConfiguration, error) {
+	data, err := ioutil.ReadFile(configurationFile)
+	if err != nil {
+		return nil, err
+	}
+	var config pb.BlobstoreConfiguration
+	if err := proto.UnmarshalText(string(data), &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// blobAccessCreationOptions contains settings that apply to all
+// storage backends created from a single configuration.
+type blobAccessCreationOptions struct {
+	// Reject configurations that relax checksum verification of
+	// the Content Addressable Storage. This is used by processes
+	// that accept data from clients, which could otherwise corrupt
+	// the Content Addressable Storage.
+	requireChecksumVerification bool
+
+	// Resources such as gRPC connections and Redis clients that
+	// backends use, keyed by storage type. These are closed when
+	// backends are replaced by ReloadingBlobAccess.
+	closers map[string]closerList
+}
+
+// addCloser registers a resource that needs to be released when
+// backends of a given storage type are no longer used.
+func (o *blobAccessCreationOptions) addCloser(storageType string, closer io.Closer) {
+	if o.closers == nil {
+		o.closers = map[string]closerList{}
+	}
+	o.closers[storageType] = append(o.closers[storageType], closer)
+}
+
+// closeAll releases all resources registered through addCloser(). It
+// is called when backends could not be created successfully.
+func (o *blobAccessCreationOptions) closeAll() {
+	for _, closers := range o.closers {
+		closers.Close()
+	}
+}
+
+// closerList is an io.Closer that closes a list of resources, returning
+// the first error that occurred.
+type closerList []io.Closer
+
+func (cl closerList) Close() error {
+	var firstErr error
+	for _, closer := range cl {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// getChecksumVerificationSamplingProbability returns the fraction of
+// requests for which checksums need to be validated, according to a
+// ChecksumVerificationConfiguration.
+func getChecksumVerificationSamplingProbability(config *pb.ChecksumVerificationConfiguration, options *blobAccessCreationOptions) (float64, error) {
+	if config == nil {
+		return 1, nil
+	}
+	samplingProbability := config.SamplingProbability
+	if samplingProbability < 0 || samplingProbability > 1 {
+		return 0, status.Error(codes.InvalidArgument, "Checksum verification sampling probability must be in range [0.0, 1.0]")
+	}
+	if options.requireChecksumVerification && samplingProbability != 1 {
+		return 0, status.Error(codes.InvalidArgument, "Checksum verification sampling probability must be 1, as this process accepts data from clients")
+	}
+	return samplingProbability, nil
+}
+
 // CreateBlobAccessObjectsFromConfig creates a pair of BlobAccess
 // objects for the Content Addressable Storage and Action cache based on
 // a configuration file.
 func CreateBlobAccessObjectsFromConfig(configurationFile string) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
-	data, err := ioutil.ReadFile(configurationFile)
+	config, err := loadConfig(configurationFile)
 	if err != nil {
 		return nil, nil, err
 	}
-	var config pb.BlobstoreConfiguration
-	if err := proto.UnmarshalText(string(data), &config); err != nil {
+	return CreateBlobAccessObjects(config, false)
+}
+
+// CreateBlobAccessObjects creates a pair of BlobAccess objects for the
+// Content Addressable Storage and Action cache based on a configuration
+// message. This is used by binaries that embed the storage
+// configuration into their own configuration file.
+//
+// Processes that accept data from clients (e.g., frontends) should set
+// requireChecksumVerification, causing configurations that relax
+// checksum verification of any part of the Content Addressable Storage
+// to be rejected.
+func CreateBlobAccessObjects(config *pb.BlobstoreConfiguration, requireChecksumVerification bool) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
+	return createBlobAccessObjects(config, &blobAccessCreationOptions{
+		requireChecksumVerification: requireChecksumVerification,
+	})
+}
+
+func createBlobAccessObjects(config *pb.BlobstoreConfiguration, options *blobAccessCreationOptions) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
+	// Stack a layer on top to protect against data corruption. It
+	// validates all objects, unless configured otherwise.
+	samplingProbability, err := getChecksumVerificationSamplingProbability(config.GetContentAddressableStorageChecksumVerification(), options)
+	if err != nil {
 		return nil, nil, err
 	}
+	contentAddressableStorage, actionCache, err := createUnverifiedBlobAccessObjects(config, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	contentAddressableStorage = blobstore.NewMetricsBlobAccess(
+		blobstore.NewSamplingMerkleBlobAccess(contentAddressableStorage, samplingProbability),
+		"cas_merkle")
+	return contentAddressableStorage, actionCache, nil
+}
+
+// CreateExecutionHistoryBlobAccess creates a BlobAccess object for the
+// storage of execution histories based on a configuration message. It
+// returns nil if no execution history storage is configured.
+func CreateExecutionHistoryBlobAccess(config *pb.BlobstoreConfiguration) (blobstore.BlobAccess, error) {
+	if config.GetExecutionHistory() == nil {
+		return nil, nil
+	}
+	return createBlobAccess(config.ExecutionHistory, "history", util.DigestKeyWithInstance, &blobAccessCreationOptions{})
+}
+
+// CreateExecutionHistoryBlobAccessFromConfig is identical to
+// CreateExecutionHistoryBlobAccess, except that it reads the storage
+// configuration from a file.
+func CreateExecutionHistoryBlobAccessFromConfig(configurationFile string) (blobstore.BlobAccess, error) {
+	config, err := loadConfig(configurationFile)
+	if err != nil {
+		return nil, err
+	}
+	return CreateExecutionHistoryBlobAccess(config)
+}
+
+// CreateUncachedActionResultBlobAccess creates a BlobAccess object for
+// the storage of results of actions that may not be stored in the
+// Action Cache. It returns nil if no such storage is configured.
+func CreateUncachedActionResultBlobAccess(config *pb.BlobstoreConfiguration) (blobstore.BlobAccess, error) {
+	if config.GetUncachedActionResult() == nil {
+		return nil, nil
+	}
+	return createBlobAccess(config.UncachedActionResult, "uncached_action_result", util.DigestKeyWithInstance, &blobAccessCreationOptions{})
+}
+
+// CreateUncachedActionResultBlobAccessFromConfig is identical to
+// CreateUncachedActionResultBlobAccess, except that it reads the
+// storage configuration from a file.
+func CreateUncachedActionResultBlobAccessFromConfig(configurationFile string) (blobstore.BlobAccess, error) {
+	config, err := loadConfig(configurationFile)
+	if err != nil {
+		return nil, err
+	}
+	return CreateUncachedActionResultBlobAccess(config)
+}
+
+// CreateUnverifiedBlobAccessObjectsFromConfig is identical to
+// CreateBlobAccessObjectsFromConfig, except that it does not validate
+// the integrity of objects in the Content Addressable Storage. This is
+// only intended to be used by tooling that needs access to corrupted
+// data, such as the scrubber.
+func CreateUnverifiedBlobAccessObjectsFromConfig(configurationFile string) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
+	config, err := loadConfig(configurationFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return createUnverifiedBlobAccessObjects(config, &blobAccessCreationOptions{})
+}
+
+func createUnverifiedBlobAccessObjects(config *pb.BlobstoreConfiguration, options *blobAccessCreationOptions) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
+	if config == nil {
+		return nil, nil, status.Error(codes.InvalidArgument, "Blob storage configuration not provided")
+	}
 
 	// Create two stores based on definitions in configuration.
-	contentAddressableStorage, err := createBlobAccess(config.ContentAddressableStorage, "cas", util.DigestKeyWithoutInstance)
+	contentAddressableStorage, err := createBlobAccess(config.ContentAddressableStorage, "cas", util.DigestKeyWithoutInstance, options)
 	if err != nil {
 		return nil, nil, err
 	}
-	actionCache, err := createBlobAccess(config.ActionCache, "ac", util.DigestKeyWithInstance)
+	actionCache, err := createBlobAccess(config.ActionCache, "ac", util.DigestKeyWithInstance, options)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	// Stack a mandatory layer on top to protect against data corruption.
-	contentAddressableStorage = blobstore.NewMetricsBlobAccess(
-		blobstore.NewMerkleBlobAccess(contentAddressableStorage),
-		"cas_merkle")
 	return contentAddressableStorage, actionCache, nil
 }
 
-func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, digestKeyFormat util.DigestKeyFormat) (blobstore.BlobAccess, error) {
+// CreateContentAddressableStorageShardsFromConfig creates a BlobAccess
+// object for every undrained shard of the Content Addressable Storage.
+// If the Content Addressable Storage is not sharded, a single
+// BlobAccess is returned. Like
+// CreateUnverifiedBlobAccessObjectsFromConfig, the integrity of objects
+// is not validated.
+func CreateContentAddressableStorageShardsFromConfig(configurationFile string) ([]blobstore.BlobAccess, error) {
+	config, err := loadConfig(configurationFile)
+	if err != nil {
+		return nil, err
+	}
+	options := &blobAccessCreationOptions{}
+	sharding, ok := config.ContentAddressableStorage.GetBackend().(*pb.BlobAccessConfiguration_Sharding)
+	if !ok {
+		contentAddressableStorage, err := createBlobAccess(config.ContentAddressableStorage, "cas", util.DigestKeyWithoutInstance, options)
+		if err != nil {
+			return nil, err
+		}
+		return []blobstore.BlobAccess{contentAddressableStorage}, nil
+	}
+
+	var shards []blobstore.BlobAccess
+	for _, shard := range sharding.Sharding.Shard {
+		if shard.Backend != nil {
+			backend, err := createBlobAccess(shard.Backend, "cas", util.DigestKeyWithoutInstance, options)
+			if err != nil {
+				return nil, err
+			}
+			shards = append(shards, backend)
+		}
+	}
+	return shards, nil
+}
+
+func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, digestKeyFormat util.DigestKeyFormat, options *blobAccessCreationOptions) (blobstore.BlobAccess, error) {
 	var implementation blobstore.BlobAccess
 	var backendType string
+	performsIO := false
 	if config == nil {
 		return nil, errors.New("Configuration not specified")
 	}
 	switch backend := config.Backend.(type) {
+	case *pb.BlobAccessConfiguration_AccessTracking:
+		backendType = "access_tracking"
+		base, err := createBlobAccess(backend.AccessTracking.Backend, storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		redisClient := redis.NewClient(
+			&redis.Options{
+				Addr: backend.AccessTracking.RedisEndpoint,
+				DB:   int(backend.AccessTracking.RedisDb),
+			})
+		options.addCloser(storageType, redisClient)
+		implementation = blobstore.NewAccessTrackingBlobAccess(
+			base,
+			blobstore.NewRedisAccessTimeStore(
+				redisClient,
+				backend.AccessTracking.SortedSetKey,
+				digestKeyFormat))
+	case *pb.BlobAccessConfiguration_ChunkVerifying:
+		backendType = "chunk_verifying"
+		chunkSizeBytes := backend.ChunkVerifying.ChunkSizeBytes
+		if chunkSizeBytes == 0 {
+			chunkSizeBytes = 16 << 20
+		} else if chunkSizeBytes < 0 {
+			return nil, status.Error(codes.InvalidArgument, "Chunk size must be positive")
+		}
+		base, err := createBlobAccess(backend.ChunkVerifying.Backend, storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		manifests, err := createBlobAccess(backend.ChunkVerifying.Manifests, "chunk_manifest", digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewChunkVerifyingBlobAccess(
+			base,
+			manifests,
+			backend.ChunkVerifying.MinimumSizeBytes,
+			chunkSizeBytes,
+			int(backend.ChunkVerifying.MaximumRetries))
 	case *pb.BlobAccessConfiguration_Circular:
 		backendType = "circular"
+		performsIO = true
 
 		// Open input files.
 		circularDirectory, err := filesystem.NewLocalDirectory(backend.Circular.Directory)
@@ -82,8 +330,7 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 		}
 
 		var offsetStore circular.OffsetStore
-		switch digestKeyFormat {
-		case util.DigestKeyWithoutInstance:
+		if !digestKeyFormat.IncludesInstance() {
 			// Open a single offset file for all entries. This is
 			// sufficient for the Content Addressable Storage.
 			offsetFile, err := circularDirectory.OpenFile("offset", os.O_RDWR|os.O_CREATE, 0644)
@@ -93,7 +340,7 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 			offsetStore = circular.NewCachingOffsetStore(
 				circular.NewFileOffsetStore(offsetFile, backend.Circular.OffsetFileSizeBytes),
 				uint(backend.Circular.OffsetCacheSize))
-		case util.DigestKeyWithInstance:
+		} else {
 			// Open an offset file for every instance. This is
 			// required for the Action Cache.
 			offsetStores := map[string]circular.OffsetStore{}
@@ -126,51 +373,216 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 				circular.NewBulkAllocatingStateStore(
 					stateStore,
 					backend.Circular.DataAllocationChunkSizeBytes)))
+	case *pb.BlobAccessConfiguration_Custom:
+		backendType = backend.Custom.Name
+		factory, err := getBlobAccessFactory(backend.Custom.Name)
+		if err != nil {
+			return nil, err
+		}
+		implementation, err = factory(
+			backend.Custom.Parameters,
+			storageType,
+			digestKeyFormat,
+			func(config *pb.BlobAccessConfiguration) (blobstore.BlobAccess, error) {
+				return createBlobAccess(config, storageType, digestKeyFormat, options)
+			})
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to create storage backend %#v", backend.Custom.Name)
+		}
+	case *pb.BlobAccessConfiguration_DeadlineEnforcing:
+		backendType = "deadline_enforcing"
+		var timeouts [3]time.Duration
+		for i, timeout := range []*duration.Duration{
+			backend.DeadlineEnforcing.GetTimeout,
+			backend.DeadlineEnforcing.PutTimeout,
+			backend.DeadlineEnforcing.FindMissingTimeout,
+		} {
+			if timeout != nil {
+				var err error
+				timeouts[i], err = ptypes.Duration(timeout)
+				if err != nil {
+					return nil, util.StatusWrap(err, "Invalid timeout")
+				}
+			}
+		}
+		base, err := createBlobAccess(backend.DeadlineEnforcing.Backend, storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewDeadlineEnforcingBlobAccess(base, timeouts[0], timeouts[1], timeouts[2])
+	case *pb.BlobAccessConfiguration_Decorated:
+		// Decorators gather metrics explicitly where requested,
+		// so there is no need to gather separate metrics for
+		// this layer.
+		blobAccess, err := createBlobAccess(backend.Decorated.Backend, storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		return applyBlobAccessDecorators(blobAccess, backend.Decorated.Decorators, storageType, digestKeyFormat, options)
+	case *pb.BlobAccessConfiguration_Demultiplexing:
+		backendType = "demultiplexing"
+		var prefixes []string
+		backends := map[string]blobstore.BlobAccess{}
+		for prefix, backendConfig := range backend.Demultiplexing.InstanceNamePrefixes {
+			backend, err := createBlobAccess(backendConfig, storageType, digestKeyFormat, options)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix)
+			backends[prefix] = backend
+		}
+		// Attempt to match the longest prefixes first.
+		sort.Slice(prefixes, func(i, j int) bool {
+			return len(prefixes[i]) > len(prefixes[j])
+		})
+		implementation = blobstore.NewDemultiplexingBlobAccess(func(instance string) (blobstore.BlobAccess, error) {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(instance, prefix) {
+					return backends[prefix], nil
+				}
+			}
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown instance name")
+		})
 	case *pb.BlobAccessConfiguration_Error:
 		backendType = "failing"
 		implementation = blobstore.NewErrorBlobAccess(status.ErrorProto(backend.Error))
+	case *pb.BlobAccessConfiguration_ExistenceCaching:
+		backendType = "existence_caching"
+		if backend.ExistenceCaching.CacheSize <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Existence cache size must be positive")
+		}
+		cacheDuration, err := ptypes.Duration(backend.ExistenceCaching.CacheDuration)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Invalid cache duration")
+		}
+		base, err := createBlobAccess(backend.ExistenceCaching.Backend, storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewExistenceCachingBlobAccess(
+			base,
+			digestKeyFormat,
+			cacheDuration,
+			int(backend.ExistenceCaching.CacheSize))
+	case *pb.BlobAccessConfiguration_FaultInjecting:
+		backendType = "fault_injecting"
+		if p := backend.FaultInjecting.ErrorProbability; p < 0 || p > 1 {
+			return nil, status.Error(codes.InvalidArgument, "Fault injection error probability must be in range [0.0, 1.0]")
+		}
+		var maximumDelay time.Duration
+		if backend.FaultInjecting.MaximumDelay != nil {
+			var err error
+			maximumDelay, err = ptypes.Duration(backend.FaultInjecting.MaximumDelay)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid maximum delay")
+			}
+		}
+		base, err := createBlobAccess(backend.FaultInjecting.Backend, storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewFaultInjectingBlobAccess(
+			base,
+			util.NewFaultInjector(backend.FaultInjecting.ErrorProbability, maximumDelay))
 	case *pb.BlobAccessConfiguration_Grpc:
 		backendType = "grpc"
-		client, err := grpc.Dial(
-			backend.Grpc.Endpoint,
-			grpc.WithInsecure(),
-			grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-			grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+		performsIO = true
+		client, err := grpcclient.NewClientFromConfiguration(backend.Grpc.Endpoint, backend.Grpc.Client)
 		if err != nil {
 			return nil, err
 		}
+		options.addCloser(storageType, client)
 		switch storageType {
 		case "ac":
 			implementation = blobstore.NewActionCacheBlobAccess(client)
 		case "cas":
-			implementation = blobstore.NewContentAddressableStorageBlobAccess(client, 65536)
+			findMissingMaxRequestSizeBytes := int(backend.Grpc.FindMissingMaxRequestSizeBytes)
+			if findMissingMaxRequestSizeBytes <= 0 {
+				findMissingMaxRequestSizeBytes = 2 << 20
+			}
+			findMissingConcurrency := int(backend.Grpc.FindMissingConcurrency)
+			if findMissingConcurrency <= 0 {
+				findMissingConcurrency = 4
+			}
+			implementation = blobstore.NewContentAddressableStorageBlobAccess(client, 65536, findMissingMaxRequestSizeBytes, findMissingConcurrency)
+		}
+	case *pb.BlobAccessConfiguration_KeyFormat:
+		// Key formats only affect the backends underneath. There
+		// is no need to gather separate metrics for this layer.
+		includeInstance := digestKeyFormat.IncludesInstance()
+		switch backend.KeyFormat.InstanceName {
+		case pb.KeyFormatBlobAccessConfiguration_INHERIT:
+		case pb.KeyFormatBlobAccessConfiguration_INCLUDE:
+			includeInstance = true
+		case pb.KeyFormatBlobAccessConfiguration_EXCLUDE:
+			includeInstance = false
+		default:
+			return nil, status.Error(codes.InvalidArgument, "Invalid instance name key format")
+		}
+		return createBlobAccess(
+			backend.KeyFormat.Backend,
+			storageType,
+			util.NewDigestKeyFormat(includeInstance, backend.KeyFormat.HashKeys || digestKeyFormat.IsHashed()),
+			options)
+	case *pb.BlobAccessConfiguration_LatencyAware:
+		backendType = "latency_aware"
+		if len(backend.LatencyAware.Replicas) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "Cannot create latency aware blob access without any replicas")
+		}
+		var replicas []blobstore.BlobAccess
+		for _, replicaConfig := range backend.LatencyAware.Replicas {
+			replica, err := createBlobAccess(replicaConfig, storageType, digestKeyFormat, options)
+			if err != nil {
+				return nil, err
+			}
+			replicas = append(replicas, replica)
 		}
+		decayTime := 10 * time.Second
+		if backend.LatencyAware.DecayTime != nil {
+			var err error
+			decayTime, err = ptypes.Duration(backend.LatencyAware.DecayTime)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid decay time")
+			}
+		}
+		errorPenalty := time.Second
+		if backend.LatencyAware.ErrorPenalty != nil {
+			var err error
+			errorPenalty, err = ptypes.Duration(backend.LatencyAware.ErrorPenalty)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid error penalty")
+			}
+		}
+		implementation = blobstore.NewLatencyAwareBlobAccess(replicas, decayTime, errorPenalty)
 	case *pb.BlobAccessConfiguration_Redis:
 		backendType = "redis"
-		implementation = blobstore.NewRedisBlobAccess(
-			redis.NewClient(
-				&redis.Options{
-					Addr: backend.Redis.Endpoint,
-					DB:   int(backend.Redis.Db),
-				}),
-			digestKeyFormat)
+		performsIO = true
+		redisClient := redis.NewClient(
+			&redis.Options{
+				Addr: backend.Redis.Endpoint,
+				DB:   int(backend.Redis.Db),
+			})
+		options.addCloser(storageType, redisClient)
+		implementation = blobstore.NewRedisBlobAccess(redisClient, digestKeyFormat)
 	case *pb.BlobAccessConfiguration_Remote:
 		backendType = "remote"
-		implementation = blobstore.NewRemoteBlobAccess(backend.Remote.Address, storageType)
+		performsIO = true
+		client, err := newRemoteBlobAccessHTTPClient(backend.Remote)
+		if err != nil {
+			return nil, err
+		}
+		header, err := newRemoteBlobAccessHeader(backend.Remote)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewRemoteBlobAccess(client, backend.Remote.Address, storageType, header, int(backend.Remote.MaxRetries))
 	case *pb.BlobAccessConfiguration_S3:
 		backendType = "s3"
-		cfg := aws.Config{
-			Endpoint:         &backend.S3.Endpoint,
-			Region:           &backend.S3.Region,
-			DisableSSL:       &backend.S3.DisableSsl,
-			S3ForcePathStyle: aws.Bool(true),
-		}
-		// If AccessKeyId isn't specified, allow AWS to search for credentials.
-		// In AWS EC2, this search will include the instance IAM Role.
-		if backend.S3.AccessKeyId != "" {
-			cfg.Credentials = credentials.NewStaticCredentials(backend.S3.AccessKeyId, backend.S3.SecretAccessKey, "")
-		}
-		session := session.New(&cfg)
+		performsIO = true
+		if digestKeyFormat.IsHashed() {
+			return nil, status.Error(codes.InvalidArgument, "S3 does not support hashed keys, as keys must be valid UTF-8")
+		}
+		session := newS3Session(backend.S3)
 		s3 := s3.New(session)
 		// Set the uploader concurrency to 1 to drastically reduce memory usage.
 		// TODO(edsch): Maybe the concurrency can be left alone for this process?
@@ -193,7 +605,7 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 				backends = append(backends, nil)
 			} else {
 				// Undrained backend.
-				backend, err := createBlobAccess(shard.Backend, storageType, digestKeyFormat)
+				backend, err := createBlobAccess(shard.Backend, storageType, digestKeyFormat, options)
 				if err != nil {
 					return nil, err
 				}
@@ -216,17 +628,240 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 			backend.Sharding.HashInitialization)
 	case *pb.BlobAccessConfiguration_SizeDistinguishing:
 		backendType = "size_distinguishing"
-		small, err := createBlobAccess(backend.SizeDistinguishing.Small, storageType, digestKeyFormat)
+		small, err := createBlobAccess(backend.SizeDistinguishing.Small, storageType, digestKeyFormat, options)
 		if err != nil {
 			return nil, err
 		}
-		large, err := createBlobAccess(backend.SizeDistinguishing.Large, storageType, digestKeyFormat)
+		large, err := createBlobAccess(backend.SizeDistinguishing.Large, storageType, digestKeyFormat, options)
 		if err != nil {
 			return nil, err
 		}
 		implementation = blobstore.NewSizeDistinguishingBlobAccess(small, large, backend.SizeDistinguishing.CutoffSizeBytes)
+	case *pb.BlobAccessConfiguration_UploadDeduplicating:
+		backendType = "upload_deduplicating"
+		leaseDuration := 10 * time.Minute
+		if backend.UploadDeduplicating.LeaseDuration != nil {
+			var err error
+			leaseDuration, err = ptypes.Duration(backend.UploadDeduplicating.LeaseDuration)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid lease duration")
+			}
+		}
+		pollInterval := time.Second
+		if backend.UploadDeduplicating.PollInterval != nil {
+			var err error
+			pollInterval, err = ptypes.Duration(backend.UploadDeduplicating.PollInterval)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid poll interval")
+			}
+		}
+		base, err := createBlobAccess(backend.UploadDeduplicating.Backend, storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		redisClient := redis.NewClient(
+			&redis.Options{
+				Addr: backend.UploadDeduplicating.RedisEndpoint,
+				DB:   int(backend.UploadDeduplicating.RedisDb),
+			})
+		options.addCloser(storageType, redisClient)
+		implementation = blobstore.NewUploadDeduplicatingBlobAccess(
+			base,
+			blobstore.NewRedisUploadLeaseStore(redisClient, digestKeyFormat),
+			backend.UploadDeduplicating.MinimumSizeBytes,
+			leaseDuration,
+			pollInterval)
 	default:
 		return nil, errors.New("Configuration did not contain a backend")
 	}
-	return blobstore.NewMetricsBlobAccess(implementation, fmt.Sprintf("%s_%s", storageType, backendType)), nil
+	name := fmt.Sprintf("%s_%s", storageType, backendType)
+
+	// Annotate errors of backends that perform I/O with the digest
+	// and the name of the backend. Errors such as "context deadline
+	// exceeded" would otherwise not reveal where they occurred.
+	if performsIO {
+		implementation = blobstore.NewErrorAnnotatingBlobAccess(implementation, name)
+	}
+	return blobstore.NewMetricsBlobAccess(implementation, name), nil
+}
+
+// ApplyBlobAccessDecorators layers a sequence of decorators on top of
+// a BlobAccess that is created by a binary itself (e.g., the writer of
+// the Content Addressable Storage that a worker uses to upload outputs
+// of build actions). The decorators are listed outermost first. The
+// storage type (i.e., "ac" or "cas") is used to name metrics.
+func ApplyBlobAccessDecorators(base blobstore.BlobAccess, decorators []*pb.BlobAccessDecoratorConfiguration, storageType string, digestKeyFormat util.DigestKeyFormat) (blobstore.BlobAccess, error) {
+	return applyBlobAccessDecorators(base, decorators, storageType, digestKeyFormat, &blobAccessCreationOptions{})
+}
+
+func applyBlobAccessDecorators(base blobstore.BlobAccess, decorators []*pb.BlobAccessDecoratorConfiguration, storageType string, digestKeyFormat util.DigestKeyFormat, options *blobAccessCreationOptions) (blobstore.BlobAccess, error) {
+	blobAccess := base
+	for i := len(decorators) - 1; i >= 0; i-- {
+		var err error
+		blobAccess, err = applyBlobAccessDecorator(blobAccess, decorators[i], storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to apply decorator %d", i)
+		}
+	}
+	return blobAccess, nil
+}
+
+// applyBlobAccessDecorator layers a single decorator that is part of a
+// DecoratedBlobAccessConfiguration on top of a BlobAccess.
+func applyBlobAccessDecorator(base blobstore.BlobAccess, config *pb.BlobAccessDecoratorConfiguration, storageType string, digestKeyFormat util.DigestKeyFormat, options *blobAccessCreationOptions) (blobstore.BlobAccess, error) {
+	switch decorator := config.Decorator.(type) {
+	case *pb.BlobAccessDecoratorConfiguration_Metrics:
+		if decorator.Metrics == "" {
+			return nil, status.Error(codes.InvalidArgument, "Metrics name must be set")
+		}
+		return blobstore.NewMetricsBlobAccess(base, fmt.Sprintf("%s_%s", storageType, decorator.Metrics)), nil
+	case *pb.BlobAccessDecoratorConfiguration_Retrying:
+		if decorator.Retrying.MaxRetries < 0 {
+			return nil, status.Error(codes.InvalidArgument, "Maximum number of retries must not be negative")
+		}
+		initialDelay := 100 * time.Millisecond
+		if decorator.Retrying.InitialDelay != nil {
+			var err error
+			initialDelay, err = ptypes.Duration(decorator.Retrying.InitialDelay)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid initial delay")
+			}
+		}
+		return blobstore.NewRetryingBlobAccess(base, int(decorator.Retrying.MaxRetries), initialDelay), nil
+	case *pb.BlobAccessDecoratorConfiguration_Compressing:
+		level := int(decorator.Compressing.Level)
+		if level == 0 {
+			level = flate.DefaultCompression
+		} else if level < flate.BestSpeed || level > flate.BestCompression {
+			return nil, status.Error(codes.InvalidArgument, "Compression level must be in range [1, 9]")
+		}
+		maximumInMemorySizeBytes := decorator.Compressing.MaximumInMemorySizeBytes
+		if maximumInMemorySizeBytes == 0 {
+			maximumInMemorySizeBytes = 1 << 20
+		} else if maximumInMemorySizeBytes < 0 {
+			return nil, status.Error(codes.InvalidArgument, "Maximum in-memory size must not be negative")
+		}
+		return blobstore.NewCompressingBlobAccess(base, level, maximumInMemorySizeBytes), nil
+	case *pb.BlobAccessDecoratorConfiguration_ReadWriteSplitting:
+		writeBackend, err := createBlobAccess(decorator.ReadWriteSplitting, storageType, digestKeyFormat, options)
+		if err != nil {
+			return nil, err
+		}
+		return blobstore.NewReadWriteSplittingBlobAccess(base, writeBackend), nil
+	case *pb.BlobAccessDecoratorConfiguration_ChecksumVerification:
+		if storageType != "cas" {
+			return nil, status.Error(codes.InvalidArgument, "Checksums can only be validated for the Content Addressable Storage")
+		}
+		samplingProbability, err := getChecksumVerificationSamplingProbability(decorator.ChecksumVerification, options)
+		if err != nil {
+			return nil, err
+		}
+		return blobstore.NewSamplingMerkleBlobAccess(base, samplingProbability), nil
+	case *pb.BlobAccessDecoratorConfiguration_ReadOnly:
+		if !decorator.ReadOnly {
+			return nil, status.Error(codes.InvalidArgument, "Read-only decorator must be set to true")
+		}
+		return blobstore.NewReadOnlyBlobAccess(base), nil
+	case *pb.BlobAccessDecoratorConfiguration_ExistencePrecondition:
+		if !decorator.ExistencePrecondition {
+			return nil, status.Error(codes.InvalidArgument, "Existence precondition decorator must be set to true")
+		}
+		return blobstore.NewExistencePreconditionBlobAccess(base), nil
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Configuration did not contain a decorator")
+	}
+}
+
+// newS3Session creates an AWS session for accessing the S3 bucket
+// specified in the configuration.
+func newS3Session(config *pb.S3BlobAccessConfiguration) *session.Session {
+	cfg := aws.Config{
+		Endpoint:         &config.Endpoint,
+		Region:           &config.Region,
+		DisableSSL:       &config.DisableSsl,
+		S3ForcePathStyle: aws.Bool(true),
+	}
+	// If AccessKeyId isn't specified, allow AWS to search for credentials.
+	// In AWS EC2, this search will include the instance IAM Role.
+	if config.AccessKeyId != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(config.AccessKeyId, config.SecretAccessKey, "")
+	}
+	return session.New(&cfg)
+}
+
+// CreateS3BlobURLProvider creates a BlobURLProvider that returns
+// presigned URLs for objects in the Content Addressable Storage that
+// are stored in an S3 bucket. The configuration must be identical to
+// the one of the S3 backend storing the objects.
+func CreateS3BlobURLProvider(config *pb.S3BlobAccessConfiguration, expiry time.Duration) blobstore.BlobURLProvider {
+	return blobstore.NewS3BlobURLProvider(
+		s3.New(newS3Session(config)),
+		&config.Bucket,
+		config.KeyPrefix,
+		util.DigestKeyWithoutInstance,
+		expiry)
+}
+
+// newRemoteBlobAccessHTTPClient creates a dedicated HTTP client for
+// accessing a remote build cache, so that timeouts and connection
+// pooling can be configured without affecting http.DefaultClient.
+func newRemoteBlobAccessHTTPClient(config *pb.RemoteBlobAccessConfiguration) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: int(config.MaxIdleConnections),
+	}
+	if tlsConfig := config.Tls; tlsConfig != nil {
+		transport.TLSClientConfig = &tls.Config{
+			ServerName: tlsConfig.ServerNameOverride,
+		}
+		if tlsConfig.ServerCertificateAuthorityPath != "" {
+			certificates, err := ioutil.ReadFile(tlsConfig.ServerCertificateAuthorityPath)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to read server certificate authorities")
+			}
+			certificatePool := x509.NewCertPool()
+			if !certificatePool.AppendCertsFromPEM(certificates) {
+				return nil, status.Error(codes.InvalidArgument, "Failed to parse server certificate authorities")
+			}
+			transport.TLSClientConfig.RootCAs = certificatePool
+		}
+	}
+
+	// Setting TLSClientConfig disables HTTP/2 support by default.
+	// Explicitly enable it, so that many concurrent requests can be
+	// multiplexed over a small number of connections.
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, util.StatusWrap(err, "Failed to enable HTTP/2")
+	}
+
+	client := &http.Client{Transport: transport}
+	if config.Timeout != nil {
+		timeout, err := ptypes.Duration(config.Timeout)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Invalid timeout")
+		}
+		client.Timeout = timeout
+	}
+	return client, nil
+}
+
+// newRemoteBlobAccessHeader creates the set of header fields that need
+// to be sent along with every request to a remote build cache.
+func newRemoteBlobAccessHeader(config *pb.RemoteBlobAccessConfiguration) (http.Header, error) {
+	header := http.Header{}
+	for key, value := range config.Headers {
+		header.Set(key, value)
+	}
+	if basicAuth := config.BasicAuth; basicAuth != nil {
+		encodedCredentials := base64.StdEncoding.EncodeToString([]byte(basicAuth.Username + ":" + basicAuth.Password))
+		header.Set("Authorization", "Basic "+encodedCredentials)
+	}
+	if config.BearerTokenPath != "" {
+		token, err := ioutil.ReadFile(config.BearerTokenPath)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to read bearer token")
+		}
+		header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return header, nil
 }
@@ -0,0 +1,384 @@
+package configuration_test
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	grpcclient_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/grpcclient"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/stretchr/testify/require"
+	status_pb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newChecksumVerificationTestConfiguration(topLevelSamplingProbability float64, decorators []*pb.BlobAccessDecoratorConfiguration) *pb.BlobstoreConfiguration {
+	backend := &pb.BlobAccessConfiguration{
+		Backend: &pb.BlobAccessConfiguration_Error{
+			Error: &status_pb.Status{Code: int32(codes.Unavailable), Message: "Backend unavailable"},
+		},
+	}
+	return &pb.BlobstoreConfiguration{
+		ContentAddressableStorage: &pb.BlobAccessConfiguration{
+			Backend: &pb.BlobAccessConfiguration_Decorated{
+				Decorated: &pb.DecoratedBlobAccessConfiguration{
+					Backend:    backend,
+					Decorators: decorators,
+				},
+			},
+		},
+		ActionCache: backend,
+		ContentAddressableStorageChecksumVerification: &pb.ChecksumVerificationConfiguration{
+			SamplingProbability: topLevelSamplingProbability,
+		},
+	}
+}
+
+func newChecksumVerificationDecorator(samplingProbability float64) *pb.BlobAccessDecoratorConfiguration {
+	return &pb.BlobAccessDecoratorConfiguration{
+		Decorator: &pb.BlobAccessDecoratorConfiguration_ChecksumVerification{
+			ChecksumVerification: &pb.ChecksumVerificationConfiguration{
+				SamplingProbability: samplingProbability,
+			},
+		},
+	}
+}
+
+func TestCreateBlobAccessObjectsChecksumVerification(t *testing.T) {
+	t.Run("FullVerification", func(t *testing.T) {
+		// Validating all objects is always permitted.
+		config := newChecksumVerificationTestConfiguration(1, nil)
+		_, _, err := configuration.CreateBlobAccessObjects(config, false)
+		require.NoError(t, err)
+		_, _, err = configuration.CreateBlobAccessObjects(config, true)
+		require.NoError(t, err)
+	})
+
+	t.Run("TopLevelRelaxed", func(t *testing.T) {
+		// Relaxing verification at the top level is only
+		// permitted on trusted internal paths.
+		config := newChecksumVerificationTestConfiguration(0.5, nil)
+		_, _, err := configuration.CreateBlobAccessObjects(config, false)
+		require.NoError(t, err)
+		_, _, err = configuration.CreateBlobAccessObjects(config, true)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("PerBackend", func(t *testing.T) {
+		// Disabling verification at the top level, while
+		// enabling it for a single backend.
+		config := newChecksumVerificationTestConfiguration(0, []*pb.BlobAccessDecoratorConfiguration{
+			newChecksumVerificationDecorator(1),
+		})
+		_, _, err := configuration.CreateBlobAccessObjects(config, false)
+		require.NoError(t, err)
+	})
+
+	t.Run("PerBackendRelaxed", func(t *testing.T) {
+		// Relaxing verification for a single backend is
+		// rejected in the same way as at the top level.
+		config := newChecksumVerificationTestConfiguration(1, []*pb.BlobAccessDecoratorConfiguration{
+			newChecksumVerificationDecorator(0.1),
+		})
+		_, _, err := configuration.CreateBlobAccessObjects(config, false)
+		require.NoError(t, err)
+		_, _, err = configuration.CreateBlobAccessObjects(config, true)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("OutOfRange", func(t *testing.T) {
+		config := newChecksumVerificationTestConfiguration(1, []*pb.BlobAccessDecoratorConfiguration{
+			newChecksumVerificationDecorator(1.5),
+		})
+		_, _, err := configuration.CreateBlobAccessObjects(config, false)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestApplyBlobAccessDecorators(t *testing.T) {
+	ctx := context.Background()
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("ExistencePrecondition", func(t *testing.T) {
+		// Absent objects should be reported as
+		// FAILED_PRECONDITION.
+		blobAccess, err := configuration.ApplyBlobAccessDecorators(
+			blobstore.NewFakeBlobAccess(util.DigestKeyWithoutInstance),
+			[]*pb.BlobAccessDecoratorConfiguration{
+				{Decorator: &pb.BlobAccessDecoratorConfiguration_ExistencePrecondition{ExistencePrecondition: true}},
+			},
+			"cas",
+			util.DigestKeyWithoutInstance)
+		require.NoError(t, err)
+		_, _, err = blobAccess.Get(ctx, digest)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("InvalidDecorator", func(t *testing.T) {
+		_, err := configuration.ApplyBlobAccessDecorators(
+			blobstore.NewFakeBlobAccess(util.DigestKeyWithoutInstance),
+			[]*pb.BlobAccessDecoratorConfiguration{
+				{Decorator: &pb.BlobAccessDecoratorConfiguration_Metrics{Metrics: "outer"}},
+				{Decorator: &pb.BlobAccessDecoratorConfiguration_ExistencePrecondition{ExistencePrecondition: false}},
+			},
+			"cas",
+			util.DigestKeyWithoutInstance)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Failed to apply decorator 1: Existence precondition decorator must be set to true"), err)
+	})
+}
+
+func TestCreateBlobAccessObjectsRemote(t *testing.T) {
+	ctx := context.Background()
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	directory, err := ioutil.TempDir("", "remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+	writeFile := func(name string, contents []byte) string {
+		path := filepath.Join(directory, name)
+		require.NoError(t, ioutil.WriteFile(path, contents, 0666))
+		return path
+	}
+
+	// Server that returns the headers of the request as part of
+	// the response, so that they can be inspected.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ac/"+digest.GetHashString() {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Slow") != "" {
+			time.Sleep(time.Second)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, r.Header.Get("Authorization")+" "+r.Header.Get("X-Custom"))
+	})
+	newActionCache := func(t *testing.T, config *pb.RemoteBlobAccessConfiguration) (blobstore.BlobAccess, error) {
+		_, actionCache, err := configuration.CreateBlobAccessObjects(&pb.BlobstoreConfiguration{
+			ContentAddressableStorage: &pb.BlobAccessConfiguration{
+				Backend: &pb.BlobAccessConfiguration_Error{
+					Error: &status_pb.Status{Code: int32(codes.Unavailable), Message: "Backend unavailable"},
+				},
+			},
+			ActionCache: &pb.BlobAccessConfiguration{
+				Backend: &pb.BlobAccessConfiguration_Remote{Remote: config},
+			},
+		}, false)
+		return actionCache, err
+	}
+	getBody := func(t *testing.T, actionCache blobstore.BlobAccess) string {
+		_, r, err := actionCache.Get(ctx, digest)
+		require.NoError(t, err)
+		defer r.Close()
+		body, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("BasicAuth", func(t *testing.T) {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		actionCache, err := newActionCache(t, &pb.RemoteBlobAccessConfiguration{
+			Address: server.URL,
+			BasicAuth: &pb.RemoteBlobAccessBasicAuthentication{
+				Username: "user",
+				Password: "pass",
+			},
+			Headers: map[string]string{"X-Custom": "value"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, "Basic dXNlcjpwYXNz value", getBody(t, actionCache))
+	})
+
+	t.Run("BearerToken", func(t *testing.T) {
+		// Trailing whitespace in the token file should be
+		// ignored. The token should take precedence over
+		// credentials provided in the headers.
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		actionCache, err := newActionCache(t, &pb.RemoteBlobAccessConfiguration{
+			Address:         server.URL,
+			BearerTokenPath: writeFile("token", []byte("secret\n")),
+			Headers:         map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, "Bearer secret ", getBody(t, actionCache))
+	})
+
+	t.Run("BearerTokenNonExistent", func(t *testing.T) {
+		_, err := newActionCache(t, &pb.RemoteBlobAccessConfiguration{
+			Address:         "http://localhost:8080",
+			BearerTokenPath: filepath.Join(directory, "nonexistent"),
+		})
+		require.True(t, strings.HasPrefix(status.Convert(err).Message(), "Failed to read bearer token: "))
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		// The server's certificate should only be accepted if
+		// the certificate authority is provided.
+		server := httptest.NewTLSServer(handler)
+		defer server.Close()
+		certificateAuthorityPath := writeFile("ca.pem", pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: server.Certificate().Raw,
+		}))
+
+		actionCache, err := newActionCache(t, &pb.RemoteBlobAccessConfiguration{
+			Address: server.URL,
+			Tls:     &grpcclient_pb.TLSConfiguration{},
+		})
+		require.NoError(t, err)
+		_, _, err = actionCache.Get(ctx, digest)
+		require.Equal(t, codes.Unavailable, status.Code(err))
+
+		actionCache, err = newActionCache(t, &pb.RemoteBlobAccessConfiguration{
+			Address: server.URL,
+			Tls: &grpcclient_pb.TLSConfiguration{
+				ServerCertificateAuthorityPath: certificateAuthorityPath,
+				ServerNameOverride:             "example.com",
+			},
+			Headers: map[string]string{"X-Custom": "value"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, " value", getBody(t, actionCache))
+	})
+
+	t.Run("TLSInvalidCertificateAuthority", func(t *testing.T) {
+		_, err := newActionCache(t, &pb.RemoteBlobAccessConfiguration{
+			Address: "https://localhost:8080",
+			Tls: &grpcclient_pb.TLSConfiguration{
+				ServerCertificateAuthorityPath: writeFile("invalid.pem", []byte("Not a certificate")),
+			},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Failed to parse server certificate authorities"), err)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		// Requests exceeding the timeout should fail.
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		actionCache, err := newActionCache(t, &pb.RemoteBlobAccessConfiguration{
+			Address: server.URL,
+			Headers: map[string]string{"X-Slow": "true"},
+			Timeout: &duration.Duration{Nanos: 100000000},
+		})
+		require.NoError(t, err)
+		_, _, err = actionCache.Get(ctx, digest)
+		require.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("TimeoutInvalid", func(t *testing.T) {
+		_, err := newActionCache(t, &pb.RemoteBlobAccessConfiguration{
+			Address: "http://localhost:8080",
+			Timeout: &duration.Duration{Seconds: -1, Nanos: 1},
+		})
+		require.True(t, strings.HasPrefix(status.Convert(err).Message(), "Invalid timeout: "))
+	})
+}
+
+func TestCreateBlobAccessObjectsKeyFormat(t *testing.T) {
+	// Storage backend that records the digest key format with
+	// which it is created.
+	var digestKeyFormats []util.DigestKeyFormat
+	configuration.RegisterBlobAccessFactory("test_key_format", func(parameters *any.Any, storageType string, digestKeyFormat util.DigestKeyFormat, createBlobAccess configuration.BlobAccessCreator) (blobstore.BlobAccess, error) {
+		digestKeyFormats = append(digestKeyFormats, digestKeyFormat)
+		return blobstore.NewFakeBlobAccess(digestKeyFormat), nil
+	})
+	recordingBackend := &pb.BlobAccessConfiguration{
+		Backend: &pb.BlobAccessConfiguration_Custom{
+			Custom: &pb.CustomBlobAccessConfiguration{Name: "test_key_format"},
+		},
+	}
+	newKeyFormat := func(backend *pb.BlobAccessConfiguration, instanceName pb.KeyFormatBlobAccessConfiguration_InstanceName, hashKeys bool) *pb.BlobAccessConfiguration {
+		return &pb.BlobAccessConfiguration{
+			Backend: &pb.BlobAccessConfiguration_KeyFormat{
+				KeyFormat: &pb.KeyFormatBlobAccessConfiguration{
+					Backend:      backend,
+					InstanceName: instanceName,
+					HashKeys:     hashKeys,
+				},
+			},
+		}
+	}
+
+	t.Run("Inherit", func(t *testing.T) {
+		// By default, only keys of the Action Cache should
+		// include the instance name.
+		digestKeyFormats = nil
+		_, _, err := configuration.CreateBlobAccessObjects(&pb.BlobstoreConfiguration{
+			ContentAddressableStorage: newKeyFormat(recordingBackend, pb.KeyFormatBlobAccessConfiguration_INHERIT, false),
+			ActionCache:               newKeyFormat(recordingBackend, pb.KeyFormatBlobAccessConfiguration_INHERIT, true),
+		}, false)
+		require.NoError(t, err)
+		require.Equal(t, []util.DigestKeyFormat{
+			util.DigestKeyWithoutInstance,
+			util.DigestKeyWithInstanceHashed,
+		}, digestKeyFormats)
+	})
+
+	t.Run("Override", func(t *testing.T) {
+		// Hashing should be inherited by nested key formats,
+		// even if the instance name is overridden once more.
+		digestKeyFormats = nil
+		_, _, err := configuration.CreateBlobAccessObjects(&pb.BlobstoreConfiguration{
+			ContentAddressableStorage: newKeyFormat(recordingBackend, pb.KeyFormatBlobAccessConfiguration_INCLUDE, false),
+			ActionCache: newKeyFormat(
+				newKeyFormat(recordingBackend, pb.KeyFormatBlobAccessConfiguration_INCLUDE, false),
+				pb.KeyFormatBlobAccessConfiguration_EXCLUDE,
+				true),
+		}, false)
+		require.NoError(t, err)
+		require.Equal(t, []util.DigestKeyFormat{
+			util.DigestKeyWithInstance,
+			util.DigestKeyWithInstanceHashed,
+		}, digestKeyFormats)
+	})
+
+	t.Run("InvalidInstanceName", func(t *testing.T) {
+		_, _, err := configuration.CreateBlobAccessObjects(&pb.BlobstoreConfiguration{
+			ContentAddressableStorage: newKeyFormat(recordingBackend, 3, false),
+			ActionCache:               recordingBackend,
+		}, false)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Invalid instance name key format"), err)
+	})
+
+	t.Run("S3Hashed", func(t *testing.T) {
+		// S3 requires keys to be valid UTF-8.
+		_, _, err := configuration.CreateBlobAccessObjects(&pb.BlobstoreConfiguration{
+			ContentAddressableStorage: newKeyFormat(&pb.BlobAccessConfiguration{
+				Backend: &pb.BlobAccessConfiguration_S3{
+					S3: &pb.S3BlobAccessConfiguration{
+						Endpoint: "http://localhost:9000",
+						Bucket:   "cas",
+					},
+				},
+			}, pb.KeyFormatBlobAccessConfiguration_INHERIT, true),
+			ActionCache: recordingBackend,
+		}, false)
+		require.Equal(t, status.Error(codes.InvalidArgument, "S3 does not support hashed keys, as keys must be valid UTF-8"), err)
+	})
+}
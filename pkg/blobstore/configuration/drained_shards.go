@@ -0,0 +1,44 @@
+package configuration
+
+import (
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+)
+
+// DrainedShard describes a shard of a sharding backend that has no
+// backend configured. Requests for objects that map to such a shard
+// are routed to the remaining shards.
+type DrainedShard struct {
+	// Indices of the shard within the sharding backends enclosing
+	// it, outermost first.
+	Path []uint32
+	// Weight of the shard, as provided in the configuration.
+	Weight uint32
+}
+
+// GetDrainedShards returns the drained shards of all sharding backends
+// in a storage configuration. Sharding backends are found when they
+// are either placed at the top level, in a shard of another sharding
+// backend, or wrapped by decorators.
+func GetDrainedShards(config *pb.BlobAccessConfiguration) []DrainedShard {
+	return appendDrainedShards(nil, config, nil)
+}
+
+func appendDrainedShards(drainedShards []DrainedShard, config *pb.BlobAccessConfiguration, path []uint32) []DrainedShard {
+	switch backend := config.GetBackend().(type) {
+	case *pb.BlobAccessConfiguration_Decorated:
+		return appendDrainedShards(drainedShards, backend.Decorated.Backend, path)
+	case *pb.BlobAccessConfiguration_Sharding:
+		for i, shard := range backend.Sharding.Shard {
+			shardPath := append(append([]uint32(nil), path...), uint32(i))
+			if shard.Backend == nil {
+				drainedShards = append(drainedShards, DrainedShard{
+					Path:   shardPath,
+					Weight: shard.Weight,
+				})
+			} else {
+				drainedShards = appendDrainedShards(drainedShards, shard.Backend, shardPath)
+			}
+		}
+	}
+	return drainedShards
+}
@@ -0,0 +1,63 @@
+package configuration_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/stretchr/testify/require"
+	status_pb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+func TestGetDrainedShards(t *testing.T) {
+	backend := &pb.BlobAccessConfiguration{
+		Backend: &pb.BlobAccessConfiguration_Error{
+			Error: &status_pb.Status{Code: int32(codes.Unavailable), Message: "Backend unavailable"},
+		},
+	}
+
+	t.Run("Unsharded", func(t *testing.T) {
+		require.Empty(t, configuration.GetDrainedShards(backend))
+		require.Empty(t, configuration.GetDrainedShards(nil))
+	})
+
+	t.Run("Nested", func(t *testing.T) {
+		// Drained shards should be reported for sharding
+		// backends placed inside shards and decorators as well.
+		require.Equal(
+			t,
+			[]configuration.DrainedShard{
+				{Path: []uint32{0, 1}, Weight: 2},
+				{Path: []uint32{1}, Weight: 3},
+			},
+			configuration.GetDrainedShards(&pb.BlobAccessConfiguration{
+				Backend: &pb.BlobAccessConfiguration_Sharding{
+					Sharding: &pb.ShardingBlobAccessConfiguration{
+						Shard: []*pb.ShardingBlobAccessConfiguration_Shard{
+							{
+								Backend: &pb.BlobAccessConfiguration{
+									Backend: &pb.BlobAccessConfiguration_Decorated{
+										Decorated: &pb.DecoratedBlobAccessConfiguration{
+											Backend: &pb.BlobAccessConfiguration{
+												Backend: &pb.BlobAccessConfiguration_Sharding{
+													Sharding: &pb.ShardingBlobAccessConfiguration{
+														Shard: []*pb.ShardingBlobAccessConfiguration_Shard{
+															{Backend: backend, Weight: 1},
+															{Weight: 2},
+														},
+													},
+												},
+											},
+										},
+									},
+								},
+								Weight: 1,
+							},
+							{Weight: 3},
+						},
+					},
+				},
+			}))
+	})
+}
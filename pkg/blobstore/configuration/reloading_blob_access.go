@@ -0,0 +1,97 @@
+package configuration
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	configurationReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "configuration_reloads_total",
+			Help:      "Total number of attempts to reload the blob storage configuration.",
+		},
+		[]string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(configurationReloadsTotal)
+}
+
+// ConfigurationLoader is called to obtain the latest version of the
+// storage configuration.
+type ConfigurationLoader func() (*pb.BlobstoreConfiguration, error)
+
+// CreateReloadingBlobAccessObjects is identical to
+// CreateBlobAccessObjects, except that the configuration is loaded
+// again every time the process receives SIGHUP. The returned
+// BlobAccess objects then forward requests to newly created backends.
+// If the new configuration is invalid (e.g., because it relaxes
+// checksum verification while requireChecksumVerification is set), the
+// existing backends remain in use.
+//
+// Connections and clients used by the old backends are closed once all
+// requests that are still using them have completed.
+//
+// Local storage backends (e.g., "circular") should not be reloaded, as
+// the old and new backends would operate on the same files
+// concurrently.
+func CreateReloadingBlobAccessObjects(loadConfig ConfigurationLoader, requireChecksumVerification bool) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	options := &blobAccessCreationOptions{
+		requireChecksumVerification: requireChecksumVerification,
+	}
+	contentAddressableStorage, actionCache, err := createBlobAccessObjects(config, options)
+	if err != nil {
+		options.closeAll()
+		return nil, nil, err
+	}
+	reloadingContentAddressableStorage := blobstore.NewReloadingBlobAccess(contentAddressableStorage, options.closers["cas"])
+	reloadingActionCache := blobstore.NewReloadingBlobAccess(actionCache, options.closers["ac"])
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := reloadBlobAccessObjects(loadConfig, requireChecksumVerification, reloadingContentAddressableStorage, reloadingActionCache); err != nil {
+				logrus.WithError(err).Error("Failed to reload blob storage configuration")
+				configurationReloadsTotal.WithLabelValues("Failure").Inc()
+			} else {
+				logrus.Info("Reloaded blob storage configuration")
+				configurationReloadsTotal.WithLabelValues("Success").Inc()
+			}
+		}
+	}()
+	return reloadingContentAddressableStorage, reloadingActionCache, nil
+}
+
+func reloadBlobAccessObjects(loadConfig ConfigurationLoader, requireChecksumVerification bool, contentAddressableStorage blobstore.ReloadingBlobAccess, actionCache blobstore.ReloadingBlobAccess) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	options := &blobAccessCreationOptions{
+		requireChecksumVerification: requireChecksumVerification,
+	}
+	newContentAddressableStorage, newActionCache, err := createBlobAccessObjects(config, options)
+	if err != nil {
+		// Release connections of backends that were created
+		// before the error occurred.
+		options.closeAll()
+		return err
+	}
+	contentAddressableStorage.SetBackend(newContentAddressableStorage, options.closers["cas"])
+	actionCache.SetBackend(newActionCache, options.closers["ac"])
+	return nil
+}
@@ -1,14 +1,14 @@
 package blobstore
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"sync"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
 	"github.com/google/uuid"
 
 	"google.golang.org/genproto/googleapis/bytestream"
@@ -20,7 +20,9 @@ import (
 type contentAddressableStorageBlobAccess struct {
 	byteStreamClient                bytestream.ByteStreamClient
 	contentAddressableStorageClient remoteexecution.ContentAddressableStorageClient
-	readChunkSize                   int
+	chunkPool                       *ChunkBufferPool
+	findMissingMaxRequestSizeBytes  int
+	findMissingConcurrency          int
 }
 
 // NewContentAddressableStorageBlobAccess creates a BlobAccess handle
@@ -28,16 +30,23 @@ type contentAddressableStorageBlobAccess struct {
 // bytestream.ByteStream and remoteexecution.ContentAddressableStorage
 // services. Those are the services that Bazel uses to access blobs
 // stored in the Content Addressable Storage.
-func NewContentAddressableStorageBlobAccess(client *grpc.ClientConn, readChunkSize int) BlobAccess {
+//
+// Calls to FindMissing() are split up into requests that are at most
+// findMissingMaxRequestSizeBytes in size, of which up to
+// findMissingConcurrency are executed in parallel.
+func NewContentAddressableStorageBlobAccess(client *grpc.ClientConn, readChunkSize int, findMissingMaxRequestSizeBytes int, findMissingConcurrency int) BlobAccess {
 	return &contentAddressableStorageBlobAccess{
 		byteStreamClient:                bytestream.NewByteStreamClient(client),
 		contentAddressableStorageClient: remoteexecution.NewContentAddressableStorageClient(client),
-		readChunkSize:                   readChunkSize,
+		chunkPool:                       NewChunkBufferPool(readChunkSize),
+		findMissingMaxRequestSizeBytes:  findMissingMaxRequestSizeBytes,
+		findMissingConcurrency:          findMissingConcurrency,
 	}
 }
 
 type byteStreamBlobReader struct {
 	client  bytestream.ByteStream_ReadClient
+	cancel  context.CancelFunc
 	partial []byte
 }
 
@@ -60,6 +69,9 @@ func (r *byteStreamBlobReader) Read(p []byte) (int, error) {
 }
 
 func (r *byteStreamBlobReader) Close() error {
+	// Cancel the stream, so that the server stops sending data
+	// when the reader is closed before reaching the end of the blob.
+	r.cancel()
 	return nil
 }
 
@@ -71,20 +83,25 @@ func (ba *contentAddressableStorageBlobAccess) Get(ctx context.Context, digest *
 	} else {
 		readRequest.ResourceName = fmt.Sprintf("%s/blobs/%s/%d", instance, digest.GetHashString(), sizeBytes)
 	}
-	client, err := ba.byteStreamClient.Read(ctx, &readRequest)
+	ctxWithCancel, cancel := context.WithCancel(ctx)
+	client, err := ba.byteStreamClient.Read(ctxWithCancel, &readRequest)
 	if err != nil {
+		cancel()
 		return 0, nil, err
 	}
 
 	// Read first chunk to detect errors eagerly.
 	chunk, err := client.Recv()
 	if err == io.EOF {
-		return sizeBytes, ioutil.NopCloser(bytes.NewBuffer(nil)), nil
+		cancel()
+		return sizeBytes, NewBytesReader(nil), nil
 	} else if err != nil {
+		cancel()
 		return 0, nil, err
 	}
 	return sizeBytes, &byteStreamBlobReader{
 		client:  client,
+		cancel:  cancel,
 		partial: chunk.Data,
 	}, nil
 }
@@ -92,6 +109,11 @@ func (ba *contentAddressableStorageBlobAccess) Get(ctx context.Context, digest *
 func (ba *contentAddressableStorageBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
 	defer r.Close()
 
+	// Cancel the stream when returning early (e.g., because reading
+	// the blob failed), so that the server does not keep waiting for
+	// data that is never going to be sent.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	client, err := ba.byteStreamClient.Write(ctx)
 	if err != nil {
 		return err
@@ -104,36 +126,46 @@ func (ba *contentAddressableStorageBlobAccess) Put(ctx context.Context, digest *
 		resourceName = fmt.Sprintf("%s/uploads/%s/blobs/%s/%d", instance, uuid.Must(uuid.NewRandom()), digest.GetHashString(), digest.GetSizeBytes())
 	}
 
+	// Non-terminating chunks.
 	writeOffset := int64(0)
-	for {
-		readBuf := make([]byte, ba.readChunkSize)
-		if n, err := r.Read(readBuf[:]); err == nil {
-			// Non-terminating chunk.
-			if err := client.Send(&bytestream.WriteRequest{
-				ResourceName: resourceName,
-				WriteOffset:  writeOffset,
-				Data:         readBuf[:n],
-			}); err != nil {
-				return err
-			}
-			writeOffset += int64(n)
-			resourceName = ""
-		} else if err == io.EOF {
-			// Terminating chunk.
-			if err := client.Send(&bytestream.WriteRequest{
-				ResourceName: resourceName,
-				WriteOffset:  writeOffset,
-				FinishWrite:  true,
-				Data:         readBuf[:n],
-			}); err != nil {
-				return err
-			}
-			_, err := client.CloseAndRecv()
-			return err
-		} else {
-			return err
+	if err := ba.chunkPool.SendInChunks(r, func(chunk []byte) error {
+		if err := client.Send(&bytestream.WriteRequest{
+			ResourceName: resourceName,
+			WriteOffset:  writeOffset,
+			Data:         chunk,
+		}); err != nil {
+			return getWriteError(client, err)
 		}
+		writeOffset += int64(len(chunk))
+		resourceName = ""
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Terminating chunk.
+	if err := client.Send(&bytestream.WriteRequest{
+		ResourceName: resourceName,
+		WriteOffset:  writeOffset,
+		FinishWrite:  true,
+	}); err != nil {
+		return getWriteError(client, err)
 	}
+	_, err = client.CloseAndRecv()
+	return err
+}
+
+// getWriteError converts an error returned by Send() to the error with
+// which the server terminated the stream. Send() only returns io.EOF in
+// that case.
+func getWriteError(client bytestream.ByteStream_WriteClient, err error) error {
+	if err == io.EOF {
+		_, err = client.CloseAndRecv()
+		if err == nil {
+			return status.Error(codes.Internal, "Server terminated write stream without returning an error")
+		}
+	}
+	return err
 }
 
 func (ba *contentAddressableStorageBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
@@ -141,22 +173,69 @@ func (ba *contentAddressableStorageBlobAccess) Delete(ctx context.Context, diges
 }
 
 func (ba *contentAddressableStorageBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
-	// Convert digests to line format.
+	// Convert digests to line format, splitting them up into
+	// batches to prevent exceeding gRPC message size limits.
 	if len(digests) == 0 {
 		return nil, nil
 	}
 	instance := digests[0].GetInstance()
-	request := remoteexecution.FindMissingBlobsRequest{
-		InstanceName: instance,
-	}
+	var batches [][]*remoteexecution.Digest
+	var batch []*remoteexecution.Digest
+	batchSizeBytes := len(instance)
 	for _, digest := range digests {
 		if digest.GetInstance() != instance {
 			return nil, status.Error(codes.InvalidArgument, "Cannot use mixed instance names in a single request")
 		}
-		request.BlobDigests = append(request.BlobDigests, digest.GetPartialDigest())
+		partialDigest := digest.GetPartialDigest()
+		// Account for the field tag and length prefix.
+		digestSizeBytes := proto.Size(partialDigest) + 4
+		if len(batch) > 0 && batchSizeBytes+digestSizeBytes > ba.findMissingMaxRequestSizeBytes {
+			batches = append(batches, batch)
+			batch = nil
+			batchSizeBytes = len(instance)
+		}
+		batch = append(batch, partialDigest)
+		batchSizeBytes += digestSizeBytes
 	}
+	batches = append(batches, batch)
+	if len(batches) == 1 {
+		return ba.findMissingBatch(ctx, instance, batches[0])
+	}
+
+	// Process batches in parallel, with bounded concurrency.
+	results := make([][]*util.Digest, len(batches))
+	errs := make([]error, len(batches))
+	semaphore := make(chan struct{}, ba.findMissingConcurrency)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, batch []*remoteexecution.Digest) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			results[i], errs[i] = ba.findMissingBatch(ctx, instance, batch)
+		}(i, batch)
+	}
+	wg.Wait()
+
+	// Merge results.
+	var outDigests []*util.Digest
+	for i, result := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		outDigests = append(outDigests, result...)
+	}
+	return outDigests, nil
+}
 
-	response, err := ba.contentAddressableStorageClient.FindMissingBlobs(ctx, &request)
+func (ba *contentAddressableStorageBlobAccess) findMissingBatch(ctx context.Context, instance string, partialDigests []*remoteexecution.Digest) ([]*util.Digest, error) {
+	response, err := ba.contentAddressableStorageClient.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+		InstanceName: instance,
+		BlobDigests:  partialDigests,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,152 @@
+package blobstore_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newContentAddressableStorageClientConn creates an RPC client
+// connection to a ContentAddressableStorageServer.
+func newContentAddressableStorageClientConn(ctx context.Context, t *testing.T, contentAddressableStorageServer remoteexecution.ContentAddressableStorageServer) (*grpc.ClientConn, func()) {
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	remoteexecution.RegisterContentAddressableStorageServer(server, contentAddressableStorageServer)
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	return conn, func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func TestContentAddressableStorageBlobAccessFindMissing(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Every test uses a server of its own, so that expectations
+	// of requests sent by one test don't carry over to the next.
+	newBlobAccess := func() (*mock.MockContentAddressableStorageServer, blobstore.BlobAccess, func()) {
+		contentAddressableStorageServer := mock.NewMockContentAddressableStorageServer(ctrl)
+		conn, cleanup := newContentAddressableStorageClientConn(ctx, t, contentAddressableStorageServer)
+		return contentAddressableStorageServer, blobstore.NewContentAddressableStorageBlobAccess(conn, 65536, 1000, 2), cleanup
+	}
+
+	var digests []*util.Digest
+	for i := 0; i < 100; i++ {
+		digests = append(digests, util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      fmt.Sprintf("%064x", i),
+			SizeBytes: int64(i),
+		}))
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		// Empty calls should not cause any requests to be sent.
+		_, blobAccess, cleanup := newBlobAccess()
+		defer cleanup()
+		missing, err := blobAccess.FindMissing(ctx, nil)
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("MixedInstances", func(t *testing.T) {
+		_, blobAccess, cleanup := newBlobAccess()
+		defer cleanup()
+		_, err := blobAccess.FindMissing(ctx, []*util.Digest{
+			digests[0],
+			util.MustNewDigest("ubuntu16-04", digests[1].GetPartialDigest()),
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Cannot use mixed instance names in a single request"), err)
+	})
+
+	t.Run("Batched", func(t *testing.T) {
+		// Large calls should be split up into requests that
+		// remain below the size limit, of which no more than
+		// two should run in parallel. Results should be
+		// returned in the original order.
+		contentAddressableStorageServer, blobAccess, cleanup := newBlobAccess()
+		defer cleanup()
+		var lock sync.Mutex
+		inFlight, maxInFlight, requests := 0, 0, 0
+		contentAddressableStorageServer.EXPECT().FindMissingBlobs(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, in *remoteexecution.FindMissingBlobsRequest) (*remoteexecution.FindMissingBlobsResponse, error) {
+				require.Equal(t, "debian8", in.InstanceName)
+				require.True(t, proto.Size(in) <= 1000)
+
+				lock.Lock()
+				inFlight++
+				requests++
+				if maxInFlight < inFlight {
+					maxInFlight = inFlight
+				}
+				lock.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				lock.Lock()
+				inFlight--
+				lock.Unlock()
+
+				// Report blobs with an even size as missing.
+				var missing []*remoteexecution.Digest
+				for _, digest := range in.BlobDigests {
+					if digest.SizeBytes%2 == 0 {
+						missing = append(missing, digest)
+					}
+				}
+				return &remoteexecution.FindMissingBlobsResponse{
+					MissingBlobDigests: missing,
+				}, nil
+			}).MinTimes(2)
+
+		missing, err := blobAccess.FindMissing(ctx, digests)
+		require.NoError(t, err)
+		var expectedMissingKeys, missingKeys []string
+		for i := 0; i < len(digests); i += 2 {
+			expectedMissingKeys = append(expectedMissingKeys, digests[i].GetKey(util.DigestKeyWithInstance))
+		}
+		for _, digest := range missing {
+			missingKeys = append(missingKeys, digest.GetKey(util.DigestKeyWithInstance))
+		}
+		require.Equal(t, expectedMissingKeys, missingKeys)
+		require.True(t, requests > 1)
+		require.True(t, maxInFlight <= 2)
+	})
+
+	t.Run("BatchFailure", func(t *testing.T) {
+		// Errors of any of the requests should be propagated.
+		contentAddressableStorageServer, blobAccess, cleanup := newBlobAccess()
+		defer cleanup()
+		contentAddressableStorageServer.EXPECT().FindMissingBlobs(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, in *remoteexecution.FindMissingBlobsRequest) (*remoteexecution.FindMissingBlobsResponse, error) {
+				for _, digest := range in.BlobDigests {
+					if digest.SizeBytes == 99 {
+						return nil, status.Error(codes.Unavailable, "Server offline")
+					}
+				}
+				return &remoteexecution.FindMissingBlobsResponse{}, nil
+			}).MinTimes(2)
+
+		_, err := blobAccess.FindMissing(ctx, digests)
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+}
@@ -0,0 +1,107 @@
+package blobstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CopyBlobsResult contains statistics on the blobs processed by
+// CopyBlobs().
+type CopyBlobsResult struct {
+	// Number of blobs and bytes copied to the destination.
+	BlobsCopied int64
+	BytesCopied int64
+	// Number of blobs that were already present in the destination.
+	BlobsSkipped int64
+	// Number of blobs that were absent in the source.
+	BlobsMissing int64
+}
+
+// CopyBlobs copies a set of blobs from one BlobAccess to another.
+// Blobs that are already present in the destination are not copied
+// again, which makes it possible to resume an interrupted copy by
+// simply running it again.
+//
+// Presence is checked by calling FindMissing() on batches of
+// batchSize blobs, after which up to concurrency blobs are transferred
+// in parallel.
+func CopyBlobs(ctx context.Context, source BlobAccess, destination BlobAccess, digests []*util.Digest, batchSize int, concurrency int) (CopyBlobsResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var result CopyBlobsResult
+	var lock sync.Mutex
+	var firstErr error
+	copyBlob := func(digest *util.Digest) {
+		length, r, err := source.Get(ctx, digest)
+		if err == nil {
+			err = destination.Put(ctx, digest, length, r)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if status.Code(err) == codes.NotFound {
+			// Blob disappeared from the source, e.g. due
+			// to eviction. Nothing to copy.
+			result.BlobsMissing++
+		} else if err != nil {
+			if firstErr == nil {
+				firstErr = util.StatusWrapf(err, "Failed to copy blob %s", digest)
+				cancel()
+			}
+		} else {
+			result.BlobsCopied++
+			result.BytesCopied += length
+		}
+	}
+
+	digestsChan := make(chan *util.Digest)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for digest := range digestsChan {
+				copyBlob(digest)
+			}
+		}()
+	}
+
+	err := func() error {
+		for len(digests) > 0 {
+			batch := digests
+			if len(batch) > batchSize {
+				batch = batch[:batchSize]
+			}
+			digests = digests[len(batch):]
+
+			missing, err := destination.FindMissing(ctx, batch)
+			if err != nil {
+				return util.StatusWrap(err, "Failed to find missing blobs in destination")
+			}
+			lock.Lock()
+			result.BlobsSkipped += int64(len(batch) - len(missing))
+			lock.Unlock()
+			for _, digest := range missing {
+				select {
+				case digestsChan <- digest:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		return nil
+	}()
+	close(digestsChan)
+	wg.Wait()
+
+	if firstErr != nil {
+		return result, firstErr
+	}
+	return result, err
+}
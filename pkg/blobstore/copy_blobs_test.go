@@ -0,0 +1,59 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCopyBlobs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	presentDigest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	copiedDigest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+	vanishedDigest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      "acbd18db4cc2f85cedef654fccc4a4d8",
+		SizeBytes: 3,
+	})
+	source := mock.NewMockBlobAccess(ctrl)
+	destination := mock.NewMockBlobAccess(ctrl)
+
+	// Blobs already present in the destination should be skipped.
+	// Blobs that have disappeared from the source should not cause
+	// copying to fail.
+	destination.EXPECT().FindMissing(gomock.Any(), []*util.Digest{presentDigest, copiedDigest}).Return(
+		[]*util.Digest{copiedDigest}, nil)
+	destination.EXPECT().FindMissing(gomock.Any(), []*util.Digest{vanishedDigest}).Return(
+		[]*util.Digest{vanishedDigest}, nil)
+	r := ioutil.NopCloser(bytes.NewBufferString("Goodbye"))
+	source.EXPECT().Get(gomock.Any(), copiedDigest).Return(int64(7), r, nil)
+	destination.EXPECT().Put(gomock.Any(), copiedDigest, int64(7), r).Return(nil)
+	source.EXPECT().Get(gomock.Any(), vanishedDigest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+
+	result, err := blobstore.CopyBlobs(ctx, source, destination, []*util.Digest{presentDigest, copiedDigest, vanishedDigest}, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, blobstore.CopyBlobsResult{
+		BlobsCopied:  1,
+		BytesCopied:  7,
+		BlobsSkipped: 1,
+		BlobsMissing: 1,
+	}, result)
+}
@@ -0,0 +1,128 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type deadlineEnforcingBlobAccess struct {
+	BlobAccess
+	getTimeout         time.Duration
+	putTimeout         time.Duration
+	findMissingTimeout time.Duration
+}
+
+// NewDeadlineEnforcingBlobAccess creates a BlobAccess that limits the
+// amount of time operations against another BlobAccess may take. This
+// prevents unresponsive backends (e.g., a Redis server whose
+// connections hang) from stalling build actions indefinitely.
+//
+// The timeout for Get() covers the entire transfer, ending when the
+// returned reader is closed. Delete() uses the timeout for Put(). A
+// timeout of zero disables the timeout for an operation.
+func NewDeadlineEnforcingBlobAccess(blobAccess BlobAccess, getTimeout time.Duration, putTimeout time.Duration, findMissingTimeout time.Duration) BlobAccess {
+	return &deadlineEnforcingBlobAccess{
+		BlobAccess:         blobAccess,
+		getTimeout:         getTimeout,
+		putTimeout:         putTimeout,
+		findMissingTimeout: findMissingTimeout,
+	}
+}
+
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// convertDeadlineExceeded converts errors caused by a timeout being
+// exceeded to DEADLINE_EXCEEDED, regardless of how the backend reported
+// them.
+func convertDeadlineExceeded(ctx context.Context, err error, operation string, timeout time.Duration) error {
+	if ctx.Err() == context.DeadlineExceeded && status.Code(err) != codes.DeadlineExceeded {
+		return util.StatusWrapfWithCode(err, codes.DeadlineExceeded, "%s did not complete within %s", operation, timeout)
+	}
+	return err
+}
+
+func (ba *deadlineEnforcingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	ctxWithTimeout, cancel := withOptionalTimeout(ctx, ba.getTimeout)
+	length, r, err := ba.BlobAccess.Get(ctxWithTimeout, digest)
+	if err != nil {
+		err = convertDeadlineExceeded(ctxWithTimeout, err, "Get", ba.getTimeout)
+		cancel()
+		return 0, nil, err
+	}
+	return length, &deadlineEnforcingReader{
+		ReadCloser: r,
+		ctx:        ctxWithTimeout,
+		cancel:     cancel,
+		timeout:    ba.getTimeout,
+	}, nil
+}
+
+func (ba *deadlineEnforcingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	ctxWithTimeout, cancel := withOptionalTimeout(ctx, ba.putTimeout)
+	defer cancel()
+	err := ba.BlobAccess.Put(ctxWithTimeout, digest, sizeBytes, &deadlineEnforcingReader{
+		ReadCloser: r,
+		ctx:        ctxWithTimeout,
+		cancel:     func() {},
+		timeout:    ba.putTimeout,
+	})
+	return convertDeadlineExceeded(ctxWithTimeout, err, "Put", ba.putTimeout)
+}
+
+func (ba *deadlineEnforcingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	ctxWithTimeout, cancel := withOptionalTimeout(ctx, ba.putTimeout)
+	defer cancel()
+	err := ba.BlobAccess.Delete(ctxWithTimeout, digest)
+	return convertDeadlineExceeded(ctxWithTimeout, err, "Delete", ba.putTimeout)
+}
+
+func (ba *deadlineEnforcingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	ctxWithTimeout, cancel := withOptionalTimeout(ctx, ba.findMissingTimeout)
+	defer cancel()
+	missing, err := ba.BlobAccess.FindMissing(ctxWithTimeout, digests)
+	if err != nil {
+		return nil, convertDeadlineExceeded(ctxWithTimeout, err, "FindMissing", ba.findMissingTimeout)
+	}
+	return missing, nil
+}
+
+// deadlineEnforcingReader stops returning data once the timeout of the
+// operation has been exceeded. This ensures that backends that read
+// data from memory or from clients also respect the timeout.
+type deadlineEnforcingReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+func (r *deadlineEnforcingReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		if err == context.DeadlineExceeded {
+			return 0, status.Errorf(codes.DeadlineExceeded, "Transfer did not complete within %s", r.timeout)
+		}
+		return 0, status.Error(codes.Canceled, err.Error())
+	}
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = convertDeadlineExceeded(r.ctx, err, "Transfer", r.timeout)
+	}
+	return n, err
+}
+
+func (r *deadlineEnforcingReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,83 @@
+package blobstore_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeadlineEnforcingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("GetHangingBackend", func(t *testing.T) {
+		// Backends that only return once their context is
+		// cancelled should cause DEADLINE_EXCEEDED.
+		bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+		bottomBlobAccess.EXPECT().Get(gomock.Any(), digest).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+				<-ctx.Done()
+				return 0, nil, status.Error(codes.Unavailable, "Connection closed")
+			})
+		blobAccess := blobstore.NewDeadlineEnforcingBlobAccess(bottomBlobAccess, time.Millisecond, 0, 0)
+
+		_, _, err := blobAccess.Get(ctx, digest)
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+
+	t.Run("GetTransferTimeout", func(t *testing.T) {
+		// The timeout should also apply to reading data after
+		// Get() has returned.
+		bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+		bottomBlobAccess.EXPECT().Get(gomock.Any(), digest).Return(int64(5), blobstore.NewBytesReader([]byte("Hello")), nil)
+		blobAccess := blobstore.NewDeadlineEnforcingBlobAccess(bottomBlobAccess, time.Millisecond, 0, 0)
+
+		_, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		_, err = ioutil.ReadAll(r)
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("PutSuccess", func(t *testing.T) {
+		// Requests that complete in time should pass through.
+		blobAccess := blobstore.NewDeadlineEnforcingBlobAccess(
+			blobstore.NewFakeBlobAccess(util.DigestKeyWithInstance),
+			0, time.Minute, time.Minute)
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("FindMissingHangingBackend", func(t *testing.T) {
+		bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+		bottomBlobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{digest}).DoAndReturn(
+			func(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+		blobAccess := blobstore.NewDeadlineEnforcingBlobAccess(bottomBlobAccess, 0, 0, time.Millisecond)
+
+		_, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+}
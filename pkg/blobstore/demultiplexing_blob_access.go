@@ -0,0 +1,88 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// BlobAccessGetter is the callback type used by the demultiplexing
+// BlobAccess and is invoked for every operation.
+type BlobAccessGetter func(instanceName string) (BlobAccess, error)
+
+type demultiplexingBlobAccess struct {
+	blobAccessGetter BlobAccessGetter
+}
+
+// NewDemultiplexingBlobAccess creates a BlobAccess that demultiplexes
+// operations based on the instance name stored in the provided digest.
+// This makes it possible to let instance names act as separate storage
+// namespaces, each backed by its own storage backend (e.g., a
+// different Redis database or S3 key prefix).
+func NewDemultiplexingBlobAccess(blobAccessGetter BlobAccessGetter) BlobAccess {
+	return &demultiplexingBlobAccess{
+		blobAccessGetter: blobAccessGetter,
+	}
+}
+
+func (ba *demultiplexingBlobAccess) getBackend(instance string) (BlobAccess, error) {
+	backend, err := ba.blobAccessGetter(instance)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to obtain backend for instance %#v", instance)
+	}
+	return backend, nil
+}
+
+func (ba *demultiplexingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	backend, err := ba.getBackend(digest.GetInstance())
+	if err != nil {
+		return 0, nil, err
+	}
+	return backend.Get(ctx, digest)
+}
+
+func (ba *demultiplexingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	backend, err := ba.getBackend(digest.GetInstance())
+	if err != nil {
+		r.Close()
+		return err
+	}
+	return backend.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *demultiplexingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	backend, err := ba.getBackend(digest.GetInstance())
+	if err != nil {
+		return err
+	}
+	return backend.Delete(ctx, digest)
+}
+
+func (ba *demultiplexingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	// Group digests by instance name, so that every backend only
+	// receives a single request.
+	var instances []string
+	digestsPerInstance := map[string][]*util.Digest{}
+	for _, digest := range digests {
+		instance := digest.GetInstance()
+		if _, ok := digestsPerInstance[instance]; !ok {
+			instances = append(instances, instance)
+		}
+		digestsPerInstance[instance] = append(digestsPerInstance[instance], digest)
+	}
+
+	var missing []*util.Digest
+	for _, instance := range instances {
+		backend, err := ba.getBackend(instance)
+		if err != nil {
+			return nil, err
+		}
+		backendMissing, err := backend.FindMissing(ctx, digestsPerInstance[instance])
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, backendMissing...)
+	}
+	return missing, nil
+}
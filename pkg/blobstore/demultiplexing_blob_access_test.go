@@ -0,0 +1,68 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDemultiplexingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	debian8Backend := mock.NewMockBlobAccess(ctrl)
+	ubuntu1604Backend := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewDemultiplexingBlobAccess(func(instance string) (blobstore.BlobAccess, error) {
+		switch instance {
+		case "debian8":
+			return debian8Backend, nil
+		case "ubuntu16-04":
+			return ubuntu1604Backend, nil
+		}
+		return nil, status.Error(codes.InvalidArgument, "Unknown instance name")
+	})
+
+	digest1 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	digest2 := util.MustNewDigest("ubuntu16-04", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	digest3 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+
+	t.Run("DeleteSuccess", func(t *testing.T) {
+		ubuntu1604Backend.EXPECT().Delete(ctx, digest2).Return(nil)
+		require.NoError(t, blobAccess.Delete(ctx, digest2))
+	})
+
+	t.Run("DeleteUnknownInstance", func(t *testing.T) {
+		err := blobAccess.Delete(ctx, util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		}))
+		require.Equal(t, status.Error(codes.InvalidArgument, "Failed to obtain backend for instance \"freebsd12\": Unknown instance name"), err)
+	})
+
+	t.Run("FindMissing", func(t *testing.T) {
+		// Digests should be grouped by instance name.
+		debian8Backend.EXPECT().FindMissing(ctx, []*util.Digest{digest1, digest3}).Return([]*util.Digest{digest3}, nil)
+		ubuntu1604Backend.EXPECT().FindMissing(ctx, []*util.Digest{digest2}).Return([]*util.Digest{digest2}, nil)
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest1, digest2, digest3})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest3, digest2}, missing)
+	})
+}
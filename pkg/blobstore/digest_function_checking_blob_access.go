@@ -0,0 +1,56 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+type digestFunctionCheckingBlobAccess struct {
+	BlobAccess
+	policy *util.DigestFunctionPolicy
+}
+
+// NewDigestFunctionCheckingBlobAccess creates a BlobAccess that rejects
+// requests for digests computed with hashing algorithms that are not
+// permitted for the instance name of the request. It is used by the
+// frontend to ensure that every instance name only contains objects
+// using the hashing algorithms it announces through GetCapabilities().
+func NewDigestFunctionCheckingBlobAccess(blobAccess BlobAccess, policy *util.DigestFunctionPolicy) BlobAccess {
+	return &digestFunctionCheckingBlobAccess{
+		BlobAccess: blobAccess,
+		policy:     policy,
+	}
+}
+
+func (ba *digestFunctionCheckingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	if err := ba.policy.ValidateDigest(digest); err != nil {
+		return 0, nil, err
+	}
+	return ba.BlobAccess.Get(ctx, digest)
+}
+
+func (ba *digestFunctionCheckingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	if err := ba.policy.ValidateDigest(digest); err != nil {
+		r.Close()
+		return err
+	}
+	return ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *digestFunctionCheckingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if err := ba.policy.ValidateDigest(digest); err != nil {
+		return err
+	}
+	return ba.BlobAccess.Delete(ctx, digest)
+}
+
+func (ba *digestFunctionCheckingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	for _, digest := range digests {
+		if err := ba.policy.ValidateDigest(digest); err != nil {
+			return nil, err
+		}
+	}
+	return ba.BlobAccess.FindMissing(ctx, digests)
+}
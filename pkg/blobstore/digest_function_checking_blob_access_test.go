@@ -0,0 +1,66 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDigestFunctionCheckingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Instance "bazel" only permits SHA-256, while all other
+	// instances also permit MD5.
+	policy, err := util.NewDigestFunctionPolicy(
+		[]remoteexecution.DigestFunction{
+			remoteexecution.DigestFunction_SHA256,
+			remoteexecution.DigestFunction_MD5,
+		},
+		map[string][]remoteexecution.DigestFunction{
+			"bazel": {remoteexecution.DigestFunction_SHA256},
+		})
+	require.NoError(t, err)
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewDigestFunctionCheckingBlobAccess(bottomBlobAccess, policy)
+
+	sha256Digest := util.MustNewDigest("bazel", &remoteexecution.Digest{
+		Hash:      "185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess.EXPECT().Get(ctx, sha256Digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	_, r, err := blobAccess.Get(ctx, sha256Digest)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	md5Digest := util.MustNewDigest("bazel", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	_, _, err = blobAccess.Get(ctx, md5Digest)
+	require.Equal(t, status.Error(codes.InvalidArgument, "Digest function MD5 is not permitted for instance \"bazel\""), err)
+	err = blobAccess.Put(ctx, md5Digest, 5, ioutil.NopCloser(bytes.NewBufferString("Hello")))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = blobAccess.FindMissing(ctx, []*util.Digest{sha256Digest, md5Digest})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	otherDigest := util.MustNewDigest("other", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{otherDigest}).Return(nil, nil)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{otherDigest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
@@ -0,0 +1,76 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+type errorAnnotatingBlobAccess struct {
+	BlobAccess
+	backend string
+}
+
+// NewErrorAnnotatingBlobAccess creates a BlobAccess that prepends the
+// operation, the digest (including the instance name) and the name of
+// the backend to errors returned by another BlobAccess, including
+// errors that occur while reading blobs. It is placed on top of
+// backends that perform I/O, so that errors logged by clients and
+// frontends can be traced back to the backend at which they occurred.
+func NewErrorAnnotatingBlobAccess(blobAccess BlobAccess, backend string) BlobAccess {
+	return &errorAnnotatingBlobAccess{
+		BlobAccess: blobAccess,
+		backend:    backend,
+	}
+}
+
+func (ba *errorAnnotatingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	length, r, err := ba.BlobAccess.Get(ctx, digest)
+	if err != nil {
+		return 0, nil, util.StatusWrapWithDigest(err, "Get", digest, ba.backend)
+	}
+	return length, &errorAnnotatingReader{
+		ReadCloser: r,
+		digest:     digest,
+		backend:    ba.backend,
+	}, nil
+}
+
+func (ba *errorAnnotatingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	if err := ba.BlobAccess.Put(ctx, digest, sizeBytes, r); err != nil {
+		return util.StatusWrapWithDigest(err, "Put", digest, ba.backend)
+	}
+	return nil
+}
+
+func (ba *errorAnnotatingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if err := ba.BlobAccess.Delete(ctx, digest); err != nil {
+		return util.StatusWrapWithDigest(err, "Delete", digest, ba.backend)
+	}
+	return nil
+}
+
+func (ba *errorAnnotatingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	missing, err := ba.BlobAccess.FindMissing(ctx, digests)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "FindMissing of %d blobs on backend %#v", len(digests), ba.backend)
+	}
+	return missing, nil
+}
+
+// errorAnnotatingReader annotates errors that occur while reading a
+// blob. io.EOF is returned as is, as callers compare against it.
+type errorAnnotatingReader struct {
+	io.ReadCloser
+	digest  *util.Digest
+	backend string
+}
+
+func (r *errorAnnotatingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = util.StatusWrapWithDigest(err, "Read", r.digest, r.backend)
+	}
+	return n, err
+}
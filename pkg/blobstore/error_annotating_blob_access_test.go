@@ -0,0 +1,70 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorAnnotatingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewErrorAnnotatingBlobAccess(bottomBlobAccess, "cas_redis")
+
+	// Errors should be annotated with the operation, the digest and
+	// the name of the backend, while retaining the error code.
+	bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(0), nil, status.Error(codes.DeadlineExceeded, "context deadline exceeded"))
+	_, _, err := blobAccess.Get(ctx, digest)
+	require.Equal(t, status.Error(codes.DeadlineExceeded, "Get 8b1a9953c4611296a827abf8c47804d7-5-debian8 on backend \"cas_redis\": context deadline exceeded"), err)
+
+	bottomBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, status.Error(codes.Unavailable, "Connection refused"))
+	_, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.Equal(t, status.Error(codes.Unavailable, "FindMissing of 1 blobs on backend \"cas_redis\": Connection refused"), err)
+
+	// Errors that occur while reading should be annotated as well.
+	// End-of-file should be propagated as is.
+	bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(io.MultiReader(
+		bytes.NewBufferString("Hel"),
+		failingReader{err: status.Error(codes.Unavailable, "Connection reset")})), nil)
+	_, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.Equal(t, []byte("Hel"), data)
+	require.Equal(t, status.Error(codes.Unavailable, "Read 8b1a9953c4611296a827abf8c47804d7-5-debian8 on backend \"cas_redis\": Connection reset"), err)
+	require.NoError(t, r.Close())
+
+	bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	_, r, err = blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+	require.NoError(t, r.Close())
+}
+
+// failingReader is a reader that always fails with a given error.
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
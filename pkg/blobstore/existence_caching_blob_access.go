@@ -0,0 +1,137 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+type existenceCachingBlobAccess struct {
+	BlobAccess
+	digestKeyFormat util.DigestKeyFormat
+	cacheDuration   time.Duration
+	cacheSize       int
+
+	lock        sync.Mutex
+	expirations map[string]time.Time
+}
+
+// NewExistenceCachingBlobAccess creates a BlobAccess that remembers
+// which objects were recently observed to be present in the backend,
+// either because they were successfully read or written, or because
+// FindMissing() did not report them as missing. These objects are
+// filtered out of subsequent FindMissing() calls for cacheDuration,
+// which significantly reduces the number of FindMissing() calls for
+// commonly used objects (e.g., compilers and SDKs).
+//
+// This adapter should only be used in front of backends that retain
+// objects for considerably longer than cacheDuration, as it may
+// otherwise cause clients to assume objects exist that have already
+// been evicted.
+func NewExistenceCachingBlobAccess(blobAccess BlobAccess, digestKeyFormat util.DigestKeyFormat, cacheDuration time.Duration, cacheSize int) BlobAccess {
+	return &existenceCachingBlobAccess{
+		BlobAccess:      blobAccess,
+		digestKeyFormat: digestKeyFormat,
+		cacheDuration:   cacheDuration,
+		cacheSize:       cacheSize,
+
+		expirations: map[string]time.Time{},
+	}
+}
+
+// markPresent records that objects were observed to be present.
+func (ba *existenceCachingBlobAccess) markPresent(digests []*util.Digest) {
+	now := time.Now()
+	expiration := now.Add(ba.cacheDuration)
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	for _, digest := range digests {
+		key := digest.GetKey(ba.digestKeyFormat)
+		if _, ok := ba.expirations[key]; !ok && len(ba.expirations) >= ba.cacheSize {
+			ba.makeSpace(now)
+		}
+		ba.expirations[key] = expiration
+	}
+}
+
+// makeSpace removes entries from the cache, so that at least one new
+// entry may be inserted. Expired entries are removed first. If none
+// are present, an arbitrary entry is removed.
+func (ba *existenceCachingBlobAccess) makeSpace(now time.Time) {
+	for key, expiration := range ba.expirations {
+		if !expiration.After(now) {
+			delete(ba.expirations, key)
+		}
+	}
+	for key := range ba.expirations {
+		if len(ba.expirations) < ba.cacheSize {
+			break
+		}
+		delete(ba.expirations, key)
+	}
+}
+
+func (ba *existenceCachingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	length, r, err := ba.BlobAccess.Get(ctx, digest)
+	if err == nil {
+		ba.markPresent([]*util.Digest{digest})
+	}
+	return length, r, err
+}
+
+func (ba *existenceCachingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	err := ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+	if err == nil {
+		ba.markPresent([]*util.Digest{digest})
+	}
+	return err
+}
+
+func (ba *existenceCachingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	ba.lock.Lock()
+	delete(ba.expirations, digest.GetKey(ba.digestKeyFormat))
+	ba.lock.Unlock()
+
+	return ba.BlobAccess.Delete(ctx, digest)
+}
+
+func (ba *existenceCachingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	// Only forward digests of objects that have not been observed
+	// to be present recently.
+	now := time.Now()
+	var uncached []*util.Digest
+	ba.lock.Lock()
+	for _, digest := range digests {
+		if expiration, ok := ba.expirations[digest.GetKey(ba.digestKeyFormat)]; !ok || !expiration.After(now) {
+			uncached = append(uncached, digest)
+		}
+	}
+	ba.lock.Unlock()
+	if len(uncached) == 0 {
+		return nil, nil
+	}
+
+	missing, err := ba.BlobAccess.FindMissing(ctx, uncached)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache the existence of objects that are not missing.
+	missingKeys := map[string]bool{}
+	for _, digest := range missing {
+		missingKeys[digest.GetKey(ba.digestKeyFormat)] = true
+	}
+	var present []*util.Digest
+	for _, digest := range uncached {
+		if !missingKeys[digest.GetKey(ba.digestKeyFormat)] {
+			present = append(present, digest)
+		}
+	}
+	ba.markPresent(present)
+	return missing, nil
+}
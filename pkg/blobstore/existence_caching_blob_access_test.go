@@ -0,0 +1,75 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExistenceCachingBlobAccessFindMissing(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest1 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	digest2 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewExistenceCachingBlobAccess(bottomBlobAccess, util.DigestKeyWithInstance, time.Hour, 10)
+
+	// Initially, nothing is cached, meaning all digests should be
+	// forwarded.
+	bottomBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest1, digest2}).Return([]*util.Digest{digest2}, nil)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest1, digest2})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{digest2}, missing)
+
+	// The first object was reported as being present. It should
+	// no longer be forwarded.
+	bottomBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest2}).Return([]*util.Digest{digest2}, nil)
+	missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digest1, digest2})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{digest2}, missing)
+
+	// Deleting the first object should invalidate the cache entry.
+	bottomBlobAccess.EXPECT().Delete(ctx, digest1).Return(nil)
+	require.NoError(t, blobAccess.Delete(ctx, digest1))
+	bottomBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest1}).Return([]*util.Digest{digest1}, nil)
+	missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digest1})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{digest1}, missing)
+}
+
+func TestExistenceCachingBlobAccessExpiration(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewExistenceCachingBlobAccess(bottomBlobAccess, util.DigestKeyWithInstance, time.Millisecond, 10)
+
+	// Cache entries should expire, causing requests to be
+	// forwarded once again.
+	bottomBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil).Times(2)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	time.Sleep(10 * time.Millisecond)
+	missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
@@ -0,0 +1,210 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeBlob struct {
+	digest    *util.Digest
+	data      []byte
+	timestamp time.Time
+}
+
+// FakeBlobAccess is an in-memory implementation of BlobAccess that is
+// intended to be used in unit tests of BlobAccess decorators and their
+// consumers. Unlike mocks, it behaves like an actual storage backend,
+// while permitting faults to be injected: operations may be delayed,
+// fail with a given error, or return readers that fail after a given
+// number of bytes.
+type FakeBlobAccess struct {
+	digestKeyFormat util.DigestKeyFormat
+
+	lock      sync.Mutex
+	blobs     map[string]fakeBlob
+	latency   time.Duration
+	errors    map[string]error
+	readLimit int64
+}
+
+// NewFakeBlobAccess creates an empty FakeBlobAccess that stores blobs
+// under keys of a given format.
+func NewFakeBlobAccess(digestKeyFormat util.DigestKeyFormat) *FakeBlobAccess {
+	return &FakeBlobAccess{
+		digestKeyFormat: digestKeyFormat,
+		blobs:           map[string]fakeBlob{},
+		errors:          map[string]error{},
+		readLimit:       -1,
+	}
+}
+
+// SetLatency causes all subsequent operations to be delayed by a
+// fixed amount of time. Operations are interrupted if their context
+// is cancelled while being delayed.
+func (ba *FakeBlobAccess) SetLatency(latency time.Duration) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	ba.latency = latency
+}
+
+// SetError causes all subsequent calls to an operation (e.g., "Get",
+// "Put", "Delete", "FindMissing" or "List") to fail with a given
+// error. Passing a nil error lets the operation succeed once again.
+func (ba *FakeBlobAccess) SetError(operation string, err error) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	if err == nil {
+		delete(ba.errors, operation)
+	} else {
+		ba.errors[operation] = err
+	}
+}
+
+// SetReadLimit causes readers returned by subsequent calls to Get() to
+// fail with io.ErrUnexpectedEOF after returning a given number of
+// bytes, simulating connections that are dropped halfway through a
+// transfer. Passing a negative limit disables this behaviour.
+func (ba *FakeBlobAccess) SetReadLimit(readLimit int64) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	ba.readLimit = readLimit
+}
+
+// GetContents returns the contents of a blob stored in the
+// FakeBlobAccess, without being subject to injected faults.
+func (ba *FakeBlobAccess) GetContents(digest *util.Digest) ([]byte, bool) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	blob, ok := ba.blobs[digest.GetKey(ba.digestKeyFormat)]
+	return blob.data, ok
+}
+
+// startOperation applies the latency and error that have been
+// injected for an operation.
+func (ba *FakeBlobAccess) startOperation(ctx context.Context, operation string) error {
+	ba.lock.Lock()
+	latency, err := ba.latency, ba.errors[operation]
+	ba.lock.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+func (ba *FakeBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	if err := ba.startOperation(ctx, "Get"); err != nil {
+		return 0, nil, err
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	blob, ok := ba.blobs[digest.GetKey(ba.digestKeyFormat)]
+	if !ok {
+		return 0, nil, status.Error(codes.NotFound, "Blob not found")
+	}
+	if ba.readLimit >= 0 && ba.readLimit < int64(len(blob.data)) {
+		return int64(len(blob.data)), ioutil.NopCloser(io.MultiReader(
+			NewBytesReader(blob.data[:ba.readLimit]),
+			errorReader{err: io.ErrUnexpectedEOF})), nil
+	}
+	return int64(len(blob.data)), NewBytesReader(blob.data), nil
+}
+
+func (ba *FakeBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	defer r.Close()
+	if err := ba.startOperation(ctx, "Put"); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != sizeBytes {
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while %d bytes were expected", len(data), sizeBytes)
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	ba.blobs[digest.GetKey(ba.digestKeyFormat)] = fakeBlob{
+		digest:    digest,
+		data:      data,
+		timestamp: time.Now(),
+	}
+	return nil
+}
+
+func (ba *FakeBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if err := ba.startOperation(ctx, "Delete"); err != nil {
+		return err
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	delete(ba.blobs, digest.GetKey(ba.digestKeyFormat))
+	return nil
+}
+
+func (ba *FakeBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	if err := ba.startOperation(ctx, "FindMissing"); err != nil {
+		return nil, err
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	var missing []*util.Digest
+	for _, digest := range digests {
+		if _, ok := ba.blobs[digest.GetKey(ba.digestKeyFormat)]; !ok {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
+
+// List enumerates all blobs, using the time at which they were
+// written as their timestamp.
+func (ba *FakeBlobAccess) List(ctx context.Context, fn BlobListerFunc) error {
+	if err := ba.startOperation(ctx, "List"); err != nil {
+		return err
+	}
+
+	// Don't hold the lock while invoking the callback, as it may
+	// call back into the FakeBlobAccess.
+	ba.lock.Lock()
+	blobs := make([]fakeBlob, 0, len(ba.blobs))
+	for _, blob := range ba.blobs {
+		blobs = append(blobs, blob)
+	}
+	ba.lock.Unlock()
+
+	for _, blob := range blobs {
+		if err := fn(blob.digest, blob.timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errorReader is an io.Reader that always fails with a fixed error.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,75 @@
+package blobstore_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFakeBlobAccess(t *testing.T) {
+	ctx := context.Background()
+	blobAccess := blobstore.NewFakeBlobAccess(util.DigestKeyWithoutInstance)
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	// Blobs should be absent initially.
+	_, _, err := blobAccess.Get(ctx, digest)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{digest}, missing)
+
+	// Blobs that are written should be readable.
+	require.NoError(t, blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+	length, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), length)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+	require.NoError(t, r.Close())
+	missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// Injected errors should be returned until cleared.
+	blobAccess.SetError("Get", status.Error(codes.Unavailable, "Server offline"))
+	_, _, err = blobAccess.Get(ctx, digest)
+	require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	blobAccess.SetError("Get", nil)
+
+	// Readers should fail halfway through if a read limit is set.
+	blobAccess.SetReadLimit(3)
+	_, r, err = blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	require.Equal(t, []byte("Hel"), data)
+	require.NoError(t, r.Close())
+	blobAccess.SetReadLimit(-1)
+
+	// Operations should be interrupted when their context is
+	// cancelled while being delayed.
+	blobAccess.SetLatency(time.Hour)
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Equal(t, context.Canceled, blobAccess.Delete(cancelledCtx, digest))
+	blobAccess.SetLatency(0)
+
+	// Deleted blobs should no longer be present.
+	require.NoError(t, blobAccess.Delete(ctx, digest))
+	_, ok := blobAccess.GetContents(digest)
+	require.False(t, ok)
+}
@@ -0,0 +1,54 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+type faultInjectingBlobAccess struct {
+	BlobAccess
+	injector *util.FaultInjector
+}
+
+// NewFaultInjectingBlobAccess creates a BlobAccess that adds random
+// latency to requests and lets a fraction of them fail with
+// UNAVAILABLE before forwarding them to a backend. It is intended to
+// be used for soak testing, ensuring that clients and replicating
+// backends deal with misbehaving storage properly.
+func NewFaultInjectingBlobAccess(blobAccess BlobAccess, injector *util.FaultInjector) BlobAccess {
+	return &faultInjectingBlobAccess{
+		BlobAccess: blobAccess,
+		injector:   injector,
+	}
+}
+
+func (ba *faultInjectingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	if err := ba.injector.Inject(ctx, "Get"); err != nil {
+		return 0, nil, err
+	}
+	return ba.BlobAccess.Get(ctx, digest)
+}
+
+func (ba *faultInjectingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	if err := ba.injector.Inject(ctx, "Put"); err != nil {
+		r.Close()
+		return err
+	}
+	return ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *faultInjectingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if err := ba.injector.Inject(ctx, "Delete"); err != nil {
+		return err
+	}
+	return ba.BlobAccess.Delete(ctx, digest)
+}
+
+func (ba *faultInjectingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	if err := ba.injector.Inject(ctx, "FindMissing"); err != nil {
+		return nil, err
+	}
+	return ba.BlobAccess.FindMissing(ctx, digests)
+}
@@ -0,0 +1,61 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFaultInjectingBlobAccessNoFaults(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// With an error probability of zero, requests should simply be
+	// forwarded to the backend.
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	blobAccess := blobstore.NewFaultInjectingBlobAccess(bottomBlobAccess, util.NewFaultInjector(0, 0))
+
+	length, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), length)
+	require.NoError(t, r.Close())
+}
+
+func TestFaultInjectingBlobAccessAlwaysFail(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// With an error probability of one, requests should never reach
+	// the backend.
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewFaultInjectingBlobAccess(bottomBlobAccess, util.NewFaultInjector(1, 0))
+
+	_, _, err := blobAccess.Get(ctx, digest)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	err = blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(bytes.NewBufferString("Hello")))
+	require.Equal(t, status.Error(codes.Unavailable, "Injected fault for operation \"Put\""), err)
+
+	_, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
@@ -0,0 +1,172 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// replicaState tracks the observed performance of a single replica. The
+// latency is stored as a peak-sensitive exponentially weighted moving
+// average: increases in latency are taken into account immediately,
+// while decreases only gradually lower the average.
+type replicaState struct {
+	latencySeconds      float64
+	lastUpdate          time.Time
+	outstandingRequests int
+}
+
+func (rs *replicaState) getScore(now time.Time, decayTime time.Duration) float64 {
+	// Let the latency decay while no requests complete, so that
+	// replicas that were penalized for failing requests are
+	// eventually tried again.
+	latencySeconds := rs.latencySeconds * math.Exp(-now.Sub(rs.lastUpdate).Seconds()/decayTime.Seconds())
+
+	// Multiply the latency by the number of requests that would be
+	// outstanding if the replica were picked. This causes load to be
+	// spread out in case of replicas with similar latencies.
+	return latencySeconds * float64(rs.outstandingRequests+1)
+}
+
+type latencyAwareBlobAccess struct {
+	replicas     []BlobAccess
+	decayTime    time.Duration
+	errorPenalty time.Duration
+
+	lock   sync.Mutex
+	states []replicaState
+}
+
+// NewLatencyAwareBlobAccess creates a BlobAccess that forwards requests
+// to one of multiple replicas that provide access to the same data
+// (e.g., bbb_storage instances spread across availability zones). For
+// every request, the replica with the lowest observed latency is
+// picked. Failing requests count as slow requests, causing unhealthy
+// replicas to be avoided.
+//
+// Get(), Delete() and FindMissing() requests that fail with
+// UNAVAILABLE are retried against the next best replica. Put() requests
+// are never retried, as the data to be written can only be read once.
+func NewLatencyAwareBlobAccess(replicas []BlobAccess, decayTime time.Duration, errorPenalty time.Duration) BlobAccess {
+	return &latencyAwareBlobAccess{
+		replicas:     replicas,
+		decayTime:    decayTime,
+		errorPenalty: errorPenalty,
+
+		states: make([]replicaState, len(replicas)),
+	}
+}
+
+// getReplicaOrder returns the indices of all replicas, sorted by the
+// order in which they should be tried.
+func (ba *latencyAwareBlobAccess) getReplicaOrder() []int {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	now := time.Now()
+	order := make([]int, len(ba.states))
+	scores := make([]float64, len(ba.states))
+	for i := range order {
+		order[i] = i
+		scores[i] = ba.states[i].getScore(now, ba.decayTime)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] < scores[order[j]]
+	})
+	return order
+}
+
+func (ba *latencyAwareBlobAccess) startRequest(replica int) time.Time {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	ba.states[replica].outstandingRequests++
+	return time.Now()
+}
+
+func (ba *latencyAwareBlobAccess) finishRequest(replica int, timeStart time.Time, err error) {
+	now := time.Now()
+	sample := now.Sub(timeStart)
+	if isReplicaFailure(err) && sample < ba.errorPenalty {
+		sample = ba.errorPenalty
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	state := &ba.states[replica]
+	state.outstandingRequests--
+	if sampleSeconds := sample.Seconds(); sampleSeconds > state.latencySeconds {
+		state.latencySeconds = sampleSeconds
+	} else {
+		weight := math.Exp(-now.Sub(state.lastUpdate).Seconds() / ba.decayTime.Seconds())
+		state.latencySeconds = state.latencySeconds*weight + sampleSeconds*(1-weight)
+	}
+	state.lastUpdate = now
+}
+
+// isReplicaFailure returns whether an error returned by a replica is
+// indicative of the replica being unhealthy, as opposed to the request
+// simply being invalid or the object being absent.
+func isReplicaFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Aborted, codes.DeadlineExceeded, codes.Internal, codes.ResourceExhausted, codes.Unavailable, codes.Unknown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ba *latencyAwareBlobAccess) call(allowRetries bool, fn func(replica BlobAccess) error) error {
+	var err error
+	for _, replica := range ba.getReplicaOrder() {
+		timeStart := ba.startRequest(replica)
+		err = fn(ba.replicas[replica])
+		ba.finishRequest(replica, timeStart, err)
+		if !allowRetries || status.Code(err) != codes.Unavailable {
+			return err
+		}
+	}
+	return err
+}
+
+func (ba *latencyAwareBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	var length int64
+	var r io.ReadCloser
+	err := ba.call(true, func(replica BlobAccess) error {
+		var err error
+		length, r, err = replica.Get(ctx, digest)
+		return err
+	})
+	return length, r, err
+}
+
+func (ba *latencyAwareBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	return ba.call(false, func(replica BlobAccess) error {
+		return replica.Put(ctx, digest, sizeBytes, r)
+	})
+}
+
+func (ba *latencyAwareBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	return ba.call(true, func(replica BlobAccess) error {
+		return replica.Delete(ctx, digest)
+	})
+}
+
+func (ba *latencyAwareBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	var missing []*util.Digest
+	err := ba.call(true, func(replica BlobAccess) error {
+		var err error
+		missing, err = replica.FindMissing(ctx, digests)
+		return err
+	})
+	return missing, err
+}
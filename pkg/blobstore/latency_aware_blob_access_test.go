@@ -0,0 +1,68 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLatencyAwareBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	replica1 := mock.NewMockBlobAccess(ctrl)
+	replica2 := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewLatencyAwareBlobAccess(
+		[]blobstore.BlobAccess{replica1, replica2},
+		time.Hour,
+		time.Hour)
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("FailoverOnUnavailable", func(t *testing.T) {
+		// Without any observations, the first replica is tried
+		// first. As it is unavailable, the request should be
+		// retried against the second replica.
+		gomock.InOrder(
+			replica1.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, status.Error(codes.Unavailable, "Connection refused")),
+			replica2.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return([]*util.Digest{digest}, nil))
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+	})
+
+	t.Run("AvoidFailingReplica", func(t *testing.T) {
+		// The first replica has been penalized for failing,
+		// meaning the second replica should now be preferred.
+		replica2.EXPECT().Delete(ctx, digest).Return(nil)
+		require.NoError(t, blobAccess.Delete(ctx, digest))
+	})
+
+	t.Run("NoRetryOnNotFound", func(t *testing.T) {
+		// Absent objects are not a sign of unhealthiness, so
+		// there is no need to contact other replicas.
+		replica2.EXPECT().Get(ctx, digest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+		_, _, err := blobAccess.Get(ctx, digest)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+
+	t.Run("NoRetryOnPut", func(t *testing.T) {
+		// Data passed to Put() can only be consumed once.
+		replica2.EXPECT().Put(ctx, digest, int64(5), nil).Return(status.Error(codes.Unavailable, "Connection refused"))
+		err := blobAccess.Put(ctx, digest, 5, nil)
+		require.Equal(t, status.Error(codes.Unavailable, "Connection refused"), err)
+	})
+}
@@ -6,8 +6,9 @@ import (
 	"encoding/hex"
 	"hash"
 	"io"
-	"log"
+	"math/rand"
 
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 
 	"google.golang.org/grpc/codes"
@@ -16,6 +17,7 @@ import (
 
 type merkleBlobAccess struct {
 	BlobAccess
+	samplingProbability float64
 }
 
 // NewMerkleBlobAccess creates an adapter that validates that blobs read
@@ -24,20 +26,35 @@ type merkleBlobAccess struct {
 // checksum match. This is used to ensure clients cannot corrupt the CAS
 // and that if corruption were to occur, use of corrupted data is prevented.
 func NewMerkleBlobAccess(blobAccess BlobAccess) BlobAccess {
+	return NewSamplingMerkleBlobAccess(blobAccess, 1)
+}
+
+// NewSamplingMerkleBlobAccess is identical to NewMerkleBlobAccess,
+// except that checksums are only validated for a random fraction of
+// requests. Sizes are validated for all requests. This may be used on
+// trusted paths where validating every blob is too costly, such as
+// workers reading from local storage.
+func NewSamplingMerkleBlobAccess(blobAccess BlobAccess, samplingProbability float64) BlobAccess {
 	return &merkleBlobAccess{
-		BlobAccess: blobAccess,
+		BlobAccess:          blobAccess,
+		samplingProbability: samplingProbability,
 	}
 }
 
+func (ba *merkleBlobAccess) shouldValidateChecksum() bool {
+	return ba.samplingProbability >= 1 || rand.Float64() < ba.samplingProbability
+}
+
 func (ba *merkleBlobAccess) discardBadBlob(ctx context.Context, digest *util.Digest) {
 	// Trigger blob deletion in case we detect data
 	// corruption. This will cause future calls to
 	// FindMissing() to indicate absence, causing clients to
 	// re-upload them and/or build actions to be retried.
+	logger := logging.FromContext(ctx).WithField(logging.BlobDigestField, digest.String())
 	if err := ba.BlobAccess.Delete(ctx, digest); err == nil {
-		log.Printf("Successfully deleted corrupted blob %s", digest)
+		logger.Info("Successfully deleted corrupted blob")
 	} else {
-		log.Printf("Failed to delete corrupted blob %s: %s", digest, err)
+		logger.WithError(err).Warn("Failed to delete corrupted blob")
 	}
 }
 
@@ -55,6 +72,9 @@ func (ba *merkleBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64
 			length,
 			digestSizeBytes)
 	}
+	if !ba.shouldValidateChecksum() {
+		return length, r, nil
+	}
 	return length, newChecksumValidatingReader(
 		digest,
 		r,
@@ -71,6 +91,9 @@ func (ba *merkleBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBy
 			sizeBytes,
 			digestSizeBytes)
 	}
+	if !ba.shouldValidateChecksum() {
+		return ba.BlobAccess.Put(ctx, digest, digestSizeBytes, r)
+	}
 	return ba.BlobAccess.Put(
 		ctx, digest, digestSizeBytes,
 		newChecksumValidatingReader(digest, r, func() {}, codes.InvalidArgument))
@@ -126,3 +149,7 @@ func (r *checksumValidatingReader) Read(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+func (ba *merkleBlobAccess) List(ctx context.Context, fn BlobListerFunc) error {
+	return ListBlobs(ctx, ba.BlobAccess, fn)
+}
@@ -188,3 +188,30 @@ func TestMerkleBlobAccessMalformedData(t *testing.T) {
 		"Checksum of blob is 64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c, "+
 			"while 185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969 was expected")
 }
+
+func TestSamplingMerkleBlobAccessDisabled(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// With checksum validation disabled, corrupted data should be
+	// passed through. Sizes should still be validated.
+	digest := util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hellp")), nil)
+	bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(6), ioutil.NopCloser(bytes.NewBufferString("Hello!")), nil)
+	bottomBlobAccess.EXPECT().Delete(ctx, digest).Return(nil)
+	blobAccess := blobstore.NewSamplingMerkleBlobAccess(bottomBlobAccess, 0)
+
+	_, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hellp"), buf)
+	require.NoError(t, r.Close())
+
+	_, _, err = blobAccess.Get(ctx, digest)
+	require.Equal(t, status.Error(codes.Internal, "Blob is 6 bytes in size, while 5 bytes were expected"), err)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -27,70 +28,194 @@ var (
 			Help:      "Amount of time spent per operation on blob access objects, in seconds.",
 			Buckets:   prometheus.ExponentialBuckets(0.001, math.Pow(10.0, 1.0/3.0), 6*3+1),
 		},
+		[]string{"name", "operation", "grpc_code"})
+	blobAccessOperationsBlobSizeBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "blob_access_operations_blob_size_bytes",
+			Help:      "Size of blobs being read or written through blob access objects, in bytes.",
+			Buckets:   prometheus.ExponentialBuckets(1.0, 2.0, 33),
+		},
+		[]string{"name", "operation"})
+	blobAccessOperationsTransferredBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "blob_access_operations_transferred_bytes_total",
+			Help:      "Total number of bytes of blobs read or written through blob access objects.",
+		},
+		[]string{"name", "operation"})
+	blobAccessOperationsBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "blob_access_operations_batch_size",
+			Help:      "Number of digests provided to batch operations on blob access objects.",
+			Buckets:   prometheus.ExponentialBuckets(1.0, 2.0, 17),
+		},
 		[]string{"name", "operation"})
 )
 
 func init() {
 	prometheus.MustRegister(blobAccessOperationsStartedTotal)
 	prometheus.MustRegister(blobAccessOperationsDurationSeconds)
+	prometheus.MustRegister(blobAccessOperationsBlobSizeBytes)
+	prometheus.MustRegister(blobAccessOperationsTransferredBytesTotal)
+	prometheus.MustRegister(blobAccessOperationsBatchSize)
+}
+
+// metricsOperation holds the metrics of a single type of operation
+// performed against a metricsBlobAccess.
+type metricsOperation struct {
+	name      string
+	operation string
+
+	startedTotal prometheus.Counter
+}
+
+func newMetricsOperation(name string, operation string) metricsOperation {
+	return metricsOperation{
+		name:      name,
+		operation: operation,
+
+		startedTotal: blobAccessOperationsStartedTotal.WithLabelValues(name, operation),
+	}
+}
+
+// start increments the number of operations started and returns the
+// time at which the operation started.
+func (mo *metricsOperation) start() time.Time {
+	mo.startedTotal.Inc()
+	return time.Now()
+}
+
+// finish records the duration of an operation, labeled with the gRPC
+// status code of its outcome. As the set of status codes is small,
+// observers are looked up on demand.
+func (mo *metricsOperation) finish(timeStart time.Time, err error) {
+	blobAccessOperationsDurationSeconds.WithLabelValues(mo.name, mo.operation, status.Code(err).String()).Observe(time.Now().Sub(timeStart).Seconds())
+}
+
+// metricsTransferOperation holds the metrics of an operation that
+// reads or writes the contents of a blob.
+type metricsTransferOperation struct {
+	metricsOperation
+
+	blobSizeBytes         prometheus.Observer
+	transferredBytesTotal prometheus.Counter
+}
+
+func newMetricsTransferOperation(name string, operation string) metricsTransferOperation {
+	return metricsTransferOperation{
+		metricsOperation: newMetricsOperation(name, operation),
+
+		blobSizeBytes:         blobAccessOperationsBlobSizeBytes.WithLabelValues(name, operation),
+		transferredBytesTotal: blobAccessOperationsTransferredBytesTotal.WithLabelValues(name, operation),
+	}
+}
+
+// record tracks the size of a blob that was opened for reading or
+// written successfully.
+func (mo *metricsTransferOperation) record(sizeBytes int64) {
+	mo.blobSizeBytes.Observe(float64(sizeBytes))
+}
+
+// newTransferCountingReader wraps a reader of a blob, so that the number
+// of bytes actually read from it is tracked. This may be less than the
+// size of the blob if the transfer is interrupted.
+func (mo *metricsTransferOperation) newTransferCountingReader(r io.ReadCloser) io.ReadCloser {
+	return &transferCountingReader{
+		ReadCloser:            r,
+		transferredBytesTotal: mo.transferredBytesTotal,
+	}
+}
+
+// transferCountingReader increments a counter for every byte read.
+type transferCountingReader struct {
+	io.ReadCloser
+	transferredBytesTotal prometheus.Counter
+}
+
+func (r *transferCountingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.transferredBytesTotal.Add(float64(n))
+	}
+	return n, err
 }
 
 type metricsBlobAccess struct {
-	blobAccess                                     BlobAccess
-	blobAccessOperationsStartedTotalGet            prometheus.Counter
-	blobAccessOperationsDurationSecondsGet         prometheus.Observer
-	blobAccessOperationsStartedTotalPut            prometheus.Counter
-	blobAccessOperationsDurationSecondsPut         prometheus.Observer
-	blobAccessOperationsStartedTotalDelete         prometheus.Counter
-	blobAccessOperationsDurationSecondsDelete      prometheus.Observer
-	blobAccessOperationsStartedTotalFindMissing    prometheus.Counter
-	blobAccessOperationsDurationSecondsFindMissing prometheus.Observer
+	blobAccess BlobAccess
+
+	get         metricsTransferOperation
+	put         metricsTransferOperation
+	delete      metricsOperation
+	findMissing metricsOperation
+	list        metricsOperation
+
+	findMissingBatchSize prometheus.Observer
 }
 
 // NewMetricsBlobAccess creates an adapter for BlobAccess that adds
-// basic instrumentation in the form of Prometheus metrics.
+// instrumentation in the form of Prometheus metrics. For every
+// operation, it tracks the number of calls and their latency, labeled
+// by the resulting gRPC status code. The sizes of blobs being read and
+// written are tracked as well, allowing slow or erroneous backends
+// to be identified.
 func NewMetricsBlobAccess(blobAccess BlobAccess, name string) BlobAccess {
 	return &metricsBlobAccess{
-		blobAccess:                                     blobAccess,
-		blobAccessOperationsStartedTotalGet:            blobAccessOperationsStartedTotal.WithLabelValues(name, "Get"),
-		blobAccessOperationsDurationSecondsGet:         blobAccessOperationsDurationSeconds.WithLabelValues(name, "Get"),
-		blobAccessOperationsStartedTotalPut:            blobAccessOperationsStartedTotal.WithLabelValues(name, "Put"),
-		blobAccessOperationsDurationSecondsPut:         blobAccessOperationsDurationSeconds.WithLabelValues(name, "Put"),
-		blobAccessOperationsStartedTotalDelete:         blobAccessOperationsStartedTotal.WithLabelValues(name, "Delete"),
-		blobAccessOperationsDurationSecondsDelete:      blobAccessOperationsDurationSeconds.WithLabelValues(name, "Delete"),
-		blobAccessOperationsStartedTotalFindMissing:    blobAccessOperationsStartedTotal.WithLabelValues(name, "FindMissing"),
-		blobAccessOperationsDurationSecondsFindMissing: blobAccessOperationsDurationSeconds.WithLabelValues(name, "FindMissing"),
+		blobAccess: blobAccess,
+
+		get:         newMetricsTransferOperation(name, "Get"),
+		put:         newMetricsTransferOperation(name, "Put"),
+		delete:      newMetricsOperation(name, "Delete"),
+		findMissing: newMetricsOperation(name, "FindMissing"),
+		list:        newMetricsOperation(name, "List"),
+
+		findMissingBatchSize: blobAccessOperationsBatchSize.WithLabelValues(name, "FindMissing"),
 	}
 }
 
 func (ba *metricsBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
-	ba.blobAccessOperationsStartedTotalGet.Inc()
-	timeStart := time.Now()
+	timeStart := ba.get.start()
 	length, r, err := ba.blobAccess.Get(ctx, digest)
-	ba.blobAccessOperationsDurationSecondsGet.Observe(time.Now().Sub(timeStart).Seconds())
-	return length, r, err
+	ba.get.finish(timeStart, err)
+	if err != nil {
+		return 0, nil, err
+	}
+	ba.get.record(length)
+	return length, ba.get.newTransferCountingReader(r), nil
 }
 
 func (ba *metricsBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
-	ba.blobAccessOperationsStartedTotalPut.Inc()
-	timeStart := time.Now()
-	err := ba.blobAccess.Put(ctx, digest, sizeBytes, r)
-	ba.blobAccessOperationsDurationSecondsPut.Observe(time.Now().Sub(timeStart).Seconds())
+	timeStart := ba.put.start()
+	err := ba.blobAccess.Put(ctx, digest, sizeBytes, ba.put.newTransferCountingReader(r))
+	ba.put.finish(timeStart, err)
+	if err == nil {
+		ba.put.record(sizeBytes)
+	}
 	return err
 }
 
 func (ba *metricsBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
-	ba.blobAccessOperationsStartedTotalDelete.Inc()
-	timeStart := time.Now()
+	timeStart := ba.delete.start()
 	err := ba.blobAccess.Delete(ctx, digest)
-	ba.blobAccessOperationsDurationSecondsDelete.Observe(time.Now().Sub(timeStart).Seconds())
+	ba.delete.finish(timeStart, err)
 	return err
 }
 
 func (ba *metricsBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
-	ba.blobAccessOperationsStartedTotalFindMissing.Inc()
-	timeStart := time.Now()
+	ba.findMissingBatchSize.Observe(float64(len(digests)))
+	timeStart := ba.findMissing.start()
 	digests, err := ba.blobAccess.FindMissing(ctx, digests)
-	ba.blobAccessOperationsDurationSecondsFindMissing.Observe(time.Now().Sub(timeStart).Seconds())
+	ba.findMissing.finish(timeStart, err)
 	return digests, err
 }
+
+func (ba *metricsBlobAccess) List(ctx context.Context, fn BlobListerFunc) error {
+	timeStart := ba.list.start()
+	err := ListBlobs(ctx, ba.blobAccess, fn)
+	ba.list.finish(timeStart, err)
+	return err
+}
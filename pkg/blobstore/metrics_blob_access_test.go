@@ -0,0 +1,95 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// getTransferredBytes returns the value of the transferred bytes
+// counter of MetricsBlobAccess for a given backend and operation.
+func getTransferredBytes(t *testing.T, name string, operation string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "buildbarn_blobstore_blob_access_operations_transferred_bytes_total" {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["name"] == name && labels["operation"] == operation {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetricsBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewMetricsBlobAccess(bottomBlobAccess, "metrics_test")
+
+	t.Run("GetPartialRead", func(t *testing.T) {
+		// Only the bytes actually read by the caller should be
+		// counted, as opposed to the size of the blob.
+		bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+
+		length, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), length)
+		require.Equal(t, 0.0, getTransferredBytes(t, "metrics_test", "Get"))
+
+		var buf [3]byte
+		n, err := r.Read(buf[:])
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+		require.NoError(t, r.Close())
+		require.Equal(t, 3.0, getTransferredBytes(t, "metrics_test", "Get"))
+	})
+
+	t.Run("GetFullRead", func(t *testing.T) {
+		bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+
+		_, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+		require.NoError(t, r.Close())
+		require.Equal(t, 8.0, getTransferredBytes(t, "metrics_test", "Get"))
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		// The bytes consumed by the backend should be counted.
+		bottomBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+				data, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello"), data)
+				return r.Close()
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+		require.Equal(t, 5.0, getTransferredBytes(t, "metrics_test", "Put"))
+	})
+}
@@ -0,0 +1,39 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/quota"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type quotaEnforcingBlobAccess struct {
+	BlobAccess
+	tracker           quota.Tracker
+	identityExtractor quota.IdentityExtractor
+}
+
+// NewQuotaEnforcingBlobAccess creates an adapter for BlobAccess that
+// limits the number of bytes that clients may store. Put() operations
+// that would cause a client to exceed its quota fail with
+// RESOURCE_EXHAUSTED before any data is read from the client.
+func NewQuotaEnforcingBlobAccess(blobAccess BlobAccess, tracker quota.Tracker, identityExtractor quota.IdentityExtractor) BlobAccess {
+	return &quotaEnforcingBlobAccess{
+		BlobAccess:        blobAccess,
+		tracker:           tracker,
+		identityExtractor: identityExtractor,
+	}
+}
+
+func (ba *quotaEnforcingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	identity := ba.identityExtractor(ctx, digest.GetInstance())
+	if !ba.tracker.Consume(identity, sizeBytes) {
+		r.Close()
+		return status.Errorf(codes.ResourceExhausted, "Client %#v exceeded its storage quota", identity)
+	}
+	return ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+}
@@ -0,0 +1,36 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type readOnlyBlobAccess struct {
+	BlobAccess
+}
+
+// NewReadOnlyBlobAccess is an adapter for BlobAccess that rejects all
+// Put() and Delete() operations with PermissionDenied. Get() and
+// FindMissing() operations are forwarded to the backend. This may be
+// used to safely expose a shared "golden" cache to clients, typically
+// in combination with NewReadWriteSplittingBlobAccess() to direct
+// writes to another backend.
+func NewReadOnlyBlobAccess(base BlobAccess) BlobAccess {
+	return &readOnlyBlobAccess{
+		BlobAccess: base,
+	}
+}
+
+func (ba *readOnlyBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	r.Close()
+	return status.Error(codes.PermissionDenied, "Storage backend is read-only")
+}
+
+func (ba *readOnlyBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	return status.Error(codes.PermissionDenied, "Storage backend is read-only")
+}
@@ -0,0 +1,64 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadOnlyBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewReadOnlyBlobAccess(bottomBlobAccess)
+
+	t.Run("Get", func(t *testing.T) {
+		// Reads should be forwarded to the backend.
+		bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+
+		length, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), length)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("FindMissing", func(t *testing.T) {
+		bottomBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return([]*util.Digest{digest}, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		// Writes should be rejected without contacting the
+		// backend.
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Storage backend is read-only"),
+			blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Storage backend is read-only"),
+			blobAccess.Delete(ctx, digest))
+	})
+}
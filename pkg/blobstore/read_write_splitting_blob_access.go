@@ -0,0 +1,33 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+type readWriteSplittingBlobAccess struct {
+	BlobAccess
+	writeBackend BlobAccess
+}
+
+// NewReadWriteSplittingBlobAccess is an adapter for BlobAccess that
+// forwards Put() and Delete() operations to a separate backend. Get()
+// and FindMissing() operations are forwarded to the read backend. This
+// may be used to let clients read from a nearby replica, while writing
+// to a primary backend that replicates its contents.
+func NewReadWriteSplittingBlobAccess(readBackend BlobAccess, writeBackend BlobAccess) BlobAccess {
+	return &readWriteSplittingBlobAccess{
+		BlobAccess:   readBackend,
+		writeBackend: writeBackend,
+	}
+}
+
+func (ba *readWriteSplittingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	return ba.writeBackend.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *readWriteSplittingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	return ba.writeBackend.Delete(ctx, digest)
+}
@@ -0,0 +1,84 @@
+package blobstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/go-redis/redis"
+
+	"google.golang.org/grpc/codes"
+)
+
+type redisAccessTimeStore struct {
+	redisClient   *redis.Client
+	key           string
+	blobKeyFormat util.DigestKeyFormat
+}
+
+// NewRedisAccessTimeStore creates an AccessTimeStore that stores access
+// times in a Redis sorted set, using the access time in seconds since
+// the Unix epoch as the score. This allows external tooling to obtain
+// the least recently used blobs efficiently using ZRANGEBYSCORE.
+func NewRedisAccessTimeStore(redisClient *redis.Client, key string, blobKeyFormat util.DigestKeyFormat) AccessTimeStore {
+	return &redisAccessTimeStore{
+		redisClient:   redisClient,
+		key:           key,
+		blobKeyFormat: blobKeyFormat,
+	}
+}
+
+func (ats *redisAccessTimeStore) Touch(ctx context.Context, digests []*util.Digest, accessTime time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+	score := float64(accessTime.Unix())
+	var members []redis.Z
+	for _, digest := range digests {
+		members = append(members, redis.Z{
+			Score:  score,
+			Member: digest.GetKey(ats.blobKeyFormat),
+		})
+	}
+	if err := ats.redisClient.ZAdd(ats.key, members...).Err(); err != nil {
+		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to store access times")
+	}
+	return nil
+}
+
+func (ats *redisAccessTimeStore) GetAccessTimes(ctx context.Context, digests []*util.Digest) ([]time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(digests) == 0 {
+		return nil, nil
+	}
+
+	// Execute "ZSCORE" requests all in a single pipeline.
+	pipeline := ats.redisClient.Pipeline()
+	var cmds []*redis.FloatCmd
+	for _, digest := range digests {
+		cmds = append(cmds, pipeline.ZScore(ats.key, digest.GetKey(ats.blobKeyFormat)))
+	}
+	if _, err := pipeline.Exec(); err != nil && err != redis.Nil {
+		return nil, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to get access times")
+	}
+
+	accessTimes := make([]time.Time, len(digests))
+	for i, cmd := range cmds {
+		if score, err := cmd.Result(); err == nil {
+			accessTimes[i] = time.Unix(int64(score), 0)
+		}
+	}
+	return accessTimes, nil
+}
+
+func (ats *redisAccessTimeStore) Remove(ctx context.Context, digest *util.Digest) error {
+	if err := ats.redisClient.ZRem(ats.key, digest.GetKey(ats.blobKeyFormat)).Err(); err != nil {
+		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to remove access time")
+	}
+	return nil
+}
@@ -1,10 +1,10 @@
 package blobstore
 
 import (
-	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/go-redis/redis"
@@ -37,7 +37,7 @@ func (ba *redisBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64,
 		}
 		return 0, nil, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to get blob")
 	}
-	return int64(len(value)), ioutil.NopCloser(bytes.NewBuffer(value)), nil
+	return int64(len(value)), NewBytesReader(value), nil
 }
 
 func (ba *redisBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
@@ -86,3 +86,49 @@ func (ba *redisBlobAccess) FindMissing(ctx context.Context, digests []*util.Dige
 	}
 	return missing, nil
 }
+
+func (ba *redisBlobAccess) List(ctx context.Context, fn BlobListerFunc) error {
+	// Redis does not track modification times. Use the idle time
+	// of keys instead, which is the time since last access.
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys, nextCursor, err := ba.redisClient.Scan(cursor, "", 1000).Result()
+		if err != nil {
+			return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to scan keys")
+		}
+
+		pipeline := ba.redisClient.Pipeline()
+		var digests []*util.Digest
+		var cmds []*redis.DurationCmd
+		for _, key := range keys {
+			digest, err := util.NewDigestFromKey(key, ba.blobKeyFormat)
+			if err != nil {
+				// Key not created by us. Ignore it.
+				continue
+			}
+			digests = append(digests, digest)
+			cmds = append(cmds, pipeline.ObjectIdleTime(key))
+		}
+		if len(cmds) > 0 {
+			// Keys may disappear between SCAN and OBJECT
+			// IDLETIME. Errors are therefore checked per key.
+			pipeline.Exec()
+			now := time.Now()
+			for i, cmd := range cmds {
+				if idleTime, err := cmd.Result(); err == nil {
+					if err := fn(digests[i], now.Add(-idleTime)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if nextCursor == 0 {
+			return nil
+		}
+		cursor = nextCursor
+	}
+}
@@ -0,0 +1,71 @@
+package blobstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/go-redis/redis"
+
+	"google.golang.org/grpc/codes"
+)
+
+// renewUploadLeaseScript extends the expiration time of an upload
+// lease in Redis, but only if it is still held by the caller.
+var renewUploadLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseUploadLeaseScript removes an upload lease from Redis, but only
+// if it is still held by the caller. The lease may have expired and
+// been acquired by another client in the meantime.
+var releaseUploadLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+type redisUploadLeaseStore struct {
+	redisClient   *redis.Client
+	blobKeyFormat util.DigestKeyFormat
+}
+
+// NewRedisUploadLeaseStore creates an UploadLeaseStore that stores
+// leases as keys in Redis, using the token of the client holding the
+// lease as the value. Leases are expired by Redis, so that leases of
+// clients that disappear are released automatically.
+func NewRedisUploadLeaseStore(redisClient *redis.Client, blobKeyFormat util.DigestKeyFormat) UploadLeaseStore {
+	return &redisUploadLeaseStore{
+		redisClient:   redisClient,
+		blobKeyFormat: blobKeyFormat,
+	}
+}
+
+func (uls *redisUploadLeaseStore) getKey(digest *util.Digest) string {
+	return "upload-lease:" + digest.GetKey(uls.blobKeyFormat)
+}
+
+func (uls *redisUploadLeaseStore) Acquire(ctx context.Context, digest *util.Digest, token string, duration time.Duration) (bool, error) {
+	acquired, err := uls.redisClient.SetNX(uls.getKey(digest), token, duration).Result()
+	if err != nil {
+		return false, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to acquire upload lease")
+	}
+	return acquired, nil
+}
+
+func (uls *redisUploadLeaseStore) Renew(ctx context.Context, digest *util.Digest, token string, duration time.Duration) (bool, error) {
+	renewed, err := renewUploadLeaseScript.Run(uls.redisClient, []string{uls.getKey(digest)}, token, int64(duration/time.Millisecond)).Int64()
+	if err != nil {
+		return false, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to renew upload lease")
+	}
+	return renewed != 0, nil
+}
+
+func (uls *redisUploadLeaseStore) Release(ctx context.Context, digest *util.Digest, token string) error {
+	if err := releaseUploadLeaseScript.Run(uls.redisClient, []string{uls.getKey(digest)}, token).Err(); err != nil {
+		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to release upload lease")
+	}
+	return nil
+}
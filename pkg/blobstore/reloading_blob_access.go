@@ -0,0 +1,142 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// ReloadingBlobAccess is a BlobAccess whose backend can be replaced
+// while the process is running.
+type ReloadingBlobAccess interface {
+	BlobAccess
+	BlobLister
+
+	SetBackend(backend BlobAccess, closer io.Closer)
+}
+
+// reloadingBlobAccessBackend is a single generation of the backend of
+// reloadingBlobAccess, together with the number of requests that are
+// still using it.
+type reloadingBlobAccessBackend struct {
+	backend  BlobAccess
+	closer   io.Closer
+	inFlight sync.WaitGroup
+}
+
+func (b *reloadingBlobAccessBackend) release() {
+	b.inFlight.Done()
+}
+
+type reloadingBlobAccess struct {
+	lock    sync.RWMutex
+	backend *reloadingBlobAccessBackend
+}
+
+// NewReloadingBlobAccess creates an adapter for BlobAccess that
+// forwards all requests to a backend that may be replaced at any time
+// by calling SetBackend(). This makes it possible to change storage
+// endpoints, credentials and shard layouts without restarting.
+//
+// Requests that are in flight while the backend is replaced continue
+// to use the old backend, meaning that ongoing builds are unaffected.
+// Once all of these requests have completed, the closer that was
+// provided along with the old backend is invoked, so that resources
+// such as gRPC connections and Redis clients are released. The closer
+// may be nil.
+func NewReloadingBlobAccess(backend BlobAccess, closer io.Closer) ReloadingBlobAccess {
+	return &reloadingBlobAccess{
+		backend: &reloadingBlobAccessBackend{
+			backend: backend,
+			closer:  closer,
+		},
+	}
+}
+
+// acquireBackend returns the current backend, preventing it from being
+// closed until release() is called.
+func (ba *reloadingBlobAccess) acquireBackend() *reloadingBlobAccessBackend {
+	ba.lock.RLock()
+	defer ba.lock.RUnlock()
+	b := ba.backend
+	b.inFlight.Add(1)
+	return b
+}
+
+func (ba *reloadingBlobAccess) SetBackend(backend BlobAccess, closer io.Closer) {
+	ba.lock.Lock()
+	oldBackend := ba.backend
+	ba.backend = &reloadingBlobAccessBackend{
+		backend: backend,
+		closer:  closer,
+	}
+	ba.lock.Unlock()
+
+	// No new requests can be forwarded to the old backend at this
+	// point. Close it as soon as all ongoing requests complete.
+	if oldBackend.closer != nil {
+		go func() {
+			oldBackend.inFlight.Wait()
+			if err := oldBackend.closer.Close(); err != nil {
+				logging.FromContext(context.Background()).WithError(err).Error("Failed to close old blob storage backend")
+			}
+		}()
+	}
+}
+
+func (ba *reloadingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	b := ba.acquireBackend()
+	length, r, err := b.backend.Get(ctx, digest)
+	if err != nil {
+		b.release()
+		return 0, nil, err
+	}
+	// The old backend must remain usable until the caller is done
+	// reading the blob.
+	return length, &reloadingBlobAccessReader{
+		ReadCloser: r,
+		backend:    b,
+	}, nil
+}
+
+func (ba *reloadingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	b := ba.acquireBackend()
+	defer b.release()
+	return b.backend.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *reloadingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	b := ba.acquireBackend()
+	defer b.release()
+	return b.backend.Delete(ctx, digest)
+}
+
+func (ba *reloadingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	b := ba.acquireBackend()
+	defer b.release()
+	return b.backend.FindMissing(ctx, digests)
+}
+
+func (ba *reloadingBlobAccess) List(ctx context.Context, fn BlobListerFunc) error {
+	b := ba.acquireBackend()
+	defer b.release()
+	return ListBlobs(ctx, b.backend, fn)
+}
+
+// reloadingBlobAccessReader is returned by reloadingBlobAccess.Get().
+// It keeps the backend from which the blob is read alive until the
+// reader is closed.
+type reloadingBlobAccessReader struct {
+	io.ReadCloser
+	backend *reloadingBlobAccessBackend
+	once    sync.Once
+}
+
+func (r *reloadingBlobAccessReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.backend.release)
+	return err
+}
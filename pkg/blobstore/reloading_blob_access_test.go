@@ -0,0 +1,109 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReloadingBlobAccessSetBackend(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	// Requests should initially be forwarded to the first backend.
+	oldBackend := mock.NewMockBlobAccess(ctrl)
+	oldBackend.EXPECT().Delete(ctx, digest).Return(status.Error(codes.Unavailable, "Old backend"))
+	blobAccess := blobstore.NewReloadingBlobAccess(oldBackend, nil)
+	require.Equal(t, status.Error(codes.Unavailable, "Old backend"), blobAccess.Delete(ctx, digest))
+
+	// After replacing the backend, the old one should no longer be
+	// used.
+	newBackend := mock.NewMockBlobAccess(ctrl)
+	newBackend.EXPECT().Delete(ctx, digest).Return(nil)
+	blobAccess.SetBackend(newBackend, nil)
+	require.NoError(t, blobAccess.Delete(ctx, digest))
+}
+
+// channelCloser is an io.Closer that closes a channel, so that tests
+// can wait for it to be invoked.
+type channelCloser chan struct{}
+
+func (c channelCloser) Close() error {
+	close(c)
+	return nil
+}
+
+func TestReloadingBlobAccessCloseAfterDrain(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	// Start reading a blob from the old backend.
+	oldBackend := mock.NewMockBlobAccess(ctrl)
+	oldBackend.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	oldCloser := make(channelCloser)
+	blobAccess := blobstore.NewReloadingBlobAccess(oldBackend, oldCloser)
+	length, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), length)
+
+	// Replacing the backend should not cause the old one to be
+	// closed while the blob is still being read.
+	newBackend := mock.NewMockBlobAccess(ctrl)
+	newCloser := make(channelCloser)
+	blobAccess.SetBackend(newBackend, newCloser)
+	select {
+	case <-oldCloser:
+		t.Fatal("Old backend was closed while a request was in flight")
+	default:
+	}
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+
+	// Once the reader is closed, the old backend should be closed
+	// as well. The new backend should remain open.
+	require.NoError(t, r.Close())
+	select {
+	case <-oldCloser:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Old backend was not closed after requests drained")
+	}
+	select {
+	case <-newCloser:
+		t.Fatal("New backend was closed")
+	default:
+	}
+
+	// Failed requests should not keep the backend alive.
+	newBackend.EXPECT().Get(ctx, digest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+	_, _, err = blobAccess.Get(ctx, digest)
+	require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	blobAccess.SetBackend(mock.NewMockBlobAccess(ctrl), nil)
+	select {
+	case <-newCloser:
+	case <-time.After(10 * time.Second):
+		t.Fatal("New backend was not closed after being replaced")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 
@@ -15,36 +16,129 @@ import (
 )
 
 type remoteBlobAccess struct {
-	address string
-	prefix  string
+	client     *http.Client
+	address    string
+	prefix     string
+	header     http.Header
+	maxRetries int
+}
+
+// convertHTTPStatusCode maps HTTP status codes returned by the remote
+// cache to the closest matching gRPC status code.
+func convertHTTPStatusCode(statusCode int) codes.Code {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusInternalServerError:
+		return codes.Internal
+	default:
+		return codes.Unknown
+	}
 }
 
 func convertHTTPUnexpectedStatus(resp *http.Response) error {
-	return status.Errorf(codes.Unknown, "Unexpected status code from remote cache: %d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	return status.Errorf(convertHTTPStatusCode(resp.StatusCode), "Unexpected status code from remote cache: %d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+}
+
+// isTransientHTTPStatusCode returns whether a request that failed
+// with a given status code may succeed when retried.
+func isTransientHTTPStatusCode(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
 }
 
-// NewRemoteBlobAccess for use of HTTP/1.1 cache backend.
+// NewRemoteBlobAccess for use of HTTP/1.1 cache backend. Requests are
+// sent using the provided HTTP client. The provided header fields
+// (e.g., "Authorization") are added to every request, making it
+// possible to access caches that require authentication.
+//
+// Idempotent requests (GET and HEAD) that fail due to transient
+// errors are retried up to maxRetries times, using exponential
+// backoff.
 //
 // See: https://docs.bazel.build/versions/master/remote-caching.html#http-caching-protocol
-func NewRemoteBlobAccess(address, prefix string) BlobAccess {
+func NewRemoteBlobAccess(client *http.Client, address, prefix string, header http.Header, maxRetries int) BlobAccess {
 	return &remoteBlobAccess{
-		address: address,
-		prefix:  prefix,
+		client:     client,
+		address:    address,
+		prefix:     prefix,
+		header:     header,
+		maxRetries: maxRetries,
 	}
 }
 
-func (ba *remoteBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+func (ba *remoteBlobAccess) newRequest(method string, digest *util.Digest, body io.Reader) (*http.Request, error) {
 	url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
-	resp, err := ctxhttp.Get(ctx, http.DefaultClient, url)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to create request")
+	}
+	for key, values := range ba.header {
+		req.Header[key] = values
+	}
+	return req, nil
+}
+
+// doIdempotent performs a GET or HEAD request, retrying it if it
+// fails due to a transient error.
+func (ba *remoteBlobAccess) doIdempotent(ctx context.Context, method string, digest *util.Digest) (*http.Response, error) {
+	delay := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		req, err := ba.newRequest(method, digest, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := ctxhttp.Do(ctx, ba.client, req)
+		if err == nil && !isTransientHTTPStatusCode(resp.StatusCode) {
+			return resp, nil
+		}
+		if attempt >= ba.maxRetries {
+			if err != nil {
+				return nil, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to contact remote cache")
+			}
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (ba *remoteBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	resp, err := ba.doIdempotent(ctx, http.MethodGet, digest)
 	if err != nil {
-		fmt.Printf("Error getting digest. %s\n", err)
 		return 0, nil, err
 	}
 
 	switch resp.StatusCode {
 	case http.StatusNotFound:
 		resp.Body.Close()
-		return 0, nil, status.Error(codes.NotFound, url)
+		return 0, nil, status.Error(codes.NotFound, resp.Request.URL.String())
 	case http.StatusOK:
 		return resp.ContentLength, resp.Body, nil
 	default:
@@ -54,15 +148,24 @@ func (ba *remoteBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64
 }
 
 func (ba *remoteBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
-	url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
-	req, err := http.NewRequest(http.MethodPut, url, r)
+	req, err := ba.newRequest(http.MethodPut, digest, r)
 	if err != nil {
 		r.Close()
 		return err
 	}
 	req.ContentLength = sizeBytes
-	_, err = ctxhttp.Do(ctx, http.DefaultClient, req)
-	return err
+	resp, err := ctxhttp.Do(ctx, ba.client, req)
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to contact remote cache")
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	default:
+		return convertHTTPUnexpectedStatus(resp)
+	}
 }
 
 func (ba *remoteBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
@@ -72,11 +175,11 @@ func (ba *remoteBlobAccess) Delete(ctx context.Context, digest *util.Digest) err
 func (ba *remoteBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
 	var missing []*util.Digest
 	for _, digest := range digests {
-		url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
-		resp, err := ctxhttp.Head(ctx, http.DefaultClient, url)
+		resp, err := ba.doIdempotent(ctx, http.MethodHead, digest)
 		if err != nil {
 			return nil, err
 		}
+		resp.Body.Close()
 
 		switch resp.StatusCode {
 		case http.StatusNotFound:
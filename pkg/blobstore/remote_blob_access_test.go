@@ -0,0 +1,63 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRemoteBlobAccessGetRetry(t *testing.T) {
+	// The first request fails with a transient error, after which
+	// the second attempt should succeed.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.Equal(t, "/cas/8b1a9953c4611296a827abf8c47804d7", r.URL.Path)
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("Hello"))
+	}))
+	defer server.Close()
+
+	blobAccess := blobstore.NewRemoteBlobAccess(server.Client(), server.URL, "cas", http.Header{"Authorization": {"Bearer secret"}}, 1)
+	length, r, err := blobAccess.Get(context.Background(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	}))
+	require.NoError(t, err)
+	require.Equal(t, int64(5), length)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+	require.NoError(t, r.Close())
+	require.Equal(t, 2, requests)
+}
+
+func TestRemoteBlobAccessPutFailure(t *testing.T) {
+	// Failures to store objects should no longer be ignored.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	blobAccess := blobstore.NewRemoteBlobAccess(server.Client(), server.URL, "cas", http.Header{}, 3)
+	err := blobAccess.Put(context.Background(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	}), 5, ioutil.NopCloser(bytes.NewBufferString("Hello")))
+	require.Equal(t, status.Error(codes.PermissionDenied, "Unexpected status code from remote cache: 403 - Forbidden"), err)
+}
@@ -0,0 +1,92 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+)
+
+type retryingBlobAccess struct {
+	BlobAccess
+	maxRetries   int
+	initialDelay time.Duration
+}
+
+// NewRetryingBlobAccess is an adapter for BlobAccess that retries
+// operations that fail with errors that are likely transient (e.g.,
+// UNAVAILABLE), using exponential backoff. Put() operations are only
+// retried if the provided reader is seekable, as the data would
+// otherwise need to be buffered. Failures that occur while reading
+// the contents of a blob returned by Get() are not retried.
+func NewRetryingBlobAccess(base BlobAccess, maxRetries int, initialDelay time.Duration) BlobAccess {
+	return &retryingBlobAccess{
+		BlobAccess:   base,
+		maxRetries:   maxRetries,
+		initialDelay: initialDelay,
+	}
+}
+
+// retry calls a function until it succeeds, fails with an error that
+// is not transient, or the maximum number of retries is reached.
+func (ba *retryingBlobAccess) retry(ctx context.Context, f func() error) error {
+	delay := ba.initialDelay
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= ba.maxRetries || !isTransientError(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (ba *retryingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	var length int64
+	var r io.ReadCloser
+	err := ba.retry(ctx, func() error {
+		var err error
+		length, r, err = ba.BlobAccess.Get(ctx, digest)
+		return err
+	})
+	return length, r, err
+}
+
+func (ba *retryingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok || ba.maxRetries == 0 {
+		return ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+	}
+	defer r.Close()
+
+	return ba.retry(ctx, func() error {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return util.StatusWrapWithCode(err, codes.Internal, "Failed to rewind blob")
+		}
+		return ba.BlobAccess.Put(ctx, digest, sizeBytes, nopCloseReadSeeker{ReadSeeker: rs})
+	})
+}
+
+func (ba *retryingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	return ba.retry(ctx, func() error {
+		return ba.BlobAccess.Delete(ctx, digest)
+	})
+}
+
+func (ba *retryingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	var missing []*util.Digest
+	err := ba.retry(ctx, func() error {
+		var err error
+		missing, err = ba.BlobAccess.FindMissing(ctx, digests)
+		return err
+	})
+	return missing, err
+}
@@ -0,0 +1,88 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewRetryingBlobAccess(bottomBlobAccess, 2, time.Millisecond)
+
+	t.Run("GetTransientFailure", func(t *testing.T) {
+		// Transient failures should be retried.
+		gomock.InOrder(
+			bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(0), nil, status.Error(codes.Unavailable, "Server not reachable")),
+			bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil))
+
+		length, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), length)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("GetPermanentFailure", func(t *testing.T) {
+		// Other errors should be returned immediately.
+		bottomBlobAccess.EXPECT().Get(ctx, digest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+
+		_, _, err := blobAccess.Get(ctx, digest)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+
+	t.Run("FindMissingRetriesExhausted", func(t *testing.T) {
+		bottomBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, status.Error(codes.Unavailable, "Server not reachable")).Times(3)
+
+		_, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.Equal(t, status.Error(codes.Unavailable, "Server not reachable"), err)
+	})
+
+	t.Run("PutSeekable", func(t *testing.T) {
+		// Seekable readers should be rewound when retrying.
+		gomock.InOrder(
+			bottomBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+					r.Close()
+					return status.Error(codes.Unavailable, "Server not reachable")
+				}),
+			bottomBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+					data, err := ioutil.ReadAll(r)
+					require.NoError(t, err)
+					require.Equal(t, []byte("Hello"), data)
+					return r.Close()
+				}))
+
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+	})
+
+	t.Run("PutNonSeekable", func(t *testing.T) {
+		// Readers that cannot be rewound can only be used once.
+		bottomBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).Return(status.Error(codes.Unavailable, "Server not reachable"))
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Server not reachable"),
+			blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+	})
+}
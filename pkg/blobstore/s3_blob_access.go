@@ -3,6 +3,8 @@ package blobstore
 import (
 	"context"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/aws/aws-sdk-go/aws"
@@ -98,3 +100,60 @@ func (ba *s3BlobAccess) getKey(digest *util.Digest) *string {
 	s := ba.keyPrefix + digest.GetKey(ba.blobKeyFormat)
 	return &s
 }
+
+func (ba *s3BlobAccess) List(ctx context.Context, fn BlobListerFunc) error {
+	var fnErr error
+	err := ba.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: ba.bucketName,
+		Prefix: &ba.keyPrefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			digest, err := util.NewDigestFromKey(strings.TrimPrefix(aws.StringValue(object.Key), ba.keyPrefix), ba.blobKeyFormat)
+			if err != nil {
+				// Object not created by us. Ignore it.
+				continue
+			}
+			if fnErr = fn(digest, aws.TimeValue(object.LastModified)); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return convertS3Error(err)
+}
+
+type s3BlobURLProvider struct {
+	s3            *s3.S3
+	bucketName    *string
+	blobKeyFormat util.DigestKeyFormat
+	keyPrefix     string
+	expiry        time.Duration
+}
+
+// NewS3BlobURLProvider creates a BlobURLProvider that returns presigned
+// URLs for objects stored in an S3 bucket by the BlobAccess returned by
+// NewS3BlobAccess(). The URLs remain valid for the provided duration.
+func NewS3BlobURLProvider(s3 *s3.S3, bucketName *string, keyPrefix string, blobKeyFormat util.DigestKeyFormat, expiry time.Duration) BlobURLProvider {
+	return &s3BlobURLProvider{
+		s3:            s3,
+		bucketName:    bucketName,
+		blobKeyFormat: blobKeyFormat,
+		keyPrefix:     keyPrefix,
+		expiry:        expiry,
+	}
+}
+
+func (up *s3BlobURLProvider) GetBlobURL(ctx context.Context, digest *util.Digest) (string, error) {
+	request, _ := up.s3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: up.bucketName,
+		Key:    aws.String(up.keyPrefix + digest.GetKey(up.blobKeyFormat)),
+	})
+	url, err := request.Presign(up.expiry)
+	if err != nil {
+		return "", util.StatusWrapWithCode(err, codes.Internal, "Failed to presign URL")
+	}
+	return url, nil
+}
@@ -0,0 +1,167 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	scrubberBlobsScrubbedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "scrubber_blobs_scrubbed_total",
+			Help:      "Total number of blobs whose integrity was verified by the scrubber.",
+		},
+		[]string{"name"})
+	scrubberBytesScrubbedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "scrubber_bytes_scrubbed_total",
+			Help:      "Total size of blobs whose integrity was verified by the scrubber.",
+		},
+		[]string{"name"})
+	scrubberBlobsCorruptedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "scrubber_blobs_corrupted_total",
+			Help:      "Total number of corrupted blobs detected by the scrubber.",
+		},
+		[]string{"name"})
+	scrubberErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "scrubber_errors_total",
+			Help:      "Total number of blobs that could not be verified by the scrubber due to I/O errors.",
+		},
+		[]string{"name"})
+)
+
+func init() {
+	prometheus.MustRegister(scrubberBlobsScrubbedTotal)
+	prometheus.MustRegister(scrubberBytesScrubbedTotal)
+	prometheus.MustRegister(scrubberBlobsCorruptedTotal)
+	prometheus.MustRegister(scrubberErrorsTotal)
+}
+
+// Scrubber verifies the integrity of all blobs stored in a Content
+// Addressable Storage backend.
+type Scrubber interface {
+	Scrub(ctx context.Context) error
+}
+
+type scrubber struct {
+	blobAccess BlobAccess
+	quarantine BlobAccess
+
+	blobsScrubbedTotal  prometheus.Counter
+	bytesScrubbedTotal  prometheus.Counter
+	blobsCorruptedTotal prometheus.Counter
+	errorsTotal         prometheus.Counter
+}
+
+// NewScrubber creates a Scrubber that iterates over all blobs in a
+// backend and validates their size and checksum, using the same logic
+// as MerkleBlobAccess. Corrupted blobs are deleted from the backend.
+// If a quarantine backend is provided, corrupted blobs are copied into
+// it prior to deletion, so that they may be inspected later.
+//
+// The backend must implement BlobLister and must not be wrapped by
+// MerkleBlobAccess, as that would already discard corrupted blobs
+// upon access. The name is used to label metrics, making it possible
+// to track corruption rates per shard.
+func NewScrubber(blobAccess BlobAccess, quarantine BlobAccess, name string) Scrubber {
+	return &scrubber{
+		blobAccess: blobAccess,
+		quarantine: quarantine,
+
+		blobsScrubbedTotal:  scrubberBlobsScrubbedTotal.WithLabelValues(name),
+		bytesScrubbedTotal:  scrubberBytesScrubbedTotal.WithLabelValues(name),
+		blobsCorruptedTotal: scrubberBlobsCorruptedTotal.WithLabelValues(name),
+		errorsTotal:         scrubberErrorsTotal.WithLabelValues(name),
+	}
+}
+
+func (s *scrubber) Scrub(ctx context.Context) error {
+	var digests []*util.Digest
+	if err := ListBlobs(ctx, s.blobAccess, func(digest *util.Digest, timestamp time.Time) error {
+		digests = append(digests, digest)
+		return nil
+	}); err != nil {
+		return util.StatusWrap(err, "Failed to list blobs")
+	}
+
+	for _, digest := range digests {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		logger := logging.FromContext(ctx).WithField(logging.BlobDigestField, digest.String())
+		corrupted, err := s.verify(ctx, digest)
+		if status.Code(err) == codes.NotFound {
+			// Blob disappeared after listing.
+			continue
+		} else if err != nil {
+			logger.WithError(err).Warn("Failed to verify blob")
+			s.errorsTotal.Inc()
+			continue
+		}
+		s.blobsScrubbedTotal.Inc()
+		s.bytesScrubbedTotal.Add(float64(digest.GetSizeBytes()))
+		if corrupted {
+			s.blobsCorruptedTotal.Inc()
+			if err := s.discard(ctx, digest); err == nil {
+				logger.Info("Discarded corrupted blob")
+			} else {
+				logger.WithError(err).Warn("Failed to discard corrupted blob")
+			}
+		}
+	}
+	return nil
+}
+
+// verify reads a blob in its entirety, returning whether its contents
+// match its digest.
+func (s *scrubber) verify(ctx context.Context, digest *util.Digest) (bool, error) {
+	length, r, err := s.blobAccess.Get(ctx, digest)
+	if err != nil {
+		return false, err
+	}
+	if length != digest.GetSizeBytes() {
+		r.Close()
+		return true, nil
+	}
+
+	corrupted := false
+	validatingReader := newChecksumValidatingReader(digest, r, func() { corrupted = true }, codes.Internal)
+	_, err = io.Copy(ioutil.Discard, validatingReader)
+	validatingReader.Close()
+	if corrupted {
+		return true, nil
+	}
+	return false, err
+}
+
+func (s *scrubber) discard(ctx context.Context, digest *util.Digest) error {
+	if s.quarantine != nil {
+		length, r, err := s.blobAccess.Get(ctx, digest)
+		if err != nil {
+			return util.StatusWrap(err, "Failed to read blob for quarantining")
+		}
+		if err := s.quarantine.Put(ctx, digest, length, r); err != nil {
+			return util.StatusWrap(err, "Failed to quarantine blob")
+		}
+	}
+	return s.blobAccess.Delete(ctx, digest)
+}
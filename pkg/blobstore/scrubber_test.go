@@ -0,0 +1,74 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+// listingBlobAccess extends a mocked BlobAccess with a fixed list of
+// blobs, as gomock only mocks BlobAccess itself.
+type listingBlobAccess struct {
+	*mock.MockBlobAccess
+	digests []*util.Digest
+}
+
+func (ba *listingBlobAccess) List(ctx context.Context, fn blobstore.BlobListerFunc) error {
+	for _, digest := range ba.digests {
+		if err := fn(digest, time.Unix(0, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestScrubberQuarantinesCorruptedBlobs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	validDigest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	corruptedDigest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+	truncatedDigest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      "acbd18db4cc2f85cedef654fccc4a4d8",
+		SizeBytes: 3,
+	})
+	blobAccess := &listingBlobAccess{
+		MockBlobAccess: mock.NewMockBlobAccess(ctrl),
+		digests:        []*util.Digest{validDigest, corruptedDigest, truncatedDigest},
+	}
+	quarantine := mock.NewMockBlobAccess(ctrl)
+
+	// Valid blobs should be left alone.
+	blobAccess.EXPECT().Get(ctx, validDigest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+
+	// Blobs with a mismatching checksum or size should be copied
+	// into quarantine and deleted.
+	blobAccess.EXPECT().Get(ctx, corruptedDigest).Return(int64(7), ioutil.NopCloser(bytes.NewBufferString("Goodbyf")), nil)
+	r := ioutil.NopCloser(bytes.NewBufferString("Goodbyf"))
+	blobAccess.EXPECT().Get(ctx, corruptedDigest).Return(int64(7), r, nil)
+	quarantine.EXPECT().Put(ctx, corruptedDigest, int64(7), r).Return(nil)
+	blobAccess.EXPECT().Delete(ctx, corruptedDigest).Return(nil)
+
+	blobAccess.EXPECT().Get(ctx, truncatedDigest).Return(int64(2), ioutil.NopCloser(bytes.NewBufferString("fo")), nil)
+	r = ioutil.NopCloser(bytes.NewBufferString("fo"))
+	blobAccess.EXPECT().Get(ctx, truncatedDigest).Return(int64(2), r, nil)
+	quarantine.EXPECT().Put(ctx, truncatedDigest, int64(2), r).Return(nil)
+	blobAccess.EXPECT().Delete(ctx, truncatedDigest).Return(nil)
+
+	require.NoError(t, blobstore.NewScrubber(blobAccess, quarantine, "test").Scrub(ctx))
+}
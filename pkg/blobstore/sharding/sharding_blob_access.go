@@ -95,3 +95,16 @@ func (ba *shardingBlobAccess) FindMissing(ctx context.Context, digests []*util.D
 	}
 	return missingDigests, err
 }
+
+func (ba *shardingBlobAccess) List(ctx context.Context, fn blobstore.BlobListerFunc) error {
+	// Drained backends are skipped, as their contents are no
+	// longer accessible through this adapter.
+	for _, backend := range ba.backends {
+		if backend != nil {
+			if err := blobstore.ListBlobs(ctx, backend, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
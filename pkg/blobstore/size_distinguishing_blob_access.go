@@ -88,3 +88,10 @@ func (ba *sizeDistinguishingBlobAccess) FindMissing(ctx context.Context, digests
 	}
 	return append(smallResults.missing, largeResults.missing...), nil
 }
+
+func (ba *sizeDistinguishingBlobAccess) List(ctx context.Context, fn BlobListerFunc) error {
+	if err := ListBlobs(ctx, ba.smallBlobAccess, fn); err != nil {
+		return err
+	}
+	return ListBlobs(ctx, ba.largeBlobAccess, fn)
+}
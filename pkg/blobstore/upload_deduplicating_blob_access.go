@@ -0,0 +1,116 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/google/uuid"
+)
+
+type uploadDeduplicatingBlobAccess struct {
+	BlobAccess
+	leaseStore       UploadLeaseStore
+	minimumSizeBytes int64
+	leaseDuration    time.Duration
+	pollInterval     time.Duration
+}
+
+// NewUploadDeduplicatingBlobAccess creates a BlobAccess that prevents
+// multiple clients from uploading the same large object at the same
+// time. This happens frequently when many workers run build actions
+// that yield identical outputs, such as toolchain archives.
+//
+// Before uploading an object that is at least minimumSizeBytes in
+// size, a lease is acquired. The lease is renewed periodically while
+// the upload is in progress. Clients that fail to obtain the lease
+// wait for the object to appear in the backend, checking for its
+// existence every pollInterval. If the client holding the lease
+// disappears, the lease expires after leaseDuration, allowing another
+// client to take over. Upload leases are only advisory: objects are
+// uploaded regardless if the lease store is unavailable.
+func NewUploadDeduplicatingBlobAccess(blobAccess BlobAccess, leaseStore UploadLeaseStore, minimumSizeBytes int64, leaseDuration time.Duration, pollInterval time.Duration) BlobAccess {
+	return &uploadDeduplicatingBlobAccess{
+		BlobAccess:       blobAccess,
+		leaseStore:       leaseStore,
+		minimumSizeBytes: minimumSizeBytes,
+		leaseDuration:    leaseDuration,
+		pollInterval:     pollInterval,
+	}
+}
+
+func (ba *uploadDeduplicatingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	if sizeBytes < ba.minimumSizeBytes {
+		return ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+	}
+
+	logger := logging.FromContext(ctx).WithField(logging.BlobDigestField, digest.String())
+	token := uuid.Must(uuid.NewRandom()).String()
+	for {
+		acquired, err := ba.leaseStore.Acquire(ctx, digest, token, ba.leaseDuration)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to acquire upload lease")
+			return ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+		}
+		if acquired {
+			return ba.putWithLease(ctx, digest, sizeBytes, r, token)
+		}
+
+		// Another client is uploading the same object. Wait for
+		// it to complete.
+		timer := time.NewTimer(ba.pollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			r.Close()
+			return util.StatusFromContext(ctx)
+		}
+		missing, err := ba.BlobAccess.FindMissing(ctx, []*util.Digest{digest})
+		if err != nil {
+			r.Close()
+			return err
+		}
+		if len(missing) == 0 {
+			r.Close()
+			return nil
+		}
+	}
+}
+
+// putWithLease uploads an object while holding its upload lease. The
+// lease is renewed periodically, so that uploads that take longer than
+// the lease duration are not taken over by other clients.
+func (ba *uploadDeduplicatingBlobAccess) putWithLease(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser, token string) error {
+	logger := logging.FromContext(ctx).WithField(logging.BlobDigestField, digest.String())
+	uploadDone := make(chan struct{})
+	renewerDone := make(chan struct{})
+	go func() {
+		defer close(renewerDone)
+		ticker := time.NewTicker(ba.leaseDuration / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if renewed, err := ba.leaseStore.Renew(ctx, digest, token, ba.leaseDuration); err != nil {
+					logger.WithError(err).Warn("Failed to renew upload lease")
+				} else if !renewed {
+					logger.Warn("Upload lease expired before it could be renewed")
+					return
+				}
+			case <-uploadDone:
+				return
+			}
+		}
+	}()
+
+	err := ba.BlobAccess.Put(ctx, digest, sizeBytes, r)
+	close(uploadDone)
+	<-renewerDone
+	if errRelease := ba.leaseStore.Release(ctx, digest, token); errRelease != nil {
+		logger.WithError(errRelease).Warn("Failed to release upload lease")
+	}
+	return err
+}
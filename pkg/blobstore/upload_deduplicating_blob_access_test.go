@@ -0,0 +1,153 @@
+package blobstore_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUploadDeduplicatingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("SmallObject", func(t *testing.T) {
+		// Objects below the minimum size should be uploaded
+		// without acquiring a lease.
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		baseBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).Return(nil)
+		leaseStore := mock.NewMockUploadLeaseStore(ctrl)
+		blobAccess := blobstore.NewUploadDeduplicatingBlobAccess(baseBlobAccess, leaseStore, 6, time.Minute, time.Millisecond)
+
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+	})
+
+	t.Run("LeaseStoreFailure", func(t *testing.T) {
+		// Leases are advisory. Objects should still be
+		// uploaded if the lease store is unavailable.
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		baseBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).Return(nil)
+		leaseStore := mock.NewMockUploadLeaseStore(ctrl)
+		leaseStore.EXPECT().Acquire(ctx, digest, gomock.Any(), time.Minute).Return(
+			false, status.Error(codes.Unavailable, "Connection refused"))
+		blobAccess := blobstore.NewUploadDeduplicatingBlobAccess(baseBlobAccess, leaseStore, 5, time.Minute, time.Millisecond)
+
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+	})
+
+	t.Run("ConcurrentPuts", func(t *testing.T) {
+		// While one client is uploading an object, a second
+		// client should wait for the upload to complete instead
+		// of uploading the object as well.
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		uploadStarted := make(chan struct{})
+		uploadFinished := make(chan struct{})
+		baseBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+				close(uploadStarted)
+				<-uploadFinished
+				return r.Close()
+			})
+		gomock.InOrder(
+			baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).DoAndReturn(
+				func(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+					close(uploadFinished)
+					return digests, nil
+				}),
+			baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil))
+		leaseStore := mock.NewMockUploadLeaseStore(ctrl)
+		gomock.InOrder(
+			leaseStore.EXPECT().Acquire(ctx, digest, gomock.Any(), time.Minute).Return(true, nil),
+			leaseStore.EXPECT().Acquire(ctx, digest, gomock.Any(), time.Minute).Return(false, nil).Times(2))
+		leaseStore.EXPECT().Release(ctx, digest, gomock.Any()).Return(nil)
+		blobAccess := blobstore.NewUploadDeduplicatingBlobAccess(baseBlobAccess, leaseStore, 5, time.Minute, time.Millisecond)
+
+		errFirst := make(chan error)
+		go func() {
+			errFirst <- blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello")))
+		}()
+		<-uploadStarted
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+		require.NoError(t, <-errFirst)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		// If the client holding the lease disappears, the lease
+		// expires, allowing another client to take over.
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return([]*util.Digest{digest}, nil)
+		baseBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).Return(nil)
+		leaseStore := mock.NewMockUploadLeaseStore(ctrl)
+		gomock.InOrder(
+			leaseStore.EXPECT().Acquire(ctx, digest, gomock.Any(), time.Minute).Return(false, nil),
+			leaseStore.EXPECT().Acquire(ctx, digest, gomock.Any(), time.Minute).Return(true, nil),
+			leaseStore.EXPECT().Release(ctx, digest, gomock.Any()).Return(nil))
+		blobAccess := blobstore.NewUploadDeduplicatingBlobAccess(baseBlobAccess, leaseStore, 5, time.Minute, time.Millisecond)
+
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+	})
+
+	t.Run("Renewal", func(t *testing.T) {
+		// Leases should be renewed while the upload is in
+		// progress, using the token with which the lease was
+		// acquired.
+		var token string
+		leaseStore := mock.NewMockUploadLeaseStore(ctrl)
+		leaseStore.EXPECT().Acquire(ctx, digest, gomock.Any(), 10*time.Millisecond).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, acquireToken string, duration time.Duration) (bool, error) {
+				token = acquireToken
+				return true, nil
+			})
+		renewed := make(chan struct{})
+		leaseStore.EXPECT().Renew(ctx, digest, gomock.Any(), 10*time.Millisecond).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, renewToken string, duration time.Duration) (bool, error) {
+				require.Equal(t, token, renewToken)
+				close(renewed)
+				return false, nil
+			})
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		baseBlobAccess.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+				<-renewed
+				return r.Close()
+			})
+		leaseStore.EXPECT().Release(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, releaseToken string) error {
+				require.Equal(t, token, releaseToken)
+				return nil
+			})
+		blobAccess := blobstore.NewUploadDeduplicatingBlobAccess(baseBlobAccess, leaseStore, 5, 10*time.Millisecond, time.Millisecond)
+
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, blobstore.NewBytesReader([]byte("Hello"))))
+	})
+
+	t.Run("Cancellation", func(t *testing.T) {
+		// Cancelling the context while waiting for another
+		// client to complete its upload should return a gRPC
+		// status error.
+		ctxWithCancel, cancel := context.WithCancel(ctx)
+		cancel()
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		leaseStore := mock.NewMockUploadLeaseStore(ctrl)
+		leaseStore.EXPECT().Acquire(ctxWithCancel, digest, gomock.Any(), time.Minute).Return(false, nil)
+		blobAccess := blobstore.NewUploadDeduplicatingBlobAccess(baseBlobAccess, leaseStore, 5, time.Minute, time.Minute)
+
+		err := blobAccess.Put(ctxWithCancel, digest, 5, blobstore.NewBytesReader([]byte("Hello")))
+		require.Equal(t, codes.Canceled, status.Code(err))
+	})
+}
@@ -0,0 +1,26 @@
+package blobstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// UploadLeaseStore keeps track of which clients are uploading which
+// objects. It is used by UploadDeduplicatingBlobAccess to ensure that
+// large objects are only uploaded by a single client at a time.
+//
+// Leases are identified by a token that is chosen by the client, so
+// that a client cannot renew or release a lease that has expired and
+// has been acquired by another client in the meantime.
+type UploadLeaseStore interface {
+	// Acquire obtains a lease on the upload of an object. It
+	// returns false if the lease is held by another client.
+	Acquire(ctx context.Context, digest *util.Digest, token string, duration time.Duration) (bool, error)
+	// Renew extends the duration of a lease. It returns false if
+	// the lease is no longer held by the caller.
+	Renew(ctx context.Context, digest *util.Digest, token string, duration time.Duration) (bool, error)
+	// Release discards a lease, if still held by the caller.
+	Release(ctx context.Context, digest *util.Digest, token string) error
+}
@@ -0,0 +1,61 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type urlFetchingBlobAccess struct {
+	BlobAccess
+	urlProvider BlobURLProvider
+	httpClient  *http.Client
+}
+
+// NewURLFetchingBlobAccess creates an adapter for BlobAccess that
+// performs Get() operations by downloading blobs over HTTP from URLs
+// obtained from a BlobURLProvider. All other operations are forwarded
+// to the backend.
+//
+// This adapter can be combined with NewSizeDistinguishingBlobAccess()
+// to let processes download large blobs directly from object storage
+// (e.g., S3 through presigned URLs), instead of through intermediate
+// storage processes. Data is not validated against the digest, meaning
+// it should be wrapped with NewMerkleBlobAccess().
+func NewURLFetchingBlobAccess(blobAccess BlobAccess, urlProvider BlobURLProvider, httpClient *http.Client) BlobAccess {
+	return &urlFetchingBlobAccess{
+		BlobAccess:  blobAccess,
+		urlProvider: urlProvider,
+		httpClient:  httpClient,
+	}
+}
+
+func (ba *urlFetchingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	url, err := ba.urlProvider.GetBlobURL(ctx, digest)
+	if err != nil {
+		return 0, nil, util.StatusWrap(err, "Failed to obtain blob URL")
+	}
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to create HTTP request")
+	}
+	response, err := ba.httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return 0, nil, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to download blob")
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.ContentLength, response.Body, nil
+	case http.StatusNotFound:
+		response.Body.Close()
+		return 0, nil, status.Error(codes.NotFound, "Blob not found")
+	default:
+		response.Body.Close()
+		return 0, nil, status.Errorf(codes.Unavailable, "Unexpected status code while downloading blob: %#v", response.Status)
+	}
+}
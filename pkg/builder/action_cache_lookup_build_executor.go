@@ -0,0 +1,82 @@
+package builder
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	actionCacheLookupBuildExecutorOperationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "action_cache_lookup_build_executor_operations_total",
+			Help:      "Total number of Action Cache lookups performed prior to executing build actions.",
+		},
+		[]string{"result"})
+	actionCacheLookupBuildExecutorOperationsTotalHit     = actionCacheLookupBuildExecutorOperationsTotal.WithLabelValues("Hit")
+	actionCacheLookupBuildExecutorOperationsTotalMiss    = actionCacheLookupBuildExecutorOperationsTotal.WithLabelValues("Miss")
+	actionCacheLookupBuildExecutorOperationsTotalFailure = actionCacheLookupBuildExecutorOperationsTotal.WithLabelValues("Failure")
+	actionCacheLookupBuildExecutorOperationsTotalSkipped = actionCacheLookupBuildExecutorOperationsTotal.WithLabelValues("Skipped")
+)
+
+func init() {
+	prometheus.MustRegister(actionCacheLookupBuildExecutorOperationsTotal)
+}
+
+type actionCacheLookupBuildExecutor struct {
+	base        BuildExecutor
+	actionCache ac.ActionCache
+	browserURL  *url.URL
+}
+
+// NewActionCacheLookupBuildExecutor creates an adapter for
+// BuildExecutor that first consults the Action Cache (AC) before
+// executing an action, unless the client requested the cache lookup to
+// be skipped. This allows workers to serve results of actions that are
+// requested repeatedly without executing them again. A link to
+// bbb_browser is added to responses served from the Action Cache.
+func NewActionCacheLookupBuildExecutor(base BuildExecutor, actionCache ac.ActionCache, browserURL *url.URL) BuildExecutor {
+	return &actionCacheLookupBuildExecutor{
+		base:        base,
+		actionCache: actionCache,
+		browserURL:  browserURL,
+	}
+}
+
+func (be *actionCacheLookupBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
+	if !request.SkipCacheLookup {
+		actionDigest, err := util.NewDigest(request.InstanceName, request.ActionDigest)
+		if err != nil {
+			return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to extract digest for action")), false
+		}
+		result, err := be.actionCache.GetActionResult(ctx, actionDigest)
+		if err == nil {
+			actionCacheLookupBuildExecutorOperationsTotalHit.Inc()
+			return &remoteexecution.ExecuteResponse{
+				Result:       result,
+				CachedResult: true,
+				Message:      "Action details (cached result): " + getBrowserURL(be.browserURL, "action", actionDigest),
+			}, true
+		} else if status.Code(err) == codes.NotFound {
+			actionCacheLookupBuildExecutorOperationsTotalMiss.Inc()
+		} else {
+			// Failures to consult the Action Cache should not
+			// prevent the action from being executed.
+			actionCacheLookupBuildExecutorOperationsTotalFailure.Inc()
+			logging.WithActionDigest(logging.FromContext(ctx), actionDigest).WithError(err).Warn("Failed to look up action result")
+		}
+	} else {
+		actionCacheLookupBuildExecutorOperationsTotalSkipped.Inc()
+	}
+	return be.base.Execute(ctx, request)
+}
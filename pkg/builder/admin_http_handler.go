@@ -0,0 +1,106 @@
+package builder
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type adminHTTPHandler struct {
+	adminServer admin.AdminServer
+	browserURL  *url.URL
+	marshaler   jsonpb.Marshaler
+	mux         *http.ServeMux
+}
+
+// NewAdminHTTPHandler creates an HTTP handler that exposes the
+// read-only methods of the Admin service as a JSON API, so that
+// dashboards can poll the state of the scheduler without needing to
+// speak gRPC. The following endpoints are provided:
+//
+// /: an HTML page displaying the queues and the workers.
+// /api/v1/queued_operations: the result of ListQueuedOperations().
+// /api/v1/workers: the result of ListWorkers(), including the
+// operations that are currently executing on every worker.
+// /api/v1/drained_shards: the result of ListDrainedShards().
+//
+// If a browser URL is provided, the HTML page links to the actions
+// that are being executed in bbb_browser.
+//
+// The "Authorization" header of HTTP requests is forwarded to the Admin
+// service as gRPC metadata. The handler may thus be combined with
+// NewAuthenticatingAdminServer() to require an admin token.
+func NewAdminHTTPHandler(adminServer admin.AdminServer, browserURL *url.URL) http.Handler {
+	h := &adminHTTPHandler{
+		adminServer: adminServer,
+		browserURL:  browserURL,
+		marshaler:   jsonpb.Marshaler{EmitDefaults: true},
+		mux:         http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/", h.serveStatusPage)
+	h.mux.HandleFunc("/api/v1/queued_operations", func(w http.ResponseWriter, r *http.Request) {
+		response, err := h.adminServer.ListQueuedOperations(getAdminRequestContext(r), &admin.ListQueuedOperationsRequest{})
+		h.writeResponse(w, response, err)
+	})
+	h.mux.HandleFunc("/api/v1/workers", func(w http.ResponseWriter, r *http.Request) {
+		response, err := h.adminServer.ListWorkers(getAdminRequestContext(r), &admin.ListWorkersRequest{})
+		h.writeResponse(w, response, err)
+	})
+	h.mux.HandleFunc("/api/v1/drained_shards", func(w http.ResponseWriter, r *http.Request) {
+		response, err := h.adminServer.ListDrainedShards(getAdminRequestContext(r), &admin.ListDrainedShardsRequest{})
+		h.writeResponse(w, response, err)
+	})
+	return h
+}
+
+func (h *adminHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET and HEAD requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// getAdminRequestContext returns the context of an HTTP request, to
+// which the "Authorization" header is attached as incoming gRPC
+// metadata.
+func getAdminRequestContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", authorization))
+	}
+	return ctx
+}
+
+// writeAdminError converts an error returned by the Admin service to
+// an HTTP response.
+func writeAdminError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	if s.Code() == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, s.Message(), http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, s.Message(), http.StatusInternalServerError)
+}
+
+func (h *adminHTTPHandler) writeResponse(w http.ResponseWriter, response proto.Message, err error) {
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.marshaler.Marshal(w, response); err != nil {
+		logrus.WithError(err).Warn("Failed to write admin API response")
+	}
+}
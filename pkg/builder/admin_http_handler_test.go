@@ -0,0 +1,106 @@
+package builder_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdminHTTPHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	adminServer := mock.NewMockAdminServer(ctrl)
+	handler := builder.NewAdminHTTPHandler(adminServer, nil)
+
+	t.Run("Workers", func(t *testing.T) {
+		adminServer.EXPECT().ListWorkers(gomock.Any(), &admin.ListWorkersRequest{}).Return(&admin.ListWorkersResponse{
+			Workers: []*admin.WorkerInfo{
+				{
+					WorkerId:    "worker1",
+					Concurrency: 4,
+				},
+			},
+		}, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/workers", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.Contains(t, w.Body.String(), "\"workerId\":\"worker1\"")
+		require.Contains(t, w.Body.String(), "\"concurrency\":4")
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		adminServer.EXPECT().ListQueuedOperations(gomock.Any(), &admin.ListQueuedOperationsRequest{}).Return(nil, status.Error(codes.Internal, "Scheduler on fire"))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/queued_operations", nil))
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		require.Equal(t, "Scheduler on fire\n", w.Body.String())
+	})
+
+	t.Run("StatusPage", func(t *testing.T) {
+		adminServer.EXPECT().ListQueuedOperations(gomock.Any(), &admin.ListQueuedOperationsRequest{}).Return(&admin.ListQueuedOperationsResponse{}, nil)
+		adminServer.EXPECT().ListWorkers(gomock.Any(), &admin.ListWorkersRequest{}).Return(&admin.ListWorkersResponse{
+			Workers: []*admin.WorkerInfo{
+				{
+					WorkerId:        "worker1",
+					Concurrency:     4,
+					UnhealthyReason: "Disk full",
+				},
+			},
+		}, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), "No operations are queued.")
+		require.Contains(t, w.Body.String(), "<td>worker1</td>")
+		require.Contains(t, w.Body.String(), "<td>Unhealthy: Disk full</td>")
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/workers", nil))
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func TestAdminHTTPHandlerAuthentication(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	adminServer := mock.NewMockAdminServer(ctrl)
+	handler := builder.NewAdminHTTPHandler(builder.NewAuthenticatingAdminServer(adminServer, "secret"), nil)
+
+	t.Run("MissingToken", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/workers", nil))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer wrong")
+		handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("ValidToken", func(t *testing.T) {
+		adminServer.EXPECT().ListWorkers(gomock.Any(), &admin.ListWorkersRequest{}).Return(&admin.ListWorkersResponse{}, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/workers", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+}
@@ -0,0 +1,183 @@
+package builder
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/sirupsen/logrus"
+)
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<title>Bazel Buildbarn Scheduler</title>
+		<meta http-equiv="refresh" content="5">
+		<style>
+			body { font-family: sans-serif; }
+			table { border-collapse: collapse; margin-bottom: 20px; }
+			th, td { border: 1px solid #ccc; padding: 2px 10px; text-align: left; vertical-align: top; }
+			.digest { font-family: monospace; }
+			.label { color: #666; font-size: smaller; }
+		</style>
+	</head>
+	<body>
+		<h1>Bazel Buildbarn Scheduler</h1>
+
+		<h2>Queues</h2>
+		<table>
+			<tr><th>Instance name</th><th>Queued operations</th><th>Oldest queued operation</th></tr>
+			{{range .Queues}}
+				<tr><td>{{.InstanceName}}</td><td>{{.QueuedOperations}}</td><td>{{duration .OldestQueuedAge}}</td></tr>
+			{{else}}
+				<tr><td colspan="3">No operations are queued.</td></tr>
+			{{end}}
+		</table>
+
+		<h2>Workers</h2>
+		<table>
+			<tr><th>Worker</th><th>Concurrency</th><th>State</th><th>Executing operations</th></tr>
+			{{range .Workers}}
+				<tr>
+					<td>
+						{{.WorkerID}}
+						{{range $name, $value := .Labels}}
+							<div class="label">{{$name}}={{$value}}</div>
+						{{end}}
+					</td>
+					<td>{{.Concurrency}}</td>
+					<td>{{.State}}</td>
+					<td>
+						{{range .Operations}}
+							<div>
+								{{if .ActionURL}}<a class="digest" href="{{.ActionURL}}">{{.ActionDigest}}</a>{{else}}<span class="digest">{{.ActionDigest}}</span>{{end}}
+								({{.ExecutionStage}}, {{duration .ExecutionTime}})
+							</div>
+						{{end}}
+					</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="4">No workers are connected.</td></tr>
+			{{end}}
+		</table>
+	</body>
+</html>
+`))
+
+type statusPageQueue struct {
+	InstanceName     string
+	QueuedOperations int
+	OldestQueuedAge  time.Duration
+}
+
+type statusPageOperation struct {
+	ActionDigest   string
+	ActionURL      string
+	ExecutionStage string
+	ExecutionTime  time.Duration
+}
+
+type statusPageWorker struct {
+	WorkerID    string
+	Labels      map[string]string
+	Concurrency uint32
+	State       string
+	Operations  []statusPageOperation
+}
+
+type statusPage struct {
+	Queues  []statusPageQueue
+	Workers []statusPageWorker
+}
+
+// serveStatusPage renders an HTML page that displays the size of the
+// queue of every instance name and the operations executing on every
+// worker. Links to bbb_browser are added if a browser URL is provided.
+func (h *adminHTTPHandler) serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := getAdminRequestContext(r)
+	queuedOperations, err := h.adminServer.ListQueuedOperations(ctx, &admin.ListQueuedOperationsRequest{})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	workers, err := h.adminServer.ListWorkers(ctx, &admin.ListWorkersRequest{})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	now := time.Now()
+	var page statusPage
+	queues := map[string]*statusPageQueue{}
+	for _, operation := range queuedOperations.QueuedOperations {
+		queue, ok := queues[operation.InstanceName]
+		if !ok {
+			queue = &statusPageQueue{InstanceName: operation.InstanceName}
+			queues[operation.InstanceName] = queue
+		}
+		queue.QueuedOperations++
+		if queuedTime, err := ptypes.Timestamp(operation.QueuedTimestamp); err == nil && now.Sub(queuedTime) > queue.OldestQueuedAge {
+			queue.OldestQueuedAge = now.Sub(queuedTime)
+		}
+	}
+	for _, queue := range queues {
+		page.Queues = append(page.Queues, *queue)
+	}
+	sort.Slice(page.Queues, func(i, j int) bool {
+		return page.Queues[i].InstanceName < page.Queues[j].InstanceName
+	})
+
+	for _, worker := range workers.Workers {
+		state := "Idle"
+		if len(worker.ExecutingOperations) > 0 {
+			state = "Executing"
+		}
+		if worker.Drained {
+			state = "Drained"
+		} else if worker.BlacklistedUntil != nil {
+			state = "Blacklisted"
+		} else if worker.UnhealthyReason != "" {
+			state = "Unhealthy: " + worker.UnhealthyReason
+		}
+		pageWorker := statusPageWorker{
+			WorkerID:    worker.WorkerId,
+			Labels:      worker.Labels,
+			Concurrency: worker.Concurrency,
+			State:       state,
+		}
+		for _, operation := range worker.ExecutingOperations {
+			pageOperation := statusPageOperation{
+				ExecutionStage: operation.ExecutionStage.String(),
+			}
+			if digest, err := util.NewDigest(operation.InstanceName, operation.ActionDigest); err == nil {
+				pageOperation.ActionDigest = digest.String()
+				if h.browserURL != nil {
+					pageOperation.ActionURL = getBrowserURL(h.browserURL, "action", digest)
+				}
+			}
+			if dispatchedTime, err := ptypes.Timestamp(operation.DispatchedTimestamp); err == nil {
+				pageOperation.ExecutionTime = now.Sub(dispatchedTime)
+			}
+			pageWorker.Operations = append(pageWorker.Operations, pageOperation)
+		}
+		page.Workers = append(page.Workers, pageWorker)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(w, &page); err != nil {
+		logrus.WithError(err).Warn("Failed to render status page")
+	}
+}
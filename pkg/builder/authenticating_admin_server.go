@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type authenticatingAdminServer struct {
+	base  admin.AdminServer
+	token []byte
+}
+
+// NewAuthenticatingAdminServer creates a decorator for the Admin
+// service that only forwards requests that carry a bearer token in the
+// "authorization" header that is equal to the token provided.
+func NewAuthenticatingAdminServer(base admin.AdminServer, token string) admin.AdminServer {
+	return &authenticatingAdminServer{
+		base:  base,
+		token: []byte(token),
+	}
+}
+
+func (s *authenticatingAdminServer) authenticate(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if strings.HasPrefix(value, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(value, "Bearer ")), s.token) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "Request does not contain a valid admin token")
+}
+
+func (s *authenticatingAdminServer) ListQueuedOperations(ctx context.Context, in *admin.ListQueuedOperationsRequest) (*admin.ListQueuedOperationsResponse, error) {
+	if err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return s.base.ListQueuedOperations(ctx, in)
+}
+
+func (s *authenticatingAdminServer) ListWorkers(ctx context.Context, in *admin.ListWorkersRequest) (*admin.ListWorkersResponse, error) {
+	if err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return s.base.ListWorkers(ctx, in)
+}
+
+func (s *authenticatingAdminServer) CancelOperation(ctx context.Context, in *admin.CancelOperationRequest) (*admin.CancelOperationResponse, error) {
+	if err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return s.base.CancelOperation(ctx, in)
+}
+
+func (s *authenticatingAdminServer) DrainWorker(ctx context.Context, in *admin.DrainWorkerRequest) (*admin.DrainWorkerResponse, error) {
+	if err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return s.base.DrainWorker(ctx, in)
+}
+
+func (s *authenticatingAdminServer) FlushWorkerCache(ctx context.Context, in *admin.FlushWorkerCacheRequest) (*admin.FlushWorkerCacheResponse, error) {
+	if err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return s.base.FlushWorkerCache(ctx, in)
+}
+
+func (s *authenticatingAdminServer) ListDrainedShards(ctx context.Context, in *admin.ListDrainedShardsRequest) (*admin.ListDrainedShardsResponse, error) {
+	if err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return s.base.ListDrainedShards(ctx, in)
+}
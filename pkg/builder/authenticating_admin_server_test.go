@@ -0,0 +1,54 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticatingAdminServerMissingToken(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	base := mock.NewMockAdminServer(ctrl)
+	adminServer := builder.NewAuthenticatingAdminServer(base, "secret")
+
+	_, err := adminServer.ListWorkers(ctx, &admin.ListWorkersRequest{})
+	require.Equal(t, status.Error(codes.Unauthenticated, "Request does not contain a valid admin token"), err)
+}
+
+func TestAuthenticatingAdminServerInvalidToken(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	base := mock.NewMockAdminServer(ctrl)
+	adminServer := builder.NewAuthenticatingAdminServer(base, "secret")
+
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer wrong"))
+	_, err := adminServer.CancelOperation(ctx, &admin.CancelOperationRequest{Name: "operation"})
+	require.Equal(t, status.Error(codes.Unauthenticated, "Request does not contain a valid admin token"), err)
+}
+
+func TestAuthenticatingAdminServerValidToken(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	base := mock.NewMockAdminServer(ctrl)
+	adminServer := builder.NewAuthenticatingAdminServer(base, "secret")
+
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer secret"))
+	request := &admin.DrainWorkerRequest{WorkerId: "10.0.0.1:12345"}
+	base.EXPECT().DrainWorker(ctx, request).Return(&admin.DrainWorkerResponse{}, nil)
+	response, err := adminServer.DrainWorker(ctx, request)
+	require.NoError(t, err)
+	require.Equal(t, &admin.DrainWorkerResponse{}, response)
+}
@@ -0,0 +1,26 @@
+package builder
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// getBrowserURL returns the URL of the page in bbb_browser that
+// displays an object of a given type (e.g., "action"), so that it may
+// be attached to an ExecuteResponse.
+func getBrowserURL(browserURL *url.URL, objectType string, digest *util.Digest) string {
+	u, err := browserURL.Parse(
+		fmt.Sprintf(
+			"/%s/%s/%s/%d/",
+			objectType,
+			digest.GetInstance(),
+			digest.GetHashString(),
+			digest.GetSizeBytes()))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return u.String()
+}
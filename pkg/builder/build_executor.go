@@ -8,6 +8,10 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// tracerName is the name of the OpenTelemetry tracer that is used to
+// create spans for build actions in this package.
+const tracerName = "github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+
 func convertErrorToExecuteResponse(err error) *remoteexecution.ExecuteResponse {
 	return &remoteexecution.ExecuteResponse{Status: status.Convert(err).Proto()}
 }
@@ -2,8 +2,6 @@ package builder
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"net/url"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
@@ -17,21 +15,24 @@ type cachingBuildExecutor struct {
 	base                      BuildExecutor
 	contentAddressableStorage cas.ContentAddressableStorage
 	actionCache               ac.ActionCache
+	uncachedActionResultStore ac.UncachedActionResultStore
 	browserURL                *url.URL
 }
 
 // NewCachingBuildExecutor creates an adapter for BuildExecutor that
 // stores action results in the Action Cache (AC) if they may be cached.
-// If they may not be cached, they are stored in the Content Addressable
-// Storage (CAS) instead.
+// If they may not be cached, they are stored in the provided
+// UncachedActionResultStore instead. If no such store is provided, they
+// are stored in the Content Addressable Storage (CAS).
 //
-// In both cases, a link to bbb_browser is added to the ExecuteResponse,
+// In all cases, a link to bbb_browser is added to the ExecuteResponse,
 // so that the user may inspect the Action and ActionResult in detail.
-func NewCachingBuildExecutor(base BuildExecutor, contentAddressableStorage cas.ContentAddressableStorage, actionCache ac.ActionCache, browserURL *url.URL) BuildExecutor {
+func NewCachingBuildExecutor(base BuildExecutor, contentAddressableStorage cas.ContentAddressableStorage, actionCache ac.ActionCache, uncachedActionResultStore ac.UncachedActionResultStore, browserURL *url.URL) BuildExecutor {
 	return &cachingBuildExecutor{
 		base:                      base,
 		contentAddressableStorage: contentAddressableStorage,
 		actionCache:               actionCache,
+		uncachedActionResultStore: uncachedActionResultStore,
 		browserURL:                browserURL,
 	}
 }
@@ -44,32 +45,29 @@ func (be *cachingBuildExecutor) Execute(ctx context.Context, request *remoteexec
 	response, mayBeCached := be.base.Execute(ctx, request)
 	if response.Result == nil {
 		// Action ran, but did not yield any results.
-		actionURL, err := be.browserURL.Parse(
-			fmt.Sprintf(
-				"/action/%s/%s/%d/",
-				actionDigest.GetInstance(),
-				actionDigest.GetHashString(),
-				actionDigest.GetSizeBytes()))
-		if err != nil {
-			log.Fatal(err)
-		}
-		response.Message = "Action details (no result): " + actionURL.String()
+		response.Message = "Action details (no result): " + getBrowserURL(be.browserURL, "action", actionDigest)
 	} else if mayBeCached {
 		// Store result in the Action Cache.
 		if err := be.actionCache.PutActionResult(ctx, actionDigest, response.Result); err != nil {
 			return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store cached action result")), false
 		}
 
-		actionURL, err := be.browserURL.Parse(
-			fmt.Sprintf(
-				"/action/%s/%s/%d/",
-				actionDigest.GetInstance(),
-				actionDigest.GetHashString(),
-				actionDigest.GetSizeBytes()))
+		response.Message = "Action details (cached result): " + getBrowserURL(be.browserURL, "action", actionDigest)
+	} else if be.uncachedActionResultStore != nil {
+		// Store the result in a separate store, so the user
+		// can at least inspect it through bbb_browser.
+		uncachedActionResultDigest, err := be.uncachedActionResultStore.PutUncachedActionResult(
+			ctx,
+			&failure.UncachedActionResult{
+				ActionDigest: request.ActionDigest,
+				ActionResult: response.Result,
+			},
+			actionDigest)
 		if err != nil {
-			log.Fatal(err)
+			return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store uncached action result")), false
 		}
-		response.Message = "Action details (cached result): " + actionURL.String()
+
+		response.Message = "Action details (uncached result): " + getBrowserURL(be.browserURL, "uncachedactionresult", uncachedActionResultDigest)
 	} else {
 		// Extension: store the result in the Content
 		// Addressable Storage, so the user can at least inspect
@@ -85,16 +83,7 @@ func (be *cachingBuildExecutor) Execute(ctx context.Context, request *remoteexec
 			return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store uncached action result")), false
 		}
 
-		actionFailureURL, err := be.browserURL.Parse(
-			fmt.Sprintf(
-				"/actionfailure/%s/%s/%d/",
-				actionFailureDigest.GetInstance(),
-				actionFailureDigest.GetHashString(),
-				actionFailureDigest.GetSizeBytes()))
-		if err != nil {
-			log.Fatal(err)
-		}
-		response.Message = "Action details (uncached result): " + actionFailureURL.String()
+		response.Message = "Action details (uncached result): " + getBrowserURL(be.browserURL, "actionfailure", actionFailureDigest)
 	}
 	return response, mayBeCached
 }
@@ -23,7 +23,7 @@ func TestCachingBuildExecutorBadActionDigest(t *testing.T) {
 	baseBuildExecutor := mock.NewMockBuildExecutor(ctrl)
 	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
 	actionCache := mock.NewMockActionCache(ctrl)
-	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, nil, &url.URL{
 		Scheme: "https",
 		Host:   "example.com",
 	})
@@ -50,7 +50,7 @@ func TestCachingBuildExecutorNoResult(t *testing.T) {
 	}, false)
 	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
 	actionCache := mock.NewMockActionCache(ctrl)
-	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, nil, &url.URL{
 		Scheme: "https",
 		Host:   "example.com",
 	})
@@ -95,7 +95,7 @@ func TestCachingBuildExecutorCachedSuccess(t *testing.T) {
 		&remoteexecution.ActionResult{
 			StdoutRaw: []byte("Hello, world!"),
 		}).Return(nil)
-	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, nil, &url.URL{
 		Scheme: "https",
 		Host:   "example.com",
 	})
@@ -142,7 +142,7 @@ func TestCachingBuildExecutorCachedFailure(t *testing.T) {
 		&remoteexecution.ActionResult{
 			StdoutRaw: []byte("Hello, world!"),
 		}).Return(status.Error(codes.Internal, "Network problems"))
-	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, nil, &url.URL{
 		Scheme: "https",
 		Host:   "example.com",
 	})
@@ -194,7 +194,7 @@ func TestCachingBuildExecutorUncachedSuccess(t *testing.T) {
 		SizeBytes: 582,
 	}), nil)
 	actionCache := mock.NewMockActionCache(ctrl)
-	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, nil, &url.URL{
 		Scheme: "https",
 		Host:   "example.com",
 	})
@@ -247,7 +247,7 @@ func TestCachingBuildExecutorUncachedFailure(t *testing.T) {
 		},
 		gomock.Any()).Return(nil, status.Error(codes.Internal, "Network problems"))
 	actionCache := mock.NewMockActionCache(ctrl)
-	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, nil, &url.URL{
 		Scheme: "https",
 		Host:   "example.com",
 	})
@@ -264,3 +264,62 @@ func TestCachingBuildExecutorUncachedFailure(t *testing.T) {
 	}, executeResponse)
 	require.False(t, mayBeCached)
 }
+
+func TestCachingBuildExecutorUncachedActionResultStore(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseBuildExecutor := mock.NewMockBuildExecutor(ctrl)
+	baseBuildExecutor.EXPECT().Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd12",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}).Return(&remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			ExitCode:  1,
+			StderrRaw: []byte("Compilation failed"),
+		},
+	}, false)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	actionCache := mock.NewMockActionCache(ctrl)
+	uncachedActionResultStore := mock.NewMockUncachedActionResultStore(ctrl)
+	uncachedActionResultStore.EXPECT().PutUncachedActionResult(
+		ctx,
+		&failure.UncachedActionResult{
+			ActionDigest: &remoteexecution.Digest{
+				Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+				SizeBytes: 11,
+			},
+			ActionResult: &remoteexecution.ActionResult{
+				ExitCode:  1,
+				StderrRaw: []byte("Compilation failed"),
+			},
+		},
+		gomock.Any()).Return(util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+		Hash:      "1204703084039248092148032948092148032948039248091284093281048023",
+		SizeBytes: 88,
+	}), nil)
+	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, uncachedActionResultStore, &url.URL{
+		Scheme: "https",
+		Host:   "example.com",
+	})
+
+	// Results of failed actions should be stored in the separate
+	// store instead of the Content Addressable Storage.
+	executeResponse, mayBeCached := cachingBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd12",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			ExitCode:  1,
+			StderrRaw: []byte("Compilation failed"),
+		},
+		Message: "Action details (uncached result): https://example.com/uncachedactionresult/freebsd12/1204703084039248092148032948092148032948039248091284093281048023/88/",
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
@@ -0,0 +1,36 @@
+package builder
+
+import (
+	"context"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+type concurrencyLimitingBuildExecutor struct {
+	base  BuildExecutor
+	slots chan struct{}
+}
+
+// NewConcurrencyLimitingBuildExecutor is an adapter for BuildExecutor
+// that limits the number of operations that may run concurrently. The
+// capacity of the provided channel determines the maximum concurrency.
+// By sharing the channel between multiple instances, a single pool of
+// slots can be allocated dynamically across multiple build queues.
+func NewConcurrencyLimitingBuildExecutor(base BuildExecutor, slots chan struct{}) BuildExecutor {
+	return &concurrencyLimitingBuildExecutor{
+		base:  base,
+		slots: slots,
+	}
+}
+
+func (be *concurrencyLimitingBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
+	select {
+	case be.slots <- struct{}{}:
+	case <-ctx.Done():
+		return convertErrorToExecuteResponse(ctx.Err()), false
+	}
+	defer func() {
+		<-be.slots
+	}()
+	return be.base.Execute(ctx, request)
+}
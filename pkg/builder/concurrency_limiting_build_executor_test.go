@@ -0,0 +1,84 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConcurrencyLimitingBuildExecutor(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Two build executors sharing a single slot, as is the case
+	// for a worker that serves multiple platforms.
+	slots := make(chan struct{}, 1)
+	baseBuildExecutor1 := mock.NewMockBuildExecutor(ctrl)
+	buildExecutor1 := builder.NewConcurrencyLimitingBuildExecutor(baseBuildExecutor1, slots)
+	baseBuildExecutor2 := mock.NewMockBuildExecutor(ctrl)
+	buildExecutor2 := builder.NewConcurrencyLimitingBuildExecutor(baseBuildExecutor2, slots)
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}
+	response := &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{ExitCode: 0},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		baseBuildExecutor1.EXPECT().Execute(ctx, request).Return(response, true)
+		executeResponse, mayBeCached := buildExecutor1.Execute(ctx, request)
+		require.Equal(t, response, executeResponse)
+		require.True(t, mayBeCached)
+		require.Empty(t, slots)
+	})
+
+	t.Run("SharedSlots", func(t *testing.T) {
+		// Let the first build executor occupy the slot.
+		started := make(chan struct{})
+		release := make(chan struct{})
+		baseBuildExecutor1.EXPECT().Execute(ctx, request).DoAndReturn(
+			func(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
+				close(started)
+				<-release
+				return response, true
+			})
+		done := make(chan struct{})
+		go func() {
+			executeResponse, _ := buildExecutor1.Execute(ctx, request)
+			require.Equal(t, response, executeResponse)
+			close(done)
+		}()
+		<-started
+
+		// The second build executor should block until its
+		// context is cancelled, without calling into its
+		// backend.
+		ctxWithCancel, cancel := context.WithCancel(ctx)
+		cancel()
+		executeResponse, mayBeCached := buildExecutor2.Execute(ctxWithCancel, request)
+		require.Equal(t, status.New(codes.Unknown, "context canceled").Proto(), executeResponse.Status)
+		require.False(t, mayBeCached)
+
+		// Once the slot is released, the second build executor
+		// should be able to run.
+		close(release)
+		<-done
+		baseBuildExecutor2.EXPECT().Execute(ctx, request).Return(response, true)
+		executeResponse, mayBeCached = buildExecutor2.Execute(ctx, request)
+		require.Equal(t, response, executeResponse)
+		require.True(t, mayBeCached)
+		require.Empty(t, slots)
+	})
+}
@@ -0,0 +1,233 @@
+package builder
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	determinismCheckingBuildQueueChecksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "determinism_checking_build_queue_checks_total",
+			Help:      "Total number of cache hits for which it was checked whether re-executing the action yields the same outputs.",
+		},
+		[]string{"instance_name", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(determinismCheckingBuildQueueChecksTotal)
+}
+
+type determinismCheckingBuildQueue struct {
+	BuildQueue
+	probability float64
+	rebuilds    chan struct{}
+}
+
+// NewDeterminismCheckingBuildQueue creates an adapter for BuildQueue
+// that validates the hermeticity of builds. For a fraction of the
+// execution requests that are answered with a cached action result,
+// the action is executed once more in the background, bypassing the
+// Action Cache. The outputs of the execution are compared against
+// those of the cached action result. Actions that yield different
+// outputs are logged and counted.
+//
+// Executions performed by this adapter cause the Action Cache entry to
+// be overwritten by the workers. This adapter should therefore only be
+// placed in front of a BuildQueue that serves cached action results,
+// such as the one returned by NewValidatingBuildQueue().
+func NewDeterminismCheckingBuildQueue(base BuildQueue, probability float64, concurrentRebuildsMax int) BuildQueue {
+	return &determinismCheckingBuildQueue{
+		BuildQueue:  base,
+		probability: probability,
+		rebuilds:    make(chan struct{}, concurrentRebuildsMax),
+	}
+}
+
+func (bq *determinismCheckingBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
+	observer := &cacheHitObservingExecuteServer{Execution_ExecuteServer: out}
+	if err := bq.BuildQueue.Execute(in, observer); err != nil {
+		return err
+	}
+	if observer.cachedResult != nil && rand.Float64() < bq.probability {
+		select {
+		case bq.rebuilds <- struct{}{}:
+			// Let the rebuild outlive the client's request,
+			// while preserving its metadata.
+			ctx := logging.NewContext(context.Background(), logging.FromContext(out.Context()))
+			if md, ok := metadata.FromIncomingContext(out.Context()); ok {
+				ctx = metadata.NewIncomingContext(ctx, md)
+			}
+			go func() {
+				bq.checkDeterminism(ctx, in, observer.cachedResult)
+				<-bq.rebuilds
+			}()
+		default:
+			determinismCheckingBuildQueueChecksTotal.WithLabelValues(in.InstanceName, "Skipped").Inc()
+		}
+	}
+	return nil
+}
+
+func (bq *determinismCheckingBuildQueue) checkDeterminism(ctx context.Context, in *remoteexecution.ExecuteRequest, cachedResult *remoteexecution.ActionResult) {
+	log := logging.FromContext(ctx)
+	if actionDigest, err := util.NewDigest(in.InstanceName, in.ActionDigest); err == nil {
+		log = logging.WithActionDigest(log, actionDigest)
+	}
+
+	rebuildRequest := *in
+	rebuildRequest.SkipCacheLookup = true
+	rebuild := &rebuildExecuteServer{ctx: ctx}
+	if err := bq.BuildQueue.Execute(&rebuildRequest, rebuild); err != nil {
+		determinismCheckingBuildQueueChecksTotal.WithLabelValues(in.InstanceName, "Failure").Inc()
+		log.WithError(err).Warn("Failed to re-execute cached action")
+		return
+	}
+	response, err := rebuild.getExecuteResponse()
+	if err != nil {
+		determinismCheckingBuildQueueChecksTotal.WithLabelValues(in.InstanceName, "Failure").Inc()
+		log.WithError(err).Warn("Failed to re-execute cached action")
+		return
+	}
+
+	if history.GetOutputFingerprint(response.Result) == history.GetOutputFingerprint(cachedResult) {
+		determinismCheckingBuildQueueChecksTotal.WithLabelValues(in.InstanceName, "Reproducible").Inc()
+		return
+	}
+	determinismCheckingBuildQueueChecksTotal.WithLabelValues(in.InstanceName, "NonReproducible").Inc()
+	log.WithFields(logrus.Fields{
+		"cached_exit_code":  cachedResult.ExitCode,
+		"rebuilt_exit_code": response.Result.ExitCode,
+		"differing_outputs": getDifferingOutputs(cachedResult, response.Result),
+	}).Warn("Re-executing cached action yielded different outputs")
+}
+
+// getOutputDigests returns a map of all output paths of an action
+// result to the digests of their contents. Symbolic links are mapped to
+// their targets.
+func getOutputDigests(actionResult *remoteexecution.ActionResult) map[string]string {
+	outputs := map[string]string{}
+	for _, outputFile := range actionResult.OutputFiles {
+		outputs[outputFile.Path] = outputFile.Digest.GetHash()
+	}
+	for _, outputDirectory := range actionResult.OutputDirectories {
+		outputs[outputDirectory.Path] = outputDirectory.TreeDigest.GetHash()
+	}
+	for _, outputSymlink := range actionResult.OutputFileSymlinks {
+		outputs[outputSymlink.Path] = "-> " + outputSymlink.Target
+	}
+	for _, outputSymlink := range actionResult.OutputDirectorySymlinks {
+		outputs[outputSymlink.Path] = "-> " + outputSymlink.Target
+	}
+	for _, outputSymlink := range actionResult.OutputSymlinks {
+		outputs[outputSymlink.Path] = "-> " + outputSymlink.Target
+	}
+	return outputs
+}
+
+// getDifferingOutputs returns a sorted list of output paths whose
+// contents differ between two action results.
+func getDifferingOutputs(a *remoteexecution.ActionResult, b *remoteexecution.ActionResult) []string {
+	outputsA := getOutputDigests(a)
+	outputsB := getOutputDigests(b)
+	var differing []string
+	for path, digestA := range outputsA {
+		if digestB, ok := outputsB[path]; !ok || digestA != digestB {
+			differing = append(differing, path)
+		}
+	}
+	for path := range outputsB {
+		if _, ok := outputsA[path]; !ok {
+			differing = append(differing, path)
+		}
+	}
+	sort.Strings(differing)
+	return differing
+}
+
+// getExecuteResponse extracts the ExecuteResponse from a completed
+// operation.
+func getExecuteResponse(operation *longrunning.Operation) (*remoteexecution.ExecuteResponse, bool) {
+	if operation == nil || !operation.Done {
+		return nil, false
+	}
+	operationResponse, ok := operation.Result.(*longrunning.Operation_Response)
+	if !ok {
+		return nil, false
+	}
+	var response remoteexecution.ExecuteResponse
+	if err := ptypes.UnmarshalAny(operationResponse.Response, &response); err != nil {
+		return nil, false
+	}
+	return &response, true
+}
+
+// cacheHitObservingExecuteServer is a decorator for
+// Execution_ExecuteServer that captures the action result sent to the
+// client if it was obtained from the Action Cache.
+type cacheHitObservingExecuteServer struct {
+	remoteexecution.Execution_ExecuteServer
+	cachedResult *remoteexecution.ActionResult
+}
+
+func (s *cacheHitObservingExecuteServer) Send(operation *longrunning.Operation) error {
+	if response, ok := getExecuteResponse(operation); ok && response.CachedResult && response.Result != nil {
+		s.cachedResult = response.Result
+	}
+	return s.Execution_ExecuteServer.Send(operation)
+}
+
+// rebuildExecuteServer is an implementation of Execution_ExecuteServer
+// that is used to execute actions without having a client attached. It
+// retains the last operation sent by the BuildQueue.
+type rebuildExecuteServer struct {
+	ctx           context.Context
+	lastOperation *longrunning.Operation
+}
+
+func (s *rebuildExecuteServer) Send(operation *longrunning.Operation) error {
+	s.lastOperation = operation
+	return nil
+}
+
+func (s *rebuildExecuteServer) getExecuteResponse() (*remoteexecution.ExecuteResponse, error) {
+	if s.lastOperation != nil {
+		if operationError, ok := s.lastOperation.Result.(*longrunning.Operation_Error); ok {
+			return nil, status.ErrorProto(operationError.Error)
+		}
+	}
+	response, ok := getExecuteResponse(s.lastOperation)
+	if !ok {
+		return nil, status.Error(codes.Internal, "Execution did not yield a response")
+	}
+	if err := status.ErrorProto(response.Status); err != nil {
+		return nil, err
+	}
+	if response.Result == nil {
+		return nil, status.Error(codes.Internal, "Execution did not yield an action result")
+	}
+	return response, nil
+}
+
+func (s *rebuildExecuteServer) SetHeader(metadata.MD) error  { return nil }
+func (s *rebuildExecuteServer) SendHeader(metadata.MD) error { return nil }
+func (s *rebuildExecuteServer) SetTrailer(metadata.MD)       {}
+func (s *rebuildExecuteServer) Context() context.Context     { return s.ctx }
+func (s *rebuildExecuteServer) SendMsg(m interface{}) error  { return nil }
+func (s *rebuildExecuteServer) RecvMsg(m interface{}) error  { return nil }
@@ -0,0 +1,115 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/longrunning"
+)
+
+func newCompletedOperation(t *testing.T, response *remoteexecution.ExecuteResponse) *longrunning.Operation {
+	responseAny, err := ptypes.MarshalAny(response)
+	require.NoError(t, err)
+	return &longrunning.Operation{
+		Name:   "fd6ee599-ee1e-4a7a-a4f5-5f5fcd5c4d4e",
+		Done:   true,
+		Result: &longrunning.Operation_Response{Response: responseAny},
+	}
+}
+
+func TestDeterminismCheckingBuildQueueCacheMiss(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	baseBuildQueue := mock.NewMockBuildQueue(ctrl)
+	buildQueue := builder.NewDeterminismCheckingBuildQueue(baseBuildQueue, 1.0, 1)
+
+	// Actions that are executed should not be executed once more.
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}
+	operation := newCompletedOperation(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{ExitCode: 1},
+	})
+	out := mock.NewMockExecution_ExecuteServer(ctrl)
+	out.EXPECT().Send(operation)
+	baseBuildQueue.EXPECT().Execute(request, gomock.Any()).DoAndReturn(
+		func(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
+			return out.Send(operation)
+		})
+
+	require.NoError(t, buildQueue.Execute(request, out))
+}
+
+func TestDeterminismCheckingBuildQueueCacheHit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	baseBuildQueue := mock.NewMockBuildQueue(ctrl)
+	buildQueue := builder.NewDeterminismCheckingBuildQueue(baseBuildQueue, 1.0, 1)
+
+	// Actions for which a cached result is returned should be
+	// executed once more in the background, bypassing the cache.
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}
+	cachedOperation := newCompletedOperation(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			OutputFiles: []*remoteexecution.OutputFile{
+				{
+					Path: "hello.o",
+					Digest: &remoteexecution.Digest{
+						Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+						SizeBytes: 0,
+					},
+				},
+			},
+		},
+		CachedResult: true,
+	})
+	out := mock.NewMockExecution_ExecuteServer(ctrl)
+	out.EXPECT().Context().Return(context.Background()).AnyTimes()
+	out.EXPECT().Send(cachedOperation)
+	baseBuildQueue.EXPECT().Execute(request, gomock.Any()).DoAndReturn(
+		func(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
+			return out.Send(cachedOperation)
+		})
+
+	rebuildRequest := proto.Clone(request).(*remoteexecution.ExecuteRequest)
+	rebuildRequest.SkipCacheLookup = true
+	rebuilt := make(chan struct{})
+	baseBuildQueue.EXPECT().Execute(rebuildRequest, gomock.Any()).DoAndReturn(
+		func(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
+			defer close(rebuilt)
+			return out.Send(newCompletedOperation(t, &remoteexecution.ExecuteResponse{
+				Result: &remoteexecution.ActionResult{
+					OutputFiles: []*remoteexecution.OutputFile{
+						{
+							Path: "hello.o",
+							Digest: &remoteexecution.Digest{
+								Hash:      "f11999245771a5c184b62dc5380e0d8b42df67b5d8cd8a9fc2ed57a7e2f1d5e5",
+								SizeBytes: 42,
+							},
+						},
+					},
+				},
+			}))
+		})
+
+	require.NoError(t, buildQueue.Execute(request, out))
+	<-rebuilt
+}
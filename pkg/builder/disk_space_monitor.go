@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	diskSpaceMonitorFreeBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "disk_space_monitor_free_bytes",
+			Help:      "Amount of free space on the file system containing a directory used by the worker, in bytes.",
+		},
+		[]string{"path"})
+	diskSpaceMonitorReclaimedBytesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "disk_space_monitor_reclaimed_bytes_total",
+			Help:      "Total number of bytes evicted from caches, as the worker was running low on disk space.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(diskSpaceMonitorFreeBytes)
+	prometheus.MustRegister(diskSpaceMonitorReclaimedBytesTotal)
+}
+
+// DiskSpaceMonitor keeps track of whether a worker has sufficient disk
+// space available to accept new build actions.
+type DiskSpaceMonitor interface {
+	// GetUnhealthyReason returns a description of why the worker
+	// lacks disk space, or an empty string if sufficient disk space
+	// is available. The channel that is returned is closed when
+	// the result of this function changes.
+	GetUnhealthyReason() (string, <-chan struct{})
+}
+
+type diskSpaceMonitor struct {
+	paths            []string
+	minimumFreeBytes int64
+	getFreeSpace     func(path string) (int64, error)
+	reclaimSpace     func(sizeBytes int64) (int64, error)
+
+	lock            sync.Mutex
+	unhealthyReason string
+	changed         chan struct{}
+}
+
+// NewDiskSpaceMonitor creates a DiskSpaceMonitor that periodically
+// checks the amount of free space on the file systems containing a set
+// of paths (e.g., the build and cache directories). When less than a
+// minimum amount of space is available, space is reclaimed by evicting
+// entries from caches first. The worker is only considered to be
+// unhealthy if this is insufficient. This prevents build actions from
+// failing halfway through their execution due to ENOSPC.
+func NewDiskSpaceMonitor(paths []string, minimumFreeBytes int64, getFreeSpace func(path string) (int64, error), reclaimSpace func(sizeBytes int64) (int64, error), interval time.Duration) DiskSpaceMonitor {
+	dsm := &diskSpaceMonitor{
+		paths:            paths,
+		minimumFreeBytes: minimumFreeBytes,
+		getFreeSpace:     getFreeSpace,
+		reclaimSpace:     reclaimSpace,
+
+		changed: make(chan struct{}),
+	}
+	dsm.check()
+	go func() {
+		for range time.Tick(interval) {
+			dsm.check()
+		}
+	}()
+	return dsm
+}
+
+// getPathUnhealthyReason checks whether sufficient space is available
+// on the file system containing a single path, reclaiming space if
+// needed.
+func (dsm *diskSpaceMonitor) getPathUnhealthyReason(path string) string {
+	freeBytes, err := dsm.getFreeSpace(path)
+	if err != nil {
+		return fmt.Sprintf("Failed to obtain free space of %#v: %s", path, err)
+	}
+	if freeBytes < dsm.minimumFreeBytes {
+		reclaimedBytes, err := dsm.reclaimSpace(dsm.minimumFreeBytes - freeBytes)
+		diskSpaceMonitorReclaimedBytesTotal.Add(float64(reclaimedBytes))
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Warn("Failed to reclaim disk space")
+		}
+		if reclaimedBytes > 0 {
+			if freeBytes, err = dsm.getFreeSpace(path); err != nil {
+				return fmt.Sprintf("Failed to obtain free space of %#v: %s", path, err)
+			}
+		}
+	}
+	diskSpaceMonitorFreeBytes.WithLabelValues(path).Set(float64(freeBytes))
+	if freeBytes < dsm.minimumFreeBytes {
+		return fmt.Sprintf("Less than %d bytes of free space available for %#v", dsm.minimumFreeBytes, path)
+	}
+	return ""
+}
+
+// check computes the health of the worker, notifying callers of
+// GetUnhealthyReason() if it has changed.
+func (dsm *diskSpaceMonitor) check() {
+	unhealthyReason := ""
+	for _, path := range dsm.paths {
+		if unhealthyReason = dsm.getPathUnhealthyReason(path); unhealthyReason != "" {
+			break
+		}
+	}
+
+	dsm.lock.Lock()
+	defer dsm.lock.Unlock()
+	if dsm.unhealthyReason != unhealthyReason {
+		if unhealthyReason == "" {
+			logrus.Info("Sufficient disk space available again")
+		} else {
+			logrus.Warn(unhealthyReason)
+		}
+		dsm.unhealthyReason = unhealthyReason
+		close(dsm.changed)
+		dsm.changed = make(chan struct{})
+	}
+}
+
+func (dsm *diskSpaceMonitor) GetUnhealthyReason() (string, <-chan struct{}) {
+	dsm.lock.Lock()
+	defer dsm.lock.Unlock()
+	return dsm.unhealthyReason, dsm.changed
+}
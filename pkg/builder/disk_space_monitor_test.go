@@ -0,0 +1,51 @@
+package builder_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskSpaceMonitorReclaimSufficient(t *testing.T) {
+	// Evicting files from the cache frees up enough space, meaning
+	// the worker should remain healthy.
+	freeBytes := map[string]int64{
+		"/worker/build": 50,
+		"/worker/cache": 50,
+	}
+	dsm := builder.NewDiskSpaceMonitor(
+		[]string{"/worker/cache", "/worker/build"},
+		100,
+		func(path string) (int64, error) {
+			return freeBytes[path], nil
+		},
+		func(sizeBytes int64) (int64, error) {
+			require.Equal(t, int64(50), sizeBytes)
+			freeBytes["/worker/build"] += 70
+			freeBytes["/worker/cache"] += 70
+			return 70, nil
+		},
+		time.Hour)
+	unhealthyReason, _ := dsm.GetUnhealthyReason()
+	require.Equal(t, "", unhealthyReason)
+}
+
+func TestDiskSpaceMonitorReclaimInsufficient(t *testing.T) {
+	// Evicting files from the cache does not free up enough space,
+	// meaning the worker should report itself as unhealthy.
+	dsm := builder.NewDiskSpaceMonitor(
+		[]string{"/worker/cache", "/worker/build"},
+		100,
+		func(path string) (int64, error) {
+			return 30, nil
+		},
+		func(sizeBytes int64) (int64, error) {
+			require.Equal(t, int64(70), sizeBytes)
+			return 0, nil
+		},
+		time.Hour)
+	unhealthyReason, _ := dsm.GetUnhealthyReason()
+	require.Equal(t, "Less than 100 bytes of free space available for \"/worker/cache\"", unhealthyReason)
+}
@@ -0,0 +1,28 @@
+package builder
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+)
+
+type drainedShardsReportingAdminServer struct {
+	admin.AdminServer
+	drainedShards []*admin.DrainedShard
+}
+
+// NewDrainedShardsReportingAdminServer creates a decorator for the
+// Admin service that reports a fixed list of drained storage shards,
+// typically obtained from the storage configuration of the scheduler.
+func NewDrainedShardsReportingAdminServer(base admin.AdminServer, drainedShards []*admin.DrainedShard) admin.AdminServer {
+	return &drainedShardsReportingAdminServer{
+		AdminServer:   base,
+		drainedShards: drainedShards,
+	}
+}
+
+func (s *drainedShardsReportingAdminServer) ListDrainedShards(ctx context.Context, in *admin.ListDrainedShardsRequest) (*admin.ListDrainedShardsResponse, error) {
+	return &admin.ListDrainedShardsResponse{
+		DrainedShards: s.drainedShards,
+	}, nil
+}
@@ -0,0 +1,34 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainedShardsReportingAdminServer(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	base := mock.NewMockAdminServer(ctrl)
+	drainedShards := []*admin.DrainedShard{
+		{StorageType: "cas", Path: []uint32{3}, Weight: 1},
+	}
+	adminServer := builder.NewDrainedShardsReportingAdminServer(base, drainedShards)
+
+	// Drained shards should be reported by the decorator itself.
+	response, err := adminServer.ListDrainedShards(ctx, &admin.ListDrainedShardsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, &admin.ListDrainedShardsResponse{DrainedShards: drainedShards}, response)
+
+	// Other requests should be forwarded.
+	request := &admin.FlushWorkerCacheRequest{WorkerId: "worker-0123abcd"}
+	base.EXPECT().FlushWorkerCache(ctx, request).Return(&admin.FlushWorkerCacheResponse{}, nil)
+	_, err = adminServer.FlushWorkerCache(ctx, request)
+	require.NoError(t, err)
+}
@@ -0,0 +1,93 @@
+package builder
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	executionHistoryFlakyActionsDetectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "execution_history_flaky_actions_detected_total",
+			Help:      "Total number of actions detected to fail intermittently or to yield non-deterministic outputs.",
+		},
+		[]string{"instance_name", "kind"})
+)
+
+func init() {
+	prometheus.MustRegister(executionHistoryFlakyActionsDetectedTotal)
+}
+
+type executionHistoryRecordingActionIndex struct {
+	base  ActionIndexRecorder
+	store history.ExecutionHistoryStore
+}
+
+// NewExecutionHistoryRecordingActionIndexRecorder is an adapter for
+// ActionIndexRecorder that also appends the outcomes of executed
+// actions to their execution history. Actions for which the history
+// indicates intermittent failures or non-deterministic outputs are
+// logged and counted, so that they can be investigated.
+func NewExecutionHistoryRecordingActionIndexRecorder(base ActionIndexRecorder, store history.ExecutionHistoryStore) ActionIndexRecorder {
+	return &executionHistoryRecordingActionIndex{
+		base:  base,
+		store: store,
+	}
+}
+
+func (ai *executionHistoryRecordingActionIndex) Record(entry *actionindex.Entry) {
+	ai.base.Record(entry)
+	if entry.CachedResult || entry.DispatchedTimestamp == nil {
+		return
+	}
+
+	// Entries are recorded while the scheduler holds its lock, so
+	// perform storage access asynchronously.
+	go func() {
+		actionDigest, err := util.NewDigest(entry.InstanceName, entry.ActionDigest)
+		if err != nil {
+			return
+		}
+		logger := logging.WithActionDigest(logging.FromContext(context.Background()), actionDigest)
+		outcome := &pb.ExecutionOutcome{
+			CompletedTimestamp: entry.CompletedTimestamp,
+			ExitCode:           entry.ExitCode,
+			Status:             entry.Status,
+			WorkerId:           entry.WorkerId,
+			OutputFingerprint:  entry.OutputFingerprint,
+		}
+		if dispatched, err := ptypes.Timestamp(entry.DispatchedTimestamp); err == nil {
+			if completed, err := ptypes.Timestamp(entry.CompletedTimestamp); err == nil {
+				outcome.ExecutionDuration = ptypes.DurationProto(completed.Sub(dispatched))
+			}
+		}
+
+		newHistory, err := ai.store.AppendExecutionOutcome(context.Background(), actionDigest, outcome)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to record execution outcome")
+			return
+		}
+
+		// Only report actions the moment they are detected to
+		// be flaky, as opposed to every time they complete.
+		oldHistory := &pb.ExecutionHistory{Outcomes: newHistory.Outcomes[:len(newHistory.Outcomes)-1]}
+		oldAnalysis, newAnalysis := history.Analyze(oldHistory), history.Analyze(newHistory)
+		if newAnalysis.IntermittentFailures && !oldAnalysis.IntermittentFailures {
+			executionHistoryFlakyActionsDetectedTotal.WithLabelValues(entry.InstanceName, "IntermittentFailures").Inc()
+			logger.Warn("Action fails intermittently")
+		}
+		if newAnalysis.NonDeterministicOutputs && !oldAnalysis.NonDeterministicOutputs {
+			executionHistoryFlakyActionsDetectedTotal.WithLabelValues(entry.InstanceName, "NonDeterministicOutputs").Inc()
+			logger.Warn("Action yields non-deterministic outputs")
+		}
+	}()
+}
@@ -0,0 +1,30 @@
+package builder
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+)
+
+// ExecutionStageReporter is a callback that is invoked by
+// BuildExecutors when execution of a build action transitions to a
+// different stage. Workers use this to forward progress to the
+// scheduler, so that clients can be informed.
+type ExecutionStageReporter func(stage scheduler.ExecutionStage)
+
+type executionStageReporterKey struct{}
+
+// NewContextWithExecutionStageReporter returns a context that carries
+// an ExecutionStageReporter. BuildExecutors that are called with this
+// context report the stages of execution through it.
+func NewContextWithExecutionStageReporter(ctx context.Context, reporter ExecutionStageReporter) context.Context {
+	return context.WithValue(ctx, executionStageReporterKey{}, reporter)
+}
+
+// reportExecutionStage invokes the ExecutionStageReporter attached to
+// a context, if any.
+func reportExecutionStage(ctx context.Context, stage scheduler.ExecutionStage) {
+	if reporter, ok := ctx.Value(executionStageReporterKey{}).(ExecutionStageReporter); ok {
+		reporter(stage)
+	}
+}
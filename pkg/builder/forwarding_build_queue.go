@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 
 	"google.golang.org/grpc"
@@ -47,7 +48,7 @@ func forwardOperations(client remoteexecution.Execution_ExecuteClient, server re
 }
 
 func (bq *forwardingBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
-	client, err := bq.executionClient.Execute(out.Context(), in)
+	client, err := bq.executionClient.Execute(util.ForwardRequestMetadata(out.Context()), in)
 	if err != nil {
 		return err
 	}
@@ -55,7 +56,7 @@ func (bq *forwardingBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out
 }
 
 func (bq *forwardingBuildQueue) WaitExecution(in *remoteexecution.WaitExecutionRequest, out remoteexecution.Execution_WaitExecutionServer) error {
-	client, err := bq.executionClient.WaitExecution(out.Context(), in)
+	client, err := bq.executionClient.WaitExecution(util.ForwardRequestMetadata(out.Context()), in)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,124 @@
+package builder
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ActionIndexRecorder is the interface for storing information on
+// completed executions of actions into an index, so that they may be
+// searched for later on.
+type ActionIndexRecorder interface {
+	Record(entry *actionindex.Entry)
+}
+
+type inMemoryActionIndex struct {
+	lock       sync.Mutex
+	entries    []*actionindex.Entry
+	nextEntry  int
+	maxResults uint32
+}
+
+// NewInMemoryActionIndex creates an action index that retains a fixed
+// number of entries in memory, discarding the oldest entries first. It
+// returns both a recorder for storing entries and a GRPC service for
+// searching through them.
+func NewInMemoryActionIndex(maxEntries int, maxResults uint32) (ActionIndexRecorder, actionindex.ActionIndexServer) {
+	ai := &inMemoryActionIndex{
+		entries:    make([]*actionindex.Entry, maxEntries),
+		maxResults: maxResults,
+	}
+	return ai, ai
+}
+
+func (ai *inMemoryActionIndex) Record(entry *actionindex.Entry) {
+	if len(ai.entries) == 0 {
+		return
+	}
+
+	ai.lock.Lock()
+	defer ai.lock.Unlock()
+
+	ai.entries[ai.nextEntry] = entry
+	ai.nextEntry = (ai.nextEntry + 1) % len(ai.entries)
+}
+
+func convertOptionalTimestamp(ts *timestamp.Timestamp) (*time.Time, error) {
+	if ts == nil {
+		return nil, nil
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (ai *inMemoryActionIndex) Search(ctx context.Context, in *actionindex.SearchRequest) (*actionindex.SearchResponse, error) {
+	completedAfter, err := convertOptionalTimestamp(in.CompletedAfter)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid lower bound on completion time: %s", err)
+	}
+	completedBefore, err := convertOptionalTimestamp(in.CompletedBefore)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid upper bound on completion time: %s", err)
+	}
+	maxResults := in.MaxResults
+	if maxResults == 0 || maxResults > ai.maxResults {
+		maxResults = ai.maxResults
+	}
+
+	ai.lock.Lock()
+	defer ai.lock.Unlock()
+
+	// Traverse the ring buffer backwards, so that the most recently
+	// completed entries are returned first.
+	var entries []*actionindex.Entry
+	for i := 0; i < len(ai.entries) && uint32(len(entries)) < maxResults; i++ {
+		entry := ai.entries[(ai.nextEntry+len(ai.entries)-1-i)%len(ai.entries)]
+		if entry == nil {
+			break
+		}
+
+		metadata := entry.RequestMetadata
+		if metadata == nil {
+			metadata = &remoteexecution.RequestMetadata{}
+		}
+		if (in.InstanceName != "" && in.InstanceName != entry.InstanceName) ||
+			(in.ToolInvocationId != "" && in.ToolInvocationId != metadata.ToolInvocationId) ||
+			(in.CorrelatedInvocationsId != "" && in.CorrelatedInvocationsId != metadata.CorrelatedInvocationsId) ||
+			(in.ActionId != "" && in.ActionId != metadata.ActionId) ||
+			(in.ActionDigestHash != "" && (entry.ActionDigest == nil || in.ActionDigestHash != entry.ActionDigest.Hash)) ||
+			(in.TestTarget != "" && in.TestTarget != entry.TestTarget) {
+			continue
+		}
+
+		succeeded := entry.ExitCode == 0 && (entry.Status == nil || codes.Code(entry.Status.Code) == codes.OK)
+		if (in.Outcome == actionindex.SearchRequest_SUCCEEDED && !succeeded) ||
+			(in.Outcome == actionindex.SearchRequest_FAILED && succeeded) {
+			continue
+		}
+
+		if completedAfter != nil || completedBefore != nil {
+			completed, err := ptypes.Timestamp(entry.CompletedTimestamp)
+			if err != nil ||
+				(completedAfter != nil && completed.Before(*completedAfter)) ||
+				(completedBefore != nil && !completed.Before(*completedBefore)) {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return &actionindex.SearchResponse{
+		Entries: entries,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+func TestInMemoryActionIndexSearch(t *testing.T) {
+	ctx := context.Background()
+
+	recorder, actionIndexServer := builder.NewInMemoryActionIndex(3, 10)
+	entry1 := &actionindex.Entry{
+		OperationName: "operation1",
+		RequestMetadata: &remoteexecution.RequestMetadata{
+			ToolInvocationId: "invocation1",
+		},
+		CompletedTimestamp: &timestamp.Timestamp{Seconds: 1000},
+	}
+	entry2 := &actionindex.Entry{
+		InstanceName:  "ubuntu16-04",
+		OperationName: "operation2",
+		RequestMetadata: &remoteexecution.RequestMetadata{
+			ToolInvocationId: "invocation2",
+		},
+		ExitCode:           1,
+		CompletedTimestamp: &timestamp.Timestamp{Seconds: 1001},
+	}
+	entry3 := &actionindex.Entry{
+		OperationName: "operation3",
+		RequestMetadata: &remoteexecution.RequestMetadata{
+			ToolInvocationId: "invocation1",
+		},
+		Status: &status.Status{
+			Code:    int32(codes.DeadlineExceeded),
+			Message: "Action timed out",
+		},
+		CompletedTimestamp: &timestamp.Timestamp{Seconds: 1002},
+	}
+	entry4 := &actionindex.Entry{
+		InstanceName:  "debian8",
+		OperationName: "operation4",
+		RequestMetadata: &remoteexecution.RequestMetadata{
+			ToolInvocationId: "invocation2",
+		},
+		CompletedTimestamp: &timestamp.Timestamp{Seconds: 1003},
+	}
+
+	// Entries should be returned most recent first.
+	recorder.Record(entry1)
+	recorder.Record(entry2)
+	response, err := actionIndexServer.Search(ctx, &actionindex.SearchRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []*actionindex.Entry{entry2, entry1}, response.Entries)
+
+	// The oldest entry should be discarded once full.
+	recorder.Record(entry3)
+	recorder.Record(entry4)
+	response, err = actionIndexServer.Search(ctx, &actionindex.SearchRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []*actionindex.Entry{entry4, entry3, entry2}, response.Entries)
+
+	// Filtering on invocation ID.
+	response, err = actionIndexServer.Search(ctx, &actionindex.SearchRequest{
+		ToolInvocationId: "invocation2",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*actionindex.Entry{entry4, entry2}, response.Entries)
+
+	// Filtering on instance name, as indices of frontends may
+	// contain entries for any instance.
+	response, err = actionIndexServer.Search(ctx, &actionindex.SearchRequest{
+		InstanceName: "debian8",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*actionindex.Entry{entry4}, response.Entries)
+
+	// Filtering on outcome. Both non-zero exit codes and errors
+	// should be considered failures.
+	response, err = actionIndexServer.Search(ctx, &actionindex.SearchRequest{
+		Outcome: actionindex.SearchRequest_FAILED,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*actionindex.Entry{entry3, entry2}, response.Entries)
+
+	// Filtering on completion time.
+	response, err = actionIndexServer.Search(ctx, &actionindex.SearchRequest{
+		CompletedAfter:  &timestamp.Timestamp{Seconds: 1002},
+		CompletedBefore: &timestamp.Timestamp{Seconds: 1003},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*actionindex.Entry{entry3}, response.Entries)
+
+	// Limiting the number of results.
+	response, err = actionIndexServer.Search(ctx, &actionindex.SearchRequest{
+		MaxResults: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*actionindex.Entry{entry4}, response.Entries)
+}
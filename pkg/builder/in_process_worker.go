@@ -0,0 +1,107 @@
+package builder
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// inProcessGetWorkServer is the server side of a GetWork() stream
+// between a scheduler and a worker running in the same process.
+// Messages are exchanged through channels, as opposed to being
+// marshaled and sent over the network.
+type inProcessGetWorkServer struct {
+	// Methods for sending headers and trailers are not used by
+	// the scheduler. Calling them causes a panic.
+	grpc.ServerStream
+
+	ctx        context.Context
+	toWorker   chan<- *scheduler.WorkRequest
+	fromWorker <-chan *scheduler.WorkerUpdate
+}
+
+func (s *inProcessGetWorkServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *inProcessGetWorkServer) Send(request *scheduler.WorkRequest) error {
+	select {
+	case s.toWorker <- request:
+		return nil
+	case <-s.ctx.Done():
+		return util.StatusFromContext(s.ctx)
+	}
+}
+
+func (s *inProcessGetWorkServer) Recv() (*scheduler.WorkerUpdate, error) {
+	select {
+	case update := <-s.fromWorker:
+		return update, nil
+	case <-s.ctx.Done():
+		return nil, util.StatusFromContext(s.ctx)
+	}
+}
+
+// RunInProcessWorker executes build actions dispatched by a scheduler
+// running in the same process, one at a time. This allows small
+// deployments (e.g., on developer machines or in CI smoke tests) to
+// run a scheduler and a worker as part of a single binary.
+//
+// This function blocks until the context is cancelled or the stream
+// with the scheduler fails, returning the error that caused it.
+func RunInProcessWorker(ctx context.Context, schedulerServer scheduler.SchedulerServer, identity *scheduler.WorkerIdentity, buildExecutor BuildExecutor) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Provide the identity of the worker to the scheduler the same
+	// way remote workers do, through gRPC metadata.
+	md, _ := metadata.FromOutgoingContext(NewContextWithWorkerIdentity(context.Background(), identity))
+	toWorker := make(chan *scheduler.WorkRequest)
+	fromWorker := make(chan *scheduler.WorkerUpdate)
+	schedulerErr := make(chan error, 1)
+	go func() {
+		schedulerErr <- schedulerServer.GetWork(&inProcessGetWorkServer{
+			ctx:        metadata.NewIncomingContext(ctx, md),
+			toWorker:   toWorker,
+			fromWorker: fromWorker,
+		})
+	}()
+
+	send := func(update *scheduler.WorkerUpdate) {
+		select {
+		case fromWorker <- update:
+		case <-ctx.Done():
+		}
+	}
+	for {
+		var request *scheduler.WorkRequest
+		select {
+		case request = <-toWorker:
+		case err := <-schedulerErr:
+			return err
+		case <-ctx.Done():
+			// Wait for the scheduler to observe the
+			// cancellation, so that build actions still
+			// assigned to this worker are rescheduled.
+			<-schedulerErr
+			return util.StatusFromContext(ctx)
+		}
+
+		executeCtx := NewContextWithWorkerName(ctx, request.Worker.GetId())
+		executeCtx = NewContextWithExecutionStageReporter(executeCtx, func(stage scheduler.ExecutionStage) {
+			send(&scheduler.WorkerUpdate{
+				OperationName: request.OperationName,
+				Update:        &scheduler.WorkerUpdate_Stage{Stage: stage},
+			})
+		})
+		response, _ := buildExecutor.Execute(executeCtx, GetExecuteRequest(request))
+		send(&scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update:        &scheduler.WorkerUpdate_ExecuteResponse{ExecuteResponse: response},
+		})
+	}
+}
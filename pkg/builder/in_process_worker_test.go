@@ -0,0 +1,74 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInProcessWorker(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, _ := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, nil, nil, 0, nil, nil, nil, nil)
+
+	// Build actions should be passed on to the BuildExecutor of
+	// the in-process worker, having the worker identity attached.
+	executeRequest := &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}
+	executeResponse := &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{ExitCode: 1},
+	}
+	buildExecutor := mock.NewMockBuildExecutor(ctrl)
+	buildExecutor.EXPECT().Execute(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
+			require.True(t, proto.Equal(executeRequest, request))
+			return executeResponse, false
+		})
+	workerCtx, cancelWorker := context.WithCancel(ctx)
+	workerErrors := make(chan error, 1)
+	go func() {
+		workerErrors <- builder.RunInProcessWorker(
+			workerCtx,
+			schedulerServer,
+			&scheduler.WorkerIdentity{Id: "embedded-0123abcd"},
+			buildExecutor)
+	}()
+
+	// The client should receive the response of the worker.
+	var lastOperation *longrunning.Operation
+	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+	executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+	executeServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(operation *longrunning.Operation) error {
+		lastOperation = operation
+		return nil
+	}).MinTimes(1)
+	require.NoError(t, buildQueue.Execute(executeRequest, executeServer))
+	require.True(t, lastOperation.Done)
+	var response remoteexecution.ExecuteResponse
+	require.NoError(t, ptypes.UnmarshalAny(lastOperation.GetResponse(), &response))
+	require.Equal(t, int32(1), response.Result.GetExitCode())
+
+	// Cancelling the context should cause the worker to
+	// disconnect from the scheduler.
+	cancelWorker()
+	require.Equal(t, codes.Canceled, status.Code(<-workerErrors))
+}
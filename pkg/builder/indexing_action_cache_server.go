@@ -0,0 +1,42 @@
+package builder
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+)
+
+type indexingActionCacheServer struct {
+	remoteexecution.ActionCacheServer
+	actionIndex ActionIndexRecorder
+}
+
+// NewIndexingActionCacheServer creates a decorator for the Action Cache
+// service that stores an entry in an action index for every action
+// result that is returned. This allows cache hits to be accounted for
+// when inspecting the actions of a single build.
+func NewIndexingActionCacheServer(base remoteexecution.ActionCacheServer, actionIndex ActionIndexRecorder) remoteexecution.ActionCacheServer {
+	return &indexingActionCacheServer{
+		ActionCacheServer: base,
+		actionIndex:       actionIndex,
+	}
+}
+
+func (s *indexingActionCacheServer) GetActionResult(ctx context.Context, in *remoteexecution.GetActionResultRequest) (*remoteexecution.ActionResult, error) {
+	actionResult, err := s.ActionCacheServer.GetActionResult(ctx, in)
+	if err == nil {
+		s.actionIndex.Record(&actionindex.Entry{
+			InstanceName:       in.InstanceName,
+			ActionDigest:       in.ActionDigest,
+			RequestMetadata:    util.GetRequestMetadata(ctx),
+			ExitCode:           actionResult.ExitCode,
+			CompletedTimestamp: ptypes.TimestampNow(),
+			CachedResult:       true,
+			TestTarget:         GetTestResultSummary(actionResult).GetTestTarget(),
+		})
+	}
+	return actionResult, err
+}
@@ -0,0 +1,73 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestIndexingActionCacheServer(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	requestMetadata, err := proto.Marshal(&remoteexecution.RequestMetadata{
+		ToolInvocationId: "invocation1",
+	})
+	require.NoError(t, err)
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("build.bazel.remote.execution.v2.requestmetadata-bin", string(requestMetadata)))
+
+	baseActionCacheServer := mock.NewMockActionCacheServer(ctrl)
+	recorder, actionIndexServer := builder.NewInMemoryActionIndex(10, 10)
+	actionCacheServer := builder.NewIndexingActionCacheServer(baseActionCacheServer, recorder)
+	request := &remoteexecution.GetActionResultRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		},
+	}
+
+	t.Run("Miss", func(t *testing.T) {
+		// Cache misses should not be recorded, as the action
+		// will be recorded by the scheduler once executed.
+		baseActionCacheServer.EXPECT().GetActionResult(ctx, request).Return(nil, status.Error(codes.NotFound, "Blob not found"))
+		_, err := actionCacheServer.GetActionResult(ctx, request)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+
+		response, err := actionIndexServer.Search(ctx, &actionindex.SearchRequest{})
+		require.NoError(t, err)
+		require.Empty(t, response.Entries)
+	})
+
+	t.Run("Hit", func(t *testing.T) {
+		baseActionCacheServer.EXPECT().GetActionResult(ctx, request).Return(&remoteexecution.ActionResult{ExitCode: 1}, nil)
+		actionResult, err := actionCacheServer.GetActionResult(ctx, request)
+		require.NoError(t, err)
+		require.Equal(t, &remoteexecution.ActionResult{ExitCode: 1}, actionResult)
+
+		// The cache hit should be attributed to the invocation
+		// that requested it.
+		response, err := actionIndexServer.Search(ctx, &actionindex.SearchRequest{
+			ToolInvocationId: "invocation1",
+		})
+		require.NoError(t, err)
+		require.Len(t, response.Entries, 1)
+		entry := response.Entries[0]
+		require.Equal(t, "debian8", entry.InstanceName)
+		require.True(t, proto.Equal(request.ActionDigest, entry.ActionDigest))
+		require.Equal(t, int32(1), entry.ExitCode)
+		require.True(t, entry.CachedResult)
+		require.NotNil(t, entry.CompletedTimestamp)
+	})
+}
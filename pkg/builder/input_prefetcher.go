@@ -0,0 +1,108 @@
+package builder
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// InputPrefetcher loads the inputs of a build action into the caches
+// of a worker ahead of its execution. Workers that receive pipelines
+// of build actions from the scheduler use this to fetch the inputs of
+// the next build action while the current one is executing.
+type InputPrefetcher interface {
+	Prefetch(ctx context.Context, actionDigest *util.Digest) error
+}
+
+type inputPrefetcher struct {
+	contentAddressableStorage cas.ContentAddressableStorage
+	scratchDirectory          filesystem.Directory
+}
+
+// NewInputPrefetcher creates an InputPrefetcher that loads all
+// directories and files of the input root of a build action through a
+// caching ContentAddressableStorage. Files are fetched into a scratch
+// directory, which is emptied afterwards. As the scratch directory is
+// not synchronized, every InputPrefetcher needs its own.
+func NewInputPrefetcher(contentAddressableStorage cas.ContentAddressableStorage, scratchDirectory filesystem.Directory) InputPrefetcher {
+	return &inputPrefetcher{
+		contentAddressableStorage: contentAddressableStorage,
+		scratchDirectory:          scratchDirectory,
+	}
+}
+
+func (ip *inputPrefetcher) Prefetch(ctx context.Context, actionDigest *util.Digest) error {
+	action, err := ip.contentAddressableStorage.GetAction(ctx, actionDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to obtain action")
+	}
+	commandDigest, err := actionDigest.NewDerivedDigest(action.CommandDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to extract digest for command")
+	}
+	if _, err := ip.contentAddressableStorage.GetCommand(ctx, commandDigest); err != nil {
+		return util.StatusWrap(err, "Failed to obtain command")
+	}
+	inputRootDigest, err := actionDigest.NewDerivedDigest(action.InputRootDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to extract digest for input root")
+	}
+
+	defer ip.scratchDirectory.RemoveAllChildren()
+	p := inputPrefetch{
+		inputPrefetcher: ip,
+		directoriesSeen: map[string]bool{},
+		filesSeen:       map[string]bool{},
+	}
+	return p.prefetchDirectory(ctx, inputRootDigest)
+}
+
+// inputPrefetch holds the state of a single call to Prefetch(), used
+// to only fetch directories and files that occur multiple times in an
+// input root once.
+type inputPrefetch struct {
+	*inputPrefetcher
+	directoriesSeen map[string]bool
+	filesSeen       map[string]bool
+}
+
+func (p *inputPrefetch) prefetchDirectory(ctx context.Context, digest *util.Digest) error {
+	key := digest.GetKey(util.DigestKeyWithoutInstance)
+	if p.directoriesSeen[key] {
+		return nil
+	}
+	p.directoriesSeen[key] = true
+
+	directory, err := p.contentAddressableStorage.GetDirectory(ctx, digest)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to obtain input directory %s", digest)
+	}
+	for _, file := range directory.Files {
+		childDigest, err := digest.NewDerivedDigest(file.Digest)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to extract digest for input file %#v", file.Name)
+		}
+		childKey := childDigest.GetKey(util.DigestKeyWithoutInstance)
+		if p.filesSeen[childKey] {
+			continue
+		}
+		name := strconv.Itoa(len(p.filesSeen))
+		p.filesSeen[childKey] = true
+		if err := p.contentAddressableStorage.GetFile(ctx, childDigest, p.scratchDirectory, name, file.IsExecutable); err != nil {
+			return util.StatusWrapf(err, "Failed to obtain input file %s", childDigest)
+		}
+	}
+	for _, child := range directory.Directories {
+		childDigest, err := digest.NewDerivedDigest(child.Digest)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to extract digest for input directory %#v", child.Name)
+		}
+		if err := p.prefetchDirectory(ctx, childDigest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInputPrefetcherSuccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// An input root containing two identical subdirectories, each
+	// containing the same file twice.
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{
+		Directories: []*remoteexecution.DirectoryNode{
+			{
+				Name: "a",
+				Digest: &remoteexecution.Digest{
+					Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+					SizeBytes: 100,
+				},
+			},
+			{
+				Name: "b",
+				Digest: &remoteexecution.Digest{
+					Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+					SizeBytes: 100,
+				},
+			},
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+			SizeBytes: 100,
+		})).Return(&remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "hello.c",
+				Digest: &remoteexecution.Digest{
+					Hash:      "9999999999999999999999999999999999999999999999999999999999999999",
+					SizeBytes: 200,
+				},
+			},
+			{
+				Name: "world.c",
+				Digest: &remoteexecution.Digest{
+					Hash:      "9999999999999999999999999999999999999999999999999999999999999999",
+					SizeBytes: 200,
+				},
+			},
+		},
+	}, nil)
+
+	// The file should only be fetched once, after which the
+	// scratch directory is emptied.
+	scratchDirectory := mock.NewMockDirectory(ctrl)
+	contentAddressableStorage.EXPECT().GetFile(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "9999999999999999999999999999999999999999999999999999999999999999",
+			SizeBytes: 200,
+		}), scratchDirectory, "0", false).Return(nil)
+	scratchDirectory.EXPECT().RemoveAllChildren().Return(nil)
+
+	inputPrefetcher := builder.NewInputPrefetcher(contentAddressableStorage, scratchDirectory)
+	require.NoError(t, inputPrefetcher.Prefetch(ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+		SizeBytes: 7,
+	})))
+}
+
+func TestInputPrefetcherActionNotInStorage(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(nil, status.Error(codes.NotFound, "Blob not found"))
+	scratchDirectory := mock.NewMockDirectory(ctrl)
+
+	inputPrefetcher := builder.NewInputPrefetcher(contentAddressableStorage, scratchDirectory)
+	require.Equal(
+		t,
+		status.Error(codes.NotFound, "Failed to obtain action: Blob not found"),
+		inputPrefetcher.Prefetch(ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})))
+}
@@ -2,6 +2,8 @@ package builder
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"math"
 	"os"
 	"path"
@@ -11,11 +13,17 @@ import (
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -31,31 +39,325 @@ var (
 			Buckets:   prometheus.ExponentialBuckets(0.001, math.Pow(10.0, 1.0/3.0), 6*3+1),
 		},
 		[]string{"step"})
-	localBuildExecutorDurationSecondsPrepareFilesystem = localBuildExecutorDurationSeconds.WithLabelValues("PrepareFilesystem")
-	localBuildExecutorDurationSecondsGetActionCommand  = localBuildExecutorDurationSeconds.WithLabelValues("GetActionCommand")
-	localBuildExecutorDurationSecondsRunCommand        = localBuildExecutorDurationSeconds.WithLabelValues("RunCommand")
-	localBuildExecutorDurationSecondsUploadOutput      = localBuildExecutorDurationSeconds.WithLabelValues("UploadOutput")
+	localBuildExecutorStepDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_step_duration_seconds",
+			Help:      "Amount of time spent per build execution step, including steps that failed, in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, math.Pow(10.0, 1.0/3.0), 6*3+1),
+		},
+		[]string{"step", "outcome"})
+	localBuildExecutorInputSizeBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_input_size_bytes",
+			Help:      "Total size of the input files of build actions, in bytes.",
+			Buckets:   prometheus.ExponentialBuckets(1.0, 4.0, 20),
+		},
+		[]string{"outcome"})
+	localBuildExecutorOutputSizeBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_output_size_bytes",
+			Help:      "Total size of the output files of build actions, including stdout and stderr, in bytes.",
+			Buckets:   prometheus.ExponentialBuckets(1.0, 4.0, 20),
+		},
+		[]string{"outcome"})
+
+	localBuildExecutorUserTimeSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_user_time_seconds",
+			Help:      "Amount of CPU time build actions spent executing in user mode, in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, math.Pow(10.0, 1.0/3.0), 6*3+1),
+		},
+		[]string{"outcome"})
+	localBuildExecutorSystemTimeSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_system_time_seconds",
+			Help:      "Amount of CPU time build actions spent executing in kernel mode, in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, math.Pow(10.0, 1.0/3.0), 6*3+1),
+		},
+		[]string{"outcome"})
+	localBuildExecutorMaximumResidentSetSizeBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_maximum_resident_set_size_bytes",
+			Help:      "Maximum resident set size of build actions, in bytes.",
+			Buckets:   prometheus.ExponentialBuckets(1024.0*1024.0, 2.0, 16),
+		},
+		[]string{"outcome"})
+	localBuildExecutorBlockIOOperations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_block_io_operations",
+			Help:      "Number of block input and output operations performed by build actions.",
+			Buckets:   prometheus.ExponentialBuckets(1.0, 4.0, 16),
+		},
+		[]string{"direction", "outcome"})
 )
 
 func init() {
 	prometheus.MustRegister(localBuildExecutorDurationSeconds)
+	prometheus.MustRegister(localBuildExecutorStepDurationSeconds)
+	prometheus.MustRegister(localBuildExecutorInputSizeBytes)
+	prometheus.MustRegister(localBuildExecutorOutputSizeBytes)
+	prometheus.MustRegister(localBuildExecutorUserTimeSeconds)
+	prometheus.MustRegister(localBuildExecutorSystemTimeSeconds)
+	prometheus.MustRegister(localBuildExecutorMaximumResidentSetSizeBytes)
+	prometheus.MustRegister(localBuildExecutorBlockIOOperations)
+}
+
+// localBuildExecutorStats keeps track of the amount of time spent in
+// every step of a single build execution, and the amount of data
+// transferred. They are reported once the outcome of the execution is
+// known, so that metrics can be labeled accordingly. Every step is
+// also traced as a separate span.
+type localBuildExecutorStats struct {
+	stepDurations    map[string]time.Duration
+	currentStep      string
+	currentStepStart time.Time
+	currentStepSpan  trace.Span
+
+	inputSizeBytes  int64
+	outputSizeBytes int64
+	resourceUsage   *resourceusage.POSIXResourceUsage
+}
+
+func newLocalBuildExecutorStats() *localBuildExecutorStats {
+	return &localBuildExecutorStats{
+		stepDurations: map[string]time.Duration{},
+	}
+}
+
+func (s *localBuildExecutorStats) finishStep() {
+	if s.currentStep != "" {
+		s.stepDurations[s.currentStep] = time.Now().Sub(s.currentStepStart)
+		s.currentStepSpan.End()
+		s.currentStep = ""
+	}
+}
+
+// startStep marks the end of the current step and the start of the
+// next one. It returns a context that is associated with the span of
+// the next step.
+func (s *localBuildExecutorStats) startStep(ctx context.Context, step string) context.Context {
+	s.finishStep()
+	s.currentStep = step
+	s.currentStepStart = time.Now()
+	ctx, s.currentStepSpan = otel.Tracer(tracerName).Start(ctx, "LocalBuildExecutor."+step)
+	return ctx
+}
+
+func (s *localBuildExecutorStats) observe(response *remoteexecution.ExecuteResponse) {
+	lastStep := s.currentStep
+	s.finishStep()
+
+	outcome := "Success"
+	if response.Status != nil && codes.Code(response.Status.Code) != codes.OK {
+		outcome = "Failure"
+	} else if response.Result != nil && response.Result.ExitCode != 0 {
+		outcome = "NonZeroExitCode"
+	}
+	for step, duration := range s.stepDurations {
+		localBuildExecutorStepDurationSeconds.WithLabelValues(step, outcome).Observe(duration.Seconds())
+		// Steps that failed are only reported to the metric
+		// that is labeled by outcome, so that the original
+		// metric retains its meaning.
+		if step != lastStep || outcome != "Failure" {
+			localBuildExecutorDurationSeconds.WithLabelValues(step).Observe(duration.Seconds())
+		}
+	}
+	if _, ok := s.stepDurations["PrepareFilesystem"]; ok {
+		localBuildExecutorInputSizeBytes.WithLabelValues(outcome).Observe(float64(s.inputSizeBytes))
+	}
+	if _, ok := s.stepDurations["UploadOutput"]; ok {
+		localBuildExecutorOutputSizeBytes.WithLabelValues(outcome).Observe(float64(s.outputSizeBytes))
+	}
+	if ru := s.resourceUsage; ru != nil {
+		if userTime, err := ptypes.Duration(ru.UserTime); err == nil {
+			localBuildExecutorUserTimeSeconds.WithLabelValues(outcome).Observe(userTime.Seconds())
+		}
+		if systemTime, err := ptypes.Duration(ru.SystemTime); err == nil {
+			localBuildExecutorSystemTimeSeconds.WithLabelValues(outcome).Observe(systemTime.Seconds())
+		}
+		localBuildExecutorMaximumResidentSetSizeBytes.WithLabelValues(outcome).Observe(float64(ru.MaximumResidentSetSize))
+		localBuildExecutorBlockIOOperations.WithLabelValues("Input", outcome).Observe(float64(ru.BlockInputOperations))
+		localBuildExecutorBlockIOOperations.WithLabelValues("Output", outcome).Observe(float64(ru.BlockOutputOperations))
+	}
+}
+
+// ActionLimits bounds the size of the inputs and outputs of build
+// actions executed by a LocalBuildExecutor. This prevents build
+// actions that accidentally depend on large parts of a repository from
+// occupying a worker for a long time. Limits that are zero are not
+// enforced.
+type ActionLimits struct {
+	// Maximum number of files in the input root.
+	MaxInputFiles int64
+	// Maximum total size of the files in the input root, in bytes.
+	MaxInputSizeBytes int64
+	// Maximum total size of the outputs, including stdout and
+	// stderr, in bytes.
+	MaxOutputSizeBytes int64
+}
+
+// StageConcurrencyLimits bounds the number of build actions that a
+// LocalBuildExecutor may process in each stage of execution
+// simultaneously. The capacity of every channel determines the maximum
+// concurrency of the stage. Stages whose channel is nil are unbounded.
+//
+// By running more build actions concurrently than permitted to be
+// executing, fetching the inputs of build actions and uploading their
+// outputs can overlap with the execution of other build actions. The
+// channels may be shared between multiple LocalBuildExecutors.
+type StageConcurrencyLimits struct {
+	FetchingInputs   chan struct{}
+	Executing        chan struct{}
+	UploadingOutputs chan struct{}
+}
+
+func (l *StageConcurrencyLimits) getSlots(stage scheduler.ExecutionStage) chan struct{} {
+	if l == nil {
+		return nil
+	}
+	switch stage {
+	case scheduler.ExecutionStage_FETCHING_INPUTS:
+		return l.FetchingInputs
+	case scheduler.ExecutionStage_EXECUTING:
+		return l.Executing
+	case scheduler.ExecutionStage_UPLOADING_OUTPUTS:
+		return l.UploadingOutputs
+	default:
+		return nil
+	}
+}
+
+// localBuildExecutorStageSlot keeps track of the slot of a
+// StageConcurrencyLimits that is held by a single execution.
+type localBuildExecutorStageSlot struct {
+	slots chan struct{}
+}
+
+func (ss *localBuildExecutorStageSlot) acquire(ctx context.Context, slots chan struct{}) error {
+	ss.release()
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		ss.slots = slots
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ss *localBuildExecutorStageSlot) release() {
+	if ss.slots != nil {
+		<-ss.slots
+		ss.slots = nil
+	}
 }
 
 type localBuildExecutor struct {
 	contentAddressableStorage cas.ContentAddressableStorage
 	environmentManager        environment.Manager
+	maxInlineStdoutSize       int64
+	maxInlineStderrSize       int64
+	maxInlineOutputFileSize   int64
+	truncateInlineLogs        bool
+	cacheFailedActions        bool
+	limits                    *ActionLimits
+	stageLimits               *StageConcurrencyLimits
 }
 
 // NewLocalBuildExecutor returns a BuildExecutor that executes build
 // steps on the local system.
-func NewLocalBuildExecutor(contentAddressableStorage cas.ContentAddressableStorage, environmentManager environment.Manager) BuildExecutor {
+//
+// The stdout and stderr output of build steps is always stored in the
+// Content Addressable Storage. Output that does not exceed a given
+// size is also embedded into the ActionResult directly, so that
+// clients don't need to download it separately. If truncateInlineLogs
+// is set, output exceeding this size is embedded partially, so that
+// clients may display a preview without fetching large logs. Output
+// files that do not exceed maxInlineOutputFileSize are embedded as
+// well. Output files are never truncated.
+//
+// Results of build actions that exit with a non-zero exit code are
+// only reported as cacheable if cacheFailedActions is set. Results of
+// build actions that have do_not_cache set are never cacheable.
+//
+// If limits are provided, build actions whose inputs or outputs exceed
+// them fail with FAILED_PRECONDITION. Inputs are checked before the
+// input root is populated.
+//
+// If stage limits are provided, build actions wait for a slot to
+// become available before entering every stage of execution.
+func NewLocalBuildExecutor(contentAddressableStorage cas.ContentAddressableStorage, environmentManager environment.Manager, maxInlineStdoutSize int64, maxInlineStderrSize int64, maxInlineOutputFileSize int64, truncateInlineLogs bool, cacheFailedActions bool, limits *ActionLimits, stageLimits *StageConcurrencyLimits) BuildExecutor {
 	return &localBuildExecutor{
 		contentAddressableStorage: contentAddressableStorage,
 		environmentManager:        environmentManager,
+		maxInlineStdoutSize:       maxInlineStdoutSize,
+		maxInlineStderrSize:       maxInlineStderrSize,
+		maxInlineOutputFileSize:   maxInlineOutputFileSize,
+		truncateInlineLogs:        truncateInlineLogs,
+		cacheFailedActions:        cacheFailedActions,
+		limits:                    limits,
+		stageLimits:               stageLimits,
+	}
+}
+
+// checkInputLimits traverses the input root of a build action to
+// check whether the number of files and their total size are within
+// the configured limits. Directory objects are typically cached, which
+// makes this cheaper than populating the input root.
+func (be *localBuildExecutor) checkInputLimits(ctx context.Context, partialDigest *remoteexecution.Digest, parentDigest *util.Digest, components []string, files *int64, sizeBytes *int64) error {
+	digest, err := parentDigest.NewDerivedDigest(partialDigest)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to extract digest for input directory %#v", path.Join(components...))
+	}
+	directory, err := be.contentAddressableStorage.GetDirectory(ctx, digest)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to obtain input directory %#v", path.Join(components...))
+	}
+
+	*files += int64(len(directory.Files))
+	if max := be.limits.MaxInputFiles; max > 0 && *files > max {
+		return status.Errorf(codes.FailedPrecondition, "Input root contains more than %d files", max)
+	}
+	for _, file := range directory.Files {
+		*sizeBytes += file.Digest.GetSizeBytes()
+	}
+	if max := be.limits.MaxInputSizeBytes; max > 0 && *sizeBytes > max {
+		return status.Errorf(codes.FailedPrecondition, "Input root is larger than %d bytes", max)
+	}
+	for _, directory := range directory.Directories {
+		if err := be.checkInputLimits(ctx, directory.Digest, digest, append(components, directory.Name), files, sizeBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOutputLimits returns an error if the total size of the outputs
+// uploaded so far exceeds the configured limit.
+func (be *localBuildExecutor) checkOutputLimits(stats *localBuildExecutorStats) error {
+	if be.limits == nil || be.limits.MaxOutputSizeBytes <= 0 || stats.outputSizeBytes <= be.limits.MaxOutputSizeBytes {
+		return nil
 	}
+	return status.Errorf(codes.FailedPrecondition, "Outputs are larger than %d bytes", be.limits.MaxOutputSizeBytes)
 }
 
-func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialDigest *remoteexecution.Digest, parentDigest *util.Digest, inputDirectory filesystem.Directory, components []string) error {
+func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialDigest *remoteexecution.Digest, parentDigest *util.Digest, inputDirectory filesystem.Directory, components []string, stats *localBuildExecutorStats) error {
 	// Obtain directory.
 	digest, err := parentDigest.NewDerivedDigest(partialDigest)
 	if err != nil {
@@ -76,6 +378,7 @@ func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialD
 		if err := be.contentAddressableStorage.GetFile(ctx, childDigest, inputDirectory, file.Name, file.IsExecutable); err != nil {
 			return util.StatusWrapf(err, "Failed to obtain input file %#v", path.Join(childComponents...))
 		}
+		stats.inputSizeBytes += childDigest.GetSizeBytes()
 	}
 	for _, directory := range directory.Directories {
 		childComponents := append(components, directory.Name)
@@ -86,7 +389,7 @@ func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialD
 		if err != nil {
 			return util.StatusWrapf(err, "Failed to enter input directory %#v", path.Join(childComponents...))
 		}
-		err = be.createInputDirectory(ctx, directory.Digest, digest, childDirectory, childComponents)
+		err = be.createInputDirectory(ctx, directory.Digest, digest, childDirectory, childComponents, stats)
 		childDirectory.Close()
 		if err != nil {
 			return err
@@ -101,7 +404,25 @@ func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialD
 	return nil
 }
 
-func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirectory filesystem.Directory, parentDigest *util.Digest, children map[string]*remoteexecution.Directory, components []string) (*remoteexecution.Directory, error) {
+// populateInputRoot places the input root of a build action inside
+// the build directory. Environments that are capable of doing this
+// more efficiently, for example by reusing the input root of a
+// previous build action, are permitted to do so.
+func (be *localBuildExecutor) populateInputRoot(ctx context.Context, buildEnvironment environment.ManagedEnvironment, inputRootDigest *remoteexecution.Digest, actionDigest *util.Digest, stats *localBuildExecutorStats) error {
+	populator, ok := buildEnvironment.(environment.InputRootPopulator)
+	if !ok {
+		return be.createInputDirectory(ctx, inputRootDigest, actionDigest, buildEnvironment.GetBuildDirectory(), []string{"."}, stats)
+	}
+	digest, err := actionDigest.NewDerivedDigest(inputRootDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to extract digest for input root")
+	}
+	sizeBytes, err := populator.PopulateInputRoot(ctx, digest)
+	stats.inputSizeBytes += sizeBytes
+	return err
+}
+
+func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirectory filesystem.Directory, parentDigest *util.Digest, children map[string]*remoteexecution.Directory, components []string, stats *localBuildExecutorStats) (*remoteexecution.Directory, error) {
 	files, err := outputDirectory.ReadDir()
 	if err != nil {
 		return nil, util.StatusWrapf(err, "Failed to read output directory %#v", path.Join(components...))
@@ -117,6 +438,10 @@ func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirecto
 			if err != nil {
 				return nil, util.StatusWrapf(err, "Failed to store output file %#v", path.Join(childComponents...))
 			}
+			stats.outputSizeBytes += digest.GetSizeBytes()
+			if err := be.checkOutputLimits(stats); err != nil {
+				return nil, err
+			}
 			directory.Files = append(directory.Files, &remoteexecution.FileNode{
 				Name:         name,
 				Digest:       digest.GetPartialDigest(),
@@ -127,7 +452,7 @@ func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirecto
 			if err != nil {
 				return nil, util.StatusWrapf(err, "Failed to enter output directory %#v", path.Join(childComponents...))
 			}
-			child, err := be.uploadDirectory(ctx, childDirectory, parentDigest, children, childComponents)
+			child, err := be.uploadDirectory(ctx, childDirectory, parentDigest, children, childComponents, stats)
 			childDirectory.Close()
 			if err != nil {
 				return nil, err
@@ -165,10 +490,10 @@ func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirecto
 	return &directory, nil
 }
 
-func (be *localBuildExecutor) uploadTree(ctx context.Context, outputDirectory filesystem.Directory, parentDigest *util.Digest, components []string) (*util.Digest, error) {
+func (be *localBuildExecutor) uploadTree(ctx context.Context, outputDirectory filesystem.Directory, parentDigest *util.Digest, components []string, stats *localBuildExecutorStats) (*util.Digest, error) {
 	// Gather all individual directory objects and turn them into a tree.
 	children := map[string]*remoteexecution.Directory{}
-	root, err := be.uploadDirectory(ctx, outputDirectory, parentDigest, children, components)
+	root, err := be.uploadDirectory(ctx, outputDirectory, parentDigest, children, components, stats)
 	if err != nil {
 		return nil, err
 	}
@@ -182,7 +507,11 @@ func (be *localBuildExecutor) uploadTree(ctx context.Context, outputDirectory fi
 	if err != nil {
 		return nil, util.StatusWrapf(err, "Failed to store output directory %#v", path.Join(components...))
 	}
-	return digest, err
+	stats.outputSizeBytes += digest.GetSizeBytes()
+	if err := be.checkOutputLimits(stats); err != nil {
+		return nil, err
+	}
+	return digest, nil
 }
 
 func (be *localBuildExecutor) createOutputParentDirectory(buildDirectory filesystem.Directory, outputParentPath string) (filesystem.Directory, error) {
@@ -210,10 +539,213 @@ func (be *localBuildExecutor) createOutputParentDirectory(buildDirectory filesys
 	return d, nil
 }
 
+// readInlineLog reads the contents of a log file that was previously
+// stored in the Content Addressable Storage, so that it may be embedded
+// into the ActionResult. Nothing is returned for log files that are
+// empty. Log files that exceed the maximum size are either omitted or
+// truncated, followed by a notice that refers to the full log file.
+func (be *localBuildExecutor) readInlineLog(directory filesystem.Directory, name string, digest *util.Digest, maxSize int64) ([]byte, error) {
+	sizeBytes := digest.GetSizeBytes()
+	truncated := sizeBytes > maxSize
+	if sizeBytes == 0 || (truncated && (!be.truncateInlineLogs || maxSize == 0)) {
+		return nil, nil
+	}
+	if truncated {
+		sizeBytes = maxSize
+	}
+	data, err := readFilePrefix(directory, name, sizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		data = append(data, fmt.Sprintf(
+			"\n[Output truncated to %d of %d bytes. The full output is stored in the Content Addressable Storage as blob %s-%d.]\n",
+			maxSize, digest.GetSizeBytes(), digest.GetHashString(), digest.GetSizeBytes())...)
+	}
+	return data, nil
+}
+
+// readFilePrefix reads the first sizeBytes bytes of a file.
+func readFilePrefix(directory filesystem.Directory, name string, sizeBytes int64) ([]byte, error) {
+	file, err := directory.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, sizeBytes)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// localBuildExecutorOutputKind indicates which kinds of files may be
+// stored at an output path of a command.
+type localBuildExecutorOutputKind int
+
+const (
+	localBuildExecutorOutputFile localBuildExecutorOutputKind = iota
+	localBuildExecutorOutputDirectory
+	localBuildExecutorOutputAny
+)
+
+func (k localBuildExecutorOutputKind) getName() string {
+	switch k {
+	case localBuildExecutorOutputFile:
+		return "output file"
+	case localBuildExecutorOutputDirectory:
+		return "output directory"
+	default:
+		return "output path"
+	}
+}
+
+type localBuildExecutorOutput struct {
+	path string
+	kind localBuildExecutorOutputKind
+}
+
+// getLocalBuildExecutorOutputs returns the list of paths at which a
+// command is expected to create outputs. Newer clients provide these
+// through output_paths, which does not distinguish between files and
+// directories. In that case output_files and output_directories are
+// ignored.
+func getLocalBuildExecutorOutputs(command *remoteexecution.Command) []localBuildExecutorOutput {
+	var outputs []localBuildExecutorOutput
+	if len(command.OutputPaths) > 0 {
+		for _, outputPath := range command.OutputPaths {
+			outputs = append(outputs, localBuildExecutorOutput{path: outputPath, kind: localBuildExecutorOutputAny})
+		}
+		return outputs
+	}
+	for _, outputDirectory := range command.OutputDirectories {
+		outputs = append(outputs, localBuildExecutorOutput{path: outputDirectory, kind: localBuildExecutorOutputDirectory})
+	}
+	for _, outputFile := range command.OutputFiles {
+		outputs = append(outputs, localBuildExecutorOutput{path: outputFile, kind: localBuildExecutorOutputFile})
+	}
+	return outputs
+}
+
+// uploadOutput stores a single output of a command in the Content
+// Addressable Storage and adds it to the action result. Outputs that
+// were not created by the command are ignored.
+func (be *localBuildExecutor) uploadOutput(ctx context.Context, outputParentDirectory filesystem.Directory, output localBuildExecutorOutput, actionDigest *util.Digest, actionResult *remoteexecution.ActionResult, stats *localBuildExecutorStats) error {
+	kindName := output.kind.getName()
+	outputBaseName := path.Base(output.path)
+	fileInfo, err := outputParentDirectory.Lstat(outputBaseName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return util.StatusWrapf(err, "Failed to read attributes of %s %#v", kindName, output.path)
+	}
+	switch mode := fileInfo.Mode(); mode & os.ModeType {
+	case 0:
+		if output.kind == localBuildExecutorOutputDirectory {
+			return status.Errorf(codes.Internal, "Output file %#v is not a directory or symlink", output.path)
+		}
+		digest, err := be.contentAddressableStorage.PutFile(ctx, outputParentDirectory, outputBaseName, actionDigest)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to store %s %#v", kindName, output.path)
+		}
+		stats.outputSizeBytes += digest.GetSizeBytes()
+		if err := be.checkOutputLimits(stats); err != nil {
+			return err
+		}
+		outputFile := &remoteexecution.OutputFile{
+			Path:         output.path,
+			Digest:       digest.GetPartialDigest(),
+			IsExecutable: (mode & 0111) != 0,
+		}
+		if sizeBytes := digest.GetSizeBytes(); sizeBytes > 0 && sizeBytes <= be.maxInlineOutputFileSize {
+			contents, err := readFilePrefix(outputParentDirectory, outputBaseName, sizeBytes)
+			if err != nil {
+				return util.StatusWrapf(err, "Failed to read %s %#v", kindName, output.path)
+			}
+			outputFile.Contents = contents
+		}
+		actionResult.OutputFiles = append(actionResult.OutputFiles, outputFile)
+	case os.ModeDir:
+		if output.kind == localBuildExecutorOutputFile {
+			return status.Errorf(codes.Internal, "Output file %#v is not a regular file or symlink", output.path)
+		}
+		directory, err := outputParentDirectory.Enter(outputBaseName)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to enter %s %#v", kindName, output.path)
+		}
+		digest, err := be.uploadTree(ctx, directory, actionDigest, []string{output.path}, stats)
+		directory.Close()
+		if err != nil {
+			return err
+		}
+		if digest != nil {
+			actionResult.OutputDirectories = append(actionResult.OutputDirectories, &remoteexecution.OutputDirectory{
+				Path:       output.path,
+				TreeDigest: digest.GetPartialDigest(),
+			})
+		}
+	case os.ModeSymlink:
+		target, err := outputParentDirectory.Readlink(outputBaseName)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to read output symlink %#v", output.path)
+		}
+		outputSymlink := &remoteexecution.OutputSymlink{
+			Path:   output.path,
+			Target: target,
+		}
+		switch output.kind {
+		case localBuildExecutorOutputFile:
+			actionResult.OutputFileSymlinks = append(actionResult.OutputFileSymlinks, outputSymlink)
+		case localBuildExecutorOutputDirectory:
+			actionResult.OutputDirectorySymlinks = append(actionResult.OutputDirectorySymlinks, outputSymlink)
+		case localBuildExecutorOutputAny:
+			actionResult.OutputSymlinks = append(actionResult.OutputSymlinks, outputSymlink)
+		}
+	default:
+		switch output.kind {
+		case localBuildExecutorOutputFile:
+			return status.Errorf(codes.Internal, "Output file %#v is not a regular file or symlink", output.path)
+		case localBuildExecutorOutputDirectory:
+			return status.Errorf(codes.Internal, "Output file %#v is not a directory or symlink", output.path)
+		default:
+			return status.Errorf(codes.Internal, "Output path %#v is not a regular file, directory or symlink", output.path)
+		}
+	}
+	return nil
+}
+
 func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
-	timeStart := time.Now()
+	stats := newLocalBuildExecutorStats()
+	var stageSlot localBuildExecutorStageSlot
+	response, mayBeCached := be.execute(ctx, request, stats, &stageSlot)
+	stageSlot.release()
+	stats.observe(response)
+	return response, mayBeCached
+}
+
+// enterStage waits for a slot of the next stage of execution to become
+// available, releasing the slot of the current stage. Time spent
+// waiting is not attributed to any of the steps.
+func (be *localBuildExecutor) enterStage(ctx context.Context, stage scheduler.ExecutionStage, stats *localBuildExecutorStats, stageSlot *localBuildExecutorStageSlot) error {
+	stats.finishStep()
+	if err := stageSlot.acquire(ctx, be.stageLimits.getSlots(stage)); err != nil {
+		code := codes.Canceled
+		if err == context.DeadlineExceeded {
+			code = codes.DeadlineExceeded
+		}
+		return util.StatusWrapfWithCode(err, code, "Failed to wait for stage %s", stage)
+	}
+	reportExecutionStage(ctx, stage)
+	return nil
+}
 
+func (be *localBuildExecutor) execute(parentCtx context.Context, request *remoteexecution.ExecuteRequest, stats *localBuildExecutorStats, stageSlot *localBuildExecutorStageSlot) (*remoteexecution.ExecuteResponse, bool) {
 	// Fetch action and command.
+	if err := be.enterStage(parentCtx, scheduler.ExecutionStage_FETCHING_INPUTS, stats, stageSlot); err != nil {
+		return convertErrorToExecuteResponse(err), false
+	}
+	ctx := stats.startStep(parentCtx, "GetActionCommand")
 	actionDigest, err := util.NewDigest(request.InstanceName, request.ActionDigest)
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to extract digest for action")), false
@@ -230,17 +762,30 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to obtain command")), false
 	}
-	timeAfterGetActionCommand := time.Now()
-	localBuildExecutorDurationSecondsGetActionCommand.Observe(
-		timeAfterGetActionCommand.Sub(timeStart).Seconds())
+	// None of the node properties that can be requested through
+	// output_node_properties are supported. Reject such requests,
+	// as clients would otherwise assume they have been reported.
+	if len(command.OutputNodeProperties) > 0 {
+		return convertErrorToExecuteResponse(status.Error(codes.InvalidArgument, "Output node properties are not supported")), false
+	}
+	// Reject build actions with excessively large input roots
+	// before spending any effort on populating them.
+	if be.limits != nil && (be.limits.MaxInputFiles > 0 || be.limits.MaxInputSizeBytes > 0) {
+		var inputFiles, inputSizeBytes int64
+		if err := be.checkInputLimits(ctx, action.InputRootDigest, actionDigest, []string{"."}, &inputFiles, &inputSizeBytes); err != nil {
+			return convertErrorToExecuteResponse(err), false
+		}
+	}
 
 	// Obtain build environment.
+	ctx = stats.startStep(parentCtx, "PrepareFilesystem")
 	platformProperties := map[string]string{}
 	if command.Platform != nil {
 		for _, platformProperty := range command.Platform.Properties {
 			platformProperties[platformProperty.Name] = platformProperty.Value
 		}
 	}
+	requestsSecrets := environment.RequestsSecrets(platformProperties)
 	environment, err := be.environmentManager.Acquire(actionDigest, platformProperties)
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to acquire build environment")), false
@@ -249,31 +794,24 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 
 	// Set up inputs.
 	buildDirectory := environment.GetBuildDirectory()
-	if err := be.createInputDirectory(ctx, action.InputRootDigest, actionDigest, buildDirectory, []string{"."}); err != nil {
+	if err := be.populateInputRoot(ctx, environment, action.InputRootDigest, actionDigest, stats); err != nil {
 		return convertErrorToExecuteResponse(err), false
 	}
 
 	// Create and open parent directories of where we expect to see output.
 	// Build rules generally expect the parent directories to already be
 	// there. We later use the directory handles to extract output files.
-	outputParentDirectories := map[string]filesystem.Directory{}
-	for _, outputDirectory := range command.OutputDirectories {
-		dirPath := path.Dir(outputDirectory)
-		if _, ok := outputParentDirectories[dirPath]; !ok {
-			dir, err := be.createOutputParentDirectory(buildDirectory, dirPath)
-			if err != nil {
-				return convertErrorToExecuteResponse(err), false
-			}
-			outputParentDirectories[dirPath] = dir
-			if dir != buildDirectory {
-				defer dir.Close()
-			}
-		}
+	// Output paths are relative to the working directory.
+	outputs := getLocalBuildExecutorOutputs(command)
+	testCommand, isTest := getTestCommand(command)
+	if isTest {
+		outputs = testCommand.addOutputs(outputs)
 	}
-	for _, outputFile := range command.OutputFiles {
-		dirPath := path.Dir(outputFile)
+	outputParentDirectories := map[string]filesystem.Directory{}
+	for _, output := range outputs {
+		dirPath := path.Dir(output.path)
 		if _, ok := outputParentDirectories[dirPath]; !ok {
-			dir, err := be.createOutputParentDirectory(buildDirectory, dirPath)
+			dir, err := be.createOutputParentDirectory(buildDirectory, path.Join(command.WorkingDirectory, dirPath))
 			if err != nil {
 				return convertErrorToExecuteResponse(err), false
 			}
@@ -284,11 +822,11 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 		}
 	}
 
-	timeAfterPrepareFilesytem := time.Now()
-	localBuildExecutorDurationSecondsPrepareFilesystem.Observe(
-		timeAfterPrepareFilesytem.Sub(timeAfterGetActionCommand).Seconds())
-
 	// Invoke command.
+	if err := be.enterStage(parentCtx, scheduler.ExecutionStage_EXECUTING, stats, stageSlot); err != nil {
+		return convertErrorToExecuteResponse(err), false
+	}
+	ctx = stats.startStep(parentCtx, "RunCommand")
 	environmentVariables := map[string]string{}
 	for _, environmentVariable := range command.EnvironmentVariables {
 		environmentVariables[environmentVariable.Name] = environmentVariable.Value
@@ -303,9 +841,10 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 	if err != nil {
 		return convertErrorToExecuteResponse(err), false
 	}
-	timeAfterRunCommand := time.Now()
-	localBuildExecutorDurationSecondsRunCommand.Observe(
-		timeAfterRunCommand.Sub(timeAfterPrepareFilesytem).Seconds())
+	if err := be.enterStage(parentCtx, scheduler.ExecutionStage_UPLOADING_OUTPUTS, stats, stageSlot); err != nil {
+		return convertErrorToExecuteResponse(err), false
+	}
+	ctx = stats.startStep(parentCtx, "UploadOutput")
 
 	response := &remoteexecution.ExecuteResponse{
 		Result: &remoteexecution.ActionResult{
@@ -313,6 +852,26 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 		},
 	}
 
+	// Attach resource usage of the command to the action result, so
+	// that users can identify resource hungry build actions. Any
+	// additional metadata provided by the runner is attached as well.
+	var auxiliaryMetadata []*any.Any
+	if runResponse.ResourceUsage != nil {
+		stats.resourceUsage = runResponse.ResourceUsage
+		resourceUsage, err := ptypes.MarshalAny(runResponse.ResourceUsage)
+		if err != nil {
+			return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to marshal resource usage")), false
+		}
+		auxiliaryMetadata = append(auxiliaryMetadata, resourceUsage)
+	}
+	auxiliaryMetadata = append(auxiliaryMetadata, runResponse.AuxiliaryMetadata...)
+	if worker := getWorkerName(parentCtx); len(auxiliaryMetadata) > 0 || worker != "" {
+		response.Result.ExecutionMetadata = &remoteexecution.ExecutedActionMetadata{
+			Worker:            worker,
+			AuxiliaryMetadata: auxiliaryMetadata,
+		}
+	}
+
 	// Upload command output. In the common case, the files are
 	// empty. If that's the case, don't bother setting the digest to
 	// keep the ActionResult small.
@@ -320,98 +879,50 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store stdout")), false
 	}
+	stats.outputSizeBytes += stdoutDigest.GetSizeBytes()
+	if err := be.checkOutputLimits(stats); err != nil {
+		return convertErrorToExecuteResponse(err), false
+	}
 	if stdoutDigest.GetSizeBytes() > 0 {
 		response.Result.StdoutDigest = stdoutDigest.GetPartialDigest()
 	}
+	response.Result.StdoutRaw, err = be.readInlineLog(buildDirectory, ".stdout.txt", stdoutDigest, be.maxInlineStdoutSize)
+	if err != nil {
+		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to read stdout")), false
+	}
 	stderrDigest, err := be.contentAddressableStorage.PutFile(ctx, buildDirectory, ".stderr.txt", actionDigest)
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store stderr")), false
 	}
+	stats.outputSizeBytes += stderrDigest.GetSizeBytes()
+	if err := be.checkOutputLimits(stats); err != nil {
+		return convertErrorToExecuteResponse(err), false
+	}
 	if stderrDigest.GetSizeBytes() > 0 {
 		response.Result.StderrDigest = stderrDigest.GetPartialDigest()
 	}
+	response.Result.StderrRaw, err = be.readInlineLog(buildDirectory, ".stderr.txt", stderrDigest, be.maxInlineStderrSize)
+	if err != nil {
+		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to read stderr")), false
+	}
 
-	// Upload output files.
-	for _, outputFile := range command.OutputFiles {
-		outputParentDirectory := outputParentDirectories[path.Dir(outputFile)]
-		outputBaseName := path.Base(outputFile)
-		fileInfo, err := outputParentDirectory.Lstat(outputBaseName)
-		if err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
-			return convertErrorToExecuteResponse(util.StatusWrapf(err, "Failed to read attributes of output file %#v", outputFile)), false
-		}
-		switch mode := fileInfo.Mode(); mode & os.ModeType {
-		case 0:
-			digest, err := be.contentAddressableStorage.PutFile(ctx, outputParentDirectory, outputBaseName, actionDigest)
-			if err != nil {
-				return convertErrorToExecuteResponse(util.StatusWrapf(err, "Failed to store output file %#v", outputFile)), false
-			}
-			response.Result.OutputFiles = append(response.Result.OutputFiles, &remoteexecution.OutputFile{
-				Path:         outputFile,
-				Digest:       digest.GetPartialDigest(),
-				IsExecutable: (mode & 0111) != 0,
-			})
-		case os.ModeSymlink:
-			target, err := outputParentDirectory.Readlink(outputBaseName)
-			if err != nil {
-				return convertErrorToExecuteResponse(util.StatusWrapf(err, "Failed to read output symlink %#v", outputFile)), false
-			}
-			response.Result.OutputFileSymlinks = append(response.Result.OutputFileSymlinks, &remoteexecution.OutputSymlink{
-				Path:   outputFile,
-				Target: target,
-			})
-		default:
-			return convertErrorToExecuteResponse(status.Errorf(codes.Internal, "Output file %#v is not a regular file or symlink", outputFile)), false
+	// Upload output files, directories and symbolic links.
+	for _, output := range outputs {
+		if err := be.uploadOutput(ctx, outputParentDirectories[path.Dir(output.path)], output, actionDigest, response.Result, stats); err != nil {
+			return convertErrorToExecuteResponse(err), false
 		}
 	}
 
-	// Upload output directories.
-	for _, outputDirectory := range command.OutputDirectories {
-		outputParentDirectory := outputParentDirectories[path.Dir(outputDirectory)]
-		outputBaseName := path.Base(outputDirectory)
-		fileInfo, err := outputParentDirectory.Lstat(outputBaseName)
-		if err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
-			return convertErrorToExecuteResponse(util.StatusWrapf(err, "Failed to read attributes of output directory %#v", outputDirectory)), false
-		}
-		switch mode := fileInfo.Mode(); mode & os.ModeType {
-		case os.ModeDir:
-			directory, err := outputParentDirectory.Enter(outputBaseName)
-			if err != nil {
-				return convertErrorToExecuteResponse(util.StatusWrapf(err, "Failed to enter output directory %#v", outputDirectory)), false
-			}
-			digest, err := be.uploadTree(ctx, directory, actionDigest, []string{outputDirectory})
-			directory.Close()
-			if err != nil {
-				return convertErrorToExecuteResponse(err), false
-			}
-			if digest != nil {
-				response.Result.OutputDirectories = append(response.Result.OutputDirectories, &remoteexecution.OutputDirectory{
-					Path:       outputDirectory,
-					TreeDigest: digest.GetPartialDigest(),
-				})
-			}
-		case os.ModeSymlink:
-			target, err := outputParentDirectory.Readlink(outputBaseName)
-			if err != nil {
-				return convertErrorToExecuteResponse(util.StatusWrapf(err, "Failed to read output symlink %#v", outputDirectory)), false
-			}
-			response.Result.OutputDirectorySymlinks = append(response.Result.OutputDirectorySymlinks, &remoteexecution.OutputSymlink{
-				Path:   outputDirectory,
-				Target: target,
-			})
-		default:
-			return convertErrorToExecuteResponse(status.Errorf(codes.Internal, "Output file %#v is not a directory or symlink", outputDirectory)), false
+	// Attach a summary of the results of test actions, so that they
+	// can be displayed without downloading any outputs.
+	if isTest {
+		if err := be.attachTestResultSummary(ctx, testCommand, outputParentDirectories, response.Result); err != nil {
+			return convertErrorToExecuteResponse(err), false
 		}
 	}
 
-	timeAfterUpload := time.Now()
-	localBuildExecutorDurationSecondsUploadOutput.Observe(
-		timeAfterUpload.Sub(timeAfterRunCommand).Seconds())
-
-	return response, !action.DoNotCache && response.Result.ExitCode == 0
+	// Results of build actions that had access to secrets may
+	// contain data derived from them. Never store these in the
+	// Action Cache, where other clients could obtain them.
+	return response, !action.DoNotCache && !requestsSecrets && (response.Result.ExitCode == 0 || be.cacheFailedActions)
 }
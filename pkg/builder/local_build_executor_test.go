@@ -8,10 +8,15 @@ import (
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/duration"
 	"github.com/stretchr/testify/require"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
@@ -31,7 +36,7 @@ func TestLocalBuildExecutorMissingActionDigest(t *testing.T) {
 	defer ctrl.Finish()
 	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "debian8",
@@ -42,12 +47,70 @@ func TestLocalBuildExecutorMissingActionDigest(t *testing.T) {
 	require.False(t, mayBeCached)
 }
 
+func TestLocalBuildExecutorExecutionStageReporting(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	environmentManager := mock.NewMockManager(ctrl)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
+
+	// Execution fails before the command is run, meaning that
+	// only the first stage should be reported.
+	var stages []scheduler.ExecutionStage
+	ctx = builder.NewContextWithExecutionStageReporter(ctx, func(stage scheduler.ExecutionStage) {
+		stages = append(stages, stage)
+	})
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Status: status.New(codes.InvalidArgument, "Failed to extract digest for action: No digest provided").Proto(),
+	}, executeResponse)
+	require.False(t, mayBeCached)
+	require.Equal(t, []scheduler.ExecutionStage{scheduler.ExecutionStage_FETCHING_INPUTS}, stages)
+}
+
+func TestLocalBuildExecutorStageConcurrencyLimits(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	environmentManager := mock.NewMockManager(ctrl)
+	stageLimits := &builder.StageConcurrencyLimits{
+		FetchingInputs: make(chan struct{}, 1),
+	}
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, stageLimits)
+
+	// The slot of a stage should be released when execution fails.
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Status: status.New(codes.InvalidArgument, "Failed to extract digest for action: No digest provided").Proto(),
+	}, executeResponse)
+	require.False(t, mayBeCached)
+	require.Len(t, stageLimits.FetchingInputs, 0)
+
+	// While all slots are in use, build actions should wait until
+	// the context is canceled.
+	stageLimits.FetchingInputs <- struct{}{}
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	executeResponse, mayBeCached = localBuildExecutor.Execute(canceledCtx, &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Status: status.New(codes.Canceled, "Failed to wait for stage FETCHING_INPUTS: context canceled").Proto(),
+	}, executeResponse)
+	require.False(t, mayBeCached)
+	require.Len(t, stageLimits.FetchingInputs, 1)
+}
+
 func TestLocalBuildExecutorMalformedActionDigest(t *testing.T) {
 	ctrl, ctx := gomock.WithContext(context.Background(), t)
 	defer ctrl.Finish()
 	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "windows10",
@@ -80,7 +143,7 @@ func TestLocalBuildExecutorActionNotInStorage(t *testing.T) {
 			},
 		})).Err())
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "freebsd12",
@@ -122,7 +185,7 @@ func TestLocalBuildExecutorMalformedCommandDigest(t *testing.T) {
 		},
 	}, nil)
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "macos",
@@ -161,7 +224,7 @@ func TestLocalBuildExecutorCommandNotInStorage(t *testing.T) {
 			SizeBytes: 123,
 		})).Return(nil, status.Error(codes.Internal, "Storage unavailable"))
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "macos",
@@ -176,6 +239,51 @@ func TestLocalBuildExecutorCommandNotInStorage(t *testing.T) {
 	require.False(t, mayBeCached)
 }
 
+func TestLocalBuildExecutorOutputNodePropertiesUnsupported(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("freebsd", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("freebsd", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments:            []string{"touch", "foo"},
+		OutputPaths:          []string{"foo"},
+		OutputNodeProperties: []string{"unix_mode"},
+	}, nil)
+	environmentManager := mock.NewMockManager(ctrl)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
+
+	// Clients requesting node properties should get an explicit
+	// error, as none of them would be reported.
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Status: status.New(codes.InvalidArgument, "Output node properties are not supported").Proto(),
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
+
 func TestLocalBuildExecutorEnvironmentAcquireFailed(t *testing.T) {
 	ctrl, ctx := gomock.WithContext(context.Background(), t)
 	defer ctrl.Finish()
@@ -213,7 +321,7 @@ func TestLocalBuildExecutorEnvironmentAcquireFailed(t *testing.T) {
 		}),
 		map[string]string{},
 	).Return(nil, status.Error(codes.InvalidArgument, "Platform requirements not provided"))
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "netbsd",
@@ -228,6 +336,75 @@ func TestLocalBuildExecutorEnvironmentAcquireFailed(t *testing.T) {
 	require.False(t, mayBeCached)
 }
 
+func TestLocalBuildExecutorInputLimitExceeded(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments:   []string{"touch", "foo"},
+		OutputFiles: []string{"foo"},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "a",
+				Digest: &remoteexecution.Digest{
+					Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+					SizeBytes: 600,
+				},
+			},
+			{
+				Name: "b",
+				Digest: &remoteexecution.Digest{
+					Hash:      "9999999999999999999999999999999999999999999999999999999999999999",
+					SizeBytes: 500,
+				},
+			},
+		},
+	}, nil)
+	environmentManager := mock.NewMockManager(ctrl)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, &builder.ActionLimits{
+		MaxInputFiles:     10,
+		MaxInputSizeBytes: 1000,
+	}, nil)
+
+	// The input root exceeds the maximum size. The build action
+	// should fail without acquiring a build environment.
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "netbsd",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Status: status.New(codes.FailedPrecondition, "Input root is larger than 1000 bytes").Proto(),
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
+
 func TestLocalBuildExecutorMissingInputDirectoryDigest(t *testing.T) {
 	ctrl, ctx := gomock.WithContext(context.Background(), t)
 	defer ctrl.Finish()
@@ -303,7 +480,7 @@ func TestLocalBuildExecutorMissingInputDirectoryDigest(t *testing.T) {
 	worldDirectory.EXPECT().Close()
 	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
 	environment.EXPECT().Release()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "netbsd",
@@ -364,7 +541,7 @@ func TestLocalBuildExecutorInputRootNotInStorage(t *testing.T) {
 	buildDirectory := mock.NewMockDirectory(ctrl)
 	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
 	environment.EXPECT().Release()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "netbsd",
@@ -426,7 +603,7 @@ func TestLocalBuildExecutorOutputDirectoryCreationFailure(t *testing.T) {
 	buildDirectory.EXPECT().Mkdir("foo", os.FileMode(0777)).Return(status.Error(codes.Internal, "Out of disk space"))
 	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
 	environment.EXPECT().Release()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "fedora",
@@ -514,7 +691,7 @@ func TestLocalBuildExecutorOutputSymlinkReadingFailure(t *testing.T) {
 	}, nil)
 	fooDirectory.EXPECT().Readlink("bar").Return("", status.Error(codes.Internal, "Cosmic rays caused interference"))
 	fooDirectory.EXPECT().Close()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "nintendo64",
@@ -688,7 +865,7 @@ func TestLocalBuildExecutorSuccess(t *testing.T) {
 		ExitCode: 0,
 	}, nil)
 	environment.EXPECT().Release()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "ubuntu1804",
@@ -730,3 +907,522 @@ func TestLocalBuildExecutorSuccess(t *testing.T) {
 }
 
 // TODO(edsch): Test aspects of execution not covered above (e.g., output directories, symlinks).
+
+func TestLocalBuildExecutorInlineLogs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments: []string{"echo", "Hello"},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{}, nil)
+
+	// Small output on stdout should be inlined, while large output
+	// on stderr should only be referenced by digest.
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "0000000000000000000000000000000000000000000000000000000000000005",
+			SizeBytes: 6,
+		}), nil)
+	stdoutFile := mock.NewMockFile(ctrl)
+	buildDirectory.EXPECT().OpenFile(".stdout.txt", os.O_RDONLY, os.FileMode(0)).Return(stdoutFile, nil)
+	stdoutFile.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		return copy(p, "Hello\n"), nil
+	})
+	stdoutFile.EXPECT().Close()
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "0000000000000000000000000000000000000000000000000000000000000006",
+			SizeBytes: 678,
+		}), nil)
+	environmentManager := mock.NewMockManager(ctrl)
+	environment := mock.NewMockManagedEnvironment(ctrl)
+	environmentManager.EXPECT().Acquire(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		}),
+		map[string]string{},
+	).Return(environment, nil)
+	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
+	environment.EXPECT().Run(ctx, &runner.RunRequest{
+		Arguments:            []string{"echo", "Hello"},
+		EnvironmentVariables: map[string]string{},
+		WorkingDirectory:     "",
+		StdoutPath:           ".stdout.txt",
+		StderrPath:           ".stderr.txt",
+	}).Return(&runner.RunResponse{
+		ExitCode: 0,
+	}, nil)
+	environment.EXPECT().Release()
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 100, 100, 0, false, false, nil, nil)
+
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "nintendo64",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello\n"),
+			StdoutDigest: &remoteexecution.Digest{
+				Hash:      "0000000000000000000000000000000000000000000000000000000000000005",
+				SizeBytes: 6,
+			},
+			StderrDigest: &remoteexecution.Digest{
+				Hash:      "0000000000000000000000000000000000000000000000000000000000000006",
+				SizeBytes: 678,
+			},
+		},
+	}, executeResponse)
+	require.True(t, mayBeCached)
+}
+
+func TestLocalBuildExecutorInlineOutputFiles(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments:   []string{"touch", "small", "large"},
+		OutputFiles: []string{"small", "large"},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{}, nil)
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		}), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		}), nil)
+	environmentManager := mock.NewMockManager(ctrl)
+	environment := mock.NewMockManagedEnvironment(ctrl)
+	environmentManager.EXPECT().Acquire(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		}),
+		map[string]string{},
+	).Return(environment, nil)
+	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
+	environment.EXPECT().Run(ctx, &runner.RunRequest{
+		Arguments:            []string{"touch", "small", "large"},
+		EnvironmentVariables: map[string]string{},
+		WorkingDirectory:     "",
+		StdoutPath:           ".stdout.txt",
+		StderrPath:           ".stderr.txt",
+	}).Return(&runner.RunResponse{
+		ExitCode: 0,
+	}, nil)
+
+	// Small output files should be inlined, while large output files
+	// should only be referenced by digest.
+	buildDirectory.EXPECT().Lstat("small").Return(filesystem.NewSimpleFileInfo("small", 0644), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, "small", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "0000000000000000000000000000000000000000000000000000000000000005",
+			SizeBytes: 6,
+		}), nil)
+	smallFile := mock.NewMockFile(ctrl)
+	buildDirectory.EXPECT().OpenFile("small", os.O_RDONLY, os.FileMode(0)).Return(smallFile, nil)
+	smallFile.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		return copy(p, "Hello\n"), nil
+	})
+	smallFile.EXPECT().Close()
+	buildDirectory.EXPECT().Lstat("large").Return(filesystem.NewSimpleFileInfo("large", 0755), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, "large", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "0000000000000000000000000000000000000000000000000000000000000006",
+			SizeBytes: 678,
+		}), nil)
+	environment.EXPECT().Release()
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 100, false, false, nil, nil)
+
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "nintendo64",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			OutputFiles: []*remoteexecution.OutputFile{
+				{
+					Path: "small",
+					Digest: &remoteexecution.Digest{
+						Hash:      "0000000000000000000000000000000000000000000000000000000000000005",
+						SizeBytes: 6,
+					},
+					Contents: []byte("Hello\n"),
+				},
+				{
+					Path: "large",
+					Digest: &remoteexecution.Digest{
+						Hash:      "0000000000000000000000000000000000000000000000000000000000000006",
+						SizeBytes: 678,
+					},
+					IsExecutable: true,
+				},
+			},
+		},
+	}, executeResponse)
+	require.True(t, mayBeCached)
+}
+
+func TestLocalBuildExecutorSecretsNotCached(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments: []string{"npm", "publish"},
+		Platform: &remoteexecution.Platform{
+			Properties: []*remoteexecution.Platform_Property{
+				{Name: "secret:NPM_TOKEN", Value: ""},
+			},
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{}, nil)
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		}), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		}), nil)
+	environmentManager := mock.NewMockManager(ctrl)
+	environment := mock.NewMockManagedEnvironment(ctrl)
+	environmentManager.EXPECT().Acquire(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		}),
+		map[string]string{"secret:NPM_TOKEN": ""},
+	).Return(environment, nil)
+	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
+	environment.EXPECT().Run(ctx, &runner.RunRequest{
+		Arguments:            []string{"npm", "publish"},
+		EnvironmentVariables: map[string]string{},
+		WorkingDirectory:     "",
+		StdoutPath:           ".stdout.txt",
+		StderrPath:           ".stderr.txt",
+	}).Return(&runner.RunResponse{
+		ExitCode: 0,
+	}, nil)
+	environment.EXPECT().Release()
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
+
+	// Even though the build action succeeded, its result may
+	// contain data derived from the secret. It must not be stored
+	// in the Action Cache.
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "nintendo64",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{},
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
+
+func TestLocalBuildExecutorTruncatedInlineLogs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments: []string{"echo", "Hello"},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{}, nil)
+
+	// Small output on stdout should be inlined, while large output
+	// on stderr should be truncated, followed by a notice.
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "0000000000000000000000000000000000000000000000000000000000000005",
+			SizeBytes: 6,
+		}), nil)
+	stdoutFile := mock.NewMockFile(ctrl)
+	buildDirectory.EXPECT().OpenFile(".stdout.txt", os.O_RDONLY, os.FileMode(0)).Return(stdoutFile, nil)
+	stdoutFile.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		return copy(p, "Hello\n"), nil
+	})
+	stdoutFile.EXPECT().Close()
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any()).Return(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "0000000000000000000000000000000000000000000000000000000000000006",
+			SizeBytes: 678,
+		}), nil)
+	stderrFile := mock.NewMockFile(ctrl)
+	buildDirectory.EXPECT().OpenFile(".stderr.txt", os.O_RDONLY, os.FileMode(0)).Return(stderrFile, nil)
+	stderrFile.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		return copy(p, "warning: unused variable"), nil
+	})
+	stderrFile.EXPECT().Close()
+	environmentManager := mock.NewMockManager(ctrl)
+	environment := mock.NewMockManagedEnvironment(ctrl)
+	environmentManager.EXPECT().Acquire(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		}),
+		map[string]string{},
+	).Return(environment, nil)
+	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
+	environment.EXPECT().Run(ctx, &runner.RunRequest{
+		Arguments:            []string{"echo", "Hello"},
+		EnvironmentVariables: map[string]string{},
+		WorkingDirectory:     "",
+		StdoutPath:           ".stdout.txt",
+		StderrPath:           ".stderr.txt",
+	}).Return(&runner.RunResponse{
+		ExitCode: 0,
+	}, nil)
+	environment.EXPECT().Release()
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 100, 16, 0, true, false, nil, nil)
+
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "nintendo64",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello\n"),
+			StderrRaw: []byte("warning: unused \n[Output truncated to 16 of 678 bytes. The full output is stored in the Content Addressable Storage as blob 0000000000000000000000000000000000000000000000000000000000000006-678.]\n"),
+			StdoutDigest: &remoteexecution.Digest{
+				Hash:      "0000000000000000000000000000000000000000000000000000000000000005",
+				SizeBytes: 6,
+			},
+			StderrDigest: &remoteexecution.Digest{
+				Hash:      "0000000000000000000000000000000000000000000000000000000000000006",
+				SizeBytes: 678,
+			},
+		},
+	}, executeResponse)
+	require.True(t, mayBeCached)
+}
+
+// TestLocalBuildExecutorOutputPaths tests that outputs declared
+// through output_paths are resolved relative to the working directory,
+// and that the type of every output is determined after execution.
+func TestLocalBuildExecutorOutputPaths(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments:        []string{"cc", "-o", "hello.o", "hello.c"},
+		WorkingDirectory: "sub",
+		OutputFiles:      []string{"ignored"},
+		OutputPaths:      []string{"hello.o", "hello"},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{}, nil)
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any()).Return(
+		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		}), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any()).Return(
+		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		}), nil)
+	resourceUsage := &resourceusage.POSIXResourceUsage{
+		UserTime:               &duration.Duration{Seconds: 1, Nanos: 500000000},
+		SystemTime:             &duration.Duration{Nanos: 250000000},
+		MaximumResidentSetSize: 12345678,
+	}
+	resourceUsageAny, err := ptypes.MarshalAny(resourceUsage)
+	require.NoError(t, err)
+	environmentManager := mock.NewMockManager(ctrl)
+	environment := mock.NewMockManagedEnvironment(ctrl)
+	environmentManager.EXPECT().Acquire(
+		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		}),
+		map[string]string{},
+	).Return(environment, nil)
+	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
+	buildDirectory.EXPECT().Mkdir("sub", os.FileMode(0777)).Return(os.ErrExist)
+	subDirectory := mock.NewMockDirectory(ctrl)
+	buildDirectory.EXPECT().Enter("sub").Return(subDirectory, nil)
+	environment.EXPECT().Run(ctx, &runner.RunRequest{
+		Arguments:            []string{"cc", "-o", "hello.o", "hello.c"},
+		EnvironmentVariables: map[string]string{},
+		WorkingDirectory:     "sub",
+		StdoutPath:           ".stdout.txt",
+		StderrPath:           ".stderr.txt",
+	}).Return(&runner.RunResponse{
+		ExitCode:      0,
+		ResourceUsage: resourceUsage,
+	}, nil)
+	subDirectory.EXPECT().Lstat("hello.o").Return(filesystem.NewSimpleFileInfo("hello.o", 0644), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, subDirectory, "hello.o", gomock.Any()).Return(
+		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+			SizeBytes: 1234,
+		}), nil)
+	subDirectory.EXPECT().Lstat("hello").Return(filesystem.NewSimpleFileInfo("hello", 0777|os.ModeSymlink), nil)
+	subDirectory.EXPECT().Readlink("hello").Return("hello.o", nil)
+	subDirectory.EXPECT().Close()
+	environment.EXPECT().Release()
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, 0, 0, 0, false, false, nil, nil)
+
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "ubuntu1804",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	})
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			OutputFiles: []*remoteexecution.OutputFile{
+				{
+					Path: "hello.o",
+					Digest: &remoteexecution.Digest{
+						Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+						SizeBytes: 1234,
+					},
+				},
+			},
+			OutputSymlinks: []*remoteexecution.OutputSymlink{
+				{
+					Path:   "hello",
+					Target: "hello.o",
+				},
+			},
+			ExecutionMetadata: &remoteexecution.ExecutedActionMetadata{
+				AuxiliaryMetadata: []*any.Any{resourceUsageAny},
+			},
+		},
+	}, executeResponse)
+	require.True(t, mayBeCached)
+}
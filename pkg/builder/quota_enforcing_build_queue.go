@@ -0,0 +1,52 @@
+package builder
+
+import (
+	"github.com/EdSchouten/bazel-buildbarn/pkg/quota"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type quotaEnforcingBuildQueue struct {
+	BuildQueue
+	tracker           quota.Tracker
+	identityExtractor quota.IdentityExtractor
+	excessPriority    *int32
+}
+
+// NewQuotaEnforcingBuildQueue creates an adapter for BuildQueue that
+// limits the number of actions that clients may execute. If no excess
+// priority is provided, execution requests that would cause a client
+// to exceed its quota fail with RESOURCE_EXHAUSTED. Otherwise, they
+// are forwarded with their priority lowered to the excess priority,
+// so that they only run when capacity is left over.
+//
+// This adapter should be placed underneath NewValidatingBuildQueue(),
+// so that requests that are answered with cached action results do
+// not count towards the quota.
+func NewQuotaEnforcingBuildQueue(base BuildQueue, tracker quota.Tracker, identityExtractor quota.IdentityExtractor, excessPriority *int32) BuildQueue {
+	return &quotaEnforcingBuildQueue{
+		BuildQueue:        base,
+		tracker:           tracker,
+		identityExtractor: identityExtractor,
+		excessPriority:    excessPriority,
+	}
+}
+
+func (bq *quotaEnforcingBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
+	identity := bq.identityExtractor(out.Context(), in.InstanceName)
+	if !bq.tracker.Consume(identity, 1) {
+		if bq.excessPriority == nil {
+			return status.Errorf(codes.ResourceExhausted, "Client %#v exceeded its execution quota", identity)
+		}
+		// Larger values correspond to lower priorities. Never
+		// raise the priority of requests.
+		if priority := in.ExecutionPolicy.GetPriority(); priority < *bq.excessPriority {
+			in = proto.Clone(in).(*remoteexecution.ExecuteRequest)
+			in.ExecutionPolicy = &remoteexecution.ExecutionPolicy{Priority: *bq.excessPriority}
+		}
+	}
+	return bq.BuildQueue.Execute(in, out)
+}
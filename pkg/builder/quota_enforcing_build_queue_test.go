@@ -0,0 +1,100 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/quota"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuotaEnforcingBuildQueueReject(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseBuildQueue := mock.NewMockBuildQueue(ctrl)
+	buildQueue := builder.NewQuotaEnforcingBuildQueue(
+		baseBuildQueue,
+		quota.NewSlidingWindowTracker("test", 1, time.Hour),
+		quota.NewHeaderIdentityExtractor(""),
+		nil)
+	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+	executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}
+
+	// The first request fits within the quota.
+	baseBuildQueue.EXPECT().Execute(request, executeServer).Return(nil)
+	require.NoError(t, buildQueue.Execute(request, executeServer))
+
+	// The second request should be rejected.
+	require.Equal(
+		t,
+		status.Error(codes.ResourceExhausted, "Client \"debian8\" exceeded its execution quota"),
+		buildQueue.Execute(request, executeServer))
+
+	// Other instances have a quota of their own.
+	otherRequest := &remoteexecution.ExecuteRequest{
+		InstanceName: "ubuntu1804",
+		ActionDigest: request.ActionDigest,
+	}
+	baseBuildQueue.EXPECT().Execute(otherRequest, executeServer).Return(nil)
+	require.NoError(t, buildQueue.Execute(otherRequest, executeServer))
+}
+
+func TestQuotaEnforcingBuildQueueDeprioritize(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseBuildQueue := mock.NewMockBuildQueue(ctrl)
+	excessPriority := int32(1000)
+	buildQueue := builder.NewQuotaEnforcingBuildQueue(
+		baseBuildQueue,
+		quota.NewSlidingWindowTracker("test", 1, time.Hour),
+		quota.NewHeaderIdentityExtractor(""),
+		&excessPriority)
+	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+	executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+		ExecutionPolicy: &remoteexecution.ExecutionPolicy{Priority: 5},
+	}
+
+	// The first request fits within the quota.
+	baseBuildQueue.EXPECT().Execute(request, executeServer).Return(nil)
+	require.NoError(t, buildQueue.Execute(request, executeServer))
+
+	// The second request should be forwarded with a lower
+	// priority, without modifying the original request.
+	baseBuildQueue.EXPECT().Execute(&remoteexecution.ExecuteRequest{
+		InstanceName:    "debian8",
+		ActionDigest:    request.ActionDigest,
+		ExecutionPolicy: &remoteexecution.ExecutionPolicy{Priority: 1000},
+	}, executeServer).Return(nil)
+	require.NoError(t, buildQueue.Execute(request, executeServer))
+	require.Equal(t, int32(5), request.ExecutionPolicy.Priority)
+
+	// Requests that already have a lower priority are left alone.
+	lowPriorityRequest := &remoteexecution.ExecuteRequest{
+		InstanceName:    "debian8",
+		ActionDigest:    request.ActionDigest,
+		ExecutionPolicy: &remoteexecution.ExecutionPolicy{Priority: 2000},
+	}
+	baseBuildQueue.EXPECT().Execute(lowPriorityRequest, executeServer).Return(nil)
+	require.NoError(t, buildQueue.Execute(lowPriorityRequest, executeServer))
+}
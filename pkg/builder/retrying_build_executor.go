@@ -0,0 +1,180 @@
+package builder
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Maximum amount of standard error output of a build action that is
+// matched against the patterns of transient failures.
+const retryingBuildExecutorMaximumStderrSizeBytes = 1 << 20
+
+var (
+	retryingBuildExecutorRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "retrying_build_executor_retries_total",
+			Help:      "Total number of build actions that were retried, as they failed in a way that is known to be transient.",
+		},
+		[]string{"reason"})
+	retryingBuildExecutorRetriesExhaustedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "retrying_build_executor_retries_exhausted_total",
+			Help:      "Total number of build actions that kept failing in a way that is known to be transient, even after retrying.",
+		},
+		[]string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(retryingBuildExecutorRetriesTotal)
+	prometheus.MustRegister(retryingBuildExecutorRetriesExhaustedTotal)
+}
+
+// TransientFailureSignature describes a way in which build actions
+// may fail that is caused by problems with the infrastructure, as
+// opposed to problems with the build action itself (e.g., SIGBUS
+// caused by a flaky file system, or an internal compiler error caused
+// by memory corruption).
+type TransientFailureSignature struct {
+	// Name of the signature, used as the label of metrics.
+	Name string
+	// Exit codes of the build action that match this signature. Any
+	// non-zero exit code matches if empty.
+	ExitCodes []int32
+	// Pattern that the standard error output of the build action
+	// should match. Not checked if nil.
+	StderrPattern *regexp.Regexp
+}
+
+func (s *TransientFailureSignature) matchesExitCode(exitCode int32) bool {
+	if len(s.ExitCodes) == 0 {
+		return true
+	}
+	for _, matchingExitCode := range s.ExitCodes {
+		if exitCode == matchingExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+type retryingBuildExecutor struct {
+	base                      BuildExecutor
+	contentAddressableStorage blobstore.BlobAccess
+	flush                     func(context.Context) error
+	signatures                []TransientFailureSignature
+	maxRetries                int
+}
+
+// NewRetryingBuildExecutor is an adapter for BuildExecutor that
+// executes build actions again if they fail in a way that matches one
+// of a list of signatures of transient failures. Build actions are
+// retried at most a given number of times, after which the failure is
+// reported.
+//
+// As the standard error output of build actions may not be stored in
+// the action result inline, it may need to be loaded from the Content
+// Addressable Storage (CAS). The flush function is called before doing
+// so, to ensure pending writes of the build action have completed.
+// This adapter should be placed below CachingBuildExecutor, so that
+// results of attempts that are retried are not stored.
+func NewRetryingBuildExecutor(base BuildExecutor, contentAddressableStorage blobstore.BlobAccess, flush func(context.Context) error, signatures []TransientFailureSignature, maxRetries int) BuildExecutor {
+	return &retryingBuildExecutor{
+		base:                      base,
+		contentAddressableStorage: contentAddressableStorage,
+		flush:                     flush,
+		signatures:                signatures,
+		maxRetries:                maxRetries,
+	}
+}
+
+func (be *retryingBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
+	for attempt := 0; ; attempt++ {
+		response, mayBeCached := be.base.Execute(ctx, request)
+		signature, err := be.getTransientFailureSignature(ctx, request.InstanceName, response)
+		if err != nil {
+			// Failing to check for transient failures should
+			// not mask the outcome of the build action.
+			logging.FromContext(ctx).WithError(err).Warn("Failed to check for transient failures")
+			return response, mayBeCached
+		}
+		if signature == nil || ctx.Err() != nil {
+			return response, mayBeCached
+		}
+		if attempt >= be.maxRetries {
+			retryingBuildExecutorRetriesExhaustedTotal.WithLabelValues(signature.Name).Inc()
+			return response, mayBeCached
+		}
+		retryingBuildExecutorRetriesTotal.WithLabelValues(signature.Name).Inc()
+		logging.FromContext(ctx).WithField("reason", signature.Name).Warnf("Retrying build action after transient failure (attempt %d of %d)", attempt+1, be.maxRetries)
+	}
+}
+
+// getTransientFailureSignature returns the first signature of a
+// transient failure that matches the response of a build action, or
+// nil if the build action succeeded or failed in another way.
+func (be *retryingBuildExecutor) getTransientFailureSignature(ctx context.Context, instance string, response *remoteexecution.ExecuteResponse) (*TransientFailureSignature, error) {
+	actionResult := response.Result
+	if actionResult == nil || actionResult.ExitCode == 0 {
+		return nil, nil
+	}
+
+	// Only load the standard error output if at least one of the
+	// signatures with a matching exit code needs it.
+	var stderr []byte
+	stderrLoaded := false
+	for i := range be.signatures {
+		signature := &be.signatures[i]
+		if !signature.matchesExitCode(actionResult.ExitCode) {
+			continue
+		}
+		if signature.StderrPattern != nil {
+			if !stderrLoaded {
+				var err error
+				if stderr, err = be.getStderr(ctx, instance, actionResult); err != nil {
+					return nil, err
+				}
+				stderrLoaded = true
+			}
+			if !signature.StderrPattern.Match(stderr) {
+				continue
+			}
+		}
+		return signature, nil
+	}
+	return nil, nil
+}
+
+func (be *retryingBuildExecutor) getStderr(ctx context.Context, instance string, actionResult *remoteexecution.ActionResult) ([]byte, error) {
+	if actionResult.StderrDigest == nil || int64(len(actionResult.StderrRaw)) == actionResult.StderrDigest.SizeBytes {
+		return actionResult.StderrRaw, nil
+	}
+	stderrDigest, err := util.NewDigest(instance, actionResult.StderrDigest)
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to extract digest for stderr")
+	}
+	if err := be.flush(ctx); err != nil {
+		return nil, util.StatusWrap(err, "Failed to flush stderr")
+	}
+	_, r, err := be.contentAddressableStorage.Get(ctx, stderrDigest)
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to load stderr")
+	}
+	defer r.Close()
+	stderr, err := ioutil.ReadAll(io.LimitReader(r, retryingBuildExecutorMaximumStderrSizeBytes))
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to load stderr")
+	}
+	return stderr, nil
+}
@@ -0,0 +1,146 @@
+package builder_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryingBuildExecutor(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBuildExecutor := mock.NewMockBuildExecutor(ctrl)
+	contentAddressableStorage := mock.NewMockBlobAccess(ctrl)
+	flushCalls := 0
+	buildExecutor := builder.NewRetryingBuildExecutor(
+		baseBuildExecutor,
+		contentAddressableStorage,
+		func(ctx context.Context) error {
+			flushCalls++
+			return nil
+		},
+		[]builder.TransientFailureSignature{
+			{
+				Name:      "SIGBUS",
+				ExitCodes: []int32{135},
+			},
+			{
+				Name:          "InternalCompilerError",
+				StderrPattern: regexp.MustCompile("internal compiler error"),
+			},
+		},
+		2)
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		response := &remoteexecution.ExecuteResponse{
+			Result: &remoteexecution.ActionResult{ExitCode: 0},
+		}
+		baseBuildExecutor.EXPECT().Execute(ctx, request).Return(response, true)
+
+		executeResponse, mayBeCached := buildExecutor.Execute(ctx, request)
+		require.Equal(t, response, executeResponse)
+		require.True(t, mayBeCached)
+	})
+
+	t.Run("NonTransientFailure", func(t *testing.T) {
+		// Failures not matching any of the signatures should
+		// be returned immediately.
+		response := &remoteexecution.ExecuteResponse{
+			Result: &remoteexecution.ActionResult{
+				ExitCode:  1,
+				StderrRaw: []byte("hello.c:1:1: error: unknown type name 'foo'\n"),
+			},
+		}
+		baseBuildExecutor.EXPECT().Execute(ctx, request).Return(response, false)
+
+		executeResponse, mayBeCached := buildExecutor.Execute(ctx, request)
+		require.Equal(t, response, executeResponse)
+		require.False(t, mayBeCached)
+	})
+
+	t.Run("RetrySucceeds", func(t *testing.T) {
+		// The build action crashing with SIGBUS should cause
+		// it to be executed again.
+		response := &remoteexecution.ExecuteResponse{
+			Result: &remoteexecution.ActionResult{ExitCode: 0},
+		}
+		gomock.InOrder(
+			baseBuildExecutor.EXPECT().Execute(ctx, request).Return(&remoteexecution.ExecuteResponse{
+				Result: &remoteexecution.ActionResult{ExitCode: 135},
+			}, false),
+			baseBuildExecutor.EXPECT().Execute(ctx, request).Return(response, true))
+
+		executeResponse, mayBeCached := buildExecutor.Execute(ctx, request)
+		require.Equal(t, response, executeResponse)
+		require.True(t, mayBeCached)
+	})
+
+	t.Run("RetriesExhausted", func(t *testing.T) {
+		// Standard error output that is not stored inline
+		// should be loaded from the CAS after flushing.
+		stderrDigest := &remoteexecution.Digest{
+			Hash:      "d8a8a3fd4fa0ec9ea3e52b2bbb3b3ae2a8b3e2e2a12ce85c0a3d1ee3fbb0a4c5",
+			SizeBytes: 38,
+		}
+		response := &remoteexecution.ExecuteResponse{
+			Result: &remoteexecution.ActionResult{
+				ExitCode:     4,
+				StderrDigest: stderrDigest,
+			},
+		}
+		baseBuildExecutor.EXPECT().Execute(ctx, request).Return(response, false).Times(3)
+		contentAddressableStorage.EXPECT().Get(ctx, util.MustNewDigest("debian8", stderrDigest)).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+				return 38, ioutil.NopCloser(bytes.NewBufferString("hello.c: internal compiler error: oops")), nil
+			}).Times(3)
+
+		flushCalls = 0
+		executeResponse, mayBeCached := buildExecutor.Execute(ctx, request)
+		require.Equal(t, response, executeResponse)
+		require.False(t, mayBeCached)
+		require.Equal(t, 3, flushCalls)
+	})
+
+	t.Run("StderrUnavailable", func(t *testing.T) {
+		// Failing to load the standard error output should not
+		// mask the outcome of the build action.
+		stderrDigest := &remoteexecution.Digest{
+			Hash:      "d8a8a3fd4fa0ec9ea3e52b2bbb3b3ae2a8b3e2e2a12ce85c0a3d1ee3fbb0a4c5",
+			SizeBytes: 38,
+		}
+		response := &remoteexecution.ExecuteResponse{
+			Result: &remoteexecution.ActionResult{
+				ExitCode:     4,
+				StderrDigest: stderrDigest,
+			},
+		}
+		baseBuildExecutor.EXPECT().Execute(ctx, request).Return(response, true)
+		contentAddressableStorage.EXPECT().Get(ctx, util.MustNewDigest("debian8", stderrDigest)).
+			Return(int64(0), nil, status.Error(codes.Unavailable, "Storage offline"))
+
+		executeResponse, mayBeCached := buildExecutor.Execute(ctx, request)
+		require.Equal(t, response, executeResponse)
+		require.True(t, mayBeCached)
+	})
+}
@@ -0,0 +1,235 @@
+package builder
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/testresult"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+)
+
+const (
+	// Maximum size of JUnit XML files that are parsed to summarize
+	// test results. Larger files are still uploaded.
+	testXMLMaximumSizeBytes = 16 << 20
+	// Maximum number of failed test cases and the maximum length
+	// of their messages stored in a TestResultSummary, to keep
+	// action results small.
+	testResultMaximumFailedTestCases = 100
+	testResultMaximumMessageLength   = 1024
+)
+
+// testCommand contains the paths of the outputs that Bazel test
+// actions are expected to generate, as provided through their
+// environment variables. Paths are relative to the working directory.
+type testCommand struct {
+	target              string
+	shardIndex          int32
+	xmlOutputFile       string
+	undeclaredOutputDir string
+}
+
+// getTestCommand returns whether a command is a Bazel test action,
+// which is the case if the environment variables that Bazel sets for
+// test actions are present.
+func getTestCommand(command *remoteexecution.Command) (*testCommand, bool) {
+	environmentVariables := map[string]string{}
+	for _, environmentVariable := range command.EnvironmentVariables {
+		environmentVariables[environmentVariable.Name] = environmentVariable.Value
+	}
+	_, hasXMLOutputFile := environmentVariables["XML_OUTPUT_FILE"]
+	_, hasTestTmpdir := environmentVariables["TEST_TMPDIR"]
+	if !hasXMLOutputFile && !hasTestTmpdir {
+		return nil, false
+	}
+	tc := &testCommand{
+		target:              environmentVariables["TEST_TARGET"],
+		xmlOutputFile:       getTestOutputPath(environmentVariables["XML_OUTPUT_FILE"]),
+		undeclaredOutputDir: getTestOutputPath(environmentVariables["TEST_UNDECLARED_OUTPUTS_DIR"]),
+	}
+	if shardIndex, err := strconv.ParseInt(environmentVariables["TEST_SHARD_INDEX"], 10, 32); err == nil {
+		tc.shardIndex = int32(shardIndex)
+	}
+	return tc, true
+}
+
+// getTestOutputPath sanitizes a path provided through an environment
+// variable of a test action. Only paths that are relative to the
+// working directory can be uploaded.
+func getTestOutputPath(p string) string {
+	if p == "" || path.IsAbs(p) {
+		return ""
+	}
+	p = path.Clean(p)
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return ""
+	}
+	return p
+}
+
+// addOutputs extends the list of outputs of a test action with the
+// JUnit XML file and the undeclared outputs directory, so that they
+// are uploaded even if the client did not declare them as outputs.
+func (tc *testCommand) addOutputs(outputs []localBuildExecutorOutput) []localBuildExecutorOutput {
+	for _, extraOutput := range []localBuildExecutorOutput{
+		{path: tc.xmlOutputFile, kind: localBuildExecutorOutputFile},
+		{path: tc.undeclaredOutputDir, kind: localBuildExecutorOutputDirectory},
+	} {
+		if extraOutput.path == "" {
+			continue
+		}
+		found := false
+		for _, output := range outputs {
+			if output.path == extraOutput.path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			outputs = append(outputs, extraOutput)
+		}
+	}
+	return outputs
+}
+
+// junitTestSuite is the subset of the JUnit XML format that is needed
+// to summarize test results. Both <testsuites> and <testsuite> root
+// elements can be decoded into this type, as suites may be nested.
+type junitTestSuite struct {
+	TestSuites []junitTestSuite `xml:"testsuite"`
+	TestCases  []junitTestCase  `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string         `xml:"classname,attr"`
+	Name      string         `xml:"name,attr"`
+	Status    string         `xml:"status,attr"`
+	Failures  []junitFailure `xml:"failure"`
+	Errors    []junitFailure `xml:"error"`
+	Skipped   []junitFailure `xml:"skipped"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// summarize adds the outcomes of all test cases in a suite to a
+// TestResultSummary.
+func (ts *junitTestSuite) summarize(summary *testresult.TestResultSummary) {
+	for i := range ts.TestSuites {
+		ts.TestSuites[i].summarize(summary)
+	}
+	for _, testCase := range ts.TestCases {
+		summary.Tests++
+		var failure *junitFailure
+		if len(testCase.Errors) > 0 {
+			summary.Errors++
+			failure = &testCase.Errors[0]
+		} else if len(testCase.Failures) > 0 {
+			summary.Failures++
+			failure = &testCase.Failures[0]
+		} else if len(testCase.Skipped) > 0 || testCase.Status == "notrun" {
+			summary.Skipped++
+		}
+		if failure != nil && len(summary.FailedTestCases) < testResultMaximumFailedTestCases {
+			message := failure.Message
+			if len(message) > testResultMaximumMessageLength {
+				n := testResultMaximumMessageLength
+				for n > 0 && !utf8.RuneStart(message[n]) {
+					n--
+				}
+				message = message[:n]
+			}
+			summary.FailedTestCases = append(summary.FailedTestCases, &testresult.FailedTestCase{
+				ClassName: testCase.ClassName,
+				Name:      testCase.Name,
+				Message:   message,
+			})
+		}
+	}
+}
+
+// summarizeTestXML parses a JUnit XML file and adds the outcomes of
+// its test cases to a TestResultSummary.
+func summarizeTestXML(data []byte, summary *testresult.TestResultSummary) error {
+	var testSuite junitTestSuite
+	if err := xml.Unmarshal(data, &testSuite); err != nil {
+		return err
+	}
+	testSuite.summarize(summary)
+	return nil
+}
+
+// attachTestResultSummary adds a TestResultSummary to the metadata of
+// the action result of a test action. The JUnit XML file generated by
+// the test is parsed to obtain the outcomes of individual test cases.
+// As the XML file is provided by the test itself, failures to parse it
+// are logged instead of causing the action to fail.
+func (be *localBuildExecutor) attachTestResultSummary(ctx context.Context, tc *testCommand, outputParentDirectories map[string]filesystem.Directory, actionResult *remoteexecution.ActionResult) error {
+	summary := &testresult.TestResultSummary{
+		TestTarget: tc.target,
+		ShardIndex: tc.shardIndex,
+	}
+	for _, outputFile := range actionResult.OutputFiles {
+		if tc.xmlOutputFile == "" || outputFile.Path != tc.xmlOutputFile {
+			continue
+		}
+		summary.TestXmlDigest = outputFile.Digest
+		if sizeBytes := outputFile.Digest.SizeBytes; sizeBytes <= testXMLMaximumSizeBytes {
+			data, err := readTestXML(outputParentDirectories[path.Dir(tc.xmlOutputFile)], path.Base(tc.xmlOutputFile), sizeBytes)
+			if err == nil {
+				err = summarizeTestXML(data, summary)
+			}
+			if err != nil {
+				logging.FromContext(ctx).WithError(err).Warn("Failed to summarize test results")
+			}
+		}
+		break
+	}
+
+	testResultSummary, err := ptypes.MarshalAny(summary)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to marshal test result summary")
+	}
+	if actionResult.ExecutionMetadata == nil {
+		actionResult.ExecutionMetadata = &remoteexecution.ExecutedActionMetadata{}
+	}
+	actionResult.ExecutionMetadata.AuxiliaryMetadata = append(actionResult.ExecutionMetadata.AuxiliaryMetadata, testResultSummary)
+	return nil
+}
+
+func readTestXML(directory filesystem.Directory, name string, sizeBytes int64) ([]byte, error) {
+	file, err := directory.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, sizeBytes)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GetTestResultSummary extracts the summary of a test action that a
+// worker attached to the metadata of an action result. It returns nil
+// if the action result does not belong to a test action.
+func GetTestResultSummary(actionResult *remoteexecution.ActionResult) *testresult.TestResultSummary {
+	for _, auxiliaryMetadata := range actionResult.GetExecutionMetadata().GetAuxiliaryMetadata() {
+		var summary testresult.TestResultSummary
+		if ptypes.UnmarshalAny(auxiliaryMetadata, &summary) == nil {
+			return &summary
+		}
+	}
+	return nil
+}
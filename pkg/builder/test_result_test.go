@@ -0,0 +1,59 @@
+package builder_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/testresult"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetTestResultSummary(t *testing.T) {
+	t.Run("NoMetadata", func(t *testing.T) {
+		require.Nil(t, builder.GetTestResultSummary(&remoteexecution.ActionResult{}))
+	})
+
+	t.Run("NotATest", func(t *testing.T) {
+		resourceUsage, err := ptypes.MarshalAny(&resourceusage.POSIXResourceUsage{})
+		require.NoError(t, err)
+		require.Nil(t, builder.GetTestResultSummary(&remoteexecution.ActionResult{
+			ExecutionMetadata: &remoteexecution.ExecutedActionMetadata{
+				AuxiliaryMetadata: []*any.Any{resourceUsage},
+			},
+		}))
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		summary := &testresult.TestResultSummary{
+			TestTarget: "//foo:bar_test",
+			ShardIndex: 2,
+			TestXmlDigest: &remoteexecution.Digest{
+				Hash:      "8b1a9953c4611296a827abf8c47804d7e6c49c6b6b3e67d5c2d8ed41e2c57eb0",
+				SizeBytes: 1234,
+			},
+			Tests:    3,
+			Failures: 1,
+			FailedTestCases: []*testresult.FailedTestCase{
+				{
+					ClassName: "foo.BarTest",
+					Name:      "testBaz",
+					Message:   "expected 1, got 2",
+				},
+			},
+		}
+		resourceUsage, err := ptypes.MarshalAny(&resourceusage.POSIXResourceUsage{})
+		require.NoError(t, err)
+		testResultSummary, err := ptypes.MarshalAny(summary)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(summary, builder.GetTestResultSummary(&remoteexecution.ActionResult{
+			ExecutionMetadata: &remoteexecution.ExecutedActionMetadata{
+				AuxiliaryMetadata: []*any.Any{resourceUsage, testResultSummary},
+			},
+		})))
+	})
+}
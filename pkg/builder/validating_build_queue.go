@@ -0,0 +1,155 @@
+package builder
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type validatingBuildQueue struct {
+	BuildQueue
+	contentAddressableStorageBlobAccess blobstore.BlobAccess
+	contentAddressableStorage           cas.ContentAddressableStorage
+	actionCache                         ac.ActionCache
+	browserURL                          *url.URL
+}
+
+// NewValidatingBuildQueue creates an adapter for BuildQueue that
+// validates execution requests before forwarding them. It checks
+// whether the action, its command and its input root are present in
+// the Content Addressable Storage (CAS). Unless the client requested
+// the cache lookup to be skipped or the action has do_not_cache set,
+// it also checks whether the Action Cache (AC) already contains a
+// result for the action. For actions that have do_not_cache set, the
+// cache lookup is skipped by workers as well. If a browser URL is
+// provided, a link to bbb_browser is added to results obtained from the
+// Action Cache.
+//
+// This adapter is used by the frontend processes to prevent malformed
+// or already cached actions from consuming capacity of schedulers and
+// workers.
+func NewValidatingBuildQueue(base BuildQueue, contentAddressableStorageBlobAccess blobstore.BlobAccess, actionCache ac.ActionCache, browserURL *url.URL) BuildQueue {
+	return &validatingBuildQueue{
+		BuildQueue:                          base,
+		contentAddressableStorageBlobAccess: contentAddressableStorageBlobAccess,
+		contentAddressableStorage: cas.NewBlobAccessContentAddressableStorage(
+			blobstore.NewExistencePreconditionBlobAccess(contentAddressableStorageBlobAccess)),
+		actionCache: actionCache,
+		browserURL:  browserURL,
+	}
+}
+
+func (bq *validatingBuildQueue) checkInputsPresent(out remoteexecution.Execution_ExecuteServer, actionDigest *util.Digest, action *remoteexecution.Action) error {
+	if action.CommandDigest == nil {
+		return status.Error(codes.InvalidArgument, "Action does not contain a command digest")
+	}
+	commandDigest, err := actionDigest.NewDerivedDigest(action.CommandDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to extract digest for command")
+	}
+	if action.InputRootDigest == nil {
+		return status.Error(codes.InvalidArgument, "Action does not contain an input root digest")
+	}
+	inputRootDigest, err := actionDigest.NewDerivedDigest(action.InputRootDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to extract digest for input root")
+	}
+
+	missing, err := bq.contentAddressableStorageBlobAccess.FindMissing(out.Context(), []*util.Digest{commandDigest, inputRootDigest})
+	if err != nil {
+		return util.StatusWrap(err, "Failed to determine existence of command and input root")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	var violations []*errdetails.PreconditionFailure_Violation
+	for _, digest := range missing {
+		violations = append(violations, &errdetails.PreconditionFailure_Violation{
+			Type:    "MISSING",
+			Subject: fmt.Sprintf("blobs/%s/%d", digest.GetHashString(), digest.GetSizeBytes()),
+		})
+	}
+	s, err := status.New(codes.FailedPrecondition, "Command or input root not present in the Content Addressable Storage").WithDetails(
+		&errdetails.PreconditionFailure{Violations: violations})
+	if err != nil {
+		return err
+	}
+	return s.Err()
+}
+
+func (bq *validatingBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
+	actionDigest, err := util.NewDigest(in.InstanceName, in.ActionDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to extract digest for action")
+	}
+	action, err := bq.contentAddressableStorage.GetAction(out.Context(), actionDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to obtain action")
+	}
+	if err := bq.checkInputsPresent(out, actionDigest, action); err != nil {
+		return err
+	}
+
+	// Return results of actions that have been executed previously
+	// without involving the scheduler.
+	if action.DoNotCache && !in.SkipCacheLookup {
+		// Prevent workers from consulting the Action Cache
+		// prior to executing the action as well.
+		request := *in
+		request.SkipCacheLookup = true
+		in = &request
+	}
+	if !in.SkipCacheLookup {
+		result, err := bq.actionCache.GetActionResult(out.Context(), actionDigest)
+		if err == nil {
+			var message string
+			if bq.browserURL != nil {
+				message = "Action details (cached result): " + getBrowserURL(bq.browserURL, "action", actionDigest)
+			}
+			return sendCachedActionResult(out, in.ActionDigest, result, message)
+		} else if status.Code(err) != codes.NotFound {
+			logging.WithActionDigest(logging.FromContext(out.Context()), actionDigest).WithError(err).Warn("Failed to look up action result")
+		}
+	}
+	return bq.BuildQueue.Execute(in, out)
+}
+
+// sendCachedActionResult sends a single completed operation to the
+// client, containing an action result obtained from the Action Cache.
+func sendCachedActionResult(out remoteexecution.Execution_ExecuteServer, actionDigest *remoteexecution.Digest, result *remoteexecution.ActionResult, message string) error {
+	metadata, err := ptypes.MarshalAny(&remoteexecution.ExecuteOperationMetadata{
+		Stage:        remoteexecution.ExecuteOperationMetadata_COMPLETED,
+		ActionDigest: actionDigest,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to marshal execute operation metadata")
+	}
+	response, err := ptypes.MarshalAny(&remoteexecution.ExecuteResponse{
+		Result:       result,
+		CachedResult: true,
+		Message:      message,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to marshal execute response")
+	}
+	return out.Send(&longrunning.Operation{
+		Name:     uuid.Must(uuid.NewRandom()).String(),
+		Metadata: metadata,
+		Done:     true,
+		Result:   &longrunning.Operation_Response{Response: response},
+	})
+}
@@ -0,0 +1,173 @@
+package builder_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func expectGetAction(t *testing.T, blobAccess *mock.MockBlobAccess, digest *util.Digest, action *remoteexecution.Action) {
+	data, err := proto.Marshal(action)
+	require.NoError(t, err)
+	blobAccess.EXPECT().Get(gomock.Any(), digest).Return(int64(len(data)), ioutil.NopCloser(bytes.NewBuffer(data)), nil)
+}
+
+func TestValidatingBuildQueueMissingInputRoot(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseBuildQueue := mock.NewMockBuildQueue(ctrl)
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	actionCache := mock.NewMockActionCache(ctrl)
+	buildQueue := builder.NewValidatingBuildQueue(baseBuildQueue, blobAccess, actionCache, nil)
+
+	// Actions whose input root is absent should be rejected.
+	expectGetAction(t, blobAccess, util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+		SizeBytes: 11,
+	}), &remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "f11999245771a5c184b62dc5380e0d8b42df67b5d8cd8a9fc2ed57a7e2f1d5e5",
+			SizeBytes: 42,
+		},
+	})
+	inputRootDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "f11999245771a5c184b62dc5380e0d8b42df67b5d8cd8a9fc2ed57a7e2f1d5e5",
+		SizeBytes: 42,
+	})
+	blobAccess.EXPECT().FindMissing(ctx, []*util.Digest{
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		}),
+		inputRootDigest,
+	}).Return([]*util.Digest{inputRootDigest}, nil)
+	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+	executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+
+	err := buildQueue.Execute(&remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}, executeServer)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestValidatingBuildQueueCachedResult(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseBuildQueue := mock.NewMockBuildQueue(ctrl)
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	actionCache := mock.NewMockActionCache(ctrl)
+	buildQueue := builder.NewValidatingBuildQueue(baseBuildQueue, blobAccess, actionCache, &url.URL{
+		Scheme: "https",
+		Host:   "example.com",
+	})
+
+	// Actions for which a result is present in the Action Cache
+	// should not be forwarded to the scheduler. A link to the
+	// browser should be attached to the response.
+	actionDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+		SizeBytes: 11,
+	})
+	expectGetAction(t, blobAccess, actionDigest, &remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "f11999245771a5c184b62dc5380e0d8b42df67b5d8cd8a9fc2ed57a7e2f1d5e5",
+			SizeBytes: 42,
+		},
+	})
+	blobAccess.EXPECT().FindMissing(ctx, gomock.Any()).Return(nil, nil)
+	actionCache.EXPECT().GetActionResult(ctx, actionDigest).Return(&remoteexecution.ActionResult{
+		ExitCode: 0,
+	}, nil)
+	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+	executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+	executeServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(operation *longrunning.Operation) error {
+		require.True(t, operation.Done)
+		var response remoteexecution.ExecuteResponse
+		require.NoError(t, ptypes.UnmarshalAny(operation.GetResponse(), &response))
+		require.True(t, response.CachedResult)
+		require.Equal(t, &remoteexecution.ActionResult{}, response.Result)
+		require.Equal(t, "Action details (cached result): https://example.com/action/debian8/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c/11/", response.Message)
+		return nil
+	})
+
+	require.NoError(t, buildQueue.Execute(&remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}, executeServer))
+}
+
+func TestValidatingBuildQueueDoNotCache(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseBuildQueue := mock.NewMockBuildQueue(ctrl)
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	actionCache := mock.NewMockActionCache(ctrl)
+	buildQueue := builder.NewValidatingBuildQueue(baseBuildQueue, blobAccess, actionCache, nil)
+
+	// Actions that have do_not_cache set should not be looked up
+	// in the Action Cache. Workers should be instructed not to
+	// look them up either.
+	expectGetAction(t, blobAccess, util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+		SizeBytes: 11,
+	}), &remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "f11999245771a5c184b62dc5380e0d8b42df67b5d8cd8a9fc2ed57a7e2f1d5e5",
+			SizeBytes: 42,
+		},
+		DoNotCache: true,
+	})
+	blobAccess.EXPECT().FindMissing(ctx, gomock.Any()).Return(nil, nil)
+	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+	executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+	baseBuildQueue.EXPECT().Execute(&remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+		SkipCacheLookup: true,
+	}, executeServer).Return(nil)
+
+	require.NoError(t, buildQueue.Execute(&remoteexecution.ExecuteRequest{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}, executeServer))
+}
@@ -0,0 +1,30 @@
+package builder
+
+import (
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// newWorkRequest creates a WorkRequest that instructs a worker to
+// process an execute request.
+func newWorkRequest(executeRequest *remoteexecution.ExecuteRequest) *scheduler.WorkRequest {
+	return &scheduler.WorkRequest{
+		InstanceName:       executeRequest.InstanceName,
+		SkipCacheLookup:    executeRequest.SkipCacheLookup,
+		ActionDigest:       executeRequest.ActionDigest,
+		ExecutionPolicy:    executeRequest.ExecutionPolicy,
+		ResultsCachePolicy: executeRequest.ResultsCachePolicy,
+	}
+}
+
+// GetExecuteRequest returns the execute request that should be
+// processed by a worker upon receiving a WorkRequest.
+func GetExecuteRequest(request *scheduler.WorkRequest) *remoteexecution.ExecuteRequest {
+	return &remoteexecution.ExecuteRequest{
+		InstanceName:       request.InstanceName,
+		SkipCacheLookup:    request.SkipCacheLookup,
+		ActionDigest:       request.ActionDigest,
+		ExecutionPolicy:    request.ExecutionPolicy,
+		ResultsCachePolicy: request.ResultsCachePolicy,
+	}
+}
@@ -0,0 +1,65 @@
+package builder_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkRequestWireCompatibility(t *testing.T) {
+	request := &scheduler.WorkRequest{
+		InstanceName:    "debian8",
+		SkipCacheLookup: true,
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+		ExecutionPolicy: &remoteexecution.ExecutionPolicy{
+			Priority: 5,
+		},
+		ResultsCachePolicy: &remoteexecution.ResultsCachePolicy{
+			Priority: 7,
+		},
+		TraceContext: map[string]string{
+			"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		OperationName:         "b9a25ae1-9ad6-4e8a-8c1b-3e2e4e6bcc3a",
+		Worker:                &scheduler.WorkerIdentity{Id: "worker-0123abcd"},
+		PreviousOperationName: "4ac0fa5b-6d6a-4d2b-a5bc-b8b7d96e8e57",
+		FlushCache:            true,
+	}
+	expectedExecuteRequest := &remoteexecution.ExecuteRequest{
+		InstanceName:    "debian8",
+		SkipCacheLookup: true,
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+		ExecutionPolicy: &remoteexecution.ExecutionPolicy{
+			Priority: 5,
+		},
+		ResultsCachePolicy: &remoteexecution.ResultsCachePolicy{
+			Priority: 7,
+		},
+	}
+
+	// Workers obtain the execute request from the WorkRequest.
+	require.True(t, proto.Equal(expectedExecuteRequest, builder.GetExecuteRequest(request)))
+
+	// Workers that still expect an ExecuteRequest to be sent by the
+	// scheduler should be able to parse a WorkRequest, ignoring the
+	// fields that are specific to Buildbarn.
+	data, err := proto.Marshal(request)
+	require.NoError(t, err)
+	var executeRequest remoteexecution.ExecuteRequest
+	require.NoError(t, proto.Unmarshal(data, &executeRequest))
+	require.Equal(t, expectedExecuteRequest.InstanceName, executeRequest.InstanceName)
+	require.Equal(t, expectedExecuteRequest.SkipCacheLookup, executeRequest.SkipCacheLookup)
+	require.True(t, proto.Equal(expectedExecuteRequest.ActionDigest, executeRequest.ActionDigest))
+	require.True(t, proto.Equal(expectedExecuteRequest.ExecutionPolicy, executeRequest.ExecutionPolicy))
+	require.True(t, proto.Equal(expectedExecuteRequest.ResultsCachePolicy, executeRequest.ResultsCachePolicy))
+}
@@ -3,22 +3,117 @@ package builder
 import (
 	"container/heap"
 	"context"
-	"log"
 	"math"
 	"sync"
+	"time"
 
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/outputstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/tracing"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/bazelbuild/remote-apis/build/bazel/semver"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 
 	"google.golang.org/genproto/googleapis/longrunning"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
+var (
+	workerBuildQueueJobsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_jobs_total",
+			Help:      "Total number of execution requests received by the worker build queue.",
+		},
+		[]string{"instance_name", "result"})
+	workerBuildQueueJobsPending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_jobs_pending",
+			Help:      "Number of build actions that are queued, waiting to be executed by a worker.",
+		},
+		[]string{"instance_name"})
+	workerBuildQueueJobsQueuedDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_jobs_queued_duration_seconds",
+			Help:      "Amount of time build actions spent in the queue before being dispatched to a worker, in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, math.Pow(10.0, 1.0/3.0), 7*3+1),
+		},
+		[]string{"instance_name"})
+	workerBuildQueueJobsDispatchedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_jobs_dispatched_total",
+			Help:      "Total number of build actions dispatched to workers.",
+		},
+		[]string{"instance_name"})
+	workerBuildQueueWorkerJobsExecuting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_worker_jobs_executing",
+			Help:      "Number of build actions currently being executed, per worker. Workers that don't provide an identity are aggregated under worker \"unidentified\".",
+		},
+		[]string{"worker"})
+
+	// Metrics intended to be consumed by autoscalers (e.g., a
+	// Kubernetes Horizontal Pod Autoscaler through the Prometheus
+	// adapter). These metrics are only provided if a target queue
+	// duration is configured.
+	workerBuildQueueAutoscalingDemandSlots = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_autoscaling_demand_slots",
+			Help:      "Number of worker slots needed to execute build actions within the target queue duration.",
+		},
+		[]string{"instance_name"})
+	workerBuildQueueAutoscalingExecutionDurationSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_autoscaling_execution_duration_seconds",
+			Help:      "Exponentially weighted moving average of the amount of time spent executing build actions, in seconds.",
+		},
+		[]string{"instance_name"})
+	workerBuildQueueAutoscalingDesiredWorkers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_autoscaling_desired_workers",
+			Help:      "Number of workers needed to execute all build actions within the target queue duration.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(workerBuildQueueJobsTotal)
+	prometheus.MustRegister(workerBuildQueueJobsPending)
+	prometheus.MustRegister(workerBuildQueueJobsQueuedDurationSeconds)
+	prometheus.MustRegister(workerBuildQueueJobsDispatchedTotal)
+	prometheus.MustRegister(workerBuildQueueWorkerJobsExecuting)
+	prometheus.MustRegister(workerBuildQueueAutoscalingDemandSlots)
+	prometheus.MustRegister(workerBuildQueueAutoscalingExecutionDurationSeconds)
+	prometheus.MustRegister(workerBuildQueueAutoscalingDesiredWorkers)
+}
+
 // workerBuildJob holds the information we need to track for a single
 // build action that is enqueued.
 type workerBuildJob struct {
@@ -27,10 +122,47 @@ type workerBuildJob struct {
 	deduplicationKey string
 	executeRequest   remoteexecution.ExecuteRequest
 	insertionOrder   uint64
+	queuedTime       time.Time
+	dispatchedTime   time.Time
+	// Time at which a worker first reported that it started
+	// running the command of the build action.
+	executingTime    time.Time
+	worker           string
+	stdoutStreamName string
+	stderrStreamName string
+	traceContext     map[string]string
+	queuedSpan       trace.Span
+	logger           *logrus.Entry
+	requestMetadata  *remoteexecution.RequestMetadata
+	// Resources consumed by the build action, if resource aware
+	// scheduling is enabled.
+	requiredResources *scheduler.WorkerResources
+	// Checksum of the directories in the input root that determine
+	// which workers the job should preferably be dispatched to, if
+	// affinity scheduling is enabled.
+	affinityKey string
+	// Number of workers currently executing the job. This may be
+	// more than one if the job has been executed speculatively.
+	executingAttempts int
+	// Whether a speculative copy of the job has been enqueued, and
+	// whether that copy is still waiting to be dispatched.
+	speculated            bool
+	speculativeCopyQueued bool
+	// Worker whose resources are being freed up to run the job, as
+	// it did not fit on any worker for too long.
+	reservedWorker string
+	// Position in the queue and estimated start time, as most
+	// recently computed by refreshQueueStatus().
+	queueStatus *scheduler.QueueStatus
 
 	stage                   remoteexecution.ExecuteOperationMetadata_Stage
 	executeResponse         *remoteexecution.ExecuteResponse
 	executeTransitionWakeup *sync.Cond
+
+	// Stage of execution, as last reported by a worker. The
+	// Remote Execution API has no way of expressing these stages,
+	// meaning that clients only observe them as EXECUTING.
+	executionStage scheduler.ExecutionStage
 }
 
 // workerBuildJobHeap is a heap of workerBuildJob entries, sorted by
@@ -70,15 +202,31 @@ func (h *workerBuildJobHeap) Pop() interface{} {
 	return x
 }
 
-func (job *workerBuildJob) waitExecution(out remoteexecution.Execution_ExecuteServer) error {
+// canRunOn determines whether the job can be dispatched to a worker.
+// For workers that advertise their resources, the resources that
+// should be reserved are returned as well.
+func (job *workerBuildJob) canRunOn(ws *workerState) (*scheduler.WorkerResources, bool) {
+	// Speculative copies of a job must run on another worker.
+	if _, ok := ws.executingJobs[job.name]; ok {
+		return nil, false
+	}
+	if ws.resources == nil {
+		return nil, true
+	}
+	required := job.requiredResources
+	if required == nil {
+		required = &scheduler.WorkerResources{Cpus: 1}
+	}
+	return allocateResources(required, &ws.resourcesInUse, ws.resources)
+}
+
+func (bq *workerBuildQueue) waitExecution(job *workerBuildJob, out remoteexecution.Execution_ExecuteServer) error {
 	for {
-		// Send current state.
-		metadata, err := ptypes.MarshalAny(&remoteexecution.ExecuteOperationMetadata{
-			Stage:        job.stage,
-			ActionDigest: job.actionDigest,
-		})
+		// Send current state. Output streams can only be read
+		// once the action is being executed.
+		metadata, err := bq.getOperationMetadata(job)
 		if err != nil {
-			log.Fatal("Failed to marshal execute operation metadata: ", err)
+			job.logger.WithError(err).Fatal("Failed to marshal execute operation metadata")
 		}
 		operation := &longrunning.Operation{
 			Name:     job.name,
@@ -88,7 +236,7 @@ func (job *workerBuildJob) waitExecution(out remoteexecution.Execution_ExecuteSe
 			operation.Done = true
 			response, err := ptypes.MarshalAny(job.executeResponse)
 			if err != nil {
-				log.Fatal("Failed to marshal execute response: ", err)
+				job.logger.WithError(err).Fatal("Failed to marshal execute response")
 			}
 			operation.Result = &longrunning.Operation_Response{Response: response}
 		}
@@ -98,7 +246,6 @@ func (job *workerBuildJob) waitExecution(out remoteexecution.Execution_ExecuteSe
 
 		// Wait for state transition.
 		// TODO(edsch): Should take a context.
-		// TODO(edsch): Should wake up periodically.
 		if job.executeResponse != nil {
 			return nil
 		}
@@ -107,50 +254,163 @@ func (job *workerBuildJob) waitExecution(out remoteexecution.Execution_ExecuteSe
 }
 
 type workerBuildQueue struct {
-	deduplicationKeyFormat util.DigestKeyFormat
-	jobsPendingMax         uint
-	nextInsertionOrder     uint64
+	deduplicationKeyFormat         util.DigestKeyFormat
+	jobsPendingMax                 uint
+	actionIndex                    ActionIndexRecorder
+	autoscalingTargetQueueDuration time.Duration
+	contentAddressableStorage      cas.ContentAddressableStorage
+	speculativeExecutionPolicy     *SpeculativeExecutionPolicy
+	workerBlacklistPolicy          *WorkerBlacklistPolicy
+	digestFunctionPolicy           *util.DigestFunctionPolicy
+	affinityPolicy                 *AffinityPolicy
+	resourcePackingPolicy          *ResourcePackingPolicy
+	reportQueueStatus              bool
+	nextInsertionOrder             uint64
 
 	jobsLock                   sync.Mutex
 	jobsNameMap                map[string]*workerBuildJob
 	jobsDeduplicationMap       map[string]*workerBuildJob
 	jobsPending                workerBuildJobHeap
 	jobsPendingInsertionWakeup *sync.Cond
+
+	workers      map[string]*workerState
+	workerHealth map[string]*workerHealthState
+	instances    map[string]*instanceState
+}
+
+// workerState holds the information we need to track for a single
+// worker that is connected to the scheduler.
+type workerState struct {
+	// Number of GetWork() calls made by the worker, used to
+	// determine when the state of a worker may be removed.
+	streams int
+	// Number of build actions the worker is able to execute
+	// concurrently, summed over all of its GetWork() calls.
+	slots int
+	// Whether the worker should be prevented from receiving new
+	// jobs, as requested through the Admin service.
+	drained bool
+	// Whether the worker should flush its cache before executing
+	// the next job, as requested through the Admin service.
+	flushCacheRequested bool
+	// Labels provided by the worker as part of its identity.
+	labels map[string]string
+	// Value of the "worker" label of metrics that are reported for
+	// the worker.
+	metricsLabel string
+	// Reason why the worker cannot accept new jobs, as reported by
+	// the worker itself (e.g., due to running out of disk space).
+	unhealthyReason string
+	// Jobs currently being executed by the worker, keyed by name.
+	executingJobs map[string]*workerBuildJob
+	// Resources advertised by the worker, or nil if the worker
+	// did not advertise any. Build actions are only dispatched to
+	// the worker if sufficient resources are available.
+	resources      *scheduler.WorkerResources
+	resourcesInUse scheduler.WorkerResources
+	// Affinity keys of the build actions most recently dispatched
+	// to the worker, most recent first.
+	affinityKeys []string
 }
 
 // NewWorkerBuildQueue creates an execution server that places execution
 // requests in a queue. These execution requests may be extracted by
-// workers.
-func NewWorkerBuildQueue(deduplicationKeyFormat util.DigestKeyFormat, jobsPendingMax uint) (BuildQueue, scheduler.SchedulerServer) {
+// workers. The Admin service that is returned may be used to inspect
+// and control the queue and the workers at runtime. Completed jobs are
+// stored in an action index, so that they may be searched for.
+//
+// If a non-zero autoscaling target queue duration is provided, Prometheus
+// metrics are exported that describe the number of workers needed to
+// execute all queued build actions within that amount of time.
+//
+// If a Content Addressable Storage is provided, the resources consumed
+// by build actions are estimated from their platform properties. Build
+// actions are then packed onto workers that advertise their resources,
+// instead of dispatching one build action per GetWork() call.
+//
+// If a speculative execution policy is provided, build actions that
+// take longer to execute than usual are executed on another worker as
+// well, returning the result of the attempt that completes first.
+// Background processing needed to implement speculative execution and
+// queue status reporting stops when the provided context is done.
+//
+// If a non-zero queue status interval is provided, clients waiting for
+// queued build actions periodically receive an update containing the
+// position in the queue and an estimated start time.
+//
+// If a worker blacklist policy is provided, workers whose build actions
+// consistently fail with infrastructure errors temporarily stop
+// receiving build actions.
+//
+// If a digest function policy is provided, the hashing algorithms
+// announced through GetCapabilities() and accepted by Execute() are
+// limited on a per instance name basis. All supported hashing
+// algorithms are permitted otherwise.
+//
+// If an affinity policy is provided, build actions are preferably
+// dispatched to workers that recently executed build actions with
+// identical toolchains or other large parts of the input root. This
+// requires a Content Addressable Storage to be provided.
+//
+// If a resource packing policy is provided, it controls how build
+// actions are packed onto workers that advertise their resources.
+// Otherwise, up to 100 build actions are considered when the one at
+// the head of the queue does not fit, and no resources are reserved.
+func NewWorkerBuildQueue(ctx context.Context, deduplicationKeyFormat util.DigestKeyFormat, jobsPendingMax uint, actionIndex ActionIndexRecorder, autoscalingTargetQueueDuration time.Duration, contentAddressableStorage cas.ContentAddressableStorage, speculativeExecutionPolicy *SpeculativeExecutionPolicy, queueStatusInterval time.Duration, workerBlacklistPolicy *WorkerBlacklistPolicy, digestFunctionPolicy *util.DigestFunctionPolicy, affinityPolicy *AffinityPolicy, resourcePackingPolicy *ResourcePackingPolicy) (BuildQueue, scheduler.SchedulerServer, admin.AdminServer) {
+	if resourcePackingPolicy == nil {
+		resourcePackingPolicy = &ResourcePackingPolicy{
+			Lookahead: 100,
+		}
+	}
 	bq := &workerBuildQueue{
-		deduplicationKeyFormat: deduplicationKeyFormat,
-		jobsPendingMax:         jobsPendingMax,
+		deduplicationKeyFormat:         deduplicationKeyFormat,
+		jobsPendingMax:                 jobsPendingMax,
+		actionIndex:                    actionIndex,
+		autoscalingTargetQueueDuration: autoscalingTargetQueueDuration,
+		contentAddressableStorage:      contentAddressableStorage,
+		speculativeExecutionPolicy:     speculativeExecutionPolicy,
+		workerBlacklistPolicy:          workerBlacklistPolicy,
+		digestFunctionPolicy:           digestFunctionPolicy,
+		affinityPolicy:                 affinityPolicy,
+		resourcePackingPolicy:          resourcePackingPolicy,
+		reportQueueStatus:              queueStatusInterval > 0,
 
 		jobsNameMap:          map[string]*workerBuildJob{},
 		jobsDeduplicationMap: map[string]*workerBuildJob{},
+		workers:              map[string]*workerState{},
+		workerHealth:         map[string]*workerHealthState{},
+		instances:            map[string]*instanceState{},
 	}
 	bq.jobsPendingInsertionWakeup = sync.NewCond(&bq.jobsLock)
-	return bq, bq
+	if speculativeExecutionPolicy != nil {
+		go bq.speculateStragglers(ctx)
+	}
+	if queueStatusInterval > 0 {
+		go bq.broadcastQueueStatus(ctx, queueStatusInterval)
+	}
+	return bq, bq, bq
 }
 
 func (bq *workerBuildQueue) GetCapabilities(ctx context.Context, in *remoteexecution.GetCapabilitiesRequest) (*remoteexecution.ServerCapabilities, error) {
+	// Announce the hashing algorithms permitted for the instance
+	// name. The preferred one is used for remote execution.
+	digestFunctions := util.SupportedDigestFunctions
+	if bq.digestFunctionPolicy != nil {
+		digestFunctions = bq.digestFunctionPolicy.GetDigestFunctions(in.InstanceName)
+	}
 	return &remoteexecution.ServerCapabilities{
 		CacheCapabilities: &remoteexecution.CacheCapabilities{
-			DigestFunction: []remoteexecution.DigestFunction{
-				remoteexecution.DigestFunction_MD5,
-				remoteexecution.DigestFunction_SHA1,
-				remoteexecution.DigestFunction_SHA256,
-			},
+			DigestFunction: digestFunctions,
 			ActionCacheUpdateCapabilities: &remoteexecution.ActionCacheUpdateCapabilities{
 				// TODO(edsch): Let bbb-frontend flip this to true when enabled?
 				UpdateEnabled: false,
 			},
 			// CachePriorityCapabilities: Priorities not supported.
-			// MaxBatchTotalSize: Not used by Bazel yet.
+			MaxBatchTotalSize:           cas.MaximumBatchTotalSizeBytes,
 			SymlinkAbsolutePathStrategy: remoteexecution.CacheCapabilities_ALLOWED,
 		},
 		ExecutionCapabilities: &remoteexecution.ExecutionCapabilities{
-			DigestFunction: remoteexecution.DigestFunction_SHA256,
+			DigestFunction: digestFunctions[0],
 			ExecEnabled:    true,
 			ExecutionPriorityCapabilities: &remoteexecution.PriorityCapabilities{
 				Priorities: []*remoteexecution.PriorityCapabilities_PriorityRange{
@@ -160,7 +420,7 @@ func (bq *workerBuildQueue) GetCapabilities(ctx context.Context, in *remoteexecu
 		},
 		// TODO(edsch): DeprecatedApiVersion.
 		LowApiVersion:  &semver.SemVer{Major: 2},
-		HighApiVersion: &semver.SemVer{Major: 2},
+		HighApiVersion: &semver.SemVer{Major: 2, Minor: 1},
 	}, nil
 }
 
@@ -169,8 +429,32 @@ func (bq *workerBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remo
 	if err != nil {
 		return err
 	}
+	if bq.digestFunctionPolicy != nil {
+		if err := bq.digestFunctionPolicy.ValidateDigest(digest); err != nil {
+			return err
+		}
+	}
 	deduplicationKey := digest.GetKey(bq.deduplicationKeyFormat)
 
+	// Estimate the resources consumed by the build action and
+	// compute its affinity key prior to acquiring the lock, as
+	// this requires access to storage.
+	var requiredResources *scheduler.WorkerResources
+	var affinityKey string
+	if bq.contentAddressableStorage != nil {
+		action, err := bq.contentAddressableStorage.GetAction(out.Context(), digest)
+		if err != nil {
+			return util.StatusWrap(err, "Failed to obtain action")
+		}
+		requiredResources, err = bq.getRequiredResources(out.Context(), digest, action)
+		if err != nil {
+			return err
+		}
+		if bq.affinityPolicy != nil {
+			affinityKey = bq.getAffinityKeyBestEffort(out.Context(), digest, action)
+		}
+	}
+
 	bq.jobsLock.Lock()
 	defer bq.jobsLock.Unlock()
 
@@ -178,6 +462,7 @@ func (bq *workerBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remo
 	if !ok {
 		// TODO(edsch): Maybe let the number of workers influence this?
 		if uint(bq.jobsPending.Len()) >= bq.jobsPendingMax {
+			workerBuildQueueJobsTotal.WithLabelValues(in.InstanceName, "Rejected").Inc()
 			return status.Errorf(codes.Unavailable, "Too many jobs pending")
 		}
 
@@ -187,16 +472,37 @@ func (bq *workerBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remo
 			deduplicationKey:        deduplicationKey,
 			executeRequest:          *in,
 			insertionOrder:          bq.nextInsertionOrder,
+			queuedTime:              time.Now(),
+			stdoutStreamName:        outputstream.GetStreamName(digest, "stdout"),
+			stderrStreamName:        outputstream.GetStreamName(digest, "stderr"),
+			requestMetadata:         util.GetRequestMetadata(out.Context()),
+			requiredResources:       requiredResources,
+			affinityKey:             affinityKey,
 			stage:                   remoteexecution.ExecuteOperationMetadata_QUEUED,
 			executeTransitionWakeup: sync.NewCond(&bq.jobsLock),
 		}
+		// Propagate the trace context of the client to the
+		// worker, so that the execution of the action becomes
+		// part of the same trace.
+		job.traceContext = tracing.InjectTraceContext(out.Context())
+		_, job.queuedSpan = otel.Tracer(tracerName).Start(out.Context(), "WorkerBuildQueue.Queued")
+		job.logger = logging.WithActionDigest(logging.FromContext(out.Context()), digest).WithField(logging.OperationNameField, job.name)
+		job.logger.Info("Enqueued action")
 		bq.jobsNameMap[job.name] = job
 		bq.jobsDeduplicationMap[deduplicationKey] = job
 		heap.Push(&bq.jobsPending, job)
-		bq.jobsPendingInsertionWakeup.Signal()
+		// Wake up all workers, as drained workers may not pick
+		// up the job.
+		bq.jobsPendingInsertionWakeup.Broadcast()
 		bq.nextInsertionOrder++
+		workerBuildQueueJobsTotal.WithLabelValues(in.InstanceName, "Enqueued").Inc()
+		workerBuildQueueJobsPending.WithLabelValues(in.InstanceName).Inc()
+		bq.getInstanceState(in.InstanceName).jobsPending++
+		bq.updateAutoscalingMetrics()
+	} else {
+		workerBuildQueueJobsTotal.WithLabelValues(in.InstanceName, "Deduplicated").Inc()
 	}
-	return job.waitExecution(out)
+	return bq.waitExecution(job, out)
 }
 
 func (bq *workerBuildQueue) WaitExecution(in *remoteexecution.WaitExecutionRequest, out remoteexecution.Execution_WaitExecutionServer) error {
@@ -207,50 +513,513 @@ func (bq *workerBuildQueue) WaitExecution(in *remoteexecution.WaitExecutionReque
 	if !ok {
 		return status.Errorf(codes.NotFound, "Build job with name %s not found", in.Name)
 	}
-	return job.waitExecution(out)
+	return bq.waitExecution(job, out)
 }
 
-func executeOnWorker(stream scheduler.Scheduler_GetWorkServer, request *remoteexecution.ExecuteRequest) *remoteexecution.ExecuteResponse {
-	// TODO(edsch): Any way we can set a timeout here?
-	if err := stream.Send(request); err != nil {
-		return convertErrorToExecuteResponse(err)
+// recordInActionIndex stores information on a completed job in the
+// action index.
+func (bq *workerBuildQueue) recordInActionIndex(job *workerBuildJob) {
+	queuedTimestamp, err := ptypes.TimestampProto(job.queuedTime)
+	if err != nil {
+		job.logger.WithError(err).Warn("Failed to convert queued time")
+	}
+	entry := &actionindex.Entry{
+		InstanceName:       job.executeRequest.InstanceName,
+		ActionDigest:       job.actionDigest,
+		OperationName:      job.name,
+		RequestMetadata:    job.requestMetadata,
+		Status:             job.executeResponse.Status,
+		QueuedTimestamp:    queuedTimestamp,
+		CompletedTimestamp: ptypes.TimestampNow(),
 	}
-	response, err := stream.Recv()
+	if result := job.executeResponse.Result; result != nil {
+		entry.ExitCode = result.ExitCode
+		entry.OutputFingerprint = history.GetOutputFingerprint(result)
+		entry.TestTarget = GetTestResultSummary(result).GetTestTarget()
+	}
+	if !job.dispatchedTime.IsZero() {
+		entry.DispatchedTimestamp, err = ptypes.TimestampProto(job.dispatchedTime)
+		if err != nil {
+			job.logger.WithError(err).Warn("Failed to convert dispatched time")
+		}
+		entry.WorkerId = job.worker
+	}
+	bq.actionIndex.Record(entry)
+}
+
+// getRequiredResources estimates the resources consumed by a build
+// action by inspecting the platform properties of its command.
+func (bq *workerBuildQueue) getRequiredResources(ctx context.Context, actionDigest *util.Digest, action *remoteexecution.Action) (*scheduler.WorkerResources, error) {
+	commandDigest, err := actionDigest.NewDerivedDigest(action.CommandDigest)
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to extract digest for command")
+	}
+	command, err := bq.contentAddressableStorage.GetCommand(ctx, commandDigest)
 	if err != nil {
-		return convertErrorToExecuteResponse(err)
+		return nil, util.StatusWrap(err, "Failed to obtain command")
+	}
+	return GetCommandResources(command)
+}
+
+// findJobForWorker returns the index in the queue of the job with the
+// highest priority that can be dispatched to a worker, along with the
+// resources that should be reserved. An index of -1 is returned if no
+// job can be dispatched.
+func (bq *workerBuildQueue) findJobForWorker(worker string, ws *workerState) (int, *scheduler.WorkerResources) {
+	if bq.jobsPending.Len() == 0 {
+		return -1, nil
+	}
+	head := bq.jobsPending[0]
+	headAllocated, headFits := head.canRunOn(ws)
+	if !headFits && bq.reserveWorkerForJob(worker, ws, head) {
+		// Let the worker's resources free up for the job at
+		// the head of the queue.
+		return -1, nil
+	}
+	if headFits && head.reservedWorker == worker {
+		// Resources have been freed up for this job. Don't let
+		// other jobs claim them.
+		return 0, headAllocated
+	}
+	if i, allocated := bq.findAffinityJobForWorker(ws); i >= 0 {
+		return i, allocated
+	}
+	if headFits {
+		return 0, headAllocated
+	}
+
+	// The job at the head of the queue does not fit. Consider a
+	// bounded number of other jobs in the order in which they would
+	// be handed out, picking the first one that fits.
+	jobIndex := -1
+	var jobAllocated *scheduler.WorkerResources
+	bq.jobsPending.visitInOrder(bq.resourcePackingPolicy.Lookahead, func(i int) bool {
+		if allocated, ok := bq.jobsPending[i].canRunOn(ws); ok {
+			jobIndex, jobAllocated = i, allocated
+			return false
+		}
+		return true
+	})
+	return jobIndex, jobAllocated
+}
+
+// reserveWorkerForJob determines whether a worker should stop
+// receiving other jobs, so that its resources free up for a job that
+// does not fit. This is done for a single worker at a time, once the
+// job has been queued for longer than the reservation age. Without
+// it, large jobs could be starved by a steady stream of smaller jobs
+// that always fit.
+func (bq *workerBuildQueue) reserveWorkerForJob(worker string, ws *workerState, job *workerBuildJob) bool {
+	reservationAge := bq.resourcePackingPolicy.ReservationAge
+	if ws.resources == nil || reservationAge <= 0 || time.Now().Sub(job.queuedTime) < reservationAge {
+		return false
+	}
+	if _, ok := ws.executingJobs[job.name]; ok {
+		// Speculative copies can never run on this worker.
+		return false
+	}
+	if job.reservedWorker != "" && job.reservedWorker != worker {
+		// Keep the existing reservation, unless the worker
+		// holding it is no longer able to accept the job.
+		if rws, ok := bq.workers[job.reservedWorker]; ok && rws.streams > 0 && !rws.drained && rws.unhealthyReason == "" {
+			return false
+		}
+	}
+	job.reservedWorker = worker
+	return true
+}
+
+// workerStreamState holds the information we need to track for a
+// single GetWork() stream of a worker. A single stream may be used to
+// execute multiple build actions concurrently. The worker controls the
+// number of build actions dispatched to it by granting credits.
+type workerStreamState struct {
+	// Number of build actions that may still be dispatched over
+	// the stream. Every stream starts with a single credit, which
+	// is returned when the build action completes. Workers may
+	// grant additional credits to execute build actions
+	// concurrently.
+	credits int
+	// Total number of credits granted by the worker, corresponding
+	// to the number of build actions it can execute concurrently.
+	slots int
+	// Whether the worker permits build actions to be pipelined
+	// behind ones that are executing.
+	pipelining bool
+	// Build actions that have started executing and have no build
+	// action pipelined behind them yet. Their worker slots are
+	// about to free up, meaning the next build action may be sent
+	// ahead of time, allowing its inputs to be prefetched.
+	pipelineCandidates []*workerDispatch
+	// Build actions dispatched over the stream that have not
+	// completed yet, keyed by operation name.
+	dispatches map[string]*workerDispatch
+	// Error that caused the stream to fail, if any.
+	err error
+}
+
+// workerDispatch holds the information we need to track for a single
+// attempt of executing a job on a worker.
+type workerDispatch struct {
+	job                *workerBuildJob
+	allocatedResources *scheduler.WorkerResources
+	dispatchedTime     time.Time
+	// Time at which the worker reported that it started running
+	// the command of the build action. Unlike the time of dispatch,
+	// this excludes time spent waiting behind a pipelined build
+	// action and fetching inputs.
+	executingTime time.Time
+	// Whether another build action has been pipelined behind this
+	// one. The credit of this build action is then handed over to
+	// the pipelined build action upon completion.
+	hasFollower bool
+	logger      *logrus.Entry
+}
+
+// getDispatch returns the build action to which an update sent by a
+// worker applies. Workers that do not provide an operation name are
+// assumed to only execute a single build action at a time.
+func (ss *workerStreamState) getDispatch(operationName string) (*workerDispatch, error) {
+	if operationName == "" && len(ss.dispatches) == 1 {
+		for _, d := range ss.dispatches {
+			return d, nil
+		}
+	}
+	d, ok := ss.dispatches[operationName]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Worker sent an update for operation %#v, which is not executing", operationName)
+	}
+	return d, nil
+}
+
+// handleWorkerUpdate processes a single message sent by a worker over
+// a GetWork() stream. This function must be called with jobsLock held.
+func (bq *workerBuildQueue) handleWorkerUpdate(worker string, ws *workerState, ss *workerStreamState, update *scheduler.WorkerUpdate) error {
+	if update.CacheFlushed {
+		logrus.WithField(logging.WorkerIDField, worker).Info("Worker flushed its cache")
+	}
+	switch u := update.Update.(type) {
+	case *scheduler.WorkerUpdate_Credits:
+		ss.credits += int(u.Credits)
+		ss.slots += int(u.Credits)
+		ws.slots += int(u.Credits)
+		bq.jobsPendingInsertionWakeup.Broadcast()
+		bq.updateAutoscalingMetrics()
+	case *scheduler.WorkerUpdate_Pipelining:
+		ss.pipelining = u.Pipelining
+	case *scheduler.WorkerUpdate_Health:
+		ws.unhealthyReason = u.Health.UnhealthyReason
+		if ws.unhealthyReason == "" {
+			bq.jobsPendingInsertionWakeup.Broadcast()
+		}
+	case *scheduler.WorkerUpdate_Stage:
+		d, err := ss.getDispatch(update.OperationName)
+		if err != nil {
+			return err
+		}
+		d.logger.WithField("stage", u.Stage.String()).Debug("Worker reported execution stage")
+		if u.Stage == scheduler.ExecutionStage_EXECUTING && d.executingTime.IsZero() {
+			d.executingTime = time.Now()
+			if d.job.executingTime.IsZero() {
+				d.job.executingTime = d.executingTime
+			}
+			// The worker slot is about to free up, meaning
+			// the next build action may be sent ahead.
+			if ss.pipelining && !d.hasFollower {
+				ss.pipelineCandidates = append(ss.pipelineCandidates, d)
+				bq.jobsPendingInsertionWakeup.Broadcast()
+			}
+		}
+		if d.job.executeResponse == nil {
+			d.job.executionStage = u.Stage
+			d.job.executeTransitionWakeup.Broadcast()
+		}
+	case *scheduler.WorkerUpdate_ExecuteResponse:
+		d, err := ss.getDispatch(update.OperationName)
+		if err != nil {
+			return err
+		}
+		if !d.hasFollower {
+			ss.credits++
+		}
+		bq.completeDispatch(worker, ws, ss, d, u.ExecuteResponse)
+	default:
+		return status.Error(codes.InvalidArgument, "Worker sent an update of an unknown type")
+	}
+	return nil
+}
+
+// completeDispatch processes the outcome of an attempt of executing a
+// job on a worker. This function must be called with jobsLock held.
+func (bq *workerBuildQueue) completeDispatch(worker string, ws *workerState, ss *workerStreamState, d *workerDispatch, executeResponse *remoteexecution.ExecuteResponse) {
+	job := d.job
+	instanceName := job.executeRequest.InstanceName
+	workerBuildQueueWorkerJobsExecuting.WithLabelValues(ws.metricsLabel).Dec()
+	delete(ws.executingJobs, job.name)
+	delete(ss.dispatches, job.name)
+	is := bq.getInstanceState(instanceName)
+	is.jobsExecuting--
+	if d.allocatedResources != nil {
+		ws.resourcesInUse.Cpus -= d.allocatedResources.Cpus
+		ws.resourcesInUse.MemoryBytes -= d.allocatedResources.MemoryBytes
+	}
+	// Credits and resources have become available, which may
+	// allow streams of the same worker to pick up other jobs.
+	bq.jobsPendingInsertionWakeup.Broadcast()
+	if !d.executingTime.IsZero() {
+		is.recordExecutionDuration(time.Now().Sub(d.executingTime))
+	}
+	bq.updateAutoscalingMetrics()
+	bq.recordWorkerOutcome(worker, executeResponse, d.logger)
+	job.executingAttempts--
+
+	// If the job was executed speculatively, only the first
+	// attempt to succeed is reported back to the client. Failures
+	// are ignored if other attempts are still pending, as they may
+	// be caused by unhealthy workers.
+	logger := d.logger
+	if job.executeResponse != nil {
+		logger.Info("Discarding result of speculative execution, as the action already completed")
+		return
+	}
+	if executeResponse.Status != nil && codes.Code(executeResponse.Status.Code) != codes.OK && (job.executingAttempts > 0 || job.speculativeCopyQueued) {
+		logger.WithField("status", executeResponse.Status.Message).Warn("Attempt to execute action failed, waiting for speculative execution")
+		return
+	}
+	bq.removeSpeculativeCopy(job)
+
+	// Mark completion.
+	delete(bq.jobsDeduplicationMap, job.deduplicationKey)
+	job.stage = remoteexecution.ExecuteOperationMetadata_COMPLETED
+	job.worker = worker
+	job.executeResponse = executeResponse
+	job.executeTransitionWakeup.Broadcast()
+	bq.recordInActionIndex(job)
+	if executeResponse.Status != nil && codes.Code(executeResponse.Status.Code) != codes.OK {
+		logger.WithField("status", executeResponse.Status.Message).Warn("Action completed with an error")
+	} else {
+		logger.Info("Action completed")
+	}
+}
+
+// popPipelineCandidate returns a build action executing on a worker
+// over a given stream behind which another build action may be
+// pipelined. This function must be called with jobsLock held.
+func (ss *workerStreamState) popPipelineCandidate() *workerDispatch {
+	for len(ss.pipelineCandidates) > 0 {
+		d := ss.pipelineCandidates[0]
+		ss.pipelineCandidates[0] = nil
+		ss.pipelineCandidates = ss.pipelineCandidates[1:]
+		// Skip build actions that have completed in the
+		// meantime, as their credits have been returned.
+		if ss.dispatches[d.job.name] == d {
+			return d
+		}
+	}
+	return nil
+}
+
+// hasPipelineCandidate returns whether popPipelineCandidate would
+// return a build action. This function must be called with jobsLock
+// held.
+func (ss *workerStreamState) hasPipelineCandidate() bool {
+	for _, d := range ss.pipelineCandidates {
+		if ss.dispatches[d.job.name] == d {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchJob removes a job from the queue and registers it as being
+// executed by a worker over a given stream. The caller is responsible
+// for consuming a credit or pipelining the job behind another one.
+// This function must be called with jobsLock held.
+func (bq *workerBuildQueue) dispatchJob(worker string, ws *workerState, ss *workerStreamState, jobIndex int, allocatedResources *scheduler.WorkerResources) *workerDispatch {
+	job := heap.Remove(&bq.jobsPending, jobIndex).(*workerBuildJob)
+	if allocatedResources != nil {
+		ws.resourcesInUse.Cpus += allocatedResources.Cpus
+		ws.resourcesInUse.MemoryBytes += allocatedResources.MemoryBytes
 	}
-	return response
+	dispatchedTime := time.Now()
+	instanceName := job.executeRequest.InstanceName
+	if job.stage == remoteexecution.ExecuteOperationMetadata_QUEUED {
+		job.stage = remoteexecution.ExecuteOperationMetadata_EXECUTING
+		job.dispatchedTime = dispatchedTime
+		job.worker = worker
+		job.queuedSpan.End()
+		workerBuildQueueJobsQueuedDurationSeconds.WithLabelValues(instanceName).Observe(job.dispatchedTime.Sub(job.queuedTime).Seconds())
+	} else {
+		job.speculativeCopyQueued = false
+	}
+	job.executingAttempts++
+	workerBuildQueueJobsPending.WithLabelValues(instanceName).Dec()
+	workerBuildQueueJobsDispatchedTotal.WithLabelValues(instanceName).Inc()
+	if job.affinityKey != "" {
+		if ws.hasAffinityKey(job.affinityKey) {
+			workerBuildQueueJobsDispatchedWithAffinityTotal.WithLabelValues(instanceName).Inc()
+		}
+		ws.recordAffinityKey(job.affinityKey, bq.affinityPolicy.HistorySize)
+	}
+	is := bq.getInstanceState(instanceName)
+	is.jobsPending--
+	is.jobsExecuting++
+	bq.updateAutoscalingMetrics()
+
+	// Hand the job to the worker. Its completion is processed by
+	// the goroutine receiving messages.
+	d := &workerDispatch{
+		job:                job,
+		allocatedResources: allocatedResources,
+		dispatchedTime:     dispatchedTime,
+		logger:             job.logger.WithField(logging.WorkerIDField, worker),
+	}
+	ss.dispatches[job.name] = d
+	ws.executingJobs[job.name] = job
+	return d
 }
 
-func (bq *workerBuildQueue) GetWork(stream scheduler.Scheduler_GetWorkServer) error {
+func (bq *workerBuildQueue) GetWork(stream scheduler.Scheduler_GetWorkServer) (err error) {
+	// Workers are identified by the identity they provide. Fall
+	// back to their network address for workers that don't.
+	// Network addresses change every time workers reconnect, so
+	// they are not used to label metrics. That would cause the
+	// number of time series to grow without bounds.
+	identity := getWorkerIdentity(stream.Context())
+	metricsLabel := "unidentified"
+	if identity == nil {
+		worker := "unknown"
+		if p, ok := peer.FromContext(stream.Context()); ok {
+			worker = p.Addr.String()
+		}
+		identity = &scheduler.WorkerIdentity{Id: worker}
+	} else {
+		metricsLabel = identity.Id
+	}
+	worker := identity.Id
+	workerJobsExecuting := workerBuildQueueWorkerJobsExecuting.WithLabelValues(metricsLabel)
+
 	bq.jobsLock.Lock()
 	defer bq.jobsLock.Unlock()
 
+	ws, ok := bq.workers[worker]
+	if !ok {
+		ws = &workerState{
+			labels:        identity.Labels,
+			metricsLabel:  metricsLabel,
+			executingJobs: map[string]*workerBuildJob{},
+		}
+		bq.workers[worker] = ws
+	}
+	if ws.resources == nil {
+		ws.resources = getWorkerResources(stream.Context())
+	}
+	ss := &workerStreamState{
+		credits:    1,
+		slots:      1,
+		dispatches: map[string]*workerDispatch{},
+	}
+	ws.streams++
+	ws.slots++
+	bq.updateAutoscalingMetrics()
+	defer func() {
+		// Build actions that were still executing when the
+		// stream failed are reported as failed. Prevent the
+		// receiving goroutine from processing any further
+		// messages.
+		if ss.err == nil {
+			ss.err = err
+		}
+		for _, d := range ss.dispatches {
+			bq.completeDispatch(worker, ws, ss, d, convertErrorToExecuteResponse(err))
+		}
+		ws.streams--
+		ws.slots -= ss.slots
+		if ws.streams == 0 {
+			delete(bq.workers, worker)
+			if ws.metricsLabel == worker {
+				workerBuildQueueWorkerJobsExecuting.DeleteLabelValues(worker)
+			}
+		}
+		bq.updateAutoscalingMetrics()
+	}()
+
+	// Process messages sent by the worker in the background, as
+	// they may arrive while build actions are being dispatched.
+	go func() {
+		for {
+			update, err := stream.Recv()
+			bq.jobsLock.Lock()
+			if ss.err != nil {
+				bq.jobsLock.Unlock()
+				return
+			}
+			if err == nil {
+				err = bq.handleWorkerUpdate(worker, ws, ss, update)
+			}
+			if err != nil {
+				ss.err = err
+				bq.jobsPendingInsertionWakeup.Broadcast()
+				bq.jobsLock.Unlock()
+				return
+			}
+			bq.jobsLock.Unlock()
+		}
+	}()
+
 	// TODO(edsch): Purge jobs from the jobsNameMap after some amount of time.
 	for {
-		// Wait for jobs to appear.
+		// Wait for jobs to appear that fit within the credits
+		// and resources of the worker, as long as the worker is
+		// healthy and not blacklisted. Workers that permit
+		// pipelining may also receive a single job for every
+		// slot that is about to free up.
 		// TODO(edsch): sync.Cond.WaitWithContext() would be helpful here.
-		for bq.jobsPending.Len() == 0 {
+		var jobIndex int
+		var allocatedResources *scheduler.WorkerResources
+		for {
+			if ss.err != nil {
+				return ss.err
+			}
+			if (ss.credits > 0 || ss.hasPipelineCandidate()) && !ws.drained && ws.unhealthyReason == "" && bq.getWorkerBlacklistedUntil(worker).IsZero() {
+				if jobIndex, allocatedResources = bq.findJobForWorker(worker, ws); jobIndex >= 0 {
+					break
+				}
+			}
 			bq.jobsPendingInsertionWakeup.Wait()
 		}
-		if err := stream.Context().Err(); err != nil {
-			bq.jobsPendingInsertionWakeup.Signal()
-			return err
-		}
-
-		// Extract job from queue.
-		job := heap.Pop(&bq.jobsPending).(*workerBuildJob)
-		job.stage = remoteexecution.ExecuteOperationMetadata_EXECUTING
 
-		// Perform execution of the job.
+		// Extract job from queue. Free slots are preferred over
+		// pipelining the job behind one that is executing.
+		d := bq.dispatchJob(worker, ws, ss, jobIndex, allocatedResources)
+		previousOperationName := ""
+		if ss.credits > 0 {
+			ss.credits--
+		} else {
+			previous := ss.popPipelineCandidate()
+			previous.hasFollower = true
+			previousOperationName = previous.job.name
+		}
+		flushCache := ws.flushCacheRequested
+		ws.flushCacheRequested = false
+		workerJobsExecuting.Inc()
 		bq.jobsLock.Unlock()
-		executeResponse := executeOnWorker(stream, &job.executeRequest)
+		if previousOperationName == "" {
+			d.logger.Info("Dispatched action to worker")
+		} else {
+			d.logger.WithField("previous_operation", previousOperationName).Info("Dispatched action to worker, pipelined behind another action")
+		}
+		// TODO(edsch): Any way we can set a timeout here?
+		request := newWorkRequest(&d.job.executeRequest)
+		request.TraceContext = d.job.traceContext
+		request.OperationName = d.job.name
+		request.Worker = identity
+		request.PreviousOperationName = previousOperationName
+		request.FlushCache = flushCache
+		err := stream.Send(request)
 		bq.jobsLock.Lock()
-
-		// Mark completion.
-		delete(bq.jobsDeduplicationMap, job.deduplicationKey)
-		job.stage = remoteexecution.ExecuteOperationMetadata_COMPLETED
-		job.executeResponse = executeResponse
-		job.executeTransitionWakeup.Broadcast()
+		if err != nil {
+			return err
+		}
 	}
 }
@@ -0,0 +1,177 @@
+package builder
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (job *workerBuildJob) getOperationInfo() (*admin.OperationInfo, error) {
+	queuedTimestamp, err := ptypes.TimestampProto(job.queuedTime)
+	if err != nil {
+		return nil, err
+	}
+	var priority int32
+	if policy := job.executeRequest.ExecutionPolicy; policy != nil {
+		priority = policy.Priority
+	}
+	var dispatchedTimestamp *timestamp.Timestamp
+	if !job.dispatchedTime.IsZero() {
+		dispatchedTimestamp, err = ptypes.TimestampProto(job.dispatchedTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &admin.OperationInfo{
+		Name:                job.name,
+		InstanceName:        job.executeRequest.InstanceName,
+		ActionDigest:        job.actionDigest,
+		Priority:            priority,
+		QueuedTimestamp:     queuedTimestamp,
+		ExecutionStage:      job.executionStage,
+		DispatchedTimestamp: dispatchedTimestamp,
+	}, nil
+}
+
+func (bq *workerBuildQueue) ListQueuedOperations(ctx context.Context, in *admin.ListQueuedOperationsRequest) (*admin.ListQueuedOperationsResponse, error) {
+	bq.jobsLock.Lock()
+	jobs := append(workerBuildJobHeap(nil), bq.jobsPending...)
+	bq.jobsLock.Unlock()
+
+	// Return jobs in the order in which they are handed out.
+	sort.Sort(jobs)
+	operations := make([]*admin.OperationInfo, 0, len(jobs))
+	for _, job := range jobs {
+		operation, err := job.getOperationInfo()
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, operation)
+	}
+	return &admin.ListQueuedOperationsResponse{
+		QueuedOperations: operations,
+	}, nil
+}
+
+func (bq *workerBuildQueue) ListWorkers(ctx context.Context, in *admin.ListWorkersRequest) (*admin.ListWorkersResponse, error) {
+	bq.jobsLock.Lock()
+	defer bq.jobsLock.Unlock()
+
+	workers := make([]*admin.WorkerInfo, 0, len(bq.workers))
+	for workerID, ws := range bq.workers {
+		operations := make([]*admin.OperationInfo, 0, len(ws.executingJobs))
+		for _, job := range ws.executingJobs {
+			operation, err := job.getOperationInfo()
+			if err != nil {
+				return nil, err
+			}
+			operations = append(operations, operation)
+		}
+		sort.Slice(operations, func(i, j int) bool {
+			return operations[i].Name < operations[j].Name
+		})
+		var blacklistedUntil *timestamp.Timestamp
+		if t := bq.getWorkerBlacklistedUntil(workerID); !t.IsZero() {
+			var err error
+			blacklistedUntil, err = ptypes.TimestampProto(t)
+			if err != nil {
+				return nil, err
+			}
+		}
+		workers = append(workers, &admin.WorkerInfo{
+			WorkerId:            workerID,
+			Concurrency:         uint32(ws.slots),
+			Drained:             ws.drained,
+			ExecutingOperations: operations,
+			BlacklistedUntil:    blacklistedUntil,
+			UnhealthyReason:     ws.unhealthyReason,
+			Labels:              ws.labels,
+		})
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].WorkerId < workers[j].WorkerId
+	})
+	return &admin.ListWorkersResponse{
+		Workers: workers,
+	}, nil
+}
+
+func (bq *workerBuildQueue) CancelOperation(ctx context.Context, in *admin.CancelOperationRequest) (*admin.CancelOperationResponse, error) {
+	bq.jobsLock.Lock()
+	defer bq.jobsLock.Unlock()
+
+	job, ok := bq.jobsNameMap[in.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Build job with name %s not found", in.Name)
+	}
+	index := -1
+	for i, pendingJob := range bq.jobsPending {
+		if pendingJob == job {
+			index = i
+			break
+		}
+	}
+	if index < 0 || job.stage != remoteexecution.ExecuteOperationMetadata_QUEUED {
+		return nil, status.Errorf(codes.FailedPrecondition, "Build job with name %s is not queued", in.Name)
+	}
+
+	// Remove the job from the queue and complete it, so that
+	// clients waiting for it receive a response.
+	heap.Remove(&bq.jobsPending, index)
+	delete(bq.jobsDeduplicationMap, job.deduplicationKey)
+	job.queuedSpan.End()
+	workerBuildQueueJobsPending.WithLabelValues(job.executeRequest.InstanceName).Dec()
+	bq.getInstanceState(job.executeRequest.InstanceName).jobsPending--
+	bq.updateAutoscalingMetrics()
+
+	job.stage = remoteexecution.ExecuteOperationMetadata_COMPLETED
+	job.executeResponse = convertErrorToExecuteResponse(
+		status.Error(codes.Canceled, "Operation cancelled by administrator"))
+	job.executeTransitionWakeup.Broadcast()
+	bq.recordInActionIndex(job)
+	job.logger.Info("Action cancelled by administrator")
+	return &admin.CancelOperationResponse{}, nil
+}
+
+func (bq *workerBuildQueue) DrainWorker(ctx context.Context, in *admin.DrainWorkerRequest) (*admin.DrainWorkerResponse, error) {
+	bq.jobsLock.Lock()
+	defer bq.jobsLock.Unlock()
+
+	ws, ok := bq.workers[in.WorkerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Worker %s not found", in.WorkerId)
+	}
+	ws.drained = !in.Undrain
+	if !ws.drained {
+		bq.jobsPendingInsertionWakeup.Broadcast()
+	}
+	return &admin.DrainWorkerResponse{}, nil
+}
+
+func (bq *workerBuildQueue) FlushWorkerCache(ctx context.Context, in *admin.FlushWorkerCacheRequest) (*admin.FlushWorkerCacheResponse, error) {
+	bq.jobsLock.Lock()
+	defer bq.jobsLock.Unlock()
+
+	ws, ok := bq.workers[in.WorkerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Worker %s not found", in.WorkerId)
+	}
+	// Workers cannot be contacted outside of dispatching jobs.
+	// Piggyback the request onto the next job dispatched to it.
+	ws.flushCacheRequested = true
+	return &admin.FlushWorkerCacheResponse{}, nil
+}
+
+func (bq *workerBuildQueue) ListDrainedShards(ctx context.Context, in *admin.ListDrainedShardsRequest) (*admin.ListDrainedShardsResponse, error) {
+	// The queue itself has no knowledge of storage. Drained shards
+	// are reported by NewDrainedShardsReportingAdminServer().
+	return &admin.ListDrainedShardsResponse{}, nil
+}
@@ -0,0 +1,188 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	workerBuildQueueJobsDispatchedWithAffinityTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_jobs_dispatched_with_affinity_total",
+			Help:      "Total number of build actions dispatched to a worker that recently executed a build action with the same affinity key.",
+		},
+		[]string{"instance_name"})
+)
+
+func init() {
+	prometheus.MustRegister(workerBuildQueueJobsDispatchedWithAffinityTotal)
+}
+
+// AffinityPolicy controls how the worker build queue routes build
+// actions to workers that recently executed similar build actions. As
+// such workers are likely to have the input files of these build
+// actions in their local caches, this reduces the amount of data that
+// needs to be fetched from storage.
+//
+// Build actions are considered similar if the directories at the
+// configured paths in their input roots (e.g., the subtree containing
+// the toolchain) are identical. Routing is best-effort: workers that
+// haven't executed any similar build actions still receive them.
+type AffinityPolicy struct {
+	// Paths of directories in the input root whose contents
+	// determine the affinity of a build action (e.g.,
+	// "external/local_config_cc").
+	Directories []string
+	// Number of distinct affinity keys to remember per worker.
+	HistorySize int
+	// Maximum number of queued build actions that may be skipped to
+	// dispatch a similar build action to a worker. This bounds the
+	// amount of unfairness introduced by affinity scheduling.
+	MaximumQueueJump int
+}
+
+// getAffinityKey computes the affinity key of a build action, being a
+// checksum of the digests of the configured directories in its input
+// root. The empty string is returned if none of the directories are
+// present.
+func (bq *workerBuildQueue) getAffinityKey(ctx context.Context, actionDigest *util.Digest, action *remoteexecution.Action) (string, error) {
+	inputRootDigest, err := actionDigest.NewDerivedDigest(action.InputRootDigest)
+	if err != nil {
+		return "", util.StatusWrap(err, "Failed to extract digest for input root")
+	}
+	hasher := sha256.New()
+	found := false
+	for _, path := range bq.affinityPolicy.Directories {
+		directoryDigest, err := bq.getDirectoryDigest(ctx, inputRootDigest, path)
+		if err != nil {
+			return "", util.StatusWrapf(err, "Failed to obtain directory %#v", path)
+		}
+		if directoryDigest != nil {
+			fmt.Fprintf(hasher, "%s=%s\n", path, directoryDigest)
+			found = true
+		}
+	}
+	if !found {
+		return "", nil
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// getDirectoryDigest resolves a path relative to the input root of a
+// build action, returning the digest of the directory. It returns nil
+// if the directory does not exist.
+func (bq *workerBuildQueue) getDirectoryDigest(ctx context.Context, inputRootDigest *util.Digest, path string) (*util.Digest, error) {
+	directoryDigest := inputRootDigest
+	for _, component := range strings.Split(path, "/") {
+		if component == "" {
+			continue
+		}
+		directory, err := bq.contentAddressableStorage.GetDirectory(ctx, directoryDigest)
+		if err != nil {
+			return nil, err
+		}
+		var childDigest *remoteexecution.Digest
+		for _, child := range directory.Directories {
+			if child.Name == component {
+				childDigest = child.Digest
+				break
+			}
+		}
+		if childDigest == nil {
+			return nil, nil
+		}
+		directoryDigest, err = inputRootDigest.NewDerivedDigest(childDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return directoryDigest, nil
+}
+
+// getAffinityKeyBestEffort computes the affinity key of a build action.
+// As affinity scheduling is merely an optimization, failures are logged
+// instead of causing the build action to fail.
+func (bq *workerBuildQueue) getAffinityKeyBestEffort(ctx context.Context, actionDigest *util.Digest, action *remoteexecution.Action) string {
+	affinityKey, err := bq.getAffinityKey(ctx, actionDigest, action)
+	if err != nil {
+		logging.WithActionDigest(logging.FromContext(ctx), actionDigest).
+			WithError(err).
+			Warn("Failed to compute affinity key")
+		return ""
+	}
+	return affinityKey
+}
+
+// hasAffinityKey returns whether a worker recently executed a build
+// action with a given affinity key.
+func (ws *workerState) hasAffinityKey(affinityKey string) bool {
+	for _, recentAffinityKey := range ws.affinityKeys {
+		if recentAffinityKey == affinityKey {
+			return true
+		}
+	}
+	return false
+}
+
+// recordAffinityKey records that a build action with a given affinity
+// key has been dispatched to a worker, evicting the least recently
+// used affinity key if more than historySize keys are tracked.
+func (ws *workerState) recordAffinityKey(affinityKey string, historySize int) {
+	for i, recentAffinityKey := range ws.affinityKeys {
+		if recentAffinityKey == affinityKey {
+			ws.affinityKeys = append(ws.affinityKeys[:i], ws.affinityKeys[i+1:]...)
+			break
+		}
+	}
+	ws.affinityKeys = append([]string{affinityKey}, ws.affinityKeys...)
+	if len(ws.affinityKeys) > historySize {
+		ws.affinityKeys = ws.affinityKeys[:historySize]
+	}
+}
+
+// findAffinityJobForWorker returns the index in the queue of the job
+// with the highest priority whose affinity key was recently observed
+// by the worker, along with the resources that should be reserved. An
+// index of -1 is returned if no such job exists, or if dispatching it
+// would skip too many jobs with a higher priority.
+func (bq *workerBuildQueue) findAffinityJobForWorker(ws *workerState) (int, *scheduler.WorkerResources) {
+	if bq.affinityPolicy == nil || len(ws.affinityKeys) == 0 {
+		return -1, nil
+	}
+	bestIndex := -1
+	var bestAllocated *scheduler.WorkerResources
+	for i, job := range bq.jobsPending {
+		if job.affinityKey == "" || !ws.hasAffinityKey(job.affinityKey) || (bestIndex >= 0 && !bq.jobsPending.Less(i, bestIndex)) {
+			continue
+		}
+		if allocated, ok := job.canRunOn(ws); ok {
+			bestIndex, bestAllocated = i, allocated
+		}
+	}
+	if bestIndex < 0 {
+		return -1, nil
+	}
+
+	// Count the number of jobs that would be skipped.
+	skipped := 0
+	for i := range bq.jobsPending {
+		if bq.jobsPending.Less(i, bestIndex) {
+			skipped++
+		}
+	}
+	if skipped > bq.affinityPolicy.MaximumQueueJump {
+		return -1, nil
+	}
+	return bestIndex, bestAllocated
+}
@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"math"
+	"time"
+)
+
+// instanceState holds the information tracked per instance name that
+// is needed to compute the autoscaling metrics and to determine when
+// to execute build actions speculatively.
+type instanceState struct {
+	jobsPending   int
+	jobsExecuting int
+	// Exponentially weighted moving average of the execution
+	// duration of build actions, in seconds. Zero if no build
+	// actions have completed yet.
+	executionDurationSeconds float64
+	// Ring buffer of recently observed execution durations, used to
+	// determine whether build actions should be executed
+	// speculatively.
+	recentExecutionDurations         []time.Duration
+	nextRecentExecutionDurationIndex int
+}
+
+func (is *instanceState) recordExecutionDuration(d time.Duration) {
+	if len(is.recentExecutionDurations) < executionDurationSamplesMax {
+		is.recentExecutionDurations = append(is.recentExecutionDurations, d)
+	} else {
+		is.recentExecutionDurations[is.nextRecentExecutionDurationIndex] = d
+		is.nextRecentExecutionDurationIndex = (is.nextRecentExecutionDurationIndex + 1) % executionDurationSamplesMax
+	}
+
+	if is.executionDurationSeconds == 0 {
+		is.executionDurationSeconds = d.Seconds()
+	} else {
+		is.executionDurationSeconds = 0.9*is.executionDurationSeconds + 0.1*d.Seconds()
+	}
+}
+
+// getDemandSlots returns the number of worker slots needed to complete
+// the build actions that are currently executing, while also ensuring
+// that all queued build actions start within the target queue duration.
+func (is *instanceState) getDemandSlots(targetQueueDuration time.Duration) float64 {
+	// A single slot can process multiple build actions within the
+	// target queue duration if they are short. For long running
+	// build actions, every build action needs a slot of its own.
+	// Without any observations, assume the latter.
+	slotsPerJob := 1.0
+	if is.executionDurationSeconds > 0 {
+		slotsPerJob = math.Min(1.0, is.executionDurationSeconds/targetQueueDuration.Seconds())
+	}
+	return float64(is.jobsExecuting) + math.Ceil(float64(is.jobsPending)*slotsPerJob)
+}
+
+func (bq *workerBuildQueue) getInstanceState(instanceName string) *instanceState {
+	is, ok := bq.instances[instanceName]
+	if !ok {
+		is = &instanceState{}
+		bq.instances[instanceName] = is
+	}
+	return is
+}
+
+// updateAutoscalingMetrics recomputes the metrics that may be used by
+// autoscalers to determine the number of workers to provision. This
+// function must be called with jobsLock held.
+func (bq *workerBuildQueue) updateAutoscalingMetrics() {
+	if bq.autoscalingTargetQueueDuration == 0 {
+		return
+	}
+
+	totalDemandSlots := 0.0
+	for instanceName, is := range bq.instances {
+		demandSlots := is.getDemandSlots(bq.autoscalingTargetQueueDuration)
+		workerBuildQueueAutoscalingDemandSlots.WithLabelValues(instanceName).Set(demandSlots)
+		workerBuildQueueAutoscalingExecutionDurationSeconds.WithLabelValues(instanceName).Set(is.executionDurationSeconds)
+		totalDemandSlots += demandSlots
+	}
+
+	// Convert the number of slots to a number of workers, based on
+	// the concurrency of the workers that are currently connected.
+	slotsPerWorker := 1.0
+	if len(bq.workers) > 0 {
+		totalSlots := 0
+		for _, ws := range bq.workers {
+			totalSlots += ws.slots
+		}
+		slotsPerWorker = float64(totalSlots) / float64(len(bq.workers))
+	}
+	workerBuildQueueAutoscalingDesiredWorkers.Set(math.Ceil(totalDemandSlots / slotsPerWorker))
+}
@@ -0,0 +1,152 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// getAutoscalingGauge returns the value of one of the autoscaling
+// gauges exported by the worker build queue. The instance name label
+// is only matched if non-empty.
+func getAutoscalingGauge(t *testing.T, name string, instanceName string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "buildbarn_builder_worker_build_queue_autoscaling_"+name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if instanceName == "" || labels["instance_name"] == instanceName {
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return -1
+}
+
+// waitForAutoscalingGauge waits for an autoscaling gauge to attain an
+// expected value, as gauges are updated asynchronously with respect
+// to the messages exchanged with workers.
+func waitForAutoscalingGauge(t *testing.T, name string, instanceName string, expected float64) {
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		value := getAutoscalingGauge(t, name, instanceName)
+		if value == expected || time.Now().After(deadline) {
+			require.Equal(t, expected, value, name)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerBuildQueueAutoscaling(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, _ := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, time.Minute, nil, nil, 0, nil, nil, nil, nil)
+
+	// Enqueue three build actions. Without any workers or
+	// observed execution durations, every build action should be
+	// assumed to require a worker of its own.
+	for _, actionDigest := range []*remoteexecution.Digest{
+		{Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", SizeBytes: 11},
+		{Hash: "3e25960a79dbc69b674cd4ec67a72c62dcf7e0a2a2a1d0c6e4db5d3e1d8a6c2f", SizeBytes: 12},
+		{Hash: "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447", SizeBytes: 13},
+	} {
+		executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+		executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+		executeServer.EXPECT().Send(gomock.Any()).Return(status.Error(codes.Canceled, "Client disconnected"))
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "Client disconnected"),
+			buildQueue.Execute(&remoteexecution.ExecuteRequest{
+				InstanceName: "autoscaling",
+				ActionDigest: actionDigest,
+			}, executeServer))
+	}
+	require.Equal(t, 3.0, getAutoscalingGauge(t, "demand_slots", "autoscaling"))
+	require.Equal(t, 0.0, getAutoscalingGauge(t, "execution_duration_seconds", "autoscaling"))
+	require.Equal(t, 3.0, getAutoscalingGauge(t, "desired_workers", ""))
+
+	// Connect a worker that executes one build action at a time.
+	updates := make(chan *scheduler.WorkerUpdate)
+	requests := make(chan *scheduler.WorkRequest, 1)
+	getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+	getWorkServer.EXPECT().Context().Return(ctx).AnyTimes()
+	getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+		update, ok := <-updates
+		if !ok {
+			return nil, status.Error(codes.Canceled, "Worker disconnected")
+		}
+		return update, nil
+	}).AnyTimes()
+	getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+		requests <- request
+		return nil
+	}).Times(3)
+	getWorkErrors := make(chan error, 1)
+	go func() {
+		getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+	}()
+	complete := func(request *scheduler.WorkRequest) {
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update:        &scheduler.WorkerUpdate_Stage{Stage: scheduler.ExecutionStage_EXECUTING},
+		}
+		time.Sleep(10 * time.Millisecond)
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update: &scheduler.WorkerUpdate_ExecuteResponse{
+				ExecuteResponse: &remoteexecution.ExecuteResponse{
+					Result: &remoteexecution.ActionResult{},
+				},
+			},
+		}
+	}
+
+	// While the first build action is executing, the demand
+	// should remain unchanged.
+	request := <-requests
+	waitForAutoscalingGauge(t, "demand_slots", "autoscaling", 3)
+	waitForAutoscalingGauge(t, "desired_workers", "", 3)
+
+	// Once the first build action completes, its execution
+	// duration is known. As it is far below the target queue
+	// duration, the remaining queued build action can be
+	// processed by the slot of the executing one.
+	complete(request)
+	request = <-requests
+	waitForAutoscalingGauge(t, "demand_slots", "autoscaling", 2)
+	waitForAutoscalingGauge(t, "desired_workers", "", 2)
+	executionDurationSeconds := getAutoscalingGauge(t, "execution_duration_seconds", "autoscaling")
+	require.True(t, executionDurationSeconds > 0 && executionDurationSeconds < 60)
+
+	complete(request)
+	request = <-requests
+	waitForAutoscalingGauge(t, "demand_slots", "autoscaling", 1)
+	waitForAutoscalingGauge(t, "desired_workers", "", 1)
+
+	// No workers are needed when idle.
+	complete(request)
+	waitForAutoscalingGauge(t, "demand_slots", "autoscaling", 0)
+	waitForAutoscalingGauge(t, "desired_workers", "", 0)
+
+	close(updates)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+}
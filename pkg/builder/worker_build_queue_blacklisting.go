@@ -0,0 +1,134 @@
+package builder
+
+import (
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	workerBuildQueueWorkerBlacklistingsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_worker_blacklistings_total",
+			Help:      "Total number of times a worker was blacklisted, as its build actions consistently failed with infrastructure errors.",
+		})
+	workerBuildQueueWorkerBlacklisted = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_worker_blacklisted",
+			Help:      "Whether a worker is currently blacklisted, per worker.",
+		},
+		[]string{"worker"})
+)
+
+func init() {
+	prometheus.MustRegister(workerBuildQueueWorkerBlacklistingsTotal)
+	prometheus.MustRegister(workerBuildQueueWorkerBlacklisted)
+}
+
+// WorkerBlacklistPolicy controls when the worker build queue stops
+// dispatching build actions to a worker. This prevents unhealthy
+// workers (e.g., ones that have run out of disk space or can no longer
+// reach their runner) from failing large numbers of build actions.
+type WorkerBlacklistPolicy struct {
+	// Number of consecutive build actions that need to fail with an
+	// infrastructure error before the worker is blacklisted.
+	FailureThreshold int
+	// Amount of time for which a worker is blacklisted.
+	Duration time.Duration
+}
+
+// workerHealthState holds the failure history of a single worker. It
+// is tracked separately from workerState, so that it is retained when
+// workers reconnect.
+type workerHealthState struct {
+	consecutiveFailures int
+	blacklistedUntil    time.Time
+}
+
+// isInfrastructureFailure returns whether the outcome of a build action
+// indicates that the worker executing it is unhealthy, as opposed to
+// the build action itself being faulty.
+func isInfrastructureFailure(executeResponse *remoteexecution.ExecuteResponse) bool {
+	if executeResponse.Status == nil {
+		return false
+	}
+	switch codes.Code(executeResponse.Status.Code) {
+	case codes.Internal, codes.ResourceExhausted, codes.Unavailable, codes.Unknown:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordWorkerOutcome updates the failure history of a worker after it
+// completed a build action, blacklisting the worker if too many build
+// actions failed in a row. This function must be called with jobsLock
+// held.
+func (bq *workerBuildQueue) recordWorkerOutcome(worker string, executeResponse *remoteexecution.ExecuteResponse, logger *logrus.Entry) {
+	policy := bq.workerBlacklistPolicy
+	if policy == nil {
+		return
+	}
+	hs, ok := bq.workerHealth[worker]
+	if !isInfrastructureFailure(executeResponse) {
+		if ok && hs.blacklistedUntil.IsZero() {
+			delete(bq.workerHealth, worker)
+		} else if ok {
+			hs.consecutiveFailures = 0
+		}
+		return
+	}
+	if !ok {
+		hs = &workerHealthState{}
+		bq.workerHealth[worker] = hs
+	}
+	hs.consecutiveFailures++
+	if hs.consecutiveFailures < policy.FailureThreshold || !hs.blacklistedUntil.IsZero() {
+		return
+	}
+
+	hs.consecutiveFailures = 0
+	hs.blacklistedUntil = time.Now().Add(policy.Duration)
+	workerBuildQueueWorkerBlacklistingsTotal.Inc()
+	workerBuildQueueWorkerBlacklisted.WithLabelValues(worker).Set(1)
+	logger.WithField("duration", policy.Duration).Warn("Blacklisted worker, as its build actions consistently failed with infrastructure errors")
+	time.AfterFunc(policy.Duration, func() {
+		bq.jobsLock.Lock()
+		defer bq.jobsLock.Unlock()
+		bq.unblacklistWorker(worker)
+	})
+}
+
+// unblacklistWorker allows a worker to receive build actions again
+// after its blacklisting period has expired. This function must be
+// called with jobsLock held.
+func (bq *workerBuildQueue) unblacklistWorker(worker string) {
+	hs, ok := bq.workerHealth[worker]
+	if !ok || hs.blacklistedUntil.IsZero() {
+		return
+	}
+	hs.blacklistedUntil = time.Time{}
+	if hs.consecutiveFailures == 0 {
+		delete(bq.workerHealth, worker)
+	}
+	workerBuildQueueWorkerBlacklisted.DeleteLabelValues(worker)
+	bq.jobsPendingInsertionWakeup.Broadcast()
+}
+
+// getWorkerBlacklistedUntil returns the time until which a worker is
+// blacklisted. It returns the zero time if the worker is not
+// blacklisted. This function must be called with jobsLock held.
+func (bq *workerBuildQueue) getWorkerBlacklistedUntil(worker string) time.Time {
+	if hs, ok := bq.workerHealth[worker]; ok {
+		return hs.blacklistedUntil
+	}
+	return time.Time{}
+}
@@ -0,0 +1,113 @@
+package builder
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+)
+
+// refreshQueueStatus computes the position of every queued job and an
+// estimate of when it will be dispatched to a worker. The estimate is
+// based on the average execution duration of the jobs in front of it
+// and the number of workers that are able to pick them up. The queue
+// is sorted once, so that the status of all jobs is computed in
+// O(n log n) time. This function must be called with jobsLock held.
+func (bq *workerBuildQueue) refreshQueueStatus() {
+	jobs := append(workerBuildJobHeap(nil), bq.jobsPending...)
+	sort.Sort(jobs)
+
+	// An estimate can only be given if workers are available and
+	// build actions have completed before.
+	slots := 0
+	for _, ws := range bq.workers {
+		if !ws.drained {
+			slots += ws.slots
+		}
+	}
+	now := time.Now()
+
+	aheadSeconds := 0.0
+	for operationsAhead, job := range jobs {
+		queueStatus := &scheduler.QueueStatus{
+			OperationsAhead: uint64(operationsAhead),
+		}
+		executionDurationSeconds := bq.getInstanceState(job.executeRequest.InstanceName).executionDurationSeconds
+		if slots > 0 && executionDurationSeconds > 0 {
+			// Jobs ahead in the queue are spread across all
+			// slots. On average, the first slot becomes
+			// available halfway through the execution of a
+			// build action.
+			waitSeconds := aheadSeconds/float64(slots) + executionDurationSeconds/2
+			estimatedStartTimestamp, err := ptypes.TimestampProto(now.Add(time.Duration(waitSeconds * float64(time.Second))))
+			if err == nil {
+				queueStatus.EstimatedStartTimestamp = estimatedStartTimestamp
+			}
+		}
+		job.queueStatus = queueStatus
+		aheadSeconds += executionDurationSeconds
+	}
+}
+
+// getOperationMetadata returns the metadata that is attached to
+// operations returned to clients. If reporting of the queue status is
+// enabled, queued jobs provide a QueuedOperationMetadata message that
+// contains the most recently computed queue status. This function must
+// be called with jobsLock held.
+func (bq *workerBuildQueue) getOperationMetadata(job *workerBuildJob) (*any.Any, error) {
+	executeOperationMetadata := &remoteexecution.ExecuteOperationMetadata{
+		Stage:        job.stage,
+		ActionDigest: job.actionDigest,
+	}
+	if job.stage != remoteexecution.ExecuteOperationMetadata_QUEUED {
+		executeOperationMetadata.StdoutStreamName = job.stdoutStreamName
+		executeOperationMetadata.StderrStreamName = job.stderrStreamName
+	} else if bq.reportQueueStatus {
+		return ptypes.MarshalAny(&scheduler.QueuedOperationMetadata{
+			ExecuteOperationMetadata: executeOperationMetadata,
+			QueueStatus:              job.queueStatus,
+		})
+	}
+	return ptypes.MarshalAny(executeOperationMetadata)
+}
+
+// GetQueueStatus extracts the queue status that the scheduler attaches
+// to the metadata of queued operations. It returns nil if the metadata
+// contains no queue status.
+func GetQueueStatus(metadata *any.Any) *scheduler.QueueStatus {
+	var queuedOperationMetadata scheduler.QueuedOperationMetadata
+	if !ptypes.Is(metadata, &queuedOperationMetadata) {
+		return nil
+	}
+	if err := ptypes.UnmarshalAny(metadata, &queuedOperationMetadata); err != nil {
+		return nil
+	}
+	return queuedOperationMetadata.QueueStatus
+}
+
+// broadcastQueueStatus periodically recomputes the queue status and
+// wakes up clients waiting for queued jobs, so that they receive it.
+// This function returns when the context is done.
+func (bq *workerBuildQueue) broadcastQueueStatus(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			bq.jobsLock.Lock()
+			bq.refreshQueueStatus()
+			for _, job := range bq.jobsPending {
+				if job.stage == remoteexecution.ExecuteOperationMetadata_QUEUED {
+					job.executeTransitionWakeup.Broadcast()
+				}
+			}
+			bq.jobsLock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package builder
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	workerBuildQueueJobsSpeculatedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_jobs_speculated_total",
+			Help:      "Total number of build actions for which a speculative copy was enqueued, as they took longer to execute than usual.",
+		},
+		[]string{"instance_name"})
+)
+
+func init() {
+	prometheus.MustRegister(workerBuildQueueJobsSpeculatedTotal)
+}
+
+// executionDurationSamplesMax is the number of recent execution
+// durations retained per instance name to compute percentiles.
+const executionDurationSamplesMax = 100
+
+// executionDurationSamplesMin is the number of execution durations that
+// need to be observed before build actions are executed speculatively.
+const executionDurationSamplesMin = 20
+
+// SpeculativeExecutionPolicy controls when the worker build queue
+// launches a second copy of a build action on another worker. This
+// reduces tail latencies caused by slow or failing workers, at the cost
+// of spending additional resources.
+type SpeculativeExecutionPolicy struct {
+	// Percentile of recently observed execution durations for the
+	// same instance name, between 0 and 1, after which a build action
+	// is considered to be straggling.
+	Percentile float64
+	// Minimum amount of time a build action needs to execute before
+	// it may be executed speculatively.
+	MinimumDelay time.Duration
+}
+
+// getSpeculationThreshold returns the amount of time after which build
+// actions should be executed speculatively. It returns false if too few
+// execution durations have been observed.
+func (is *instanceState) getSpeculationThreshold(policy *SpeculativeExecutionPolicy) (time.Duration, bool) {
+	if len(is.recentExecutionDurations) < executionDurationSamplesMin {
+		return 0, false
+	}
+	durations := append([]time.Duration(nil), is.recentExecutionDurations...)
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	threshold := durations[int(policy.Percentile*float64(len(durations)-1))]
+	if threshold < policy.MinimumDelay {
+		threshold = policy.MinimumDelay
+	}
+	return threshold, true
+}
+
+// speculateStragglers periodically scans all executing jobs and
+// enqueues a copy of jobs that take longer to execute than usual. The
+// copy may then be picked up by another worker. This function returns
+// when the context is done.
+func (bq *workerBuildQueue) speculateStragglers(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			bq.jobsLock.Lock()
+			bq.enqueueSpeculativeCopies(now)
+			bq.jobsLock.Unlock()
+		}
+	}
+}
+
+// enqueueSpeculativeCopies enqueues a copy of every executing job that
+// has been running its command for longer than the speculation
+// threshold of its instance name. This function must be called with
+// jobsLock held.
+func (bq *workerBuildQueue) enqueueSpeculativeCopies(now time.Time) {
+	enqueued := false
+	for _, ws := range bq.workers {
+		for _, job := range ws.executingJobs {
+			// Only consider the time spent running the
+			// command, as the time spent fetching inputs or
+			// waiting behind a pipelined build action is not
+			// representative.
+			if job.speculated || job.executeResponse != nil || job.executingTime.IsZero() {
+				continue
+			}
+			instanceName := job.executeRequest.InstanceName
+			is := bq.getInstanceState(instanceName)
+			if threshold, ok := is.getSpeculationThreshold(bq.speculativeExecutionPolicy); ok && now.Sub(job.executingTime) > threshold {
+				// The job retains its original insertion
+				// order, causing it to be placed at the
+				// front of the queue.
+				job.speculated = true
+				job.speculativeCopyQueued = true
+				heap.Push(&bq.jobsPending, job)
+				enqueued = true
+				workerBuildQueueJobsPending.WithLabelValues(instanceName).Inc()
+				workerBuildQueueJobsSpeculatedTotal.WithLabelValues(instanceName).Inc()
+				is.jobsPending++
+				job.logger.WithField("threshold", threshold).Info("Enqueued speculative copy of straggling action")
+			}
+		}
+	}
+	if enqueued {
+		bq.jobsPendingInsertionWakeup.Broadcast()
+		bq.updateAutoscalingMetrics()
+	}
+}
+
+// removeSpeculativeCopy removes the speculative copy of a job from the
+// queue if it has not been dispatched to a worker yet. This function
+// must be called with jobsLock held.
+func (bq *workerBuildQueue) removeSpeculativeCopy(job *workerBuildJob) {
+	if !job.speculativeCopyQueued {
+		return
+	}
+	for i, pendingJob := range bq.jobsPending {
+		if pendingJob == job {
+			heap.Remove(&bq.jobsPending, i)
+			break
+		}
+	}
+	job.speculativeCopyQueued = false
+	instanceName := job.executeRequest.InstanceName
+	workerBuildQueueJobsPending.WithLabelValues(instanceName).Dec()
+	bq.getInstanceState(instanceName).jobsPending--
+	bq.updateAutoscalingMetrics()
+}
@@ -0,0 +1,181 @@
+package builder_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestWorkerBuildQueueSpeculativeExecution(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Stop looking for stragglers when the test completes.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, adminServer := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 100, actionIndexRecorder, 0, nil, &builder.SpeculativeExecutionPolicy{
+		Percentile: 0.5,
+	}, 0, nil, nil, nil, nil)
+
+	getActionDigest := func(i int) *remoteexecution.Digest {
+		return &remoteexecution.Digest{
+			Hash:      fmt.Sprintf("%064x", i),
+			SizeBytes: int64(i + 1),
+		}
+	}
+
+	// execute enqueues a build action. The execute response that is
+	// returned to the client is sent through the resulting channel.
+	execute := func(i int) <-chan *remoteexecution.ExecuteResponse {
+		var lastOperation *longrunning.Operation
+		executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+		executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+		executeServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(operation *longrunning.Operation) error {
+			lastOperation = operation
+			return nil
+		}).AnyTimes()
+		responses := make(chan *remoteexecution.ExecuteResponse, 1)
+		go func() {
+			var response remoteexecution.ExecuteResponse
+			if err := buildQueue.Execute(&remoteexecution.ExecuteRequest{
+				InstanceName: "debian8",
+				ActionDigest: getActionDigest(i),
+			}, executeServer); err != nil {
+				response.Status = status.Convert(err).Proto()
+			} else if err := ptypes.UnmarshalAny(lastOperation.GetResponse(), &response); err != nil {
+				response.Status = status.Convert(err).Proto()
+			}
+			responses <- &response
+		}()
+		return responses
+	}
+
+	// connectWorker lets a worker with a given identity call
+	// GetWork(). It returns channels through which updates are sent
+	// and work requests are received.
+	connectWorker := func(id string) (chan<- *scheduler.WorkerUpdate, <-chan *scheduler.WorkRequest, <-chan error) {
+		outgoingMetadata, _ := metadata.FromOutgoingContext(builder.NewContextWithWorkerIdentity(ctx, &scheduler.WorkerIdentity{Id: id}))
+		updates := make(chan *scheduler.WorkerUpdate)
+		requests := make(chan *scheduler.WorkRequest, 1)
+		getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+		getWorkServer.EXPECT().Context().Return(metadata.NewIncomingContext(ctx, outgoingMetadata)).AnyTimes()
+		getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+			update, ok := <-updates
+			if !ok {
+				return nil, status.Error(codes.Canceled, "Worker disconnected")
+			}
+			return update, nil
+		}).AnyTimes()
+		getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+			requests <- request
+			return nil
+		}).AnyTimes()
+		getWorkErrors := make(chan error, 1)
+		go func() {
+			getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+		}()
+		return updates, requests, getWorkErrors
+	}
+
+	startExecuting := func(updates chan<- *scheduler.WorkerUpdate, request *scheduler.WorkRequest) {
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update:        &scheduler.WorkerUpdate_Stage{Stage: scheduler.ExecutionStage_EXECUTING},
+		}
+	}
+	complete := func(updates chan<- *scheduler.WorkerUpdate, request *scheduler.WorkRequest, exitCode int32) {
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update: &scheduler.WorkerUpdate_ExecuteResponse{
+				ExecuteResponse: &remoteexecution.ExecuteResponse{
+					Result: &remoteexecution.ActionResult{ExitCode: exitCode},
+				},
+			},
+		}
+	}
+
+	// getQueuedOperationNames returns the names of the operations
+	// that are queued, waiting until the expected number of
+	// operations is reached.
+	getQueuedOperationNames := func(count int) []string {
+		for deadline := time.Now().Add(10 * time.Second); ; {
+			response, err := adminServer.ListQueuedOperations(ctx, &admin.ListQueuedOperationsRequest{})
+			require.NoError(t, err)
+			if len(response.QueuedOperations) == count || time.Now().After(deadline) {
+				var names []string
+				for _, operation := range response.QueuedOperations {
+					names = append(names, operation.Name)
+				}
+				return names
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Let a worker execute a sufficient number of build actions to
+	// determine how long build actions usually take to execute.
+	updates1, requests1, getWorkErrors1 := connectWorker("worker-1")
+	for i := 0; i < 20; i++ {
+		responses := execute(i)
+		request := <-requests1
+		require.True(t, proto.Equal(getActionDigest(i), request.ActionDigest))
+		startExecuting(updates1, request)
+		complete(updates1, request, 0)
+		require.Equal(t, int32(0), (<-responses).Result.GetExitCode())
+	}
+
+	// Let the next build action straggle. A copy of it should be
+	// handed to another worker. The copy completes first, meaning
+	// its result should be returned to the client.
+	responses := execute(20)
+	originalRequest := <-requests1
+	startExecuting(updates1, originalRequest)
+	updates2, requests2, getWorkErrors2 := connectWorker("worker-2")
+	speculativeRequest := <-requests2
+	require.Equal(t, originalRequest.OperationName, speculativeRequest.OperationName)
+	require.True(t, proto.Equal(getActionDigest(20), speculativeRequest.ActionDigest))
+	startExecuting(updates2, speculativeRequest)
+	complete(updates2, speculativeRequest, 2)
+	require.Equal(t, int32(2), (<-responses).Result.GetExitCode())
+
+	// The result of the losing attempt should be discarded. This
+	// should still return the credit of the worker.
+	complete(updates1, originalRequest, 1)
+	close(updates2)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors2)
+
+	// Let another build action straggle, while no other worker is
+	// available. Its copy remains queued.
+	responses = execute(21)
+	originalRequest = <-requests1
+	require.True(t, proto.Equal(getActionDigest(21), originalRequest.ActionDigest))
+	startExecuting(updates1, originalRequest)
+	require.Equal(t, []string{originalRequest.OperationName}, getQueuedOperationNames(1))
+
+	// Completion of the original attempt should cancel the copy,
+	// removing it from the queue.
+	complete(updates1, originalRequest, 0)
+	require.Equal(t, int32(0), (<-responses).Result.GetExitCode())
+	require.Empty(t, getQueuedOperationNames(0))
+
+	close(updates1)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors1)
+}
@@ -0,0 +1,722 @@
+package builder_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/admin"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestWorkerBuildQueueQueueStatus(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+
+	t.Run("Disabled", func(t *testing.T) {
+		// Without a queue status interval, clients should
+		// receive plain ExecuteOperationMetadata.
+		buildQueue, _, _ := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, nil, nil, 0, nil, nil, nil, nil)
+		executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+		executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+		executeServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(operation *longrunning.Operation) error {
+			var executeOperationMetadata remoteexecution.ExecuteOperationMetadata
+			require.NoError(t, ptypes.UnmarshalAny(operation.Metadata, &executeOperationMetadata))
+			require.Equal(t, remoteexecution.ExecuteOperationMetadata_QUEUED, executeOperationMetadata.Stage)
+			require.Nil(t, builder.GetQueueStatus(operation.Metadata))
+			return status.Error(codes.Canceled, "Client disconnected")
+		})
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "Client disconnected"),
+			buildQueue.Execute(&remoteexecution.ExecuteRequest{
+				InstanceName: "debian8",
+				ActionDigest: &remoteexecution.Digest{
+					Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+					SizeBytes: 11,
+				},
+			}, executeServer))
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		buildQueue, _, _ := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, nil, nil, 10*time.Millisecond, nil, nil, nil, nil)
+
+		// Enqueue two build actions. Clients wait until they
+		// receive a queue status and disconnect afterwards,
+		// leaving the actions queued.
+		for i, actionDigest := range []*remoteexecution.Digest{
+			{Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", SizeBytes: 11},
+			{Hash: "3e25960a79dbc69b674cd4ec67a72c62dcf7e0a2a2a1d0c6e4db5d3e1d8a6c2f", SizeBytes: 12},
+		} {
+			operationsAhead := uint64(i)
+			executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+			executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+			executeServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(operation *longrunning.Operation) error {
+				var queuedOperationMetadata scheduler.QueuedOperationMetadata
+				require.NoError(t, ptypes.UnmarshalAny(operation.Metadata, &queuedOperationMetadata))
+				require.Equal(t, remoteexecution.ExecuteOperationMetadata_QUEUED, queuedOperationMetadata.ExecuteOperationMetadata.Stage)
+				queueStatus := builder.GetQueueStatus(operation.Metadata)
+				if queueStatus == nil {
+					// Not computed yet.
+					return nil
+				}
+				require.Equal(t, operationsAhead, queueStatus.OperationsAhead)
+				require.Nil(t, queueStatus.EstimatedStartTimestamp)
+				return status.Error(codes.Canceled, "Client disconnected")
+			}).MinTimes(1)
+			require.Equal(
+				t,
+				status.Error(codes.Canceled, "Client disconnected"),
+				buildQueue.Execute(&remoteexecution.ExecuteRequest{
+					InstanceName: "debian8",
+					ActionDigest: actionDigest,
+				}, executeServer))
+		}
+	})
+}
+
+func TestWorkerBuildQueueGetWorkCredits(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, _ := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, nil, nil, 0, nil, nil, nil, nil)
+
+	// Enqueue two build actions.
+	for _, actionDigest := range []*remoteexecution.Digest{
+		{Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", SizeBytes: 11},
+		{Hash: "3e25960a79dbc69b674cd4ec67a72c62dcf7e0a2a2a1d0c6e4db5d3e1d8a6c2f", SizeBytes: 12},
+	} {
+		executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+		executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+		executeServer.EXPECT().Send(gomock.Any()).Return(status.Error(codes.Canceled, "Client disconnected"))
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "Client disconnected"),
+			buildQueue.Execute(&remoteexecution.ExecuteRequest{
+				InstanceName: "debian8",
+				ActionDigest: actionDigest,
+			}, executeServer))
+	}
+
+	// A worker that grants an additional credit should receive
+	// both build actions without completing either of them.
+	updates := make(chan *scheduler.WorkerUpdate, 3)
+	requests := make(chan *scheduler.WorkRequest, 2)
+	getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+	getWorkServer.EXPECT().Context().Return(ctx).AnyTimes()
+	getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+		update, ok := <-updates
+		if !ok {
+			return nil, status.Error(codes.Canceled, "Worker disconnected")
+		}
+		return update, nil
+	}).AnyTimes()
+	getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+		requests <- request
+		return nil
+	}).Times(2)
+	getWorkErrors := make(chan error, 1)
+	go func() {
+		getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+	}()
+	updates <- &scheduler.WorkerUpdate{
+		Update: &scheduler.WorkerUpdate_Credits{Credits: 1},
+	}
+	request1 := <-requests
+	request2 := <-requests
+	require.NotEqual(t, request1.OperationName, request2.OperationName)
+
+	// Completion of both build actions should be matched by
+	// operation name. Closing the stream should cause GetWork()
+	// to return.
+	for _, request := range []*scheduler.WorkRequest{request2, request1} {
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update: &scheduler.WorkerUpdate_ExecuteResponse{
+				ExecuteResponse: &remoteexecution.ExecuteResponse{
+					Result: &remoteexecution.ActionResult{},
+				},
+			},
+		}
+	}
+	close(updates)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+}
+
+func TestWorkerBuildQueueWorkerBlacklisting(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, adminServer := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, nil, nil, 0, &builder.WorkerBlacklistPolicy{
+		FailureThreshold: 1,
+		Duration:         time.Hour,
+	}, nil, nil, nil)
+
+	// Enqueue two build actions.
+	for _, actionDigest := range []*remoteexecution.Digest{
+		{Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", SizeBytes: 11},
+		{Hash: "3e25960a79dbc69b674cd4ec67a72c62dcf7e0a2a2a1d0c6e4db5d3e1d8a6c2f", SizeBytes: 12},
+	} {
+		executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+		executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+		executeServer.EXPECT().Send(gomock.Any()).Return(status.Error(codes.Canceled, "Client disconnected"))
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "Client disconnected"),
+			buildQueue.Execute(&remoteexecution.ExecuteRequest{
+				InstanceName: "debian8",
+				ActionDigest: actionDigest,
+			}, executeServer))
+	}
+
+	// Let the worker fail the first build action with an
+	// infrastructure error. The second build action should not be
+	// dispatched to it, as the worker is blacklisted.
+	updates := make(chan *scheduler.WorkerUpdate)
+	recvCalls := make(chan struct{}, 1)
+	requests := make(chan *scheduler.WorkRequest, 1)
+	getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+	getWorkServer.EXPECT().Context().Return(ctx).AnyTimes()
+	getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+		recvCalls <- struct{}{}
+		update, ok := <-updates
+		if !ok {
+			return nil, status.Error(codes.Canceled, "Worker disconnected")
+		}
+		return update, nil
+	}).AnyTimes()
+	getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+		requests <- request
+		return nil
+	})
+	getWorkErrors := make(chan error, 1)
+	go func() {
+		getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+	}()
+	request := <-requests
+	<-recvCalls
+	updates <- &scheduler.WorkerUpdate{
+		OperationName: request.OperationName,
+		Update: &scheduler.WorkerUpdate_ExecuteResponse{
+			ExecuteResponse: &remoteexecution.ExecuteResponse{
+				Status: status.New(codes.Internal, "Failed to create build directory: No space left on device").Proto(),
+			},
+		},
+	}
+	<-recvCalls
+
+	// The blacklisting should be visible through the Admin service.
+	response, err := adminServer.ListWorkers(ctx, &admin.ListWorkersRequest{})
+	require.NoError(t, err)
+	require.Len(t, response.Workers, 1)
+	require.NotNil(t, response.Workers[0].BlacklistedUntil)
+
+	close(updates)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+}
+
+func TestWorkerBuildQueueWorkerIdentity(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, adminServer := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, nil, nil, 0, nil, nil, nil, nil)
+
+	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+	executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+	executeServer.EXPECT().Send(gomock.Any()).Return(status.Error(codes.Canceled, "Client disconnected"))
+	require.Equal(
+		t,
+		status.Error(codes.Canceled, "Client disconnected"),
+		buildQueue.Execute(&remoteexecution.ExecuteRequest{
+			InstanceName: "debian8",
+			ActionDigest: &remoteexecution.Digest{
+				Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+				SizeBytes: 11,
+			},
+		}, executeServer))
+
+	// Convert the identity attached to an outgoing call to
+	// incoming metadata, as the GRPC server would.
+	identity := builder.NewWorkerIdentity("worker-pod", map[string]string{"zone": "europe-west4-a"})
+	require.Regexp(t, "^worker-pod-[0-9a-f]{8}$", identity.Id)
+	outgoingMetadata, _ := metadata.FromOutgoingContext(builder.NewContextWithWorkerIdentity(ctx, identity))
+	workerCtx := metadata.NewIncomingContext(ctx, outgoingMetadata)
+
+	// The scheduler should refer to the worker by its identity,
+	// both in work requests and through the Admin service.
+	updates := make(chan *scheduler.WorkerUpdate)
+	requests := make(chan *scheduler.WorkRequest, 1)
+	getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+	getWorkServer.EXPECT().Context().Return(workerCtx).AnyTimes()
+	getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+		update, ok := <-updates
+		if !ok {
+			return nil, status.Error(codes.Canceled, "Worker disconnected")
+		}
+		return update, nil
+	}).AnyTimes()
+	getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+		requests <- request
+		return nil
+	})
+	getWorkErrors := make(chan error, 1)
+	go func() {
+		getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+	}()
+	request := <-requests
+	require.True(t, proto.Equal(identity, request.Worker))
+
+	response, err := adminServer.ListWorkers(ctx, &admin.ListWorkersRequest{})
+	require.NoError(t, err)
+	require.Len(t, response.Workers, 1)
+	require.Equal(t, identity.Id, response.Workers[0].WorkerId)
+	require.Equal(t, map[string]string{"zone": "europe-west4-a"}, response.Workers[0].Labels)
+
+	close(updates)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+}
+
+func TestWorkerBuildQueueFlushWorkerCache(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, adminServer := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, nil, nil, 0, nil, nil, nil, nil)
+
+	enqueue := func(hash string) {
+		executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+		executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+		executeServer.EXPECT().Send(gomock.Any()).Return(status.Error(codes.Canceled, "Client disconnected"))
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "Client disconnected"),
+			buildQueue.Execute(&remoteexecution.ExecuteRequest{
+				InstanceName: "debian8",
+				ActionDigest: &remoteexecution.Digest{
+					Hash:      hash,
+					SizeBytes: 11,
+				},
+			}, executeServer))
+	}
+	enqueue("64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c")
+
+	// Flushing the cache of a worker that isn't connected should
+	// fail.
+	_, err := adminServer.FlushWorkerCache(ctx, &admin.FlushWorkerCacheRequest{WorkerId: "unknown"})
+	require.Equal(t, status.Error(codes.NotFound, "Worker unknown not found"), err)
+
+	updates := make(chan *scheduler.WorkerUpdate)
+	requests := make(chan *scheduler.WorkRequest, 1)
+	getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+	getWorkServer.EXPECT().Context().Return(ctx).AnyTimes()
+	getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+		update, ok := <-updates
+		if !ok {
+			return nil, status.Error(codes.Canceled, "Worker disconnected")
+		}
+		return update, nil
+	}).AnyTimes()
+	getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+		requests <- request
+		return nil
+	}).Times(3)
+	getWorkErrors := make(chan error, 1)
+	go func() {
+		getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+	}()
+	complete := func(request *scheduler.WorkRequest) {
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update: &scheduler.WorkerUpdate_ExecuteResponse{
+				ExecuteResponse: &remoteexecution.ExecuteResponse{
+					Result: &remoteexecution.ActionResult{},
+				},
+			},
+		}
+	}
+	request := <-requests
+	require.False(t, request.FlushCache)
+
+	// A request to flush the cache should be attached to the next
+	// build action dispatched to the worker, but not to the ones
+	// after that. Workers without an identity are named "unknown"
+	// if their network address is not known either.
+	_, err = adminServer.FlushWorkerCache(ctx, &admin.FlushWorkerCacheRequest{WorkerId: "unknown"})
+	require.NoError(t, err)
+	complete(request)
+	enqueue("3e25960a79dbc69b674cd4ec67a72c62dcf7e0a2a2a1d0c6e4db5d3e1d8a6c2f")
+	request = <-requests
+	require.True(t, request.FlushCache)
+
+	// The worker reports completion of the flush through the next
+	// update it sends.
+	updates <- &scheduler.WorkerUpdate{
+		OperationName: request.OperationName,
+		Update: &scheduler.WorkerUpdate_ExecuteResponse{
+			ExecuteResponse: &remoteexecution.ExecuteResponse{
+				Result: &remoteexecution.ActionResult{},
+			},
+		},
+		CacheFlushed: true,
+	}
+	enqueue("8b1a9953c4611296a827abf8c47804d78b1a9953c4611296a827abf8c47804d7")
+	request = <-requests
+	require.False(t, request.FlushCache)
+
+	close(updates)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+}
+
+func TestWorkerBuildQueueAffinity(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Three build actions, of which the first and the last use the
+	// same toolchain.
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	toolchainDigests := []*remoteexecution.Digest{
+		{Hash: "1111111111111111111111111111111111111111111111111111111111111111", SizeBytes: 100},
+		{Hash: "2222222222222222222222222222222222222222222222222222222222222222", SizeBytes: 100},
+		{Hash: "1111111111111111111111111111111111111111111111111111111111111111", SizeBytes: 100},
+	}
+	actionDigests := []*remoteexecution.Digest{
+		{Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", SizeBytes: 11},
+		{Hash: "3e25960a79dbc69b674cd4ec67a72c62dcf7e0a2a2a1d0c6e4db5d3e1d8a6c2f", SizeBytes: 12},
+		{Hash: "9a7b1d3c1f2e9e8a6c4b2d0f1e3a5c7b9d1f3e5a7c9b1d3f5e7a9c1b3d5f7e9a", SizeBytes: 13},
+	}
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, _ := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, contentAddressableStorage, nil, 0, nil, nil, &builder.AffinityPolicy{
+		Directories:      []string{"toolchain"},
+		HistorySize:      4,
+		MaximumQueueJump: 1,
+	}, nil)
+	for i, actionDigest := range actionDigests {
+		inputRootDigest := &remoteexecution.Digest{
+			Hash:      fmt.Sprintf("%064x", i),
+			SizeBytes: 50,
+		}
+		contentAddressableStorage.EXPECT().GetAction(gomock.Any(), util.MustNewDigest("debian8", actionDigest)).Return(&remoteexecution.Action{
+			CommandDigest: &remoteexecution.Digest{
+				Hash:      "f7fce1ee6ef2a3a3a9d5d1e5e1d2dc3e1e8a3e6b8c1dc6e0f8e3d1e1a5e2c3d4",
+				SizeBytes: 20,
+			},
+			InputRootDigest: inputRootDigest,
+		}, nil)
+		contentAddressableStorage.EXPECT().GetCommand(gomock.Any(), gomock.Any()).Return(&remoteexecution.Command{}, nil)
+		contentAddressableStorage.EXPECT().GetDirectory(gomock.Any(), util.MustNewDigest("debian8", inputRootDigest)).Return(&remoteexecution.Directory{
+			Directories: []*remoteexecution.DirectoryNode{
+				{Name: "toolchain", Digest: toolchainDigests[i]},
+			},
+		}, nil)
+
+		executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+		executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+		executeServer.EXPECT().Send(gomock.Any()).Return(status.Error(codes.Canceled, "Client disconnected"))
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "Client disconnected"),
+			buildQueue.Execute(&remoteexecution.ExecuteRequest{
+				InstanceName: "debian8",
+				ActionDigest: actionDigest,
+			}, executeServer))
+	}
+
+	updates := make(chan *scheduler.WorkerUpdate)
+	requests := make(chan *scheduler.WorkRequest, 1)
+	getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+	getWorkServer.EXPECT().Context().Return(ctx).AnyTimes()
+	getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+		update, ok := <-updates
+		if !ok {
+			return nil, status.Error(codes.Canceled, "Worker disconnected")
+		}
+		return update, nil
+	}).AnyTimes()
+	getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+		requests <- request
+		return nil
+	}).Times(3)
+	getWorkErrors := make(chan error, 1)
+	go func() {
+		getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+	}()
+
+	// After executing the first build action, the worker should
+	// receive the third build action, as it uses the same
+	// toolchain. The second build action is executed last.
+	for _, i := range []int{0, 2, 1} {
+		request := <-requests
+		require.True(t, proto.Equal(actionDigests[i], request.ActionDigest))
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update: &scheduler.WorkerUpdate_ExecuteResponse{
+				ExecuteResponse: &remoteexecution.ExecuteResponse{
+					Result: &remoteexecution.ActionResult{},
+				},
+			},
+		}
+	}
+	close(updates)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+}
+
+func TestWorkerBuildQueuePipelining(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+	buildQueue, schedulerServer, _ := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, nil, nil, 0, nil, nil, nil, nil)
+
+	// Enqueue three build actions.
+	actionDigests := []*remoteexecution.Digest{
+		{Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", SizeBytes: 11},
+		{Hash: "3e25960a79dbc69b674cd4ec67a72c62dcf7e0a2a2a1d0c6e4db5d3e1d8a6c2f", SizeBytes: 12},
+		{Hash: "9a7b1d3c1f2e9e8a6c4b2d0f1e3a5c7b9d1f3e5a7c9b1d3f5e7a9c1b3d5f7e9a", SizeBytes: 13},
+	}
+	for _, actionDigest := range actionDigests {
+		executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+		executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+		executeServer.EXPECT().Send(gomock.Any()).Return(status.Error(codes.Canceled, "Client disconnected"))
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "Client disconnected"),
+			buildQueue.Execute(&remoteexecution.ExecuteRequest{
+				InstanceName: "debian8",
+				ActionDigest: actionDigest,
+			}, executeServer))
+	}
+
+	updates := make(chan *scheduler.WorkerUpdate)
+	requests := make(chan *scheduler.WorkRequest, 1)
+	getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+	getWorkServer.EXPECT().Context().Return(ctx).AnyTimes()
+	getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+		update, ok := <-updates
+		if !ok {
+			return nil, status.Error(codes.Canceled, "Worker disconnected")
+		}
+		return update, nil
+	}).AnyTimes()
+	getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+		requests <- request
+		return nil
+	}).Times(3)
+	getWorkErrors := make(chan error, 1)
+	go func() {
+		getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+	}()
+	completeRequest := func(request *scheduler.WorkRequest) {
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update: &scheduler.WorkerUpdate_ExecuteResponse{
+				ExecuteResponse: &remoteexecution.ExecuteResponse{
+					Result: &remoteexecution.ActionResult{},
+				},
+			},
+		}
+	}
+
+	// With the initial credit, only the first build action is
+	// dispatched.
+	request1 := <-requests
+	require.True(t, proto.Equal(actionDigests[0], request1.ActionDigest))
+	require.Empty(t, request1.PreviousOperationName)
+
+	// Once the worker enables pipelining and reports that the first
+	// build action is executing, the second build action should be
+	// pipelined behind it.
+	updates <- &scheduler.WorkerUpdate{
+		Update: &scheduler.WorkerUpdate_Pipelining{Pipelining: true},
+	}
+	updates <- &scheduler.WorkerUpdate{
+		OperationName: request1.OperationName,
+		Update:        &scheduler.WorkerUpdate_Stage{Stage: scheduler.ExecutionStage_EXECUTING},
+	}
+	request2 := <-requests
+	require.True(t, proto.Equal(actionDigests[1], request2.ActionDigest))
+	require.Equal(t, request1.OperationName, request2.PreviousOperationName)
+
+	// Completing the first build action should not return its
+	// credit, as it is handed over to the second build action. The
+	// third build action should thus only be sent once the second
+	// build action is executing, pipelined behind it.
+	completeRequest(request1)
+	updates <- &scheduler.WorkerUpdate{
+		OperationName: request2.OperationName,
+		Update:        &scheduler.WorkerUpdate_Stage{Stage: scheduler.ExecutionStage_FETCHING_INPUTS},
+	}
+	updates <- &scheduler.WorkerUpdate{
+		OperationName: request2.OperationName,
+		Update:        &scheduler.WorkerUpdate_Stage{Stage: scheduler.ExecutionStage_EXECUTING},
+	}
+	request3 := <-requests
+	require.True(t, proto.Equal(actionDigests[2], request3.ActionDigest))
+	require.Equal(t, request2.OperationName, request3.PreviousOperationName)
+
+	completeRequest(request2)
+	completeRequest(request3)
+	close(updates)
+	require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+}
+
+func TestWorkerBuildQueueResourcePacking(t *testing.T) {
+	actionDigests := []*remoteexecution.Digest{
+		{Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", SizeBytes: 11},
+		{Hash: "3e25960a79dbc69b674cd4ec67a72c62dcf7e0a2a2a1d0c6e4db5d3e1d8a6c2f", SizeBytes: 12},
+		{Hash: "9a7b1d3c1f2e9e8a6c4b2d0f1e3a5c7b9d1f3e5a7c9b1d3f5e7a9c1b3d5f7e9a", SizeBytes: 13},
+		{Hash: "0d5b2f8e4a6c1e3b5d7f9a1c3e5b7d9f1a3c5e7b9d1f3a5c7e9b1d3f5a7c9e1b", SizeBytes: 14},
+	}
+
+	// runWorker enqueues build actions requiring a given number of
+	// CPUs and connects a worker with four CPUs and four credits.
+	// It returns channels through which work requests are received
+	// and updates are sent.
+	runWorker := func(t *testing.T, ctrl *gomock.Controller, ctx context.Context, resourcePackingPolicy *builder.ResourcePackingPolicy, cpus []int) (chan<- *scheduler.WorkerUpdate, <-chan *scheduler.WorkRequest, <-chan error) {
+		contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+		actionIndexRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+		buildQueue, schedulerServer, _ := builder.NewWorkerBuildQueue(ctx, util.DigestKeyWithInstance, 10, actionIndexRecorder, 0, contentAddressableStorage, nil, 0, nil, nil, nil, resourcePackingPolicy)
+
+		updates := make(chan *scheduler.WorkerUpdate)
+		requests := make(chan *scheduler.WorkRequest, len(cpus))
+		md, _ := metadata.FromOutgoingContext(builder.NewContextWithWorkerResources(ctx, &scheduler.WorkerResources{Cpus: 4}))
+		getWorkServer := mock.NewMockScheduler_GetWorkServer(ctrl)
+		getWorkServer.EXPECT().Context().Return(metadata.NewIncomingContext(ctx, md)).AnyTimes()
+		getWorkServer.EXPECT().Recv().DoAndReturn(func() (*scheduler.WorkerUpdate, error) {
+			update, ok := <-updates
+			if !ok {
+				return nil, status.Error(codes.Canceled, "Worker disconnected")
+			}
+			return update, nil
+		}).AnyTimes()
+		getWorkServer.EXPECT().Send(gomock.Any()).DoAndReturn(func(request *scheduler.WorkRequest) error {
+			requests <- request
+			return nil
+		}).Times(len(cpus))
+		getWorkErrors := make(chan error, 1)
+		go func() {
+			getWorkErrors <- schedulerServer.GetWork(getWorkServer)
+		}()
+
+		// Updates are received one at a time, meaning that the
+		// credits are granted once the second update is sent.
+		updates <- &scheduler.WorkerUpdate{
+			Update: &scheduler.WorkerUpdate_Credits{Credits: 2},
+		}
+		updates <- &scheduler.WorkerUpdate{
+			Update: &scheduler.WorkerUpdate_Credits{Credits: 1},
+		}
+
+		for i, actionCPUs := range cpus {
+			commandDigest := &remoteexecution.Digest{
+				Hash:      fmt.Sprintf("%064x", i),
+				SizeBytes: 20,
+			}
+			contentAddressableStorage.EXPECT().GetAction(gomock.Any(), util.MustNewDigest("debian8", actionDigests[i])).Return(&remoteexecution.Action{
+				CommandDigest: commandDigest,
+			}, nil)
+			contentAddressableStorage.EXPECT().GetCommand(gomock.Any(), util.MustNewDigest("debian8", commandDigest)).Return(&remoteexecution.Command{
+				Platform: &remoteexecution.Platform{
+					Properties: []*remoteexecution.Platform_Property{
+						{Name: "cpus", Value: fmt.Sprintf("%d", actionCPUs)},
+					},
+				},
+			}, nil)
+
+			executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
+			executeServer.EXPECT().Context().Return(ctx).AnyTimes()
+			executeServer.EXPECT().Send(gomock.Any()).Return(status.Error(codes.Canceled, "Client disconnected"))
+			require.Equal(
+				t,
+				status.Error(codes.Canceled, "Client disconnected"),
+				buildQueue.Execute(&remoteexecution.ExecuteRequest{
+					InstanceName: "debian8",
+					ActionDigest: actionDigests[i],
+				}, executeServer))
+		}
+		return updates, requests, getWorkErrors
+	}
+	expectRequest := func(t *testing.T, requests <-chan *scheduler.WorkRequest, i int) *scheduler.WorkRequest {
+		request := <-requests
+		require.True(t, proto.Equal(actionDigests[i], request.ActionDigest))
+		return request
+	}
+	complete := func(updates chan<- *scheduler.WorkerUpdate, request *scheduler.WorkRequest) {
+		updates <- &scheduler.WorkerUpdate{
+			OperationName: request.OperationName,
+			Update: &scheduler.WorkerUpdate_ExecuteResponse{
+				ExecuteResponse: &remoteexecution.ExecuteResponse{
+					Result: &remoteexecution.ActionResult{},
+				},
+			},
+		}
+	}
+
+	t.Run("Lookahead", func(t *testing.T) {
+		ctrl, ctx := gomock.WithContext(context.Background(), t)
+		defer ctrl.Finish()
+
+		// The second build action does not fit while the first
+		// one is running. The third one should be dispatched
+		// in the meantime.
+		updates, requests, getWorkErrors := runWorker(t, ctrl, ctx, &builder.ResourcePackingPolicy{
+			Lookahead: 100,
+		}, []int{1, 4, 1})
+		request1 := expectRequest(t, requests, 0)
+		request3 := expectRequest(t, requests, 2)
+		complete(updates, request1)
+		complete(updates, request3)
+		complete(updates, expectRequest(t, requests, 1))
+		close(updates)
+		require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+	})
+
+	t.Run("LookaheadExceeded", func(t *testing.T) {
+		ctrl, ctx := gomock.WithContext(context.Background(), t)
+		defer ctrl.Finish()
+
+		// Only the third build action is considered when the
+		// second one does not fit. As it does not fit either,
+		// the fourth build action has to wait.
+		updates, requests, getWorkErrors := runWorker(t, ctrl, ctx, &builder.ResourcePackingPolicy{
+			Lookahead: 1,
+		}, []int{1, 4, 4, 1})
+		complete(updates, expectRequest(t, requests, 0))
+		complete(updates, expectRequest(t, requests, 1))
+		complete(updates, expectRequest(t, requests, 2))
+		complete(updates, expectRequest(t, requests, 3))
+		close(updates)
+		require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+	})
+
+	t.Run("Reservation", func(t *testing.T) {
+		ctrl, ctx := gomock.WithContext(context.Background(), t)
+		defer ctrl.Finish()
+
+		// The second build action has been queued for longer
+		// than the reservation age. Instead of dispatching the
+		// third build action, the worker should be reserved
+		// until the second one fits.
+		updates, requests, getWorkErrors := runWorker(t, ctrl, ctx, &builder.ResourcePackingPolicy{
+			Lookahead:      100,
+			ReservationAge: time.Nanosecond,
+		}, []int{1, 4, 1})
+		complete(updates, expectRequest(t, requests, 0))
+		complete(updates, expectRequest(t, requests, 1))
+		complete(updates, expectRequest(t, requests, 2))
+		close(updates)
+		require.Equal(t, status.Error(codes.Canceled, "Worker disconnected"), <-getWorkErrors)
+	})
+}
@@ -0,0 +1,78 @@
+package builder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// workerIdentityHeader is the name of the GRPC header through which
+// workers provide a WorkerIdentity message when calling GetWork().
+const workerIdentityHeader = "build.bazel.buildbarn.worker-identity-bin"
+
+// NewWorkerIdentity creates a WorkerIdentity for a worker process. A
+// random suffix is appended to the name of the worker (e.g., its
+// hostname or the name of its Kubernetes pod), so that restarts of the
+// same worker can be distinguished in logs and execution history.
+func NewWorkerIdentity(name string, labels map[string]string) *scheduler.WorkerIdentity {
+	var suffix [4]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		panic(err)
+	}
+	return &scheduler.WorkerIdentity{
+		Id:     name + "-" + hex.EncodeToString(suffix[:]),
+		Labels: labels,
+	}
+}
+
+// NewContextWithWorkerIdentity attaches the identity of a worker to an
+// outgoing GetWork() call, so that the scheduler refers to the worker
+// by its identity instead of its network address.
+func NewContextWithWorkerIdentity(ctx context.Context, identity *scheduler.WorkerIdentity) context.Context {
+	data, err := proto.Marshal(identity)
+	if err != nil {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, workerIdentityHeader, string(data))
+}
+
+// getWorkerIdentity extracts the WorkerIdentity message that a worker
+// attached to an incoming GetWork() call. It returns nil if the worker
+// did not provide its identity.
+func getWorkerIdentity(ctx context.Context) *scheduler.WorkerIdentity {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	values := md.Get(workerIdentityHeader)
+	if len(values) == 0 {
+		return nil
+	}
+	var identity scheduler.WorkerIdentity
+	if err := proto.Unmarshal([]byte(values[0]), &identity); err != nil || identity.Id == "" {
+		return nil
+	}
+	return &identity
+}
+
+type workerNameKey struct{}
+
+// NewContextWithWorkerName returns a context that carries the name of
+// the worker slot on which a build action is executed. BuildExecutors
+// that are called with this context store the name in the
+// ExecutedActionMetadata of the action result.
+func NewContextWithWorkerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, workerNameKey{}, name)
+}
+
+// getWorkerName returns the name of the worker slot attached to a
+// context, or the empty string if none is attached.
+func getWorkerName(ctx context.Context) string {
+	name, _ := ctx.Value(workerNameKey{}).(string)
+	return name
+}
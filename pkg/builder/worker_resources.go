@@ -0,0 +1,170 @@
+package builder
+
+import (
+	"container/heap"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// workerResourcesHeader is the name of the GRPC header through which
+// workers provide a WorkerResources message when calling GetWork().
+const workerResourcesHeader = "build.bazel.buildbarn.worker-resources-bin"
+
+// ResourcePackingPolicy controls how build actions are packed onto
+// workers that advertise their resources.
+type ResourcePackingPolicy struct {
+	// Maximum number of queued build actions that are considered
+	// when the one at the head of the queue does not fit on a
+	// worker. This bounds the amount of work done while holding the
+	// lock of the queue.
+	Lookahead int
+	// Amount of time after which a build action at the head of the
+	// queue that does not fit reserves a worker, causing no other
+	// build actions to be dispatched to it until sufficient
+	// resources have freed up. Zero disables reservations.
+	ReservationAge time.Duration
+}
+
+// NewContextWithWorkerResources attaches the resources available on a
+// worker to an outgoing GetWork() call, so that the scheduler does not
+// dispatch more build actions to the worker than it can accommodate.
+func NewContextWithWorkerResources(ctx context.Context, resources *scheduler.WorkerResources) context.Context {
+	data, err := proto.Marshal(resources)
+	if err != nil {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, workerResourcesHeader, string(data))
+}
+
+// getWorkerResources extracts the WorkerResources message that a
+// worker attached to an incoming GetWork() call. It returns nil if the
+// worker did not advertise its resources.
+func getWorkerResources(ctx context.Context) *scheduler.WorkerResources {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	values := md.Get(workerResourcesHeader)
+	if len(values) == 0 {
+		return nil
+	}
+	var resources scheduler.WorkerResources
+	if err := proto.Unmarshal([]byte(values[0]), &resources); err != nil || resources.Cpus == 0 {
+		return nil
+	}
+	return &resources
+}
+
+// GetCommandResources estimates the resources consumed by a build
+// action, based on the "cpus" and "memory_bytes" platform properties of
+// its command. Build actions are assumed to use a single CPU core by
+// default.
+func GetCommandResources(command *remoteexecution.Command) (*scheduler.WorkerResources, error) {
+	resources := &scheduler.WorkerResources{Cpus: 1}
+	for _, property := range command.Platform.GetProperties() {
+		switch property.Name {
+		case "cpus":
+			cpus, err := strconv.ParseUint(property.Value, 10, 32)
+			if err != nil || cpus == 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid value for platform property \"cpus\": %#v", property.Value)
+			}
+			resources.Cpus = uint32(cpus)
+		case "memory_bytes":
+			memoryBytes, err := strconv.ParseUint(property.Value, 10, 64)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid value for platform property \"memory_bytes\": %#v", property.Value)
+			}
+			resources.MemoryBytes = memoryBytes
+		}
+	}
+	return resources, nil
+}
+
+// allocateResources returns the resources that should be reserved on
+// a worker to start a build action, if the worker has sufficient
+// resources available. Requirements exceeding the total resources of
+// the worker are capped, so that such build actions can still run on an
+// otherwise idle worker.
+func allocateResources(required *scheduler.WorkerResources, inUse *scheduler.WorkerResources, total *scheduler.WorkerResources) (*scheduler.WorkerResources, bool) {
+	allocated := &scheduler.WorkerResources{
+		Cpus:        required.Cpus,
+		MemoryBytes: required.MemoryBytes,
+	}
+	if allocated.Cpus > total.Cpus {
+		allocated.Cpus = total.Cpus
+	}
+	if total.MemoryBytes == 0 {
+		allocated.MemoryBytes = 0
+	} else if allocated.MemoryBytes > total.MemoryBytes {
+		allocated.MemoryBytes = total.MemoryBytes
+	}
+	if inUse.Cpus+allocated.Cpus > total.Cpus || inUse.MemoryBytes+allocated.MemoryBytes > total.MemoryBytes {
+		return nil, false
+	}
+	return allocated, true
+}
+
+// workerBuildJobIndexHeap is a heap of indices into a
+// workerBuildJobHeap, sorted by the priority of the jobs they refer to.
+type workerBuildJobIndexHeap struct {
+	jobs    workerBuildJobHeap
+	indices []int
+}
+
+func (h *workerBuildJobIndexHeap) Len() int {
+	return len(h.indices)
+}
+
+func (h *workerBuildJobIndexHeap) Less(i, j int) bool {
+	return h.jobs.Less(h.indices[i], h.indices[j])
+}
+
+func (h *workerBuildJobIndexHeap) Swap(i, j int) {
+	h.indices[i], h.indices[j] = h.indices[j], h.indices[i]
+}
+
+func (h *workerBuildJobIndexHeap) Push(x interface{}) {
+	h.indices = append(h.indices, x.(int))
+}
+
+func (h *workerBuildJobIndexHeap) Pop() interface{} {
+	n := len(h.indices)
+	x := h.indices[n-1]
+	h.indices = h.indices[:n-1]
+	return x
+}
+
+// visitInOrder calls a function for the indices of the jobs in the
+// heap following the head, in the order in which they would be popped.
+// At most limit jobs are visited. Instead of sorting the entire heap,
+// the children of visited jobs are tracked in a secondary heap, meaning
+// that visiting k jobs takes O(k log k) time. Iteration stops when the
+// function returns false.
+func (h workerBuildJobHeap) visitInOrder(limit int, fn func(i int) bool) {
+	frontier := workerBuildJobIndexHeap{jobs: h}
+	for _, child := range []int{1, 2} {
+		if child < len(h) {
+			heap.Push(&frontier, child)
+		}
+	}
+	for visited := 0; visited < limit && frontier.Len() > 0; visited++ {
+		i := heap.Pop(&frontier).(int)
+		if !fn(i) {
+			return
+		}
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(h) {
+				heap.Push(&frontier, child)
+			}
+		}
+	}
+}
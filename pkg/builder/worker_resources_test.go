@@ -0,0 +1,48 @@
+package builder_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetCommandResources(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		// Build actions without any platform properties are
+		// assumed to use a single core.
+		resources, err := builder.GetCommandResources(&remoteexecution.Command{})
+		require.NoError(t, err)
+		require.Equal(t, &scheduler.WorkerResources{Cpus: 1}, resources)
+	})
+
+	t.Run("Explicit", func(t *testing.T) {
+		resources, err := builder.GetCommandResources(&remoteexecution.Command{
+			Platform: &remoteexecution.Platform{
+				Properties: []*remoteexecution.Platform_Property{
+					{Name: "OSFamily", Value: "Linux"},
+					{Name: "cpus", Value: "16"},
+					{Name: "memory_bytes", Value: "8589934592"},
+				},
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &scheduler.WorkerResources{Cpus: 16, MemoryBytes: 8589934592}, resources)
+	})
+
+	t.Run("InvalidCPUs", func(t *testing.T) {
+		_, err := builder.GetCommandResources(&remoteexecution.Command{
+			Platform: &remoteexecution.Platform{
+				Properties: []*remoteexecution.Platform_Property{
+					{Name: "cpus", Value: "0"},
+				},
+			},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Invalid value for platform property \"cpus\": \"0\""), err)
+	})
+}
@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"io/ioutil"
 	"os"
+	"sync"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
@@ -15,6 +15,20 @@ import (
 	"github.com/golang/protobuf/proto"
 )
 
+// maxPooledDecodeBufferSize is the maximum capacity of buffers that are
+// returned to decodeBufferPool. Larger buffers are discarded, so that
+// the pool doesn't retain memory for rarely occurring large messages.
+const maxPooledDecodeBufferSize = 1 << 20
+
+// decodeBufferPool contains buffers into which serialized messages are
+// read prior to unmarshalling them. Reusing these buffers reduces
+// garbage collection pressure when many messages are fetched.
+var decodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
 type blobAccessContentAddressableStorage struct {
 	blobAccess blobstore.BlobAccess
 }
@@ -34,12 +48,24 @@ func (cas *blobAccessContentAddressableStorage) getMessage(ctx context.Context,
 	if err != nil {
 		return err
 	}
-	data, err := ioutil.ReadAll(r)
+	b := decodeBufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		if b.Cap() <= maxPooledDecodeBufferSize {
+			decodeBufferPool.Put(b)
+		}
+	}()
+	b.Reset()
+	if sizeBytes := digest.GetSizeBytes(); sizeBytes <= maxPooledDecodeBufferSize {
+		b.Grow(int(sizeBytes))
+	}
+	_, err = b.ReadFrom(r)
 	r.Close()
 	if err != nil {
 		return err
 	}
-	return proto.Unmarshal(data, message)
+	// proto.Unmarshal() copies all data out of the buffer, meaning
+	// it can safely be reused afterwards.
+	return proto.Unmarshal(b.Bytes(), message)
 }
 
 func (cas *blobAccessContentAddressableStorage) GetAction(ctx context.Context, digest *util.Digest) (*remoteexecution.Action, error) {
@@ -115,7 +141,7 @@ func (cas *blobAccessContentAddressableStorage) putBlob(ctx context.Context, dat
 	}
 	digest := digestGenerator.Sum()
 
-	if err := cas.blobAccess.Put(ctx, digest, digest.GetSizeBytes(), ioutil.NopCloser(bytes.NewBuffer(data))); err != nil {
+	if err := cas.blobAccess.Put(ctx, digest, digest.GetSizeBytes(), blobstore.NewBytesReader(data)); err != nil {
 		return nil, err
 	}
 	return digest, nil
@@ -72,8 +72,8 @@ func parseResourceNameWrite(resourceName string) (*util.Digest, error) {
 }
 
 type byteStreamServer struct {
-	blobAccess    blobstore.BlobAccess
-	readChunkSize int
+	blobAccess blobstore.BlobAccess
+	chunkPool  *blobstore.ChunkBufferPool
 }
 
 // NewByteStreamServer creates a GRPC service for reading blobs from and
@@ -81,8 +81,8 @@ type byteStreamServer struct {
 // Content Addressable Storage (CAS).
 func NewByteStreamServer(blobAccess blobstore.BlobAccess, readChunkSize int) bytestream.ByteStreamServer {
 	return &byteStreamServer{
-		blobAccess:    blobAccess,
-		readChunkSize: readChunkSize,
+		blobAccess: blobAccess,
+		chunkPool:  blobstore.NewChunkBufferPool(readChunkSize),
 	}
 }
 
@@ -101,21 +101,9 @@ func (s *byteStreamServer) Read(in *bytestream.ReadRequest, out bytestream.ByteS
 	}
 	defer r.Close()
 
-	for {
-		readBuf := make([]byte, s.readChunkSize)
-		n, err := r.Read(readBuf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n > 0 {
-			if err := out.Send(&bytestream.ReadResponse{Data: readBuf[:n]}); err != nil {
-				return err
-			}
-		}
-		if err == io.EOF {
-			return nil
-		}
-	}
+	return s.chunkPool.SendInChunks(r, func(chunk []byte) error {
+		return out.Send(&bytestream.ReadResponse{Data: chunk})
+	})
 }
 
 type byteStreamWriteServerReader struct {
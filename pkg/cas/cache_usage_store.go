@@ -0,0 +1,29 @@
+package cas
+
+// CacheUsage is the number of files stored in a cache directory and
+// their total size.
+type CacheUsage struct {
+	Files     int
+	SizeBytes int64
+}
+
+// CacheUsageStore keeps track of the usage of a cache directory that
+// may be shared by multiple processes. It is used by
+// HardlinkingContentAddressableStorage to enforce limits on the size of
+// the cache directory across all processes, as opposed to enforcing
+// them for every process individually.
+//
+// Files are only added to or removed from the cache directory while
+// exclusive access to its usage is held. This means that the usage may
+// be recomputed by scanning the cache directory if it is unknown.
+type CacheUsageStore interface {
+	// Lock obtains exclusive access to the usage of the cache
+	// directory, blocking until other processes have released it.
+	// It returns false if the usage is unknown (e.g., because it
+	// has never been stored, or because a process terminated
+	// while storing it).
+	Lock() (CacheUsage, bool, error)
+	// Unlock releases exclusive access to the usage of the cache
+	// directory. If provided, the usage is stored first.
+	Unlock(usage *CacheUsage) error
+}
@@ -2,24 +2,46 @@ package cas
 
 import (
 	"context"
+	"io/ioutil"
+	"sync"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// MaximumBatchTotalSizeBytes is the maximum combined size of blobs
+// that may be transferred through BatchReadBlobs() and
+// BatchUpdateBlobs(). It is also the limit on the size of a single
+// GetTree() response. It is chosen to stay below gRPC's default
+// maximum message size of 4 MiB, leaving room for the digests and
+// other metadata stored in the same message.
+const MaximumBatchTotalSizeBytes = 4*1024*1024 - 64*1024
+
+// defaultTreePageSize is the maximum number of directories returned
+// in a single GetTree() response if the client does not specify a
+// page size.
+const defaultTreePageSize = 1000
+
 type contentAddressableStorageServer struct {
 	contentAddressableStorage blobstore.BlobAccess
+	directoryFetcher          ContentAddressableStorage
 }
 
 // NewContentAddressableStorageServer creates a GRPC service for serving
 // the contents of a Bazel Content Addressable Storage (CAS) to Bazel.
+//
+// In addition to FindMissingBlobs(), which is the only call used by
+// Bazel, this service implements the batch and GetTree() calls that
+// are used by clients such as Buck2, Reclient and recc.
 func NewContentAddressableStorageServer(contentAddressableStorage blobstore.BlobAccess) remoteexecution.ContentAddressableStorageServer {
 	return &contentAddressableStorageServer{
 		contentAddressableStorage: contentAddressableStorage,
+		directoryFetcher:          NewBlobAccessContentAddressableStorage(contentAddressableStorage),
 	}
 }
 
@@ -46,13 +68,148 @@ func (s *contentAddressableStorageServer) FindMissingBlobs(ctx context.Context,
 }
 
 func (s *contentAddressableStorageServer) BatchReadBlobs(ctx context.Context, in *remoteexecution.BatchReadBlobsRequest) (*remoteexecution.BatchReadBlobsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "This service does not support batched reading of blobs")
+	// Validate all digests up front, so that the total size of the
+	// response is known before any data is read.
+	digests := make([]*util.Digest, 0, len(in.Digests))
+	totalSizeBytes := int64(0)
+	for _, partialDigest := range in.Digests {
+		digest, err := util.NewDigest(in.InstanceName, partialDigest)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+		totalSizeBytes += digest.GetSizeBytes()
+	}
+	if totalSizeBytes > MaximumBatchTotalSizeBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "Attempted to read a total of %d bytes, while a maximum of %d bytes is permitted", totalSizeBytes, MaximumBatchTotalSizeBytes)
+	}
+
+	// Fetch blobs in parallel, as clients tend to batch up large
+	// numbers of small objects.
+	responses := make([]*remoteexecution.BatchReadBlobsResponse_Response, len(digests))
+	var wg sync.WaitGroup
+	for i, digest := range digests {
+		wg.Add(1)
+		go func(i int, digest *util.Digest) {
+			defer wg.Done()
+			response := &remoteexecution.BatchReadBlobsResponse_Response{
+				Digest: digest.GetPartialDigest(),
+			}
+			data, err := s.readBlob(ctx, digest)
+			if err == nil {
+				response.Data = data
+			}
+			response.Status = status.Convert(err).Proto()
+			responses[i] = response
+		}(i, digest)
+	}
+	wg.Wait()
+	return &remoteexecution.BatchReadBlobsResponse{
+		Responses: responses,
+	}, nil
+}
+
+func (s *contentAddressableStorageServer) readBlob(ctx context.Context, digest *util.Digest) ([]byte, error) {
+	_, r, err := s.contentAddressableStorage.Get(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	return data, err
 }
 
 func (s *contentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context, in *remoteexecution.BatchUpdateBlobsRequest) (*remoteexecution.BatchUpdateBlobsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "This service does not support batched uploading of blobs")
+	totalSizeBytes := int64(0)
+	for _, request := range in.Requests {
+		totalSizeBytes += int64(len(request.Data))
+	}
+	if totalSizeBytes > MaximumBatchTotalSizeBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "Attempted to write a total of %d bytes, while a maximum of %d bytes is permitted", totalSizeBytes, MaximumBatchTotalSizeBytes)
+	}
+
+	responses := make([]*remoteexecution.BatchUpdateBlobsResponse_Response, len(in.Requests))
+	var wg sync.WaitGroup
+	for i, request := range in.Requests {
+		wg.Add(1)
+		go func(i int, request *remoteexecution.BatchUpdateBlobsRequest_Request) {
+			defer wg.Done()
+			responses[i] = &remoteexecution.BatchUpdateBlobsResponse_Response{
+				Digest: request.Digest,
+				Status: status.Convert(s.writeBlob(ctx, in.InstanceName, request)).Proto(),
+			}
+		}(i, request)
+	}
+	wg.Wait()
+	return &remoteexecution.BatchUpdateBlobsResponse{
+		Responses: responses,
+	}, nil
 }
 
+func (s *contentAddressableStorageServer) writeBlob(ctx context.Context, instance string, request *remoteexecution.BatchUpdateBlobsRequest_Request) error {
+	digest, err := util.NewDigest(instance, request.Digest)
+	if err != nil {
+		return err
+	}
+	if sizeBytes := int64(len(request.Data)); sizeBytes != digest.GetSizeBytes() {
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while %d bytes were expected", sizeBytes, digest.GetSizeBytes())
+	}
+	return s.contentAddressableStorage.Put(ctx, digest, digest.GetSizeBytes(), blobstore.NewBytesReader(request.Data))
+}
+
+// GetTree returns all directories underneath a root directory by
+// traversing the tree in breadth-first order. All directories are
+// returned in a single call by sending multiple responses, meaning
+// that this implementation never issues page tokens.
 func (s *contentAddressableStorageServer) GetTree(in *remoteexecution.GetTreeRequest, stream remoteexecution.ContentAddressableStorage_GetTreeServer) error {
-	return status.Error(codes.Unimplemented, "This service does not support downloading directory trees")
+	if in.PageToken != "" {
+		return status.Error(codes.InvalidArgument, "This service does not issue page tokens")
+	}
+	rootDigest, err := util.NewDigest(in.InstanceName, in.RootDigest)
+	if err != nil {
+		return err
+	}
+	pageSize := int(in.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultTreePageSize
+	}
+
+	ctx := stream.Context()
+	digestKeyFormat := util.DigestKeyWithoutInstance
+	queue := []*util.Digest{rootDigest}
+	seen := map[string]bool{rootDigest.GetKey(digestKeyFormat): true}
+	var response remoteexecution.GetTreeResponse
+	responseSizeBytes := 0
+	for len(queue) > 0 {
+		digest := queue[0]
+		queue = queue[1:]
+		directory, err := s.directoryFetcher.GetDirectory(ctx, digest)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to obtain directory %#v", digest.GetHashString())
+		}
+		for _, child := range directory.Directories {
+			childDigest, err := digest.NewDerivedDigest(child.Digest)
+			if err != nil {
+				return util.StatusWrapf(err, "Failed to extract digest for directory %#v", child.Name)
+			}
+			if key := childDigest.GetKey(digestKeyFormat); !seen[key] {
+				seen[key] = true
+				queue = append(queue, childDigest)
+			}
+		}
+
+		// Flush the current response if adding this directory
+		// would cause it to exceed the page or message size.
+		directorySizeBytes := proto.Size(directory)
+		if len(response.Directories) > 0 && (len(response.Directories) >= pageSize || responseSizeBytes+directorySizeBytes > MaximumBatchTotalSizeBytes) {
+			if err := stream.Send(&response); err != nil {
+				return err
+			}
+			response = remoteexecution.GetTreeResponse{}
+			responseSizeBytes = 0
+		}
+		response.Directories = append(response.Directories, directory)
+		responseSizeBytes += directorySizeBytes
+	}
+	return stream.Send(&response)
 }
@@ -0,0 +1,202 @@
+package cas_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newContentAddressableStorageClient creates an RPC server/client
+// pair for a ContentAddressableStorageServer backed by a
+// FakeBlobAccess.
+func newContentAddressableStorageClient(ctx context.Context, t *testing.T, blobAccess blobstore.BlobAccess) (remoteexecution.ContentAddressableStorageClient, func()) {
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	remoteexecution.RegisterContentAddressableStorageServer(server, cas.NewContentAddressableStorageServer(blobAccess))
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	return remoteexecution.NewContentAddressableStorageClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+// putBlob stores a blob in a BlobAccess, returning its SHA-256 digest.
+func putBlob(ctx context.Context, t *testing.T, blobAccess blobstore.BlobAccess, instance string, data []byte) *util.Digest {
+	digestGenerator := util.MustNewDigest(instance, &remoteexecution.Digest{
+		Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		SizeBytes: 0,
+	}).NewDigestGenerator()
+	_, err := digestGenerator.Write(data)
+	require.NoError(t, err)
+	digest := digestGenerator.Sum()
+	require.NoError(t, blobAccess.Put(ctx, digest, digest.GetSizeBytes(), blobstore.NewBytesReader(data)))
+	return digest
+}
+
+func putDirectory(ctx context.Context, t *testing.T, blobAccess blobstore.BlobAccess, instance string, directory *remoteexecution.Directory) *util.Digest {
+	data, err := proto.Marshal(directory)
+	require.NoError(t, err)
+	return putBlob(ctx, t, blobAccess, instance, data)
+}
+
+// TestContentAddressableStorageServerClientPatterns exercises the
+// request patterns of clients other than Bazel. Buck2 uploads small
+// blobs through BatchUpdateBlobs() after calling FindMissingBlobs().
+// Reclient downloads outputs through BatchReadBlobs(), expecting
+// per-blob errors for missing objects. recc uses GetTree() to
+// download entire output directories.
+func TestContentAddressableStorageServerClientPatterns(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Buck2", func(t *testing.T) {
+		blobAccess := blobstore.NewFakeBlobAccess(util.DigestKeyWithInstance)
+		client, cleanup := newContentAddressableStorageClient(ctx, t, blobAccess)
+		defer cleanup()
+
+		helloDigest := &remoteexecution.Digest{
+			Hash:      "185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969",
+			SizeBytes: 5,
+		}
+		worldDigest := &remoteexecution.Digest{
+			Hash:      "78ae647dc5544d227130a0682a51e30bc7777fbb6d8a8f17007463a3ecd1d524",
+			SizeBytes: 5,
+		}
+		missing, err := client.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+			InstanceName: "buck2",
+			BlobDigests:  []*remoteexecution.Digest{helloDigest, worldDigest},
+		})
+		require.NoError(t, err)
+		require.Len(t, missing.MissingBlobDigests, 2)
+
+		updated, err := client.BatchUpdateBlobs(ctx, &remoteexecution.BatchUpdateBlobsRequest{
+			InstanceName: "buck2",
+			Requests: []*remoteexecution.BatchUpdateBlobsRequest_Request{
+				{Digest: helloDigest, Data: []byte("Hello")},
+				{Digest: worldDigest, Data: []byte("Wrld")},
+			},
+		})
+		require.NoError(t, err)
+		require.Len(t, updated.Responses, 2)
+		require.True(t, proto.Equal(helloDigest, updated.Responses[0].Digest))
+		require.Equal(t, int32(codes.OK), updated.Responses[0].Status.Code)
+		require.True(t, proto.Equal(worldDigest, updated.Responses[1].Digest))
+		require.Equal(t, int32(codes.InvalidArgument), updated.Responses[1].Status.Code)
+		require.Equal(t, "Blob is 4 bytes in size, while 5 bytes were expected", updated.Responses[1].Status.Message)
+
+		missing, err = client.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+			InstanceName: "buck2",
+			BlobDigests:  []*remoteexecution.Digest{helloDigest, worldDigest},
+		})
+		require.NoError(t, err)
+		require.Len(t, missing.MissingBlobDigests, 1)
+		require.True(t, proto.Equal(worldDigest, missing.MissingBlobDigests[0]))
+	})
+
+	t.Run("Reclient", func(t *testing.T) {
+		blobAccess := blobstore.NewFakeBlobAccess(util.DigestKeyWithInstance)
+		client, cleanup := newContentAddressableStorageClient(ctx, t, blobAccess)
+		defer cleanup()
+
+		presentDigest := putBlob(ctx, t, blobAccess, "reclient", []byte("Hello")).GetPartialDigest()
+		absentDigest := &remoteexecution.Digest{
+			Hash:      "78ae647dc5544d227130a0682a51e30bc7777fbb6d8a8f17007463a3ecd1d524",
+			SizeBytes: 5,
+		}
+		read, err := client.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			InstanceName: "reclient",
+			Digests:      []*remoteexecution.Digest{presentDigest, absentDigest},
+		})
+		require.NoError(t, err)
+		require.Len(t, read.Responses, 2)
+		require.True(t, proto.Equal(presentDigest, read.Responses[0].Digest))
+		require.Equal(t, []byte("Hello"), read.Responses[0].Data)
+		require.Equal(t, int32(codes.OK), read.Responses[0].Status.Code)
+		require.True(t, proto.Equal(absentDigest, read.Responses[1].Digest))
+		require.Equal(t, int32(codes.NotFound), read.Responses[1].Status.Code)
+
+		// Batches exceeding the advertised maximum size
+		// should be rejected as a whole.
+		_, err = client.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			InstanceName: "reclient",
+			Digests: []*remoteexecution.Digest{{
+				Hash:      "78ae647dc5544d227130a0682a51e30bc7777fbb6d8a8f17007463a3ecd1d524",
+				SizeBytes: cas.MaximumBatchTotalSizeBytes + 1,
+			}},
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("Recc", func(t *testing.T) {
+		blobAccess := blobstore.NewFakeBlobAccess(util.DigestKeyWithInstance)
+		client, cleanup := newContentAddressableStorageClient(ctx, t, blobAccess)
+		defer cleanup()
+
+		// A tree in which the same empty directory is
+		// referenced twice. It should only be returned once.
+		emptyDirectory := &remoteexecution.Directory{}
+		emptyDigest := putDirectory(ctx, t, blobAccess, "recc", emptyDirectory).GetPartialDigest()
+		childDirectory := &remoteexecution.Directory{
+			Directories: []*remoteexecution.DirectoryNode{
+				{Name: "empty", Digest: emptyDigest},
+			},
+		}
+		childDigest := putDirectory(ctx, t, blobAccess, "recc", childDirectory).GetPartialDigest()
+		rootDirectory := &remoteexecution.Directory{
+			Directories: []*remoteexecution.DirectoryNode{
+				{Name: "child", Digest: childDigest},
+				{Name: "empty", Digest: emptyDigest},
+			},
+		}
+		rootDigest := putDirectory(ctx, t, blobAccess, "recc", rootDirectory).GetPartialDigest()
+
+		stream, err := client.GetTree(ctx, &remoteexecution.GetTreeRequest{
+			InstanceName: "recc",
+			RootDigest:   rootDigest,
+			PageSize:     2,
+		})
+		require.NoError(t, err)
+		response, err := stream.Recv()
+		require.NoError(t, err)
+		require.Len(t, response.Directories, 2)
+		require.True(t, proto.Equal(rootDirectory, response.Directories[0]))
+		require.True(t, proto.Equal(childDirectory, response.Directories[1]))
+		require.Empty(t, response.NextPageToken)
+		response, err = stream.Recv()
+		require.NoError(t, err)
+		require.Len(t, response.Directories, 1)
+		require.True(t, proto.Equal(emptyDirectory, response.Directories[0]))
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
+
+		// Page tokens are never issued, so clients
+		// providing them should be rejected.
+		stream, err = client.GetTree(ctx, &remoteexecution.GetTreeRequest{
+			InstanceName: "recc",
+			RootDigest:   rootDigest,
+			PageToken:    "foo",
+		})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
@@ -0,0 +1,101 @@
+package cas
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"golang.org/x/sys/unix"
+)
+
+// directoryCacheUsageStoreFilename is the name of the file in which
+// DirectoryCacheUsageStore stores the usage of the cache directory.
+const directoryCacheUsageStoreFilename = "usage"
+
+type directoryCacheUsageStore struct {
+	directory filesystem.Directory
+}
+
+// NewDirectoryCacheUsageStore creates a CacheUsageStore that stores the
+// usage of a cache directory in a file inside a given directory.
+// Processes synchronize access to the usage by placing an exclusive
+// lock on the directory.
+//
+// The directory should not be the cache directory itself, as
+// HardlinkingContentAddressableStorage holds a shared lock on the cache
+// directory for its entire lifetime.
+func NewDirectoryCacheUsageStore(directory filesystem.Directory) CacheUsageStore {
+	return &directoryCacheUsageStore{
+		directory: directory,
+	}
+}
+
+func (cus *directoryCacheUsageStore) Lock() (CacheUsage, bool, error) {
+	if err := cus.directory.Flock(unix.LOCK_EX); err != nil {
+		return CacheUsage{}, false, util.StatusWrap(err, "Failed to lock usage directory")
+	}
+
+	f, err := cus.directory.OpenFile(directoryCacheUsageStoreFilename, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return CacheUsage{}, false, nil
+	} else if err != nil {
+		cus.directory.Flock(unix.LOCK_UN)
+		return CacheUsage{}, false, util.StatusWrap(err, "Failed to open usage file")
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		cus.directory.Flock(unix.LOCK_UN)
+		return CacheUsage{}, false, util.StatusWrap(err, "Failed to read usage file")
+	}
+
+	// The usage file is rewritten in place. Require that it is
+	// terminated by a newline, so that files that were only
+	// written partially are not accepted.
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || data[len(data)-1] != '\n' {
+		return CacheUsage{}, false, nil
+	}
+	files, err := strconv.Atoi(fields[0])
+	if err != nil || files < 0 {
+		return CacheUsage{}, false, nil
+	}
+	sizeBytes, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || sizeBytes < 0 {
+		return CacheUsage{}, false, nil
+	}
+	return CacheUsage{Files: files, SizeBytes: sizeBytes}, true, nil
+}
+
+func (cus *directoryCacheUsageStore) Unlock(usage *CacheUsage) error {
+	if usage != nil {
+		if err := cus.writeUsage(*usage); err != nil {
+			cus.directory.Flock(unix.LOCK_UN)
+			return err
+		}
+	}
+	if err := cus.directory.Flock(unix.LOCK_UN); err != nil {
+		return util.StatusWrap(err, "Failed to unlock usage directory")
+	}
+	return nil
+}
+
+func (cus *directoryCacheUsageStore) writeUsage(usage CacheUsage) error {
+	f, err := cus.directory.OpenFile(directoryCacheUsageStoreFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to create usage file")
+	}
+	if _, err := fmt.Fprintf(f, "%d %d\n", usage.Files, usage.SizeBytes); err != nil {
+		f.Close()
+		return util.StatusWrap(err, "Failed to write usage file")
+	}
+	if err := f.Close(); err != nil {
+		return util.StatusWrap(err, "Failed to close usage file")
+	}
+	return nil
+}
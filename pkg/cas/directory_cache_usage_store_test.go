@@ -0,0 +1,82 @@
+package cas_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDirectoryCacheUsageStore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	directory := mock.NewMockDirectory(ctrl)
+	usageStore := cas.NewDirectoryCacheUsageStore(directory)
+
+	t.Run("NotFound", func(t *testing.T) {
+		// The usage is unknown if it has never been stored.
+		directory.EXPECT().Flock(unix.LOCK_EX).Return(nil)
+		directory.EXPECT().OpenFile("usage", os.O_RDONLY, os.FileMode(0)).Return(nil, syscall.ENOENT)
+		_, ok, err := usageStore.Lock()
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// Unlocking without providing the usage should not
+		// store anything.
+		directory.EXPECT().Flock(unix.LOCK_UN).Return(nil)
+		require.NoError(t, usageStore.Unlock(nil))
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		directory.EXPECT().Flock(unix.LOCK_EX).Return(nil)
+		usageFile := mock.NewMockFile(ctrl)
+		directory.EXPECT().OpenFile("usage", os.O_RDONLY, os.FileMode(0)).Return(usageFile, nil)
+		usageFileReader := strings.NewReader("12 3456\n")
+		usageFile.EXPECT().Read(gomock.Any()).DoAndReturn(usageFileReader.Read).AnyTimes()
+		usageFile.EXPECT().Close()
+		usage, ok, err := usageStore.Lock()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, cas.CacheUsage{Files: 12, SizeBytes: 3456}, usage)
+
+		// The usage should be stored prior to releasing the
+		// lock.
+		newUsageFile := mock.NewMockFile(ctrl)
+		directory.EXPECT().OpenFile("usage", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0666)).Return(newUsageFile, nil)
+		var newUsageFileContents bytes.Buffer
+		newUsageFile.EXPECT().Write(gomock.Any()).DoAndReturn(newUsageFileContents.Write).AnyTimes()
+		newUsageFile.EXPECT().Close()
+		directory.EXPECT().Flock(unix.LOCK_UN).Return(nil)
+		require.NoError(t, usageStore.Unlock(&cas.CacheUsage{Files: 13, SizeBytes: 3500}))
+		require.Equal(t, "13 3500\n", newUsageFileContents.String())
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		// A process may have terminated while writing the usage
+		// file. Its contents should not be trusted.
+		directory.EXPECT().Flock(unix.LOCK_EX).Return(nil)
+		usageFile := mock.NewMockFile(ctrl)
+		directory.EXPECT().OpenFile("usage", os.O_RDONLY, os.FileMode(0)).Return(usageFile, nil)
+		usageFileReader := strings.NewReader("12 34")
+		usageFile.EXPECT().Read(gomock.Any()).DoAndReturn(usageFileReader.Read).AnyTimes()
+		usageFile.EXPECT().Close()
+		_, ok, err := usageStore.Lock()
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("LockFailure", func(t *testing.T) {
+		directory.EXPECT().Flock(unix.LOCK_EX).Return(syscall.EBADF)
+		_, _, err := usageStore.Lock()
+		require.Error(t, err)
+	})
+}
@@ -2,78 +2,270 @@ package cas
 
 import (
 	"context"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"sync"
 
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
 )
 
+// directoryCacheIndexName is the name of the file in the cache
+// directory that stores cached messages across restarts.
+const directoryCacheIndexName = ".messages"
+
+// Prefixes of the keys of cached messages, so that messages of
+// different types that happen to have the same digest don't collide.
+const (
+	cachedCommandKeyPrefix   = "command:"
+	cachedDirectoryKeyPrefix = "directory:"
+	cachedTreeKeyPrefix      = "tree:"
+)
+
+type cachedMessage struct {
+	message   proto.Message
+	sizeBytes int64
+}
+
 type directoryCachingContentAddressableStorage struct {
 	ContentAddressableStorage
 
 	lock sync.RWMutex
 
 	digestKeyFormat util.DigestKeyFormat
-	maxDirectories  int
+	maxMessages     int
+	maxSizeBytes    int64
+	cacheDirectory  filesystem.Directory
 
-	directoriesPresentList    []string
-	directoriesPresentMessage map[string]*remoteexecution.Directory
+	messagesPresentList      []string
+	messagesPresentMessage   map[string]cachedMessage
+	messagesPresentSizeBytes int64
+	// Messages loaded from disk that have not been requested yet.
+	// Their contents are validated upon first use.
+	messagesSaved map[string][]byte
 }
 
 // NewDirectoryCachingContentAddressableStorage is an adapter for
-// ContentAddressableStorage that caches up a fixed number of
-// unmarshalled directory objects in memory. This reduces the amount of
-// network traffic needed.
-func NewDirectoryCachingContentAddressableStorage(base ContentAddressableStorage, digestKeyFormat util.DigestKeyFormat, maxDirectories int) ContentAddressableStorage {
-	return &directoryCachingContentAddressableStorage{
+// ContentAddressableStorage that caches up a bounded number of
+// unmarshalled Command, Directory and Tree objects in memory. This
+// reduces the amount of network traffic needed, and prevents spending
+// CPU time on parsing the same objects (e.g., ones belonging to
+// toolchains) over and over again. All objects share the same budget,
+// expressed both in the number of objects and their total size.
+//
+// The function that is returned alongside the ContentAddressableStorage
+// may be called upon shutdown to write the cached objects to a file in
+// the cache directory. They are loaded by the next instance, but only
+// used after checking that they match their digest.
+func NewDirectoryCachingContentAddressableStorage(base ContentAddressableStorage, digestKeyFormat util.DigestKeyFormat, maxMessages int, maxSizeBytes int64, cacheDirectory filesystem.Directory) (ContentAddressableStorage, func() error, error) {
+	cas := &directoryCachingContentAddressableStorage{
 		ContentAddressableStorage: base,
 
 		digestKeyFormat: digestKeyFormat,
-		maxDirectories:  maxDirectories,
+		maxMessages:     maxMessages,
+		maxSizeBytes:    maxSizeBytes,
+		cacheDirectory:  cacheDirectory,
 
-		directoriesPresentMessage: map[string]*remoteexecution.Directory{},
+		messagesPresentMessage: map[string]cachedMessage{},
+		messagesSaved:          map[string][]byte{},
+	}
+	if err := cas.loadSavedMessages(); err != nil {
+		return nil, nil, err
 	}
+	return cas, cas.saveMessages, nil
 }
 
-func (cas *directoryCachingContentAddressableStorage) makeSpace() {
-	for len(cas.directoriesPresentList) >= cas.maxDirectories {
-		// Pick random directory to remove.
-		idx := rand.Intn(len(cas.directoriesPresentList))
-		key := cas.directoriesPresentList[idx]
+// loadSavedMessages reads the messages written by saveMessages(). A
+// missing or corrupted file is not an error, as it merely causes the
+// cache to start off empty.
+func (cas *directoryCachingContentAddressableStorage) loadSavedMessages() error {
+	f, err := cas.cacheDirectory.OpenFile(directoryCacheIndexName, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return util.StatusWrap(err, "Failed to open saved messages")
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return util.StatusWrap(err, "Failed to read saved messages")
+	}
 
-		// Remove directory from bookkeeping.
-		delete(cas.directoriesPresentMessage, key)
-		last := len(cas.directoriesPresentList) - 1
-		cas.directoriesPresentList[idx] = cas.directoriesPresentList[last]
-		cas.directoriesPresentList = cas.directoriesPresentList[:last]
+	b := proto.NewBuffer(data)
+	savedSizeBytes := int64(0)
+	for len(cas.messagesSaved) < cas.maxMessages {
+		key, err := b.DecodeStringBytes()
+		if err != nil {
+			break
+		}
+		message, err := b.DecodeRawBytes(true)
+		if err != nil {
+			break
+		}
+		savedSizeBytes += int64(len(message))
+		if savedSizeBytes > cas.maxSizeBytes {
+			break
+		}
+		cas.messagesSaved[key] = message
 	}
+	return nil
 }
 
-func (cas *directoryCachingContentAddressableStorage) GetDirectory(ctx context.Context, digest *util.Digest) (*remoteexecution.Directory, error) {
-	key := digest.GetKey(cas.digestKeyFormat)
+// saveMessages writes all cached messages to the cache directory, so
+// that they may be reloaded by the next instance.
+func (cas *directoryCachingContentAddressableStorage) saveMessages() error {
+	cas.lock.RLock()
+	defer cas.lock.RUnlock()
+
+	var b proto.Buffer
+	for key, entry := range cas.messagesPresentMessage {
+		data, err := proto.Marshal(entry.message)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to marshal message %#v", key)
+		}
+		b.EncodeStringBytes(key)
+		b.EncodeRawBytes(data)
+	}
+	for key, data := range cas.messagesSaved {
+		b.EncodeStringBytes(key)
+		b.EncodeRawBytes(data)
+	}
+
+	f, err := cas.cacheDirectory.OpenFile(directoryCacheIndexName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to create saved messages")
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return util.StatusWrap(err, "Failed to write saved messages")
+	}
+	if err := f.Close(); err != nil {
+		return util.StatusWrap(err, "Failed to close saved messages")
+	}
+	return nil
+}
+
+// makeSpace removes randomly chosen messages from the cache until a
+// message of a given size can be inserted.
+func (cas *directoryCachingContentAddressableStorage) makeSpace(sizeBytes int64) {
+	for len(cas.messagesPresentList) > 0 && (len(cas.messagesPresentList) >= cas.maxMessages || cas.messagesPresentSizeBytes+sizeBytes > cas.maxSizeBytes) {
+		// Pick random message to remove.
+		idx := rand.Intn(len(cas.messagesPresentList))
+		key := cas.messagesPresentList[idx]
+
+		// Remove message from bookkeeping.
+		cas.messagesPresentSizeBytes -= cas.messagesPresentMessage[key].sizeBytes
+		delete(cas.messagesPresentMessage, key)
+		last := len(cas.messagesPresentList) - 1
+		cas.messagesPresentList[idx] = cas.messagesPresentList[last]
+		cas.messagesPresentList = cas.messagesPresentList[:last]
+	}
+}
+
+func (cas *directoryCachingContentAddressableStorage) insertMessage(key string, message proto.Message, sizeBytes int64) {
+	if sizeBytes > cas.maxSizeBytes || cas.maxMessages <= 0 {
+		return
+	}
+	if _, ok := cas.messagesPresentMessage[key]; !ok {
+		cas.makeSpace(sizeBytes)
+		cas.messagesPresentList = append(cas.messagesPresentList, key)
+		cas.messagesPresentMessage[key] = cachedMessage{
+			message:   message,
+			sizeBytes: sizeBytes,
+		}
+		cas.messagesPresentSizeBytes += sizeBytes
+	}
+}
+
+// getSavedMessage unmarshals a message that was loaded from disk, if
+// it matches the digest.
+func (cas *directoryCachingContentAddressableStorage) getSavedMessage(digest *util.Digest, key string, message proto.Message) bool {
+	cas.lock.Lock()
+	defer cas.lock.Unlock()
+	data, ok := cas.messagesSaved[key]
+	if !ok {
+		return false
+	}
+	delete(cas.messagesSaved, key)
+
+	digestGenerator := digest.NewDigestGenerator()
+	if _, err := digestGenerator.Write(data); err != nil {
+		return false
+	}
+	if actualDigest := digestGenerator.Sum(); actualDigest.GetHashString() != digest.GetHashString() || actualDigest.GetSizeBytes() != digest.GetSizeBytes() {
+		return false
+	}
+	if err := proto.Unmarshal(data, message); err != nil {
+		return false
+	}
+	cas.insertMessage(key, message, digest.GetSizeBytes())
+	return true
+}
+
+// getMessage returns a message from the cache, falling back to
+// messages loaded from disk and the backend. The newMessage and
+// fetchMessage callbacks are used to create empty messages into which
+// saved messages are unmarshalled, and to download messages from the
+// backend, respectively.
+func (cas *directoryCachingContentAddressableStorage) getMessage(digest *util.Digest, keyPrefix string, newMessage func() proto.Message, fetchMessage func() (proto.Message, error)) (proto.Message, error) {
+	key := keyPrefix + digest.GetKey(cas.digestKeyFormat)
 
 	// Check the cache.
 	cas.lock.RLock()
-	directory, ok := cas.directoriesPresentMessage[key]
+	entry, ok := cas.messagesPresentMessage[key]
 	cas.lock.RUnlock()
 	if ok {
-		return directory, nil
+		return entry.message, nil
+	}
+	if message := newMessage(); cas.getSavedMessage(digest, key, message) {
+		return message, nil
 	}
 
-	// Not found. Download directory.
-	directory, err := cas.ContentAddressableStorage.GetDirectory(ctx, digest)
+	// Not found. Download message.
+	message, err := fetchMessage()
 	if err != nil {
 		return nil, err
 	}
 
 	// Insert it into the cache.
 	cas.lock.Lock()
-	if _, ok := cas.directoriesPresentMessage[key]; !ok {
-		cas.makeSpace()
-		cas.directoriesPresentList = append(cas.directoriesPresentList, key)
-		cas.directoriesPresentMessage[key] = directory
-	}
+	cas.insertMessage(key, message, digest.GetSizeBytes())
 	cas.lock.Unlock()
-	return directory, nil
+	return message, nil
+}
+
+func (cas *directoryCachingContentAddressableStorage) GetCommand(ctx context.Context, digest *util.Digest) (*remoteexecution.Command, error) {
+	command, err := cas.getMessage(
+		digest, cachedCommandKeyPrefix,
+		func() proto.Message { return &remoteexecution.Command{} },
+		func() (proto.Message, error) { return cas.ContentAddressableStorage.GetCommand(ctx, digest) })
+	if err != nil {
+		return nil, err
+	}
+	return command.(*remoteexecution.Command), nil
+}
+
+func (cas *directoryCachingContentAddressableStorage) GetDirectory(ctx context.Context, digest *util.Digest) (*remoteexecution.Directory, error) {
+	directory, err := cas.getMessage(
+		digest, cachedDirectoryKeyPrefix,
+		func() proto.Message { return &remoteexecution.Directory{} },
+		func() (proto.Message, error) { return cas.ContentAddressableStorage.GetDirectory(ctx, digest) })
+	if err != nil {
+		return nil, err
+	}
+	return directory.(*remoteexecution.Directory), nil
+}
+
+func (cas *directoryCachingContentAddressableStorage) GetTree(ctx context.Context, digest *util.Digest) (*remoteexecution.Tree, error) {
+	tree, err := cas.getMessage(
+		digest, cachedTreeKeyPrefix,
+		func() proto.Message { return &remoteexecution.Tree{} },
+		func() (proto.Message, error) { return cas.ContentAddressableStorage.GetTree(ctx, digest) })
+	if err != nil {
+		return nil, err
+	}
+	return tree.(*remoteexecution.Tree), nil
 }
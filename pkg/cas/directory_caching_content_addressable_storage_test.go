@@ -0,0 +1,70 @@
+package cas_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryCachingContentAddressableStorageSizeLimit(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().OpenFile(".messages", os.O_RDONLY, os.FileMode(0)).Return(nil, syscall.ENOENT)
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	directoryCachingCAS, _, err := cas.NewDirectoryCachingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, 10, 100, cacheDirectory)
+	require.NoError(t, err)
+
+	// Commands should only be fetched from the backend once.
+	commandDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 60,
+	})
+	command := &remoteexecution.Command{Arguments: []string{"cc"}}
+	baseCAS.EXPECT().GetCommand(ctx, commandDigest).Return(command, nil)
+	for i := 0; i < 2; i++ {
+		cachedCommand, err := directoryCachingCAS.GetCommand(ctx, commandDigest)
+		require.NoError(t, err)
+		require.Equal(t, command, cachedCommand)
+	}
+
+	// Directories and commands share the same budget. Inserting a
+	// directory that doesn't fit alongside the command should cause
+	// the command to be evicted.
+	directoryDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 50,
+	})
+	directory := &remoteexecution.Directory{}
+	baseCAS.EXPECT().GetDirectory(ctx, directoryDigest).Return(directory, nil)
+	cachedDirectory, err := directoryCachingCAS.GetDirectory(ctx, directoryDigest)
+	require.NoError(t, err)
+	require.Equal(t, directory, cachedDirectory)
+
+	baseCAS.EXPECT().GetCommand(ctx, commandDigest).Return(command, nil)
+	cachedCommand, err := directoryCachingCAS.GetCommand(ctx, commandDigest)
+	require.NoError(t, err)
+	require.Equal(t, command, cachedCommand)
+
+	// Trees that exceed the budget entirely should not be cached.
+	treeDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "4a8a08f09d37b73795649038408b5f33",
+		SizeBytes: 1000,
+	})
+	tree := &remoteexecution.Tree{}
+	baseCAS.EXPECT().GetTree(ctx, treeDigest).Return(tree, nil).Times(2)
+	for i := 0; i < 2; i++ {
+		cachedTree, err := directoryCachingCAS.GetTree(ctx, treeDigest)
+		require.NoError(t, err)
+		require.Equal(t, tree, cachedTree)
+	}
+}
@@ -1,13 +1,24 @@
 package cas
 
 import (
+	"bufio"
+	"container/list"
 	"context"
-	"math/rand"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"golang.org/x/sys/unix"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -21,25 +32,99 @@ var (
 		[]string{"result"})
 	hardlinkingContentAddressableStorageOperationsTotalHit  = hardlinkingContentAddressableStorageOperationsTotal.WithLabelValues("Hit")
 	hardlinkingContentAddressableStorageOperationsTotalMiss = hardlinkingContentAddressableStorageOperationsTotal.WithLabelValues("Miss")
+
+	hardlinkingContentAddressableStorageEvictionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "cas",
+			Name:      "hardlinking_content_addressable_storage_evictions_total",
+			Help:      "Total number of files evicted from the hardlinking content addressable storage.",
+		})
+
+	hardlinkingContentAddressableStorageLinkFallbacksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "cas",
+			Name:      "hardlinking_content_addressable_storage_link_fallbacks_total",
+			Help:      "Total number of times a file was cloned or copied into or out of the cache instead of being hardlinked, either because hardlinking failed or because cloning is preferred.",
+		},
+		[]string{"reason", "method"})
+)
+
+const (
+	// hardlinkingIndexName is the name of the file in the cache
+	// directory that stores the index of the cache across
+	// restarts. Filenames starting with a dot are never used for
+	// cached files.
+	hardlinkingIndexName   = ".index"
+	hardlinkingIndexHeader = "buildbarn-hardlinking-cache-index-v1"
+	hardlinkingIndexFooter = "end"
+
+	// hardlinkingTemporaryPrefix is the prefix of the names of
+	// files that are cloned into the cache directory, prior to
+	// being linked into place.
+	hardlinkingTemporaryPrefix = ".tmp-"
+
+	// hardlinkingDigestXattrName is the name of the extended
+	// attribute in which the digest of a cached file is stored.
+	hardlinkingDigestXattrName = "user.buildbarn.digest"
 )
 
 func init() {
 	prometheus.MustRegister(hardlinkingContentAddressableStorageOperationsTotal)
+	prometheus.MustRegister(hardlinkingContentAddressableStorageEvictionsTotal)
+	prometheus.MustRegister(hardlinkingContentAddressableStorageLinkFallbacksTotal)
+}
+
+// cachedFile contains the bookkeeping of a single file stored in the
+// cache directory.
+type cachedFile struct {
+	key       string
+	sizeBytes int64
+
+	// Number of GetFile() calls currently hardlinking this file out
+	// of the cache. Files that are in use may not be evicted.
+	useCount int
+	// Position of this file in the LRU list. Only set when the file
+	// is not in use, as only those files are eligible for eviction.
+	element *list.Element
 }
 
 type hardlinkingContentAddressableStorage struct {
 	ContentAddressableStorage
 
-	lock sync.RWMutex
+	lock sync.Mutex
 
 	digestKeyFormat util.DigestKeyFormat
 	cacheDirectory  filesystem.Directory
+	usageStore      CacheUsageStore
 	maxFiles        int
 	maxSize         int64
+	cloneFiles      bool
 
-	filesPresentList      []string
-	filesPresentSize      map[string]int64
-	filesPresentTotalSize int64
+	filesPresent map[string]*cachedFile
+	// Files that are not in use, ordered from most recently used
+	// (front) to least recently used (back).
+	filesUnused *list.List
+	// Number of temporary files created, used to give them unique
+	// names.
+	temporaryFilesCreated uint64
+}
+
+// HardlinkingCache provides maintenance operations on the cache
+// directory of a ContentAddressableStorage created through
+// NewHardlinkingContentAddressableStorage().
+type HardlinkingCache interface {
+	// SaveIndex writes the index of the cache to disk. It may be
+	// called upon shutdown, so that the cache remains warm across
+	// restarts. It may also be called periodically, as the cache
+	// directory remains locked in shared mode afterwards.
+	SaveIndex() error
+	// Evict removes the least recently used files that are not in
+	// use from the cache, until at least a given number of bytes
+	// has been freed. It returns the number of bytes freed, which
+	// may be lower if too few files are eligible for eviction.
+	Evict(sizeBytes int64) (int64, error)
 }
 
 // NewHardlinkingContentAddressableStorage is an adapter for
@@ -48,38 +133,536 @@ type hardlinkingContentAddressableStorage struct {
 // into the cache. Future calls for the same file will hardlink them from the
 // cache to the target location. This reduces the amount of network traffic
 // needed.
-func NewHardlinkingContentAddressableStorage(base ContentAddressableStorage, digestKeyFormat util.DigestKeyFormat, cacheDirectory filesystem.Directory, maxFiles int, maxSize int64) ContentAddressableStorage {
-	return &hardlinkingContentAddressableStorage{
+//
+// Files are reference counted while they are being hardlinked out of
+// the cache. When the cache is full, the least recently used file that
+// is not in use is evicted. As the name of every file in the cache
+// directory corresponds to its digest, the index of the cache is
+// reconstructed from the contents of the cache directory upon
+// construction. This allows caches to remain warm across restarts.
+//
+// The HardlinkingCache that is returned alongside the
+// ContentAddressableStorage may be used to write the index of the cache
+// to disk upon shutdown. This preserves the order in which files were used and permits the
+// next instance to skip scanning the cache directory. Entries in the
+// saved index are not validated upon startup. Files that have gone
+// missing are removed from the index when requested.
+//
+// The cache directory may be shared by multiple processes on the same
+// system. Files placed in the cache directory by other processes are
+// adopted into the index of this process when requested. The maximum
+// number of files and their total size apply to all processes
+// combined, as the usage of the cache directory is tracked through a
+// CacheUsageStore that is shared between them. Every process only
+// evicts files from its own index, meaning that files may only be
+// added if enough files are known to this process.
+//
+// The digest of every file added to the cache directory is stored as an
+// extended attribute, if supported by the file system. This allows
+// files that have been renamed or overwritten by other tools to be
+// discarded when scanning the cache directory, without needing to
+// checksum their contents. It also permits auditing deduplication of
+// files in the cache directory and in build directories.
+//
+// The HardlinkingCache may also be used to free up disk space on
+// demand, as the cache directory tends to be placed on the same file
+// system as the build directory.
+//
+// When cloneFiles is set, files are cloned (reflinked) into and out of
+// the cache instead of being hardlinked. This permits build actions to
+// modify their input files without corrupting the cache. Files are
+// copied out of the cache if cloning is not supported by the file
+// system, and are not cached at all in that case.
+func NewHardlinkingContentAddressableStorage(base ContentAddressableStorage, digestKeyFormat util.DigestKeyFormat, cacheDirectory filesystem.Directory, usageStore CacheUsageStore, maxFiles int, maxSize int64, cloneFiles bool) (ContentAddressableStorage, HardlinkingCache, error) {
+	cas := &hardlinkingContentAddressableStorage{
 		ContentAddressableStorage: base,
 
 		digestKeyFormat: digestKeyFormat,
 		cacheDirectory:  cacheDirectory,
+		usageStore:      usageStore,
 		maxFiles:        maxFiles,
 		maxSize:         maxSize,
+		cloneFiles:      cloneFiles,
+
+		filesPresent: map[string]*cachedFile{},
+		filesUnused:  list.New(),
+	}
+	if err := cas.loadIndex(); err != nil {
+		return nil, nil, err
+	}
+	return cas, cas, nil
+}
 
-		filesPresentSize: map[string]int64{},
+// parseCacheKeySize extracts the size of a file in the cache from its
+// filename. Filenames have the form "hash-size[-instance]+x" or
+// "hash-size[-instance]-x".
+func parseCacheKeySize(key string) (int64, bool) {
+	if !strings.HasSuffix(key, "+x") && !strings.HasSuffix(key, "-x") {
+		return 0, false
 	}
+	fields := strings.SplitN(key[:len(key)-2], "-", 3)
+	if len(fields) < 2 || fields[0] == "" {
+		return 0, false
+	}
+	sizeBytes, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || sizeBytes < 0 {
+		return 0, false
+	}
+	return sizeBytes, true
 }
 
-func (cas *hardlinkingContentAddressableStorage) makeSpace(size int64) error {
-	for len(cas.filesPresentList) > 0 && (len(cas.filesPresentList) >= cas.maxFiles || cas.filesPresentTotalSize+size > cas.maxSize) {
-		// Remove random file from disk.
-		idx := rand.Intn(len(cas.filesPresentList))
-		key := cas.filesPresentList[idx]
-		if err := cas.cacheDirectory.Remove(key); err != nil {
+// loadIndex reconstructs the index of the cache from files left behind
+// in the cache directory by a previous instance. Files that could not
+// have been created by this cache are removed.
+//
+// Multiple processes may share the same cache directory. Every process
+// holds a shared lock on the cache directory for its entire lifetime.
+// Invalid files are only removed by a process that is capable of
+// obtaining an exclusive lock, as it is the only user of the cache
+// directory at that point in time.
+func (cas *hardlinkingContentAddressableStorage) loadIndex() error {
+	exclusive := true
+	if err := cas.cacheDirectory.Flock(unix.LOCK_EX | unix.LOCK_NB); err == unix.EWOULDBLOCK {
+		// Another process is using the cache directory. Wait
+		// for it to finish loading its index, as it may still
+		// be removing invalid files.
+		exclusive = false
+		if err := cas.cacheDirectory.Flock(unix.LOCK_SH); err != nil {
+			return util.StatusWrap(err, "Failed to lock cache directory")
+		}
+	} else if err != nil {
+		return util.StatusWrap(err, "Failed to lock cache directory")
+	}
+
+	// The usage stored by a previous instance may be inaccurate if
+	// it terminated uncleanly. Recompute it if no other processes
+	// are using the cache directory.
+	var usage CacheUsage
+	if exclusive {
+		if _, _, err := cas.usageStore.Lock(); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if usage, err = cas.lockUsage(); err != nil {
 			return err
 		}
+	}
+	if err := cas.loadIndexWithUsage(exclusive, &usage); err != nil {
+		cas.usageStore.Unlock(nil)
+		return err
+	}
+	if err := cas.usageStore.Unlock(&usage); err != nil {
+		return err
+	}
+	if exclusive {
+		if err := cas.cacheDirectory.Flock(unix.LOCK_SH); err != nil {
+			return util.StatusWrap(err, "Failed to lock cache directory")
+		}
+	}
+	return nil
+}
+
+func (cas *hardlinkingContentAddressableStorage) loadIndexWithUsage(exclusive bool, usage *CacheUsage) error {
+	// Only trust the index saved by a previous instance if no other
+	// processes have modified the cache directory since.
+	if exclusive {
+		if err := cas.readSavedIndex(); err == nil {
+			if *usage, err = cas.scanUsage(); err != nil {
+				return err
+			}
+			return cas.finishLoadingIndex(usage)
+		} else if !os.IsNotExist(err) {
+			logrus.WithError(err).Warn("Failed to read saved index of cache directory, scanning cache directory instead")
+			cas.filesPresent = map[string]*cachedFile{}
+			cas.filesUnused.Init()
+		}
+		if err := cas.cacheDirectory.Remove(hardlinkingIndexName); err != nil && !os.IsNotExist(err) {
+			return util.StatusWrap(err, "Failed to remove saved index of cache directory")
+		}
+	}
+
+	files, err := cas.cacheDirectory.ReadDir()
+	if err != nil {
+		return util.StatusWrap(err, "Failed to read cache directory")
+	}
+	var scannedUsage CacheUsage
+	for _, file := range files {
+		key := file.Name()
+		if strings.HasPrefix(key, ".") {
+			// Remove temporary files left behind by
+			// processes that terminated while adding files.
+			if exclusive && strings.HasPrefix(key, hardlinkingTemporaryPrefix) {
+				if err := cas.cacheDirectory.Remove(key); err != nil && !os.IsNotExist(err) {
+					return util.StatusWrapf(err, "Failed to remove temporary file %#v", key)
+				}
+			}
+			continue
+		}
+		sizeBytes, ok := parseCacheKeySize(key)
+		if !ok || !file.Mode().IsRegular() || !cas.hasValidDigestXattr(key) {
+			if !exclusive {
+				continue
+			}
+			if err := cas.cacheDirectory.RemoveAll(key); err != nil {
+				return util.StatusWrapf(err, "Failed to remove invalid cache entry %#v", key)
+			}
+			continue
+		}
+		cas.insertFile(key, sizeBytes)
+		scannedUsage.Files++
+		scannedUsage.SizeBytes += sizeBytes
+	}
+	if exclusive {
+		*usage = scannedUsage
+	}
+	return cas.finishLoadingIndex(usage)
+}
+
+func (cas *hardlinkingContentAddressableStorage) finishLoadingIndex(usage *CacheUsage) error {
+	// Limits may have been lowered since the previous run.
+	_, err := cas.makeSpace(usage, 0, 0)
+	return err
+}
+
+// scanUsage computes the usage of the cache directory by scanning its
+// contents. It must only be called while holding exclusive access to
+// the usage of the cache directory, as other processes would otherwise
+// be able to add or remove files concurrently.
+func (cas *hardlinkingContentAddressableStorage) scanUsage() (CacheUsage, error) {
+	files, err := cas.cacheDirectory.ReadDir()
+	if err != nil {
+		return CacheUsage{}, util.StatusWrap(err, "Failed to read cache directory")
+	}
+	var usage CacheUsage
+	for _, file := range files {
+		if sizeBytes, ok := parseCacheKeySize(file.Name()); ok && file.Mode().IsRegular() {
+			usage.Files++
+			usage.SizeBytes += sizeBytes
+		}
+	}
+	return usage, nil
+}
+
+// lockUsage obtains exclusive access to the usage of the cache
+// directory. The usage is recomputed if it is unknown.
+func (cas *hardlinkingContentAddressableStorage) lockUsage() (CacheUsage, error) {
+	usage, ok, err := cas.usageStore.Lock()
+	if err != nil || ok {
+		return usage, err
+	}
+	usage, err = cas.scanUsage()
+	if err != nil {
+		cas.usageStore.Unlock(nil)
+		return CacheUsage{}, err
+	}
+	return usage, nil
+}
+
+// readSavedIndex reconstructs the index of the cache from the file
+// written by saveIndex(). The file is removed afterwards, so that the
+// index is not reused if this process terminates uncleanly.
+func (cas *hardlinkingContentAddressableStorage) readSavedIndex() error {
+	f, err := cas.cacheDirectory.OpenFile(hardlinkingIndexName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != hardlinkingIndexHeader {
+		return status.Error(codes.InvalidArgument, "Saved index has an invalid header")
+	}
+	for scanner.Scan() {
+		key := scanner.Text()
+		if key == hardlinkingIndexFooter {
+			return cas.cacheDirectory.Remove(hardlinkingIndexName)
+		}
+		sizeBytes, ok := parseCacheKeySize(key)
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "Saved index contains invalid entry %#v", key)
+		}
+		if _, ok := cas.filesPresent[key]; !ok {
+			cas.insertFile(key, sizeBytes)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return status.Error(codes.InvalidArgument, "Saved index is truncated")
+}
+
+// SaveIndex writes the index of the cache to the cache directory, so
+// that it may be reloaded by the next instance. Files are stored from
+// least recently used to most recently used. The index is not written
+// if other processes are still using the cache directory, as they may
+// continue to alter its contents. The shared lock on the cache
+// directory is restored afterwards, so that other processes remain
+// capable of detecting that the cache directory is in use.
+func (cas *hardlinkingContentAddressableStorage) SaveIndex() error {
+	cas.lock.Lock()
+	defer cas.lock.Unlock()
+
+	err := cas.cacheDirectory.Flock(unix.LOCK_EX | unix.LOCK_NB)
+	if err == nil {
+		err = cas.writeIndex()
+	} else if err == unix.EWOULDBLOCK {
+		// Converting the lock may have released the shared
+		// lock, even though the exclusive lock was not
+		// obtained.
+		err = nil
+	} else {
+		err = util.StatusWrap(err, "Failed to lock cache directory")
+	}
+	if lockErr := cas.cacheDirectory.Flock(unix.LOCK_SH); lockErr != nil && err == nil {
+		err = util.StatusWrap(lockErr, "Failed to lock cache directory")
+	}
+	return err
+}
 
-		// Remove file from bookkeeping.
-		cas.filesPresentTotalSize -= cas.filesPresentSize[key]
-		delete(cas.filesPresentSize, key)
-		last := len(cas.filesPresentList) - 1
-		cas.filesPresentList[idx] = cas.filesPresentList[last]
-		cas.filesPresentList = cas.filesPresentList[:last]
+// writeIndex writes the index of the cache to the cache directory.
+// This function must be called with the exclusive lock on the cache
+// directory held.
+func (cas *hardlinkingContentAddressableStorage) writeIndex() error {
+	f, err := cas.cacheDirectory.OpenFile(hardlinkingIndexName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to create saved index of cache directory")
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, hardlinkingIndexHeader)
+	for element := cas.filesUnused.Back(); element != nil; element = element.Prev() {
+		fmt.Fprintln(w, element.Value.(*cachedFile).key)
+	}
+	for key, file := range cas.filesPresent {
+		if file.useCount > 0 {
+			fmt.Fprintln(w, key)
+		}
+	}
+	fmt.Fprintln(w, hardlinkingIndexFooter)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return util.StatusWrap(err, "Failed to write saved index of cache directory")
+	}
+	if err := f.Close(); err != nil {
+		return util.StatusWrap(err, "Failed to close saved index of cache directory")
 	}
 	return nil
 }
 
+// hasValidDigestXattr returns whether the digest stored as an extended
+// attribute of a file in the cache directory matches its filename.
+// Files without the extended attribute (e.g., ones created on file
+// systems without support for extended attributes) are assumed to be
+// valid.
+func (cas *hardlinkingContentAddressableStorage) hasValidDigestXattr(key string) bool {
+	value, err := cas.cacheDirectory.Getxattr(key, hardlinkingDigestXattrName)
+	return err != nil || string(value) == key[:len(key)-2]
+}
+
+// setDigestXattr stores the digest of a file that is added to the
+// cache directory as an extended attribute. Failures are not fatal, as
+// extended attributes are merely used for validation.
+func (cas *hardlinkingContentAddressableStorage) setDigestXattr(name string, key string) {
+	if err := cas.cacheDirectory.Setxattr(name, hardlinkingDigestXattrName, []byte(key[:len(key)-2])); err != nil && err != unix.ENOTSUP {
+		logrus.WithError(err).WithField("key", key).Warn("Failed to store digest of cache entry")
+	}
+}
+
+// insertFile adds a file to the index as the most recently used file.
+func (cas *hardlinkingContentAddressableStorage) insertFile(key string, sizeBytes int64) {
+	file := &cachedFile{
+		key:       key,
+		sizeBytes: sizeBytes,
+	}
+	file.element = cas.filesUnused.PushFront(file)
+	cas.filesPresent[key] = file
+}
+
+// makeSpace evicts the least recently used files that are not in use,
+// until there is room for storing an additional number of files of a
+// given total size. It returns false if not enough files could be
+// evicted, due to the remaining files being in use or being unknown to
+// this process.
+func (cas *hardlinkingContentAddressableStorage) makeSpace(usage *CacheUsage, files int, sizeBytes int64) (bool, error) {
+	for usage.Files+files > cas.maxFiles || usage.SizeBytes+sizeBytes > cas.maxSize {
+		if ok, err := cas.evictLeastRecentlyUsed(usage); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// evictLeastRecentlyUsed evicts the least recently used file that is
+// not in use. It returns false if all files are in use. Files that have
+// already been evicted by another process are only removed from the
+// index, as they are no longer accounted for in the usage of the cache
+// directory.
+func (cas *hardlinkingContentAddressableStorage) evictLeastRecentlyUsed(usage *CacheUsage) (bool, error) {
+	element := cas.filesUnused.Back()
+	if element == nil {
+		return false, nil
+	}
+	file := element.Value.(*cachedFile)
+	if err := cas.cacheDirectory.Remove(file.key); err == nil {
+		usage.Files--
+		usage.SizeBytes -= file.sizeBytes
+		hardlinkingContentAddressableStorageEvictionsTotal.Inc()
+	} else if !os.IsNotExist(err) {
+		return false, util.StatusWrapf(err, "Failed to evict cache entry %#v", file.key)
+	}
+	cas.filesUnused.Remove(element)
+	delete(cas.filesPresent, file.key)
+	return true, nil
+}
+
+func (cas *hardlinkingContentAddressableStorage) Evict(sizeBytes int64) (int64, error) {
+	cas.lock.Lock()
+	defer cas.lock.Unlock()
+
+	usage, err := cas.lockUsage()
+	if err != nil {
+		return 0, err
+	}
+	initialSize := usage.SizeBytes
+	for initialSize-usage.SizeBytes < sizeBytes {
+		var ok bool
+		if ok, err = cas.evictLeastRecentlyUsed(&usage); err != nil || !ok {
+			break
+		}
+	}
+	if err2 := cas.usageStore.Unlock(&usage); err == nil {
+		err = err2
+	}
+	return initialSize - usage.SizeBytes, err
+}
+
+// acquireFile increments the use count of a file in the cache,
+// preventing it from being evicted.
+func (cas *hardlinkingContentAddressableStorage) acquireFile(file *cachedFile) {
+	if file.useCount == 0 {
+		cas.filesUnused.Remove(file.element)
+		file.element = nil
+	}
+	file.useCount++
+}
+
+// releaseFile decrements the use count of a file in the cache. When
+// no longer in use, it becomes the most recently used file that is
+// eligible for eviction.
+func (cas *hardlinkingContentAddressableStorage) releaseFile(file *cachedFile) {
+	file.useCount--
+	if file.useCount == 0 {
+		file.element = cas.filesUnused.PushFront(file)
+	}
+}
+
+// removeFile removes a file from the index that is no longer present
+// in the cache directory, due to it being evicted by another process.
+func (cas *hardlinkingContentAddressableStorage) removeFile(file *cachedFile) {
+	if file.useCount == 0 && cas.filesPresent[file.key] == file {
+		cas.filesUnused.Remove(file.element)
+		delete(cas.filesPresent, file.key)
+	}
+}
+
+// adoptFile adds a file to the index that has been placed in the cache
+// directory, either by this process or another process sharing the
+// same cache directory. The file is already accounted for in the usage
+// of the cache directory.
+func (cas *hardlinkingContentAddressableStorage) adoptFile(key string, sizeBytes int64) {
+	if _, ok := cas.filesPresent[key]; !ok {
+		cas.insertFile(key, sizeBytes)
+	}
+}
+
+// getLinkFallbackReason returns whether a failure to create a hardlink
+// may be resolved by cloning or copying the file instead. It returns a
+// description of the failure for use in metrics.
+func getLinkFallbackReason(err error) (string, bool) {
+	switch err {
+	case unix.EXDEV:
+		// Hardlinks cannot be created across volumes (e.g., on
+		// macOS when the build directory is placed on a
+		// separate APFS volume).
+		return "EXDEV", true
+	case unix.EMLINK:
+		// Frequently used files may reach the maximum number of
+		// hardlinks supported by the file system (e.g., 65000
+		// on ext4).
+		return "EMLINK", true
+	default:
+		return "", false
+	}
+}
+
+// linkFromCache places a file stored in the cache directory at a
+// target location. If the file cannot be hardlinked or cloning is
+// preferred, fall back to cloning or copying it.
+func (cas *hardlinkingContentAddressableStorage) linkFromCache(key string, directory filesystem.Directory, name string) error {
+	reason := "CloningPreferred"
+	if !cas.cloneFiles {
+		err := cas.cacheDirectory.Link(key, directory, name)
+		var ok bool
+		if reason, ok = getLinkFallbackReason(err); !ok {
+			return err
+		}
+	}
+	if err := cas.cacheDirectory.Clonefile(key, directory, name); err == nil || os.IsNotExist(err) {
+		if err == nil {
+			hardlinkingContentAddressableStorageLinkFallbacksTotal.WithLabelValues(reason, "Clone").Inc()
+		}
+		return err
+	}
+	hardlinkingContentAddressableStorageLinkFallbacksTotal.WithLabelValues(reason, "Copy").Inc()
+	return filesystem.CopyFile(cas.cacheDirectory, key, directory, name)
+}
+
+// linkIntoCache places a file that has just been downloaded into the
+// cache directory. Other processes may never observe partially written
+// files in the cache directory. Creating a hardlink is atomic. Files
+// that cannot be hardlinked are cloned to a temporary file instead,
+// which is subsequently hardlinked into place. Files are left uncached
+// if they can neither be hardlinked nor cloned.
+//
+// It returns whether the file was added to the cache directory by this
+// call, and whether the file is present in the cache directory, as
+// another process may have added it already.
+func (cas *hardlinkingContentAddressableStorage) linkIntoCache(directory filesystem.Directory, name string, key string) (bool, bool, error) {
+	reason := "CloningPreferred"
+	if !cas.cloneFiles {
+		err := directory.Link(name, cas.cacheDirectory, key)
+		if err == nil {
+			cas.setDigestXattr(key, key)
+			return true, true, nil
+		} else if os.IsExist(err) {
+			return false, true, nil
+		}
+		var ok bool
+		if reason, ok = getLinkFallbackReason(err); !ok {
+			return false, false, err
+		}
+	}
+
+	temporaryName := fmt.Sprintf("%s%d-%d", hardlinkingTemporaryPrefix, os.Getpid(), cas.temporaryFilesCreated)
+	cas.temporaryFilesCreated++
+	if err := directory.Clonefile(name, cas.cacheDirectory, temporaryName); err != nil {
+		hardlinkingContentAddressableStorageLinkFallbacksTotal.WithLabelValues(reason, "Uncached").Inc()
+		return false, false, nil
+	}
+	hardlinkingContentAddressableStorageLinkFallbacksTotal.WithLabelValues(reason, "Clone").Inc()
+	cas.setDigestXattr(temporaryName, key)
+	err := cas.cacheDirectory.Link(temporaryName, cas.cacheDirectory, key)
+	if err := cas.cacheDirectory.Remove(temporaryName); err != nil {
+		logrus.WithError(err).WithField("name", temporaryName).Warn("Failed to remove temporary file from cache directory")
+	}
+	if err == nil {
+		return true, true, nil
+	} else if os.IsExist(err) {
+		return false, true, nil
+	}
+	return false, false, err
+}
+
 func (cas *hardlinkingContentAddressableStorage) GetFile(ctx context.Context, digest *util.Digest, directory filesystem.Directory, name string, isExecutable bool) error {
 	key := digest.GetKey(cas.digestKeyFormat)
 	if isExecutable {
@@ -87,16 +670,41 @@ func (cas *hardlinkingContentAddressableStorage) GetFile(ctx context.Context, di
 	} else {
 		key += "-x"
 	}
+	sizeBytes := digest.GetSizeBytes()
 
-	// If the file is present in the cache, hardlink it to the destination.
-	cas.lock.RLock()
-	if _, ok := cas.filesPresentSize[key]; ok {
-		err := cas.cacheDirectory.Link(key, directory, name)
-		cas.lock.RUnlock()
+	// If the file is present in the cache, hardlink it to the
+	// destination. Keep the file referenced while linking, so that
+	// it cannot be evicted by concurrent calls.
+	cas.lock.Lock()
+	if file, ok := cas.filesPresent[key]; ok {
+		cas.acquireFile(file)
+		cas.lock.Unlock()
+
+		err := cas.linkFromCache(key, directory, name)
+
+		cas.lock.Lock()
+		cas.releaseFile(file)
+		if !os.IsNotExist(err) {
+			cas.lock.Unlock()
+			hardlinkingContentAddressableStorageOperationsTotalHit.Inc()
+			return err
+		}
+		// File got evicted by another process.
+		cas.removeFile(file)
+	}
+	cas.lock.Unlock()
+
+	// The file may have been placed in the cache directory by
+	// another process sharing the same cache directory.
+	if err := cas.linkFromCache(key, directory, name); err == nil {
 		hardlinkingContentAddressableStorageOperationsTotalHit.Inc()
+		cas.lock.Lock()
+		cas.adoptFile(key, sizeBytes)
+		cas.lock.Unlock()
+		return nil
+	} else if !os.IsNotExist(err) {
 		return err
 	}
-	cas.lock.RUnlock()
 	hardlinkingContentAddressableStorageOperationsTotalMiss.Inc()
 
 	// Download the file at the intended location.
@@ -104,20 +712,40 @@ func (cas *hardlinkingContentAddressableStorage) GetFile(ctx context.Context, di
 		return err
 	}
 
-	// Hardlink the file into the cache.
+	// Link the file into the cache. Skip this if all files in the
+	// cache are in use and no space can be made. If another process
+	// already added the same file, reuse it.
 	cas.lock.Lock()
 	defer cas.lock.Unlock()
-	if _, ok := cas.filesPresentSize[key]; !ok {
-		sizeBytes := digest.GetSizeBytes()
-		if err := cas.makeSpace(sizeBytes); err != nil {
-			return err
-		}
-		if err := directory.Link(name, cas.cacheDirectory, key); err != nil {
-			return err
-		}
-		cas.filesPresentList = append(cas.filesPresentList, key)
-		cas.filesPresentSize[key] = sizeBytes
-		cas.filesPresentTotalSize += sizeBytes
+	if _, ok := cas.filesPresent[key]; ok {
+		return nil
+	}
+	usage, err := cas.lockUsage()
+	if err != nil {
+		return err
+	}
+	err = cas.addFile(&usage, directory, name, key, sizeBytes)
+	if err2 := cas.usageStore.Unlock(&usage); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// addFile links a file that has just been downloaded into the cache
+// directory and adds it to the index. Space is made by evicting files
+// first.
+func (cas *hardlinkingContentAddressableStorage) addFile(usage *CacheUsage, directory filesystem.Directory, name string, key string, sizeBytes int64) error {
+	if ok, err := cas.makeSpace(usage, 1, sizeBytes); err != nil || !ok {
+		return err
+	}
+	created, present, err := cas.linkIntoCache(directory, name, key)
+	if err != nil || !present {
+		return err
+	}
+	if created {
+		usage.Files++
+		usage.SizeBytes += sizeBytes
 	}
+	cas.insertFile(key, sizeBytes)
 	return nil
 }
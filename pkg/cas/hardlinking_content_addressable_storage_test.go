@@ -0,0 +1,509 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestHardlinkingContentAddressableStorageReloadAndEvict(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// The cache directory contains a file from a previous run,
+	// which should be reused. Other files should be removed.
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_RDONLY, os.FileMode(0)).Return(nil, syscall.ENOENT)
+	cacheDirectory.EXPECT().Remove(".index").Return(syscall.ENOENT)
+	cacheDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo("8b1a9953c4611296a827abf8c47804d7-5-x", 0),
+		filesystem.NewSimpleFileInfo("garbage", 0),
+		filesystem.NewSimpleFileInfo("9a0364b9e99bb480dd25e1f0284c8555-7+x", os.ModeDir),
+		filesystem.NewSimpleFileInfo(".tmp-123-4", 0),
+		filesystem.NewSimpleFileInfo(".usage", os.ModeDir),
+	}, nil)
+	cacheDirectory.EXPECT().Getxattr("8b1a9953c4611296a827abf8c47804d7-5-x", "user.buildbarn.digest").Return([]byte("8b1a9953c4611296a827abf8c47804d7-5"), nil)
+	cacheDirectory.EXPECT().RemoveAll("garbage").Return(nil)
+	cacheDirectory.EXPECT().RemoveAll("9a0364b9e99bb480dd25e1f0284c8555-7+x").Return(nil)
+	cacheDirectory.EXPECT().Remove(".tmp-123-4").Return(nil)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+
+	// The usage stored by the previous run should be discarded in
+	// favour of the contents of the cache directory.
+	usageStore := mock.NewMockCacheUsageStore(ctrl)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 3, SizeBytes: 12}, true, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 5}).Return(nil)
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	hardlinkingCAS, _, err := cas.NewHardlinkingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, cacheDirectory, usageStore, 2, 100, false)
+	require.NoError(t, err)
+
+	// Files from the previous run should be linked from the cache.
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Link("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello.txt").Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(
+		ctx,
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		}),
+		buildDirectory,
+		"hello.txt",
+		false))
+
+	// Files that are not present should be downloaded and linked
+	// into the cache.
+	digest2 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "4a8a08f09d37b73795649038408b5f33",
+		SizeBytes: 10,
+	})
+	cacheDirectory.EXPECT().Link("4a8a08f09d37b73795649038408b5f33-10+x", buildDirectory, "a.txt").Return(syscall.ENOENT)
+	baseCAS.EXPECT().GetFile(ctx, digest2, buildDirectory, "a.txt", true).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 1, SizeBytes: 5}, true, nil)
+	buildDirectory.EXPECT().Link("a.txt", cacheDirectory, "4a8a08f09d37b73795649038408b5f33-10+x").Return(nil)
+	cacheDirectory.EXPECT().Setxattr("4a8a08f09d37b73795649038408b5f33-10+x", "user.buildbarn.digest", []byte("4a8a08f09d37b73795649038408b5f33-10")).Return(nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 2, SizeBytes: 15}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest2, buildDirectory, "a.txt", true))
+
+	// Adding a third file exceeds the maximum number of files,
+	// causing the least recently used file to be evicted.
+	digest3 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "0cc175b9c0f1b6a831c399e269772661",
+		SizeBytes: 1,
+	})
+	cacheDirectory.EXPECT().Link("0cc175b9c0f1b6a831c399e269772661-1-x", buildDirectory, "b.txt").Return(syscall.ENOENT)
+	baseCAS.EXPECT().GetFile(ctx, digest3, buildDirectory, "b.txt", false).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 2, SizeBytes: 15}, true, nil)
+	cacheDirectory.EXPECT().Remove("8b1a9953c4611296a827abf8c47804d7-5-x").Return(nil)
+	buildDirectory.EXPECT().Link("b.txt", cacheDirectory, "0cc175b9c0f1b6a831c399e269772661-1-x").Return(nil)
+	cacheDirectory.EXPECT().Setxattr("0cc175b9c0f1b6a831c399e269772661-1-x", "user.buildbarn.digest", []byte("0cc175b9c0f1b6a831c399e269772661-1")).Return(nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 2, SizeBytes: 11}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest3, buildDirectory, "b.txt", false))
+}
+
+func TestHardlinkingContentAddressableStorageShared(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Another process is already using the cache directory. Files
+	// that look invalid may be in the process of being created by
+	// the other process, so they must be left alone.
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(unix.EWOULDBLOCK)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	usageStore := mock.NewMockCacheUsageStore(ctrl)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 1, SizeBytes: 20}, true, nil)
+	cacheDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo("garbage", 0),
+	}, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 20}).Return(nil)
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	hardlinkingCAS, _, err := cas.NewHardlinkingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, cacheDirectory, usageStore, 2, 100, false)
+	require.NoError(t, err)
+
+	// Limits apply to all processes combined. If the cache
+	// directory is full and this process is not aware of any files
+	// that it can evict, downloaded files should not be cached. If
+	// the usage of the cache directory is unknown, it should be
+	// recomputed by scanning the cache directory.
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	digest1 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "4a8a08f09d37b73795649038408b5f33",
+		SizeBytes: 10,
+	})
+	cacheDirectory.EXPECT().Link("4a8a08f09d37b73795649038408b5f33-10-x", buildDirectory, "a.txt").Return(syscall.ENOENT)
+	baseCAS.EXPECT().GetFile(ctx, digest1, buildDirectory, "a.txt", false).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{}, false, nil)
+	cacheDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo("0cc175b9c0f1b6a831c399e269772661-1-x", 0),
+		filesystem.NewSimpleFileInfo("6fc422233a40a75a1f028e11c3cd1140-7+x", 0),
+		filesystem.NewSimpleFileInfo("garbage", 0),
+	}, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 2, SizeBytes: 8}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest1, buildDirectory, "a.txt", false))
+
+	// A file placed in the cache directory by the other process
+	// should be linked without downloading it. It is already
+	// accounted for in the usage of the cache directory.
+	digest2 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	cacheDirectory.EXPECT().Link("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello.txt").Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest2, buildDirectory, "hello.txt", false))
+
+	// As this process is now aware of a file in the cache
+	// directory, it may evict it to make space for another file.
+	digest3 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "0cc175b9c0f1b6a831c399e269772661",
+		SizeBytes: 1,
+	})
+	cacheDirectory.EXPECT().Link("0cc175b9c0f1b6a831c399e269772661-1+x", buildDirectory, "b.txt").Return(syscall.ENOENT)
+	baseCAS.EXPECT().GetFile(ctx, digest3, buildDirectory, "b.txt", true).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 2, SizeBytes: 12}, true, nil)
+	cacheDirectory.EXPECT().Remove("8b1a9953c4611296a827abf8c47804d7-5-x").Return(nil)
+	buildDirectory.EXPECT().Link("b.txt", cacheDirectory, "0cc175b9c0f1b6a831c399e269772661-1+x").Return(nil)
+	cacheDirectory.EXPECT().Setxattr("0cc175b9c0f1b6a831c399e269772661-1+x", "user.buildbarn.digest", []byte("0cc175b9c0f1b6a831c399e269772661-1")).Return(nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 2, SizeBytes: 8}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest3, buildDirectory, "b.txt", true))
+
+	// When the other process evicts a file, it should be
+	// downloaded once again. If the other process has added the
+	// file to the cache directory in the meantime, it should not
+	// be accounted for twice.
+	cacheDirectory.EXPECT().Link("0cc175b9c0f1b6a831c399e269772661-1+x", buildDirectory, "b.txt").Return(syscall.ENOENT).Times(2)
+	baseCAS.EXPECT().GetFile(ctx, digest3, buildDirectory, "b.txt", true).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 1, SizeBytes: 7}, true, nil)
+	buildDirectory.EXPECT().Link("b.txt", cacheDirectory, "0cc175b9c0f1b6a831c399e269772661-1+x").Return(syscall.EEXIST)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 7}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest3, buildDirectory, "b.txt", true))
+
+	// Evicting a file that has already been evicted by the other
+	// process should not alter the usage of the cache directory.
+	digest4 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+	cacheDirectory.EXPECT().Link("6fc422233a40a75a1f028e11c3cd1140-7-x", buildDirectory, "c.txt").Return(syscall.ENOENT)
+	baseCAS.EXPECT().GetFile(ctx, digest4, buildDirectory, "c.txt", false).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 2, SizeBytes: 8}, true, nil)
+	cacheDirectory.EXPECT().Remove("0cc175b9c0f1b6a831c399e269772661-1+x").Return(syscall.ENOENT)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 2, SizeBytes: 8}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest4, buildDirectory, "c.txt", false))
+}
+
+func TestHardlinkingContentAddressableStorageInvalidDigestXattr(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Files whose digest stored as an extended attribute does not
+	// match their filename have been renamed or overwritten by
+	// other tools. They should be removed when scanning the cache
+	// directory.
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_RDONLY, os.FileMode(0)).Return(nil, syscall.ENOENT)
+	cacheDirectory.EXPECT().Remove(".index").Return(syscall.ENOENT)
+	cacheDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo("8b1a9953c4611296a827abf8c47804d7-5-x", 0),
+		filesystem.NewSimpleFileInfo("4a8a08f09d37b73795649038408b5f33-10+x", 0),
+	}, nil)
+	cacheDirectory.EXPECT().Getxattr("8b1a9953c4611296a827abf8c47804d7-5-x", "user.buildbarn.digest").Return([]byte("8b1a9953c4611296a827abf8c47804d7-5"), nil)
+	cacheDirectory.EXPECT().Getxattr("4a8a08f09d37b73795649038408b5f33-10+x", "user.buildbarn.digest").Return([]byte("0cc175b9c0f1b6a831c399e269772661-1"), nil)
+	cacheDirectory.EXPECT().RemoveAll("4a8a08f09d37b73795649038408b5f33-10+x").Return(nil)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	usageStore := mock.NewMockCacheUsageStore(ctrl)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{}, false, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 5}).Return(nil)
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	_, hardlinkingCache, err := cas.NewHardlinkingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, cacheDirectory, usageStore, 10, 100, false)
+	require.NoError(t, err)
+
+	// Only the valid file should have been added to the index.
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 1, SizeBytes: 5}, true, nil)
+	cacheDirectory.EXPECT().Remove("8b1a9953c4611296a827abf8c47804d7-5-x").Return(nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{}).Return(nil)
+	freed, err := hardlinkingCache.Evict(100)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), freed)
+}
+
+func TestHardlinkingContentAddressableStorageCrossVolume(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_RDONLY, os.FileMode(0)).Return(nil, syscall.ENOENT)
+	cacheDirectory.EXPECT().Remove(".index").Return(syscall.ENOENT)
+	cacheDirectory.EXPECT().ReadDir().Return(nil, nil)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	usageStore := mock.NewMockCacheUsageStore(ctrl)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{}, false, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{}).Return(nil)
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	hardlinkingCAS, _, err := cas.NewHardlinkingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, cacheDirectory, usageStore, 2, 100, false)
+	require.NoError(t, err)
+
+	// If the build directory is placed on another volume, files
+	// should be cloned into the cache after downloading them. They
+	// are cloned to a temporary file first, so that other processes
+	// never observe partially written files.
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	digest := util.MustNewDigest("macos", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	cacheDirectory.EXPECT().Link("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello.txt").Return(syscall.ENOENT)
+	baseCAS.EXPECT().GetFile(ctx, digest, buildDirectory, "hello.txt", false).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{}, true, nil)
+	buildDirectory.EXPECT().Link("hello.txt", cacheDirectory, "8b1a9953c4611296a827abf8c47804d7-5-x").Return(syscall.EXDEV)
+	temporaryName := fmt.Sprintf(".tmp-%d-0", os.Getpid())
+	buildDirectory.EXPECT().Clonefile("hello.txt", cacheDirectory, temporaryName).Return(nil)
+	cacheDirectory.EXPECT().Setxattr(temporaryName, "user.buildbarn.digest", []byte("8b1a9953c4611296a827abf8c47804d7-5")).Return(syscall.ENOTSUP)
+	cacheDirectory.EXPECT().Link(temporaryName, cacheDirectory, "8b1a9953c4611296a827abf8c47804d7-5-x").Return(nil)
+	cacheDirectory.EXPECT().Remove(temporaryName).Return(nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 5}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest, buildDirectory, "hello.txt", false))
+
+	// Subsequent requests should clone the file from the cache.
+	cacheDirectory.EXPECT().Link("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello2.txt").Return(syscall.EXDEV)
+	cacheDirectory.EXPECT().Clonefile("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello2.txt").Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest, buildDirectory, "hello2.txt", false))
+}
+
+func TestHardlinkingContentAddressableStorageLinkLimit(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_RDONLY, os.FileMode(0)).Return(nil, syscall.ENOENT)
+	cacheDirectory.EXPECT().Remove(".index").Return(syscall.ENOENT)
+	cacheDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo("8b1a9953c4611296a827abf8c47804d7-5-x", 0),
+	}, nil)
+	cacheDirectory.EXPECT().Getxattr("8b1a9953c4611296a827abf8c47804d7-5-x", "user.buildbarn.digest").Return(nil, syscall.ENODATA)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	usageStore := mock.NewMockCacheUsageStore(ctrl)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{}, false, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 5}).Return(nil)
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	hardlinkingCAS, _, err := cas.NewHardlinkingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, cacheDirectory, usageStore, 2, 100, false)
+	require.NoError(t, err)
+
+	// If the file in the cache has reached the maximum number of
+	// hardlinks and cloning is not supported, it should be copied.
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Link("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello.txt").Return(syscall.EMLINK)
+	cacheDirectory.EXPECT().Clonefile("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello.txt").Return(syscall.ENOTSUP)
+	cacheDirectory.EXPECT().Lstat("8b1a9953c4611296a827abf8c47804d7-5-x").Return(filesystem.NewSimpleFileInfo("8b1a9953c4611296a827abf8c47804d7-5-x", 0444), nil)
+	cachedFile := mock.NewMockFile(ctrl)
+	cacheDirectory.EXPECT().OpenFile("8b1a9953c4611296a827abf8c47804d7-5-x", os.O_RDONLY, os.FileMode(0)).Return(cachedFile, nil)
+	cachedFileReader := strings.NewReader("Hello")
+	cachedFile.EXPECT().Read(gomock.Any()).DoAndReturn(cachedFileReader.Read).AnyTimes()
+	cachedFile.EXPECT().Close()
+	copiedFile := mock.NewMockFile(ctrl)
+	buildDirectory.EXPECT().OpenFile("hello.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0444)).Return(copiedFile, nil)
+	var copiedFileContents bytes.Buffer
+	copiedFile.EXPECT().Write(gomock.Any()).DoAndReturn(copiedFileContents.Write).AnyTimes()
+	copiedFile.EXPECT().Close()
+	require.NoError(t, hardlinkingCAS.GetFile(
+		ctx,
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		}),
+		buildDirectory,
+		"hello.txt",
+		false))
+	require.Equal(t, "Hello", copiedFileContents.String())
+}
+
+func TestHardlinkingContentAddressableStorageCloneFiles(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_RDONLY, os.FileMode(0)).Return(nil, syscall.ENOENT)
+	cacheDirectory.EXPECT().Remove(".index").Return(syscall.ENOENT)
+	cacheDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo("8b1a9953c4611296a827abf8c47804d7-5-x", 0),
+	}, nil)
+	cacheDirectory.EXPECT().Getxattr("8b1a9953c4611296a827abf8c47804d7-5-x", "user.buildbarn.digest").Return(nil, syscall.ENODATA)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	usageStore := mock.NewMockCacheUsageStore(ctrl)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{}, false, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 5}).Return(nil)
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	hardlinkingCAS, _, err := cas.NewHardlinkingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, cacheDirectory, usageStore, 2, 100, true)
+	require.NoError(t, err)
+
+	// Files in the cache should be cloned instead of hardlinked.
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Clonefile("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello.txt").Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(
+		ctx,
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		}),
+		buildDirectory,
+		"hello.txt",
+		false))
+
+	// Files that are downloaded should be cloned into the cache.
+	digest2 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+	cacheDirectory.EXPECT().Clonefile("6fc422233a40a75a1f028e11c3cd1140-7+x", buildDirectory, "goodbye.sh").Return(syscall.ENOENT)
+	baseCAS.EXPECT().GetFile(ctx, digest2, buildDirectory, "goodbye.sh", true).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 1, SizeBytes: 5}, true, nil)
+	temporaryName1 := fmt.Sprintf(".tmp-%d-0", os.Getpid())
+	buildDirectory.EXPECT().Clonefile("goodbye.sh", cacheDirectory, temporaryName1).Return(nil)
+	cacheDirectory.EXPECT().Setxattr(temporaryName1, "user.buildbarn.digest", []byte("6fc422233a40a75a1f028e11c3cd1140-7")).Return(nil)
+	cacheDirectory.EXPECT().Link(temporaryName1, cacheDirectory, "6fc422233a40a75a1f028e11c3cd1140-7+x").Return(nil)
+	cacheDirectory.EXPECT().Remove(temporaryName1).Return(nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 2, SizeBytes: 12}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest2, buildDirectory, "goodbye.sh", true))
+
+	// If cloning is not supported, files should be copied out of
+	// the cache, and downloaded files should not be cached, as
+	// hardlinking them would cause the cache to be corrupted when
+	// they are modified.
+	digest3 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "4a8a08f09d37b73795649038408b5f33",
+		SizeBytes: 10,
+	})
+	cacheDirectory.EXPECT().Clonefile("4a8a08f09d37b73795649038408b5f33-10-x", buildDirectory, "other.txt").Return(syscall.ENOENT)
+	baseCAS.EXPECT().GetFile(ctx, digest3, buildDirectory, "other.txt", false).Return(nil)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 2, SizeBytes: 12}, true, nil)
+	cacheDirectory.EXPECT().Remove("8b1a9953c4611296a827abf8c47804d7-5-x").Return(nil)
+	buildDirectory.EXPECT().Clonefile("other.txt", cacheDirectory, fmt.Sprintf(".tmp-%d-1", os.Getpid())).Return(syscall.ENOTSUP)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 7}).Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(ctx, digest3, buildDirectory, "other.txt", false))
+}
+
+func TestHardlinkingContentAddressableStorageSavedIndex(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// The index saved by a previous run should be loaded instead of
+	// scanning the cache directory. It should be removed afterwards.
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	savedIndex := mock.NewMockFile(ctrl)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_RDONLY, os.FileMode(0)).Return(savedIndex, nil)
+	savedIndexReader := strings.NewReader(
+		"buildbarn-hardlinking-cache-index-v1\n" +
+			"8b1a9953c4611296a827abf8c47804d7-5-x\n" +
+			"4a8a08f09d37b73795649038408b5f33-10+x\n" +
+			"end\n")
+	savedIndex.EXPECT().Read(gomock.Any()).DoAndReturn(savedIndexReader.Read).AnyTimes()
+	savedIndex.EXPECT().Close()
+	cacheDirectory.EXPECT().Remove(".index").Return(nil)
+	cacheDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo("4a8a08f09d37b73795649038408b5f33-10+x", 0),
+		filesystem.NewSimpleFileInfo("8b1a9953c4611296a827abf8c47804d7-5-x", 0),
+	}, nil)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	usageStore := mock.NewMockCacheUsageStore(ctrl)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{}, false, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 2, SizeBytes: 15}).Return(nil)
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	hardlinkingCAS, hardlinkingCache, err := cas.NewHardlinkingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, cacheDirectory, usageStore, 10, 100, false)
+	require.NoError(t, err)
+
+	// Files listed in the index should be linked from the cache.
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Link("8b1a9953c4611296a827abf8c47804d7-5-x", buildDirectory, "hello.txt").Return(nil)
+	require.NoError(t, hardlinkingCAS.GetFile(
+		ctx,
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		}),
+		buildDirectory,
+		"hello.txt",
+		false))
+
+	// Saving the index should write all files, ordered from least
+	// recently used to most recently used.
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	newIndex := mock.NewMockFile(ctrl)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0666)).Return(newIndex, nil)
+	var newIndexContents bytes.Buffer
+	newIndex.EXPECT().Write(gomock.Any()).DoAndReturn(newIndexContents.Write).AnyTimes()
+	newIndex.EXPECT().Close()
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	require.NoError(t, hardlinkingCache.SaveIndex())
+	require.Equal(t,
+		"buildbarn-hardlinking-cache-index-v1\n"+
+			"4a8a08f09d37b73795649038408b5f33-10+x\n"+
+			"8b1a9953c4611296a827abf8c47804d7-5-x\n"+
+			"end\n",
+		newIndexContents.String())
+
+	// The index should not be written while other processes use
+	// the cache directory.
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(unix.EWOULDBLOCK)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	require.NoError(t, hardlinkingCache.SaveIndex())
+
+	// The shared lock should also be restored if writing the index
+	// fails.
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0666)).Return(nil, syscall.ENOSPC)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	require.Equal(t, util.StatusWrap(syscall.ENOSPC, "Failed to create saved index of cache directory"), hardlinkingCache.SaveIndex())
+}
+
+func TestHardlinkingContentAddressableStorageEvictOnDemand(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cacheDirectory := mock.NewMockDirectory(ctrl)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_EX | unix.LOCK_NB).Return(nil)
+	savedIndex := mock.NewMockFile(ctrl)
+	cacheDirectory.EXPECT().OpenFile(".index", os.O_RDONLY, os.FileMode(0)).Return(savedIndex, nil)
+	savedIndexReader := strings.NewReader(
+		"buildbarn-hardlinking-cache-index-v1\n" +
+			"8b1a9953c4611296a827abf8c47804d7-5-x\n" +
+			"4a8a08f09d37b73795649038408b5f33-10+x\n" +
+			"end\n")
+	savedIndex.EXPECT().Read(gomock.Any()).DoAndReturn(savedIndexReader.Read).AnyTimes()
+	savedIndex.EXPECT().Close()
+	cacheDirectory.EXPECT().Remove(".index").Return(nil)
+	cacheDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo("4a8a08f09d37b73795649038408b5f33-10+x", 0),
+		filesystem.NewSimpleFileInfo("8b1a9953c4611296a827abf8c47804d7-5-x", 0),
+	}, nil)
+	cacheDirectory.EXPECT().Flock(unix.LOCK_SH).Return(nil)
+	usageStore := mock.NewMockCacheUsageStore(ctrl)
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{}, false, nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 2, SizeBytes: 15}).Return(nil)
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	_, hardlinkingCache, err := cas.NewHardlinkingContentAddressableStorage(baseCAS, util.DigestKeyWithoutInstance, cacheDirectory, usageStore, 10, 100, false)
+	require.NoError(t, err)
+
+	// Evicting a small amount of space should only remove the
+	// least recently used file.
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 2, SizeBytes: 15}, true, nil)
+	cacheDirectory.EXPECT().Remove("8b1a9953c4611296a827abf8c47804d7-5-x").Return(nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{Files: 1, SizeBytes: 10}).Return(nil)
+	freed, err := hardlinkingCache.Evict(3)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), freed)
+
+	// Requesting more space than available should empty the cache.
+	usageStore.EXPECT().Lock().Return(cas.CacheUsage{Files: 1, SizeBytes: 10}, true, nil)
+	cacheDirectory.EXPECT().Remove("4a8a08f09d37b73795649038408b5f33-10+x").Return(nil)
+	usageStore.EXPECT().Unlock(&cas.CacheUsage{}).Return(nil)
+	freed, err = hardlinkingCache.Evict(100)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), freed)
+}
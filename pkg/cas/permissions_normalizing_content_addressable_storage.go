@@ -0,0 +1,60 @@
+package cas
+
+import (
+	"context"
+	"os"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+type permissionsNormalizingContentAddressableStorage struct {
+	ContentAddressableStorage
+
+	fileMode           os.FileMode
+	executableFileMode os.FileMode
+	uid                int
+	gid                int
+}
+
+// NewPermissionsNormalizingContentAddressableStorage is an adapter for
+// ContentAddressableStorage that adjusts the mode and ownership of
+// files obtained through GetFile(). This may be used to place input
+// files with different permissions than the default 0444 and 0555
+// (e.g., for tools that require inputs to be writable), or to make
+// them owned by the user as which build actions are run.
+//
+// A user ID or group ID of -1 leaves the respective ownership
+// unchanged. Changing ownership typically requires the worker to run
+// with elevated privileges (e.g., CAP_CHOWN).
+func NewPermissionsNormalizingContentAddressableStorage(base ContentAddressableStorage, fileMode os.FileMode, executableFileMode os.FileMode, uid int, gid int) ContentAddressableStorage {
+	return &permissionsNormalizingContentAddressableStorage{
+		ContentAddressableStorage: base,
+
+		fileMode:           fileMode,
+		executableFileMode: executableFileMode,
+		uid:                uid,
+		gid:                gid,
+	}
+}
+
+func (cas *permissionsNormalizingContentAddressableStorage) GetFile(ctx context.Context, digest *util.Digest, directory filesystem.Directory, name string, isExecutable bool) error {
+	if err := cas.ContentAddressableStorage.GetFile(ctx, digest, directory, name, isExecutable); err != nil {
+		return err
+	}
+	mode := cas.fileMode
+	if isExecutable {
+		mode = cas.executableFileMode
+	}
+	if err := directory.Chmod(name, mode); err != nil {
+		directory.Remove(name)
+		return util.StatusWrap(err, "Failed to change file mode")
+	}
+	if cas.uid != -1 || cas.gid != -1 {
+		if err := directory.Lchown(name, cas.uid, cas.gid); err != nil {
+			directory.Remove(name)
+			return util.StatusWrap(err, "Failed to change file ownership")
+		}
+	}
+	return nil
+}
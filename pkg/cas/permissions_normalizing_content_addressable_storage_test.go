@@ -0,0 +1,54 @@
+package cas_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPermissionsNormalizingContentAddressableStorageGetFile(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseCAS := mock.NewMockContentAddressableStorage(ctrl)
+	directory := mock.NewMockDirectory(ctrl)
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	// Only the mode should be changed if no user or group ID is
+	// provided.
+	modeOnlyCAS := cas.NewPermissionsNormalizingContentAddressableStorage(baseCAS, 0644, 0755, -1, -1)
+	baseCAS.EXPECT().GetFile(ctx, digest, directory, "hello.txt", false).Return(nil)
+	directory.EXPECT().Chmod("hello.txt", os.FileMode(0644)).Return(nil)
+	require.NoError(t, modeOnlyCAS.GetFile(ctx, digest, directory, "hello.txt", false))
+
+	// Executables should have their ownership changed as well.
+	ownershipCAS := cas.NewPermissionsNormalizingContentAddressableStorage(baseCAS, 0444, 0555, 1000, 1000)
+	baseCAS.EXPECT().GetFile(ctx, digest, directory, "hello.sh", true).Return(nil)
+	directory.EXPECT().Chmod("hello.sh", os.FileMode(0555)).Return(nil)
+	directory.EXPECT().Lchown("hello.sh", 1000, 1000).Return(nil)
+	require.NoError(t, ownershipCAS.GetFile(ctx, digest, directory, "hello.sh", true))
+
+	// Files should not be left behind if changing ownership fails.
+	baseCAS.EXPECT().GetFile(ctx, digest, directory, "hello.txt", false).Return(nil)
+	directory.EXPECT().Chmod("hello.txt", os.FileMode(0444)).Return(nil)
+	directory.EXPECT().Lchown("hello.txt", 1000, 1000).Return(syscall.EPERM)
+	directory.EXPECT().Remove("hello.txt").Return(nil)
+	require.Equal(
+		t,
+		status.Error(codes.Unknown, "Failed to change file ownership: operation not permitted"),
+		ownershipCAS.GetFile(ctx, digest, directory, "hello.txt", false))
+}
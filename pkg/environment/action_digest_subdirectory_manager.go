@@ -2,12 +2,13 @@ package environment
 
 import (
 	"context"
-	"log"
 	"path"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/sirupsen/logrus"
 
 	"google.golang.org/grpc/codes"
 )
@@ -51,7 +52,7 @@ func (em *actionDigestSubdirectoryManager) Acquire(actionDigest *util.Digest, pl
 	subdirectory, err := buildDirectory.Enter(subdirectoryName)
 	if err != nil {
 		if err := buildDirectory.Remove(subdirectoryName); err != nil {
-			log.Print("Failed to remove action digest build directory upon failure to enter: ", err)
+			logging.WithActionDigest(logrus.NewEntry(logrus.StandardLogger()), actionDigest).WithError(err).Warn("Failed to remove build subdirectory upon failure to enter")
 		}
 		environment.Release()
 		return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to enter build subdirectory %#v", subdirectoryName)
@@ -80,16 +81,17 @@ func (e *actionDigestSubdirectoryEnvironment) Run(ctx context.Context, request *
 	newRequest.WorkingDirectory = path.Join(e.subdirectoryName, newRequest.WorkingDirectory)
 	newRequest.StdoutPath = path.Join(e.subdirectoryName, newRequest.StdoutPath)
 	newRequest.StderrPath = path.Join(e.subdirectoryName, newRequest.StderrPath)
+	newRequest.SecretFiles = prefixSecretFiles(newRequest.SecretFiles, e.subdirectoryName)
 	return e.base.Run(ctx, &newRequest)
 }
 
 func (e *actionDigestSubdirectoryEnvironment) Release() {
 	// Remove subdirectory prior to releasing the environment.
 	if err := e.subdirectory.Close(); err != nil {
-		log.Printf("Failed to close build subdirectory %s: %s", e.subdirectoryName, err)
+		logrus.WithField("build_subdirectory", e.subdirectoryName).WithError(err).Warn("Failed to close build subdirectory")
 	}
 	if err := e.base.GetBuildDirectory().RemoveAll(e.subdirectoryName); err != nil {
-		log.Printf("Failed to remove build subdirectory %s: %s", e.subdirectoryName, err)
+		logrus.WithField("build_subdirectory", e.subdirectoryName).WithError(err).Warn("Failed to remove build subdirectory")
 	}
 	e.base.Release()
 }
@@ -0,0 +1,127 @@
+package environment
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+)
+
+type compilerCacheManager struct {
+	base               Manager
+	cacheDirectoryPath string
+}
+
+// NewCompilerCacheManager is an adapter for Manager that lets build
+// actions use a compiler cache (ccache or sccache) stored in a
+// directory that persists across build actions. This speeds up builds
+// of non-hermetic C/C++ setups, where actions are rarely cache hits in
+// the Action Cache, but compiler invocations are.
+//
+// ccache is instructed to log the outcome of every compiler invocation
+// to a file specific to the build action, so that the number of cache
+// hits and misses can be reported as auxiliary metadata. This adapter
+// is intended to be used by bbb_runner.
+func NewCompilerCacheManager(base Manager, cacheDirectoryPath string) Manager {
+	return &compilerCacheManager{
+		base:               base,
+		cacheDirectoryPath: cacheDirectoryPath,
+	}
+}
+
+func (em *compilerCacheManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	return &compilerCacheEnvironment{
+		ManagedEnvironment: environment,
+		cacheDirectoryPath: em.cacheDirectoryPath,
+	}, nil
+}
+
+type compilerCacheEnvironment struct {
+	ManagedEnvironment
+	cacheDirectoryPath string
+}
+
+func (e *compilerCacheEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	statsLog, err := ioutil.TempFile(e.cacheDirectoryPath, "statslog")
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to create compiler cache statistics log")
+	}
+	statsLogPath := statsLog.Name()
+	statsLog.Close()
+	defer os.Remove(statsLogPath)
+
+	environmentVariables := map[string]string{}
+	for name, value := range request.EnvironmentVariables {
+		environmentVariables[name] = value
+	}
+	environmentVariables["CCACHE_DIR"] = e.cacheDirectoryPath
+	environmentVariables["CCACHE_STATSLOG"] = statsLogPath
+	environmentVariables["SCCACHE_DIR"] = e.cacheDirectoryPath
+
+	newRequest := *request
+	newRequest.EnvironmentVariables = environmentVariables
+	response, err := e.ManagedEnvironment.Run(ctx, &newRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing to report statistics should not cause the build
+	// action to fail.
+	statistics, err := readCompilerCacheStatistics(statsLogPath)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to read compiler cache statistics log")
+		return response, nil
+	}
+	if statistics.Hits == 0 && statistics.Misses == 0 {
+		return response, nil
+	}
+	statisticsAny, err := ptypes.MarshalAny(statistics)
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to marshal compiler cache statistics")
+	}
+	newResponse := *response
+	newResponse.AuxiliaryMetadata = append(append([]*any.Any(nil), response.AuxiliaryMetadata...), statisticsAny)
+	return &newResponse, nil
+}
+
+// readCompilerCacheStatistics counts the number of cache hits and
+// misses in a statistics log written by ccache. Lines starting with
+// "#" contain timestamps. Other lines contain the outcome of a single
+// compiler invocation (e.g., "direct_cache_hit", "cache_miss" or
+// "cache hit (preprocessed)", depending on the version of ccache).
+func readCompilerCacheStatistics(statsLogPath string) (*resourceusage.CompilerCacheStatistics, error) {
+	f, err := os.Open(statsLogPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var statistics resourceusage.CompilerCacheStatistics
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "hit") {
+			statistics.Hits++
+		} else if strings.Contains(line, "miss") {
+			statistics.Misses++
+		}
+	}
+	return &statistics, scanner.Err()
+}
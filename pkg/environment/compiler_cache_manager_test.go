@@ -0,0 +1,119 @@
+package environment_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCompilerCacheManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	cacheDirectoryPath, err := ioutil.TempDir("", "ccache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDirectoryPath)
+
+	baseManager := mock.NewMockManager(ctrl)
+	manager := environment.NewCompilerCacheManager(baseManager, cacheDirectoryPath)
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+	request := &runner.RunRequest{
+		Arguments: []string{"cc", "-c", "hello.c"},
+		EnvironmentVariables: map[string]string{
+			"PATH": "/bin:/usr/bin",
+		},
+	}
+
+	t.Run("AcquireFailure", func(t *testing.T) {
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(nil, status.Error(codes.Internal, "Out of disk space"))
+		_, err := manager.Acquire(actionDigest, map[string]string{})
+		require.Equal(t, status.Error(codes.Internal, "Out of disk space"), err)
+	})
+
+	t.Run("RunFailure", func(t *testing.T) {
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		baseEnvironment.EXPECT().Run(ctx, gomock.Any()).Return(nil, status.Error(codes.Unavailable, "Runner offline"))
+		_, err = environment.Run(ctx, request)
+		require.Equal(t, status.Error(codes.Unavailable, "Runner offline"), err)
+	})
+
+	t.Run("NoInvocations", func(t *testing.T) {
+		// Build actions that don't invoke the compiler should
+		// not have any statistics attached.
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		response := &runner.RunResponse{ExitCode: 1}
+		baseEnvironment.EXPECT().Run(ctx, gomock.Any()).Return(response, nil)
+		runResponse, err := environment.Run(ctx, request)
+		require.NoError(t, err)
+		require.Equal(t, response, runResponse)
+	})
+
+	t.Run("Statistics", func(t *testing.T) {
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		// The command should be pointed to the cache directory
+		// and a statistics log, which it fills with the
+		// outcomes of three compiler invocations.
+		existingMetadata, err := ptypes.MarshalAny(&resourceusage.POSIXResourceUsage{})
+		require.NoError(t, err)
+		baseEnvironment.EXPECT().Run(ctx, gomock.Any()).DoAndReturn(func(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+			require.Equal(t, "/bin:/usr/bin", request.EnvironmentVariables["PATH"])
+			require.Equal(t, cacheDirectoryPath, request.EnvironmentVariables["CCACHE_DIR"])
+			require.Equal(t, cacheDirectoryPath, request.EnvironmentVariables["SCCACHE_DIR"])
+			statsLogPath := request.EnvironmentVariables["CCACHE_STATSLOG"]
+			require.Equal(t, cacheDirectoryPath, filepath.Dir(statsLogPath))
+			require.NoError(t, ioutil.WriteFile(statsLogPath, []byte("# 2026-10-15T12:00:00\ndirect_cache_hit\ncache_miss\n# 2026-10-15T12:00:01\ncache hit (preprocessed)\n"), 0666))
+			return &runner.RunResponse{
+				AuxiliaryMetadata: []*any.Any{existingMetadata},
+			}, nil
+		})
+		runResponse, err := environment.Run(ctx, request)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"PATH": "/bin:/usr/bin"}, request.EnvironmentVariables)
+
+		// Statistics should be appended to existing metadata.
+		require.Len(t, runResponse.AuxiliaryMetadata, 2)
+		require.Equal(t, existingMetadata, runResponse.AuxiliaryMetadata[0])
+		var statistics resourceusage.CompilerCacheStatistics
+		require.NoError(t, ptypes.UnmarshalAny(runResponse.AuxiliaryMetadata[1], &statistics))
+		require.True(t, proto.Equal(&resourceusage.CompilerCacheStatistics{Hits: 2, Misses: 1}, &statistics))
+
+		// The statistics log should have been removed.
+		files, err := ioutil.ReadDir(cacheDirectoryPath)
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+}
@@ -1,10 +1,10 @@
 package environment
 
 import (
-	"log"
 	"sync"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/sirupsen/logrus"
 )
 
 type concurrentManager struct {
@@ -55,7 +55,7 @@ func (e *concurrentEnvironment) Release() {
 	e.manager.lock.Lock()
 	defer e.manager.lock.Unlock()
 	if e.manager.refcount == 0 {
-		log.Fatal("Attempted to release an already released environment")
+		logrus.Fatal("Attempted to release an already released environment")
 	}
 	e.manager.refcount--
 	if e.manager.refcount == 0 {
@@ -0,0 +1,150 @@
+package environment
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ContainerImagePlatformProperty is the name of the platform
+	// property that build actions may set to request being run
+	// inside a container (e.g., "docker://ubuntu:18.04").
+	ContainerImagePlatformProperty = "container-image"
+	// DockerPrivilegedPlatformProperty is the name of the platform
+	// property that build actions may set to request their
+	// container to be run with extended privileges.
+	DockerPrivilegedPlatformProperty = "dockerPrivileged"
+	// DockerRuntimePlatformProperty is the name of the platform
+	// property that build actions may set to request their
+	// container to be run using a specific runtime.
+	DockerRuntimePlatformProperty = "dockerRuntime"
+)
+
+// ContainerPolicy describes which containers build actions are
+// permitted to request.
+type ContainerPolicy struct {
+	// Patterns of images that may be used, using the syntax of
+	// path.Match() (e.g., "gcr.io/my-project/*").
+	AllowedImages []string
+	// Whether containers may be run with extended privileges.
+	AllowPrivileged bool
+	// Names of container runtimes that may be requested, in
+	// addition to the default runtime.
+	AllowedRuntimes []string
+}
+
+func (p *ContainerPolicy) isAllowedImage(image string) bool {
+	for _, pattern := range p.AllowedImages {
+		if matched, _ := path.Match(pattern, image); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ContainerPolicy) isAllowedRuntime(runtime string) bool {
+	for _, allowedRuntime := range p.AllowedRuntimes {
+		if runtime == allowedRuntime {
+			return true
+		}
+	}
+	return false
+}
+
+// getContainer converts the platform properties of a build action to
+// a container that is permitted by the policy. It returns nil if the
+// build action does not request to be run in a container.
+func (p *ContainerPolicy) getContainer(platformProperties map[string]string) (*runner.Container, error) {
+	image, ok := platformProperties[ContainerImagePlatformProperty]
+	if !ok {
+		for _, name := range []string{DockerPrivilegedPlatformProperty, DockerRuntimePlatformProperty} {
+			if _, ok := platformProperties[name]; ok {
+				return nil, status.Errorf(codes.InvalidArgument, "Platform property %#v can only be used in combination with %#v", name, ContainerImagePlatformProperty)
+			}
+		}
+		return nil, nil
+	}
+
+	container := runner.Container{
+		Image: strings.TrimPrefix(image, "docker://"),
+	}
+	if !p.isAllowedImage(container.Image) {
+		return nil, status.Errorf(codes.PermissionDenied, "Container image %#v is not permitted on this worker", container.Image)
+	}
+	if value, ok := platformProperties[DockerPrivilegedPlatformProperty]; ok {
+		privileged, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Platform property %#v has invalid value %#v", DockerPrivilegedPlatformProperty, value)
+		}
+		if privileged && !p.AllowPrivileged {
+			return nil, status.Error(codes.PermissionDenied, "Privileged containers are not permitted on this worker")
+		}
+		container.Privileged = privileged
+	}
+	if runtime := platformProperties[DockerRuntimePlatformProperty]; runtime != "" {
+		if !p.isAllowedRuntime(runtime) {
+			return nil, status.Errorf(codes.PermissionDenied, "Container runtime %#v is not permitted on this worker", runtime)
+		}
+		container.Runtime = runtime
+	}
+	return &container, nil
+}
+
+type containerPolicyManager struct {
+	base   Manager
+	policy *ContainerPolicy
+}
+
+// NewContainerPolicyManager is an adapter for Manager that allows
+// build actions to request being run inside a container, based on the
+// "container-image", "dockerPrivileged" and "dockerRuntime" platform
+// properties. Requests for containers that are not permitted by the
+// policy are rejected.
+//
+// This adapter only annotates the commands that are run. It should be
+// used in combination with a runner that is capable of running
+// containers, for example by using ContainerRoutingEnvironment.
+func NewContainerPolicyManager(base Manager, policy *ContainerPolicy) Manager {
+	return &containerPolicyManager{
+		base:   base,
+		policy: policy,
+	}
+}
+
+func (em *containerPolicyManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	container, err := em.policy.getContainer(platformProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	if container == nil {
+		return environment, nil
+	}
+	return &containerPolicyEnvironment{
+		ManagedEnvironment: environment,
+		container:          container,
+	}, nil
+}
+
+type containerPolicyEnvironment struct {
+	ManagedEnvironment
+	container *runner.Container
+}
+
+func (e *containerPolicyEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	newRequest := *request
+	newRequest.Container = e.container
+	return e.ManagedEnvironment.Run(ctx, &newRequest)
+}
@@ -0,0 +1,101 @@
+package environment_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContainerPolicyManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseManager := mock.NewMockManager(ctrl)
+	manager := environment.NewContainerPolicyManager(baseManager, &environment.ContainerPolicy{
+		AllowedImages:   []string{"gcr.io/my-project/*"},
+		AllowedRuntimes: []string{"runsc"},
+	})
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+
+	t.Run("NoContainer", func(t *testing.T) {
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{"OSFamily": "Linux"}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{"OSFamily": "Linux"})
+		require.NoError(t, err)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+		}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+		response, err := environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+	})
+
+	t.Run("OptionsWithoutImage", func(t *testing.T) {
+		_, err := manager.Acquire(actionDigest, map[string]string{"dockerRuntime": "runsc"})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Platform property \"dockerRuntime\" can only be used in combination with \"container-image\""), err)
+	})
+
+	t.Run("ImageNotAllowed", func(t *testing.T) {
+		_, err := manager.Acquire(actionDigest, map[string]string{"container-image": "docker://ubuntu:18.04"})
+		require.Equal(t, status.Error(codes.PermissionDenied, "Container image \"ubuntu:18.04\" is not permitted on this worker"), err)
+	})
+
+	t.Run("PrivilegedNotAllowed", func(t *testing.T) {
+		_, err := manager.Acquire(actionDigest, map[string]string{
+			"container-image":  "docker://gcr.io/my-project/toolchain:1.0",
+			"dockerPrivileged": "true",
+		})
+		require.Equal(t, status.Error(codes.PermissionDenied, "Privileged containers are not permitted on this worker"), err)
+	})
+
+	t.Run("RuntimeNotAllowed", func(t *testing.T) {
+		_, err := manager.Acquire(actionDigest, map[string]string{
+			"container-image": "docker://gcr.io/my-project/toolchain:1.0",
+			"dockerRuntime":   "kata",
+		})
+		require.Equal(t, status.Error(codes.PermissionDenied, "Container runtime \"kata\" is not permitted on this worker"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		platformProperties := map[string]string{
+			"container-image":  "docker://gcr.io/my-project/toolchain:1.0",
+			"dockerPrivileged": "false",
+			"dockerRuntime":    "runsc",
+		}
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, platformProperties).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, platformProperties)
+		require.NoError(t, err)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+			Container: &runner.Container{
+				Image:   "gcr.io/my-project/toolchain:1.0",
+				Runtime: "runsc",
+			},
+		}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+		response, err := environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+	})
+}
@@ -0,0 +1,31 @@
+package environment
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+)
+
+type containerRoutingEnvironment struct {
+	Environment
+	containerEnvironment Environment
+}
+
+// NewContainerRoutingEnvironment creates an Environment that forwards
+// commands that need to be run inside a container to a separate
+// Environment (e.g., a runner capable of launching Docker containers).
+// All other commands are run by the default Environment. Both
+// Environments are expected to share the same build directory.
+func NewContainerRoutingEnvironment(defaultEnvironment Environment, containerEnvironment Environment) Environment {
+	return &containerRoutingEnvironment{
+		Environment:          defaultEnvironment,
+		containerEnvironment: containerEnvironment,
+	}
+}
+
+func (e *containerRoutingEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	if request.Container != nil {
+		return e.containerEnvironment.Run(ctx, request)
+	}
+	return e.Environment.Run(ctx, request)
+}
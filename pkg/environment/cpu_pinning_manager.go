@@ -0,0 +1,61 @@
+package environment
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+type cpuPinningManager struct {
+	base    Manager
+	cpuSets chan []uint32
+}
+
+// NewCPUPinningManager is an adapter for Manager that dedicates a set
+// of CPUs to every build action, so that build actions running
+// concurrently don't compete for the same CPUs. This reduces the
+// variance in timings of benchmarks and tests.
+//
+// CPU sets are taken from the provided channel when acquiring an
+// environment, and are returned to it when the environment is
+// released. The channel should contain at least as many CPU sets as
+// the number of build actions that may run concurrently, as acquiring
+// an environment blocks until a CPU set becomes available.
+func NewCPUPinningManager(base Manager, cpuSets chan []uint32) Manager {
+	return &cpuPinningManager{
+		base:    base,
+		cpuSets: cpuSets,
+	}
+}
+
+func (em *cpuPinningManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	cpus := <-em.cpuSets
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		em.cpuSets <- cpus
+		return nil, err
+	}
+	return preserveInputRootPopulator(&cpuPinningEnvironment{
+		ManagedEnvironment: environment,
+		cpuSets:            em.cpuSets,
+		cpus:               cpus,
+	}, environment), nil
+}
+
+type cpuPinningEnvironment struct {
+	ManagedEnvironment
+	cpuSets chan []uint32
+	cpus    []uint32
+}
+
+func (e *cpuPinningEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	newRequest := *request
+	newRequest.Cpus = e.cpus
+	return e.ManagedEnvironment.Run(ctx, &newRequest)
+}
+
+func (e *cpuPinningEnvironment) Release() {
+	e.ManagedEnvironment.Release()
+	e.cpuSets <- e.cpus
+}
@@ -0,0 +1,156 @@
+package environment_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCPUPinningManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseManager := mock.NewMockManager(ctrl)
+	cpuSets := make(chan []uint32, 1)
+	cpuSets <- []uint32{4, 5}
+	manager := environment.NewCPUPinningManager(baseManager, cpuSets)
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+
+	t.Run("AcquireFailure", func(t *testing.T) {
+		// The CPU set should be returned to the pool if the
+		// environment cannot be acquired.
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(nil, status.Error(codes.Internal, "Out of disk space"))
+		_, err := manager.Acquire(actionDigest, map[string]string{})
+		require.Equal(t, status.Error(codes.Internal, "Out of disk space"), err)
+		require.Len(t, cpuSets, 1)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+		require.Len(t, cpuSets, 0)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+			Cpus:      []uint32{4, 5},
+		}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+		response, err := environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+
+		baseEnvironment.EXPECT().Release()
+		environment.Release()
+		require.Equal(t, []uint32{4, 5}, <-cpuSets)
+	})
+
+	t.Run("InputRootReusing", func(t *testing.T) {
+		// When placed on top of an adapter that reuses input
+		// roots, the environment should still be capable of
+		// populating the input root incrementally.
+		contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+		cpuSets := make(chan []uint32, 1)
+		cpuSets <- []uint32{6, 7}
+		manager := environment.NewCPUPinningManager(
+			environment.NewInputRootReusingManager(baseManager, contentAddressableStorage),
+			cpuSets)
+
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		rootDirectory := mock.NewMockDirectory(ctrl)
+		baseEnvironment.EXPECT().GetBuildDirectory().Return(rootDirectory).AnyTimes()
+		subdirectory := mock.NewMockDirectory(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		rootDirectory.EXPECT().RemoveAllChildren()
+		rootDirectory.EXPECT().RemoveAll("0")
+		rootDirectory.EXPECT().Mkdir("0", os.FileMode(0777))
+		rootDirectory.EXPECT().Enter("0").Return(subdirectory, nil)
+		environment1, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		inputRootDigest := util.MustNewDigest(
+			"debian8",
+			&remoteexecution.Digest{
+				Hash:      "2b5e0c1a1e0e1c6fbc7d7b0cb1a8b5c58b4d1e8f9e8d1bd6c3e2d8b0c5d2a1e0",
+				SizeBytes: 0,
+			})
+		contentAddressableStorage.EXPECT().GetDirectory(ctx, inputRootDigest).Return(&remoteexecution.Directory{}, nil)
+		populator, ok := environment1.(environment.InputRootPopulator)
+		require.True(t, ok)
+		sizeBytes, err := populator.PopulateInputRoot(ctx, inputRootDigest)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), sizeBytes)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments:        []string{"cc", "-c", "hello.c"},
+			WorkingDirectory: "0",
+			StdoutPath:       "0/.stdout.txt",
+			StderrPath:       "0/.stderr.txt",
+			Cpus:             []uint32{6, 7},
+		}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+		response, err := environment1.Run(ctx, &runner.RunRequest{
+			Arguments:  []string{"cc", "-c", "hello.c"},
+			StdoutPath: ".stdout.txt",
+			StderrPath: ".stderr.txt",
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+
+		subdirectory.EXPECT().Close()
+		baseEnvironment.EXPECT().Release()
+		environment1.Release()
+		require.Equal(t, []uint32{6, 7}, <-cpuSets)
+	})
+}
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := environment.ParseCPUList("0-3,8,10-11\n")
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1, 2, 3, 8, 10, 11}, cpus)
+
+	_, err = environment.ParseCPUList("3-1")
+	require.Equal(t, status.Error(codes.InvalidArgument, "Invalid CPU range \"3-1\""), err)
+
+	_, err = environment.ParseCPUList("0-x")
+	require.Equal(t, status.Error(codes.InvalidArgument, "Invalid CPU \"x\""), err)
+}
+
+func TestAllocateCPUSets(t *testing.T) {
+	numaNodeCPUs := [][]uint32{
+		{0, 1, 2, 3, 4},
+		{5, 6, 7, 8, 9},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		// Sets should alternate between nodes and should never
+		// span multiple nodes.
+		cpuSets, err := environment.AllocateCPUSets(numaNodeCPUs, 4, 2)
+		require.NoError(t, err)
+		require.Equal(t, [][]uint32{{0, 1}, {5, 6}, {2, 3}, {7, 8}}, cpuSets)
+	})
+
+	t.Run("Insufficient", func(t *testing.T) {
+		// Though there are ten CPUs, only two sets of three
+		// CPUs fit within the nodes.
+		_, err := environment.AllocateCPUSets(numaNodeCPUs, 3, 3)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Only 2 sets of 3 CPUs can be allocated without spanning NUMA nodes, while 3 sets are needed"), err)
+	})
+}
@@ -0,0 +1,107 @@
+package environment
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ParseCPUList parses a list of CPUs in the format used by Linux
+// (e.g., "0-3,8-11"), returning the indices of the CPUs in the list.
+func ParseCPUList(cpuList string) ([]uint32, error) {
+	var cpus []uint32
+	for _, cpuRange := range strings.Split(strings.TrimSpace(cpuList), ",") {
+		if cpuRange == "" {
+			continue
+		}
+		bounds := strings.SplitN(cpuRange, "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid CPU %#v", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.ParseUint(bounds[1], 10, 32); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid CPU %#v", bounds[1])
+			}
+			if last < first {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid CPU range %#v", cpuRange)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, uint32(cpu))
+		}
+	}
+	return cpus, nil
+}
+
+// GetNUMANodeCPUs returns the CPUs of the system, grouped by the NUMA
+// node to which they belong. On systems that don't expose their NUMA
+// topology through sysfs, all CPUs are assumed to belong to a single
+// node.
+func GetNUMANodeCPUs() ([][]uint32, error) {
+	cpuListPaths, err := filepath.Glob("/sys/devices/system/node/node*/cpulist")
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to list NUMA nodes")
+	}
+	if len(cpuListPaths) == 0 {
+		cpus := make([]uint32, 0, runtime.NumCPU())
+		for cpu := 0; cpu < runtime.NumCPU(); cpu++ {
+			cpus = append(cpus, uint32(cpu))
+		}
+		return [][]uint32{cpus}, nil
+	}
+
+	sort.Strings(cpuListPaths)
+	var nodes [][]uint32
+	for _, cpuListPath := range cpuListPaths {
+		cpuList, err := ioutil.ReadFile(cpuListPath)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to read CPU list %#v", cpuListPath)
+		}
+		cpus, err := ParseCPUList(string(cpuList))
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to parse CPU list %#v", cpuListPath)
+		}
+		if len(cpus) > 0 {
+			nodes = append(nodes, cpus)
+		}
+	}
+	return nodes, nil
+}
+
+// AllocateCPUSets partitions the CPUs of a system into a given number
+// of disjoint sets of a given size. None of the sets span multiple
+// NUMA nodes, so that build actions pinned to them don't incur the
+// cost of accessing memory of remote nodes. Sets are allocated from
+// all nodes in turn, so that build actions are spread evenly across
+// nodes when fewer sets are used than allocated.
+func AllocateCPUSets(numaNodeCPUs [][]uint32, count int, cpusPerSet int) ([][]uint32, error) {
+	if cpusPerSet <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Number of CPUs per set must be positive")
+	}
+	remaining := append([][]uint32{}, numaNodeCPUs...)
+	cpuSets := make([][]uint32, 0, count)
+	for len(cpuSets) < count {
+		progress := false
+		for i, cpus := range remaining {
+			if len(cpuSets) < count && len(cpus) >= cpusPerSet {
+				cpuSets = append(cpuSets, cpus[:cpusPerSet:cpusPerSet])
+				remaining[i] = cpus[cpusPerSet:]
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, status.Errorf(codes.InvalidArgument, "Only %d sets of %d CPUs can be allocated without spanning NUMA nodes, while %d sets are needed", len(cpuSets), cpusPerSet, count)
+		}
+	}
+	return cpuSets, nil
+}
@@ -1,8 +1,11 @@
 package environment
 
 import (
+	"context"
+
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 )
 
 // Environment represents a context in which build commands may be
@@ -20,3 +23,16 @@ type Environment interface {
 	// where output files created by the build action are stored.
 	GetBuildDirectory() filesystem.Directory
 }
+
+// InputRootPopulator may be implemented by Environments that are
+// capable of populating their build directory with the input root of a
+// build action by themselves. A BuildExecutor should call into this
+// interface instead of creating the input root from scratch if
+// provided.
+type InputRootPopulator interface {
+	// PopulateInputRoot ensures that the build directory contains
+	// exactly the files, directories and symbolic links of the
+	// provided input root. It returns the total size of the files
+	// that had to be obtained from the Content Addressable Storage.
+	PopulateInputRoot(ctx context.Context, inputRootDigest *util.Digest) (int64, error)
+}
@@ -0,0 +1,106 @@
+package environment
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// EnvironmentVariableRule describes how the environment variables
+// provided by a Command should be adjusted prior to execution.
+type EnvironmentVariableRule struct {
+	// Platform properties that a build action needs to have for the
+	// rule to apply. If empty, the rule applies to all build actions.
+	PlatformProperties map[string]string
+	// Names of environment variables to remove.
+	Remove []string
+	// Environment variables to set, only if not provided already.
+	SetDefault map[string]string
+	// Environment variables to set, overriding any value provided.
+	Set map[string]string
+}
+
+func (r *EnvironmentVariableRule) matches(platformProperties map[string]string) bool {
+	for name, value := range r.PlatformProperties {
+		if v, ok := platformProperties[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *EnvironmentVariableRule) apply(environmentVariables map[string]string) {
+	for _, name := range r.Remove {
+		delete(environmentVariables, name)
+	}
+	for name, value := range r.SetDefault {
+		if _, ok := environmentVariables[name]; !ok {
+			environmentVariables[name] = value
+		}
+	}
+	for name, value := range r.Set {
+		environmentVariables[name] = value
+	}
+}
+
+type environmentVariablePolicyManager struct {
+	base  Manager
+	rules []EnvironmentVariableRule
+}
+
+// NewEnvironmentVariablePolicyManager is an adapter for Manager that
+// adjusts the environment variables of build actions before they are
+// run, instead of using the ones provided by the Command as is. This
+// can be used to force the value of PATH, to strip variables
+// containing proxy settings or to point tools to caches that are
+// local to the worker.
+//
+// Rules are applied in the order in which they are provided, meaning
+// later rules take precedence over earlier ones.
+func NewEnvironmentVariablePolicyManager(base Manager, rules []EnvironmentVariableRule) Manager {
+	return &environmentVariablePolicyManager{
+		base:  base,
+		rules: rules,
+	}
+}
+
+func (em *environmentVariablePolicyManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*EnvironmentVariableRule
+	for i := range em.rules {
+		if rule := &em.rules[i]; rule.matches(platformProperties) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return environment, nil
+	}
+	return &environmentVariablePolicyEnvironment{
+		ManagedEnvironment: environment,
+		rules:              rules,
+	}, nil
+}
+
+type environmentVariablePolicyEnvironment struct {
+	ManagedEnvironment
+	rules []*EnvironmentVariableRule
+}
+
+func (e *environmentVariablePolicyEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	environmentVariables := map[string]string{}
+	for name, value := range request.EnvironmentVariables {
+		environmentVariables[name] = value
+	}
+	for _, rule := range e.rules {
+		rule.apply(environmentVariables)
+	}
+
+	newRequest := *request
+	newRequest.EnvironmentVariables = environmentVariables
+	return e.ManagedEnvironment.Run(ctx, &newRequest)
+}
@@ -0,0 +1,66 @@
+package environment_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironmentVariablePolicyManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseManager := mock.NewMockManager(ctrl)
+	manager := environment.NewEnvironmentVariablePolicyManager(baseManager, []environment.EnvironmentVariableRule{
+		{
+			Remove: []string{"http_proxy", "https_proxy"},
+			Set:    map[string]string{"PATH": "/bin:/usr/bin"},
+		},
+		{
+			PlatformProperties: map[string]string{"compiler": "ccache"},
+			SetDefault:         map[string]string{"CCACHE_DIR": "/worker/ccache", "CCACHE_SLOPPINESS": "time_macros"},
+		},
+	})
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+
+	// Only rules matching the platform properties of the build
+	// action should be applied.
+	baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+	baseManager.EXPECT().Acquire(actionDigest, map[string]string{"compiler": "ccache"}).Return(baseEnvironment, nil)
+	environment, err := manager.Acquire(actionDigest, map[string]string{"compiler": "ccache"})
+	require.NoError(t, err)
+
+	baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+		Arguments: []string{"cc", "-c", "hello.c"},
+		EnvironmentVariables: map[string]string{
+			"PATH":              "/bin:/usr/bin",
+			"CCACHE_DIR":        "/worker/ccache",
+			"CCACHE_SLOPPINESS": "file_macro",
+		},
+	}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+	response, err := environment.Run(ctx, &runner.RunRequest{
+		Arguments: []string{"cc", "-c", "hello.c"},
+		EnvironmentVariables: map[string]string{
+			"PATH":              "/usr/local/bin:/bin:/usr/bin",
+			"CCACHE_SLOPPINESS": "file_macro",
+			"https_proxy":       "http://proxy.example.com:3128",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+
+	baseEnvironment.EXPECT().Release()
+	environment.Release()
+}
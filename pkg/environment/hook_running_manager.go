@@ -0,0 +1,104 @@
+package environment
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/jsonpb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type hookRunningManager struct {
+	base             Manager
+	wrapperArguments []string
+	preRunHook       []string
+	postRunHook      []string
+}
+
+// NewHookRunningManager is an adapter for Manager that allows sites to
+// customize the execution of build actions without making changes to
+// Buildbarn itself. Wrapper arguments are prepended to the command
+// line of every build action (e.g., to run it through strace or
+// ccache). A pre-run hook is invoked before every build action (e.g.,
+// to mount secrets), while a post-run hook is invoked after every build
+// action that could be started (e.g., to collect logs).
+//
+// Hooks receive a JSON encoded runner.HookInput message on stdin. As
+// hooks are executed by the current process, this adapter should only
+// be used by bbb_runner. Empty argument lists disable the respective
+// customization.
+func NewHookRunningManager(base Manager, wrapperArguments []string, preRunHook []string, postRunHook []string) Manager {
+	return &hookRunningManager{
+		base:             base,
+		wrapperArguments: wrapperArguments,
+		preRunHook:       preRunHook,
+		postRunHook:      postRunHook,
+	}
+}
+
+func (em *hookRunningManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	return &hookRunningEnvironment{
+		ManagedEnvironment: environment,
+		manager:            em,
+	}, nil
+}
+
+type hookRunningEnvironment struct {
+	ManagedEnvironment
+	manager *hookRunningManager
+}
+
+func (e *hookRunningEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	em := e.manager
+	if err := runHook(ctx, em.preRunHook, &runner.HookInput{
+		Request: request,
+	}); err != nil {
+		return nil, util.StatusWrap(err, "Pre-run hook failed")
+	}
+
+	newRequest := *request
+	if len(em.wrapperArguments) > 0 {
+		newRequest.Arguments = append(append([]string(nil), em.wrapperArguments...), request.Arguments...)
+	}
+	response, err := e.ManagedEnvironment.Run(ctx, &newRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runHook(ctx, em.postRunHook, &runner.HookInput{
+		Request:  request,
+		Response: response,
+	}); err != nil {
+		return nil, util.StatusWrap(err, "Post-run hook failed")
+	}
+	return response, nil
+}
+
+// runHook executes a hook command, providing it the specification of
+// the build action on stdin. Output of the hook is included in the
+// error message upon failure.
+func runHook(ctx context.Context, arguments []string, input *runner.HookInput) error {
+	if len(arguments) == 0 {
+		return nil
+	}
+	marshaler := jsonpb.Marshaler{}
+	data, err := marshaler.MarshalToString(input)
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to marshal hook input")
+	}
+	cmd := exec.CommandContext(ctx, arguments[0], arguments[1:]...)
+	cmd.Stdin = strings.NewReader(data)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package environment_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHookRunningManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseManager := mock.NewMockManager(ctrl)
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+
+	t.Run("Success", func(t *testing.T) {
+		// Hooks that succeed should not affect the outcome of
+		// the build action. Wrapper arguments should be
+		// prepended to the command line.
+		manager := environment.NewHookRunningManager(baseManager, []string{"strace", "-f"}, []string{"true"}, []string{"cat"})
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments: []string{"strace", "-f", "cc", "-c", "hello.c"},
+		}).Return(&runner.RunResponse{ExitCode: 1}, nil)
+		response, err := environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 1}, response)
+	})
+
+	t.Run("PreRunHookFailure", func(t *testing.T) {
+		// The build action should not be run if the pre-run
+		// hook fails.
+		manager := environment.NewHookRunningManager(baseManager, nil, []string{"false"}, nil)
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		_, err = environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+		})
+		require.Equal(t, status.Error(codes.FailedPrecondition, "Pre-run hook failed: exit status 1: "), err)
+	})
+}
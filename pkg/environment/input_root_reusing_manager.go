@@ -0,0 +1,373 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+)
+
+// inputRootReusingSlot is a subdirectory of the build directory that
+// is retained across build actions.
+type inputRootReusingSlot struct {
+	subdirectoryName string
+	// Digest of the input root that was last materialized inside
+	// the subdirectory, or nil if its contents are unknown.
+	inputRootDigest *util.Digest
+	// Attributes of the input files at the time they were
+	// materialized, keyed by path.
+	inputFiles map[string]inputFileAttributes
+}
+
+// inputFileAttributes are the attributes of an input file that are
+// compared to determine whether a build action modified or replaced
+// it.
+type inputFileAttributes struct {
+	sizeBytes int64
+	modTime   time.Time
+}
+
+func getInputFileAttributes(fileInfo filesystem.FileInfo) inputFileAttributes {
+	return inputFileAttributes{
+		sizeBytes: fileInfo.Size(),
+		modTime:   fileInfo.ModTime(),
+	}
+}
+
+func (a inputFileAttributes) equals(b inputFileAttributes) bool {
+	return a.sizeBytes == b.sizeBytes && a.modTime.Equal(b.modTime)
+}
+
+type inputRootReusingManager struct {
+	base                      Manager
+	contentAddressableStorage cas.ContentAddressableStorage
+
+	lock      sync.Mutex
+	cleaned   bool
+	idleSlots []*inputRootReusingSlot
+	slotsMade int
+}
+
+// NewInputRootReusingManager is an adapter for Manager that causes
+// build actions to be executed inside numbered subdirectories of the
+// build directory that are not removed after use. Instead, the input
+// root of the previous build action is retained. When the next build
+// action is run inside the same subdirectory, only the differences
+// between both input roots are applied. This speeds up incremental
+// builds, where successive build actions tend to have near-identical
+// inputs.
+//
+// Files created by build actions that are not part of the next input
+// root (e.g., output files) are removed. As build actions may modify
+// or replace their input files, the size and modification time of
+// every input file is recorded when it is created. Input files whose
+// attributes have changed since are recreated.
+//
+// This adapter replaces both CleanBuildDirectoryManager and
+// ActionDigestSubdirectoryManager. The build directory is emptied out
+// upon first acquisition. As the subdirectory in which build actions
+// run is no longer named after the action digest, absolute paths that
+// end up in build output may differ between workers.
+func NewInputRootReusingManager(base Manager, contentAddressableStorage cas.ContentAddressableStorage) Manager {
+	return &inputRootReusingManager{
+		base:                      base,
+		contentAddressableStorage: contentAddressableStorage,
+	}
+}
+
+func (em *inputRootReusingManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	// Allocate underlying environment.
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	buildDirectory := environment.GetBuildDirectory()
+
+	// Claim a subdirectory. Prefer the one that was released most
+	// recently, as its contents are most likely to be similar.
+	em.lock.Lock()
+	if !em.cleaned {
+		if err := buildDirectory.RemoveAllChildren(); err != nil {
+			em.lock.Unlock()
+			environment.Release()
+			return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to clean build directory prior to build")
+		}
+		em.cleaned = true
+	}
+	var slot *inputRootReusingSlot
+	if n := len(em.idleSlots); n > 0 {
+		slot = em.idleSlots[n-1]
+		em.idleSlots = em.idleSlots[:n-1]
+	} else {
+		slot = &inputRootReusingSlot{
+			subdirectoryName: strconv.FormatInt(int64(em.slotsMade), 10),
+		}
+		em.slotsMade++
+	}
+	em.lock.Unlock()
+
+	if slot.inputRootDigest == nil {
+		// Contents of the subdirectory are unknown, or it has
+		// not been created yet.
+		if err := buildDirectory.RemoveAll(slot.subdirectoryName); err != nil {
+			em.releaseSlot(slot)
+			environment.Release()
+			return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to remove build subdirectory %#v", slot.subdirectoryName)
+		}
+		if err := buildDirectory.Mkdir(slot.subdirectoryName, 0777); err != nil {
+			em.releaseSlot(slot)
+			environment.Release()
+			return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to create build subdirectory %#v", slot.subdirectoryName)
+		}
+	}
+	subdirectory, err := buildDirectory.Enter(slot.subdirectoryName)
+	if err != nil {
+		slot.inputRootDigest = nil
+		em.releaseSlot(slot)
+		environment.Release()
+		return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to enter build subdirectory %#v", slot.subdirectoryName)
+	}
+
+	return &inputRootReusingEnvironment{
+		base:         environment,
+		manager:      em,
+		slot:         slot,
+		subdirectory: subdirectory,
+	}, nil
+}
+
+func (em *inputRootReusingManager) releaseSlot(slot *inputRootReusingSlot) {
+	em.lock.Lock()
+	em.idleSlots = append(em.idleSlots, slot)
+	em.lock.Unlock()
+}
+
+type inputRootReusingEnvironment struct {
+	base         ManagedEnvironment
+	manager      *inputRootReusingManager
+	slot         *inputRootReusingSlot
+	subdirectory filesystem.Directory
+}
+
+func (e *inputRootReusingEnvironment) GetBuildDirectory() filesystem.Directory {
+	return e.subdirectory
+}
+
+func (e *inputRootReusingEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	// Prepend subdirectory name to working directory and log files of build action.
+	newRequest := *request
+	newRequest.WorkingDirectory = path.Join(e.slot.subdirectoryName, newRequest.WorkingDirectory)
+	newRequest.StdoutPath = path.Join(e.slot.subdirectoryName, newRequest.StdoutPath)
+	newRequest.StderrPath = path.Join(e.slot.subdirectoryName, newRequest.StderrPath)
+	newRequest.SecretFiles = prefixSecretFiles(newRequest.SecretFiles, e.slot.subdirectoryName)
+	return e.base.Run(ctx, &newRequest)
+}
+
+func (e *inputRootReusingEnvironment) Release() {
+	if err := e.subdirectory.Close(); err != nil {
+		logrus.WithField("build_subdirectory", e.slot.subdirectoryName).WithError(err).Warn("Failed to close build subdirectory")
+	}
+	e.manager.releaseSlot(e.slot)
+	e.base.Release()
+}
+
+func (e *inputRootReusingEnvironment) PopulateInputRoot(ctx context.Context, inputRootDigest *util.Digest) (int64, error) {
+	// Forget about the current contents of the subdirectory, so that
+	// it is emptied out by the next build action in case we fail.
+	oldInputRootDigest := e.slot.inputRootDigest
+	oldInputFiles := e.slot.inputFiles
+	e.slot.inputRootDigest = nil
+	e.slot.inputFiles = nil
+	newInputFiles := map[string]inputFileAttributes{}
+	sizeBytes, err := e.populateDirectory(ctx, e.subdirectory, oldInputRootDigest, inputRootDigest, oldInputFiles, newInputFiles, []string{"."})
+	if err != nil {
+		return sizeBytes, err
+	}
+	e.slot.inputRootDigest = inputRootDigest
+	e.slot.inputFiles = newInputFiles
+	return sizeBytes, nil
+}
+
+// populateDirectory converts the contents of a directory that
+// corresponds to an old Directory object to match a new one. Entries
+// that are present in both, having the same contents, are left intact.
+// The attributes of all input files are stored in newInputFiles.
+func (e *inputRootReusingEnvironment) populateDirectory(ctx context.Context, directory filesystem.Directory, oldDigest *util.Digest, newDigest *util.Digest, oldInputFiles map[string]inputFileAttributes, newInputFiles map[string]inputFileAttributes, components []string) (int64, error) {
+	newDirectory, err := e.manager.contentAddressableStorage.GetDirectory(ctx, newDigest)
+	if err != nil {
+		return 0, util.StatusWrapf(err, "Failed to obtain input directory %#v", path.Join(components...))
+	}
+
+	// Determine which entries in the directory may be kept. If the
+	// old Directory object is no longer available, simply start
+	// with an empty directory.
+	keep := map[string]bool{}
+	var oldDirectories map[string]*remoteexecution.DirectoryNode
+	if oldDigest != nil {
+		oldDirectory := newDirectory
+		if oldDigest.GetKey(util.DigestKeyWithInstance) != newDigest.GetKey(util.DigestKeyWithInstance) {
+			oldDirectory, err = e.manager.contentAddressableStorage.GetDirectory(ctx, oldDigest)
+		}
+		if err == nil {
+			oldDirectories, err = e.removeStaleEntries(directory, oldDirectory, newDirectory, oldInputFiles, newInputFiles, keep, components)
+			if err != nil {
+				return 0, err
+			}
+		} else if err := directory.RemoveAllChildren(); err != nil {
+			return 0, util.StatusWrapfWithCode(err, codes.Internal, "Failed to empty out input directory %#v", path.Join(components...))
+		}
+	}
+
+	// Create children that are missing.
+	var sizeBytes int64
+	for _, file := range newDirectory.Files {
+		if keep[file.Name] {
+			continue
+		}
+		childComponents := append(components, file.Name)
+		childDigest, err := newDigest.NewDerivedDigest(file.Digest)
+		if err != nil {
+			return sizeBytes, util.StatusWrapf(err, "Failed to extract digest for input file %#v", path.Join(childComponents...))
+		}
+		if err := e.manager.contentAddressableStorage.GetFile(ctx, childDigest, directory, file.Name, file.IsExecutable); err != nil {
+			return sizeBytes, util.StatusWrapf(err, "Failed to obtain input file %#v", path.Join(childComponents...))
+		}
+		fileInfo, err := directory.Lstat(file.Name)
+		if err != nil {
+			return sizeBytes, util.StatusWrapfWithCode(err, codes.Internal, "Failed to obtain attributes of input file %#v", path.Join(childComponents...))
+		}
+		newInputFiles[path.Join(childComponents...)] = getInputFileAttributes(fileInfo)
+		sizeBytes += childDigest.GetSizeBytes()
+	}
+	for _, newChild := range newDirectory.Directories {
+		childComponents := append(components, newChild.Name)
+		childDigest, err := newDigest.NewDerivedDigest(newChild.Digest)
+		if err != nil {
+			return sizeBytes, util.StatusWrapf(err, "Failed to extract digest for input directory %#v", path.Join(childComponents...))
+		}
+		var oldChildDigest *util.Digest
+		if keep[newChild.Name] {
+			oldChildDigest, err = oldDigest.NewDerivedDigest(oldDirectories[newChild.Name].Digest)
+			if err != nil {
+				return sizeBytes, util.StatusWrapf(err, "Failed to extract digest for input directory %#v", path.Join(childComponents...))
+			}
+		} else if err := directory.Mkdir(newChild.Name, 0777); err != nil {
+			return sizeBytes, util.StatusWrapf(err, "Failed to create input directory %#v", path.Join(childComponents...))
+		}
+		childDirectory, err := directory.Enter(newChild.Name)
+		if err != nil {
+			return sizeBytes, util.StatusWrapf(err, "Failed to enter input directory %#v", path.Join(childComponents...))
+		}
+		childSizeBytes, err := e.populateDirectory(ctx, childDirectory, oldChildDigest, childDigest, oldInputFiles, newInputFiles, childComponents)
+		childDirectory.Close()
+		sizeBytes += childSizeBytes
+		if err != nil {
+			return sizeBytes, err
+		}
+	}
+	for _, symlink := range newDirectory.Symlinks {
+		if keep[symlink.Name] {
+			continue
+		}
+		childComponents := append(components, symlink.Name)
+		if err := directory.Symlink(symlink.Target, symlink.Name); err != nil {
+			return sizeBytes, util.StatusWrapf(err, "Failed to create input symlink %#v", path.Join(childComponents...))
+		}
+	}
+	return sizeBytes, nil
+}
+
+// removeStaleEntries removes all entries from a directory that are
+// either not part of the new Directory object, or have contents that
+// differ from those in the old Directory object. Files whose attributes
+// differ from the ones recorded when they were created, and symbolic
+// links whose targets have changed, are removed as well, as they have
+// been modified or replaced by the previous build action. The names of
+// entries that remain are stored in keep.
+func (e *inputRootReusingEnvironment) removeStaleEntries(directory filesystem.Directory, oldDirectory *remoteexecution.Directory, newDirectory *remoteexecution.Directory, oldInputFiles map[string]inputFileAttributes, newInputFiles map[string]inputFileAttributes, keep map[string]bool, components []string) (map[string]*remoteexecution.DirectoryNode, error) {
+	oldFiles := map[string]*remoteexecution.FileNode{}
+	for _, file := range oldDirectory.Files {
+		oldFiles[file.Name] = file
+	}
+	oldDirectories := map[string]*remoteexecution.DirectoryNode{}
+	for _, directory := range oldDirectory.Directories {
+		oldDirectories[directory.Name] = directory
+	}
+	oldSymlinks := map[string]*remoteexecution.SymlinkNode{}
+	for _, symlink := range oldDirectory.Symlinks {
+		oldSymlinks[symlink.Name] = symlink
+	}
+
+	for _, file := range newDirectory.Files {
+		if oldFile, ok := oldFiles[file.Name]; ok && proto.Equal(oldFile, file) {
+			keep[file.Name] = true
+		}
+	}
+	for _, directory := range newDirectory.Directories {
+		if _, ok := oldDirectories[directory.Name]; ok {
+			keep[directory.Name] = true
+		}
+	}
+	for _, symlink := range newDirectory.Symlinks {
+		if oldSymlink, ok := oldSymlinks[symlink.Name]; ok && oldSymlink.Target == symlink.Target {
+			keep[symlink.Name] = true
+		}
+	}
+
+	files, err := directory.ReadDir()
+	if err != nil {
+		return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to read input directory %#v", path.Join(components...))
+	}
+	present := map[string]bool{}
+	for _, file := range files {
+		name := file.Name()
+		childPath := path.Join(append(components, name)...)
+		mode := file.Mode() & os.ModeType
+		unmodified := false
+		if keep[name] {
+			switch mode {
+			case 0:
+				if attributes, ok := oldInputFiles[childPath]; ok && oldFiles[name] != nil && attributes.equals(getInputFileAttributes(file)) {
+					newInputFiles[childPath] = attributes
+					unmodified = true
+				}
+			case os.ModeDir:
+				unmodified = oldDirectories[name] != nil
+			case os.ModeSymlink:
+				if oldSymlinks[name] != nil {
+					target, err := directory.Readlink(name)
+					if err != nil {
+						return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to read input symlink %#v", childPath)
+					}
+					unmodified = target == oldSymlinks[name].Target
+				}
+			}
+		}
+		if unmodified {
+			present[name] = true
+		} else if err := directory.RemoveAll(name); err != nil {
+			return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to remove %#v", childPath)
+		}
+	}
+
+	// Entries that were removed by the previous build action need
+	// to be recreated.
+	for name := range keep {
+		if !present[name] {
+			delete(keep, name)
+		}
+	}
+	return oldDirectories, nil
+}
@@ -0,0 +1,246 @@
+package environment_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInputRootReusingManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseManager := mock.NewMockManager(ctrl)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	manager := environment.NewInputRootReusingManager(baseManager, contentAddressableStorage)
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+	baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+	rootDirectory := mock.NewMockDirectory(ctrl)
+	baseEnvironment.EXPECT().GetBuildDirectory().Return(rootDirectory).AnyTimes()
+	subdirectory := mock.NewMockDirectory(ctrl)
+	includeDirectory := mock.NewMockDirectory(ctrl)
+
+	includeDigest := &remoteexecution.Digest{
+		Hash:      "0c6ad5bfbe4d7eaf4e4d2d2b8b04a5cbab1bc2d5d5eb3f5fd5fcc1b2f0d8a0c1",
+		SizeBytes: 81,
+	}
+	includeDirectoryContents := &remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "hello.h",
+				Digest: &remoteexecution.Digest{
+					Hash:      "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4",
+					SizeBytes: 20,
+				},
+			},
+		},
+	}
+
+	// The first build action should be run in a freshly created
+	// subdirectory. The input root should be created from scratch.
+	baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+	rootDirectory.EXPECT().RemoveAllChildren()
+	rootDirectory.EXPECT().RemoveAll("0")
+	rootDirectory.EXPECT().Mkdir("0", os.FileMode(0777))
+	rootDirectory.EXPECT().Enter("0").Return(subdirectory, nil)
+	environment1, err := manager.Acquire(actionDigest, map[string]string{})
+	require.NoError(t, err)
+	require.Equal(t, subdirectory, environment1.GetBuildDirectory())
+
+	inputRootDigest1 := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "2b5e0c1a1e0e1c6fbc7d7b0cb1a8b5c58b4d1e8f9e8d1bd6c3e2d8b0c5d2a1e0",
+			SizeBytes: 160,
+		})
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, inputRootDigest1).Return(&remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "hello.c",
+				Digest: &remoteexecution.Digest{
+					Hash:      "ed8f5e7ba9fb5d3f43b6b4aef3b2c2bdc2b7a0b5c3a7e8bf8d2d6f9c5b8d5b4a",
+					SizeBytes: 100,
+				},
+			},
+		},
+		Directories: []*remoteexecution.DirectoryNode{
+			{Name: "include", Digest: includeDigest},
+		},
+	}, nil).Times(2)
+	contentAddressableStorage.EXPECT().GetFile(
+		ctx,
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "ed8f5e7ba9fb5d3f43b6b4aef3b2c2bdc2b7a0b5c3a7e8bf8d2d6f9c5b8d5b4a",
+			SizeBytes: 100,
+		}),
+		subdirectory,
+		"hello.c",
+		false)
+	subdirectory.EXPECT().Lstat("hello.c").Return(filesystem.NewFileInfo("hello.c", 0, 100, time.Unix(1000, 0)), nil)
+	subdirectory.EXPECT().Mkdir("include", os.FileMode(0777))
+	subdirectory.EXPECT().Enter("include").Return(includeDirectory, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, util.MustNewDigest("debian8", includeDigest)).Return(includeDirectoryContents, nil)
+	contentAddressableStorage.EXPECT().GetFile(
+		ctx,
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4",
+			SizeBytes: 20,
+		}),
+		includeDirectory,
+		"hello.h",
+		false)
+	includeDirectory.EXPECT().Lstat("hello.h").Return(filesystem.NewFileInfo("hello.h", 0, 20, time.Unix(1000, 0)), nil)
+	includeDirectory.EXPECT().Close()
+	sizeBytes, err := environment1.(environment.InputRootPopulator).PopulateInputRoot(ctx, inputRootDigest1)
+	require.NoError(t, err)
+	require.Equal(t, int64(120), sizeBytes)
+
+	// Build actions should be run inside the subdirectory.
+	baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+		Arguments:        []string{"cc", "-c", "hello.c"},
+		WorkingDirectory: "0",
+		StdoutPath:       "0/.stdout.txt",
+		StderrPath:       "0/.stderr.txt",
+	}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+	response, err := environment1.Run(ctx, &runner.RunRequest{
+		Arguments:  []string{"cc", "-c", "hello.c"},
+		StdoutPath: ".stdout.txt",
+		StderrPath: ".stderr.txt",
+	})
+	require.NoError(t, err)
+	require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+
+	// Releasing the environment should leave the subdirectory intact.
+	subdirectory.EXPECT().Close()
+	baseEnvironment.EXPECT().Release()
+	environment1.Release()
+
+	// The second build action should reuse the subdirectory. Only
+	// the source file that changed should be replaced. Output
+	// files of the previous build action should be removed.
+	baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+	rootDirectory.EXPECT().Enter("0").Return(subdirectory, nil)
+	environment2, err := manager.Acquire(actionDigest, map[string]string{})
+	require.NoError(t, err)
+
+	inputRootDigest2 := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "9a1d2e6c3b7f4a8e5d0c1b2a3f4e5d6c7b8a9f0e1d2c3b4a5f6e7d8c9b0a1f2e",
+			SizeBytes: 160,
+		})
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, inputRootDigest2).Return(&remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "hello.c",
+				Digest: &remoteexecution.Digest{
+					Hash:      "5d41402abc4b2a76b9719d911017c5925d41402abc4b2a76b9719d911017c592",
+					SizeBytes: 105,
+				},
+			},
+		},
+		Directories: []*remoteexecution.DirectoryNode{
+			{Name: "include", Digest: includeDigest},
+		},
+	}, nil)
+	subdirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo(".stderr.txt", 0),
+		filesystem.NewSimpleFileInfo(".stdout.txt", 0),
+		filesystem.NewFileInfo("hello.c", 0, 100, time.Unix(1000, 0)),
+		filesystem.NewSimpleFileInfo("hello.o", 0),
+		filesystem.NewSimpleFileInfo("include", os.ModeDir),
+	}, nil)
+	subdirectory.EXPECT().RemoveAll(".stderr.txt")
+	subdirectory.EXPECT().RemoveAll(".stdout.txt")
+	subdirectory.EXPECT().RemoveAll("hello.c")
+	subdirectory.EXPECT().RemoveAll("hello.o")
+	contentAddressableStorage.EXPECT().GetFile(
+		ctx,
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "5d41402abc4b2a76b9719d911017c5925d41402abc4b2a76b9719d911017c592",
+			SizeBytes: 105,
+		}),
+		subdirectory,
+		"hello.c",
+		false)
+	subdirectory.EXPECT().Lstat("hello.c").Return(filesystem.NewFileInfo("hello.c", 0, 105, time.Unix(2000, 0)), nil)
+	subdirectory.EXPECT().Enter("include").Return(includeDirectory, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, util.MustNewDigest("debian8", includeDigest)).Return(includeDirectoryContents, nil)
+	includeDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewFileInfo("hello.h", 0, 20, time.Unix(1000, 0)),
+	}, nil)
+	includeDirectory.EXPECT().Close()
+	sizeBytes, err = environment2.(environment.InputRootPopulator).PopulateInputRoot(ctx, inputRootDigest2)
+	require.NoError(t, err)
+	require.Equal(t, int64(105), sizeBytes)
+
+	subdirectory.EXPECT().Close()
+	baseEnvironment.EXPECT().Release()
+	environment2.Release()
+
+	// The third build action uses the same input root. As the
+	// previous build action replaced one of its input files, that
+	// file should be recreated. Other files should be left intact.
+	baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+	rootDirectory.EXPECT().Enter("0").Return(subdirectory, nil)
+	environment3, err := manager.Acquire(actionDigest, map[string]string{})
+	require.NoError(t, err)
+
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, inputRootDigest2).Return(&remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "hello.c",
+				Digest: &remoteexecution.Digest{
+					Hash:      "5d41402abc4b2a76b9719d911017c5925d41402abc4b2a76b9719d911017c592",
+					SizeBytes: 105,
+				},
+			},
+		},
+		Directories: []*remoteexecution.DirectoryNode{
+			{Name: "include", Digest: includeDigest},
+		},
+	}, nil)
+	subdirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewFileInfo("hello.c", 0, 105, time.Unix(2000, 0)),
+		filesystem.NewSimpleFileInfo("include", os.ModeDir),
+	}, nil)
+	subdirectory.EXPECT().Enter("include").Return(includeDirectory, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, util.MustNewDigest("debian8", includeDigest)).Return(includeDirectoryContents, nil)
+	includeDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewFileInfo("hello.h", 0, 20, time.Unix(3000, 0)),
+	}, nil)
+	includeDirectory.EXPECT().RemoveAll("hello.h")
+	contentAddressableStorage.EXPECT().GetFile(
+		ctx,
+		util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4",
+			SizeBytes: 20,
+		}),
+		includeDirectory,
+		"hello.h",
+		false)
+	includeDirectory.EXPECT().Lstat("hello.h").Return(filesystem.NewFileInfo("hello.h", 0, 20, time.Unix(4000, 0)), nil)
+	includeDirectory.EXPECT().Close()
+	sizeBytes, err = environment3.(environment.InputRootPopulator).PopulateInputRoot(ctx, inputRootDigest2)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), sizeBytes)
+
+	subdirectory.EXPECT().Close()
+	baseEnvironment.EXPECT().Release()
+	environment3.Release()
+}
@@ -8,10 +8,13 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -66,6 +69,12 @@ func (e *localExecutionEnvironment) Run(ctx context.Context, request *runner.Run
 	if len(request.Arguments) < 1 {
 		return nil, status.Error(codes.InvalidArgument, "Insufficient number of command arguments")
 	}
+	if len(request.SecretEnvironmentVariables) > 0 || len(request.SecretFiles) > 0 {
+		return nil, status.Error(codes.FailedPrecondition, "Build action requests secrets, but the runner is not configured with a secret provider")
+	}
+	if request.Container != nil {
+		return nil, status.Error(codes.FailedPrecondition, "Build action requests to be run in a container, but the runner is not capable of running containers")
+	}
 	cmd := exec.CommandContext(ctx, request.Arguments[0], request.Arguments[1:]...)
 	// TODO(edsch): Convert workingDirectory to use platform
 	// specific path delimiter.
@@ -73,6 +82,11 @@ func (e *localExecutionEnvironment) Run(ctx context.Context, request *runner.Run
 	for name, value := range request.EnvironmentVariables {
 		cmd.Env = append(cmd.Env, name+"="+value)
 	}
+	if request.NetworkIsolated {
+		if err := isolateNetwork(cmd); err != nil {
+			return nil, err
+		}
+	}
 
 	// Open output files for logging.
 	stdout, err := e.openLog(request.StdoutPath)
@@ -90,7 +104,11 @@ func (e *localExecutionEnvironment) Run(ctx context.Context, request *runner.Run
 
 	// Start the subprocess. We can already close the output files
 	// while the process is running.
-	err = cmd.Start()
+	if len(request.Cpus) > 0 {
+		err = startWithCPUAffinity(cmd, request.Cpus)
+	} else {
+		err = cmd.Start()
+	}
 	stdout.Close()
 	stderr.Close()
 	if err != nil {
@@ -102,10 +120,34 @@ func (e *localExecutionEnvironment) Run(ctx context.Context, request *runner.Run
 	if exitError, ok := err.(*exec.ExitError); ok {
 		waitStatus := exitError.Sys().(syscall.WaitStatus)
 		return &runner.RunResponse{
-			ExitCode: int32(waitStatus.ExitStatus()),
+			ExitCode:      int32(waitStatus.ExitStatus()),
+			ResourceUsage: getPOSIXResourceUsage(cmd.ProcessState),
 		}, nil
+	} else if err != nil {
+		return nil, err
 	}
 	return &runner.RunResponse{
-		ExitCode: 0,
-	}, err
+		ExitCode:      0,
+		ResourceUsage: getPOSIXResourceUsage(cmd.ProcessState),
+	}, nil
+}
+
+// getPOSIXResourceUsage converts the resource usage of a process that
+// has terminated to a Protobuf message.
+func getPOSIXResourceUsage(processState *os.ProcessState) *resourceusage.POSIXResourceUsage {
+	rusage, ok := processState.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+	return &resourceusage.POSIXResourceUsage{
+		UserTime:                   ptypes.DurationProto(time.Duration(rusage.Utime.Nano())),
+		SystemTime:                 ptypes.DurationProto(time.Duration(rusage.Stime.Nano())),
+		MaximumResidentSetSize:     int64(rusage.Maxrss) * maximumResidentSetSizeUnit,
+		PageReclaims:               int64(rusage.Minflt),
+		PageFaults:                 int64(rusage.Majflt),
+		BlockInputOperations:       int64(rusage.Inblock),
+		BlockOutputOperations:      int64(rusage.Oublock),
+		VoluntaryContextSwitches:   int64(rusage.Nvcsw),
+		InvoluntaryContextSwitches: int64(rusage.Nivcsw),
+	}
 }
@@ -0,0 +1,49 @@
+package environment
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"golang.org/x/sys/unix"
+
+	"google.golang.org/grpc/codes"
+)
+
+// maximumResidentSetSizeUnit is the unit in which Linux reports the
+// maximum resident set size of processes (kilobytes).
+const maximumResidentSetSizeUnit = 1024
+
+// isolateNetwork causes a command to be run in a network namespace of
+// its own, which only contains a loopback interface that is down. This
+// requires the runner to have CAP_SYS_ADMIN.
+func isolateNetwork(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	return nil
+}
+
+// startWithCPUAffinity starts a command that may only run on a given
+// set of CPUs. Processes inherit the CPU affinity of the thread that
+// creates them. The command is therefore started from a thread whose
+// CPU affinity is adjusted first. This thread is never unlocked, which
+// causes it to be discarded once the goroutine terminates.
+func startWithCPUAffinity(cmd *exec.Cmd, cpus []uint32) error {
+	errs := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		var cpuSet unix.CPUSet
+		for _, cpu := range cpus {
+			cpuSet.Set(int(cpu))
+		}
+		if err := unix.SchedSetaffinity(0, &cpuSet); err != nil {
+			errs <- util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to set CPU affinity")
+			return
+		}
+		errs <- cmd.Start()
+	}()
+	return <-errs
+}
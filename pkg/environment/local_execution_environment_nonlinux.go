@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package environment
+
+import (
+	"os/exec"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maximumResidentSetSizeUnit is the unit in which the maximum resident
+// set size of processes is reported. macOS reports it in bytes.
+const maximumResidentSetSizeUnit = 1
+
+// isolateNetwork returns an error, as running commands without network
+// access is only supported on Linux.
+func isolateNetwork(cmd *exec.Cmd) error {
+	return status.Error(codes.Unimplemented, "Network isolation is not supported on this platform")
+}
+
+// startWithCPUAffinity returns an error, as pinning commands to CPUs
+// is only supported on Linux.
+func startWithCPUAffinity(cmd *exec.Cmd, cpus []uint32) error {
+	return status.Error(codes.Unimplemented, "CPU pinning is not supported on this platform")
+}
@@ -1,6 +1,8 @@
 package environment
 
 import (
+	"context"
+
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 )
 
@@ -22,3 +24,30 @@ type ManagedEnvironment interface {
 	// causing any input/output files to be discarded.
 	Release()
 }
+
+// inputRootPopulatingEnvironment is a ManagedEnvironment that forwards
+// calls to PopulateInputRoot() to the environment wrapped by an
+// adapter. Adapters that embed ManagedEnvironment would otherwise hide
+// this method, causing the BuildExecutor to create the input root from
+// scratch.
+type inputRootPopulatingEnvironment struct {
+	ManagedEnvironment
+	populator InputRootPopulator
+}
+
+func (e *inputRootPopulatingEnvironment) PopulateInputRoot(ctx context.Context, inputRootDigest *util.Digest) (int64, error) {
+	return e.populator.PopulateInputRoot(ctx, inputRootDigest)
+}
+
+// preserveInputRootPopulator returns an adapter's environment in such
+// a way that it still implements InputRootPopulator if the
+// environment it wraps does.
+func preserveInputRootPopulator(environment ManagedEnvironment, base ManagedEnvironment) ManagedEnvironment {
+	if populator, ok := base.(InputRootPopulator); ok {
+		return &inputRootPopulatingEnvironment{
+			ManagedEnvironment: environment,
+			populator:          populator,
+		}
+	}
+	return environment
+}
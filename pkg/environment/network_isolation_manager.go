@@ -0,0 +1,68 @@
+package environment
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// NoNetworkPlatformProperty is the name of the platform property
+	// that build actions may set to request being run without
+	// network access.
+	NoNetworkPlatformProperty = "no-network"
+	// RequiresNetworkPlatformProperty is the name of the platform
+	// property that build actions may set to request being run with
+	// network access.
+	RequiresNetworkPlatformProperty = "requires-network"
+)
+
+type networkIsolationManager struct {
+	base             Manager
+	isolateByDefault bool
+}
+
+// NewNetworkIsolationManager is an adapter for Manager that determines
+// whether build actions should be run without network access, based on
+// the "no-network" and "requires-network" platform properties. Build
+// actions that have neither of these properties set are isolated only
+// if isolateByDefault is set.
+func NewNetworkIsolationManager(base Manager, isolateByDefault bool) Manager {
+	return &networkIsolationManager{
+		base:             base,
+		isolateByDefault: isolateByDefault,
+	}
+}
+
+func (em *networkIsolationManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	_, noNetwork := platformProperties[NoNetworkPlatformProperty]
+	_, requiresNetwork := platformProperties[RequiresNetworkPlatformProperty]
+	if noNetwork && requiresNetwork {
+		return nil, status.Errorf(codes.InvalidArgument, "Platform properties %#v and %#v are mutually exclusive", NoNetworkPlatformProperty, RequiresNetworkPlatformProperty)
+	}
+
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	if !noNetwork && (requiresNetwork || !em.isolateByDefault) {
+		return environment, nil
+	}
+	return &networkIsolationEnvironment{
+		ManagedEnvironment: environment,
+	}, nil
+}
+
+type networkIsolationEnvironment struct {
+	ManagedEnvironment
+}
+
+func (e *networkIsolationEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	newRequest := *request
+	newRequest.NetworkIsolated = true
+	return e.ManagedEnvironment.Run(ctx, &newRequest)
+}
@@ -0,0 +1,72 @@
+package environment_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNetworkIsolationManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseManager := mock.NewMockManager(ctrl)
+	manager := environment.NewNetworkIsolationManager(baseManager, true)
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+
+	t.Run("MutuallyExclusive", func(t *testing.T) {
+		_, err := manager.Acquire(actionDigest, map[string]string{
+			"no-network":       "",
+			"requires-network": "",
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Platform properties \"no-network\" and \"requires-network\" are mutually exclusive"), err)
+	})
+
+	t.Run("IsolatedByDefault", func(t *testing.T) {
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments:       []string{"ping", "example.com"},
+			NetworkIsolated: true,
+		}).Return(&runner.RunResponse{ExitCode: 2}, nil)
+		response, err := environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"ping", "example.com"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 2}, response)
+	})
+
+	t.Run("RequiresNetwork", func(t *testing.T) {
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{"requires-network": ""}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{"requires-network": ""})
+		require.NoError(t, err)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments: []string{"ping", "example.com"},
+		}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+		response, err := environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"ping", "example.com"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+	})
+}
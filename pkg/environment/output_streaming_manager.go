@@ -0,0 +1,163 @@
+package environment
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/outputstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+)
+
+type outputStreamingManager struct {
+	base         Manager
+	client       bytestream.ByteStreamClient
+	pollInterval time.Duration
+}
+
+// NewOutputStreamingManager is an adapter for Manager that streams the
+// stdout and stderr output of build actions to a ByteStream service
+// while they are running. The output is written into streams with
+// names obtained through outputstream.GetStreamName(), allowing clients
+// to observe the output of long running actions before they complete.
+//
+// The output files are polled at a fixed interval, meaning that this
+// adapter does not depend on support from the runner.
+func NewOutputStreamingManager(base Manager, client bytestream.ByteStreamClient, pollInterval time.Duration) Manager {
+	return &outputStreamingManager{
+		base:         base,
+		client:       client,
+		pollInterval: pollInterval,
+	}
+}
+
+func (em *outputStreamingManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	return preserveInputRootPopulator(&outputStreamingEnvironment{
+		ManagedEnvironment: environment,
+		manager:            em,
+		actionDigest:       actionDigest,
+	}, environment), nil
+}
+
+type outputStreamingEnvironment struct {
+	ManagedEnvironment
+	manager      *outputStreamingManager
+	actionDigest *util.Digest
+}
+
+func (e *outputStreamingEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, output := range []struct {
+		stream string
+		path   string
+	}{
+		{"stdout", request.StdoutPath},
+		{"stderr", request.StderrPath},
+	} {
+		wg.Add(1)
+		go func(stream string, path string) {
+			e.streamOutput(ctx, outputstream.GetStreamName(e.actionDigest, stream), path, done)
+			wg.Done()
+		}(output.stream, output.path)
+	}
+
+	response, err := e.ManagedEnvironment.Run(ctx, request)
+	close(done)
+	wg.Wait()
+	return response, err
+}
+
+// streamOutput repeatedly reads data appended to an output file and
+// writes it into an output stream, until the action completes.
+func (e *outputStreamingEnvironment) streamOutput(ctx context.Context, streamName string, path string, done <-chan struct{}) {
+	// Output files are placed directly in the build directory.
+	if path == "" || strings.ContainsRune(path, '/') {
+		return
+	}
+	logger := logging.FromContext(ctx).WithField(logging.StreamNameField, streamName)
+	client, err := e.manager.client.Write(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to create output stream")
+		return
+	}
+	// Announce the stream immediately, so that clients can start
+	// reading it before any output is generated.
+	if err := client.Send(&bytestream.WriteRequest{ResourceName: streamName}); err != nil {
+		logger.WithError(err).Warn("Failed to create output stream")
+		return
+	}
+
+	var file filesystem.File
+	var writeOffset int64
+	buf := make([]byte, 1<<16)
+	for {
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(e.manager.pollInterval):
+		}
+
+		// Output files are only created once the action starts.
+		if file == nil {
+			file, err = e.GetBuildDirectory().OpenFile(path, os.O_RDONLY, 0)
+			if err != nil && !os.IsNotExist(err) {
+				logger.WithError(err).Warn("Failed to open output file for stream")
+			}
+		}
+		if file != nil {
+			for {
+				n, err := file.ReadAt(buf, writeOffset)
+				if n > 0 {
+					if err := client.Send(&bytestream.WriteRequest{
+						ResourceName: streamName,
+						WriteOffset:  writeOffset,
+						Data:         buf[:n],
+					}); err != nil {
+						logger.WithError(err).Warn("Failed to write to output stream")
+						file.Close()
+						return
+					}
+					writeOffset += int64(n)
+				}
+				if err != nil {
+					if err != io.EOF {
+						logger.WithError(err).Warn("Failed to read output file for stream")
+					}
+					break
+				}
+			}
+		}
+
+		if finished {
+			if file != nil {
+				file.Close()
+			}
+			if err := client.Send(&bytestream.WriteRequest{
+				ResourceName: streamName,
+				WriteOffset:  writeOffset,
+				FinishWrite:  true,
+			}); err != nil {
+				logger.WithError(err).Warn("Failed to finish output stream")
+				return
+			}
+			if _, err := client.CloseAndRecv(); err != nil {
+				logger.WithError(err).Warn("Failed to finish output stream")
+			}
+			return
+		}
+	}
+}
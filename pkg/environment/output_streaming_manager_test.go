@@ -0,0 +1,121 @@
+package environment_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/outputstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+)
+
+func TestOutputStreamingManagerInputRootReusing(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Output streaming placed on top of input root reusing should
+	// both stream output files stored inside the subdirectory and
+	// leave the input root to be populated incrementally.
+	baseManager := mock.NewMockManager(ctrl)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	byteStreamClient := mock.NewMockByteStreamClient(ctrl)
+	manager := environment.NewOutputStreamingManager(
+		environment.NewInputRootReusingManager(baseManager, contentAddressableStorage),
+		byteStreamClient,
+		time.Hour)
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+
+	baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+	rootDirectory := mock.NewMockDirectory(ctrl)
+	baseEnvironment.EXPECT().GetBuildDirectory().Return(rootDirectory).AnyTimes()
+	subdirectory := mock.NewMockDirectory(ctrl)
+	baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+	rootDirectory.EXPECT().RemoveAllChildren()
+	rootDirectory.EXPECT().RemoveAll("0")
+	rootDirectory.EXPECT().Mkdir("0", os.FileMode(0777))
+	rootDirectory.EXPECT().Enter("0").Return(subdirectory, nil)
+	environment1, err := manager.Acquire(actionDigest, map[string]string{})
+	require.NoError(t, err)
+	require.Equal(t, subdirectory, environment1.GetBuildDirectory())
+
+	// The input root should be populated by the reusing adapter.
+	inputRootDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "2b5e0c1a1e0e1c6fbc7d7b0cb1a8b5c58b4d1e8f9e8d1bd6c3e2d8b0c5d2a1e0",
+			SizeBytes: 0,
+		})
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, inputRootDigest).Return(&remoteexecution.Directory{}, nil)
+	populator, ok := environment1.(environment.InputRootPopulator)
+	require.True(t, ok)
+	sizeBytes, err := populator.PopulateInputRoot(ctx, inputRootDigest)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), sizeBytes)
+
+	// Output files should be read from the subdirectory, even
+	// though the runner receives paths that include the name of
+	// the subdirectory.
+	stdoutStreamName := outputstream.GetStreamName(actionDigest, "stdout")
+	stderrStreamName := outputstream.GetStreamName(actionDigest, "stderr")
+	writeClient := mock.NewMockByteStream_WriteClient(ctrl)
+	byteStreamClient.EXPECT().Write(ctx).Return(writeClient, nil).Times(2)
+	writeClient.EXPECT().Send(&bytestream.WriteRequest{ResourceName: stdoutStreamName})
+	writeClient.EXPECT().Send(&bytestream.WriteRequest{ResourceName: stderrStreamName})
+	baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+		Arguments:        []string{"echo", "Hello"},
+		WorkingDirectory: "0",
+		StdoutPath:       "0/.stdout.txt",
+		StderrPath:       "0/.stderr.txt",
+	}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+
+	stdoutFile := mock.NewMockFile(ctrl)
+	subdirectory.EXPECT().OpenFile(".stdout.txt", os.O_RDONLY, os.FileMode(0)).Return(stdoutFile, nil)
+	stdoutFile.EXPECT().ReadAt(gomock.Any(), int64(0)).DoAndReturn(
+		func(p []byte, off int64) (int, error) {
+			return copy(p, "Hello\n"), io.EOF
+		})
+	stdoutFile.EXPECT().Close()
+	writeClient.EXPECT().Send(&bytestream.WriteRequest{
+		ResourceName: stdoutStreamName,
+		Data:         []byte("Hello\n"),
+	})
+	writeClient.EXPECT().Send(&bytestream.WriteRequest{
+		ResourceName: stdoutStreamName,
+		WriteOffset:  6,
+		FinishWrite:  true,
+	})
+	subdirectory.EXPECT().OpenFile(".stderr.txt", os.O_RDONLY, os.FileMode(0)).Return(nil, syscall.ENOENT)
+	writeClient.EXPECT().Send(&bytestream.WriteRequest{
+		ResourceName: stderrStreamName,
+		FinishWrite:  true,
+	})
+	writeClient.EXPECT().CloseAndRecv().Return(&bytestream.WriteResponse{}, nil).Times(2)
+
+	response, err := environment1.Run(ctx, &runner.RunRequest{
+		Arguments:  []string{"echo", "Hello"},
+		StdoutPath: ".stdout.txt",
+		StderrPath: ".stderr.txt",
+	})
+	require.NoError(t, err)
+	require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+
+	subdirectory.EXPECT().Close()
+	baseEnvironment.EXPECT().Release()
+	environment1.Release()
+}
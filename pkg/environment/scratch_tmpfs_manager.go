@@ -0,0 +1,101 @@
+package environment
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+)
+
+// TmpfsMountFunc is the signature of MountTmpfs(). It can be
+// substituted for testing purposes.
+type TmpfsMountFunc func(path string, sizeBytes int64) error
+
+// TmpfsUnmountFunc is the signature of UnmountTmpfs(). It can be
+// substituted for testing purposes.
+type TmpfsUnmountFunc func(path string) error
+
+type scratchTmpfsManager struct {
+	base                 Manager
+	scratchDirectoryPath string
+	sizeBytes            int64
+	mount                TmpfsMountFunc
+	unmount              TmpfsUnmountFunc
+}
+
+// NewScratchTmpfsManager is an adapter for Manager that gives every
+// command a tmpfs of its own with a limited size, which is discarded
+// after the command completes. The TMPDIR and TEST_TMPDIR environment
+// variables of the command are pointed at it. This speeds up build
+// actions that perform lots of I/O on temporary files, while preventing
+// runaway usage of temporary storage from affecting other build
+// actions. This adapter is intended to be used by bbb_runner, which
+// needs to have CAP_SYS_ADMIN to mount file systems. File systems are
+// mounted and unmounted using the provided functions, which should
+// normally be MountTmpfs() and UnmountTmpfs().
+//
+// Commands that are run inside a container are left alone, as the
+// scratch directory is a path on the host that is not visible inside
+// the container.
+func NewScratchTmpfsManager(base Manager, scratchDirectoryPath string, sizeBytes int64, mount TmpfsMountFunc, unmount TmpfsUnmountFunc) Manager {
+	return &scratchTmpfsManager{
+		base:                 base,
+		scratchDirectoryPath: scratchDirectoryPath,
+		sizeBytes:            sizeBytes,
+		mount:                mount,
+		unmount:              unmount,
+	}
+}
+
+func (em *scratchTmpfsManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	return &scratchTmpfsEnvironment{
+		ManagedEnvironment: environment,
+		manager:            em,
+	}, nil
+}
+
+type scratchTmpfsEnvironment struct {
+	ManagedEnvironment
+	manager *scratchTmpfsManager
+}
+
+func (e *scratchTmpfsEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	if request.Container != nil {
+		return e.ManagedEnvironment.Run(ctx, request)
+	}
+
+	em := e.manager
+	tmpfsPath, err := ioutil.TempDir(em.scratchDirectoryPath, "tmp")
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to create scratch directory")
+	}
+	defer os.Remove(tmpfsPath)
+	if err := em.mount(tmpfsPath, em.sizeBytes); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to mount scratch tmpfs")
+	}
+	defer func() {
+		if err := em.unmount(tmpfsPath); err != nil {
+			logrus.WithError(err).WithField("path", tmpfsPath).Warn("Failed to unmount scratch tmpfs")
+		}
+	}()
+
+	environmentVariables := map[string]string{}
+	for name, value := range request.EnvironmentVariables {
+		environmentVariables[name] = value
+	}
+	environmentVariables["TMPDIR"] = tmpfsPath
+	environmentVariables["TEST_TMPDIR"] = tmpfsPath
+
+	newRequest := *request
+	newRequest.EnvironmentVariables = environmentVariables
+	return e.ManagedEnvironment.Run(ctx, &newRequest)
+}
@@ -0,0 +1,20 @@
+package environment
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountTmpfs mounts a tmpfs of a given size at a given path. The file
+// system is world writable, as commands may run as another user than
+// the runner.
+func MountTmpfs(path string, sizeBytes int64) error {
+	return unix.Mount("tmpfs", path, "tmpfs", unix.MS_NODEV|unix.MS_NOSUID, fmt.Sprintf("size=%d,mode=1777", sizeBytes))
+}
+
+// UnmountTmpfs lazily unmounts a tmpfs, so that it is discarded even
+// if processes left behind by the command still have files opened.
+func UnmountTmpfs(path string) error {
+	return unix.Unmount(path, unix.MNT_DETACH)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package environment
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MountTmpfs returns an error, as scratch file systems are only
+// supported on Linux.
+func MountTmpfs(path string, sizeBytes int64) error {
+	return status.Error(codes.Unimplemented, "Scratch tmpfs is not supported on this platform")
+}
+
+// UnmountTmpfs returns an error, as scratch file systems are only
+// supported on Linux.
+func UnmountTmpfs(path string) error {
+	return status.Error(codes.Unimplemented, "Scratch tmpfs is not supported on this platform")
+}
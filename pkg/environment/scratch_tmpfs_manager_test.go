@@ -0,0 +1,154 @@
+package environment_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestScratchTmpfsManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	scratchDirectoryPath, err := ioutil.TempDir("", "scratch")
+	require.NoError(t, err)
+	defer os.RemoveAll(scratchDirectoryPath)
+
+	// Record the calls to mount and unmount, as opposed to actually
+	// mounting file systems, which requires CAP_SYS_ADMIN.
+	var mountedPaths, unmountedPaths []string
+	mountErr := error(nil)
+	baseManager := mock.NewMockManager(ctrl)
+	manager := environment.NewScratchTmpfsManager(
+		baseManager,
+		scratchDirectoryPath,
+		1<<20,
+		func(path string, sizeBytes int64) error {
+			require.Equal(t, int64(1<<20), sizeBytes)
+			mountedPaths = append(mountedPaths, path)
+			return mountErr
+		},
+		func(path string) error {
+			unmountedPaths = append(unmountedPaths, path)
+			return nil
+		})
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+
+	t.Run("AcquireFailure", func(t *testing.T) {
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(nil, status.Error(codes.Internal, "Out of disk space"))
+		_, err := manager.Acquire(actionDigest, map[string]string{})
+		require.Equal(t, status.Error(codes.Internal, "Out of disk space"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mountedPaths, unmountedPaths = nil, nil
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		// The command should have TMPDIR and TEST_TMPDIR point
+		// to the tmpfs. The original request should be left
+		// untouched.
+		request := &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+			EnvironmentVariables: map[string]string{
+				"PATH": "/bin:/usr/bin",
+			},
+		}
+		baseEnvironment.EXPECT().Run(ctx, gomock.Any()).DoAndReturn(func(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+			require.Len(t, mountedPaths, 1)
+			tmpfsPath := mountedPaths[0]
+			require.Equal(t, scratchDirectoryPath, filepath.Dir(tmpfsPath))
+			require.Equal(t, map[string]string{
+				"PATH":        "/bin:/usr/bin",
+				"TMPDIR":      tmpfsPath,
+				"TEST_TMPDIR": tmpfsPath,
+			}, request.EnvironmentVariables)
+			return &runner.RunResponse{ExitCode: 0}, nil
+		})
+		response, err := environment.Run(ctx, request)
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+		require.Equal(t, map[string]string{"PATH": "/bin:/usr/bin"}, request.EnvironmentVariables)
+
+		// The tmpfs should be unmounted and its mount point
+		// removed after the command completes.
+		require.Equal(t, mountedPaths, unmountedPaths)
+		_, err = os.Stat(mountedPaths[0])
+		require.True(t, os.IsNotExist(err))
+
+		baseEnvironment.EXPECT().Release()
+		environment.Release()
+	})
+
+	t.Run("MountFailure", func(t *testing.T) {
+		mountedPaths, unmountedPaths = nil, nil
+		mountErr = status.Error(codes.PermissionDenied, "Operation not permitted")
+		defer func() { mountErr = nil }()
+
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		// The command should not be run if no tmpfs can be
+		// mounted.
+		_, err = environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+		})
+		require.Equal(t, status.Error(codes.Internal, "Failed to mount scratch tmpfs: Operation not permitted"), err)
+		require.Empty(t, unmountedPaths)
+		_, err = os.Stat(mountedPaths[0])
+		require.True(t, os.IsNotExist(err))
+
+		baseEnvironment.EXPECT().Release()
+		environment.Release()
+	})
+
+	t.Run("Container", func(t *testing.T) {
+		mountedPaths, unmountedPaths = nil, nil
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{})
+		require.NoError(t, err)
+
+		// The scratch directory is not visible inside
+		// containers. Commands run inside containers should
+		// keep their own temporary directory.
+		request := &runner.RunRequest{
+			Arguments: []string{"cc", "-c", "hello.c"},
+			EnvironmentVariables: map[string]string{
+				"PATH": "/bin:/usr/bin",
+			},
+			Container: &runner.Container{Image: "ubuntu:18.04"},
+		}
+		baseEnvironment.EXPECT().Run(ctx, request).Return(&runner.RunResponse{ExitCode: 0}, nil)
+		response, err := environment.Run(ctx, request)
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+		require.Empty(t, mountedPaths)
+		require.Empty(t, unmountedPaths)
+
+		baseEnvironment.EXPECT().Release()
+		environment.Release()
+	})
+}
@@ -0,0 +1,145 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/secrets"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type secretInjectingManager struct {
+	base     Manager
+	provider secrets.Provider
+}
+
+// NewSecretInjectingManager is an adapter for Manager that fetches the
+// secrets requested through RunRequest's secret_environment_variables
+// and secret_files fields from a secrets.Provider, exposing them to the
+// command that is run. Secret files are removed after the command
+// completes. This adapter is intended to be used by bbb_runner.
+func NewSecretInjectingManager(base Manager, provider secrets.Provider) Manager {
+	return &secretInjectingManager{
+		base:     base,
+		provider: provider,
+	}
+}
+
+func (em *secretInjectingManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	return &secretInjectingEnvironment{
+		ManagedEnvironment: environment,
+		provider:           em.provider,
+	}, nil
+}
+
+type secretInjectingEnvironment struct {
+	ManagedEnvironment
+	provider secrets.Provider
+}
+
+func (e *secretInjectingEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	if len(request.SecretEnvironmentVariables) == 0 && len(request.SecretFiles) == 0 {
+		return e.ManagedEnvironment.Run(ctx, request)
+	}
+
+	environmentVariables := map[string]string{}
+	for name, value := range request.EnvironmentVariables {
+		environmentVariables[name] = value
+	}
+	for name, secretName := range request.SecretEnvironmentVariables {
+		value, err := e.provider.GetSecret(ctx, secretName)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to obtain secret %#v", secretName)
+		}
+		environmentVariables[name] = string(value)
+	}
+
+	// Only remove the secret files that were created by us, so that
+	// input files with the same name are left alone.
+	buildDirectory := e.ManagedEnvironment.GetBuildDirectory()
+	var createdFiles []secretFile
+	defer func() {
+		for _, f := range createdFiles {
+			f.directory.Remove(f.name)
+			if f.directory != buildDirectory {
+				f.directory.Close()
+			}
+		}
+	}()
+	for filePath, secretName := range request.SecretFiles {
+		value, err := e.provider.GetSecret(ctx, secretName)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to obtain secret %#v", secretName)
+		}
+		f, err := createSecretFile(buildDirectory, filePath, value)
+		if err != nil {
+			return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to create secret file %#v", filePath)
+		}
+		createdFiles = append(createdFiles, f)
+	}
+
+	newRequest := *request
+	newRequest.EnvironmentVariables = environmentVariables
+	newRequest.SecretEnvironmentVariables = nil
+	newRequest.SecretFiles = nil
+	return e.ManagedEnvironment.Run(ctx, &newRequest)
+}
+
+// secretFile is a file containing a secret that was created in the
+// build directory, which needs to be removed after the command
+// completes.
+type secretFile struct {
+	directory filesystem.Directory
+	name      string
+}
+
+func createSecretFile(buildDirectory filesystem.Directory, filePath string, value []byte) (secretFile, error) {
+	components := strings.FieldsFunc(filePath, func(r rune) bool { return r == '/' })
+	if len(components) < 1 {
+		return secretFile{}, status.Error(codes.InvalidArgument, "Insufficient pathname components in filename")
+	}
+
+	// Traverse to the directory in which the file should be created.
+	d := buildDirectory
+	for n, component := range components[:len(components)-1] {
+		d2, err := d.Enter(component)
+		if d != buildDirectory {
+			d.Close()
+		}
+		if err != nil {
+			return secretFile{}, util.StatusWrapf(err, "Failed to enter directory %#v", path.Join(components[:n+1]...))
+		}
+		d = d2
+	}
+
+	name := components[len(components)-1]
+	f, err := d.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0400)
+	if err != nil {
+		if d != buildDirectory {
+			d.Close()
+		}
+		return secretFile{}, err
+	}
+	created := secretFile{directory: d, name: name}
+	_, err = f.Write(value)
+	f.Close()
+	if err != nil {
+		d.Remove(name)
+		if d != buildDirectory {
+			d.Close()
+		}
+		return secretFile{}, err
+	}
+	return created, nil
+}
@@ -0,0 +1,131 @@
+package environment
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SecretPlatformPropertyPrefix is the prefix of platform properties
+// that build actions may set to request access to a secret. The
+// remainder of the platform property name is the name of the secret.
+// The value of the platform property determines how the secret is
+// exposed. If empty or "env", the secret is exposed through an
+// environment variable named after the secret. If "env:NAME", it is
+// exposed through environment variable NAME. If "file:NAME", it is
+// written to file NAME, relative to the input root.
+const SecretPlatformPropertyPrefix = "secret:"
+
+// RequestsSecrets returns whether a build action with a given set of
+// platform properties requests access to secrets. Results of such build
+// actions may contain data derived from the secrets, meaning they
+// should not be stored in the Action Cache.
+func RequestsSecrets(platformProperties map[string]string) bool {
+	for name := range platformProperties {
+		if strings.HasPrefix(name, SecretPlatformPropertyPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type secretRequestingManager struct {
+	base           Manager
+	allowedSecrets map[string]map[string]bool
+}
+
+// NewSecretRequestingManager is an adapter for Manager that translates
+// platform properties with prefix "secret:" to requests for secrets
+// that are sent to the runner. The runner is responsible for fetching
+// the secrets, meaning the worker itself never has access to them.
+//
+// Build actions may only request the secrets that are listed for their
+// instance name. Requests for other secrets are rejected, so that
+// clients cannot obtain arbitrary secrets reachable by the runner.
+func NewSecretRequestingManager(base Manager, allowedSecrets map[string][]string) Manager {
+	em := &secretRequestingManager{
+		base:           base,
+		allowedSecrets: map[string]map[string]bool{},
+	}
+	for instance, names := range allowedSecrets {
+		allowedNames := map[string]bool{}
+		for _, name := range names {
+			allowedNames[name] = true
+		}
+		em.allowedSecrets[instance] = allowedNames
+	}
+	return em
+}
+
+func (em *secretRequestingManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	secretEnvironmentVariables := map[string]string{}
+	secretFiles := map[string]string{}
+	for name, value := range platformProperties {
+		if !strings.HasPrefix(name, SecretPlatformPropertyPrefix) {
+			continue
+		}
+		secretName := name[len(SecretPlatformPropertyPrefix):]
+		if secretName == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "Platform property %#v does not contain a secret name", name)
+		}
+		if !em.allowedSecrets[actionDigest.GetInstance()][secretName] {
+			return nil, status.Errorf(codes.PermissionDenied, "Secret %#v may not be requested by build actions of instance %#v", secretName, actionDigest.GetInstance())
+		}
+		switch {
+		case value == "" || value == "env":
+			secretEnvironmentVariables[secretName] = secretName
+		case strings.HasPrefix(value, "env:") && len(value) > len("env:"):
+			secretEnvironmentVariables[value[len("env:"):]] = secretName
+		case strings.HasPrefix(value, "file:") && len(value) > len("file:"):
+			secretFiles[value[len("file:"):]] = secretName
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Platform property %#v has invalid value %#v", name, value)
+		}
+	}
+
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	if len(secretEnvironmentVariables) == 0 && len(secretFiles) == 0 {
+		return environment, nil
+	}
+	return preserveInputRootPopulator(&secretRequestingEnvironment{
+		ManagedEnvironment:         environment,
+		secretEnvironmentVariables: secretEnvironmentVariables,
+		secretFiles:                secretFiles,
+	}, environment), nil
+}
+
+type secretRequestingEnvironment struct {
+	ManagedEnvironment
+	secretEnvironmentVariables map[string]string
+	secretFiles                map[string]string
+}
+
+func (e *secretRequestingEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+	newRequest := *request
+	newRequest.SecretEnvironmentVariables = e.secretEnvironmentVariables
+	newRequest.SecretFiles = e.secretFiles
+	return e.ManagedEnvironment.Run(ctx, &newRequest)
+}
+
+// prefixSecretFiles prepends a directory name to the paths of secret
+// files. This is used by Managers that run build actions in
+// subdirectories of the build directory.
+func prefixSecretFiles(secretFiles map[string]string, prefix string) map[string]string {
+	if len(secretFiles) == 0 {
+		return secretFiles
+	}
+	newSecretFiles := make(map[string]string, len(secretFiles))
+	for name, secretName := range secretFiles {
+		newSecretFiles[path.Join(prefix, name)] = secretName
+	}
+	return newSecretFiles
+}
@@ -0,0 +1,163 @@
+package environment_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSecretRequestingManager(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseManager := mock.NewMockManager(ctrl)
+	manager := environment.NewSecretRequestingManager(baseManager, map[string][]string{
+		"debian8":  {"GITHUB_AUTH", "NPM_TOKEN", "npmrc"},
+		"ubuntu16": {"NPM_TOKEN"},
+	})
+	actionDigest := util.MustNewDigest(
+		"debian8",
+		&remoteexecution.Digest{
+			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			SizeBytes: 0,
+		})
+
+	t.Run("InvalidValue", func(t *testing.T) {
+		_, err := manager.Acquire(actionDigest, map[string]string{
+			"secret:NPM_TOKEN": "stdin",
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Platform property \"secret:NPM_TOKEN\" has invalid value \"stdin\""), err)
+	})
+
+	t.Run("SecretNotAllowed", func(t *testing.T) {
+		// Build actions may not request secrets that are not
+		// listed for their instance name.
+		_, err := manager.Acquire(actionDigest, map[string]string{
+			"secret:AWS_SECRET_ACCESS_KEY": "",
+		})
+		require.Equal(t, status.Error(codes.PermissionDenied, "Secret \"AWS_SECRET_ACCESS_KEY\" may not be requested by build actions of instance \"debian8\""), err)
+
+		_, err = manager.Acquire(
+			util.MustNewDigest(
+				"centos7",
+				&remoteexecution.Digest{
+					Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+					SizeBytes: 0,
+				}),
+			map[string]string{
+				"secret:NPM_TOKEN": "",
+			})
+		require.Equal(t, status.Error(codes.PermissionDenied, "Secret \"NPM_TOKEN\" may not be requested by build actions of instance \"centos7\""), err)
+	})
+
+	t.Run("NoSecrets", func(t *testing.T) {
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, map[string]string{"OSFamily": "Linux"}).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, map[string]string{"OSFamily": "Linux"})
+		require.NoError(t, err)
+		require.Equal(t, baseEnvironment, environment)
+	})
+
+	t.Run("Secrets", func(t *testing.T) {
+		platformProperties := map[string]string{
+			"secret:NPM_TOKEN":   "",
+			"secret:GITHUB_AUTH": "env:GITHUB_TOKEN",
+			"secret:npmrc":       "file:.npmrc",
+		}
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, platformProperties).Return(baseEnvironment, nil)
+		environment, err := manager.Acquire(actionDigest, platformProperties)
+		require.NoError(t, err)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments: []string{"npm", "install"},
+			SecretEnvironmentVariables: map[string]string{
+				"NPM_TOKEN":    "NPM_TOKEN",
+				"GITHUB_TOKEN": "GITHUB_AUTH",
+			},
+			SecretFiles: map[string]string{
+				".npmrc": "npmrc",
+			},
+		}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+		response, err := environment.Run(ctx, &runner.RunRequest{
+			Arguments: []string{"npm", "install"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+	})
+
+	t.Run("InputRootReusing", func(t *testing.T) {
+		// When placed on top of an adapter that reuses input
+		// roots, the environment should still be capable of
+		// populating the input root incrementally. Paths of
+		// secret files should be prefixed with the name of the
+		// subdirectory.
+		contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+		manager := environment.NewSecretRequestingManager(
+			environment.NewInputRootReusingManager(baseManager, contentAddressableStorage),
+			map[string][]string{
+				"debian8": {"npmrc"},
+			})
+		platformProperties := map[string]string{
+			"secret:npmrc": "file:.npmrc",
+		}
+
+		baseEnvironment := mock.NewMockManagedEnvironment(ctrl)
+		rootDirectory := mock.NewMockDirectory(ctrl)
+		baseEnvironment.EXPECT().GetBuildDirectory().Return(rootDirectory).AnyTimes()
+		subdirectory := mock.NewMockDirectory(ctrl)
+		baseManager.EXPECT().Acquire(actionDigest, platformProperties).Return(baseEnvironment, nil)
+		rootDirectory.EXPECT().RemoveAllChildren()
+		rootDirectory.EXPECT().RemoveAll("0")
+		rootDirectory.EXPECT().Mkdir("0", os.FileMode(0777))
+		rootDirectory.EXPECT().Enter("0").Return(subdirectory, nil)
+		environment1, err := manager.Acquire(actionDigest, platformProperties)
+		require.NoError(t, err)
+
+		inputRootDigest := util.MustNewDigest(
+			"debian8",
+			&remoteexecution.Digest{
+				Hash:      "2b5e0c1a1e0e1c6fbc7d7b0cb1a8b5c58b4d1e8f9e8d1bd6c3e2d8b0c5d2a1e0",
+				SizeBytes: 0,
+			})
+		contentAddressableStorage.EXPECT().GetDirectory(ctx, inputRootDigest).Return(&remoteexecution.Directory{}, nil)
+		populator, ok := environment1.(environment.InputRootPopulator)
+		require.True(t, ok)
+		sizeBytes, err := populator.PopulateInputRoot(ctx, inputRootDigest)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), sizeBytes)
+
+		baseEnvironment.EXPECT().Run(ctx, &runner.RunRequest{
+			Arguments:                  []string{"npm", "install"},
+			WorkingDirectory:           "0",
+			StdoutPath:                 "0/.stdout.txt",
+			StderrPath:                 "0/.stderr.txt",
+			SecretEnvironmentVariables: map[string]string{},
+			SecretFiles: map[string]string{
+				"0/.npmrc": "npmrc",
+			},
+		}).Return(&runner.RunResponse{ExitCode: 0}, nil)
+		response, err := environment1.Run(ctx, &runner.RunRequest{
+			Arguments:  []string{"npm", "install"},
+			StdoutPath: ".stdout.txt",
+			StderrPath: ".stderr.txt",
+		})
+		require.NoError(t, err)
+		require.Equal(t, &runner.RunResponse{ExitCode: 0}, response)
+
+		subdirectory.EXPECT().Close()
+		baseEnvironment.EXPECT().Release()
+		environment1.Release()
+	})
+}
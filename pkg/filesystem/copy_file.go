@@ -0,0 +1,35 @@
+package filesystem
+
+import (
+	"io"
+	"os"
+)
+
+// CopyFile creates a copy of a regular file, preserving its
+// permissions. It may be used to place a file in another directory when
+// neither hardlinking nor cloning is possible. Upon failure, no partial
+// copy is left behind.
+func CopyFile(oldDirectory Directory, oldName string, newDirectory Directory, newName string) error {
+	fileInfo, err := oldDirectory.Lstat(oldName)
+	if err != nil {
+		return err
+	}
+	r, err := oldDirectory.OpenFile(oldName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := newDirectory.OpenFile(newName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileInfo.Mode()&os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		newDirectory.Remove(newName)
+	}
+	return err
+}
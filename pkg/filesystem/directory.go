@@ -2,6 +2,7 @@ package filesystem
 
 import (
 	"os"
+	"time"
 )
 
 // Directory is an abstraction for accessing a subtree of the file
@@ -18,8 +19,32 @@ type Directory interface {
 	// Close any resources associated with the current directory.
 	Close() error
 
+	// Chmod is the equivalent of os.Chmod().
+	Chmod(name string, mode os.FileMode) error
+	// Chtimes is the equivalent of os.Chtimes(), except that it
+	// does not follow symbolic links.
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	// Clonefile creates a copy-on-write copy of a file, similar to
+	// clonefileat() on macOS or the FICLONE ioctl() on Linux
+	// (reflinks). Unlike Link(), the copy may be modified without
+	// affecting the original, and it works across volumes that
+	// share the same underlying storage. It fails with ENOTSUP on
+	// systems or file systems that do not support it.
+	Clonefile(oldName string, newDirectory Directory, newName string) error
+
+	// Flock is the equivalent of unix.Flock(), applied to the
+	// directory itself. It may be used to synchronize access to a
+	// directory between processes.
+	Flock(how int) error
+	// Getxattr returns the value of an extended attribute of a
+	// file, similar to getxattr(). Symbolic links are not
+	// followed. It fails with ENOTSUP on file systems that do not
+	// support extended attributes.
+	Getxattr(name string, attr string) ([]byte, error)
 	// Link is the equivalent of os.Link().
 	Link(oldName string, newDirectory Directory, newName string) error
+	// Lchown is the equivalent of os.Lchown().
+	Lchown(name string, uid int, gid int) error
 	// Lstat is the equivalent of os.Lstat().
 	Lstat(name string) (FileInfo, error)
 	// Mkdir is the equivalent of os.Mkdir().
@@ -37,6 +62,11 @@ type Directory interface {
 	// RemoveAllChildren empties out a directory, without removing
 	// the directory itself.
 	RemoveAllChildren() error
+	// Setxattr sets the value of an extended attribute of a file,
+	// similar to setxattr(). Symbolic links are not followed. It
+	// fails with ENOTSUP on file systems that do not support
+	// extended attributes.
+	Setxattr(name string, attr string, value []byte) error
 	// Symlink is the equivalent of os.Symlink().
 	Symlink(oldName string, newName string) error
 }
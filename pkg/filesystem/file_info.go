@@ -2,6 +2,7 @@ package filesystem
 
 import (
 	"os"
+	"time"
 )
 
 // FileInfo is a subset of os.FileInfo, only containing the features
@@ -9,4 +10,6 @@ import (
 type FileInfo interface {
 	Name() string
 	Mode() os.FileMode
+	Size() int64
+	ModTime() time.Time
 }
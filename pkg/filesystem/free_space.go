@@ -0,0 +1,15 @@
+package filesystem
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// GetFreeSpace returns the number of bytes available to unprivileged
+// users on the file system containing a given path.
+func GetFreeSpace(path string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
@@ -62,6 +63,87 @@ func (d *localDirectory) Close() error {
 	return unix.Close(fd)
 }
 
+func (d *localDirectory) Chmod(name string, mode os.FileMode) error {
+	if err := validateFilename(name); err != nil {
+		return err
+	}
+	defer runtime.KeepAlive(d)
+
+	return unix.Fchmodat(d.fd, name, uint32(mode), 0)
+}
+
+func (d *localDirectory) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := validateFilename(name); err != nil {
+		return err
+	}
+	defer runtime.KeepAlive(d)
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(d.fd, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func (d *localDirectory) Clonefile(oldName string, newDirectory Directory, newName string) error {
+	if err := validateFilename(oldName); err != nil {
+		return err
+	}
+	if err := validateFilename(newName); err != nil {
+		return err
+	}
+	defer runtime.KeepAlive(d)
+	defer runtime.KeepAlive(newDirectory)
+
+	d2, ok := newDirectory.(*localDirectory)
+	if !ok {
+		return errors.New("Source and target directory have different types")
+	}
+	return clonefileat(d.fd, oldName, d2.fd, newName)
+}
+
+func (d *localDirectory) Flock(how int) error {
+	defer runtime.KeepAlive(d)
+
+	return unix.Flock(d.fd, how)
+}
+
+// openForXattr opens a file, so that its extended attributes may be
+// accessed through its file descriptor. There are no *at() variants of
+// the system calls for accessing extended attributes.
+func (d *localDirectory) openForXattr(name string) (int, error) {
+	if err := validateFilename(name); err != nil {
+		return -1, err
+	}
+	defer runtime.KeepAlive(d)
+
+	return unix.Openat(d.fd, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+}
+
+func (d *localDirectory) Getxattr(name string, attr string) ([]byte, error) {
+	fd, err := d.openForXattr(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	for {
+		// Obtain the size of the value first. Retry if the
+		// value grows in the meantime.
+		size, err := unix.Fgetxattr(fd, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		n, err := unix.Fgetxattr(fd, attr, value)
+		if err == nil {
+			return value[:n], nil
+		} else if err != unix.ERANGE {
+			return nil, err
+		}
+	}
+}
+
 func (d *localDirectory) Link(oldName string, newDirectory Directory, newName string) error {
 	if err := validateFilename(oldName); err != nil {
 		return err
@@ -79,6 +161,15 @@ func (d *localDirectory) Link(oldName string, newDirectory Directory, newName st
 	return unix.Linkat(d.fd, oldName, d2.fd, newName, 0)
 }
 
+func (d *localDirectory) Lchown(name string, uid int, gid int) error {
+	if err := validateFilename(name); err != nil {
+		return err
+	}
+	defer runtime.KeepAlive(d)
+
+	return unix.Fchownat(d.fd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+}
+
 func (d *localDirectory) Lstat(name string) (FileInfo, error) {
 	if err := validateFilename(name); err != nil {
 		return nil, err
@@ -101,7 +192,7 @@ func (d *localDirectory) Lstat(name string) (FileInfo, error) {
 	default:
 		mode |= os.ModeIrregular
 	}
-	return NewSimpleFileInfo(name, mode), nil
+	return NewFileInfo(name, mode, stat.Size, getModTime(&stat)), nil
 }
 
 func (d *localDirectory) Mkdir(name string, perm os.FileMode) error {
@@ -260,6 +351,16 @@ func (d *localDirectory) RemoveAll(name string) error {
 	}
 }
 
+func (d *localDirectory) Setxattr(name string, attr string, value []byte) error {
+	fd, err := d.openForXattr(name)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	return unix.Fsetxattr(fd, attr, value, 0)
+}
+
 func (d *localDirectory) Symlink(oldName string, newName string) error {
 	if err := validateFilename(newName); err != nil {
 		return err
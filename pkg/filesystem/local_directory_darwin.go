@@ -0,0 +1,42 @@
+package filesystem
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func getModTime(stat *unix.Stat_t) time.Time {
+	return time.Unix(stat.Mtimespec.Unix())
+}
+
+const (
+	// System call number and flags of clonefileat(), as declared in
+	// <sys/syscall.h> and <sys/clonefile.h>.
+	sysClonefileat   = 462
+	cloneNoFollow    = 0x0001
+	cloneNoOwnerCopy = 0x0002
+)
+
+func clonefileat(srcDirFD int, src string, dstDirFD int, dst string) error {
+	srcPtr, err := unix.BytePtrFromString(src)
+	if err != nil {
+		return err
+	}
+	dstPtr, err := unix.BytePtrFromString(dst)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := unix.Syscall6(
+		sysClonefileat,
+		uintptr(srcDirFD),
+		uintptr(unsafe.Pointer(srcPtr)),
+		uintptr(dstDirFD),
+		uintptr(unsafe.Pointer(dstPtr)),
+		cloneNoFollow|cloneNoOwnerCopy,
+		0); errno != 0 {
+		return errno
+	}
+	return nil
+}
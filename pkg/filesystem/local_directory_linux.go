@@ -0,0 +1,46 @@
+package filesystem
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func getModTime(stat *unix.Stat_t) time.Time {
+	return time.Unix(stat.Mtim.Unix())
+}
+
+// ficlone is the ioctl() request for sharing the extents of one file
+// with another, as declared in <linux/fs.h>. It is supported by file
+// systems such as Btrfs and XFS.
+const ficlone = 0x40049409
+
+func clonefileat(srcDirFD int, src string, dstDirFD int, dst string) error {
+	srcFD, err := unix.Openat(srcDirFD, src, unix.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(srcFD)
+	var stat unix.Stat_t
+	if err := unix.Fstat(srcFD, &stat); err != nil {
+		return err
+	}
+
+	dstFD, err := unix.Openat(dstDirFD, dst, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW, stat.Mode&0777)
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(dstFD), ficlone, uintptr(srcFD))
+	unix.Close(dstFD)
+	if errno != 0 {
+		// Don't leave an empty file behind. Report the lack of
+		// support for cloning consistently with macOS.
+		unix.Unlinkat(dstDirFD, dst, 0)
+		switch errno {
+		case unix.EOPNOTSUPP, unix.EINVAL, unix.ENOTTY:
+			return unix.ENOTSUP
+		}
+		return errno
+	}
+	return nil
+}
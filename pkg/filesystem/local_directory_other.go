@@ -0,0 +1,18 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package filesystem
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func getModTime(stat *unix.Stat_t) time.Time {
+	return time.Unix(stat.Mtim.Unix())
+}
+
+func clonefileat(srcDirFD int, src string, dstDirFD int, dst string) error {
+	return unix.ENOTSUP
+}
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/stretchr/testify/require"
@@ -31,6 +32,103 @@ func TestLocalDirectoryCreationSuccess(t *testing.T) {
 	require.NoError(t, d.Close())
 }
 
+func TestLocalDirectoryChmodNonExistent(t *testing.T) {
+	d := openTmpDir(t)
+	require.True(t, os.IsNotExist(d.Chmod("nonexistent", 0644)))
+	require.NoError(t, d.Close())
+}
+
+func TestLocalDirectoryChmodSuccess(t *testing.T) {
+	syscall.Umask(0)
+	d := openTmpDir(t)
+	f, err := d.OpenFile("file", os.O_CREATE|os.O_WRONLY, 0444)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, d.Chmod("file", 0644))
+	fi, err := d.Lstat("file")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode())
+	require.NoError(t, d.Close())
+}
+
+func TestLocalDirectoryChtimes(t *testing.T) {
+	d := openTmpDir(t)
+	f, err := d.OpenFile("file", os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, d.Chtimes("file", time.Unix(1000, 0), time.Unix(2000, 0)))
+	f, err = d.OpenFile("file", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	fi, err := f.(*os.File).Stat()
+	require.NoError(t, err)
+	require.Equal(t, time.Unix(2000, 0), fi.ModTime())
+	require.NoError(t, f.Close())
+
+	fi2, err := d.Lstat("file")
+	require.NoError(t, err)
+	require.Equal(t, time.Unix(2000, 0), fi2.ModTime())
+	require.Equal(t, int64(0), fi2.Size())
+
+	require.True(t, os.IsNotExist(d.Chtimes("nonexistent", time.Unix(1000, 0), time.Unix(2000, 0))))
+	require.NoError(t, d.Close())
+}
+
+func TestLocalDirectoryClonefile(t *testing.T) {
+	syscall.Umask(0)
+	d := openTmpDir(t)
+	f, err := d.OpenFile("source", os.O_CREATE|os.O_WRONLY, 0444)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("Hello"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Cloning either succeeds, yielding a file with the same
+	// contents and mode, or fails without leaving a file behind.
+	if err := d.Clonefile("source", d, "target"); err == syscall.ENOTSUP {
+		_, err := d.Lstat("target")
+		require.True(t, os.IsNotExist(err))
+	} else {
+		require.NoError(t, err)
+		fi, err := d.Lstat("target")
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0444), fi.Mode())
+		f, err := d.OpenFile("target", os.O_RDONLY, 0)
+		require.NoError(t, err)
+		data := make([]byte, 10)
+		n, err := f.Read(data)
+		require.NoError(t, err)
+		require.Equal(t, "Hello", string(data[:n]))
+		require.NoError(t, f.Close())
+	}
+
+	// Cloning onto an existing file should fail.
+	require.True(t, os.IsExist(d.Clonefile("source", d, "source")))
+	require.NoError(t, d.Close())
+}
+
+func TestLocalDirectoryXattr(t *testing.T) {
+	d := openTmpDir(t)
+	f, err := d.OpenFile("file", os.O_CREATE|os.O_WRONLY, 0444)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Extended attributes may not be supported by the file system
+	// on which the tests are run.
+	if err := d.Setxattr("file", "user.buildbarn.test", []byte("Hello")); err == syscall.ENOTSUP {
+		t.Skip("Extended attributes are not supported")
+	} else {
+		require.NoError(t, err)
+	}
+	value, err := d.Getxattr("file", "user.buildbarn.test")
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), value)
+
+	_, err = d.Getxattr("nonexistent", "user.buildbarn.test")
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, d.Close())
+}
+
 func TestLocalDirectoryEnterBadName(t *testing.T) {
 	d := openTmpDir(t)
 
@@ -2,15 +2,18 @@ package filesystem
 
 import (
 	"os"
+	"time"
 )
 
 type simpleFileInfo struct {
-	name string
-	mode os.FileMode
+	name    string
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
 }
 
 // NewSimpleFileInfo constructs a FileInfo object that returns fixed
-// values for its methods.
+// values for its methods. The size and modification time are zero.
 func NewSimpleFileInfo(name string, mode os.FileMode) FileInfo {
 	return &simpleFileInfo{
 		name: name,
@@ -18,6 +21,17 @@ func NewSimpleFileInfo(name string, mode os.FileMode) FileInfo {
 	}
 }
 
+// NewFileInfo constructs a FileInfo object that returns fixed values
+// for its methods, including the size and modification time.
+func NewFileInfo(name string, mode os.FileMode, size int64, modTime time.Time) FileInfo {
+	return &simpleFileInfo{
+		name:    name,
+		mode:    mode,
+		size:    size,
+		modTime: modTime,
+	}
+}
+
 func (fi *simpleFileInfo) Name() string {
 	return fi.name
 }
@@ -25,3 +39,11 @@ func (fi *simpleFileInfo) Name() string {
 func (fi *simpleFileInfo) Mode() os.FileMode {
 	return fi.mode
 }
+
+func (fi *simpleFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *simpleFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
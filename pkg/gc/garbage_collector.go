@@ -0,0 +1,307 @@
+package gc
+
+import (
+	"context"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	garbageCollectorRunsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "gc",
+			Name:      "runs_total",
+			Help:      "Total number of garbage collection runs, by result.",
+		},
+		[]string{"result"})
+	garbageCollectorLastSuccessTimestampSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "gc",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Time at which the last successful garbage collection run completed.",
+		})
+	garbageCollectorActionCacheEntriesScannedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "gc",
+			Name:      "action_cache_entries_scanned_total",
+			Help:      "Total number of Action Cache entries scanned during the mark phase.",
+		})
+	garbageCollectorReachableBlobs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "gc",
+			Name:      "reachable_blobs",
+			Help:      "Number of Content Addressable Storage blobs that were reachable during the last run.",
+		})
+	garbageCollectorBlobsScannedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "gc",
+			Name:      "blobs_scanned_total",
+			Help:      "Total number of Content Addressable Storage blobs scanned during the sweep phase.",
+		})
+	garbageCollectorBlobsCollectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "gc",
+			Name:      "blobs_collected_total",
+			Help:      "Total number of unreachable blobs collected, by whether they were actually deleted.",
+		},
+		[]string{"mode"})
+	garbageCollectorBlobsCollectedBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "gc",
+			Name:      "blobs_collected_bytes_total",
+			Help:      "Total size of unreachable blobs collected, by whether they were actually deleted.",
+		},
+		[]string{"mode"})
+	garbageCollectorDeleteFailuresTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "gc",
+			Name:      "delete_failures_total",
+			Help:      "Total number of unreachable blobs that could not be deleted.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(garbageCollectorRunsTotal)
+	prometheus.MustRegister(garbageCollectorLastSuccessTimestampSeconds)
+	prometheus.MustRegister(garbageCollectorActionCacheEntriesScannedTotal)
+	prometheus.MustRegister(garbageCollectorReachableBlobs)
+	prometheus.MustRegister(garbageCollectorBlobsScannedTotal)
+	prometheus.MustRegister(garbageCollectorBlobsCollectedTotal)
+	prometheus.MustRegister(garbageCollectorBlobsCollectedBytesTotal)
+	prometheus.MustRegister(garbageCollectorDeleteFailuresTotal)
+}
+
+// GarbageCollector removes blobs from the Content Addressable Storage
+// (CAS) that are no longer referenced by any entry in the Action Cache
+// (AC).
+type GarbageCollector interface {
+	Run(ctx context.Context) error
+}
+
+type garbageCollector struct {
+	contentAddressableStorageBlobAccess blobstore.BlobAccess
+	contentAddressableStorage           cas.ContentAddressableStorage
+	actionCacheBlobAccess               blobstore.BlobAccess
+	actionCache                         ac.ActionCache
+	minimumAge                          time.Duration
+	dryRun                              bool
+}
+
+// NewGarbageCollector creates a GarbageCollector that performs a
+// mark-and-sweep over the CAS. During the mark phase, all entries in
+// the AC are scanned to determine which blobs are reachable. Reachable
+// blobs are the Action and Command messages of cached actions and all
+// of their outputs. During the sweep phase, all unreachable blobs that
+// are older than a minimum age are deleted. The minimum age prevents
+// the removal of blobs that have been uploaded by clients, but are not
+// yet referenced by an action result.
+//
+// Both backends need to implement blobstore.BlobLister. When dryRun is
+// set, blobs are only reported as collectable, not deleted.
+func NewGarbageCollector(contentAddressableStorage blobstore.BlobAccess, actionCache blobstore.BlobAccess, minimumAge time.Duration, dryRun bool) GarbageCollector {
+	return &garbageCollector{
+		contentAddressableStorageBlobAccess: contentAddressableStorage,
+		contentAddressableStorage:           cas.NewBlobAccessContentAddressableStorage(contentAddressableStorage),
+		actionCacheBlobAccess:               actionCache,
+		actionCache:                         ac.NewBlobAccessActionCache(actionCache),
+		minimumAge:                          minimumAge,
+		dryRun:                              dryRun,
+	}
+}
+
+// FindReachableBlobs performs the mark phase of garbage collection,
+// without sweeping. It returns the digests of all entries in the AC and
+// the digests of all blobs in the CAS that are referenced by them.
+func FindReachableBlobs(ctx context.Context, contentAddressableStorage blobstore.BlobAccess, actionCache blobstore.BlobAccess) ([]*util.Digest, []*util.Digest, error) {
+	gc := &garbageCollector{
+		contentAddressableStorage: cas.NewBlobAccessContentAddressableStorage(contentAddressableStorage),
+		actionCacheBlobAccess:     actionCache,
+		actionCache:               ac.NewBlobAccessActionCache(actionCache),
+	}
+	actionDigests, reachable, err := gc.mark(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	blobDigests := make([]*util.Digest, 0, len(reachable))
+	for _, digest := range reachable {
+		blobDigests = append(blobDigests, digest)
+	}
+	return actionDigests, blobDigests, nil
+}
+
+func (gc *garbageCollector) Run(ctx context.Context) error {
+	if err := gc.run(ctx); err != nil {
+		garbageCollectorRunsTotal.WithLabelValues("Failure").Inc()
+		return err
+	}
+	garbageCollectorRunsTotal.WithLabelValues("Success").Inc()
+	garbageCollectorLastSuccessTimestampSeconds.SetToCurrentTime()
+	return nil
+}
+
+func (gc *garbageCollector) run(ctx context.Context) error {
+	// Capture the cutoff before marking, so that blobs uploaded
+	// while the mark phase is running are never considered.
+	cutoff := time.Now().Add(-gc.minimumAge)
+
+	_, reachable, err := gc.mark(ctx)
+	if err != nil {
+		return err
+	}
+	garbageCollectorReachableBlobs.Set(float64(len(reachable)))
+	return gc.sweep(ctx, reachable, cutoff)
+}
+
+// reachableSet contains all blobs in the CAS that are referenced by
+// entries in the AC, keyed by digest without instance name.
+type reachableSet map[string]*util.Digest
+
+func (rs reachableSet) add(parentDigest *util.Digest, partialDigest *remoteexecution.Digest) error {
+	if partialDigest == nil {
+		return nil
+	}
+	digest, err := parentDigest.NewDerivedDigest(partialDigest)
+	if err != nil {
+		return err
+	}
+	rs[digest.GetKey(util.DigestKeyWithoutInstance)] = digest
+	return nil
+}
+
+func (gc *garbageCollector) mark(ctx context.Context) ([]*util.Digest, reachableSet, error) {
+	// Gather the keys of all AC entries first, so that the backend
+	// is not accessed recursively while listing.
+	var actionDigests []*util.Digest
+	if err := blobstore.ListBlobs(ctx, gc.actionCacheBlobAccess, func(digest *util.Digest, timestamp time.Time) error {
+		actionDigests = append(actionDigests, digest)
+		return nil
+	}); err != nil {
+		return nil, nil, util.StatusWrap(err, "Failed to list Action Cache entries")
+	}
+
+	reachable := reachableSet{}
+	for _, actionDigest := range actionDigests {
+		garbageCollectorActionCacheEntriesScannedTotal.Inc()
+		if err := gc.markActionResult(ctx, reachable, actionDigest); err != nil {
+			return nil, nil, util.StatusWrapf(err, "Failed to mark blobs referenced by action %s", actionDigest)
+		}
+	}
+	return actionDigests, reachable, nil
+}
+
+func (gc *garbageCollector) markActionResult(ctx context.Context, reachable reachableSet, actionDigest *util.Digest) error {
+	actionResult, err := gc.actionCache.GetActionResult(ctx, actionDigest)
+	if status.Code(err) == codes.NotFound {
+		// Entry disappeared after listing.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Keep the Action and Command messages around, so that cached
+	// results can still be inspected through bbb_browser.
+	if err := reachable.add(actionDigest, actionDigest.GetPartialDigest()); err != nil {
+		return err
+	}
+	action, err := gc.contentAddressableStorage.GetAction(ctx, actionDigest)
+	if err == nil {
+		if err := reachable.add(actionDigest, action.CommandDigest); err != nil {
+			return err
+		}
+	} else if status.Code(err) != codes.NotFound {
+		return err
+	}
+
+	for _, outputFile := range actionResult.OutputFiles {
+		if err := reachable.add(actionDigest, outputFile.Digest); err != nil {
+			return err
+		}
+	}
+	for _, outputDirectory := range actionResult.OutputDirectories {
+		if err := reachable.add(actionDigest, outputDirectory.TreeDigest); err != nil {
+			return err
+		}
+		if outputDirectory.TreeDigest == nil {
+			continue
+		}
+		treeDigest, err := actionDigest.NewDerivedDigest(outputDirectory.TreeDigest)
+		if err != nil {
+			return err
+		}
+		tree, err := gc.contentAddressableStorage.GetTree(ctx, treeDigest)
+		if status.Code(err) == codes.NotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, directory := range append([]*remoteexecution.Directory{tree.Root}, tree.Children...) {
+			for _, file := range directory.GetFiles() {
+				if err := reachable.add(actionDigest, file.Digest); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := reachable.add(actionDigest, actionResult.StdoutDigest); err != nil {
+		return err
+	}
+	return reachable.add(actionDigest, actionResult.StderrDigest)
+}
+
+func (gc *garbageCollector) sweep(ctx context.Context, reachable reachableSet, cutoff time.Time) error {
+	// Gather unreachable blobs first, as deleting objects while
+	// listing may cause backends to skip over entries.
+	var unreachable []*util.Digest
+	if err := blobstore.ListBlobs(ctx, gc.contentAddressableStorageBlobAccess, func(digest *util.Digest, timestamp time.Time) error {
+		garbageCollectorBlobsScannedTotal.Inc()
+		if _, ok := reachable[digest.GetKey(util.DigestKeyWithoutInstance)]; !ok && timestamp.Before(cutoff) {
+			unreachable = append(unreachable, digest)
+		}
+		return nil
+	}); err != nil {
+		return util.StatusWrap(err, "Failed to list Content Addressable Storage blobs")
+	}
+
+	mode := "Delete"
+	if gc.dryRun {
+		mode = "DryRun"
+	}
+	blobsCollectedTotal := garbageCollectorBlobsCollectedTotal.WithLabelValues(mode)
+	blobsCollectedBytesTotal := garbageCollectorBlobsCollectedBytesTotal.WithLabelValues(mode)
+	logger := logging.FromContext(ctx)
+	for _, digest := range unreachable {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if gc.dryRun {
+			logger.WithField(logging.BlobDigestField, digest.String()).Info("Would delete unreachable blob")
+		} else if err := gc.contentAddressableStorageBlobAccess.Delete(ctx, digest); err != nil {
+			// Continue with the remaining blobs, as a single
+			// failure should not block collection entirely.
+			logger.WithField(logging.BlobDigestField, digest.String()).WithError(err).Warn("Failed to delete unreachable blob")
+			garbageCollectorDeleteFailuresTotal.Inc()
+			continue
+		}
+		blobsCollectedTotal.Inc()
+		blobsCollectedBytesTotal.Add(float64(digest.GetSizeBytes()))
+	}
+	return nil
+}
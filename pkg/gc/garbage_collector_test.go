@@ -0,0 +1,114 @@
+package gc_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/gc"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+type listedBlob struct {
+	digest    *util.Digest
+	timestamp time.Time
+}
+
+// listingBlobAccess extends a mocked BlobAccess with a fixed list of
+// blobs, as gomock only mocks BlobAccess itself.
+type listingBlobAccess struct {
+	*mock.MockBlobAccess
+	blobs []listedBlob
+}
+
+func (ba *listingBlobAccess) List(ctx context.Context, fn blobstore.BlobListerFunc) error {
+	for _, blob := range ba.blobs {
+		if err := fn(blob.digest, blob.timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expectGetMessage(t *testing.T, blobAccess *mock.MockBlobAccess, digest *util.Digest, message proto.Message) {
+	data, err := proto.Marshal(message)
+	require.NoError(t, err)
+	blobAccess.EXPECT().Get(gomock.Any(), digest).Return(int64(len(data)), ioutil.NopCloser(bytes.NewBuffer(data)), nil)
+}
+
+func newTestDigest(hash string, sizeBytes int64) *util.Digest {
+	return util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      hash,
+		SizeBytes: sizeBytes,
+	})
+}
+
+func setUpGarbageCollectorTest(t *testing.T, ctrl *gomock.Controller, now time.Time) (*listingBlobAccess, *listingBlobAccess, *util.Digest, *util.Digest) {
+	actionDigest := newTestDigest("64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", 11)
+	commandDigest := newTestDigest("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", 0)
+	outputDigest := newTestDigest("f11999245771a5c184b62dc5380e0d8b42df67b5d8cd8a9fc2ed57a7e2f1d5e5", 42)
+	stdoutDigest := newTestDigest("2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", 3)
+	oldGarbageDigest := newTestDigest("fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9", 3)
+	newGarbageDigest := newTestDigest("baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096", 3)
+
+	actionCache := &listingBlobAccess{
+		MockBlobAccess: mock.NewMockBlobAccess(ctrl),
+		blobs: []listedBlob{
+			{digest: actionDigest, timestamp: now.Add(-48 * time.Hour)},
+		},
+	}
+	expectGetMessage(t, actionCache.MockBlobAccess, actionDigest, &remoteexecution.ActionResult{
+		OutputFiles: []*remoteexecution.OutputFile{
+			{Path: "hello.o", Digest: outputDigest.GetPartialDigest()},
+		},
+		StdoutDigest: stdoutDigest.GetPartialDigest(),
+	})
+
+	contentAddressableStorage := &listingBlobAccess{
+		MockBlobAccess: mock.NewMockBlobAccess(ctrl),
+		blobs: []listedBlob{
+			{digest: actionDigest, timestamp: now.Add(-48 * time.Hour)},
+			{digest: commandDigest, timestamp: now.Add(-48 * time.Hour)},
+			{digest: outputDigest, timestamp: now.Add(-48 * time.Hour)},
+			{digest: stdoutDigest, timestamp: now.Add(-48 * time.Hour)},
+			{digest: oldGarbageDigest, timestamp: now.Add(-48 * time.Hour)},
+			{digest: newGarbageDigest, timestamp: now.Add(-time.Minute)},
+		},
+	}
+	expectGetMessage(t, contentAddressableStorage.MockBlobAccess, actionDigest, &remoteexecution.Action{
+		CommandDigest: commandDigest.GetPartialDigest(),
+	})
+	return contentAddressableStorage, actionCache, oldGarbageDigest, newGarbageDigest
+}
+
+func TestGarbageCollectorDeletesUnreachableBlobs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Only the old blob that is not referenced by the AC should be
+	// removed. The recently uploaded blob should be left alone.
+	contentAddressableStorage, actionCache, oldGarbageDigest, _ := setUpGarbageCollectorTest(t, ctrl, time.Now())
+	contentAddressableStorage.EXPECT().Delete(ctx, oldGarbageDigest).Return(nil)
+
+	garbageCollector := gc.NewGarbageCollector(contentAddressableStorage, actionCache, 24*time.Hour, false)
+	require.NoError(t, garbageCollector.Run(ctx))
+}
+
+func TestGarbageCollectorDryRun(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// In dry-run mode, no calls to Delete() should be made.
+	contentAddressableStorage, actionCache, _, _ := setUpGarbageCollectorTest(t, ctrl, time.Now())
+
+	garbageCollector := gc.NewGarbageCollector(contentAddressableStorage, actionCache, 24*time.Hour, true)
+	require.NoError(t, garbageCollector.Run(ctx))
+}
@@ -0,0 +1,134 @@
+package global
+
+import (
+	"context"
+	"strings"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	concurrencyLimiterRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "global",
+			Name:      "concurrency_limiter_requests_total",
+			Help:      "Total number of gRPC requests subject to concurrency limits, and whether they were queued or rejected.",
+		},
+		[]string{"name", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(concurrencyLimiterRequestsTotal)
+}
+
+// concurrencyLimiter limits the number of requests that may be
+// processed concurrently. Requests exceeding the limit are queued,
+// until the queue is full. Past that point, requests are shed.
+type concurrencyLimiter struct {
+	slots chan struct{}
+	queue chan struct{}
+
+	requestsImmediate prometheus.Counter
+	requestsQueued    prometheus.Counter
+	requestsRejected  prometheus.Counter
+}
+
+func newConcurrencyLimiter(name string, configuration *pb.ConcurrencyLimitConfiguration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots: make(chan struct{}, configuration.MaxConcurrent),
+		queue: make(chan struct{}, configuration.MaxQueued),
+
+		requestsImmediate: concurrencyLimiterRequestsTotal.WithLabelValues(name, "Immediate"),
+		requestsQueued:    concurrencyLimiterRequestsTotal.WithLabelValues(name, "Queued"),
+		requestsRejected:  concurrencyLimiterRequestsTotal.WithLabelValues(name, "Rejected"),
+	}
+}
+
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		l.requestsImmediate.Inc()
+		return nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		l.requestsRejected.Inc()
+		return status.Error(codes.ResourceExhausted, "Too many concurrent requests, please try again later")
+	}
+	defer func() {
+		<-l.queue
+	}()
+	l.requestsQueued.Inc()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return util.StatusFromContext(ctx)
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+// concurrencyLimiters holds the limiters of a gRPC server, keyed by
+// service name (e.g., "google.bytestream.ByteStream") or method name
+// (e.g., "google.bytestream.ByteStream/Read").
+type concurrencyLimiters map[string]*concurrencyLimiter
+
+func newConcurrencyLimiters(configurations map[string]*pb.ConcurrencyLimitConfiguration) concurrencyLimiters {
+	limiters := concurrencyLimiters{}
+	for name, configuration := range configurations {
+		limiters[name] = newConcurrencyLimiter(name, configuration)
+	}
+	return limiters
+}
+
+// getLimiter returns the limiter that applies to a full gRPC method
+// name (e.g., "/google.bytestream.ByteStream/Read"). Limiters for
+// individual methods take precedence over ones for entire services.
+func (ls concurrencyLimiters) getLimiter(fullMethod string) *concurrencyLimiter {
+	method := strings.TrimPrefix(fullMethod, "/")
+	if l, ok := ls[method]; ok {
+		return l
+	}
+	if i := strings.LastIndexByte(method, '/'); i >= 0 {
+		return ls[method[:i]]
+	}
+	return nil
+}
+
+func (ls concurrencyLimiters) unaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	l := ls.getLimiter(info.FullMethod)
+	if l == nil {
+		return handler(ctx, req)
+	}
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer l.release()
+	return handler(ctx, req)
+}
+
+func (ls concurrencyLimiters) streamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	l := ls.getLimiter(info.FullMethod)
+	if l == nil {
+		return handler(srv, ss)
+	}
+	if err := l.acquire(ss.Context()); err != nil {
+		return err
+	}
+	defer l.release()
+	return handler(srv, ss)
+}
@@ -0,0 +1,149 @@
+package global
+
+import (
+	_ "expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime/pprof"
+	"strings"
+	"syscall"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/tracing"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnmarshalConfigurationFromFile reads a configuration file into a
+// Protobuf message. Files whose name ends with ".json" are parsed as
+// JSON. All other files are parsed using the Protobuf text format.
+func UnmarshalConfigurationFromFile(path string, configuration proto.Message) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to read configuration file %#v", path)
+	}
+	if strings.HasSuffix(path, ".json") {
+		err = jsonpb.UnmarshalString(string(data), configuration)
+	} else {
+		err = proto.UnmarshalText(string(data), configuration)
+	}
+	if err != nil {
+		return util.StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to parse configuration file %#v", path)
+	}
+	return nil
+}
+
+// ApplyDiagnosticsConfiguration configures logging and tracing, and
+// launches an HTTP server that exposes Prometheus metrics, profiling
+// information and expvar variables. It may also install a handler
+// that dumps the stack traces of all goroutines upon SIGQUIT.
+func ApplyDiagnosticsConfiguration(serviceName string, configuration *pb.DiagnosticsConfiguration) error {
+	logFormat := configuration.GetLogFormat()
+	if logFormat == "" {
+		logFormat = "text"
+	}
+	if err := logging.Configure(logFormat); err != nil {
+		return util.StatusWrap(err, "Failed to configure logging")
+	}
+
+	tracingConfiguration := configuration.GetTracing()
+	if err := tracing.Configure(serviceName, tracingConfiguration.GetOtlpEndpoint(), tracingConfiguration.GetSamplingProbability()); err != nil {
+		return util.StatusWrap(err, "Failed to configure tracing")
+	}
+
+	if httpListenAddress := configuration.GetHttpListenAddress(); httpListenAddress != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			logrus.Fatal(http.ListenAndServe(httpListenAddress, nil))
+		}()
+	}
+
+	if goroutineDumpPath := configuration.GetGoroutineDumpPath(); goroutineDumpPath != "" {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGQUIT)
+		go func() {
+			for range signals {
+				if err := writeGoroutineDump(goroutineDumpPath); err != nil {
+					logrus.WithError(err).Error("Failed to write goroutine dump")
+				} else {
+					logrus.WithField("path", goroutineDumpPath).Info("Wrote goroutine dump")
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// writeGoroutineDump writes the stack traces of all goroutines to a
+// file, using the same format as the one used by the Go runtime when
+// terminating upon SIGQUIT.
+func writeGoroutineDump(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ConfigurationErrors collects problems detected while validating a
+// configuration file, so that all of them can be reported at once.
+type ConfigurationErrors []string
+
+// Require records an error for a field if a condition does not hold.
+func (e *ConfigurationErrors) Require(condition bool, field string, message string) {
+	if !condition {
+		*e = append(*e, field+": "+message)
+	}
+}
+
+// Err returns an error that lists all problems that were detected, or
+// nil if the configuration is valid.
+func (e ConfigurationErrors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "Invalid configuration:\n  %s", strings.Join(e, "\n  "))
+}
+
+// ValidateServerConfiguration checks that the configuration of a gRPC
+// server is complete.
+func (e *ConfigurationErrors) ValidateServerConfiguration(field string, configuration *pb.ServerConfiguration) {
+	e.Require(configuration.GetListenAddress() != "", field+".listen_address", "must be set")
+	if tls := configuration.GetTls(); tls != nil {
+		e.Require(tls.CertificatePath != "", field+".tls.certificate_path", "must be set when TLS is enabled")
+		e.Require(tls.PrivateKeyPath != "", field+".tls.private_key_path", "must be set when TLS is enabled")
+	}
+	for name, limit := range configuration.GetConcurrencyLimits() {
+		limitField := fmt.Sprintf("%s.concurrency_limits[%#v]", field, name)
+		e.Require(limit.GetMaxConcurrent() > 0, limitField+".max_concurrent", "must be positive")
+		e.Require(limit.GetMaxQueued() >= 0, limitField+".max_queued", "must be non-negative")
+	}
+}
+
+// NewDigestFunctionPolicyFromConfiguration creates a
+// DigestFunctionPolicy that limits the hashing algorithms clients may
+// use. All supported algorithms are permitted if no configuration is
+// provided.
+func NewDigestFunctionPolicyFromConfiguration(configuration *pb.DigestFunctionConfiguration) (*util.DigestFunctionPolicy, error) {
+	perInstanceDigestFunctions := map[string][]remoteexecution.DigestFunction{}
+	for instance, instanceConfiguration := range configuration.GetPerInstanceDigestFunctions() {
+		perInstanceDigestFunctions[instance] = instanceConfiguration.DigestFunctions
+	}
+	return util.NewDigestFunctionPolicy(configuration.GetDefaultDigestFunctions(), perInstanceDigestFunctions)
+}
@@ -0,0 +1,149 @@
+package global_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/global"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/global"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnmarshalConfigurationFromFile(t *testing.T) {
+	directory, err := ioutil.TempDir("", "configuration")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	writeFile := func(name string, contents string) string {
+		path := filepath.Join(directory, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0666))
+		return path
+	}
+	expected := &pb.DiagnosticsConfiguration{
+		HttpListenAddress: ":80",
+		LogFormat:         "json",
+		Tracing: &pb.TracingConfiguration{
+			SamplingProbability: 0.5,
+		},
+	}
+
+	t.Run("Text", func(t *testing.T) {
+		var configuration pb.DiagnosticsConfiguration
+		require.NoError(t, global.UnmarshalConfigurationFromFile(
+			writeFile("diagnostics.conf", "http_listen_address: \":80\"\nlog_format: \"json\"\ntracing { sampling_probability: 0.5 }\n"),
+			&configuration))
+		require.True(t, proto.Equal(expected, &configuration))
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		var configuration pb.DiagnosticsConfiguration
+		require.NoError(t, global.UnmarshalConfigurationFromFile(
+			writeFile("diagnostics.json", "{\"httpListenAddress\": \":80\", \"logFormat\": \"json\", \"tracing\": {\"samplingProbability\": 0.5}}"),
+			&configuration))
+		require.True(t, proto.Equal(expected, &configuration))
+	})
+
+	t.Run("ParseFailure", func(t *testing.T) {
+		// Unknown fields should be rejected, so that typos
+		// don't go unnoticed.
+		path := writeFile("invalid.conf", "http_listen_addres: \":80\"\n")
+		var configuration pb.DiagnosticsConfiguration
+		err := global.UnmarshalConfigurationFromFile(path, &configuration)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+		require.True(t, strings.HasPrefix(status.Convert(err).Message(), "Failed to parse configuration file \""+path+"\": "))
+	})
+
+	t.Run("NonExistent", func(t *testing.T) {
+		path := filepath.Join(directory, "nonexistent.conf")
+		var configuration pb.DiagnosticsConfiguration
+		err := global.UnmarshalConfigurationFromFile(path, &configuration)
+		require.True(t, strings.HasPrefix(status.Convert(err).Message(), "Failed to read configuration file \""+path+"\": "))
+	})
+}
+
+func TestConfigurationErrors(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		var errs global.ConfigurationErrors
+		errs.Require(true, "listen_address", "must be set")
+		errs.ValidateServerConfiguration("grpc_server", &pb.ServerConfiguration{
+			ListenAddress: ":8981",
+		})
+		require.NoError(t, errs.Err())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		// All problems should be reported at once.
+		var errs global.ConfigurationErrors
+		errs.Require(false, "blobstore", "must be set")
+		errs.ValidateServerConfiguration("grpc_server", &pb.ServerConfiguration{
+			Tls: &pb.TLSServerConfiguration{
+				CertificatePath: "/etc/ssl/server.crt",
+			},
+		})
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Invalid configuration:\n  blobstore: must be set\n  grpc_server.listen_address: must be set\n  grpc_server.tls.private_key_path: must be set when TLS is enabled"),
+			errs.Err())
+	})
+
+	t.Run("ConcurrencyLimits", func(t *testing.T) {
+		var errs global.ConfigurationErrors
+		errs.ValidateServerConfiguration("grpc_server", &pb.ServerConfiguration{
+			ListenAddress: ":8981",
+			ConcurrencyLimits: map[string]*pb.ConcurrencyLimitConfiguration{
+				"google.bytestream.ByteStream/Read": {MaxConcurrent: 0, MaxQueued: -1},
+			},
+		})
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Invalid configuration:\n  grpc_server.concurrency_limits[\"google.bytestream.ByteStream/Read\"].max_concurrent: must be positive\n  grpc_server.concurrency_limits[\"google.bytestream.ByteStream/Read\"].max_queued: must be non-negative"),
+			errs.Err())
+	})
+}
+
+func TestApplyDiagnosticsConfiguration(t *testing.T) {
+	directory, err := ioutil.TempDir("", "diagnostics")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+	goroutineDumpPath := filepath.Join(directory, "goroutines.txt")
+
+	require.NoError(t, global.ApplyDiagnosticsConfiguration("test", &pb.DiagnosticsConfiguration{
+		GoroutineDumpPath: goroutineDumpPath,
+	}))
+
+	t.Run("DebugHandlers", func(t *testing.T) {
+		// Profiling information and expvar variables should be
+		// registered with the default HTTP handler.
+		for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+			w := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			require.Equal(t, http.StatusOK, w.Code, path)
+		}
+	})
+
+	t.Run("GoroutineDump", func(t *testing.T) {
+		// SIGQUIT should cause stack traces to be written to
+		// the configured path, instead of terminating the
+		// process.
+		require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGQUIT))
+		for deadline := time.Now().Add(10 * time.Second); ; {
+			data, err := ioutil.ReadFile(goroutineDumpPath)
+			if err == nil && strings.Contains(string(data), "TestApplyDiagnosticsConfiguration") {
+				break
+			}
+			require.True(t, time.Now().Before(deadline), "Goroutine dump was not written")
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
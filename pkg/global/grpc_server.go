@@ -0,0 +1,60 @@
+package global
+
+import (
+	"context"
+	"net"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/tracing"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// NewGRPCServer creates a gRPC server that is instrumented with
+// Prometheus metrics and tracing. TLS and concurrency limits are
+// enabled if configured.
+func NewGRPCServer(configuration *pb.ServerConfiguration) (*grpc.Server, error) {
+	streamInterceptor := grpc_prometheus.StreamServerInterceptor
+	unaryInterceptor := grpc_prometheus.UnaryServerInterceptor
+	if limits := configuration.GetConcurrencyLimits(); len(limits) > 0 {
+		// Apply limits underneath the Prometheus interceptors,
+		// so that shed requests are still accounted.
+		limiters := newConcurrencyLimiters(limits)
+		streamInterceptor = func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return grpc_prometheus.StreamServerInterceptor(srv, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+				return limiters.streamServerInterceptor(srv, ss, info, handler)
+			})
+		}
+		unaryInterceptor = func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return grpc_prometheus.UnaryServerInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return limiters.unaryServerInterceptor(ctx, req, info, handler)
+			})
+		}
+	}
+	options := tracing.NewServerOptions(unaryInterceptor, streamInterceptor)
+	if tls := configuration.GetTls(); tls != nil {
+		creds, err := credentials.NewServerTLSFromFile(tls.CertificatePath, tls.PrivateKeyPath)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to load server certificate")
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	return grpc.NewServer(options...), nil
+}
+
+// ServeGRPC registers the metrics of a gRPC server and lets it accept
+// connections on the configured address. This function only returns
+// when serving fails.
+func ServeGRPC(s *grpc.Server, configuration *pb.ServerConfiguration) error {
+	grpc_prometheus.EnableHandlingTimeHistogram()
+	grpc_prometheus.Register(s)
+
+	sock, err := net.Listen("tcp", configuration.GetListenAddress())
+	if err != nil {
+		return util.StatusWrap(err, "Failed to create listening socket")
+	}
+	return s.Serve(sock)
+}
@@ -0,0 +1,113 @@
+package global_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/global"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/global"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// getConcurrencyLimiterRequests returns the number of requests
+// processed by a concurrency limiter with a given result.
+func getConcurrencyLimiterRequests(t *testing.T, name string, result string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "buildbarn_global_concurrency_limiter_requests_total" {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["name"] == name && labels["result"] == result {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestNewGRPCServerConcurrencyLimits(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Limit FindMissingBlobs() to a single request at a time,
+	// with room for a single request to be queued. Other methods
+	// of the same service use a separate limit.
+	const serviceName = "build.bazel.remote.execution.v2.ContentAddressableStorage"
+	const methodName = serviceName + "/FindMissingBlobs"
+	server, err := global.NewGRPCServer(&pb.ServerConfiguration{
+		ConcurrencyLimits: map[string]*pb.ConcurrencyLimitConfiguration{
+			serviceName: {MaxConcurrent: 1},
+			methodName:  {MaxConcurrent: 1, MaxQueued: 1},
+		},
+	})
+	require.NoError(t, err)
+	contentAddressableStorageServer := mock.NewMockContentAddressableStorageServer(ctrl)
+	remoteexecution.RegisterContentAddressableStorageServer(server, contentAddressableStorageServer)
+	l := bufconn.Listen(1 << 20)
+	go server.Serve(l)
+	defer server.Stop()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := remoteexecution.NewContentAddressableStorageClient(conn)
+
+	// Let the first request block inside the handler.
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	contentAddressableStorageServer.EXPECT().FindMissingBlobs(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, in *remoteexecution.FindMissingBlobsRequest) (*remoteexecution.FindMissingBlobsResponse, error) {
+			started <- struct{}{}
+			<-release
+			return &remoteexecution.FindMissingBlobsResponse{}, nil
+		}).Times(2)
+	errs := make(chan error, 2)
+	findMissingBlobs := func() {
+		_, err := client.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{})
+		errs <- err
+	}
+	go findMissingBlobs()
+	<-started
+
+	// The second request should end up in the queue.
+	go findMissingBlobs()
+	for deadline := time.Now().Add(10 * time.Second); getConcurrencyLimiterRequests(t, methodName, "Queued") == 0; {
+		require.True(t, time.Now().Before(deadline), "Second request was not queued")
+		time.Sleep(time.Millisecond)
+	}
+
+	// The third request should be shed, as the queue is full.
+	_, err = client.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{})
+	require.Equal(t, status.Error(codes.ResourceExhausted, "Too many concurrent requests, please try again later"), err)
+	require.Equal(t, 1.0, getConcurrencyLimiterRequests(t, methodName, "Rejected"))
+
+	// Other methods of the service should not be affected.
+	contentAddressableStorageServer.EXPECT().BatchReadBlobs(gomock.Any(), gomock.Any()).Return(&remoteexecution.BatchReadBlobsResponse{}, nil)
+	_, err = client.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 1.0, getConcurrencyLimiterRequests(t, serviceName, "Immediate"))
+
+	// Once released, both requests should complete.
+	close(release)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	require.Equal(t, 1.0, getConcurrencyLimiterRequests(t, methodName, "Immediate"))
+}
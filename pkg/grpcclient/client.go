@@ -0,0 +1,126 @@
+package grpcclient
+
+import (
+	"fmt"
+	"time"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/grpcclient"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/tracing"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+)
+
+// NewClientFromConfiguration creates a gRPC client connection to a
+// server, applying message size limits, keepalive parameters and
+// connection pooling as specified in the configuration. A nil
+// configuration causes gRPC's defaults to be used. Connections are
+// instrumented with Prometheus metrics and tracing. Faults may
+// optionally be injected into RPCs for the purpose of soak testing.
+func NewClientFromConfiguration(address string, config *pb.ClientConfiguration) (*grpc.ClientConn, error) {
+	unaryInterceptor := grpc_prometheus.UnaryClientInterceptor
+	streamInterceptor := grpc_prometheus.StreamClientInterceptor
+	if config != nil && config.FaultInjection != nil {
+		if p := config.FaultInjection.ErrorProbability; p < 0 || p > 1 {
+			return nil, status.Error(codes.InvalidArgument, "Fault injection error probability must be in range [0.0, 1.0]")
+		}
+		var maximumDelay time.Duration
+		if config.FaultInjection.MaximumDelay != nil {
+			var err error
+			maximumDelay, err = ptypes.Duration(config.FaultInjection.MaximumDelay)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid fault injection maximum delay")
+			}
+		}
+		injector := util.NewFaultInjector(config.FaultInjection.ErrorProbability, maximumDelay)
+		unaryInterceptor = newFaultInjectingUnaryInterceptor(injector, unaryInterceptor)
+		streamInterceptor = newFaultInjectingStreamInterceptor(injector, streamInterceptor)
+	}
+	options := tracing.NewDialOptions(unaryInterceptor, streamInterceptor)
+	if config == nil {
+		return grpc.Dial(address, append(options, grpc.WithInsecure())...)
+	}
+
+	if tlsConfig := config.Tls; tlsConfig == nil {
+		options = append(options, grpc.WithInsecure())
+	} else if tlsConfig.ServerCertificateAuthorityPath == "" {
+		options = append(options, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, tlsConfig.ServerNameOverride)))
+	} else {
+		creds, err := credentials.NewClientTLSFromFile(tlsConfig.ServerCertificateAuthorityPath, tlsConfig.ServerNameOverride)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to load server certificate authorities")
+		}
+		options = append(options, grpc.WithTransportCredentials(creds))
+	}
+
+	var callOptions []grpc.CallOption
+	if size := config.MaxSendMessageSizeBytes; size > 0 {
+		callOptions = append(callOptions, grpc.MaxCallSendMsgSize(int(size)))
+	}
+	if size := config.MaxRecvMessageSizeBytes; size > 0 {
+		callOptions = append(callOptions, grpc.MaxCallRecvMsgSize(int(size)))
+	}
+	if len(callOptions) > 0 {
+		options = append(options, grpc.WithDefaultCallOptions(callOptions...))
+	}
+
+	if keepaliveConfig := config.Keepalive; keepaliveConfig != nil {
+		var parameters keepalive.ClientParameters
+		if keepaliveConfig.Time != nil {
+			keepaliveTime, err := ptypes.Duration(keepaliveConfig.Time)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid keepalive time")
+			}
+			parameters.Time = keepaliveTime
+		}
+		if keepaliveConfig.Timeout != nil {
+			timeout, err := ptypes.Duration(keepaliveConfig.Timeout)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid keepalive timeout")
+			}
+			parameters.Timeout = timeout
+		}
+		parameters.PermitWithoutStream = keepaliveConfig.PermitWithoutStream
+		options = append(options, grpc.WithKeepaliveParams(parameters))
+	}
+
+	if poolSize := int(config.ConnectionPoolSize); poolSize > 1 {
+		// gRPC only creates a single connection per address. Let
+		// a resolver return the same address multiple times,
+		// made distinct through metadata, so that the round
+		// robin balancer creates multiple connections. The
+		// resolver is never unregistered, as it is used for the
+		// lifetime of the connection.
+		r, _ := manual.GenerateAndRegisterManualResolver()
+		var addresses []resolver.Address
+		for i := 0; i < poolSize; i++ {
+			addresses = append(addresses, resolver.Address{
+				Addr:     address,
+				Metadata: i,
+			})
+		}
+		r.InitialAddrs(addresses)
+		options = append(options, grpc.WithBalancerName(roundrobin.Name))
+		address = fmt.Sprintf("%s:///%s", r.Scheme(), address)
+	}
+	return grpc.Dial(address, options...)
+}
+
+// NewClientFromEndpointConfiguration is identical to
+// NewClientFromConfiguration, except that the address of the server
+// is obtained from the configuration message as well.
+func NewClientFromEndpointConfiguration(config *pb.EndpointConfiguration) (*grpc.ClientConn, error) {
+	if config == nil {
+		return nil, status.Error(codes.InvalidArgument, "No endpoint configuration provided")
+	}
+	return NewClientFromConfiguration(config.Address, config.Client)
+}
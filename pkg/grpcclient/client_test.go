@@ -0,0 +1,153 @@
+package grpcclient_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/grpcclient"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/grpcclient"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// newContentAddressableStorageServer launches a gRPC server on a
+// loopback address, returning the address on which it listens.
+func newContentAddressableStorageServer(t *testing.T, contentAddressableStorageServer remoteexecution.ContentAddressableStorageServer) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	remoteexecution.RegisterContentAddressableStorageServer(server, contentAddressableStorageServer)
+	go server.Serve(l)
+	return l.Addr().String(), server.Stop
+}
+
+func TestNewClientFromConfigurationMessageSizes(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	contentAddressableStorageServer := mock.NewMockContentAddressableStorageServer(ctrl)
+	address, cleanup := newContentAddressableStorageServer(t, contentAddressableStorageServer)
+	defer cleanup()
+
+	conn, err := grpcclient.NewClientFromConfiguration(address, &pb.ClientConfiguration{
+		MaxSendMessageSizeBytes: 100,
+		MaxRecvMessageSizeBytes: 200,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	client := remoteexecution.NewContentAddressableStorageClient(conn)
+
+	t.Run("SendTooLarge", func(t *testing.T) {
+		// Requests exceeding the limit should not be sent.
+		_, err := client.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+			InstanceName: strings.Repeat("x", 100),
+		})
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("ReceiveTooLarge", func(t *testing.T) {
+		contentAddressableStorageServer.EXPECT().FindMissingBlobs(gomock.Any(), gomock.Any()).Return(&remoteexecution.FindMissingBlobsResponse{
+			MissingBlobDigests: []*remoteexecution.Digest{
+				{Hash: strings.Repeat("0", 64), SizeBytes: 1},
+				{Hash: strings.Repeat("1", 64), SizeBytes: 1},
+				{Hash: strings.Repeat("2", 64), SizeBytes: 1},
+			},
+		}, nil)
+		_, err := client.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{})
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		contentAddressableStorageServer.EXPECT().FindMissingBlobs(gomock.Any(), gomock.Any()).Return(&remoteexecution.FindMissingBlobsResponse{
+			MissingBlobDigests: []*remoteexecution.Digest{
+				{Hash: strings.Repeat("0", 64), SizeBytes: 1},
+			},
+		}, nil)
+		response, err := client.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{})
+		require.NoError(t, err)
+		require.Len(t, response.MissingBlobDigests, 1)
+	})
+}
+
+func TestNewClientFromConfigurationConnectionPool(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Track the addresses of the clients calling into the server.
+	var lock sync.Mutex
+	clientAddresses := map[string]bool{}
+	contentAddressableStorageServer := mock.NewMockContentAddressableStorageServer(ctrl)
+	contentAddressableStorageServer.EXPECT().FindMissingBlobs(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, in *remoteexecution.FindMissingBlobsRequest) (*remoteexecution.FindMissingBlobsResponse, error) {
+			p, ok := peer.FromContext(ctx)
+			require.True(t, ok)
+			lock.Lock()
+			clientAddresses[p.Addr.String()] = true
+			lock.Unlock()
+			return &remoteexecution.FindMissingBlobsResponse{}, nil
+		}).AnyTimes()
+	address, cleanup := newContentAddressableStorageServer(t, contentAddressableStorageServer)
+	defer cleanup()
+
+	conn, err := grpcclient.NewClientFromConfiguration(address, &pb.ClientConfiguration{
+		ConnectionPoolSize: 3,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	client := remoteexecution.NewContentAddressableStorageClient(conn)
+
+	// Requests should eventually be spread across three separate
+	// connections, as the round robin balancer only uses
+	// connections once they are ready.
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		_, err := client.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{})
+		require.NoError(t, err)
+		lock.Lock()
+		count := len(clientAddresses)
+		lock.Unlock()
+		if count == 3 || time.Now().After(deadline) {
+			require.Equal(t, 3, count)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewClientFromConfigurationInvalid(t *testing.T) {
+	t.Run("KeepaliveTime", func(t *testing.T) {
+		_, err := grpcclient.NewClientFromConfiguration("localhost:8980", &pb.ClientConfiguration{
+			Keepalive: &pb.KeepaliveConfiguration{
+				Time: &duration.Duration{Nanos: 2000000000},
+			},
+		})
+		require.Error(t, err)
+		require.True(t, strings.HasPrefix(status.Convert(err).Message(), "Invalid keepalive time: "))
+	})
+
+	t.Run("KeepaliveTimeout", func(t *testing.T) {
+		_, err := grpcclient.NewClientFromConfiguration("localhost:8980", &pb.ClientConfiguration{
+			Keepalive: &pb.KeepaliveConfiguration{
+				Timeout: &duration.Duration{Nanos: 2000000000},
+			},
+		})
+		require.Error(t, err)
+		require.True(t, strings.HasPrefix(status.Convert(err).Message(), "Invalid keepalive timeout: "))
+	})
+
+	t.Run("NoEndpoint", func(t *testing.T) {
+		_, err := grpcclient.NewClientFromEndpointConfiguration(nil)
+		require.Equal(t, status.Error(codes.InvalidArgument, "No endpoint configuration provided"), err)
+	})
+}
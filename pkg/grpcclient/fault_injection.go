@@ -0,0 +1,39 @@
+package grpcclient
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc"
+)
+
+// newFaultInjectingUnaryInterceptor wraps a gRPC client interceptor,
+// causing unary RPCs to be delayed and failed randomly. Faults are
+// injected underneath the wrapped interceptor, so that they show up in
+// client-side metrics as if they were returned by the server.
+func newFaultInjectingUnaryInterceptor(injector *util.FaultInjector, base grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return base(ctx, method, req, reply, cc, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			if err := injector.Inject(ctx, method); err != nil {
+				return err
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}, opts...)
+	}
+}
+
+// newFaultInjectingStreamInterceptor is the streaming counterpart of
+// newFaultInjectingUnaryInterceptor. Faults are only injected while
+// creating streams, as opposed to while sending and receiving
+// messages.
+func newFaultInjectingStreamInterceptor(injector *util.FaultInjector, base grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return base(ctx, desc, cc, method, func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			if err := injector.Inject(ctx, method); err != nil {
+				return nil, err
+			}
+			return streamer(ctx, desc, cc, method, opts...)
+		}, opts...)
+	}
+}
@@ -0,0 +1,90 @@
+package healthcheck
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Check is a function that returns an error if a dependency of the
+// process is unhealthy.
+type Check func(ctx context.Context) error
+
+// NewConnectionCheck creates a Check that fails if a GRPC client
+// connection is unable to connect to its backend.
+func NewConnectionCheck(conn *grpc.ClientConn) Check {
+	return func(ctx context.Context) error {
+		switch state := conn.GetState(); state {
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return status.Errorf(codes.Unavailable, "Connection is in state %s", state)
+		}
+		return nil
+	}
+}
+
+// emptyBlobDigest is the digest of the empty blob. It is queried to
+// test whether storage backends are reachable.
+var emptyBlobDigest = util.MustNewDigest("", &remoteexecution.Digest{
+	Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	SizeBytes: 0,
+})
+
+// NewBlobAccessCheck creates a Check that fails if a storage backend
+// cannot be reached. Backends that don't support bulk existence
+// checking (e.g., Action Caches accessed over GRPC) are probed by
+// loading the empty blob instead.
+func NewBlobAccessCheck(blobAccess blobstore.BlobAccess) Check {
+	return func(ctx context.Context) error {
+		_, err := blobAccess.FindMissing(ctx, []*util.Digest{emptyBlobDigest})
+		if status.Code(err) == codes.Unimplemented {
+			var r io.ReadCloser
+			if _, r, err = blobAccess.Get(ctx, emptyBlobDigest); err == nil {
+				r.Close()
+			} else if status.Code(err) == codes.NotFound {
+				err = nil
+			}
+		}
+		if err != nil && status.Code(err) != codes.InvalidArgument {
+			// Storage that rejects the request is reachable,
+			// but may not accept the empty instance name.
+			return err
+		}
+		return nil
+	}
+}
+
+// Register adds the GRPC health checking service to a GRPC server. The
+// server is reported to be serving only if all checks pass. Checks are
+// evaluated periodically.
+func Register(s *grpc.Server, interval time.Duration, checks map[string]Check) {
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, healthServer)
+	go func() {
+		for {
+			servingStatus := grpc_health_v1.HealthCheckResponse_SERVING
+			for name, check := range checks {
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				err := check(ctx)
+				cancel()
+				if err != nil {
+					logrus.WithField("check", name).WithError(err).Warn("Health check failed")
+					servingStatus = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+				}
+			}
+			healthServer.SetServingStatus("", servingStatus)
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package healthcheck_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/healthcheck"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBlobAccessCheckContentAddressableStorage(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	check := healthcheck.NewBlobAccessCheck(blobAccess)
+
+	t.Run("Success", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(ctx, gomock.Len(1)).Return(nil, nil)
+		require.NoError(t, check(ctx))
+	})
+
+	t.Run("InvalidInstanceName", func(t *testing.T) {
+		// Storage that rejects the empty instance name is
+		// still reachable.
+		blobAccess.EXPECT().FindMissing(ctx, gomock.Len(1)).Return(nil, status.Error(codes.InvalidArgument, "Unknown instance name"))
+		require.NoError(t, check(ctx))
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(ctx, gomock.Len(1)).Return(nil, status.Error(codes.Unavailable, "Server not reachable"))
+		require.Equal(t, status.Error(codes.Unavailable, "Server not reachable"), check(ctx))
+	})
+}
+
+func TestBlobAccessCheckActionCache(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Action Caches accessed over GRPC don't support FindMissing().
+	// They should be probed by loading the empty blob.
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	check := healthcheck.NewBlobAccessCheck(blobAccess)
+	findMissingUnimplemented := status.Error(codes.Unimplemented, "Bazel action cache does not support bulk existence checking")
+
+	t.Run("NotFound", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(ctx, gomock.Len(1)).Return(nil, findMissingUnimplemented)
+		blobAccess.EXPECT().Get(ctx, gomock.Any()).Return(int64(0), nil, status.Error(codes.NotFound, "Action result not found"))
+		require.NoError(t, check(ctx))
+	})
+
+	t.Run("Found", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(ctx, gomock.Len(1)).Return(nil, findMissingUnimplemented)
+		blobAccess.EXPECT().Get(ctx, gomock.Any()).Return(int64(0), ioutil.NopCloser(&bytes.Buffer{}), nil)
+		require.NoError(t, check(ctx))
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(ctx, gomock.Len(1)).Return(nil, findMissingUnimplemented)
+		blobAccess.EXPECT().Get(ctx, gomock.Any()).Return(int64(0), nil, status.Error(codes.Unavailable, "Server not reachable"))
+		require.Equal(t, status.Error(codes.Unavailable, "Server not reachable"), check(ctx))
+	})
+}
@@ -0,0 +1,66 @@
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/history"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+)
+
+// GetOutputFingerprint computes a fingerprint of the outputs of an
+// action. Execution metadata and logs are not taken into account, as
+// these are expected to differ between executions.
+func GetOutputFingerprint(actionResult *remoteexecution.ActionResult) string {
+	data, err := proto.Marshal(&remoteexecution.ActionResult{
+		OutputFiles:             actionResult.OutputFiles,
+		OutputFileSymlinks:      actionResult.OutputFileSymlinks,
+		OutputDirectories:       actionResult.OutputDirectories,
+		OutputDirectorySymlinks: actionResult.OutputDirectorySymlinks,
+		OutputSymlinks:          actionResult.OutputSymlinks,
+		ExitCode:                actionResult.ExitCode,
+	})
+	if err != nil {
+		return ""
+	}
+	fingerprint := sha256.Sum256(data)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// Analysis contains the conclusions that can be drawn from the
+// execution history of an action.
+type Analysis struct {
+	// The action both succeeded and failed, meaning it is flaky.
+	IntermittentFailures bool
+	// Successful executions of the action yielded different
+	// outputs, meaning the action is not deterministic.
+	NonDeterministicOutputs bool
+}
+
+// IsFlaky returns whether any problems were detected.
+func (a *Analysis) IsFlaky() bool {
+	return a.IntermittentFailures || a.NonDeterministicOutputs
+}
+
+// Analyze the execution history of an action to detect flakiness.
+func Analyze(history *pb.ExecutionHistory) Analysis {
+	var analysis Analysis
+	succeeded, failed := false, false
+	fingerprints := map[string]bool{}
+	for _, outcome := range history.GetOutcomes() {
+		if codes.Code(outcome.Status.GetCode()) != codes.OK || outcome.ExitCode != 0 {
+			failed = true
+		} else {
+			succeeded = true
+			if outcome.OutputFingerprint != "" {
+				fingerprints[outcome.OutputFingerprint] = true
+			}
+		}
+	}
+	analysis.IntermittentFailures = succeeded && failed
+	analysis.NonDeterministicOutputs = len(fingerprints) > 1
+	return analysis
+}
@@ -0,0 +1,51 @@
+package history_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/history"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/history"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+func TestAnalyze(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		analysis := history.Analyze(&pb.ExecutionHistory{})
+		require.False(t, analysis.IsFlaky())
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		analysis := history.Analyze(&pb.ExecutionHistory{
+			Outcomes: []*pb.ExecutionOutcome{
+				{OutputFingerprint: "a"},
+				{OutputFingerprint: "a"},
+				{ExitCode: 1, OutputFingerprint: "b"},
+			},
+		})
+		require.Equal(t, history.Analysis{IntermittentFailures: true}, analysis)
+	})
+
+	t.Run("NonDeterministic", func(t *testing.T) {
+		analysis := history.Analyze(&pb.ExecutionHistory{
+			Outcomes: []*pb.ExecutionOutcome{
+				{OutputFingerprint: "a"},
+				{OutputFingerprint: "b"},
+			},
+		})
+		require.Equal(t, history.Analysis{NonDeterministicOutputs: true}, analysis)
+	})
+
+	t.Run("ConsistentFailures", func(t *testing.T) {
+		// Actions that fail all the time are not flaky.
+		analysis := history.Analyze(&pb.ExecutionHistory{
+			Outcomes: []*pb.ExecutionOutcome{
+				{ExitCode: 1},
+				{Status: &status.Status{Code: int32(codes.DeadlineExceeded)}},
+			},
+		})
+		require.False(t, analysis.IsFlaky())
+	})
+}
@@ -0,0 +1,80 @@
+package history
+
+import (
+	"context"
+	"io/ioutil"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/history"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ExecutionHistoryStore provides access to the outcomes of recent
+// executions of actions, keyed by action digest.
+type ExecutionHistoryStore interface {
+	GetExecutionHistory(ctx context.Context, actionDigest *util.Digest) (*pb.ExecutionHistory, error)
+	AppendExecutionOutcome(ctx context.Context, actionDigest *util.Digest, outcome *pb.ExecutionOutcome) (*pb.ExecutionHistory, error)
+}
+
+type blobAccessExecutionHistoryStore struct {
+	blobAccess  blobstore.BlobAccess
+	outcomesMax int
+}
+
+// NewBlobAccessExecutionHistoryStore creates an ExecutionHistoryStore
+// that stores execution histories in a BlobAccess. Only the most recent
+// outcomes are retained per action.
+//
+// Appending outcomes is implemented as a read-modify-write cycle.
+// Outcomes of actions that complete simultaneously may thus get lost,
+// which is acceptable for the purpose of detecting flakiness.
+func NewBlobAccessExecutionHistoryStore(blobAccess blobstore.BlobAccess, outcomesMax int) ExecutionHistoryStore {
+	return &blobAccessExecutionHistoryStore{
+		blobAccess:  blobAccess,
+		outcomesMax: outcomesMax,
+	}
+}
+
+func (hs *blobAccessExecutionHistoryStore) GetExecutionHistory(ctx context.Context, actionDigest *util.Digest) (*pb.ExecutionHistory, error) {
+	_, r, err := hs.blobAccess.Get(ctx, actionDigest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	var history pb.ExecutionHistory
+	if err := proto.Unmarshal(data, &history); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.NotFound, "Failed to unmarshal execution history")
+	}
+	return &history, nil
+}
+
+func (hs *blobAccessExecutionHistoryStore) AppendExecutionOutcome(ctx context.Context, actionDigest *util.Digest, outcome *pb.ExecutionOutcome) (*pb.ExecutionHistory, error) {
+	history, err := hs.GetExecutionHistory(ctx, actionDigest)
+	if status.Code(err) == codes.NotFound {
+		history = &pb.ExecutionHistory{}
+	} else if err != nil {
+		return nil, util.StatusWrap(err, "Failed to obtain execution history")
+	}
+
+	history.Outcomes = append(history.Outcomes, outcome)
+	if len(history.Outcomes) > hs.outcomesMax {
+		history.Outcomes = history.Outcomes[len(history.Outcomes)-hs.outcomesMax:]
+	}
+
+	data, err := proto.Marshal(history)
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to marshal execution history")
+	}
+	if err := hs.blobAccess.Put(ctx, actionDigest, int64(len(data)), blobstore.NewBytesReader(data)); err != nil {
+		return nil, util.StatusWrap(err, "Failed to store execution history")
+	}
+	return history, nil
+}
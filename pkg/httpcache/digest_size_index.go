@@ -0,0 +1,65 @@
+package httpcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+type digestSizeIndexEntry struct {
+	hash      string
+	sizeBytes int64
+}
+
+// digestSizeIndex keeps track of the sizes of a bounded number of
+// recently observed blobs, keyed by their hash. Entries are evicted in
+// least recently used order.
+type digestSizeIndex struct {
+	lock       sync.Mutex
+	maxEntries int
+
+	// Entries, ordered from most recently used (front) to least
+	// recently used (back).
+	entriesList    *list.List
+	entriesPresent map[string]*list.Element
+}
+
+func newDigestSizeIndex(maxEntries int) *digestSizeIndex {
+	return &digestSizeIndex{
+		maxEntries: maxEntries,
+
+		entriesList:    list.New(),
+		entriesPresent: map[string]*list.Element{},
+	}
+}
+
+func (i *digestSizeIndex) add(hash string, sizeBytes int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if element, ok := i.entriesPresent[hash]; ok {
+		element.Value.(*digestSizeIndexEntry).sizeBytes = sizeBytes
+		i.entriesList.MoveToFront(element)
+		return
+	}
+	for i.entriesList.Len() >= i.maxEntries && i.entriesList.Len() > 0 {
+		element := i.entriesList.Back()
+		delete(i.entriesPresent, element.Value.(*digestSizeIndexEntry).hash)
+		i.entriesList.Remove(element)
+	}
+	i.entriesPresent[hash] = i.entriesList.PushFront(&digestSizeIndexEntry{
+		hash:      hash,
+		sizeBytes: sizeBytes,
+	})
+}
+
+func (i *digestSizeIndex) get(hash string) (int64, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	element, ok := i.entriesPresent[hash]
+	if !ok {
+		return 0, false
+	}
+	i.entriesList.MoveToFront(element)
+	return element.Value.(*digestSizeIndexEntry).sizeBytes, true
+}
@@ -0,0 +1,277 @@
+package httpcache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type server struct {
+	contentAddressableStorage blobstore.BlobAccess
+	actionCache               blobstore.BlobAccess
+	allowActionCacheUpdates   bool
+	sizeIndex                 *digestSizeIndex
+	blobURLProvider           blobstore.BlobURLProvider
+	redirectMinimumSizeBytes  int64
+}
+
+// NewServer creates an HTTP handler that serves the Bazel HTTP caching
+// protocol, backed by the provided BlobAccess objects. Objects are
+// accessed through URLs of the form "/[instance/]{ac,cas}/hash".
+//
+// The HTTP caching protocol identifies objects by hash only, whereas
+// the storage backends also require the size of objects. The sizes of
+// objects in the Content Addressable Storage are therefore tracked by
+// observing uploads and action results returned to clients, retaining
+// up to sizeIndexEntriesMax of them. Objects whose size is unknown are
+// reported as absent. Action Cache entries are stored with a size of
+// zero, meaning they are not shared with clients of the gRPC protocol.
+//
+// If a BlobURLProvider is provided, requests for objects in the
+// Content Addressable Storage that are at least
+// redirectMinimumSizeBytes in size are answered with a redirect to a
+// URL from which the object can be downloaded directly. This requires
+// clients that follow redirects.
+//
+// See: https://docs.bazel.build/versions/master/remote-caching.html#http-caching-protocol
+func NewServer(contentAddressableStorage blobstore.BlobAccess, actionCache blobstore.BlobAccess, allowActionCacheUpdates bool, sizeIndexEntriesMax int, blobURLProvider blobstore.BlobURLProvider, redirectMinimumSizeBytes int64) http.Handler {
+	return &server{
+		contentAddressableStorage: contentAddressableStorage,
+		actionCache:               actionCache,
+		allowActionCacheUpdates:   allowActionCacheUpdates,
+		sizeIndex:                 newDigestSizeIndex(sizeIndexEntriesMax),
+		blobURLProvider:           blobURLProvider,
+		redirectMinimumSizeBytes:  redirectMinimumSizeBytes,
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	components := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(components) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	instance := strings.Join(components[:len(components)-2], "/")
+	hash := components[len(components)-1]
+	switch components[len(components)-2] {
+	case "ac":
+		s.serveActionCache(w, r, instance, hash)
+	case "cas":
+		s.serveContentAddressableStorage(w, r, instance, hash)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) serveActionCache(w http.ResponseWriter, r *http.Request, instance string, hash string) {
+	ctx := r.Context()
+	digest, err := util.NewDigest(instance, &remoteexecution.Digest{Hash: hash})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		_, body, err := s.actionCache.Get(ctx, digest)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var actionResult remoteexecution.ActionResult
+		if err := proto.Unmarshal(data, &actionResult); err != nil {
+			writeError(w, util.StatusWrapWithCode(err, codes.NotFound, "Failed to unmarshal action result"))
+			return
+		}
+		// Learn the sizes of the outputs, so that the client
+		// is able to download them.
+		s.indexActionResult(ctx, instance, &actionResult)
+		writeBlob(w, int64(len(data)), blobstore.NewBytesReader(data))
+	case http.MethodHead:
+		s.serveHead(w, ctx, s.actionCache, digest)
+	case http.MethodPut:
+		if !s.allowActionCacheUpdates {
+			http.Error(w, "This service can only be used to get action results", http.StatusForbidden)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var actionResult remoteexecution.ActionResult
+		if err := proto.Unmarshal(data, &actionResult); err != nil {
+			writeError(w, util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to unmarshal action result"))
+			return
+		}
+		if err := s.actionCache.Put(ctx, digest, int64(len(data)), blobstore.NewBytesReader(data)); err != nil {
+			writeError(w, err)
+			return
+		}
+		s.indexActionResult(ctx, instance, &actionResult)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) serveContentAddressableStorage(w http.ResponseWriter, r *http.Request, instance string, hash string) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		sizeBytes, ok := s.sizeIndex.get(hash)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		digest, err := util.NewDigest(instance, &remoteexecution.Digest{Hash: hash, SizeBytes: sizeBytes})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if r.Method == http.MethodHead {
+			s.serveHead(w, ctx, s.contentAddressableStorage, digest)
+			return
+		}
+		if s.blobURLProvider != nil && sizeBytes >= s.redirectMinimumSizeBytes {
+			url, err := s.blobURLProvider.GetBlobURL(ctx, digest)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+		length, body, err := s.contentAddressableStorage.Get(ctx, digest)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeBlob(w, length, body)
+	case http.MethodPut:
+		if r.ContentLength < 0 {
+			http.Error(w, "Content length required", http.StatusLengthRequired)
+			return
+		}
+		digest, err := util.NewDigest(instance, &remoteexecution.Digest{Hash: hash, SizeBytes: r.ContentLength})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := s.contentAddressableStorage.Put(ctx, digest, r.ContentLength, r.Body); err != nil {
+			writeError(w, err)
+			return
+		}
+		s.sizeIndex.add(hash, r.ContentLength)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) serveHead(w http.ResponseWriter, ctx context.Context, blobAccess blobstore.BlobAccess, digest *util.Digest) {
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	if status.Code(err) == codes.Unimplemented {
+		// Action Caches backed by the REv2 protocol don't
+		// implement FindMissing(). Probe for existence by
+		// loading the object instead.
+		var r io.ReadCloser
+		if _, r, err = blobAccess.Get(ctx, digest); err == nil {
+			r.Close()
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+	} else if len(missing) > 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// indexActionResult records the sizes of all objects referenced by an
+// action result. For output directories, the Tree objects are loaded
+// to obtain the sizes of the files contained within.
+func (s *server) indexActionResult(ctx context.Context, instance string, actionResult *remoteexecution.ActionResult) {
+	for _, outputFile := range actionResult.OutputFiles {
+		s.indexDigest(outputFile.Digest)
+	}
+	for _, outputDirectory := range actionResult.OutputDirectories {
+		s.indexDigest(outputDirectory.TreeDigest)
+		if err := s.indexTree(ctx, instance, outputDirectory.TreeDigest); err != nil {
+			logging.FromContext(ctx).WithError(err).Warn("Failed to index output directory")
+		}
+	}
+	s.indexDigest(actionResult.StdoutDigest)
+	s.indexDigest(actionResult.StderrDigest)
+}
+
+func (s *server) indexTree(ctx context.Context, instance string, partialDigest *remoteexecution.Digest) error {
+	digest, err := util.NewDigest(instance, partialDigest)
+	if err != nil {
+		return err
+	}
+	_, body, err := s.contentAddressableStorage.Get(ctx, digest)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	var tree remoteexecution.Tree
+	if err := proto.Unmarshal(data, &tree); err != nil {
+		return err
+	}
+	for _, directory := range append([]*remoteexecution.Directory{tree.Root}, tree.Children...) {
+		for _, file := range directory.GetFiles() {
+			s.indexDigest(file.Digest)
+		}
+	}
+	return nil
+}
+
+func (s *server) indexDigest(partialDigest *remoteexecution.Digest) {
+	if partialDigest != nil {
+		s.sizeIndex.add(partialDigest.Hash, partialDigest.SizeBytes)
+	}
+}
+
+func writeBlob(w http.ResponseWriter, length int64, body io.ReadCloser) {
+	defer body.Close()
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, body)
+}
+
+// writeError converts a gRPC status error to an HTTP status code.
+func writeError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	code := http.StatusInternalServerError
+	switch s.Code() {
+	case codes.NotFound:
+		code = http.StatusNotFound
+	case codes.InvalidArgument:
+		code = http.StatusBadRequest
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.Unavailable:
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, s.Message(), code)
+}
@@ -0,0 +1,176 @@
+package httpcache_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/httpcache"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerContentAddressableStorage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockBlobAccess(ctrl)
+	actionCache := mock.NewMockBlobAccess(ctrl)
+	server := httpcache.NewServer(contentAddressableStorage, actionCache, false, 100, nil, 0)
+
+	// The size of the blob is not known yet, meaning it cannot be
+	// looked up in storage.
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debian8/cas/8b1a9953c4611296a827abf8c47804d7", nil))
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+
+	// Uploading the blob lets the server learn its size.
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	contentAddressableStorage.EXPECT().Put(gomock.Any(), digest, int64(5), gomock.Any()).Return(nil)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/debian8/cas/8b1a9953c4611296a827abf8c47804d7", bytes.NewBufferString("Hello")))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	contentAddressableStorage.EXPECT().Get(gomock.Any(), digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debian8/cas/8b1a9953c4611296a827abf8c47804d7", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "Hello", recorder.Body.String())
+}
+
+func TestServerContentAddressableStorageRedirect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockBlobAccess(ctrl)
+	actionCache := mock.NewMockBlobAccess(ctrl)
+	blobURLProvider := mock.NewMockBlobURLProvider(ctrl)
+	server := httpcache.NewServer(contentAddressableStorage, actionCache, false, 100, blobURLProvider, 10)
+
+	smallDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	contentAddressableStorage.EXPECT().Put(gomock.Any(), smallDigest, int64(5), gomock.Any()).Return(nil)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/debian8/cas/8b1a9953c4611296a827abf8c47804d7", bytes.NewBufferString("Hello")))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	largeDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	})
+	contentAddressableStorage.EXPECT().Put(gomock.Any(), largeDigest, int64(11), gomock.Any()).Return(nil)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/debian8/cas/3e25960a79dbc69b674cd4ec67a72c62", bytes.NewBufferString("Hello world")))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	// Small objects should be served directly.
+	contentAddressableStorage.EXPECT().Get(gomock.Any(), smallDigest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debian8/cas/8b1a9953c4611296a827abf8c47804d7", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "Hello", recorder.Body.String())
+
+	// Large objects should be served through a redirect.
+	blobURLProvider.EXPECT().GetBlobURL(gomock.Any(), largeDigest).Return("https://s3.example.com/bucket/3e25960a79dbc69b674cd4ec67a72c62-11?X-Amz-Signature=abc", nil)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debian8/cas/3e25960a79dbc69b674cd4ec67a72c62", nil))
+	require.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	require.Equal(t, "https://s3.example.com/bucket/3e25960a79dbc69b674cd4ec67a72c62-11?X-Amz-Signature=abc", recorder.Header().Get("Location"))
+}
+
+func TestServerActionCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockBlobAccess(ctrl)
+	actionCache := mock.NewMockBlobAccess(ctrl)
+	server := httpcache.NewServer(contentAddressableStorage, actionCache, false, 100, nil, 0)
+
+	// Updates to the Action Cache are disallowed.
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/ac/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", nil))
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	// Fetching an action result should cause the sizes of its
+	// outputs to be learned.
+	outputDigest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	data, err := proto.Marshal(&remoteexecution.ActionResult{
+		OutputFiles: []*remoteexecution.OutputFile{
+			{Path: "hello.txt", Digest: outputDigest.GetPartialDigest()},
+		},
+	})
+	require.NoError(t, err)
+	actionCache.EXPECT().Get(gomock.Any(), util.MustNewDigest("", &remoteexecution.Digest{
+		Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+	})).Return(int64(len(data)), ioutil.NopCloser(bytes.NewBuffer(data)), nil)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ac/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, data, recorder.Body.Bytes())
+
+	contentAddressableStorage.EXPECT().FindMissing(gomock.Any(), []*util.Digest{outputDigest}).Return(nil, nil)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, "/cas/8b1a9953c4611296a827abf8c47804d7", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestServerActionCacheHead(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockBlobAccess(ctrl)
+	actionCache := mock.NewMockBlobAccess(ctrl)
+	server := httpcache.NewServer(contentAddressableStorage, actionCache, false, 100, nil, 0)
+	actionDigest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash: "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+	})
+
+	t.Run("Present", func(t *testing.T) {
+		actionCache.EXPECT().FindMissing(gomock.Any(), []*util.Digest{actionDigest}).Return(nil, nil)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, "/ac/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		actionCache.EXPECT().FindMissing(gomock.Any(), []*util.Digest{actionDigest}).Return([]*util.Digest{actionDigest}, nil)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, "/ac/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", nil))
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+
+	// Action Caches that don't implement FindMissing() should be
+	// probed by loading the action result.
+	t.Run("FindMissingUnimplementedPresent", func(t *testing.T) {
+		actionCache.EXPECT().FindMissing(gomock.Any(), []*util.Digest{actionDigest}).Return(nil, status.Error(codes.Unimplemented, "Bazel action cache does not support bulk existence checking"))
+		actionCache.EXPECT().Get(gomock.Any(), actionDigest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, "/ac/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("FindMissingUnimplementedMissing", func(t *testing.T) {
+		actionCache.EXPECT().FindMissing(gomock.Any(), []*util.Digest{actionDigest}).Return(nil, status.Error(codes.Unimplemented, "Bazel action cache does not support bulk existence checking"))
+		actionCache.EXPECT().Get(gomock.Any(), actionDigest).Return(int64(0), nil, status.Error(codes.NotFound, "Action result not found"))
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, "/ac/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c", nil))
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Names of fields attached to log entries. All services use the same
+// names, so that log entries of a single build action can be
+// correlated across services.
+const (
+	ActionDigestField  = "action_digest"
+	InstanceNameField  = "instance_name"
+	OperationNameField = "operation_name"
+	WorkerIDField      = "worker_id"
+
+	BlobDigestField = "blob_digest"
+	StreamNameField = "stream_name"
+)
+
+// Configure sets the format in which log entries are written. Supported
+// formats are "text" and "json".
+func Configure(format string) error {
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return status.Errorf(codes.InvalidArgument, "Unknown log format %#v", format)
+	}
+	return nil
+}
+
+type loggerKey struct{}
+
+// NewContext returns a context that carries a logger. Code that is
+// called with this context may obtain the logger through
+// FromContext(), so that its log entries contain the same fields.
+func NewContext(ctx context.Context, logger *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger that is attached to a context. If no
+// logger is attached, the standard logger is returned.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if logger, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return logger
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// WithActionDigest adds fields to a logger that identify the build
+// action with a given digest.
+func WithActionDigest(logger *logrus.Entry, actionDigest *util.Digest) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		ActionDigestField: fmt.Sprintf("%s-%d", actionDigest.GetHashString(), actionDigest.GetSizeBytes()),
+		InstanceNameField: actionDigest.GetInstance(),
+	})
+}
@@ -0,0 +1,487 @@
+package outputstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/logging"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/logstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stream holds the data written into a single output stream.
+type stream struct {
+	name        string
+	instance    string
+	isLogStream bool
+	// Resource name through which a log stream may be written, if
+	// it has not been written yet.
+	writeName string
+	// Whether a call to Write() is currently writing into the
+	// stream. Such streams are never considered to be idle.
+	writing      bool
+	data         []byte
+	finished     bool
+	removed      bool
+	lastActivity time.Time
+	// Digest of the data, if the stream has been finished and its
+	// data has been moved into the Content Addressable Storage.
+	digest *util.Digest
+	// Channel that is closed every time data is appended to the
+	// stream or the stream is finished.
+	wakeup chan struct{}
+}
+
+func newStream(name string, instance string, isLogStream bool, now time.Time) *stream {
+	return &stream{
+		name:         name,
+		instance:     instance,
+		isLogStream:  isLogStream,
+		lastActivity: now,
+		wakeup:       make(chan struct{}),
+	}
+}
+
+func (s *stream) notify() {
+	close(s.wakeup)
+	s.wakeup = make(chan struct{})
+}
+
+type server struct {
+	contentAddressableStorage blobstore.BlobAccess
+	readChunkSize             int
+	chunkPool                 *blobstore.ChunkBufferPool
+	maxFinishedStreams        int
+	maxStreamSizeBytes        int64
+	maxTotalSizeBytes         int64
+	idleTimeout               time.Duration
+
+	lock                  sync.Mutex
+	streams               map[string]*stream
+	writeNames            map[string]string
+	finishedStreams       []*stream
+	totalSizeBytes        int64
+	nextGarbageCollection time.Time
+}
+
+// NewServer creates a pair of GRPC services that store output streams
+// of actions (e.g., stdout and stderr) and log streams in memory.
+// Workers write data into output streams while actions are being
+// executed. Log streams may be created by arbitrary clients through the
+// LogStream service. Clients may read streams at the same time,
+// receiving data as soon as it is written.
+//
+// Streams that are finished are retained, so that clients may read
+// them after they complete. Only a fixed number of finished streams is
+// retained, discarding the oldest ones first. If a Content Addressable
+// Storage is provided, the contents of finished log streams are moved
+// into it, instead of being retained in memory.
+//
+// To bound memory usage, writes that cause a single stream to exceed
+// maxStreamSizeBytes fail. Writes that cause the total size of all
+// streams to exceed maxTotalSizeBytes first discard finished streams,
+// failing if that does not free up enough space. Streams (including
+// log streams that have been created, but not written) are discarded
+// if they have not been written to for idleTimeout.
+func NewServer(contentAddressableStorage blobstore.BlobAccess, readChunkSize int, maxFinishedStreams int, maxStreamSizeBytes int64, maxTotalSizeBytes int64, idleTimeout time.Duration) (bytestream.ByteStreamServer, logstream.LogStreamServiceServer) {
+	s := &server{
+		contentAddressableStorage: contentAddressableStorage,
+		readChunkSize:             readChunkSize,
+		chunkPool:                 blobstore.NewChunkBufferPool(readChunkSize),
+		maxFinishedStreams:        maxFinishedStreams,
+		maxStreamSizeBytes:        maxStreamSizeBytes,
+		maxTotalSizeBytes:         maxTotalSizeBytes,
+		idleTimeout:               idleTimeout,
+
+		streams:    map[string]*stream{},
+		writeNames: map[string]string{},
+	}
+	return s, s
+}
+
+func (s *server) finishStreamLocked(st *stream) {
+	if st.finished {
+		return
+	}
+	st.finished = true
+	st.notify()
+	if st.removed {
+		return
+	}
+
+	s.finishedStreams = append(s.finishedStreams, st)
+	for len(s.finishedStreams) > s.maxFinishedStreams {
+		s.removeOldestFinishedStreamLocked()
+	}
+}
+
+// removeStreamLocked discards a stream, releasing the memory used to
+// store its contents. Readers of the stream are woken up, so that they
+// may return an error.
+func (s *server) removeStreamLocked(st *stream) {
+	if st.removed {
+		return
+	}
+	st.removed = true
+	if s.streams[st.name] == st {
+		delete(s.streams, st.name)
+	}
+	if st.writeName != "" {
+		delete(s.writeNames, st.writeName)
+		st.writeName = ""
+	}
+	s.totalSizeBytes -= int64(len(st.data))
+	st.data = nil
+	st.notify()
+}
+
+func (s *server) removeOldestFinishedStreamLocked() {
+	st := s.finishedStreams[0]
+	s.finishedStreams[0] = nil
+	s.finishedStreams = s.finishedStreams[1:]
+	s.removeStreamLocked(st)
+}
+
+// collectGarbageLocked discards all streams that are not being written
+// and have not been accessed for the configured idle timeout. As this
+// requires a scan over all streams, it is performed at most once per
+// idle timeout.
+func (s *server) collectGarbageLocked(now time.Time) {
+	if now.Before(s.nextGarbageCollection) {
+		return
+	}
+	s.nextGarbageCollection = now.Add(s.idleTimeout)
+
+	cutoff := now.Add(-s.idleTimeout)
+	for _, st := range s.streams {
+		if !st.writing && st.lastActivity.Before(cutoff) {
+			s.removeStreamLocked(st)
+		}
+	}
+	finishedStreams := s.finishedStreams[:0]
+	for _, st := range s.finishedStreams {
+		if !st.removed {
+			finishedStreams = append(finishedStreams, st)
+		}
+	}
+	for i := len(finishedStreams); i < len(s.finishedStreams); i++ {
+		s.finishedStreams[i] = nil
+	}
+	s.finishedStreams = finishedStreams
+}
+
+// appendLocked appends data to a stream that is being written,
+// discarding finished streams if needed to remain within the total
+// size limit.
+func (s *server) appendLocked(st *stream, data []byte, now time.Time) error {
+	if st.removed {
+		return status.Errorf(codes.NotFound, "Stream %#v has expired", st.name)
+	}
+	sizeBytes := int64(len(data))
+	if int64(len(st.data))+sizeBytes > s.maxStreamSizeBytes {
+		return status.Errorf(codes.ResourceExhausted, "Stream %#v would exceed the maximum size of %d bytes", st.name, s.maxStreamSizeBytes)
+	}
+	for s.totalSizeBytes+sizeBytes > s.maxTotalSizeBytes && len(s.finishedStreams) > 0 {
+		s.removeOldestFinishedStreamLocked()
+	}
+	if s.totalSizeBytes+sizeBytes > s.maxTotalSizeBytes {
+		return status.Errorf(codes.ResourceExhausted, "Streams would exceed the maximum total size of %d bytes", s.maxTotalSizeBytes)
+	}
+	st.data = append(st.data, data...)
+	st.lastActivity = now
+	s.totalSizeBytes += sizeBytes
+	st.notify()
+	return nil
+}
+
+// storeStream moves the contents of a finished log stream into the
+// Content Addressable Storage.
+func (s *server) storeStream(st *stream, data []byte) (*util.Digest, error) {
+	hash := sha256.Sum256(data)
+	digest, err := util.NewDigest(st.instance, &remoteexecution.Digest{
+		Hash:      hex.EncodeToString(hash[:]),
+		SizeBytes: int64(len(data)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.contentAddressableStorage.Put(context.Background(), digest, digest.GetSizeBytes(), blobstore.NewBytesReader(data)); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+func (s *server) readFromStorage(out bytestream.ByteStream_ReadServer, digest *util.Digest, offset int64, remaining int64) error {
+	_, r, err := s.contentAddressableStorage.Get(out.Context(), digest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to read finished stream from storage")
+	}
+	defer r.Close()
+	if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+		return err
+	}
+	if remaining > 0 {
+		r = ioutil.NopCloser(io.LimitReader(r, remaining))
+	}
+	return s.chunkPool.SendInChunks(r, func(chunk []byte) error {
+		return out.Send(&bytestream.ReadResponse{Data: chunk})
+	})
+}
+
+func (s *server) Read(in *bytestream.ReadRequest, out bytestream.ByteStream_ReadServer) error {
+	if _, ok := ParseStreamName(in.ResourceName); !ok {
+		return status.Error(codes.InvalidArgument, "Invalid resource naming scheme")
+	}
+	if in.ReadOffset < 0 || in.ReadLimit < 0 {
+		return status.Error(codes.OutOfRange, "Read offset and limit cannot be negative")
+	}
+
+	s.lock.Lock()
+	now := time.Now()
+	s.collectGarbageLocked(now)
+	st, ok := s.streams[in.ResourceName]
+	if ok {
+		st.lastActivity = now
+	}
+	s.lock.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "Stream %#v not found", in.ResourceName)
+	}
+
+	offset := in.ReadOffset
+	remaining := in.ReadLimit
+	for {
+		// Extract any data that is available.
+		s.lock.Lock()
+		if st.removed {
+			s.lock.Unlock()
+			return status.Errorf(codes.NotFound, "Stream %#v has expired", in.ResourceName)
+		}
+		if digest := st.digest; digest != nil {
+			s.lock.Unlock()
+			if offset > digest.GetSizeBytes() {
+				return status.Error(codes.OutOfRange, "Read offset exceeds the size of the stream")
+			}
+			return s.readFromStorage(out, digest, offset, remaining)
+		}
+		if offset > int64(len(st.data)) {
+			s.lock.Unlock()
+			return status.Error(codes.OutOfRange, "Read offset exceeds the size of the stream")
+		}
+		chunk := st.data[offset:]
+		if len(chunk) > s.readChunkSize {
+			chunk = chunk[:s.readChunkSize]
+		}
+		if remaining > 0 && int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		finished := st.finished
+		wakeup := st.wakeup
+		s.lock.Unlock()
+
+		if len(chunk) > 0 {
+			if err := out.Send(&bytestream.ReadResponse{Data: chunk}); err != nil {
+				return err
+			}
+			offset += int64(len(chunk))
+			if remaining > 0 {
+				remaining -= int64(len(chunk))
+				if remaining == 0 {
+					return nil
+				}
+			}
+			continue
+		}
+		if finished {
+			return nil
+		}
+
+		// Wait for more data to be written.
+		select {
+		case <-out.Context().Done():
+			return out.Context().Err()
+		case <-wakeup:
+		}
+	}
+}
+
+// getStreamForWriting looks up the stream that corresponds to a
+// resource name provided to Write().
+func (s *server) getStreamForWriting(resourceName string) (*stream, error) {
+	instance, isLogStream, ok := parseStreamName(resourceName)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "Invalid resource naming scheme")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	s.collectGarbageLocked(now)
+
+	// Log streams are created ahead of time and may only be
+	// written once.
+	if name, ok := s.writeNames[resourceName]; ok {
+		delete(s.writeNames, resourceName)
+		st := s.streams[name]
+		st.writeName = ""
+		st.writing = true
+		st.lastActivity = now
+		return st, nil
+	}
+	if oldStream, ok := s.streams[resourceName]; ok && oldStream.isLogStream {
+		return nil, status.Error(codes.PermissionDenied, "Log streams can only be written through their write resource name")
+	}
+	if isLogStream {
+		return nil, status.Errorf(codes.NotFound, "Log stream %#v not found", resourceName)
+	}
+
+	// Output streams of actions are created upon first write. Any
+	// stream of a previous execution of the same action is
+	// replaced.
+	if oldStream, ok := s.streams[resourceName]; ok {
+		s.removeStreamLocked(oldStream)
+		s.finishStreamLocked(oldStream)
+	}
+	st := newStream(resourceName, instance, false, now)
+	st.writing = true
+	s.streams[resourceName] = st
+	return st, nil
+}
+
+// finishWrite marks a stream as finished after Write() completes. The
+// contents of log streams are moved into the Content Addressable
+// Storage, if provided.
+func (s *server) finishWrite(st *stream) {
+	var digest *util.Digest
+	if st.isLogStream && s.contentAddressableStorage != nil {
+		s.lock.Lock()
+		data := st.data
+		removed := st.removed
+		s.lock.Unlock()
+		if !removed {
+			var err error
+			digest, err = s.storeStream(st, data)
+			if err != nil {
+				logrus.WithField(logging.StreamNameField, st.name).WithError(err).Error("Failed to store log stream")
+			}
+		}
+	}
+
+	s.lock.Lock()
+	if digest != nil && !st.removed {
+		st.digest = digest
+		s.totalSizeBytes -= int64(len(st.data))
+		st.data = nil
+	}
+	st.writing = false
+	st.lastActivity = time.Now()
+	s.finishStreamLocked(st)
+	s.lock.Unlock()
+}
+
+func (s *server) Write(in bytestream.ByteStream_WriteServer) error {
+	request, err := in.Recv()
+	if err != nil {
+		return err
+	}
+	st, err := s.getStreamForWriting(request.ResourceName)
+	if err != nil {
+		return err
+	}
+
+	// Always mark the stream as finished, so that readers don't
+	// block indefinitely if the writer disappears.
+	finished := false
+	defer func() {
+		if !finished {
+			s.finishWrite(st)
+		}
+	}()
+
+	var writeOffset int64
+	for {
+		if request.WriteOffset != writeOffset {
+			return status.Errorf(codes.InvalidArgument, "Attempted to write at offset %d, while %d was expected", request.WriteOffset, writeOffset)
+		}
+		writeOffset += int64(len(request.Data))
+		if len(request.Data) > 0 {
+			s.lock.Lock()
+			err := s.appendLocked(st, request.Data, time.Now())
+			s.lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		if request.FinishWrite {
+			// Finish the stream before responding, so that
+			// the client observes the final state.
+			finished = true
+			s.finishWrite(st)
+			return in.SendAndClose(&bytestream.WriteResponse{
+				CommittedSize: writeOffset,
+			})
+		}
+
+		request, err = in.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return status.Error(codes.InvalidArgument, "Client closed stream without finishing write")
+			}
+			return err
+		}
+	}
+}
+
+func (s *server) QueryWriteStatus(ctx context.Context, in *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.collectGarbageLocked(time.Now())
+	name := in.ResourceName
+	if readName, ok := s.writeNames[name]; ok {
+		name = readName
+	}
+	st, ok := s.streams[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Stream %#v not found", in.ResourceName)
+	}
+	sizeBytes := int64(len(st.data))
+	if st.digest != nil {
+		sizeBytes = st.digest.GetSizeBytes()
+	}
+	return &bytestream.QueryWriteStatusResponse{
+		CommittedSize: sizeBytes,
+		Complete:      st.finished,
+	}, nil
+}
+
+func (s *server) CreateLogStream(ctx context.Context, in *logstream.CreateLogStreamRequest) (*logstream.LogStream, error) {
+	name, writeName := newLogStreamNames(in.Parent)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	s.collectGarbageLocked(now)
+	st := newStream(name, in.Parent, true, now)
+	st.writeName = writeName
+	s.streams[name] = st
+	s.writeNames[writeName] = name
+	return &logstream.LogStream{
+		Name:              name,
+		WriteResourceName: writeName,
+	}, nil
+}
@@ -0,0 +1,367 @@
+package outputstream_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/outputstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/logstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const stdoutStreamName = "debian8/streams/8b1a9953c4611296a827abf8c47804d7/123/stdout"
+
+// newTestClients creates an RPC server/client pair for the output
+// stream server.
+func newTestClients(ctx context.Context, t *testing.T, contentAddressableStorage blobstore.BlobAccess, maxStreamSizeBytes int64, maxTotalSizeBytes int64, idleTimeout time.Duration) (bytestream.ByteStreamClient, logstream.LogStreamServiceClient, func()) {
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	byteStreamServer, logStreamServer := outputstream.NewServer(contentAddressableStorage, 5, 1, maxStreamSizeBytes, maxTotalSizeBytes, idleTimeout)
+	bytestream.RegisterByteStreamServer(server, byteStreamServer)
+	logstream.RegisterLogStreamServiceServer(server, logStreamServer)
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	return bytestream.NewByteStreamClient(conn), logstream.NewLogStreamServiceClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+// writeStream writes a sequence of chunks into a stream, finishing the
+// write afterwards.
+func writeStream(ctx context.Context, t *testing.T, client bytestream.ByteStreamClient, resourceName string, chunks ...string) error {
+	stream, err := client.Write(ctx)
+	require.NoError(t, err)
+	var writeOffset int64
+	for _, chunk := range chunks {
+		if err := stream.Send(&bytestream.WriteRequest{
+			ResourceName: resourceName,
+			WriteOffset:  writeOffset,
+			Data:         []byte(chunk),
+		}); err != nil {
+			break
+		}
+		writeOffset += int64(len(chunk))
+	}
+	stream.Send(&bytestream.WriteRequest{
+		ResourceName: resourceName,
+		WriteOffset:  writeOffset,
+		FinishWrite:  true,
+	})
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// waitForCommittedSize waits until data sent by a writer has been
+// processed by the server, as WriteRequests are sent asynchronously.
+func waitForCommittedSize(ctx context.Context, t *testing.T, client bytestream.ByteStreamClient, resourceName string, sizeBytes int64) {
+	for {
+		response, err := client.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+			ResourceName: resourceName,
+		})
+		if err == nil && response.CommittedSize == sizeBytes {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readStream reads a stream until it is finished.
+func readStream(ctx context.Context, t *testing.T, client bytestream.ByteStreamClient, resourceName string) (string, error) {
+	stream, err := client.Read(ctx, &bytestream.ReadRequest{ResourceName: resourceName})
+	require.NoError(t, err)
+	var data []byte
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return string(data), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		data = append(data, response.Data...)
+	}
+}
+
+func TestByteStreamServerOutputStream(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	byteStreamClient, _, cleanup := newTestClients(ctx, t, nil, 100, 1000, time.Hour)
+	defer cleanup()
+
+	t.Run("InvalidResourceName", func(t *testing.T) {
+		_, err := readStream(ctx, t, byteStreamClient, "This is an incorrect resource name")
+		require.Equal(t, status.Error(codes.InvalidArgument, "Invalid resource naming scheme"), err)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := readStream(ctx, t, byteStreamClient, stdoutStreamName)
+		require.Equal(t, status.Errorf(codes.NotFound, "Stream %#v not found", stdoutStreamName), err)
+
+		_, err = byteStreamClient.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+			ResourceName: stdoutStreamName,
+		})
+		require.Equal(t, status.Errorf(codes.NotFound, "Stream %#v not found", stdoutStreamName), err)
+	})
+
+	t.Run("ReadWhileWriting", func(t *testing.T) {
+		writer, err := byteStreamClient.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, writer.Send(&bytestream.WriteRequest{
+			ResourceName: stdoutStreamName,
+			Data:         []byte("Hello, "),
+		}))
+		waitForCommittedSize(ctx, t, byteStreamClient, stdoutStreamName, 7)
+
+		// Data that has been written should be returned
+		// immediately, split up in chunks.
+		reader, err := byteStreamClient.Read(ctx, &bytestream.ReadRequest{ResourceName: stdoutStreamName})
+		require.NoError(t, err)
+		response, err := reader.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), response.Data)
+		response, err = reader.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(", "), response.Data)
+
+		statusResponse, err := byteStreamClient.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+			ResourceName: stdoutStreamName,
+		})
+		require.NoError(t, err)
+		require.Equal(t, &bytestream.QueryWriteStatusResponse{CommittedSize: 7}, statusResponse)
+
+		// Finishing the write should cause the reader to
+		// receive the remaining data, followed by EOF.
+		require.NoError(t, writer.Send(&bytestream.WriteRequest{
+			ResourceName: stdoutStreamName,
+			WriteOffset:  7,
+			Data:         []byte("world"),
+			FinishWrite:  true,
+		}))
+		writeResponse, err := writer.CloseAndRecv()
+		require.NoError(t, err)
+		require.Equal(t, int64(12), writeResponse.CommittedSize)
+
+		response, err = reader.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("world"), response.Data)
+		_, err = reader.Recv()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("ReadAfterFinishing", func(t *testing.T) {
+		data, err := readStream(ctx, t, byteStreamClient, stdoutStreamName)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world", data)
+
+		statusResponse, err := byteStreamClient.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+			ResourceName: stdoutStreamName,
+		})
+		require.NoError(t, err)
+		require.Equal(t, &bytestream.QueryWriteStatusResponse{CommittedSize: 12, Complete: true}, statusResponse)
+	})
+
+	t.Run("BadWriteOffset", func(t *testing.T) {
+		writer, err := byteStreamClient.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, writer.Send(&bytestream.WriteRequest{
+			ResourceName: stdoutStreamName,
+			WriteOffset:  3,
+			Data:         []byte("Hello"),
+		}))
+		_, err = writer.CloseAndRecv()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Attempted to write at offset 3, while 0 was expected"), err)
+	})
+}
+
+func TestByteStreamServerLogStream(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockBlobAccess(ctrl)
+	byteStreamClient, logStreamClient, cleanup := newTestClients(ctx, t, contentAddressableStorage, 100, 1000, time.Hour)
+	defer cleanup()
+
+	logStream, err := logStreamClient.CreateLogStream(ctx, &logstream.CreateLogStreamRequest{Parent: "debian8"})
+	require.NoError(t, err)
+	instance, ok := outputstream.ParseStreamName(logStream.Name)
+	require.True(t, ok)
+	require.Equal(t, "debian8", instance)
+
+	// Log streams may only be written through the write resource
+	// name.
+	require.Equal(
+		t,
+		status.Error(codes.PermissionDenied, "Log streams can only be written through their write resource name"),
+		writeStream(ctx, t, byteStreamClient, logStream.Name, "Hello"))
+
+	// Finishing the write should cause the data to be moved into
+	// the Content Addressable Storage.
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "4ae7c3b6ac0beff671efa8cf57386151c06e58ca53a78d83f36107316cec125f",
+		SizeBytes: 12,
+	})
+	contentAddressableStorage.EXPECT().Put(gomock.Any(), digest, int64(12), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+			data, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hello, world"), data)
+			return r.Close()
+		})
+	require.NoError(t, writeStream(ctx, t, byteStreamClient, logStream.WriteResourceName, "Hello, ", "world"))
+
+	// Log streams may only be written once.
+	require.Equal(
+		t,
+		status.Errorf(codes.NotFound, "Log stream %#v not found", logStream.WriteResourceName),
+		writeStream(ctx, t, byteStreamClient, logStream.WriteResourceName, "Hello"))
+
+	// Reads should be served from the Content Addressable Storage.
+	contentAddressableStorage.EXPECT().Get(gomock.Any(), digest).
+		Return(int64(12), ioutil.NopCloser(bytes.NewBufferString("Hello, world")), nil)
+	stream, err := byteStreamClient.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: logStream.Name,
+		ReadOffset:   7,
+	})
+	require.NoError(t, err)
+	response, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), response.Data)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestByteStreamServerSizeLimits(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	byteStreamClient, _, cleanup := newTestClients(ctx, t, nil, 10, 12, time.Hour)
+	defer cleanup()
+
+	t.Run("StreamTooLarge", func(t *testing.T) {
+		require.Equal(
+			t,
+			status.Errorf(codes.ResourceExhausted, "Stream %#v would exceed the maximum size of 10 bytes", stdoutStreamName),
+			writeStream(ctx, t, byteStreamClient, stdoutStreamName, "Hello", "world!"))
+
+		// Data written before the limit was reached should
+		// remain readable.
+		data, err := readStream(ctx, t, byteStreamClient, stdoutStreamName)
+		require.NoError(t, err)
+		require.Equal(t, "Hello", data)
+	})
+
+	t.Run("EvictFinishedStreams", func(t *testing.T) {
+		// Exceeding the total size limit should cause finished
+		// streams to be discarded.
+		stderrStreamName := "debian8/streams/8b1a9953c4611296a827abf8c47804d7/123/stderr"
+		require.NoError(t, writeStream(ctx, t, byteStreamClient, stderrStreamName, "Goodbye", "!!!"))
+		_, err := readStream(ctx, t, byteStreamClient, stdoutStreamName)
+		require.Equal(t, status.Errorf(codes.NotFound, "Stream %#v not found", stdoutStreamName), err)
+		data, err := readStream(ctx, t, byteStreamClient, stderrStreamName)
+		require.NoError(t, err)
+		require.Equal(t, "Goodbye!!!", data)
+	})
+
+	t.Run("TotalSizeExceeded", func(t *testing.T) {
+		// Streams that are still being written cannot be
+		// discarded, meaning that writes to other streams fail.
+		writer, err := byteStreamClient.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, writer.Send(&bytestream.WriteRequest{
+			ResourceName: stdoutStreamName,
+			Data:         []byte("0123456789"),
+		}))
+		waitForCommittedSize(ctx, t, byteStreamClient, stdoutStreamName, 10)
+
+		otherStreamName := "debian8/streams/8b1a9953c4611296a827abf8c47804d7/456/stdout"
+		require.Equal(
+			t,
+			status.Error(codes.ResourceExhausted, "Streams would exceed the maximum total size of 12 bytes"),
+			writeStream(ctx, t, byteStreamClient, otherStreamName, "0123456789"))
+
+		require.NoError(t, writer.Send(&bytestream.WriteRequest{
+			ResourceName: stdoutStreamName,
+			WriteOffset:  10,
+			FinishWrite:  true,
+		}))
+		_, err = writer.CloseAndRecv()
+		require.NoError(t, err)
+	})
+}
+
+func TestByteStreamServerExpiry(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	byteStreamClient, logStreamClient, cleanup := newTestClients(ctx, t, nil, 100, 1000, 10*time.Millisecond)
+	defer cleanup()
+
+	// Streams that are finished and log streams that are never
+	// written should be discarded after the idle timeout.
+	require.NoError(t, writeStream(ctx, t, byteStreamClient, stdoutStreamName, "Hello"))
+	logStream, err := logStreamClient.CreateLogStream(ctx, &logstream.CreateLogStreamRequest{Parent: "debian8"})
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = readStream(ctx, t, byteStreamClient, stdoutStreamName)
+	require.Equal(t, status.Errorf(codes.NotFound, "Stream %#v not found", stdoutStreamName), err)
+	_, err = readStream(ctx, t, byteStreamClient, logStream.Name)
+	require.Equal(t, status.Errorf(codes.NotFound, "Stream %#v not found", logStream.Name), err)
+	require.Equal(
+		t,
+		status.Errorf(codes.NotFound, "Log stream %#v not found", logStream.WriteResourceName),
+		writeStream(ctx, t, byteStreamClient, logStream.WriteResourceName, "Hello"))
+
+	// Streams that are being written should not be discarded, even
+	// if no data is written for a longer amount of time.
+	writer, err := byteStreamClient.Write(ctx)
+	require.NoError(t, err)
+	require.NoError(t, writer.Send(&bytestream.WriteRequest{
+		ResourceName: stdoutStreamName,
+		Data:         []byte("Hello"),
+	}))
+	waitForCommittedSize(ctx, t, byteStreamClient, stdoutStreamName, 5)
+
+	time.Sleep(50 * time.Millisecond)
+
+	statusResponse, err := byteStreamClient.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+		ResourceName: stdoutStreamName,
+	})
+	require.NoError(t, err)
+	require.Equal(t, &bytestream.QueryWriteStatusResponse{CommittedSize: 5}, statusResponse)
+
+	require.NoError(t, writer.Send(&bytestream.WriteRequest{
+		ResourceName: stdoutStreamName,
+		WriteOffset:  5,
+		FinishWrite:  true,
+	}))
+	_, err = writer.CloseAndRecv()
+	require.NoError(t, err)
+	data, err := readStream(ctx, t, byteStreamClient, stdoutStreamName)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", data)
+}
@@ -0,0 +1,143 @@
+package outputstream
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ByteStreamClientGetter is the callback invoked by the demultiplexing
+// ByteStream server to obtain a client for the scheduler that matches
+// the instance name that is provided.
+type ByteStreamClientGetter func(instanceName string) (bytestream.ByteStreamClient, error)
+
+type demultiplexingByteStreamServer struct {
+	bytestream.ByteStreamServer
+	byteStreamClientGetter ByteStreamClientGetter
+}
+
+// NewDemultiplexingByteStreamServer creates an adapter for the
+// ByteStream service that forwards requests to read output streams and
+// log streams, and requests to write log streams, to the scheduler
+// responsible for the instance name in the resource name. Writes to
+// output streams of actions are rejected, as only workers may write
+// those. All other requests are forwarded to the base server, which is
+// typically backed by the Content Addressable Storage (CAS).
+func NewDemultiplexingByteStreamServer(base bytestream.ByteStreamServer, byteStreamClientGetter ByteStreamClientGetter) bytestream.ByteStreamServer {
+	return &demultiplexingByteStreamServer{
+		ByteStreamServer:       base,
+		byteStreamClientGetter: byteStreamClientGetter,
+	}
+}
+
+func (s *demultiplexingByteStreamServer) Read(in *bytestream.ReadRequest, out bytestream.ByteStream_ReadServer) error {
+	instance, ok := ParseStreamName(in.ResourceName)
+	if !ok {
+		return s.ByteStreamServer.Read(in, out)
+	}
+	backend, err := s.byteStreamClientGetter(instance)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to obtain backend for instance %#v", instance)
+	}
+	client, err := backend.Read(out.Context(), in)
+	if err != nil {
+		return err
+	}
+	for {
+		response, err := client.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := out.Send(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *demultiplexingByteStreamServer) QueryWriteStatus(ctx context.Context, in *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	instance, ok := ParseStreamName(in.ResourceName)
+	if !ok {
+		return s.ByteStreamServer.QueryWriteStatus(ctx, in)
+	}
+	backend, err := s.byteStreamClientGetter(instance)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to obtain backend for instance %#v", instance)
+	}
+	return backend.QueryWriteStatus(ctx, in)
+}
+
+// replayingWriteServer is a wrapper for ByteStream_WriteServer that
+// returns a previously received request before any others.
+type replayingWriteServer struct {
+	bytestream.ByteStream_WriteServer
+	request *bytestream.WriteRequest
+}
+
+func (s *replayingWriteServer) Recv() (*bytestream.WriteRequest, error) {
+	if request := s.request; request != nil {
+		s.request = nil
+		return request, nil
+	}
+	return s.ByteStream_WriteServer.Recv()
+}
+
+func (s *demultiplexingByteStreamServer) Write(in bytestream.ByteStream_WriteServer) error {
+	// The resource name is only known after the first request has
+	// been received.
+	request, err := in.Recv()
+	if err != nil {
+		return err
+	}
+	instance, isLogStream, ok := parseStreamName(request.ResourceName)
+	if !ok {
+		return s.ByteStreamServer.Write(&replayingWriteServer{
+			ByteStream_WriteServer: in,
+			request:                request,
+		})
+	}
+	if !isLogStream {
+		// Output streams of actions are written by workers,
+		// which talk to the scheduler directly. Permitting
+		// clients to write them would allow them to replace
+		// the output of other actions.
+		return status.Errorf(codes.PermissionDenied, "Output stream %#v may only be written by workers", request.ResourceName)
+	}
+	backend, err := s.byteStreamClientGetter(instance)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to obtain backend for instance %#v", instance)
+	}
+	client, err := backend.Write(in.Context())
+	if err != nil {
+		return err
+	}
+	for {
+		if err := client.Send(request); err != nil {
+			if err == io.EOF {
+				// The backend closed the stream. The actual
+				// error is returned by CloseAndRecv().
+				break
+			}
+			return err
+		}
+		if request.FinishWrite {
+			break
+		}
+		request, err = in.Recv()
+		if err != nil {
+			return err
+		}
+	}
+	response, err := client.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	return in.SendAndClose(response)
+}
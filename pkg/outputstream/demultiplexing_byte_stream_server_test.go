@@ -0,0 +1,124 @@
+package outputstream_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/outputstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/logstream"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newDemultiplexingTestClients creates an RPC server/client pair for
+// the demultiplexing servers, forwarding requests for instance
+// "debian8" to the provided scheduler clients.
+func newDemultiplexingTestClients(ctx context.Context, t *testing.T, base bytestream.ByteStreamServer, schedulerByteStreamClient bytestream.ByteStreamClient, schedulerLogStreamClient logstream.LogStreamServiceClient) (bytestream.ByteStreamClient, logstream.LogStreamServiceClient, func()) {
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	bytestream.RegisterByteStreamServer(server, outputstream.NewDemultiplexingByteStreamServer(
+		base,
+		func(instanceName string) (bytestream.ByteStreamClient, error) {
+			if instanceName != "debian8" {
+				return nil, status.Error(codes.InvalidArgument, "Unknown instance name")
+			}
+			return schedulerByteStreamClient, nil
+		}))
+	logstream.RegisterLogStreamServiceServer(server, outputstream.NewDemultiplexingLogStreamServiceServer(
+		func(instanceName string) (logstream.LogStreamServiceClient, error) {
+			if instanceName != "debian8" {
+				return nil, status.Error(codes.InvalidArgument, "Unknown instance name")
+			}
+			return schedulerLogStreamClient, nil
+		}))
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	return bytestream.NewByteStreamClient(conn), logstream.NewLogStreamServiceClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func TestDemultiplexingByteStreamServer(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	schedulerByteStreamClient, schedulerLogStreamClient, schedulerCleanup := newTestClients(ctx, t, nil, 100, 1000, time.Hour)
+	defer schedulerCleanup()
+	base := mock.NewMockByteStreamServer(ctrl)
+	byteStreamClient, _, cleanup := newDemultiplexingTestClients(ctx, t, base, schedulerByteStreamClient, schedulerLogStreamClient)
+	defer cleanup()
+
+	t.Run("BaseServer", func(t *testing.T) {
+		// Requests for objects other than streams should be
+		// forwarded to the base server.
+		blobName := "debian8/blobs/8b1a9953c4611296a827abf8c47804d7/5"
+		base.EXPECT().Read(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(in *bytestream.ReadRequest, out bytestream.ByteStream_ReadServer) error {
+				require.Equal(t, blobName, in.ResourceName)
+				return out.Send(&bytestream.ReadResponse{Data: []byte("Hello")})
+			})
+		data, err := readStream(ctx, t, byteStreamClient, blobName)
+		require.NoError(t, err)
+		require.Equal(t, "Hello", data)
+
+		base.EXPECT().Write(gomock.Any()).DoAndReturn(
+			func(in bytestream.ByteStream_WriteServer) error {
+				request, err := in.Recv()
+				require.NoError(t, err)
+				require.Equal(t, "debian8/uploads/1234/blobs/8b1a9953c4611296a827abf8c47804d7/5", request.ResourceName)
+				require.Equal(t, []byte("Hello"), request.Data)
+				return status.Error(codes.Unavailable, "Storage offline")
+			})
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Storage offline"),
+			writeStream(ctx, t, byteStreamClient, "debian8/uploads/1234/blobs/8b1a9953c4611296a827abf8c47804d7/5", "Hello"))
+	})
+
+	t.Run("UnknownInstance", func(t *testing.T) {
+		_, err := readStream(ctx, t, byteStreamClient, "ubuntu16/streams/8b1a9953c4611296a827abf8c47804d7/123/stdout")
+		require.Equal(t, status.Error(codes.InvalidArgument, "Failed to obtain backend for instance \"ubuntu16\": Unknown instance name"), err)
+	})
+
+	t.Run("OutputStream", func(t *testing.T) {
+		// Output streams are written by workers directly
+		// against the scheduler. Reads should be forwarded to
+		// the scheduler.
+		require.NoError(t, writeStream(ctx, t, schedulerByteStreamClient, stdoutStreamName, "Hello, ", "world"))
+		data, err := readStream(ctx, t, byteStreamClient, stdoutStreamName)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world", data)
+
+		response, err := byteStreamClient.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+			ResourceName: stdoutStreamName,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(12), response.CommittedSize)
+		require.True(t, response.Complete)
+
+		// Clients should not be able to replace the output
+		// stream of an action.
+		require.Equal(
+			t,
+			status.Errorf(codes.PermissionDenied, "Output stream %#v may only be written by workers", stdoutStreamName),
+			writeStream(ctx, t, byteStreamClient, stdoutStreamName, "Spoofed"))
+		data, err = readStream(ctx, t, byteStreamClient, stdoutStreamName)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world", data)
+	})
+}
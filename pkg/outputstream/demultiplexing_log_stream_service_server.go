@@ -0,0 +1,36 @@
+package outputstream
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/logstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// LogStreamServiceClientGetter is the callback invoked by the
+// demultiplexing LogStream server to obtain a client for the scheduler
+// that matches the instance name that is provided.
+type LogStreamServiceClientGetter func(instanceName string) (logstream.LogStreamServiceClient, error)
+
+type demultiplexingLogStreamServiceServer struct {
+	logStreamServiceClientGetter LogStreamServiceClientGetter
+}
+
+// NewDemultiplexingLogStreamServiceServer creates a LogStream service
+// that forwards requests to create log streams to the scheduler
+// responsible for the instance name provided as the parent. The
+// resulting log streams may be accessed through a ByteStream server
+// created by NewDemultiplexingByteStreamServer().
+func NewDemultiplexingLogStreamServiceServer(logStreamServiceClientGetter LogStreamServiceClientGetter) logstream.LogStreamServiceServer {
+	return &demultiplexingLogStreamServiceServer{
+		logStreamServiceClientGetter: logStreamServiceClientGetter,
+	}
+}
+
+func (s *demultiplexingLogStreamServiceServer) CreateLogStream(ctx context.Context, in *logstream.CreateLogStreamRequest) (*logstream.LogStream, error) {
+	backend, err := s.logStreamServiceClientGetter(in.Parent)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to obtain backend for instance %#v", in.Parent)
+	}
+	return backend.CreateLogStream(ctx, in)
+}
@@ -0,0 +1,65 @@
+package outputstream_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/outputstream"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/logstream"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDemultiplexingLogStreamServiceServer(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	schedulerByteStreamClient, schedulerLogStreamClient, schedulerCleanup := newTestClients(ctx, t, nil, 100, 1000, time.Hour)
+	defer schedulerCleanup()
+	byteStreamClient, logStreamClient, cleanup := newDemultiplexingTestClients(ctx, t, mock.NewMockByteStreamServer(ctrl), schedulerByteStreamClient, schedulerLogStreamClient)
+	defer cleanup()
+
+	t.Run("UnknownInstance", func(t *testing.T) {
+		_, err := logStreamClient.CreateLogStream(ctx, &logstream.CreateLogStreamRequest{Parent: "ubuntu16"})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Failed to obtain backend for instance \"ubuntu16\": Unknown instance name"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		// Log streams should be created by the scheduler
+		// responsible for the instance name.
+		logStream, err := logStreamClient.CreateLogStream(ctx, &logstream.CreateLogStreamRequest{Parent: "debian8"})
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(logStream.Name, "debian8/logstreams/"))
+		require.True(t, strings.HasPrefix(logStream.WriteResourceName, logStream.Name+"/"))
+		instance, ok := outputstream.ParseStreamName(logStream.Name)
+		require.True(t, ok)
+		require.Equal(t, "debian8", instance)
+
+		// Writes through the demultiplexer should only be
+		// accepted for the write resource name, and only once.
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Log streams can only be written through their write resource name"),
+			writeStream(ctx, t, byteStreamClient, logStream.Name, "Hello"))
+		require.NoError(t, writeStream(ctx, t, byteStreamClient, logStream.WriteResourceName, "Hello, ", "world"))
+		require.Equal(
+			t,
+			status.Errorf(codes.NotFound, "Log stream %#v not found", logStream.WriteResourceName),
+			writeStream(ctx, t, byteStreamClient, logStream.WriteResourceName, "Hello"))
+
+		// The log stream should be readable through both the
+		// demultiplexer and the scheduler.
+		data, err := readStream(ctx, t, byteStreamClient, logStream.Name)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world", data)
+		data, err = readStream(ctx, t, schedulerByteStreamClient, logStream.Name)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world", data)
+	})
+}
@@ -0,0 +1,79 @@
+package outputstream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/google/uuid"
+)
+
+// GetStreamName returns the ByteStream resource name under which an
+// output stream (e.g., "stdout" or "stderr") of an action is exposed
+// while the action is being executed. Names have one of the following
+// two forms:
+//
+// - streams/${hash}/${size}/${stream}
+// - ${instance}/streams/${hash}/${size}/${stream}
+//
+// As names are derived from the action digest, both the scheduler and
+// the worker executing the action can compute them independently.
+func GetStreamName(actionDigest *util.Digest, stream string) string {
+	return prependInstance(
+		actionDigest.GetInstance(),
+		fmt.Sprintf("streams/%s/%d/%s", actionDigest.GetHashString(), actionDigest.GetSizeBytes(), stream))
+}
+
+// newLogStreamNames generates the names of a log stream created through
+// the LogStream service. The name used for writing contains an
+// additional random token, so that only the creator of the log stream
+// is capable of writing to it. Names have the following forms:
+//
+// - [${instance}/]logstreams/${uuid}
+// - [${instance}/]logstreams/${uuid}/${token}
+func newLogStreamNames(instance string) (string, string) {
+	name := prependInstance(instance, "logstreams/"+uuid.Must(uuid.NewRandom()).String())
+	return name, name + "/" + uuid.Must(uuid.NewRandom()).String()
+}
+
+func prependInstance(instance string, name string) string {
+	if instance != "" {
+		return instance + "/" + name
+	}
+	return name
+}
+
+// ParseStreamName checks whether a ByteStream resource name refers to
+// an output stream of an action or a log stream. If so, the instance
+// name is extracted.
+func ParseStreamName(resourceName string) (string, bool) {
+	instance, _, ok := parseStreamName(resourceName)
+	return instance, ok
+}
+
+// parseStreamName is identical to ParseStreamName, except that it also
+// returns whether the resource name refers to a log stream.
+func parseStreamName(resourceName string) (string, bool, bool) {
+	fields := strings.FieldsFunc(resourceName, func(r rune) bool { return r == '/' })
+	offset := 0
+	if len(fields) > 0 && fields[0] != "streams" && fields[0] != "logstreams" {
+		offset = 1
+	}
+	remaining := fields[offset:]
+	isLogStream := false
+	switch {
+	case len(remaining) == 4 && remaining[0] == "streams":
+		if _, err := strconv.ParseInt(remaining[2], 10, 64); err != nil {
+			return "", false, false
+		}
+	case (len(remaining) == 2 || len(remaining) == 3) && remaining[0] == "logstreams":
+		isLogStream = true
+	default:
+		return "", false, false
+	}
+	if offset == 1 {
+		return fields[0], isLogStream, true
+	}
+	return "", isLogStream, true
+}
@@ -0,0 +1,32 @@
+package quota
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// IdentityExtractor is used to determine the identity of the client
+// on whose behalf a request is performed. Quotas are tracked
+// separately for every identity.
+type IdentityExtractor func(ctx context.Context, instance string) string
+
+// NewHeaderIdentityExtractor creates an IdentityExtractor that
+// identifies clients by the instance name of the request, combined
+// with the value of a gRPC header (e.g., one containing a user or team
+// name injected by an authenticating proxy). If the header name is
+// empty, clients are only distinguished by instance name.
+func NewHeaderIdentityExtractor(header string) IdentityExtractor {
+	return func(ctx context.Context, instance string) string {
+		if header == "" {
+			return instance
+		}
+		var value string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(header); len(values) > 0 {
+				value = values[0]
+			}
+		}
+		return instance + "/" + value
+	}
+}
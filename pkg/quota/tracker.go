@@ -0,0 +1,123 @@
+package quota
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	trackerConsumptionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "quota",
+			Name:      "tracker_consumptions_total",
+			Help:      "Total number of attempts to consume resources, and whether they fit within the quota.",
+		},
+		[]string{"name", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(trackerConsumptionsTotal)
+}
+
+// Tracker keeps track of the amount of a resource (e.g., bytes
+// uploaded, actions executed) that has been consumed by clients.
+type Tracker interface {
+	// Consume records that a client has consumed a given amount of
+	// the resource. It returns false without recording anything if
+	// doing so would cause the client to exceed its quota.
+	Consume(identity string, amount int64) bool
+}
+
+// slidingWindowTrackerBucketCount is the number of buckets into which
+// the window of a sliding window tracker is split. Consumption is
+// expired one bucket at a time.
+const slidingWindowTrackerBucketCount = 10
+
+type slidingWindowUsage struct {
+	// Amount consumed in every bucket, indexed by bucket number
+	// modulo the number of buckets.
+	amounts [slidingWindowTrackerBucketCount]int64
+	// Bucket number to which the amounts belong.
+	buckets [slidingWindowTrackerBucketCount]int64
+}
+
+func (u *slidingWindowUsage) getTotal(currentBucket int64) int64 {
+	total := int64(0)
+	for i, bucket := range u.buckets {
+		if bucket > currentBucket-slidingWindowTrackerBucketCount {
+			total += u.amounts[i]
+		}
+	}
+	return total
+}
+
+type slidingWindowTracker struct {
+	limit          int64
+	bucketDuration time.Duration
+
+	consumptionsAllowed  prometheus.Counter
+	consumptionsRejected prometheus.Counter
+
+	lock              sync.Mutex
+	usages            map[string]*slidingWindowUsage
+	lastCleanupBucket int64
+}
+
+// NewSlidingWindowTracker creates a Tracker that permits every client
+// to consume up to a fixed amount of a resource during any window of
+// time of a given duration. Consumption is accounted with a
+// granularity of a tenth of the window.
+func NewSlidingWindowTracker(name string, limit int64, window time.Duration) Tracker {
+	bucketDuration := window / slidingWindowTrackerBucketCount
+	if bucketDuration <= 0 {
+		bucketDuration = 1
+	}
+	return &slidingWindowTracker{
+		limit:          limit,
+		bucketDuration: bucketDuration,
+
+		consumptionsAllowed:  trackerConsumptionsTotal.WithLabelValues(name, "Allowed"),
+		consumptionsRejected: trackerConsumptionsTotal.WithLabelValues(name, "Rejected"),
+
+		usages: map[string]*slidingWindowUsage{},
+	}
+}
+
+func (t *slidingWindowTracker) Consume(identity string, amount int64) bool {
+	currentBucket := time.Now().UnixNano() / int64(t.bucketDuration)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Periodically discard clients that have not consumed
+	// anything during the last window, to bound memory usage.
+	if currentBucket-t.lastCleanupBucket >= slidingWindowTrackerBucketCount {
+		for otherIdentity, usage := range t.usages {
+			if usage.getTotal(currentBucket) == 0 {
+				delete(t.usages, otherIdentity)
+			}
+		}
+		t.lastCleanupBucket = currentBucket
+	}
+
+	usage, ok := t.usages[identity]
+	if !ok {
+		usage = &slidingWindowUsage{}
+		t.usages[identity] = usage
+	}
+	if usage.getTotal(currentBucket)+amount > t.limit {
+		t.consumptionsRejected.Inc()
+		return false
+	}
+	i := currentBucket % slidingWindowTrackerBucketCount
+	if usage.buckets[i] != currentBucket {
+		usage.buckets[i] = currentBucket
+		usage.amounts[i] = 0
+	}
+	usage.amounts[i] += amount
+	t.consumptionsAllowed.Inc()
+	return true
+}
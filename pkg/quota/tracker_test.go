@@ -0,0 +1,36 @@
+package quota_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/quota"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlidingWindowTracker(t *testing.T) {
+	tracker := quota.NewSlidingWindowTracker("test", 100, time.Hour)
+
+	// Consumption should be permitted until the limit is reached.
+	require.True(t, tracker.Consume("alice", 60))
+	require.True(t, tracker.Consume("alice", 40))
+	require.False(t, tracker.Consume("alice", 1))
+
+	// Rejected consumption should not be recorded.
+	require.False(t, tracker.Consume("bob", 101))
+	require.True(t, tracker.Consume("bob", 100))
+
+	// Other clients should not be affected.
+	require.True(t, tracker.Consume("carol", 0))
+	require.True(t, tracker.Consume("carol", 100))
+}
+
+func TestSlidingWindowTrackerExpiry(t *testing.T) {
+	tracker := quota.NewSlidingWindowTracker("test", 100, 100*time.Millisecond)
+
+	// Consumption should expire once the window has passed.
+	require.True(t, tracker.Consume("alice", 100))
+	require.False(t, tracker.Consume("alice", 1))
+	time.Sleep(150 * time.Millisecond)
+	require.True(t, tracker.Consume("alice", 100))
+}
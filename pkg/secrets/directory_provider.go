@@ -0,0 +1,42 @@
+package secrets
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type directoryProvider struct {
+	directory filesystem.Directory
+}
+
+// NewDirectoryProvider creates a Provider that reads secrets from files
+// stored in a single directory, where the name of the file corresponds
+// to the name of the secret. This layout matches how Kubernetes
+// exposes secrets that are mounted as a volume.
+func NewDirectoryProvider(directory filesystem.Directory) Provider {
+	return &directoryProvider{
+		directory: directory,
+	}
+}
+
+func (p *directoryProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	f, err := p.directory.OpenFile(name, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "Secret %#v does not exist", name)
+	} else if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to open secret %#v", name)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to read secret %#v", name)
+	}
+	return data, nil
+}
@@ -0,0 +1,13 @@
+package secrets
+
+import (
+	"context"
+)
+
+// Provider of secrets (e.g., API tokens, passwords) that build actions
+// may request access to. Secrets are obtained by the runner right
+// before a build action is run, meaning they never end up being
+// stored in the Content Addressable Storage.
+type Provider interface {
+	GetSecret(ctx context.Context, name string) ([]byte, error)
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type vaultProvider struct {
+	client     *http.Client
+	secretURL  string
+	vaultToken string
+}
+
+// NewVaultProvider creates a Provider that reads secrets from a single
+// secret stored in HashiCorp Vault's key/value secrets engine (version
+// 2), where the keys of the Vault secret correspond to the names of the
+// secrets exposed by this Provider. The secret is fetched every time,
+// so that changes in Vault are picked up immediately.
+func NewVaultProvider(client *http.Client, address string, secretPath string, vaultToken string) Provider {
+	return &vaultProvider{
+		client:     client,
+		secretURL:  strings.TrimSuffix(address, "/") + "/v1/" + strings.TrimPrefix(secretPath, "/"),
+		vaultToken: vaultToken,
+	}
+}
+
+func (p *vaultProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, p.secretURL, nil)
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to create Vault request")
+	}
+	req.Header.Set("X-Vault-Token", p.vaultToken)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to contact Vault")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Unavailable, "Vault returned HTTP status %#v", resp.Status)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to parse Vault response")
+	}
+	value, ok := body.Data.Data[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Secret %#v does not exist", name)
+	}
+	return []byte(value), nil
+}
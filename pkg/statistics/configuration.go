@@ -0,0 +1,49 @@
+package statistics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/statistics"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NewActionIndexRecorderFromConfiguration wraps an ActionIndexRecorder,
+// so that statistics of recorded actions are exported to the sink
+// specified in the configuration.
+func NewActionIndexRecorderFromConfiguration(base builder.ActionIndexRecorder, config *pb.ExportConfiguration) (builder.ActionIndexRecorder, error) {
+	var sink Sink
+	switch s := config.Sink.(type) {
+	case *pb.ExportConfiguration_CsvFilePath:
+		var err error
+		sink, err = NewCSVFileSink(s.CsvFilePath)
+		if err != nil {
+			return nil, err
+		}
+	case *pb.ExportConfiguration_HttpUrl:
+		sink = NewHTTPSink(&http.Client{Timeout: time.Minute}, s.HttpUrl)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Configuration did not contain a sink")
+	}
+
+	batchSize := 1000
+	if config.BatchSize > 0 {
+		batchSize = int(config.BatchSize)
+	}
+	flushInterval := 10 * time.Second
+	if config.FlushInterval != nil {
+		var err error
+		flushInterval, err = ptypes.Duration(config.FlushInterval)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Invalid flush interval")
+		}
+		if flushInterval <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Flush interval must be positive")
+		}
+	}
+	return NewExportingActionIndexRecorder(base, sink, batchSize, flushInterval), nil
+}
@@ -0,0 +1,58 @@
+package statistics_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/statistics"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/statistics"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewActionIndexRecorderFromConfiguration(t *testing.T) {
+	baseRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+
+	t.Run("CSVFile", func(t *testing.T) {
+		// The CSV file should be created immediately.
+		directory, err := ioutil.TempDir("", "statistics")
+		require.NoError(t, err)
+		defer os.RemoveAll(directory)
+		path := filepath.Join(directory, "statistics.csv")
+
+		_, err = statistics.NewActionIndexRecorderFromConfiguration(baseRecorder, &pb.ExportConfiguration{
+			Sink: &pb.ExportConfiguration_CsvFilePath{CsvFilePath: path},
+		})
+		require.NoError(t, err)
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		_, err := statistics.NewActionIndexRecorderFromConfiguration(baseRecorder, &pb.ExportConfiguration{
+			Sink:          &pb.ExportConfiguration_HttpUrl{HttpUrl: "http://clickhouse:8123/"},
+			BatchSize:     100,
+			FlushInterval: &duration.Duration{Seconds: 5},
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("NoSink", func(t *testing.T) {
+		_, err := statistics.NewActionIndexRecorderFromConfiguration(baseRecorder, &pb.ExportConfiguration{})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Configuration did not contain a sink"), err)
+	})
+
+	t.Run("NegativeFlushInterval", func(t *testing.T) {
+		_, err := statistics.NewActionIndexRecorderFromConfiguration(baseRecorder, &pb.ExportConfiguration{
+			Sink:          &pb.ExportConfiguration_HttpUrl{HttpUrl: "http://clickhouse:8123/"},
+			FlushInterval: &duration.Duration{Seconds: -5},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Flush interval must be positive"), err)
+	})
+}
@@ -0,0 +1,46 @@
+package statistics
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+)
+
+type csvFileSink struct {
+	file *os.File
+}
+
+// NewCSVFileSink creates a Sink that appends records to a CSV file on
+// local disk. A header containing the names of the columns is written
+// if the file is empty.
+func NewCSVFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to open %#v", path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to obtain size of %#v", path)
+	}
+	s := &csvFileSink{file: f}
+	if info.Size() == 0 {
+		if err := s.Write(context.Background(), [][]string{Columns}); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *csvFileSink) Write(ctx context.Context, records [][]string) error {
+	w := csv.NewWriter(s.file)
+	if err := w.WriteAll(records); err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to write records")
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package statistics_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/statistics"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCSVFileSink(t *testing.T) {
+	ctx := context.Background()
+	directory, err := ioutil.TempDir("", "statistics")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "statistics.csv")
+	header := strings.Join(statistics.Columns, ",") + "\n"
+
+	t.Run("NewFile", func(t *testing.T) {
+		// A header should be written to new files.
+		sink, err := statistics.NewCSVFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Write(ctx, [][]string{{"a", "b,c"}}))
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, header+"a,\"b,c\"\n", string(data))
+	})
+
+	t.Run("ExistingFile", func(t *testing.T) {
+		// Records should be appended to existing files,
+		// without repeating the header.
+		sink, err := statistics.NewCSVFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Write(ctx, [][]string{{"d", "e"}, {"f", "g"}}))
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, header+"a,\"b,c\"\nd,e\nf,g\n", string(data))
+	})
+
+	t.Run("OpenFailure", func(t *testing.T) {
+		_, err := statistics.NewCSVFileSink(filepath.Join(directory, "nonexistent", "statistics.csv"))
+		require.Equal(t, codes.Internal, status.Code(err))
+	})
+}
@@ -0,0 +1,132 @@
+package statistics
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	exportingActionIndexRecorderRecordsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "statistics",
+			Name:      "exporting_action_index_recorder_records_total",
+			Help:      "Total number of statistics records processed, by outcome.",
+		},
+		[]string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(exportingActionIndexRecorderRecordsTotal)
+}
+
+type exportingActionIndexRecorder struct {
+	base    builder.ActionIndexRecorder
+	entries chan *actionindex.Entry
+}
+
+// NewExportingActionIndexRecorder is an adapter for
+// ActionIndexRecorder that converts entries to statistics records and
+// writes them to a Sink in batches. As entries are recorded while the
+// scheduler holds its lock, entries are discarded if the sink is not
+// able to keep up, as opposed to blocking.
+func NewExportingActionIndexRecorder(base builder.ActionIndexRecorder, sink Sink, batchSize int, flushInterval time.Duration) builder.ActionIndexRecorder {
+	r := &exportingActionIndexRecorder{
+		base:    base,
+		entries: make(chan *actionindex.Entry, 10*batchSize),
+	}
+	go r.export(sink, batchSize, flushInterval)
+	return r
+}
+
+func (r *exportingActionIndexRecorder) Record(entry *actionindex.Entry) {
+	r.base.Record(entry)
+	select {
+	case r.entries <- entry:
+	default:
+		exportingActionIndexRecorderRecordsTotal.WithLabelValues("Discarded").Inc()
+	}
+}
+
+func (r *exportingActionIndexRecorder) export(sink Sink, batchSize int, flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	var records [][]string
+	for {
+		select {
+		case entry := <-r.entries:
+			records = append(records, getRecord(entry))
+			if len(records) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(records) == 0 {
+				continue
+			}
+		}
+		if err := sink.Write(context.Background(), records); err != nil {
+			logrus.WithError(err).Warn("Failed to export statistics records")
+			exportingActionIndexRecorderRecordsTotal.WithLabelValues("Failed").Add(float64(len(records)))
+		} else {
+			exportingActionIndexRecorderRecordsTotal.WithLabelValues("Exported").Add(float64(len(records)))
+		}
+		records = nil
+	}
+}
+
+// getRecord converts an action index entry to a record containing the
+// fields listed in Columns.
+func getRecord(entry *actionindex.Entry) []string {
+	requestMetadata := entry.RequestMetadata
+	var toolName string
+	if toolDetails := requestMetadata.GetToolDetails(); toolDetails != nil {
+		toolName = toolDetails.ToolName
+	}
+	var completedTimestamp string
+	if completed, err := ptypes.Timestamp(entry.CompletedTimestamp); err == nil {
+		completedTimestamp = completed.UTC().Format(time.RFC3339Nano)
+	}
+	return []string{
+		completedTimestamp,
+		entry.InstanceName,
+		entry.ActionDigest.GetHash(),
+		strconv.FormatInt(entry.ActionDigest.GetSizeBytes(), 10),
+		entry.OperationName,
+		toolName,
+		requestMetadata.GetToolInvocationId(),
+		requestMetadata.GetCorrelatedInvocationsId(),
+		requestMetadata.GetActionId(),
+		strconv.FormatBool(entry.CachedResult),
+		entry.WorkerId,
+		strconv.FormatInt(int64(entry.ExitCode), 10),
+		codes.Code(entry.Status.GetCode()).String(),
+		getDurationSeconds(entry.QueuedTimestamp, entry.DispatchedTimestamp),
+		getDurationSeconds(entry.DispatchedTimestamp, entry.CompletedTimestamp),
+	}
+}
+
+// getDurationSeconds returns the amount of time between two points in
+// time in seconds, or an empty string if either is unknown.
+func getDurationSeconds(start *timestamp.Timestamp, end *timestamp.Timestamp) string {
+	if start == nil || end == nil {
+		return ""
+	}
+	startTime, err := ptypes.Timestamp(start)
+	if err != nil {
+		return ""
+	}
+	endTime, err := ptypes.Timestamp(end)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatFloat(endTime.Sub(startTime).Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,132 @@
+package statistics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/actionindex"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/statistics"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/stretchr/testify/require"
+
+	status_pb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestExportingActionIndexRecorder(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	entry := &actionindex.Entry{
+		InstanceName: "debian8",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+		OperationName: "operation1",
+		RequestMetadata: &remoteexecution.RequestMetadata{
+			ToolDetails:             &remoteexecution.ToolDetails{ToolName: "bazel"},
+			ToolInvocationId:        "invocation1",
+			CorrelatedInvocationsId: "build1",
+			ActionId:                "action1",
+		},
+		ExitCode:            1,
+		Status:              &status_pb.Status{Code: int32(codes.DeadlineExceeded)},
+		QueuedTimestamp:     &timestamp.Timestamp{Seconds: 1000},
+		DispatchedTimestamp: &timestamp.Timestamp{Seconds: 1002, Nanos: 500000000},
+		CompletedTimestamp:  &timestamp.Timestamp{Seconds: 1012},
+		WorkerId:            "worker1",
+	}
+	record := []string{
+		"1970-01-01T00:16:52Z",
+		"debian8",
+		"64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+		"11",
+		"operation1",
+		"bazel",
+		"invocation1",
+		"build1",
+		"action1",
+		"false",
+		"worker1",
+		"1",
+		"DeadlineExceeded",
+		"2.500",
+		"9.500",
+	}
+	cachedEntry := &actionindex.Entry{
+		InstanceName:       "debian8",
+		CachedResult:       true,
+		CompletedTimestamp: &timestamp.Timestamp{Seconds: 1013},
+	}
+	cachedRecord := []string{
+		"1970-01-01T00:16:53Z",
+		"debian8",
+		"",
+		"0",
+		"",
+		"",
+		"",
+		"",
+		"",
+		"true",
+		"",
+		"0",
+		"OK",
+		"",
+		"",
+	}
+
+	t.Run("BatchSize", func(t *testing.T) {
+		// Records should be written once a batch is full.
+		// Entries should also be forwarded to the base
+		// recorder.
+		baseRecorder, actionIndexServer := builder.NewInMemoryActionIndex(10, 10)
+		sink := mock.NewMockSink(ctrl)
+		writes := make(chan [][]string, 1)
+		sink.EXPECT().Write(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, records [][]string) error {
+			writes <- records
+			return nil
+		})
+		recorder := statistics.NewExportingActionIndexRecorder(baseRecorder, sink, 2, time.Hour)
+
+		recorder.Record(entry)
+		recorder.Record(cachedEntry)
+		require.Equal(t, [][]string{record, cachedRecord}, <-writes)
+		require.Len(t, statistics.Columns, len(record))
+
+		response, err := actionIndexServer.Search(ctx, &actionindex.SearchRequest{})
+		require.NoError(t, err)
+		require.Len(t, response.Entries, 2)
+	})
+
+	t.Run("FlushInterval", func(t *testing.T) {
+		// Partial batches should be written periodically.
+		// Failures should not prevent successive batches from
+		// being written.
+		baseRecorder, _ := builder.NewInMemoryActionIndex(10, 10)
+		sink := mock.NewMockSink(ctrl)
+		writes := make(chan [][]string, 2)
+		gomock.InOrder(
+			sink.EXPECT().Write(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, records [][]string) error {
+				writes <- records
+				return status.Error(codes.Unavailable, "Server offline")
+			}),
+			sink.EXPECT().Write(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, records [][]string) error {
+				writes <- records
+				return nil
+			}))
+		recorder := statistics.NewExportingActionIndexRecorder(baseRecorder, sink, 100, 10*time.Millisecond)
+
+		recorder.Record(entry)
+		require.Equal(t, [][]string{record}, <-writes)
+		recorder.Record(cachedEntry)
+		require.Equal(t, [][]string{cachedRecord}, <-writes)
+	})
+}
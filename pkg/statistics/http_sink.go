@@ -0,0 +1,54 @@
+package statistics
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type httpSink struct {
+	client *http.Client
+	url    string
+}
+
+// NewHTTPSink creates a Sink that sends batches of records to an HTTP
+// endpoint as the body of a POST request, encoded as CSV without a
+// header. This format is accepted by ClickHouse's HTTP interface, but
+// may also be used to forward records to a custom collector (e.g., one
+// that stores records in BigQuery).
+func NewHTTPSink(client *http.Client, url string) Sink {
+	return &httpSink{
+		client: client,
+		url:    url,
+	}
+}
+
+func (s *httpSink) Write(ctx context.Context, records [][]string) error {
+	var body bytes.Buffer
+	if err := csv.NewWriter(&body).WriteAll(records); err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to encode records")
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, &body)
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to create request")
+	}
+	req.Header.Set("Content-Type", "text/csv")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to send records")
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return status.Errorf(codes.Unavailable, "Sending records failed with HTTP status %#v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package statistics_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/statistics"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHTTPSink(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Success", func(t *testing.T) {
+		// Records should be sent as CSV without a header.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodPost, r.Method)
+			require.Equal(t, "/?query=INSERT", r.URL.RequestURI())
+			require.Equal(t, "text/csv", r.Header.Get("Content-Type"))
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, "a,b\nc,d\n", string(body))
+		}))
+		defer server.Close()
+
+		sink := statistics.NewHTTPSink(server.Client(), server.URL+"/?query=INSERT")
+		require.NoError(t, sink.Write(ctx, [][]string{{"a", "b"}, {"c", "d"}}))
+	})
+
+	t.Run("HTTPFailure", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Table does not exist", http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		sink := statistics.NewHTTPSink(server.Client(), server.URL)
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Sending records failed with HTTP status \"500 Internal Server Error\""),
+			sink.Write(ctx, [][]string{{"a", "b"}}))
+	})
+
+	t.Run("ConnectionFailure", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		sink := statistics.NewHTTPSink(server.Client(), server.URL)
+		require.Equal(t, codes.Unavailable, status.Code(sink.Write(ctx, [][]string{{"a", "b"}})))
+	})
+}
@@ -0,0 +1,32 @@
+package statistics
+
+import (
+	"context"
+)
+
+// Columns contains the names of the fields of the records that are
+// written to a Sink, in the order in which they appear.
+var Columns = []string{
+	"completed_timestamp",
+	"instance_name",
+	"action_digest_hash",
+	"action_digest_size_bytes",
+	"operation_name",
+	"tool_name",
+	"tool_invocation_id",
+	"correlated_invocations_id",
+	"action_id",
+	"cached_result",
+	"worker_id",
+	"exit_code",
+	"status_code",
+	"queued_duration_seconds",
+	"execution_duration_seconds",
+}
+
+// Sink of statistics records, each corresponding to a single action
+// that was executed or whose result was obtained from the Action
+// Cache. Records contain the fields listed in Columns.
+type Sink interface {
+	Write(ctx context.Context, records [][]string) error
+}
@@ -0,0 +1,117 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+
+	"google.golang.org/grpc"
+)
+
+// Configure enables the export of trace spans to an OpenTelemetry
+// collector over OTLP/gRPC. Spans are sampled with the provided
+// probability, unless a remote parent span has already been sampled.
+// If no collector endpoint is provided, no new traces are started, but
+// trace contexts are still propagated in the W3C Trace Context format,
+// so that traces remain intact across processes.
+func Configure(serviceName string, otlpEndpoint string, samplingProbability float64) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if otlpEndpoint == "" {
+		return nil
+	}
+	exporter, err := otlptracegrpc.New(
+		context.Background(),
+		otlptracegrpc.WithEndpoint(otlpEndpoint),
+		otlptracegrpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingProbability))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName)))))
+	return nil
+}
+
+// NewServerOptions returns options for gRPC servers that create a span
+// for every incoming request, using the trace context propagated by the
+// client through request metadata. The provided interceptors, which may
+// be nil, are called within the scope of the span.
+func NewServerOptions(unaryInterceptor grpc.UnaryServerInterceptor, streamInterceptor grpc.StreamServerInterceptor) []grpc.ServerOption {
+	tracingUnaryInterceptor := otelgrpc.UnaryServerInterceptor()
+	tracingStreamInterceptor := otelgrpc.StreamServerInterceptor()
+	outerUnaryInterceptor := tracingUnaryInterceptor
+	if unaryInterceptor != nil {
+		outerUnaryInterceptor = func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return tracingUnaryInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return unaryInterceptor(ctx, req, info, handler)
+			})
+		}
+	}
+	outerStreamInterceptor := tracingStreamInterceptor
+	if streamInterceptor != nil {
+		outerStreamInterceptor = func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return tracingStreamInterceptor(srv, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+				return streamInterceptor(srv, ss, info, handler)
+			})
+		}
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(outerUnaryInterceptor),
+		grpc.StreamInterceptor(outerStreamInterceptor),
+	}
+}
+
+// NewDialOptions returns options for gRPC clients that create a span
+// for every outgoing request and propagate its trace context to the
+// server through request metadata. The provided interceptors, which may
+// be nil, are called within the scope of the span.
+func NewDialOptions(unaryInterceptor grpc.UnaryClientInterceptor, streamInterceptor grpc.StreamClientInterceptor) []grpc.DialOption {
+	tracingUnaryInterceptor := otelgrpc.UnaryClientInterceptor()
+	tracingStreamInterceptor := otelgrpc.StreamClientInterceptor()
+	outerUnaryInterceptor := tracingUnaryInterceptor
+	if unaryInterceptor != nil {
+		outerUnaryInterceptor = func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return tracingUnaryInterceptor(ctx, method, req, reply, cc, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return unaryInterceptor(ctx, method, req, reply, cc, invoker, opts...)
+			}, opts...)
+		}
+	}
+	outerStreamInterceptor := tracingStreamInterceptor
+	if streamInterceptor != nil {
+		outerStreamInterceptor = func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return tracingStreamInterceptor(ctx, desc, cc, method, func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return streamInterceptor(ctx, desc, cc, method, streamer, opts...)
+			}, opts...)
+		}
+	}
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(outerUnaryInterceptor),
+		grpc.WithStreamInterceptor(outerStreamInterceptor),
+	}
+}
+
+// InjectTraceContext stores the trace context of the span associated
+// with a context in a map, allowing it to be propagated through
+// messages, as opposed to request metadata.
+func InjectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// ExtractTraceContext returns a context that has a trace context
+// attached to it that was previously stored in a map by
+// InjectTraceContext(), causing spans created from it to become part of
+// the same trace.
+func ExtractTraceContext(ctx context.Context, traceContext map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(traceContext))
+}
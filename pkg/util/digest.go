@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"hash"
 	"log"
+	"strconv"
+	"strings"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 
@@ -80,9 +82,14 @@ func MustNewDigest(instance string, partialDigest *remoteexecution.Digest) *Dige
 // name as the one from which it is derived. This can be used to refer
 // to inputs (command, directories, files) of an action.
 func (d *Digest) NewDerivedDigest(partialDigest *remoteexecution.Digest) (*Digest, error) {
-	// TODO(edsch): Check whether the resulting digest uses the same
-	// hashing algorithm?
-	return NewDigest(d.instance, partialDigest)
+	derivedDigest, err := NewDigest(d.instance, partialDigest)
+	if err != nil {
+		return nil, err
+	}
+	if derivedDigest.GetDigestFunction() != d.GetDigestFunction() {
+		return nil, status.Errorf(codes.InvalidArgument, "Digest uses hashing algorithm %s, while its parent uses %s", derivedDigest.GetDigestFunction(), d.GetDigestFunction())
+	}
+	return derivedDigest, nil
 }
 
 // GetPartialDigest encodes the digest into the format used by the remote
@@ -116,6 +123,24 @@ func (d *Digest) GetSizeBytes() int64 {
 	return d.partialDigest.SizeBytes
 }
 
+// GetDigestFunction returns the hashing algorithm that was used to
+// compute the digest. As the remote execution protocol does not
+// transmit the hashing algorithm as part of digests, it is derived from
+// the length of the hash.
+func (d *Digest) GetDigestFunction() remoteexecution.DigestFunction {
+	switch len(d.partialDigest.Hash) {
+	case md5.Size * 2:
+		return remoteexecution.DigestFunction_MD5
+	case sha1.Size * 2:
+		return remoteexecution.DigestFunction_SHA1
+	case sha256.Size * 2:
+		return remoteexecution.DigestFunction_SHA256
+	default:
+		log.Fatal("Digest hash is of unknown type")
+		return remoteexecution.DigestFunction_UNKNOWN
+	}
+}
+
 // DigestKeyFormat is an enumeration type that determines the format of
 // object keys returned by Digest.GetKey().
 type DigestKeyFormat int
@@ -128,8 +153,46 @@ const (
 	// DigestKeyWithInstance lets Digest.GetKey() return a key
 	// that includes the hash, size and instance name.
 	DigestKeyWithInstance
+	// DigestKeyWithoutInstanceHashed is identical to
+	// DigestKeyWithoutInstance, except that keys are hashed into a
+	// fixed-length binary string. This reduces the amount of memory
+	// used by storage backends that hold keys in memory, at the cost
+	// of no longer being able to convert keys back to digests.
+	DigestKeyWithoutInstanceHashed
+	// DigestKeyWithInstanceHashed is identical to
+	// DigestKeyWithInstance, except that keys are hashed into a
+	// fixed-length binary string.
+	DigestKeyWithInstanceHashed
 )
 
+// NewDigestKeyFormat returns the digest key format that either includes
+// or excludes the instance name, optionally hashing keys.
+func NewDigestKeyFormat(includeInstance bool, hashed bool) DigestKeyFormat {
+	if includeInstance {
+		if hashed {
+			return DigestKeyWithInstanceHashed
+		}
+		return DigestKeyWithInstance
+	}
+	if hashed {
+		return DigestKeyWithoutInstanceHashed
+	}
+	return DigestKeyWithoutInstance
+}
+
+// IncludesInstance returns whether keys of this format include the
+// instance name. Digests with different instance names but identical
+// hashes and sizes map to the same key if this returns false.
+func (f DigestKeyFormat) IncludesInstance() bool {
+	return f == DigestKeyWithInstance || f == DigestKeyWithInstanceHashed
+}
+
+// IsHashed returns whether keys of this format are hashed into a
+// fixed-length binary string.
+func (f DigestKeyFormat) IsHashed() bool {
+	return f == DigestKeyWithoutInstanceHashed || f == DigestKeyWithInstanceHashed
+}
+
 // GetKey generates a string representation of the digest object that
 // may be used as keys in hash tables.
 func (d *Digest) GetKey(format DigestKeyFormat) string {
@@ -138,12 +201,52 @@ func (d *Digest) GetKey(format DigestKeyFormat) string {
 		return fmt.Sprintf("%s-%d", d.partialDigest.Hash, d.partialDigest.SizeBytes)
 	case DigestKeyWithInstance:
 		return fmt.Sprintf("%s-%d-%s", d.partialDigest.Hash, d.partialDigest.SizeBytes, d.instance)
+	case DigestKeyWithoutInstanceHashed:
+		h := sha256.Sum256([]byte(d.GetKey(DigestKeyWithoutInstance)))
+		return string(h[:])
+	case DigestKeyWithInstanceHashed:
+		h := sha256.Sum256([]byte(d.GetKey(DigestKeyWithInstance)))
+		return string(h[:])
 	default:
 		log.Fatal("Invalid digest key format")
 		return ""
 	}
 }
 
+// NewDigestFromKey is the inverse of Digest.GetKey(). It parses a key
+// in the provided format back into a Digest. This is used by
+// components that enumerate the contents of a storage backend, such as
+// the garbage collector.
+func NewDigestFromKey(key string, format DigestKeyFormat) (*Digest, error) {
+	var fields []string
+	var instance string
+	switch format {
+	case DigestKeyWithoutInstance:
+		fields = strings.SplitN(key, "-", 2)
+		if len(fields) != 2 {
+			return nil, status.Errorf(codes.InvalidArgument, "Key %#v does not consist of a hash and size", key)
+		}
+	case DigestKeyWithInstance:
+		fields = strings.SplitN(key, "-", 3)
+		if len(fields) != 3 {
+			return nil, status.Errorf(codes.InvalidArgument, "Key %#v does not consist of a hash, size and instance", key)
+		}
+		instance = fields[2]
+	case DigestKeyWithoutInstanceHashed, DigestKeyWithInstanceHashed:
+		return nil, status.Error(codes.Unimplemented, "Hashed keys cannot be converted back to digests")
+	default:
+		log.Fatal("Invalid digest key format")
+	}
+	sizeBytes, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, StatusWrapWithCode(err, codes.InvalidArgument, "Invalid size in key")
+	}
+	return NewDigest(instance, &remoteexecution.Digest{
+		Hash:      fields[0],
+		SizeBytes: sizeBytes,
+	})
+}
+
 func (d *Digest) String() string {
 	return d.GetKey(DigestKeyWithInstance)
 }
@@ -153,16 +256,13 @@ func (d *Digest) String() string {
 // algorithm as the one that was used to create the digest, making it
 // possible to validate data against a digest.
 func (d *Digest) NewHasher() hash.Hash {
-	switch len(d.partialDigest.Hash) {
-	case md5.Size * 2:
+	switch d.GetDigestFunction() {
+	case remoteexecution.DigestFunction_MD5:
 		return md5.New()
-	case sha1.Size * 2:
+	case remoteexecution.DigestFunction_SHA1:
 		return sha1.New()
-	case sha256.Size * 2:
-		return sha256.New()
 	default:
-		log.Fatal("Digest hash is of unknown type")
-		return nil
+		return sha256.New()
 	}
 }
 
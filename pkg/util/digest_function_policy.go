@@ -0,0 +1,91 @@
+package util
+
+import (
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SupportedDigestFunctions contains the hashing algorithms that can be
+// used to construct Digest objects. Newer algorithms such as BLAKE3 and
+// SHA256TREE cannot be listed here, as they are not part of the version
+// of the remote execution protocol that is currently used.
+var SupportedDigestFunctions = []remoteexecution.DigestFunction{
+	remoteexecution.DigestFunction_SHA256,
+	remoteexecution.DigestFunction_SHA1,
+	remoteexecution.DigestFunction_MD5,
+}
+
+// DigestFunctionPolicy determines which hashing algorithms clients may
+// use on a per instance name basis. This makes it possible to let one
+// instance name be used by Bazel with SHA-256, while another instance
+// name is used by clients that require another algorithm.
+type DigestFunctionPolicy struct {
+	defaultDigestFunctions     []remoteexecution.DigestFunction
+	perInstanceDigestFunctions map[string][]remoteexecution.DigestFunction
+}
+
+// NewDigestFunctionPolicy creates a DigestFunctionPolicy. Instance
+// names that are not present in perInstanceDigestFunctions use the
+// default set of hashing algorithms. If the default set is empty, all
+// supported hashing algorithms are permitted. The first hashing
+// algorithm in every list is the preferred one, which is announced to
+// clients as the one to use for remote execution.
+func NewDigestFunctionPolicy(defaultDigestFunctions []remoteexecution.DigestFunction, perInstanceDigestFunctions map[string][]remoteexecution.DigestFunction) (*DigestFunctionPolicy, error) {
+	if len(defaultDigestFunctions) == 0 {
+		defaultDigestFunctions = SupportedDigestFunctions
+	}
+	if err := validateDigestFunctions(defaultDigestFunctions); err != nil {
+		return nil, StatusWrap(err, "Invalid default digest functions")
+	}
+	for instance, digestFunctions := range perInstanceDigestFunctions {
+		if len(digestFunctions) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "No digest functions provided for instance %#v", instance)
+		}
+		if err := validateDigestFunctions(digestFunctions); err != nil {
+			return nil, StatusWrapf(err, "Invalid digest functions for instance %#v", instance)
+		}
+	}
+	return &DigestFunctionPolicy{
+		defaultDigestFunctions:     defaultDigestFunctions,
+		perInstanceDigestFunctions: perInstanceDigestFunctions,
+	}, nil
+}
+
+func validateDigestFunctions(digestFunctions []remoteexecution.DigestFunction) error {
+	for _, digestFunction := range digestFunctions {
+		supported := false
+		for _, supportedDigestFunction := range SupportedDigestFunctions {
+			if digestFunction == supportedDigestFunction {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return status.Errorf(codes.Unimplemented, "Digest function %s is not supported", digestFunction)
+		}
+	}
+	return nil
+}
+
+// GetDigestFunctions returns the hashing algorithms that may be used
+// in combination with an instance name, preferred algorithm first.
+func (p *DigestFunctionPolicy) GetDigestFunctions(instance string) []remoteexecution.DigestFunction {
+	if digestFunctions, ok := p.perInstanceDigestFunctions[instance]; ok {
+		return digestFunctions
+	}
+	return p.defaultDigestFunctions
+}
+
+// ValidateDigest returns an error if a digest was computed using a
+// hashing algorithm that is not permitted for its instance name.
+func (p *DigestFunctionPolicy) ValidateDigest(digest *Digest) error {
+	digestFunction := digest.GetDigestFunction()
+	for _, allowedDigestFunction := range p.GetDigestFunctions(digest.GetInstance()) {
+		if digestFunction == allowedDigestFunction {
+			return nil
+		}
+	}
+	return status.Errorf(codes.InvalidArgument, "Digest function %s is not permitted for instance %#v", digestFunction, digest.GetInstance())
+}
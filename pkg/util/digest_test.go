@@ -0,0 +1,82 @@
+package util_test
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewDigestKeyFormat(t *testing.T) {
+	for _, format := range []struct {
+		includeInstance bool
+		hashed          bool
+		expected        util.DigestKeyFormat
+	}{
+		{false, false, util.DigestKeyWithoutInstance},
+		{true, false, util.DigestKeyWithInstance},
+		{false, true, util.DigestKeyWithoutInstanceHashed},
+		{true, true, util.DigestKeyWithInstanceHashed},
+	} {
+		digestKeyFormat := util.NewDigestKeyFormat(format.includeInstance, format.hashed)
+		require.Equal(t, format.expected, digestKeyFormat)
+		require.Equal(t, format.includeInstance, digestKeyFormat.IncludesInstance())
+		require.Equal(t, format.hashed, digestKeyFormat.IsHashed())
+	}
+}
+
+func TestDigestGetKey(t *testing.T) {
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("Plain", func(t *testing.T) {
+		require.Equal(t, "8b1a9953c4611296a827abf8c47804d7-5", digest.GetKey(util.DigestKeyWithoutInstance))
+		require.Equal(t, "8b1a9953c4611296a827abf8c47804d7-5-debian8", digest.GetKey(util.DigestKeyWithInstance))
+	})
+
+	t.Run("Hashed", func(t *testing.T) {
+		// Hashed keys should be the SHA-256 sum of the keys in
+		// their plain format.
+		withoutInstance := sha256.Sum256([]byte("8b1a9953c4611296a827abf8c47804d7-5"))
+		require.Equal(t, string(withoutInstance[:]), digest.GetKey(util.DigestKeyWithoutInstanceHashed))
+		withInstance := sha256.Sum256([]byte("8b1a9953c4611296a827abf8c47804d7-5-debian8"))
+		require.Equal(t, string(withInstance[:]), digest.GetKey(util.DigestKeyWithInstanceHashed))
+
+		// Only the latter should depend on the instance name.
+		otherInstance := util.MustNewDigest("ubuntu16-04", digest.GetPartialDigest())
+		require.Equal(t, digest.GetKey(util.DigestKeyWithoutInstanceHashed), otherInstance.GetKey(util.DigestKeyWithoutInstanceHashed))
+		require.NotEqual(t, digest.GetKey(util.DigestKeyWithInstanceHashed), otherInstance.GetKey(util.DigestKeyWithInstanceHashed))
+	})
+}
+
+func TestNewDigestFromKey(t *testing.T) {
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("WithoutInstance", func(t *testing.T) {
+		parsed, err := util.NewDigestFromKey(digest.GetKey(util.DigestKeyWithoutInstance), util.DigestKeyWithoutInstance)
+		require.NoError(t, err)
+		require.Equal(t, "8b1a9953c4611296a827abf8c47804d7-5-", parsed.GetKey(util.DigestKeyWithInstance))
+	})
+
+	t.Run("WithInstance", func(t *testing.T) {
+		parsed, err := util.NewDigestFromKey(digest.GetKey(util.DigestKeyWithInstance), util.DigestKeyWithInstance)
+		require.NoError(t, err)
+		require.Equal(t, digest.GetKey(util.DigestKeyWithInstance), parsed.GetKey(util.DigestKeyWithInstance))
+	})
+
+	t.Run("Hashed", func(t *testing.T) {
+		// Hashed keys cannot be converted back.
+		_, err := util.NewDigestFromKey(digest.GetKey(util.DigestKeyWithInstanceHashed), util.DigestKeyWithInstanceHashed)
+		require.Equal(t, status.Error(codes.Unimplemented, "Hashed keys cannot be converted back to digests"), err)
+	})
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FaultInjector can be used by decorators to artificially delay and
+// fail a fraction of all operations. This is useful for soak testing
+// a deployment, validating that retries and failover work as intended.
+type FaultInjector struct {
+	errorProbability float64
+	maximumDelay     time.Duration
+}
+
+// NewFaultInjector creates a FaultInjector that delays every operation
+// by a random duration in [0, maximumDelay] and subsequently fails it
+// with UNAVAILABLE with the provided probability.
+func NewFaultInjector(errorProbability float64, maximumDelay time.Duration) *FaultInjector {
+	return &FaultInjector{
+		errorProbability: errorProbability,
+		maximumDelay:     maximumDelay,
+	}
+}
+
+// Inject a delay and possibly an error into an operation. The name of
+// the operation is included in the error message, so that injected
+// failures can be distinguished from genuine ones.
+func (fi *FaultInjector) Inject(ctx context.Context, operation string) error {
+	if fi.maximumDelay > 0 {
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(fi.maximumDelay) + 1)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if fi.errorProbability > 0 && rand.Float64() < fi.errorProbability {
+		return status.Errorf(codes.Unavailable, "Injected fault for operation %#v", operation)
+	}
+	return nil
+}
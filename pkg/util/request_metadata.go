@@ -0,0 +1,48 @@
+package util
+
+import (
+	"context"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// requestMetadataHeader is the name of the GRPC header through which
+// clients provide a RequestMetadata message.
+const requestMetadataHeader = "build.bazel.remote.execution.v2.requestmetadata-bin"
+
+// GetRequestMetadata extracts the RequestMetadata message that the
+// client attached to an incoming GRPC request. It returns nil if no
+// valid message is present.
+func GetRequestMetadata(ctx context.Context) *remoteexecution.RequestMetadata {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	values := md.Get(requestMetadataHeader)
+	if len(values) == 0 {
+		return nil
+	}
+	var requestMetadata remoteexecution.RequestMetadata
+	if err := proto.Unmarshal([]byte(values[0]), &requestMetadata); err != nil {
+		return nil
+	}
+	return &requestMetadata
+}
+
+// ForwardRequestMetadata copies the RequestMetadata header of an
+// incoming GRPC request to the outgoing context, so that it is
+// provided to backends as well.
+func ForwardRequestMetadata(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	values := md.Get(requestMetadataHeader)
+	if len(values) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, requestMetadataHeader, values[0])
+}
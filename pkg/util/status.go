@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"fmt"
 
 	"google.golang.org/grpc/codes"
@@ -33,3 +34,29 @@ func StatusWrapWithCode(err error, code codes.Code, msg string) error {
 func StatusWrapfWithCode(err error, code codes.Code, format string, args ...interface{}) error {
 	return StatusWrapWithCode(err, code, fmt.Sprintf(format, args...))
 }
+
+// StatusWrapWithDigest prepends the name of an operation, the digest
+// of the object on which it was performed and the name of the storage
+// backend to the message of an existing error. This makes errors that
+// are logged far from where they occurred (e.g., "context deadline
+// exceeded") actionable.
+func StatusWrapWithDigest(err error, operation string, digest *Digest, backend string) error {
+	return StatusWrapf(err, "%s %s on backend %#v", operation, digest, backend)
+}
+
+// StatusFromContext converts the error associated with a context that
+// has been cancelled or whose deadline has been exceeded to a gRPC
+// status error, so that it is propagated to clients with the right
+// code.
+func StatusFromContext(ctx context.Context) error {
+	switch err := ctx.Err(); err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case nil:
+		return nil
+	default:
+		return status.Error(codes.Unknown, err.Error())
+	}
+}